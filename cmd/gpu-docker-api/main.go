@@ -5,8 +5,10 @@ import (
 	goflag "flag"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/judwhite/go-svc"
@@ -15,8 +17,11 @@ import (
 
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/projection"
 	"github.com/mayooot/gpu-docker-api/internal/routers"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
 	"github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/utils"
@@ -35,11 +40,56 @@ var (
 	etcdAddr  = flag.StringP("etcd", "e", "0.0.0.0:2379", "Address of etcd server, format: ip:port")
 	portRange = flag.StringP("portRange", "p", "40000-65535", "Port range of docker container, format: startPort-endPort")
 	logLevel  = flag.StringP("logLevel", "l", "debug", "Log level, optional: release")
+
+	volumeGcInterval  = flag.Duration("volumeGcInterval", time.Hour, "Interval of pruning volume versions according to the retention policy")
+	helperImage       = flag.String("helperImage", "busybox:latest", "Image of the helper container that used to copy data between volumes")
+	copyMaxAttempts   = flag.Int("copyMaxAttempts", 3, "Max attempts of copying data from the old version to the new version")
+	copyRetryBackoff  = flag.Duration("copyRetryBackoff", time.Second, "Wait time before the first retry of copying data, it doubles after each retry")
+	copyConcurrency   = flag.Int("copyConcurrency", 0, "Max number of copies of data running at the same time, the others are queued, 0 means unlimited")
+	copyWithCp        = flag.Bool("copyWithCp", false, "Copy the merged layers with cp instead of the native copy, it will be removed in the next release")
+	mpsPipeDir        = flag.String("mpsPipeDir", "/tmp/nvidia-mps", "Root directory of the pipe directories of the MPS daemons, one sub directory per gpu")
+	mpsLogDir         = flag.String("mpsLogDir", "/var/log/nvidia-mps", "Root directory of the log directories of the MPS daemons, one sub directory per gpu")
+	externalScheduler = flag.String("externalScheduler", "", "URL of the external scheduler which decides the gpus of a new container, empty means the built-in allocator")
+	enableProjection  = flag.Bool("projection", false, "Mirror the container and volume records of etcd into a queryable store for dashboards")
+	projectionDriver  = flag.String("projectionDriver", projection.DriverSQLite, "Database of the projection, optional: sqlite, postgres")
+	projectionDSN     = flag.String("projectionDSN", "projection.db", "Data source of the projection, the database file of sqlite or the connection string of postgres")
+	gpuSlots          = flag.Int("gpuSlots", 1, "Number of slots the capacity of a gpu is divided into, e.g. 2 allows requesting half of a gpu")
+	scalingInterval   = flag.Duration("scalingInterval", 30*time.Second, "Interval of adjusting the replicas of scaling groups according to gpu utilization")
+	mpsCheckInterval  = flag.Duration("mpsCheckInterval", 30*time.Second, "Interval of checking whether the MPS daemons are alive")
+	allowProfiler     = flag.Bool("allowProfiler", false, "Allow running privileged profiler containers in the pid namespace of the managed containers")
+	maxContainers     = flag.Int("maxContainers", 0, "Max number of managed running containers on the host, 0 means unlimited")
+	encryptionDir     = flag.String("encryptionDir", "/var/lib/gpu-docker-api/encrypted", "Root directory of the encrypted filesystems of volumes")
+	secretDir         = flag.String("secretDir", "", "Directory where the secret store renders the keys of encrypted volumes, empty means encryption is disabled")
+	checkpointDir     = flag.String("checkpointDir", "/var/lib/gpu-docker-api/checkpoints", "Root directory of the checkpoints of containers")
+	cudaCheckpoint    = flag.Bool("cudaCheckpoint", false, "Whether cuda-checkpoint is installed, so that the containers using gpus can be checkpointed")
+	gpuConflicts      = flag.StringSlice("gpuConflicts", nil, "Pairs of anti-co-location labels that can't share a gpu, e.g. inference:batch")
+	archiveDir        = flag.String("archiveDir", "/var/lib/gpu-docker-api/archive", "Directory of the logs exported by soft deleting containers")
+	archiveRetention  = flag.Duration("archiveRetention", 72*time.Hour, "How long a soft deleted container is kept before it's removed")
+	archiveGcInterval = flag.Duration("archiveGcInterval", time.Hour, "Interval of removing the soft deleted containers whose retention expired, with their archive images and logs")
+	terminalOrigins   = flag.StringSlice("terminalOrigins", nil, "Origins allowed to open the terminal websocket besides the same origin, e.g. https://dashboard.example.com")
+	gpuRuntimes       = flag.StringSlice("gpuRuntimes", []string{"runc", "nvidia"}, "Runtimes that can run the containers requesting gpus")
+	reserveGcInterval = flag.Duration("reserveGcInterval", time.Minute, "Interval of reclaiming the gpus of the expired reservations")
+	workQueueSize     = flag.Int("workQueueSize", workQueue.DefaultSize, "Capacity of the queue of the etcd writes, the writes wait for a place or the requests are rejected when it's full")
+	registryAuthFile  = flag.String("registryAuthFile", "", "Credential file of the private registries in the format of docker config.json, empty means pulling anonymously")
+	defaultShmSize    = flag.String("defaultShmSize", "1GB", "Size of /dev/shm of the containers using gpus if it's not requested, empty means the 64MB of docker")
+	dockerTimeout     = flag.Duration("dockerTimeout", 2*time.Minute, "Timeout of the docker calls of a request, the pull of images, the copy of data and the health check are not included, 0 means no timeout")
+	execTimeout       = flag.Duration("execTimeout", 10*time.Minute, "Timeout of the output of a command executed in a container, the streamed ones are not included, 0 means no timeout")
+	reconcilePrune    = flag.Bool("reconcilePrune", false, "Delete the replicaSets and volumes recorded in etcd at startup if none of their versions exists in docker")
+	reconcileImport   = flag.Bool("reconcileImport", false, "Record the containers and volumes named like a version, e.g. foo-1, in etcd at startup if they are not recorded")
+	portCheckInterval = flag.Duration("portCheckInterval", 5*time.Minute, "Interval of updating the host ports recorded in etcd to the live bindings")
+	frameworkEnv      = flag.StringToString("frameworkEnv", map[string]string{
+		"jax":        "XLA_PYTHON_CLIENT_MEM_FRACTION={fraction}",
+		"tensorflow": "TF_FORCE_GPU_ALLOW_GROWTH=true;TF_DEVICE_MIN_SYS_MEMORY_IN_MB={reservedMB}",
+		"pytorch":    "PYTORCH_CUDA_ALLOC_CONF=garbage_collection_threshold:{fraction}",
+		"mps":        "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE={percent};CUDA_MPS_PINNED_DEVICE_MEM_LIMIT=0={memoryMB}M",
+	}, "Envs injected for a fractional gpu or a MPS client by framework, separated by ';', the envs of mps are injected into every MPS client with max sharers, "+
+		"{fraction} and {percent} are replaced with the share of the gpu, {memoryMB} and {reservedMB} with the memory of the share and the rest of the gpu")
 )
 
 type program struct {
-	ctx context.Context
-	wg  sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func main() {
@@ -53,9 +103,23 @@ func main() {
 func (p *program) Init(svc.Environment) (err error) {
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	flag.Parse()
-	p.ctx = context.Background()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	log.SetLevelByString(*logLevel)
 
+	// the loops tick by the intervals, a ticker can't tick by an interval not greater than 0
+	for name, interval := range map[string]time.Duration{
+		"volumeGcInterval":  *volumeGcInterval,
+		"scalingInterval":   *scalingInterval,
+		"mpsCheckInterval":  *mpsCheckInterval,
+		"archiveGcInterval": *archiveGcInterval,
+		"reserveGcInterval": *reserveGcInterval,
+		"portCheckInterval": *portCheckInterval,
+	} {
+		if interval <= 0 {
+			return fmt.Errorf("invalid --%s: %s, it must be greater than 0", name, interval)
+		}
+	}
+
 	if err = docker.InitDockerClient(); err != nil {
 		return
 	}
@@ -64,9 +128,43 @@ func (p *program) Init(svc.Environment) (err error) {
 		return
 	}
 
-	workQueue.InitWorkQueue()
+	workQueue.InitWorkQueue(*workQueueSize)
+
+	var shmSize int64
+	if len(*defaultShmSize) != 0 {
+		if shmSize, err = utils.ToBytes(strings.ToUpper(*defaultShmSize)); err != nil {
+			return fmt.Errorf("invalid --defaultShmSize: %s, %v", *defaultShmSize, err)
+		}
+	}
+
+	services.InitConfig(services.Config{
+		HelperImage:      *helperImage,
+		CopyMaxAttempts:  *copyMaxAttempts,
+		CopyRetryBackoff: *copyRetryBackoff,
+		CopyConcurrency:  *copyConcurrency,
+		CopyWithCp:       *copyWithCp,
+		FrameworkEnv:     *frameworkEnv,
+		AllowProfiler:    *allowProfiler,
+		MaxContainers:    *maxContainers,
+		EncryptionDir:    *encryptionDir,
+		SecretDir:        *secretDir,
+		CheckpointDir:    *checkpointDir,
+		CudaCheckpoint:   *cudaCheckpoint,
+		ArchiveDir:       *archiveDir,
+		ArchiveRetention: *archiveRetention,
+		GpuRuntimes:      *gpuRuntimes,
+		RegistryAuthFile: *registryAuthFile,
+		DefaultShmSize:   shmSize,
+		DockerTimeout:    *dockerTimeout,
+		ExecTimeout:      *execTimeout,
+		ReconcilePrune:   *reconcilePrune,
+		ReconcileImport:  *reconcileImport,
+	})
 
-	if err = schedulers.InitGPuScheduler(); err != nil {
+	if err = schedulers.InitGPuScheduler(*gpuSlots); err != nil {
+		return
+	}
+	if err = schedulers.GpuScheduler.SetGpuConflicts(*gpuConflicts); err != nil {
 		return
 	}
 
@@ -74,6 +172,16 @@ func (p *program) Init(svc.Environment) (err error) {
 		return
 	}
 
+	schedulers.InitSchedulerProvider(*externalScheduler)
+
+	if err = schedulers.InitResourceScheduler(); err != nil {
+		return
+	}
+
+	if err = schedulers.InitMpsManager(*mpsPipeDir, *mpsLogDir); err != nil {
+		return
+	}
+
 	if err = version.InitVersionMap(); err != nil {
 		return
 	}
@@ -82,6 +190,26 @@ func (p *program) Init(svc.Environment) (err error) {
 		return
 	}
 
+	// the versions and the gpu state saved at shutdown are stale if the last run crashed,
+	// the records are reconciled first, the versions and the gpu claims are rebuilt from them
+	if err = services.ReconcileState(); err != nil {
+		return
+	}
+	if err = services.ReconcileVersions(); err != nil {
+		return
+	}
+	if err = services.ReconcileGpuClaims(); err != nil {
+		return
+	}
+
+	if err = projection.Init(*enableProjection, *projectionDriver, *projectionDSN); err != nil {
+		return
+	}
+
+	if err = notify.Init(); err != nil {
+		return
+	}
+
 	//  create merges dir, that used to store container merged layer
 	layer := "merges"
 	if err = utils.IsDir(layer); err != nil {
@@ -97,21 +225,39 @@ func (p *program) Start() error {
 		ch routers.ReplicaSetHandler
 		vh routers.VolumeHandler
 		gh routers.Resource
+		th routers.TemplateHandler
+		dh routers.DiagnosticsHandler
+		lh routers.DeadLetterHandler
+		sh routers.ScalingHandler
+		ph routers.ProjectionHandler
+		kh routers.TokenHandler
+		wh routers.WebhookHandler
+		jh routers.JobHandler
 	)
 
-	fmt.Printf("CONFIG\n addr: %s\n etcdAddr: %s\n portRange: %s\n logLevel: %s\n\n", *addr, *etcdAddr, *portRange, *logLevel)
+	fmt.Printf("CONFIG\n addr: %s\n etcdAddr: %s\n portRange: %s\n logLevel: %s\n volumeGcInterval: %s\n helperImage: %s\n mpsPipeDir: %s\n mpsLogDir: %s\n externalScheduler: %s\n\n",
+		*addr, *etcdAddr, *portRange, *logLevel, *volumeGcInterval, *helperImage, *mpsPipeDir, *mpsLogDir, *externalScheduler)
 	log.Infof("The number of available gpus is %d", schedulers.GpuScheduler.AvailableGpuNums)
+	if !services.NvidiaRuntimeAvailable() {
+		log.Warn("The nvidia runtime is not registered in docker, gpu containers may fail to start, " +
+			"please install nvidia-container-toolkit")
+	}
 	log.Infof("The range of available ports is %d-%d, and the available number is %d",
 		schedulers.PortScheduler.StartPort,
 		schedulers.PortScheduler.EndPort,
 		schedulers.PortScheduler.AvailableCount,
 	)
+	log.Infof("The capacity of cpu is %d nano cpus, and the capacity of memory is %d bytes",
+		schedulers.ResourceScheduler.CpuCapacity,
+		schedulers.ResourceScheduler.MemoryCapacity,
+	)
 
 	log.Info("gpu-docker-api started successfully!")
 
 	gin.SetMode(*logLevel)
 	r := gin.New()
 	r.Use(routers.Cors())
+	routers.SetAllowedOrigins(*terminalOrigins)
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
@@ -122,25 +268,44 @@ func (p *program) Start() error {
 	ch.RegisterRoute(apiv1)
 	vh.RegisterRoute(apiv1)
 	gh.RegisterRoute(apiv1)
+	th.RegisterRoute(apiv1)
+	dh.RegisterRoute(apiv1)
+	lh.RegisterRoute(apiv1)
+	sh.RegisterRoute(apiv1)
+	ph.RegisterRoute(apiv1)
+	kh.RegisterRoute(apiv1)
+	wh.RegisterRoute(apiv1)
+	jh.RegisterRoute(apiv1)
 
 	go func() {
 		_ = r.Run(*addr)
 	}()
 
+	p.wg.Add(1)
 	go workQueue.SyncLoop(p.ctx, &p.wg)
+	go services.VolumeRetentionLoop(p.ctx, *volumeGcInterval)
+	go schedulers.MpsMonitorLoop(p.ctx, *mpsCheckInterval)
+	go services.ScalingLoop(p.ctx, *scalingInterval)
+	go services.PortCheckLoop(p.ctx, *portCheckInterval)
+	go notify.DeliverLoop(p.ctx)
+	go services.ArchiveGcLoop(p.ctx, *archiveGcInterval)
+	go services.ReservationGcLoop(p.ctx, *reserveGcInterval)
 
 	return nil
 }
 
 func (p *program) Stop() error {
 	log.Info("gpu-docker-routers is stopping...")
-	p.ctx.Done()
+	p.cancel()
 	p.wg.Wait()
 
 	workQueue.Close()
+	_ = projection.Close()
 	docker.CloseDockerClient()
 	_ = schedulers.CloseGpuScheduler()
 	_ = schedulers.ClosePortScheduler()
+	_ = schedulers.CloseResourceScheduler()
+	_ = schedulers.CloseMpsManager()
 	_ = version.CloseVersionMap()
 	_ = version.CloseMergedMap()
 	_ = etcd.CloseEtcdClient()
@@ -3,6 +3,7 @@ package etcd
 import (
 	"context"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,12 +21,28 @@ const (
 type Resource = string
 
 const (
-	Containers Resource = "containers"
-	Volumes    Resource = "volumes"
-	Versions   Resource = "versions"
-	Merges     Resource = "merges"
-	Gpus       Resource = "gpus"
-	Ports      Resource = "ports"
+	Containers  Resource = "containers"
+	Volumes     Resource = "volumes"
+	Versions    Resource = "versions"
+	Merges      Resource = "merges"
+	Gpus        Resource = "gpus"
+	Ports       Resource = "ports"
+	Reserves    Resource = "reserves"
+	Retentions  Resource = "retentions"
+	Templates   Resource = "templates"
+	Copies      Resource = "copies"
+	DeadLetters Resource = "deadLetters"
+	Scalings    Resource = "scalings"
+	Cutovers    Resource = "cutovers"
+	Checkpoints Resource = "checkpoints"
+	Tokens      Resource = "tokens"
+	Webhooks    Resource = "webhooks"
+	// VolumeUsages is the index of the volume versions mounted by the container versions
+	VolumeUsages Resource = "volumeUsages"
+	// GpuReservations are attached to leases, they are deleted by etcd when expired
+	GpuReservations Resource = "gpuReservations"
+	// Idempotencies are the results of the creates with an idempotency key, they are attached to leases
+	Idempotencies Resource = "idempotencies"
 
 	operationDuration = 1 * time.Second
 )
@@ -42,9 +59,30 @@ type DelKey struct {
 }
 
 func Put(resource Resource, key string, value *string) error {
+	_, err := PutRevision(resource, key, value)
+	return err
+}
+
+// PutRevision puts the key and returns the revision of the put, which is the mod revision of the key
+func PutRevision(resource Resource, key string, value *string) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
 	defer cancel()
-	_, err := cli.Put(ctx, ResourcePrefix(resource, key), *value)
+	resp, err := cli.Put(ctx, ResourcePrefix(resource, key), *value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "etcd.Put failed, resource %s, key: %s, value: %s", resource, key, *value)
+	}
+	return resp.Header.Revision, nil
+}
+
+// PutWithTTL puts the key with a lease, the key will be deleted when the ttl expires
+func PutWithTTL(resource Resource, key string, value *string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	lease, err := cli.Grant(ctx, int64(max(ttl/time.Second, 1)))
+	if err != nil {
+		return errors.Wrapf(err, "etcd.Grant failed, resource %s, key: %s, ttl: %s", resource, key, ttl)
+	}
+	_, err = cli.Put(ctx, ResourcePrefix(resource, key), *value, clientv3.WithLease(lease.ID))
 	if err != nil {
 		return errors.Wrapf(err, "etcd.Put failed, resource %s, key: %s, value: %s", resource, key, *value)
 	}
@@ -59,13 +97,110 @@ func GetValue(resource Resource, key string) ([]byte, error) {
 	return kvs[0].Value, nil
 }
 
-func Del(resource Resource, key string) error {
+// List returns all the key-value pairs under the resource, the key is without prefix.
+func List(resource Resource) (map[string][]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
 	defer cancel()
-	_, err := cli.Delete(ctx, ResourcePrefix(resource, key))
+	prefix := ResourcePrefix(resource, "") + "/"
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.List failed, resource %s", resource)
+	}
+	kvs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[strings.TrimPrefix(string(kv.Key), prefix)] = kv.Value
+	}
+	return kvs, nil
+}
+
+func Del(resource Resource, key string) error {
+	_, err := DelRevision(resource, key)
 	return err
 }
 
+// DelRevision deletes the key and returns the revision of the delete
+func DelRevision(resource Resource, key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	resp, err := cli.Delete(ctx, ResourcePrefix(resource, key))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// ListRevision returns all the key-value pairs under the resource with their mod revisions,
+// and the revision of etcd the list is read at
+func ListRevision(resource Resource) (map[string]RevisionValue, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	prefix := ResourcePrefix(resource, "") + "/"
+	resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "etcd.List failed, resource %s", resource)
+	}
+	kvs := make(map[string]RevisionValue, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[strings.TrimPrefix(string(kv.Key), prefix)] = RevisionValue{Value: kv.Value, ModRevision: kv.ModRevision}
+	}
+	return kvs, resp.Header.Revision, nil
+}
+
+// ListPrefix lists the keys of the resource that begin with the prefix, the keys are returned without the resource prefix
+func ListPrefix(resource Resource, prefix string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	resourcePrefix := ResourcePrefix(resource, "") + "/"
+	resp, err := cli.Get(ctx, resourcePrefix+prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.ListPrefix failed, resource %s, prefix: %s", resource, prefix)
+	}
+	kvs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[strings.TrimPrefix(string(kv.Key), resourcePrefix)] = kv.Value
+	}
+	return kvs, nil
+}
+
+// Take deletes the key and returns its value, only one of the concurrent callers gets the value
+func Take(resource Resource, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	resp, err := cli.Delete(ctx, ResourcePrefix(resource, key), clientv3.WithPrevKV())
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.Take failed, resource %s, key: %s", resource, key)
+	}
+	if len(resp.PrevKvs) == 0 {
+		return nil, xerrors.NewNotExistInEtcdError()
+	}
+	return resp.PrevKvs[0].Value, nil
+}
+
+// GetRevisionValue returns the value of the key with the revision it was last modified at
+func GetRevisionValue(resource Resource, key string) (RevisionValue, error) {
+	kvs, err := get(resource, key)
+	if err != nil {
+		return RevisionValue{}, err
+	}
+	return RevisionValue{Value: kvs[0].Value, ModRevision: kvs[0].ModRevision}, nil
+}
+
+// DelIfRevision deletes the key only if it's not modified since the revision, it reports whether the key is deleted,
+// only one of the concurrent callers deletes it
+func DelIfRevision(resource Resource, key string, modRevision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
+	defer cancel()
+	k := ResourcePrefix(resource, key)
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(k), "=", modRevision)).
+		Then(clientv3.OpDelete(k)).
+		Commit()
+	if err != nil {
+		return false, errors.Wrapf(err, "etcd.DelIfRevision failed, resource %s, key: %s", resource, key)
+	}
+	return resp.Succeeded, nil
+}
+
 func get(resource Resource, key string) ([]*mvccpb.KeyValue, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), operationDuration)
 	defer cancel()
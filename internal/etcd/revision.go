@@ -9,6 +9,12 @@ type (
 	Value      = []byte
 )
 
+// RevisionValue is the value of a key with the revision it was last modified at
+type RevisionValue struct {
+	Value       Value
+	ModRevision int64
+}
+
 type combine struct {
 	Version  int64
 	Revision int64
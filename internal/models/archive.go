@@ -0,0 +1,26 @@
+package models
+
+// ContainerDelete are the options of deleting a container, it's force removed by default
+type ContainerDelete struct {
+	// Graceful stops the container with SIGTERM first, so that e.g. a training job can checkpoint,
+	// it's killed only if it doesn't exit in StopTimeout seconds, the default is 30
+	Graceful    bool `json:"graceful"`
+	StopTimeout int  `json:"stopTimeout"`
+}
+
+// ContainerSoftDelete are the options of a soft delete, the container is stopped and kept for post-mortem
+type ContainerSoftDelete struct {
+	// CommitImage commits the filesystem of the container to an archive image
+	CommitImage bool `json:"commitImage"`
+	// ExportLogs writes the logs of the container to a file in the archive directory
+	ExportLogs bool `json:"exportLogs"`
+}
+
+// ContainerArchive is set on a soft deleted container, it's removed by the retention gc after ExpireTime
+type ContainerArchive struct {
+	ContainerName string `json:"containerName"`
+	Image         string `json:"image,omitempty"`
+	LogFile       string `json:"logFile,omitempty"`
+	ArchiveTime   string `json:"archiveTime"`
+	ExpireTime    string `json:"expireTime"`
+}
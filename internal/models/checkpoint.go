@@ -0,0 +1,22 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// ContainerCheckpoint is a checkpoint of the process state of a container, the key is the id
+type ContainerCheckpoint struct {
+	ID        string `json:"id"`
+	Dir       string `json:"dir"`
+	Container string `json:"container"`
+	// Cuda means the cuda processes were suspended by cuda-checkpoint before the checkpoint
+	Cuda       bool   `json:"cuda"`
+	Exit       bool   `json:"exit"`
+	CreateTime string `json:"createTime"`
+}
+
+func (c *ContainerCheckpoint) Serialize() *string {
+	bytes, _ := json.Marshal(c)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -1,13 +1,212 @@
 package models
 
+// ReservedGpuDriverOptions are the keys that can't be set in GpuDriverOptions,
+// the device ids are always chosen by GpuScheduler and the capabilities are always gpu.
+var ReservedGpuDriverOptions = map[string]struct{}{
+	"count":        {},
+	"device_ids":   {},
+	"deviceIDs":    {},
+	"capabilities": {},
+}
+
 type ContainerRun struct {
-	ImageName      string   `json:"imageName"`
-	ReplicaSetName string   `json:"replicaSetName"`
-	GpuCount       int      `json:"gpuCount,omitempty"`
-	Binds          []Bind   `json:"binds,omitempty"`
-	Env            []string `json:"env,omitempty"`
-	Cmd            []string `json:"cmd,omitempty"`
+	ImageName      string `json:"imageName"`
+	ReplicaSetName string `json:"replicaSetName"`
+	// ForcePull pulls the image even if it's on the host, e.g. for a moving tag like latest
+	ForcePull bool `json:"forcePull,omitempty"`
+	GpuCount  int  `json:"gpuCount,omitempty"`
+	// GpuUUIDs are the gpus requested by uuid, which is stable across reboots while the index is not.
+	// The rest of GpuCount is applied from the free gpus, GpuCount defaults to the number of uuids.
+	GpuUUIDs []string `json:"gpuUUIDs,omitempty"`
+	// GpuConstraints exclude gpus or pin them to a NUMA node, the requested uuids must satisfy them too
+	GpuConstraints *GpuConstraints `json:"gpuConstraints,omitempty"`
+	Binds          []Bind          `json:"binds,omitempty"`
+	Env            []string        `json:"env,omitempty"`
+	Cmd            []string        `json:"cmd,omitempty"`
+	// ContainerPorts are bound to the host ports applied from the port range, e.g. 8888 or 5000/udp
 	ContainerPorts []string `json:"containerPorts,omitempty"`
+	// Ports are the ports whose host port is not applied from the port range, the host port must not be in use,
+	// HostPort 0 means docker assigns an ephemeral host port, the actual port is returned after start.
+	Ports []Port `json:"ports,omitempty"`
+	// StorageOptSize limits the size of the container's writable layer, e.g. 20GB.
+	// Only works on storage drivers that support it, such as overlay2 over xfs with pquota.
+	StorageOptSize string `json:"storageOptSize,omitempty"`
+	// GpuDriverOptions are passed through to DeviceRequest.Options of the nvidia driver as-is,
+	// it only takes effect when GpuCount is greater than 0.
+	GpuDriverOptions map[string]string `json:"gpuDriverOptions,omitempty"`
+	// CpuRequest and MemoryRequest are reserved for the container when it is placed,
+	// CpuLimit and MemoryLimit are the cgroup caps, the container can burst up to the limit.
+	// The cpu is in cores, e.g. 0.5, the memory is a size, e.g. 4GB.
+	// If only the limit is set, the request is the same as the limit.
+	CpuRequest    float64 `json:"cpuRequest,omitempty"`
+	CpuLimit      float64 `json:"cpuLimit,omitempty"`
+	MemoryRequest string  `json:"memoryRequest,omitempty"`
+	MemoryLimit   string  `json:"memoryLimit,omitempty"`
+	// CpusetCpus pins the container to the cpus of the host, e.g. 0-3,8, empty means all cpus
+	CpusetCpus string `json:"cpusetCpus,omitempty"`
+	// OomScoreAdj is in -1000..1000, the lower the score, the later the container is killed when the host is out of memory.
+	// OomKillDisable never kills the container, it should be used together with MemoryLimit.
+	OomScoreAdj    int  `json:"oomScoreAdj,omitempty"`
+	OomKillDisable bool `json:"oomKillDisable,omitempty"`
+	// Runtime is the OCI runtime registered in docker, e.g. runsc for untrusted workloads, empty means the default runtime.
+	// The gpus can only be requested with the runtimes in --gpuRuntimes.
+	Runtime string `json:"runtime,omitempty"`
+	// ReservationToken consumes the gpus held by a reservation instead of allocating, GpuCount must be the same
+	ReservationToken string `json:"reservationToken,omitempty"`
+	// GpuMps shares the gpu through the MPS daemon, which is managed by gpu-docker-api,
+	// only one gpu can be shared by a container. It implies GpuShared, the gpu is shared only with the other MPS clients.
+	GpuMps bool `json:"gpuMps,omitempty"`
+	// JobID is the id of the job in the external job system, it is recorded in the gpu reservation
+	// and the container label, so that the external system can reconcile its view of gpu usage.
+	JobID string `json:"jobId,omitempty"`
+	// Hostname and Domainname inside the container, all versions of the replicaSet keep the same hostname,
+	// so that the peers of distributed frameworks can resolve each other deterministically.
+	Hostname   string `json:"hostname,omitempty"`
+	Domainname string `json:"domainname,omitempty"`
+	// GpuFraction requests a part of a gpu, e.g. 0.5, it must be a multiple of the slot size of the gpu,
+	// it can't be used together with GpuCount.
+	GpuFraction float64 `json:"gpuFraction,omitempty"`
+	// GpuShared assigns GpuCount gpus which other shared replicaSets may be assigned too, they are time-sliced
+	// by the nvidia device plugin. A shared gpu is not allocated exclusively or fractionally until all sharers release it.
+	// GpuMaxSharers caps the replicaSets sharing each gpu, 0 means no limit.
+	GpuShared     bool `json:"gpuShared,omitempty"`
+	GpuMaxSharers int  `json:"gpuMaxSharers,omitempty"`
+	// MigProfile requests MigCount mig instances of the profile, e.g. 1g.5gb, on the gpus in mig mode,
+	// MigCount defaults to 1. It can't be used together with GpuCount or GpuFraction.
+	MigProfile string `json:"migProfile,omitempty"`
+	MigCount   int    `json:"migCount,omitempty"`
+	// GpuFramework is the framework running in the container, e.g. jax, tensorflow or pytorch, the env that limits
+	// its gpu memory to the fraction or the share of the MPS client is injected, so that it doesn't take the memory of the whole gpu.
+	GpuFramework string `json:"gpuFramework,omitempty"`
+	// GpuLabels are the anti-co-location labels, e.g. inference, a gpu is never shared through its slots,
+	// the shared mode or its mig instances with a replicaSet holding a label that conflicts with them.
+	// A whole gpu is held exclusively so it is never shared, the labels still apply if the replicaSet is patched to share.
+	GpuLabels []string `json:"gpuLabels,omitempty"`
+	// GpuOrder decides which gpu is cuda:0, cuda:1 and so on inside the container,
+	// empty means the order enumerated by CUDA is kept. It can't be used together with MigProfile.
+	GpuOrder GpuOrder `json:"gpuOrder,omitempty"`
+	// NetworkBandwidth shapes the traffic of the container with tc, it's not limited if not set
+	NetworkBandwidth *NetworkBandwidth `json:"networkBandwidth,omitempty"`
+	// HealthCheck waits until the application inside is ready, e.g. a jupyter server,
+	// the create fails and the container is removed if it's never ready
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	// RestartPolicy restarts the crashed container by docker, the gpus are kept while it's restarted,
+	// it's not restarted if not set
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+	// ShmSize is the size of /dev/shm, e.g. 8GB, the containers using gpus get --defaultShmSize if it's not set,
+	// which is large enough for the data loader workers of pytorch
+	ShmSize string `json:"shmSize,omitempty"`
+	// IdempotencyKey makes the create safe to retry, e.g. after a timeout, the container created
+	// with the same key in the last 24 hours is returned instead of creating another one
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// DryRun validates the spec and plans the resources without creating the container,
+	// nothing is allocated, pulled or written to etcd
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ContainerRunPlan is what RunGpuContainer would create for the spec, the resources may be taken by others
+// before the spec is run for real
+type ContainerRunPlan struct {
+	ContainerName string   `json:"containerName"`
+	DeviceIDs     []string `json:"deviceIds"`
+	GpuSlots      int      `json:"gpuSlots,omitempty"`
+	// Ports maps the container ports to the host ports, an empty host port is assigned by docker
+	Ports    map[string]string `json:"ports"`
+	Binds    []string          `json:"binds"`
+	Warnings []string          `json:"warnings"`
+}
+
+// NetworkBandwidth is in bits per second, 0 means the direction is not limited.
+// The container must be in a bridge network, the host network has no veth to shape.
+type NetworkBandwidth struct {
+	Ingress int64 `json:"ingress,omitempty"`
+	Egress  int64 `json:"egress,omitempty"`
+}
+
+// HealthCheck is polled after the container started, exactly one of Cmd and Port is set
+type HealthCheck struct {
+	// Cmd is executed in the container, exit code 0 means ready, e.g. ["curl", "-sf", "localhost:8888/api"]
+	Cmd []string `json:"cmd,omitempty"`
+	// Port is a tcp port of the container, it's ready once the port accepts connections
+	Port int `json:"port,omitempty"`
+	// Timeout is the max seconds to wait, the default is 120
+	Timeout int `json:"timeout,omitempty"`
+	// Interval is the seconds between the checks, the default is 2
+	Interval int `json:"interval,omitempty"`
+}
+
+// RestartPolicy is the restart policy of docker, the Name is one of no, on-failure, unless-stopped and always,
+// MaximumRetryCount can only be set for on-failure, 0 means retrying forever
+type RestartPolicy struct {
+	Name              string `json:"name"`
+	MaximumRetryCount int    `json:"maximumRetryCount,omitempty"`
+}
+
+const RestartPolicyOnFailure = "on-failure"
+
+// RestartPolicies are the names of the restart policies of docker which can be requested. The always policy is not
+// allowed, it also starts the container that was stopped by the api or superseded by a new version when docker restarts,
+// while its gpus and ports may have been given to another one, use unless-stopped instead.
+var RestartPolicies = []string{"no", RestartPolicyOnFailure, "unless-stopped"}
+
+// Readiness is the result of waiting for the HealthCheck
+type Readiness struct {
+	Attempts int `json:"attempts"`
+	// Elapsed is how long the container took to be ready, e.g. 12.5s
+	Elapsed string `json:"elapsed"`
+}
+
+type GpuOrder = string
+
+const (
+	// GpuOrderPci numbers the gpus in the order of their host index
+	GpuOrderPci GpuOrder = "pci"
+	// GpuOrderAllocation numbers the gpus in the order they are allocated, e.g. by an external provider
+	GpuOrderAllocation GpuOrder = "allocation"
+)
+
+// GpuIndex maps the index of a gpu inside the container to the gpu on the host
+type GpuIndex struct {
+	Index     int    `json:"index"`
+	HostIndex int    `json:"hostIndex"`
+	UUID      string `json:"uuid"`
+}
+
+type ContainerLimitStatus struct {
+	// Limit is the max number of managed running containers, 0 means unlimited
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+	// Reserved are the containers being created or started, they are counted against the limit too
+	Reserved int `json:"reserved"`
+}
+
+type ContainerLimitPatch struct {
+	Limit int `json:"limit"`
+}
+
+// ResourceRequests are the cpu and memory reserved by a replicaSet
+type ResourceRequests struct {
+	NanoCpus    int64 `json:"nanoCpus"`
+	MemoryBytes int64 `json:"memoryBytes"`
+}
+
+// Port is bound to HostPort on the host, 0 means docker assigns an ephemeral host port
+type Port struct {
+	ContainerPort int `json:"containerPort"`
+	HostPort      int `json:"hostPort"`
+	// Protocol is tcp, udp or sctp, the default is tcp, it's kept in the etcd record for the new versions
+	Protocol string `json:"protocol,omitempty"`
+}
+
+const (
+	ProtocolTcp  = "tcp"
+	ProtocolUdp  = "udp"
+	ProtocolSctp = "sctp"
+)
+
+// ValidProtocol means docker can publish the port of the protocol
+func ValidProtocol(protocol string) bool {
+	return protocol == ProtocolTcp || protocol == ProtocolUdp || protocol == ProtocolSctp
 }
 
 type GpuPatch struct {
@@ -19,26 +218,164 @@ type VolumePatch struct {
 	NewBind *Bind `json:"newBind"`
 }
 
+// EnvPatch adds or updates the envs in Set and deletes the envs in Delete by key,
+// all entries of a key are replaced, so a key repeated in the original envs appears only once after the patch.
+type EnvPatch struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Delete []string          `json:"delete,omitempty"`
+}
+
+// ImagePatch replaces the image of the container, the image is pulled if it's not on the host.
+// The merged files of the old version are copied only if CopyMerged is set,
+// because they would overwrite the files of the new image, e.g. the libraries upgraded by the new tag.
+type ImagePatch struct {
+	ImageName  string `json:"imageName"`
+	CopyMerged bool   `json:"copyMerged"`
+}
+
+// ContainerPortPatch unpublishes the container ports in Remove, e.g. 8888 or 5000/udp, and publishes the ports
+// in ContainerPorts and Ports like ContainerRun, a port already published is rebound as requested.
+type ContainerPortPatch struct {
+	ContainerPorts []string `json:"containerPorts,omitempty"`
+	Ports          []Port   `json:"ports,omitempty"`
+	Remove         []string `json:"remove,omitempty"`
+}
+
+type CheckpointCreate struct {
+	// Exit stops the container after the checkpoint
+	Exit bool `json:"exit"`
+}
+
+type PatchStrategy = string
+
+const (
+	// PatchReplace deletes the old version as soon as the new version is running, it's the default
+	PatchReplace PatchStrategy = "replace"
+	// PatchBlueGreen keeps the old version serving until the new version is healthy and the traffic is cut over
+	PatchBlueGreen PatchStrategy = "blueGreen"
+)
+
 type PatchRequest struct {
-	GpuPatch    *GpuPatch    `json:"gpuPatch"`
-	VolumePatch *VolumePatch `json:"volumePatch"`
+	GpuPatch    *GpuPatch           `json:"gpuPatch"`
+	VolumePatch *VolumePatch        `json:"volumePatch"`
+	EnvPatch    *EnvPatch           `json:"envPatch"`
+	ImagePatch  *ImagePatch         `json:"imagePatch"`
+	PortPatch   *ContainerPortPatch `json:"portPatch"`
+	Strategy    PatchStrategy       `json:"strategy"`
+	// CutoverHook is called with a CutoverRecord when the new version is healthy in a blue/green patch,
+	// e.g. to switch a load balancer to the new ports, the old version is kept if it doesn't return 2xx.
+	CutoverHook string `json:"cutoverHook"`
+	// Checkpoint the process state of the old version and restore it on the new version,
+	// the gpu count can't be changed if the old version uses gpus.
+	Checkpoint bool `json:"checkpoint"`
 }
 
 type RollbackRequest struct {
 	Version int64 `json:"version"`
+	// FromCurrent copies the files of the current version instead of the files saved with the target version,
+	// so only the configuration is rolled back.
+	FromCurrent bool `json:"fromCurrent,omitempty"`
 }
 
 type ContainerExecute struct {
 	WorkDir string   `json:"workDir,omitempty"`
 	Cmd     []string `json:"cmd,omitempty"`
+	// Env is added to the envs of the container, e.g. KEY=VALUE
+	Env []string `json:"env,omitempty"`
+	// User runs the command as another user than the one of the container, e.g. user, uid, user:group or uid:gid
+	User string `json:"user,omitempty"`
+	// DetachKeys is the key sequence to detach from an interactive exec, e.g. ctrl-a,d, the default is ctrl-p,q
+	DetachKeys string `json:"detachKeys,omitempty"`
+}
+
+const (
+	ExecMessageStdin  = "stdin"
+	ExecMessageResize = "resize"
+)
+
+// ExecMessage is sent by the client of an interactive exec, it's the input or the new size of the terminal
+type ExecMessage struct {
+	// Type is stdin or resize
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Rows uint   `json:"rows,omitempty"`
+	Cols uint   `json:"cols,omitempty"`
+}
+
+// ExecResult is the output of a finished exec, the exit code tells whether the command succeeded
+type ExecResult struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// ProfilerLaunch runs a privileged profiler, e.g. nsys or dcgmi, in the pid namespace and on the gpus of the container
+type ProfilerLaunch struct {
+	Image string   `json:"image"`
+	Cmd   []string `json:"cmd"`
+	// Timeout is the max seconds the profiler runs, the default is 300
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type ProfilerResult struct {
+	ExitCode int64  `json:"exitCode"`
+	Output   string `json:"output"`
+}
+
+type ProcessKill struct {
+	// Pid is the pid on the host, as listed by top
+	Pid int `json:"pid"`
+	// Signal is the name or number of the signal, e.g. TERM, SIGKILL or 9, the default is TERM
+	Signal string `json:"signal,omitempty"`
 }
 
 type ContainerCommit struct {
 	NewImageName string `json:"newImageName"`
 }
 
+type ContainerRename struct {
+	NewReplicaSetName string `json:"newReplicaSetName"`
+}
+
+type ContainerClone struct {
+	NewReplicaSetName string `json:"newReplicaSetName"`
+	// CopyMerged whether to copy the merged layer of the source container to the new container
+	CopyMerged bool `json:"copyMerged,omitempty"`
+}
+
+// ContainerListItem is the metadata of a container version, the status is the live state in docker,
+// e.g. running or exited, removed means the container of the version no longer exists.
+type ContainerListItem struct {
+	ReplicaSetName string            `json:"replicaSetName"`
+	ContainerName  string            `json:"containerName"`
+	Version        int64             `json:"version"`
+	Image          string            `json:"image"`
+	Gpus           []string          `json:"gpus"`
+	Binds          []string          `json:"binds"`
+	Ports          map[string]string `json:"ports"`
+	CreateTime     string            `json:"createTime"`
+	Status         string            `json:"status"`
+}
+
+// LogOptions selects the logs of the container, Since is a timestamp or a duration relative to now, e.g. 10m,
+// Tail is the number of lines from the end or all.
+type LogOptions struct {
+	Follow     bool   `json:"follow,omitempty"`
+	Tail       string `json:"tail,omitempty"`
+	Since      string `json:"since,omitempty"`
+	Timestamps bool   `json:"timestamps,omitempty"`
+}
+
 type ContainerHistoryItem struct {
 	Version    int64             `json:"version"`
 	CreateTime string            `json:"createTime"`
 	Status     EtcdContainerInfo `json:"status"`
 }
+
+// ContainerDeleteReport lists the versions of the replicaSet handled by deleting all versions,
+// Running are the running versions kept because the deletion is not forced.
+type ContainerDeleteReport struct {
+	Removed []string `json:"removed"`
+	Running []string `json:"running"`
+	Failed  []string `json:"failed"`
+}
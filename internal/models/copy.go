@@ -0,0 +1,57 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+type CopyStatus = string
+
+const (
+	CopyQueued    CopyStatus = "queued"
+	CopyRunning   CopyStatus = "running"
+	CopySucceeded CopyStatus = "succeeded"
+	CopyFailed    CopyStatus = "failed"
+)
+
+// CopyRecord records the copy of data from the old version to the new version of a container or volume,
+// the key is the name of the new version.
+type CopyRecord struct {
+	Resource  string     `json:"resource"`
+	Src       string     `json:"src"`
+	Dest      string     `json:"dest"`
+	Status    CopyStatus `json:"status"`
+	Attempts  int        `json:"attempts"`
+	Errors    []string   `json:"errors,omitempty"`
+	StartTime string     `json:"startTime"`
+	EndTime   string     `json:"endTime,omitempty"`
+	// Resumed means an attempt skipped the files already copied by the previous attempts
+	Resumed bool `json:"resumed,omitempty"`
+	// CopiedFiles and SkippedFiles are counted by the last attempt of a resumable copy
+	CopiedFiles  int `json:"copiedFiles,omitempty"`
+	SkippedFiles int `json:"skippedFiles,omitempty"`
+	// ClonedFiles are the copied files cloned copy-on-write by reflink, Reflink means all of them are cloned
+	ClonedFiles int  `json:"clonedFiles,omitempty"`
+	Reflink     bool `json:"reflink,omitempty"`
+	// CopiedBytes and TotalBytes are counted by the last attempt, the skipped files are counted as copied,
+	// TotalBytes is 0 if the data is copied by a helper container and can't be counted
+	CopiedBytes int64 `json:"copiedBytes"`
+	TotalBytes  int64 `json:"totalBytes"`
+}
+
+// Finished means the copy succeeded or failed, a queued or running copy is not finished
+func (r *CopyRecord) Finished() bool {
+	return r.Status != CopyQueued && r.Status != CopyRunning
+}
+
+func (r *CopyRecord) Serialize() *string {
+	bytes, _ := json.Marshal(r)
+	tmp := string(bytes)
+	return &tmp
+}
+
+// CopyQueueStats are the copies running and waiting for a slot, Limit is 0 if the copies are not limited
+type CopyQueueStats struct {
+	Limit  int   `json:"limit"`
+	Active int64 `json:"active"`
+	Queued int64 `json:"queued"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// CutoverRecord records the blue/green cutover of a replicaSet from the old version to the new version,
+// the key is the name of the new version.
+type CutoverRecord struct {
+	ReplicaSetName string            `json:"replicaSetName"`
+	From           string            `json:"from"`
+	To             string            `json:"to"`
+	BoundPorts     map[string]string `json:"boundPorts,omitempty"`
+	Hook           string            `json:"hook,omitempty"`
+	Succeeded      bool              `json:"succeeded"`
+	Error          string            `json:"error,omitempty"`
+	Time           string            `json:"time"`
+}
+
+func (r *CutoverRecord) Serialize() *string {
+	bytes, _ := json.Marshal(r)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+type DeadLetterKind = string
+
+const (
+	DeadLetterPut DeadLetterKind = "put"
+	DeadLetterDel DeadLetterKind = "del"
+)
+
+// DeadLetter records a WorkQueue item which failed after all attempts, it can be requeued by operators
+type DeadLetter struct {
+	ID         string         `json:"id"`
+	Kind       DeadLetterKind `json:"kind"`
+	Resource   string         `json:"resource"`
+	Key        string         `json:"key"`
+	Value      *string        `json:"value,omitempty"`
+	Attempts   int            `json:"attempts"`
+	Errors     []string       `json:"errors"`
+	FailedTime string         `json:"failedTime"`
+}
+
+func (d *DeadLetter) Serialize() *string {
+	bytes, _ := json.Marshal(d)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -0,0 +1,79 @@
+package models
+
+type DiagnosticsReport struct {
+	FailedCopies []*CopyRecord `json:"failedCopies"`
+	Ports        *PortReport   `json:"ports"`
+}
+
+// PortMismatch is a container whose host ports recorded in etcd differ from the live bindings
+type PortMismatch struct {
+	Container string            `json:"container"`
+	Recorded  map[string]string `json:"recorded"`
+	Live      map[string]string `json:"live"`
+}
+
+// PortConflict is a host port claimed by more than one managed container
+type PortConflict struct {
+	HostPort   string   `json:"hostPort"`
+	Containers []string `json:"containers"`
+}
+
+type PortReport struct {
+	Mismatches []*PortMismatch `json:"mismatches"`
+	Conflicts  []*PortConflict `json:"conflicts"`
+	// Repaired means the mismatched records have been updated to the live bindings
+	Repaired bool `json:"repaired"`
+}
+
+type VersionMaps struct {
+	Containers map[string]int64 `json:"containers"`
+	Volumes    map[string]int64 `json:"volumes"`
+}
+
+// VersionCorrection is a change made to the version map when it is repaired,
+// Old or New is 0 means the entry is added or removed.
+type VersionCorrection struct {
+	Name   string `json:"name"`
+	Old    int64  `json:"old"`
+	New    int64  `json:"new"`
+	Reason string `json:"reason"`
+}
+
+type VersionRepairReport struct {
+	Containers []*VersionCorrection `json:"containers"`
+	Volumes    []*VersionCorrection `json:"volumes"`
+}
+
+// StateMismatch is a replicaSet or volume that etcd and docker disagree on,
+// Latest is the latest version recorded in etcd for a stale one, or existing in docker for an unknown one.
+type StateMismatch struct {
+	Name   string `json:"name"`
+	Latest string `json:"latest"`
+	// Fixed means the stale record has been pruned or the unknown resource has been imported
+	Fixed bool `json:"fixed"`
+}
+
+type StateReport struct {
+	// StaleContainers and StaleVolumes are recorded in etcd, but no version of them exists in docker
+	StaleContainers []*StateMismatch `json:"staleContainers"`
+	StaleVolumes    []*StateMismatch `json:"staleVolumes"`
+	// UnknownContainers and UnknownVolumes are named like a version in docker, but not recorded in etcd
+	UnknownContainers []*StateMismatch `json:"unknownContainers"`
+	UnknownVolumes    []*StateMismatch `json:"unknownVolumes"`
+}
+
+// WorkQueueStats are the depth and the counters of the WorkQueue since startup, the latency is in milliseconds
+// from enqueue to the end of the last attempt. Rejected counts the items that found the queue full,
+// Blocked counts the rejected items whose producer waited for a place.
+type WorkQueueStats struct {
+	Capacity      int   `json:"capacity"`
+	Depth         int   `json:"depth"`
+	Enqueued      int64 `json:"enqueued"`
+	Rejected      int64 `json:"rejected"`
+	Blocked       int64 `json:"blocked"`
+	Processed     int64 `json:"processed"`
+	Failed        int64 `json:"failed"`
+	AvgLatencyMs  int64 `json:"avgLatencyMs"`
+	LastLatencyMs int64 `json:"lastLatencyMs"`
+	MaxLatencyMs  int64 `json:"maxLatencyMs"`
+}
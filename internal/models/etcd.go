@@ -17,6 +17,41 @@ type EtcdContainerInfo struct {
 	NetworkingConfig *network.NetworkingConfig `json:"networkingConfig"`
 	Platform         *ocispec.Platform         `json:"platform"`
 	ContainerName    string                    `json:"containerName"`
+	// CloneFrom is the versioned name of the container that this replicaSet was cloned from
+	CloneFrom string `json:"cloneFrom,omitempty"`
+	// RenameFrom is the versioned name of the container that this replicaSet was renamed from
+	RenameFrom string `json:"renameFrom,omitempty"`
+	// Ports are the ports requested with a host port instead of applied from the port range
+	Ports []Port `json:"ports,omitempty"`
+	// BoundPorts are the host ports actually bound after the container started, e.g. "22/tcp": "40001"
+	BoundPorts map[string]string `json:"boundPorts,omitempty"`
+	// Incomplete means the merged layer of the old version failed to copy to this version
+	Incomplete bool `json:"incomplete,omitempty"`
+	// Requests are the cpu and memory reserved for the replicaSet, the limits are in HostConfig
+	Requests *ResourceRequests `json:"requests,omitempty"`
+	// GpuMps means the gpu is shared through the MPS daemon
+	GpuMps bool `json:"gpuMps,omitempty"`
+	// GpuSlots are the slots of the gpu held by a fractional request, 0 means whole gpus are used
+	GpuSlots int `json:"gpuSlots,omitempty"`
+	// GpuShared means the gpus are shared with other replicaSets, GpuMaxSharers is honored when they are applied again
+	GpuShared     bool `json:"gpuShared,omitempty"`
+	GpuMaxSharers int  `json:"gpuMaxSharers,omitempty"`
+	// GpuConstraints are honored whenever the gpus of the replicaSet are applied again, e.g. on patch
+	GpuConstraints *GpuConstraints `json:"gpuConstraints,omitempty"`
+	// GpuUUIDs are the gpus requested by uuid, they are kept on patch and requested again on restart
+	GpuUUIDs []string `json:"gpuUUIDs,omitempty"`
+	// GpuOrder and GpuIndexes are the order of the gpus inside the container and the resulting mapping
+	GpuOrder   GpuOrder   `json:"gpuOrder,omitempty"`
+	GpuIndexes []GpuIndex `json:"gpuIndexes,omitempty"`
+	// NetworkBandwidth is shaped after every start, the veth is recreated by docker
+	NetworkBandwidth *NetworkBandwidth `json:"networkBandwidth,omitempty"`
+	// HealthCheck is waited for on every version, Readiness is the result of this version
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	Readiness   *Readiness   `json:"readiness,omitempty"`
+	// Archive is set when the replicaSet is soft deleted, the resources are released but the container is kept
+	Archive *ContainerArchive `json:"archive,omitempty"`
+	// Checkpoint is restored when the container starts, it's used only once and not saved
+	Checkpoint *ContainerCheckpoint `json:"-"`
 }
 
 func (i *EtcdContainerInfo) Serialize() *string {
@@ -29,6 +64,26 @@ type EtcdVolumeInfo struct {
 	Version    int64                 `json:"version"`
 	CreateTime string                `json:"createTime"`
 	Opt        *volume.CreateOptions `json:"opt"`
+	// Migration is set when this version is created by migrating from another storage driver
+	Migration *VolumeMigration `json:"migration,omitempty"`
+	// Incomplete means the data of the old version failed to copy to this version,
+	// it's only set by the old releases, the version is removed if the copy failed now
+	Incomplete bool `json:"incomplete,omitempty"`
+	// Encryption is set when the volume is created on an encrypted filesystem
+	Encryption *VolumeEncryption `json:"encryption,omitempty"`
+	// OptionsPatch is set when this version is created by patching the driver options of another version
+	OptionsPatch *VolumeOptionsRecord `json:"optionsPatch,omitempty"`
+}
+
+type VolumeMigration struct {
+	From       string `json:"from"`
+	FromDriver string `json:"fromDriver"`
+	ToDriver   string `json:"toDriver"`
+}
+
+type VolumeOptionsRecord struct {
+	From    string                        `json:"from"`
+	Changes map[string]VolumeOptionChange `json:"changes"`
 }
 
 func (i *EtcdVolumeInfo) Serialize() *string {
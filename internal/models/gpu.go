@@ -0,0 +1,48 @@
+package models
+
+// GpuDevice is a gpu on the host with its live usage and the containers it's assigned to
+type GpuDevice struct {
+	Index int    `json:"index"`
+	UUID  string `json:"uuid"`
+	// MemoryTotal and MemoryUsed are in MiB
+	MemoryTotal        int64 `json:"memoryTotal"`
+	MemoryUsed         int64 `json:"memoryUsed"`
+	UtilizationPercent int   `json:"utilizationPercent"`
+	// NumaNode is the NUMA node the gpu is attached to, -1 means the host has no NUMA or it's unknown
+	NumaNode int  `json:"numaNode"`
+	Healthy  bool `json:"healthy"`
+	// UnhealthyReason tells why the gpu is excluded from allocation
+	UnhealthyReason string `json:"unhealthyReason,omitempty"`
+	// Owner is the replicaSet, reservation or job holding the gpu in the scheduler
+	Owner string `json:"owner,omitempty"`
+	// Containers are the container versions whose device requests include the gpu, several for a shared gpu
+	Containers []string `json:"containers"`
+}
+
+// MigDevice is a mig instance of a gpu in mig mode, its uuid is passed to the container as a device id
+type MigDevice struct {
+	UUID string `json:"uuid"`
+	// Profile is the gpu instance profile, e.g. 1g.5gb
+	Profile string `json:"profile"`
+	// GpuUUID is the uuid of the gpu that the instance is partitioned from
+	GpuUUID string `json:"gpuUuid"`
+	Owner   string `json:"owner,omitempty"`
+}
+
+// GpuConstraints limit the gpus a whole-card request is allocated from
+type GpuConstraints struct {
+	// Exclude are the host indexes of the gpus never allocated, e.g. 0 for the gpu driving the display
+	Exclude []int `json:"exclude,omitempty"`
+	// NumaNode pins the gpus to the NUMA node, nil means any node
+	NumaNode *int `json:"numaNode,omitempty"`
+}
+
+// Excludes whether the gpu of the host index is excluded
+func (c *GpuConstraints) Excludes(index int) bool {
+	for _, i := range c.Exclude {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// IdempotencyRecord is the result of a create with an idempotency key, the key in etcd is the Key,
+// it's attached to a lease, so it disappears when the ttl expires
+type IdempotencyRecord struct {
+	Key            string            `json:"key"`
+	ReplicaSetName string            `json:"replicaSetName"`
+	ID             string            `json:"id"`
+	ContainerName  string            `json:"containerName"`
+	BoundPorts     map[string]string `json:"boundPorts,omitempty"`
+	Readiness      *Readiness        `json:"readiness,omitempty"`
+	CreateTime     string            `json:"createTime"`
+}
+
+func (r *IdempotencyRecord) Serialize() *string {
+	bytes, _ := json.Marshal(r)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -0,0 +1,29 @@
+package models
+
+// JobRun runs a one-off container until it exits, the container is always removed afterwards
+type JobRun struct {
+	ImageName string   `json:"imageName"`
+	Cmd       []string `json:"cmd,omitempty"`
+	Env       []string `json:"env,omitempty"`
+	Binds     []Bind   `json:"binds,omitempty"`
+	GpuCount  int      `json:"gpuCount,omitempty"`
+	// ArtifactPath is a path in the container, it's copied out as a tar archive after the job exits
+	ArtifactPath string `json:"artifactPath,omitempty"`
+	// Timeout is the max seconds the job runs, the job is killed when it's reached, the default is 3600
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type JobResult struct {
+	Name     string   `json:"name"`
+	ExitCode int64    `json:"exitCode"`
+	TimedOut bool     `json:"timedOut,omitempty"`
+	Gpus     []string `json:"gpus,omitempty"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	// OutputTruncated means stdout or stderr exceeds the max size, only the beginning is kept
+	OutputTruncated bool `json:"outputTruncated,omitempty"`
+	// Artifacts is the tar archive of ArtifactPath
+	Artifacts  []byte `json:"artifacts,omitempty"`
+	StartTime  string `json:"startTime"`
+	FinishTime string `json:"finishTime"`
+}
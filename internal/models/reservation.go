@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+type TokenReservationCreate struct {
+	Count int `json:"count"`
+	// TTL is the seconds the gpus are held if the reservation is not used, the default is 3600
+	TTL int `json:"ttl,omitempty"`
+}
+
+// TokenReservation holds gpus for a future job until its token is used, the key in etcd is the ID, which is the sha256 of the token,
+// the key is attached to a lease, so it disappears when the reservation expires.
+type TokenReservation struct {
+	ID         string   `json:"id"`
+	Gpus       []string `json:"gpus"`
+	ExpireAt   int64    `json:"expireAt"`
+	CreateTime string   `json:"createTime"`
+}
+
+func (r *TokenReservation) Serialize() *string {
+	bytes, _ := json.Marshal(r)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+// ScalingGroup is a group of replicaSets launched from the same spec, the number of replicaSets
+// tracks the target gpu utilization. Each replica is a normal replicaSet named `<group>_<index>`.
+type ScalingGroup struct {
+	Name string       `json:"name"`
+	Spec ContainerRun `json:"spec"`
+	// Replicas is the desired number of replicas, it is adjusted by the controller
+	// when TargetGpuUtilization is set.
+	Replicas    int `json:"replicas"`
+	MinReplicas int `json:"minReplicas"`
+	MaxReplicas int `json:"maxReplicas"`
+	// TargetGpuUtilization is the target average gpu utilization of all replicas in percent,
+	// 0 means no auto-scaling, the controller only keeps the replicas at the desired number.
+	TargetGpuUtilization int `json:"targetGpuUtilization,omitempty"`
+	// Members are the replicaSet names of the replicas which are running
+	Members []string `json:"members,omitempty"`
+}
+
+func (g *ScalingGroup) Serialize() *string {
+	bytes, _ := json.Marshal(g)
+	tmp := string(bytes)
+	return &tmp
+}
+
+type ScalingPatch struct {
+	Replicas             *int `json:"replicas"`
+	MinReplicas          *int `json:"minReplicas"`
+	MaxReplicas          *int `json:"maxReplicas"`
+	TargetGpuUtilization *int `json:"targetGpuUtilization"`
+}
+
+type ScalingReplica struct {
+	ReplicaSetName string         `json:"replicaSetName"`
+	ContainerName  string         `json:"containerName"`
+	Gpus           []string       `json:"gpus"`
+	Utilization    map[string]int `json:"utilization,omitempty"`
+}
+
+type ScalingGroupStatus struct {
+	Group    *ScalingGroup     `json:"group"`
+	Replicas []*ScalingReplica `json:"replicas"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// ContainerStats is a sample of the resource usage of a container
+type ContainerStats struct {
+	ContainerName string    `json:"containerName"`
+	Read          time.Time `json:"read"`
+	// CpuPercent is the usage of all cpus of the host, 100% is one cpu
+	CpuPercent float64 `json:"cpuPercent"`
+	// MemoryUsage excludes the inactive page cache, like docker stats
+	MemoryUsage   uint64  `json:"memoryUsage"`
+	MemoryLimit   uint64  `json:"memoryLimit"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	NetworkRx     uint64  `json:"networkRx"`
+	NetworkTx     uint64  `json:"networkTx"`
+	BlockRead     uint64  `json:"blockRead"`
+	BlockWrite    uint64  `json:"blockWrite"`
+	Pids          uint64  `json:"pids"`
+	// Gpus are the whole gpus of the container, the usage of a shared gpu includes the other containers on it
+	Gpus []*GpuStats `json:"gpus,omitempty"`
+}
+
+// GpuStats is the usage of a gpu, the memory is in MiB
+type GpuStats struct {
+	UUID               string `json:"uuid"`
+	MemoryTotal        int64  `json:"memoryTotal"`
+	MemoryUsed         int64  `json:"memoryUsed"`
+	UtilizationPercent int    `json:"utilizationPercent"`
+}
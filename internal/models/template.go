@@ -0,0 +1,13 @@
+package models
+
+// ContainerTemplate is a ContainerRun spec with placeholders like {{tag}},
+// placeholders can only be used in string fields, e.g. imageName, env, cmd and binds.
+type ContainerTemplate struct {
+	Name string       `json:"name"`
+	Spec ContainerRun `json:"spec"`
+}
+
+type TemplateLaunch struct {
+	ReplicaSetName string            `json:"replicaSetName,omitempty"`
+	Params         map[string]string `json:"params,omitempty"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+type TokenAction = string
+
+const (
+	// TokenActionExecute allows executing a command in the container
+	TokenActionExecute TokenAction = "execute"
+	// TokenActionTerminal allows attaching an interactive terminal to the container
+	TokenActionTerminal TokenAction = "terminal"
+	// TokenActionLogs allows streaming the logs of the container
+	TokenActionLogs TokenAction = "logs"
+)
+
+var TokenActions = map[TokenAction]struct{}{
+	TokenActionExecute:  {},
+	TokenActionTerminal: {},
+	TokenActionLogs:     {},
+}
+
+type AccessTokenCreate struct {
+	Actions []TokenAction `json:"actions"`
+	// TTL is the seconds the token is valid, the default is 300
+	TTL int `json:"ttl,omitempty"`
+}
+
+// AccessToken is a single-use token scoped to one replicaSet and the chosen actions,
+// the key in etcd is the ID, which is the sha256 of the token, the token itself is never saved.
+type AccessToken struct {
+	ID             string        `json:"id"`
+	ReplicaSetName string        `json:"replicaSetName"`
+	Actions        []TokenAction `json:"actions"`
+	ExpireAt       int64         `json:"expireAt"`
+	CreateTime     string        `json:"createTime"`
+}
+
+func (t *AccessToken) Serialize() *string {
+	bytes, _ := json.Marshal(t)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -1,39 +1,211 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 )
 
-var VolumeSizeMap = map[string]struct{}{
-	"KB": {},
-	"MB": {},
-	"GB": {},
-	"TB": {},
-}
-
+// Bind mounts a volume, a path of the host or a tmpfs into the container
 type Bind struct {
-	Src  string `json:"src"`
+	// Type is one of bind, volume and tmpfs, if it's not set, a Src starting with / is a host path, otherwise a volume
+	Type string `json:"type,omitempty"`
+	// Src is the absolute path of the host or the name of the volume, it's empty for a tmpfs
+	Src  string `json:"src,omitempty"`
 	Dest string `json:"dest"`
+	// TmpfsSize limits the memory of a tmpfs, e.g. 16GB for a large /dev/shm, it's not limited if not set
+	TmpfsSize string `json:"tmpfsSize,omitempty"`
+	// ReadOnly protects the shared data, e.g. a dataset, from being changed by the container
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Propagation is the bind propagation of a host path, e.g. rslave, so that the mounts made
+	// on the host after the container started are visible inside, it can't be set for a volume
+	Propagation string `json:"propagation,omitempty"`
+	// Consistency is one of consistent, cached and delegated, it's ignored on linux
+	Consistency string `json:"consistency,omitempty"`
 }
 
+const (
+	BindTypeBind   = "bind"
+	BindTypeVolume = "volume"
+	BindTypeTmpfs  = "tmpfs"
+)
+
+var (
+	BindPropagations  = []string{"private", "rprivate", "shared", "rshared", "slave", "rslave"}
+	BindConsistencies = []string{"consistent", "cached", "delegated"}
+)
+
+// Format returns the bind in the docker format, e.g. /data:/data:ro,rslave, it's empty for a tmpfs,
+// which is not a bind in docker
 func (b *Bind) Format() string {
-	if len(b.Src) == 0 || len(b.Dest) == 0 {
+	if b.Type == BindTypeTmpfs || len(b.Src) == 0 || len(b.Dest) == 0 {
 		return ""
 	}
-	return fmt.Sprintf("%s:%s", b.Src, b.Dest)
+	var options []string
+	if b.ReadOnly {
+		options = append(options, "ro")
+	}
+	if len(b.Propagation) != 0 {
+		options = append(options, b.Propagation)
+	}
+	if len(b.Consistency) != 0 {
+		options = append(options, b.Consistency)
+	}
+	if len(options) == 0 {
+		return fmt.Sprintf("%s:%s", b.Src, b.Dest)
+	}
+	return fmt.Sprintf("%s:%s:%s", b.Src, b.Dest, strings.Join(options, ","))
+}
+
+// IsHostPath means the Src is a path of the host instead of a volume,
+// the prefix of Src is only guessed if the Type is not set
+func (b *Bind) IsHostPath() bool {
+	if len(b.Type) != 0 {
+		return b.Type == BindTypeBind
+	}
+	return strings.HasPrefix(b.Src, "/")
+}
+
+// IsTmpfs means the Dest is a tmpfs in the memory
+func (b *Bind) IsTmpfs() bool {
+	return b.Type == BindTypeTmpfs
+}
+
+// Valid means the bind can be mounted by docker, docker decides whether the Src is a host path by the prefix,
+// so a host path must be absolute and a volume name must not contain /, e.g. a relative path or a windows path
+func (b *Bind) Valid() bool {
+	if strings.Contains(b.Dest, ":") || !strings.HasPrefix(b.Dest, "/") || strings.Contains(b.Src, ":") {
+		return false
+	}
+	switch b.Type {
+	case "":
+		if !strings.HasPrefix(b.Src, "/") && strings.Contains(b.Src, "/") {
+			return false
+		}
+	case BindTypeBind:
+		if !strings.HasPrefix(b.Src, "/") {
+			return false
+		}
+	case BindTypeVolume:
+		if strings.Contains(b.Src, "/") {
+			return false
+		}
+	case BindTypeTmpfs:
+		return len(b.Src) == 0 && len(b.Propagation) == 0 && len(b.Consistency) == 0
+	default:
+		return false
+	}
+	if len(b.TmpfsSize) != 0 || len(b.Format()) == 0 {
+		return false
+	}
+	if len(b.Propagation) != 0 && (!b.IsHostPath() || !slices.Contains(BindPropagations, b.Propagation)) {
+		return false
+	}
+	return len(b.Consistency) == 0 || slices.Contains(BindConsistencies, b.Consistency)
 }
 
 type VolumeCreate struct {
 	Name string `json:"name,omitempty"`
 	Size string `json:"size,omitempty"`
+	// Encryption creates the volume on an encrypted filesystem, it can't be used together with size
+	Encryption *VolumeEncryption `json:"encryption,omitempty"`
+}
+
+// VolumeEncryption is the encryption metadata of a volume, the key itself is kept in the secret store
+type VolumeEncryption struct {
+	// KeyID is the name of the key in the secret store
+	KeyID     string `json:"keyId"`
+	Type      string `json:"type,omitempty"`
+	CipherDir string `json:"cipherDir,omitempty"`
 }
 
 type VolumeSize struct {
 	Size string `json:"size"` // KB, MB, GB, TB
 }
 
+// VolumeOptionsPatch is merged into the driver options, an empty value removes the option,
+// e.g. {"o": "addr=10.0.0.2,rw"} changes the address of the nfs server.
+type VolumeOptionsPatch struct {
+	DriverOpts map[string]string `json:"driverOpts"`
+}
+
+type VolumeOptionChange struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+type VolumeMigrate struct {
+	Driver     string            `json:"driver"`
+	DriverOpts map[string]string `json:"driverOpts,omitempty"`
+}
+
 type VolumeHistoryItem struct {
 	Version    int64          `json:"version"`
 	CreateTime string         `json:"createTime"`
 	Status     EtcdVolumeInfo `json:"status"`
 }
+
+// VolumeRetention is the retention policy of all versions of a volume.
+// The latest version and the versions used by containers are never pruned,
+// other versions are pruned only when they are neither in the last KeepLast versions nor created within KeepDays days.
+// Zero means the rule is not set.
+type VolumeRetention struct {
+	KeepLast int `json:"keepLast"`
+	KeepDays int `json:"keepDays"`
+}
+
+type VolumeStatus = string
+
+const (
+	// VolumePending means the data of the old version is being copied to the latest version, it must not be mounted yet
+	VolumePending VolumeStatus = "pending"
+	VolumeReady   VolumeStatus = "ready"
+)
+
+// VolumeSpace is the space used by the latest version of a volume, compared with its size, so the clients
+// can warn before a resize. SizeBytes is 0 if the driver doesn't limit the size, UsedBytes is -1 if it can't be measured
+// from the host, e.g. the volume on a nfs server, the Reason tells why.
+type VolumeSpace struct {
+	VolumeName string `json:"volumeName"`
+	Driver     string `json:"driver"`
+	Size       string `json:"size,omitempty"`
+	SizeBytes  int64  `json:"sizeBytes"`
+	UsedBytes  int64  `json:"usedBytes"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// VolumeDeleteReport is the result of deleting all versions of a volume,
+// InUse are the versions kept and the containers mounting them
+type VolumeDeleteReport struct {
+	Removed []string            `json:"removed"`
+	InUse   map[string][]string `json:"inUse"`
+	Failed  []string            `json:"failed"`
+}
+
+type VolumePruneReport struct {
+	DryRun         bool     `json:"dryRun"`
+	Removed        []string `json:"removed"`
+	InUse          []string `json:"inUse"`
+	Failed         []string `json:"failed"`
+	ReclaimedBytes int64    `json:"reclaimedBytes"`
+}
+
+// VolumeUsage records that a container version mounted a volume version,
+// the key in etcd is the volume version name and the container version name, e.g. "data-2/train-3".
+type VolumeUsage struct {
+	VolumeName       string `json:"volumeName"`
+	VolumeVersion    int64  `json:"volumeVersion"`
+	ReplicaSetName   string `json:"replicaSetName"`
+	ContainerVersion int64  `json:"containerVersion"`
+	ContainerName    string `json:"containerName"`
+	StartTime        string `json:"startTime"`
+	// EndTime is set when the container version is replaced or deleted
+	EndTime string `json:"endTime,omitempty"`
+}
+
+func (u *VolumeUsage) Serialize() *string {
+	bytes, _ := json.Marshal(u)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+type EventType = string
+
+const (
+	EventContainerCreated EventType = "container.created"
+	EventContainerPatched EventType = "container.patched"
+	EventContainerDeleted EventType = "container.deleted"
+	EventContainerRenamed EventType = "container.renamed"
+	EventVolumeCreated    EventType = "volume.created"
+	EventVolumePatched    EventType = "volume.patched"
+	EventVolumeDeleted    EventType = "volume.deleted"
+	// EventGpuExhausted means a request is rejected because not enough gpus are free
+	EventGpuExhausted EventType = "gpu.exhausted"
+)
+
+var EventTypes = map[EventType]struct{}{
+	EventContainerCreated: {},
+	EventContainerPatched: {},
+	EventContainerDeleted: {},
+	EventContainerRenamed: {},
+	EventVolumeCreated:    {},
+	EventVolumePatched:    {},
+	EventVolumeDeleted:    {},
+	EventGpuExhausted:     {},
+}
+
+// Webhook is an endpoint notified of the lifecycle events, the key in etcd is the name
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Events are the event types the webhook subscribes to, empty means all
+	Events     []EventType `json:"events,omitempty"`
+	CreateTime string      `json:"createTime"`
+}
+
+func (w *Webhook) Serialize() *string {
+	bytes, _ := json.Marshal(w)
+	tmp := string(bytes)
+	return &tmp
+}
+
+// Event is posted to the webhooks as the body, Name is the replicaSet or volume, or the owner for gpu events.
+// Version is the version of the container or volume the event is about, it's omitted for the gpu events.
+type Event struct {
+	Type    EventType              `json:"type"`
+	Name    string                 `json:"name"`
+	Version int64                  `json:"version,omitempty"`
+	Time    string                 `json:"time"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
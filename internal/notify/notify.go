@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// The lifecycle events are emitted by services and schedulers, and posted to the subscribed webhooks
+// in the background, so that a slow or dead endpoint never blocks the api.
+
+const (
+	deliverTimeout     = 10 * time.Second
+	deliverMaxAttempts = 3
+	deliverBackoff     = 1 * time.Second
+	// eventBufferSize is the number of events waiting for delivery, the new events are dropped when it's full
+	eventBufferSize = 1024
+)
+
+var (
+	mu       sync.RWMutex
+	webhooks = make(map[string]*models.Webhook)
+
+	events = make(chan models.Event, eventBufferSize)
+	client = &http.Client{Timeout: deliverTimeout}
+)
+
+// Init loads the webhooks from etcd
+func Init() error {
+	kvs, err := etcd.List(etcd.Webhooks)
+	if err != nil {
+		return errors.WithMessage(err, "etcd.List failed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, value := range kvs {
+		var hook models.Webhook
+		if err = json.Unmarshal(value, &hook); err != nil {
+			log.Errorf("notify.Init, webhook: %s is invalid, error: %v", name, err)
+			continue
+		}
+		webhooks[name] = &hook
+	}
+	return nil
+}
+
+// Set adds the webhook, the webhook with the same name will be replaced
+func Set(hook *models.Webhook) {
+	mu.Lock()
+	defer mu.Unlock()
+	webhooks[hook.Name] = hook
+}
+
+// Remove the webhook, it reports whether the webhook existed
+func Remove(name string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := webhooks[name]
+	delete(webhooks, name)
+	return ok
+}
+
+func Webhooks() []*models.Webhook {
+	mu.RLock()
+	defer mu.RUnlock()
+	hooks := make([]*models.Webhook, 0, len(webhooks))
+	for _, hook := range webhooks {
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// Emit queues the event for delivery and streams it to the subscribers without waiting
+func Emit(eventType models.EventType, name string, data map[string]interface{}) {
+	event := models.Event{
+		Type:    eventType,
+		Name:    name,
+		Version: eventVersion(data),
+		Time:    time.Now().Format("2006-01-02 15:04:05"),
+		Data:    data,
+	}
+	publish(event)
+	select {
+	case events <- event:
+	default:
+		log.Errorf("notify.Emit, too many events waiting for delivery, event: %s of %s is dropped", eventType, name)
+	}
+}
+
+// DeliverLoop posts the events to the webhooks subscribed to them
+func DeliverLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			body, _ := json.Marshal(event)
+			for _, hook := range subscribers(event.Type) {
+				go deliver(ctx, hook, event, body)
+			}
+		}
+	}
+}
+
+func subscribers(eventType models.EventType) []*models.Webhook {
+	mu.RLock()
+	defer mu.RUnlock()
+	var hooks []*models.Webhook
+	for _, hook := range webhooks {
+		if len(hook.Events) == 0 {
+			hooks = append(hooks, hook)
+			continue
+		}
+		for _, t := range hook.Events {
+			if t == eventType {
+				hooks = append(hooks, hook)
+				break
+			}
+		}
+	}
+	return hooks
+}
+
+// deliver posts the event with exponential backoff until deliverMaxAttempts is reached
+func deliver(ctx context.Context, hook *models.Webhook, event models.Event, body []byte) {
+	backoff := deliverBackoff
+	for attempt := 1; attempt <= deliverMaxAttempts; attempt++ {
+		err := post(ctx, hook.URL, body)
+		if err == nil {
+			return
+		}
+		log.Errorf("notify.deliver, post event: %s of %s to webhook: %s failed, attempt: %d/%d, error: %v",
+			event.Type, event.Name, hook.Name, attempt, deliverMaxAttempts, err)
+		if attempt < deliverMaxAttempts {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "http.NewRequest failed, url: %s", url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "http.Post failed, url: %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("webhook: %s returned status: %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// TestDeliverLoop posts the events to the webhooks subscribed to them, a webhook without events subscribes to all
+func TestDeliverLoop(t *testing.T) {
+	var mu sync.Mutex
+	posted := make(map[string][]models.EventType)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event models.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decode the event error = %v", err)
+		}
+		mu.Lock()
+		posted[r.URL.Path] = append(posted[r.URL.Path], event.Type)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	hooks := []*models.Webhook{
+		{Name: "all", URL: server.URL + "/all"},
+		{Name: "containers", URL: server.URL + "/containers",
+			Events: []models.EventType{models.EventContainerCreated, models.EventContainerDeleted}},
+		{Name: "gpus", URL: server.URL + "/gpus", Events: []models.EventType{models.EventGpuExhausted}},
+	}
+	for _, hook := range hooks {
+		Set(hook)
+		defer Remove(hook.Name)
+	}
+	// the events emitted by the other tests are left in the queue of delivery
+	for len(events) > 0 {
+		<-events
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go DeliverLoop(ctx)
+
+	emitted := []models.EventType{models.EventContainerCreated, models.EventVolumePatched, models.EventContainerDeleted}
+	for _, eventType := range emitted {
+		Emit(eventType, "foo", nil)
+	}
+
+	want := map[string][]models.EventType{
+		"/all":        {models.EventContainerCreated, models.EventContainerDeleted, models.EventVolumePatched},
+		"/containers": {models.EventContainerCreated, models.EventContainerDeleted},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := make(map[string][]models.EventType, len(posted))
+		for path, types := range posted {
+			got[path] = append([]models.EventType(nil), types...)
+			// the events are posted concurrently, so they may arrive out of order
+			sort.Strings(got[path])
+		}
+		mu.Unlock()
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("webhooks received %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ngaut/log"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// The events are also streamed to the in-process subscribers, e.g. the clients of the event stream api,
+// a subscriber that doesn't keep up misses events rather than slowing the others down.
+
+// streamBufferSize is the number of events waiting for a subscriber
+const streamBufferSize = 64
+
+type stream struct {
+	events chan models.Event
+	types  map[models.EventType]struct{}
+}
+
+var (
+	streamsMu sync.RWMutex
+	streams   = make(map[*stream]struct{})
+)
+
+// Subscribe returns the events of the types from now on, empty types means all,
+// the cancel must be called when the events are no longer read, it closes the channel.
+func Subscribe(types []models.EventType) (<-chan models.Event, func()) {
+	s := &stream{
+		events: make(chan models.Event, streamBufferSize),
+		types:  make(map[models.EventType]struct{}, len(types)),
+	}
+	for _, t := range types {
+		s.types[t] = struct{}{}
+	}
+
+	streamsMu.Lock()
+	streams[s] = struct{}{}
+	streamsMu.Unlock()
+
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			streamsMu.Lock()
+			delete(streams, s)
+			streamsMu.Unlock()
+			close(s.events)
+		})
+	}
+}
+
+// publish sends the event to the subscribers of its type without waiting
+func publish(event models.Event) {
+	streamsMu.RLock()
+	defer streamsMu.RUnlock()
+	for s := range streams {
+		if _, ok := s.types[event.Type]; len(s.types) != 0 && !ok {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			log.Warnf("notify.publish, a subscriber is too slow, event: %s of %s is dropped for it", event.Type, event.Name)
+		}
+	}
+}
+
+// eventVersion is the version of the container or volume in the data, e.g. 3 of foo-3, 0 if there is none
+func eventVersion(data map[string]interface{}) int64 {
+	for _, key := range []string{"containerName", "volumeName"} {
+		name, ok := data[key].(string)
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(name, "-"); i != -1 {
+			if version, err := strconv.ParseInt(name[i+1:], 10, 64); err == nil {
+				return version
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// received drains the events streamed so far
+func received(events <-chan models.Event) []models.Event {
+	var got []models.Event
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		default:
+			return got
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []models.EventType
+		want  []models.EventType
+	}{
+		{
+			name: "all",
+			want: []models.EventType{models.EventContainerCreated, models.EventVolumeDeleted, models.EventGpuExhausted},
+		},
+		{
+			name:  "one type",
+			types: []models.EventType{models.EventVolumeDeleted},
+			want:  []models.EventType{models.EventVolumeDeleted},
+		},
+		{
+			name:  "two types",
+			types: []models.EventType{models.EventContainerCreated, models.EventGpuExhausted},
+			want:  []models.EventType{models.EventContainerCreated, models.EventGpuExhausted},
+		},
+		{
+			name:  "none of the types",
+			types: []models.EventType{models.EventContainerRenamed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, cancel := Subscribe(tt.types)
+			defer cancel()
+			Emit(models.EventContainerCreated, "foo", map[string]interface{}{"containerName": "foo-1"})
+			Emit(models.EventVolumeDeleted, "bar", map[string]interface{}{"volumeName": "bar-2"})
+			Emit(models.EventGpuExhausted, "foo", nil)
+
+			var got []models.EventType
+			for _, event := range received(events) {
+				got = append(got, event.Type)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Subscribe(%v) received %v, want %v", tt.types, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmit(t *testing.T) {
+	events, cancel := Subscribe(nil)
+	defer cancel()
+	data := map[string]interface{}{"containerName": "foo-3", "gpus": []string{"gpu-0"}}
+	before := time.Now().Truncate(time.Second)
+	Emit(models.EventContainerPatched, "foo", data)
+
+	got := received(events)
+	if len(got) != 1 {
+		t.Fatalf("Emit() streamed %d events, want 1", len(got))
+	}
+	event := got[0]
+	if event.Type != models.EventContainerPatched || event.Name != "foo" || event.Version != 3 || !reflect.DeepEqual(event.Data, data) {
+		t.Errorf("Emit() streamed %+v, want the patch of foo-3", event)
+	}
+	at, err := time.ParseInLocation("2006-01-02 15:04:05", event.Time, time.Local)
+	if err != nil || at.Before(before) || at.After(time.Now()) {
+		t.Errorf("Emit() time = %q, %v, want now", event.Time, err)
+	}
+}
+
+func TestEventVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want int64
+	}{
+		{name: "container", data: map[string]interface{}{"containerName": "foo-3"}, want: 3},
+		{name: "volume", data: map[string]interface{}{"volumeName": "bar-12"}, want: 12},
+		{name: "base name with a dash", data: map[string]interface{}{"containerName": "foo-bar-2"}, want: 2},
+		{name: "container before volume", data: map[string]interface{}{"containerName": "foo-1", "volumeName": "bar-2"}, want: 1},
+		{name: "without version", data: map[string]interface{}{"containerName": "foo"}},
+		{name: "not a number", data: map[string]interface{}{"volumeName": "foo-bar"}},
+		{name: "not a string", data: map[string]interface{}{"volumeNames": []string{"foo-1"}}},
+		{name: "no data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventVersion(tt.data); got != tt.want {
+				t.Errorf("eventVersion(%v) = %d, want %d", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	events, cancel := Subscribe(nil)
+	cancel()
+	// the cancel may be called again, e.g. by a deferred call after the client left
+	cancel()
+	Emit(models.EventVolumeCreated, "foo", nil)
+	if _, ok := <-events; ok {
+		t.Error("an event is streamed after the cancel, want the channel closed")
+	}
+}
+
+// TestSlowSubscriber fills the buffer of a subscriber, the events beyond it are dropped for it only
+func TestSlowSubscriber(t *testing.T) {
+	slow, cancelSlow := Subscribe(nil)
+	defer cancelSlow()
+	for i := 0; i < streamBufferSize; i++ {
+		Emit(models.EventVolumeCreated, "foo", nil)
+	}
+
+	fast, cancelFast := Subscribe(nil)
+	defer cancelFast()
+	Emit(models.EventVolumeDeleted, "foo", nil)
+
+	if got := received(fast); len(got) != 1 || got[0].Type != models.EventVolumeDeleted {
+		t.Errorf("fast subscriber received %v, want the deletion", got)
+	}
+	got := received(slow)
+	if len(got) != streamBufferSize {
+		t.Fatalf("slow subscriber received %d events, want %d", len(got), streamBufferSize)
+	}
+	for _, event := range got {
+		if event.Type != models.EventVolumeCreated {
+			t.Fatalf("slow subscriber received %s, want the deletion dropped", event.Type)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package projection
+
+import (
+	"encoding/json"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// The projection mirrors the container and volume records of etcd into a queryable store,
+// as they pass through the WorkQueue, so that dashboards can query them without hammering etcd.
+// It is eventually consistent, and rebuilt from etcd on startup.
+// Every record carries the etcd revision it was written at, a change older than the record is ignored,
+// so a rebuild racing with the WorkQueue never overwrites a newer change.
+
+const (
+	StateActive     = "active"
+	StateIncomplete = "incomplete"
+
+	// jobIDLabel is the container label of the external job id, the same as the one set by services
+	jobIDLabel = "gpu-docker-api.job-id"
+)
+
+type Record struct {
+	Resource   string `json:"resource"`
+	Name       string `json:"name"`
+	Version    int64  `json:"version"`
+	State      string `json:"state"`
+	Owner      string `json:"owner,omitempty"`
+	GpuCount   int    `json:"gpuCount"`
+	CreateTime string `json:"createTime"`
+	// Revision is the etcd revision the record was written at
+	Revision int64 `json:"revision"`
+}
+
+// Filter of the query, the zero value of a field matches all
+type Filter struct {
+	Resource string
+	Prefix   string
+	State    string
+	Owner    string
+	MinGpus  int
+}
+
+// Store is the secondary store of the projection, the records are kept in SQLite or Postgres
+type Store interface {
+	// Upsert writes the record unless the stored record or its deletion has a newer revision
+	Upsert(record *Record) error
+	// Delete deletes the record unless the stored record has a newer revision
+	Delete(resource, name string, revision int64) error
+	Query(filter Filter) ([]*Record, error)
+	// Rebuild replaces the records of the resource changed up to the revision with the records listed at it
+	Rebuild(resource string, records []*Record, revision int64) error
+	Close() error
+}
+
+var store Store
+
+// Init enables the projection with the store opened by the driver, sqlite or postgres, and rebuilds it from etcd
+func Init(enabled bool, driver, dsn string) (err error) {
+	if !enabled {
+		return nil
+	}
+	if store, err = newSQLStore(driver, dsn); err != nil {
+		return errors.WithMessage(err, "newSQLStore failed")
+	}
+	return Rebuild()
+}
+
+func Enabled() bool {
+	return store != nil
+}
+
+func Close() error {
+	if store == nil {
+		return nil
+	}
+	return store.Close()
+}
+
+// Rebuild the projection from the records in etcd
+func Rebuild() error {
+	if store == nil {
+		return nil
+	}
+	for _, resource := range []etcd.Resource{etcd.Containers, etcd.Volumes} {
+		kvs, revision, err := etcd.ListRevision(resource)
+		if err != nil {
+			return errors.WithMessagef(err, "etcd.ListRevision failed, resource: %s", resource)
+		}
+		records := make([]*Record, 0, len(kvs))
+		for key, kv := range kvs {
+			if record := parse(resource, key, kv.Value, kv.ModRevision); record != nil {
+				records = append(records, record)
+			}
+		}
+		if err = store.Rebuild(resource, records, revision); err != nil {
+			return errors.WithMessagef(err, "store.Rebuild failed, resource: %s", resource)
+		}
+		log.Infof("projection.Rebuild, %d records of %s rebuilt at revision: %d", len(records), resource, revision)
+	}
+	return nil
+}
+
+// Apply the WorkQueue item which has been written to etcd successfully at the revision,
+// a failed write is left to the next rebuild
+func Apply(item interface{}, revision int64) {
+	if store == nil {
+		return
+	}
+	switch v := item.(type) {
+	case etcd.PutKeyValue:
+		record := parse(v.Resource, v.Key, []byte(*v.Value), revision)
+		if record == nil {
+			return
+		}
+		if err := store.Upsert(record); err != nil {
+			log.Errorf("projection.Apply, upsert %s: %s failed, error: %v", v.Resource, v.Key, err)
+		}
+	case etcd.DelKey:
+		if v.Resource != etcd.Containers && v.Resource != etcd.Volumes {
+			return
+		}
+		if err := store.Delete(v.Resource, v.Key, revision); err != nil {
+			log.Errorf("projection.Apply, delete %s: %s failed, error: %v", v.Resource, v.Key, err)
+		}
+	}
+}
+
+func Query(filter Filter) ([]*Record, error) {
+	if store == nil {
+		return nil, nil
+	}
+	return store.Query(filter)
+}
+
+// parse returns the record of the etcd value, nil if the resource is not projected or the value is invalid
+func parse(resource etcd.Resource, key string, value []byte, revision int64) *Record {
+	var record *Record
+	switch resource {
+	case etcd.Containers:
+		var info models.EtcdContainerInfo
+		if err := json.Unmarshal(value, &info); err != nil {
+			log.Errorf("projection.parse, container: %s json.Unmarshal failed, error: %v", key, err)
+			return nil
+		}
+		record = &Record{
+			Version:    info.Version,
+			State:      state(info.Incomplete),
+			CreateTime: info.CreateTime,
+		}
+		if info.Config != nil {
+			record.Owner = info.Config.Labels[jobIDLabel]
+		}
+		if info.HostConfig != nil && len(info.HostConfig.DeviceRequests) > 0 {
+			record.GpuCount = len(info.HostConfig.DeviceRequests[0].DeviceIDs)
+		}
+	case etcd.Volumes:
+		var info models.EtcdVolumeInfo
+		if err := json.Unmarshal(value, &info); err != nil {
+			log.Errorf("projection.parse, volume: %s json.Unmarshal failed, error: %v", key, err)
+			return nil
+		}
+		record = &Record{
+			Version:    info.Version,
+			State:      state(info.Incomplete),
+			CreateTime: info.CreateTime,
+		}
+	default:
+		return nil
+	}
+	record.Resource = resource
+	record.Name = key
+	record.Revision = revision
+	return record
+}
+
+func state(incomplete bool) string {
+	if incomplete {
+		return StateIncomplete
+	}
+	return StateActive
+}
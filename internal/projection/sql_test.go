@@ -0,0 +1,214 @@
+package projection
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestStore(t *testing.T, path string) *sqlStore {
+	t.Helper()
+	s, err := newSQLStore(DriverSQLite, path)
+	if err != nil {
+		t.Fatalf("newSQLStore() error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func names(records []*Record) []string {
+	names := make([]string, 0, len(records))
+	for _, record := range records {
+		names = append(names, record.Name)
+	}
+	return names
+}
+
+// change is a put or, if deleted is set, a delete of the record at the revision
+type change struct {
+	record  Record
+	deleted bool
+}
+
+func TestOrderedChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		changes     []change
+		want        []string
+		wantVersion int64
+	}{
+		{
+			name: "newer put",
+			changes: []change{
+				{record: Record{Name: "foo", Version: 1, Revision: 10}},
+				{record: Record{Name: "foo", Version: 2, Revision: 11}},
+			},
+			want:        []string{"foo"},
+			wantVersion: 2,
+		},
+		{
+			name: "older put applied later",
+			changes: []change{
+				{record: Record{Name: "foo", Version: 2, Revision: 11}},
+				{record: Record{Name: "foo", Version: 1, Revision: 10}},
+			},
+			want:        []string{"foo"},
+			wantVersion: 2,
+		},
+		{
+			name: "deleted",
+			changes: []change{
+				{record: Record{Name: "foo", Version: 1, Revision: 10}},
+				{record: Record{Name: "foo", Revision: 11}, deleted: true},
+			},
+			want: []string{},
+		},
+		{
+			name: "older put applied after the delete",
+			changes: []change{
+				{record: Record{Name: "foo", Revision: 11}, deleted: true},
+				{record: Record{Name: "foo", Version: 1, Revision: 10}},
+			},
+			want: []string{},
+		},
+		{
+			name: "created again after the delete",
+			changes: []change{
+				{record: Record{Name: "foo", Version: 1, Revision: 10}},
+				{record: Record{Name: "foo", Revision: 11}, deleted: true},
+				{record: Record{Name: "foo", Version: 1, Revision: 12}},
+			},
+			want:        []string{"foo"},
+			wantVersion: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, filepath.Join(t.TempDir(), "projection.db"))
+			for _, c := range tt.changes {
+				c.record.Resource, c.record.State = "containers", StateActive
+				var err error
+				if c.deleted {
+					err = s.Delete(c.record.Resource, c.record.Name, c.record.Revision)
+				} else {
+					err = s.Upsert(&c.record)
+				}
+				if err != nil {
+					t.Fatalf("change %+v error = %v", c, err)
+				}
+			}
+			records, err := s.Query(Filter{Resource: "containers"})
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if got := names(records); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Query() = %v, want %v", got, tt.want)
+			}
+			if len(records) != 0 && records[0].Version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", records[0].Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "projection.db"))
+	for i, record := range []Record{
+		{Resource: "containers", Name: "train-a", State: StateActive, Owner: "job1", GpuCount: 2},
+		{Resource: "containers", Name: "train_b", State: StateIncomplete, Owner: "job2", GpuCount: 1},
+		{Resource: "containers", Name: "Train-c", State: StateActive},
+		{Resource: "volumes", Name: "train-data", State: StateActive},
+	} {
+		record.Revision = int64(i + 1)
+		if err := s.Upsert(&record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{name: "resource", filter: Filter{Resource: "containers"}, want: []string{"Train-c", "train-a", "train_b"}},
+		{name: "prefix is case-sensitive", filter: Filter{Resource: "containers", Prefix: "train"}, want: []string{"train-a", "train_b"}},
+		{name: "prefix with wildcard", filter: Filter{Resource: "containers", Prefix: "train_"}, want: []string{"train_b"}},
+		{name: "state", filter: Filter{Resource: "containers", State: StateIncomplete}, want: []string{"train_b"}},
+		{name: "owner", filter: Filter{Owner: "job1"}, want: []string{"train-a"}},
+		{name: "min gpus", filter: Filter{MinGpus: 1}, want: []string{"train-a", "train_b"}},
+		{name: "volumes", filter: Filter{Resource: "volumes", Prefix: "train"}, want: []string{"train-data"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := s.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if got := names(records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query(%+v) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRebuild lists the records at revision 20, the changes applied after the list are kept
+func TestRebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "projection.db")
+	s := newTestStore(t, path)
+	for _, record := range []Record{
+		{Name: "stale", Revision: 5},
+		{Name: "updated", Version: 1, Revision: 6},
+		{Name: "newer", Version: 2, Revision: 21},
+	} {
+		record.Resource = "containers"
+		if err := s.Upsert(&record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("containers", "deleted", 22); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := []*Record{
+		{Resource: "containers", Name: "updated", Version: 2, Revision: 15},
+		{Resource: "containers", Name: "newer", Version: 1, Revision: 12},
+		{Resource: "containers", Name: "deleted", Version: 1, Revision: 13},
+	}
+	if err := s.Rebuild("containers", listed, 20); err != nil {
+		t.Fatalf("Rebuild() error = %v", err)
+	}
+	_ = s.Close()
+
+	// the records persist across restarts
+	s = newTestStore(t, path)
+	records, err := s.Query(Filter{Resource: "containers"})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	got := make(map[string]int64, len(records))
+	for _, record := range records {
+		got[record.Name] = record.Version
+	}
+	if want := map[string]int64{"newer": 2, "updated": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() after Rebuild = %v, want %v", got, want)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		driver string
+		query  string
+		want   string
+	}{
+		{driver: DriverSQLite, query: "a = ? AND b = ?", want: "a = ? AND b = ?"},
+		{driver: DriverPostgres, query: "a = ? AND b = ?", want: "a = $1 AND b = $2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			s := &sqlStore{driver: tt.driver}
+			if got := s.rebind(tt.query); got != tt.want {
+				t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -41,6 +41,133 @@ const (
 	CodeVolumeGetInfoFailed                          ResCode = 1033
 	CodeVolumeGetHistoryFailed                       ResCode = 1034
 	CodeVolumePatchFailed                            ResCode = 1035
+	CodeContainerStorageOptSizeNotSupported          ResCode = 1036
+	CodeContainerStorageOptNotSupported              ResCode = 1037
+	CodeContainerCloneFailed                         ResCode = 1038
+	CodeContainerWaitFailed                          ResCode = 1039
+	CodeContainerGpuDriverOptionsInvalid             ResCode = 1040
+	CodeVolumeRetentionInvalid                       ResCode = 1041
+	CodeVolumeRetentionSetFailed                     ResCode = 1042
+	CodeVolumeRetentionGetFailed                     ResCode = 1043
+	CodeVolumePruneFailed                            ResCode = 1044
+	CodeTemplateNameCannotBeEmpty                    ResCode = 1045
+	CodeTemplateSaveFailed                           ResCode = 1046
+	CodeTemplateGetInfoFailed                        ResCode = 1047
+	CodeTemplateDeleteFailed                         ResCode = 1048
+	CodeTemplateParamsMissing                        ResCode = 1049
+	CodeTemplateRenderFailed                         ResCode = 1050
+	CodeVolumeDriverCannotBeEmpty                    ResCode = 1051
+	CodeVolumeInUse                                  ResCode = 1052
+	CodeVolumeNoNeedMigrate                          ResCode = 1053
+	CodeVolumeMigrateFailed                          ResCode = 1054
+	CodeContainerPortInvalid                         ResCode = 1055
+	CodeDiagnosticsReportFailed                      ResCode = 1056
+	CodeContainerResourceRequestInvalid              ResCode = 1057
+	CodeContainerResourceNotEnough                   ResCode = 1058
+	CodeVersionRepairFailed                          ResCode = 1059
+	CodeContainerGpuMpsInvalid                       ResCode = 1060
+	CodeContainerNvidiaRuntimeMissing                ResCode = 1061
+	CodeDeadLetterIDCannotBeEmpty                    ResCode = 1062
+	CodeDeadLetterListFailed                         ResCode = 1063
+	CodeDeadLetterGetInfoFailed                      ResCode = 1064
+	CodeDeadLetterRequeueFailed                      ResCode = 1065
+	CodeScalingGroupNameCannotBeEmpty                ResCode = 1066
+	CodeScalingGroupExisted                          ResCode = 1067
+	CodeScalingGroupInvalid                          ResCode = 1068
+	CodeScalingGroupCreateFailed                     ResCode = 1069
+	CodeScalingGroupGetInfoFailed                    ResCode = 1070
+	CodeScalingGroupPatchFailed                      ResCode = 1071
+	CodeScalingGroupDeleteFailed                     ResCode = 1072
+	CodeContainerHostnameInvalid                     ResCode = 1073
+	CodeContainerTopFailed                           ResCode = 1074
+	CodeContainerProcessNotFound                     ResCode = 1075
+	CodeContainerSignalInvalid                       ResCode = 1076
+	CodeContainerKillProcessFailed                   ResCode = 1077
+	CodeContainerGpuFractionInvalid                  ResCode = 1078
+	CodeProjectionDisabled                           ResCode = 1079
+	CodeProjectionRebuildFailed                      ResCode = 1080
+	CodeContainerPatchStrategyInvalid                ResCode = 1081
+	CodePortRepairFailed                             ResCode = 1082
+	CodeContainerProfilerNotAllowed                  ResCode = 1083
+	CodeContainerProfileFailed                       ResCode = 1084
+	CodeContainerLimitReached                        ResCode = 1085
+	CodeContainerLimitInvalid                        ResCode = 1086
+	CodeResourceStatusFailed                         ResCode = 1087
+	CodeVolumeEncryptionInvalid                      ResCode = 1088
+	CodeVolumeEncryptionKeyUnavailable               ResCode = 1089
+	CodeContainerCheckpointNotSupported              ResCode = 1090
+	CodeContainerCheckpointFailed                    ResCode = 1091
+	CodeTokenActionsInvalid                          ResCode = 1092
+	CodeTokenCreateFailed                            ResCode = 1093
+	CodeTokenIDCannotBeEmpty                         ResCode = 1094
+	CodeTokenRevokeFailed                            ResCode = 1095
+	CodeTokenInvalid                                 ResCode = 1096
+	CodeContainerGpuLabelsInvalid                    ResCode = 1097
+	CodeContainerGpuConflict                         ResCode = 1098
+	CodeContainerGpuOrderInvalid                     ResCode = 1099
+	CodeWebhookInvalid                               ResCode = 1100
+	CodeWebhookSaveFailed                            ResCode = 1101
+	CodeWebhookDeleteFailed                          ResCode = 1102
+	CodeContainerOomScoreAdjInvalid                  ResCode = 1103
+	CodeVolumeUsageGetFailed                         ResCode = 1104
+	CodeContainerSoftDeleteFailed                    ResCode = 1105
+	CodeContainerAlreadyArchived                     ResCode = 1106
+	CodeContainerNotArchived                         ResCode = 1107
+	CodeContainerUndeleteFailed                      ResCode = 1108
+	CodeContainerRuntimeNotSupported                 ResCode = 1109
+	CodeContainerRuntimeGpuIncompatible              ResCode = 1110
+	CodeGpuReservationInvalid                        ResCode = 1111
+	CodeGpuReservationParamsInvalid                  ResCode = 1112
+	CodeGpuReservationCreateFailed                   ResCode = 1113
+	CodeGpuReservationReleaseFailed                  ResCode = 1114
+	CodeContainerNetworkBandwidthInvalid             ResCode = 1115
+	CodeContainerTcNotAvailable                      ResCode = 1116
+	CodeVolumeOptionsInvalid                         ResCode = 1117
+	CodeVolumeOptionsNoNeedPatch                     ResCode = 1118
+	CodeJobTimeoutInvalid                            ResCode = 1119
+	CodeJobRunFailed                                 ResCode = 1120
+	CodeGpuCountExceeded                             ResCode = 1121
+	CodeContainerListFailed                          ResCode = 1122
+	CodeContainerVersionNotFound                     ResCode = 1123
+	CodeContainerLogsFailed                          ResCode = 1124
+	CodeCopyNotFound                                 ResCode = 1125
+	CodeCopyGetProgressFailed                        ResCode = 1126
+	CodeGpuUnhealthy                                 ResCode = 1127
+	CodeGpuListFailed                                ResCode = 1128
+	CodeContainerResourceExceedsHost                 ResCode = 1129
+	CodeContainerCpusetInvalid                       ResCode = 1130
+	CodeContainerEnvPatchInvalid                     ResCode = 1131
+	CodeContainerImagePullFailed                     ResCode = 1132
+	CodeContainerHealthCheckInvalid                  ResCode = 1133
+	CodeContainerNotReady                            ResCode = 1134
+	CodeContainerGpuUUIDsInvalid                     ResCode = 1135
+	CodeGpuBusy                                      ResCode = 1136
+	CodeContainerMigProfileInvalid                   ResCode = 1137
+	CodeContainerPortConflict                        ResCode = 1138
+	CodeContainerIdempotencyKeyReused                ResCode = 1139
+	CodeContainerBindInvalid                         ResCode = 1140
+	CodeContainerShmSizeInvalid                      ResCode = 1141
+	CodeContainerRestartPolicyInvalid                ResCode = 1142
+	CodeVolumeSpaceGetFailed                         ResCode = 1143
+	CodeVolumePending                                ResCode = 1144
+	CodeDockerNotFound                               ResCode = 1145
+	CodeDockerConflict                               ResCode = 1146
+	CodeDockerUnauthorized                           ResCode = 1147
+	CodeDockerUnavailable                            ResCode = 1148
+	CodeContainerExecInvalid                         ResCode = 1149
+	CodeContainerStatsFailed                         ResCode = 1150
+	CodeStateCheckFailed                             ResCode = 1151
+	CodeContainerGpuConstraintsInvalid               ResCode = 1152
+	CodeGpuConstraintUnsatisfiable                   ResCode = 1153
+	CodeContainerRenameFailed                        ResCode = 1154
+	CodeVolumeExportFailed                           ResCode = 1155
+	CodeVolumeImportFailed                           ResCode = 1156
+	CodeVolumeDataNotOnHost                          ResCode = 1157
+	CodeContainerGpuShareInvalid                     ResCode = 1158
+	CodeWorkQueueFull                                ResCode = 1159
+	CodeCopyRetrying                                 ResCode = 1160
+	CodeProjectionQueryFailed                        ResCode = 1161
+	CodeContainerMigGpuOrderUnsupported              ResCode = 1162
 )
 
 var codeMsgMap = map[ResCode]string{
@@ -75,13 +202,140 @@ var codeMsgMap = map[ResCode]string{
 	CodeVolumeExisted:                                "Volume already exists",
 	CodeVolumeNameMustContainVersion:                 "Volume name must contain the version number",
 	CodeVolumeSizeNoNeedPatch:                        "Volume doesn't need patch, as it is the same size before and after the update",
-	CodeVolumeSizeNotSupported:                       "Volume size units are not supported, supported units: KB, MB, GB, TB",
+	CodeVolumeSizeNotSupported:                       "Volume size is invalid, it must be a number with the unit K, M, G or T, e.g. 10G, 512MB or 1TiB",
 	CodeVolumeSizeUsedGreaterThanReduce:              "Failed to patch volume size, the patch size is smaller than the used size",
 	CodeVolumeNameNotContainsDash:                    "Volume name cannot contain dash",
 	CodeVolumeNameNotBeginWithForwardSlash:           "Volume name must not begin with /",
 	CodeVolumeGetInfoFailed:                          "Failed to get volume info",
 	CodeVolumeGetHistoryFailed:                       "Failed to get volume history",
 	CodeVolumePatchFailed:                            "Failed to patch volume",
+	CodeContainerStorageOptSizeNotSupported:          "Container storage opt size units are not supported, supported units: KB, MB, GB, TB",
+	CodeContainerStorageOptNotSupported:              "The storage driver doesn't support limiting the container size, e.g. overlay2 requires xfs with pquota",
+	CodeContainerCloneFailed:                         "Failed to clone container",
+	CodeContainerWaitFailed:                          "Failed to wait container",
+	CodeContainerGpuDriverOptionsInvalid:             "GPU driver options are invalid, count, device_ids and capabilities are managed by the server, and gpu count must be greater than 0",
+	CodeVolumeRetentionInvalid:                       "Volume retention keepLast and keepDays must be greater than or equal to 0",
+	CodeVolumeRetentionSetFailed:                     "Failed to set volume retention",
+	CodeVolumeRetentionGetFailed:                     "Failed to get volume retention, retention not found",
+	CodeVolumePruneFailed:                            "Failed to prune volume versions",
+	CodeTemplateNameCannotBeEmpty:                    "Template name cannot be empty",
+	CodeTemplateSaveFailed:                           "Failed to save template",
+	CodeTemplateGetInfoFailed:                        "Failed to get template info, template not found",
+	CodeTemplateDeleteFailed:                         "Failed to delete template, template not found",
+	CodeTemplateParamsMissing:                        "Failed to launch template, not all required params are supplied",
+	CodeTemplateRenderFailed:                         "Failed to render template",
+	CodeVolumeDriverCannotBeEmpty:                    "Volume driver cannot be empty",
+	CodeVolumeInUse:                                  "Volume is in use by running containers, stop them first",
+	CodeVolumeNoNeedMigrate:                          "Volume doesn't need migrate, as the driver and options are the same",
+	CodeVolumeMigrateFailed:                          "Failed to migrate volume",
+	CodeContainerPortInvalid:                         "Container port must be between 1 and 65535 and not duplicated, and host port must be 0 which means docker assigns an ephemeral port",
+	CodeDiagnosticsReportFailed:                      "Failed to get diagnostics report",
+	CodeContainerResourceRequestInvalid:              "Cpu or memory request is invalid, the request must not be greater than the limit",
+	CodeContainerResourceNotEnough:                   "Not enough cpu or memory resources to satisfy the request",
+	CodeVersionRepairFailed:                          "Failed to repair version maps",
+	CodeContainerGpuMpsInvalid:                       "MPS only supports sharing one GPU, the GPU count must be 1",
+	CodeContainerNvidiaRuntimeMissing:                "NVIDIA runtime is missing, please install nvidia-container-toolkit, card-less containers can still run",
+	CodeDeadLetterIDCannotBeEmpty:                    "Dead letter id cannot be empty",
+	CodeDeadLetterListFailed:                         "Failed to list dead letters",
+	CodeDeadLetterGetInfoFailed:                      "Failed to get dead letter, dead letter not found",
+	CodeDeadLetterRequeueFailed:                      "Failed to requeue dead letter",
+	CodeScalingGroupNameCannotBeEmpty:                "Scaling group name cannot be empty",
+	CodeScalingGroupExisted:                          "Scaling group already exists",
+	CodeScalingGroupInvalid:                          "Scaling group is invalid, the replicas must be between min and max replicas, and the target utilization must be between 0 and 100",
+	CodeScalingGroupCreateFailed:                     "Failed to create scaling group",
+	CodeScalingGroupGetInfoFailed:                    "Failed to get scaling group info, scaling group not found",
+	CodeScalingGroupPatchFailed:                      "Failed to patch scaling group",
+	CodeScalingGroupDeleteFailed:                     "Failed to delete scaling group",
+	CodeContainerHostnameInvalid:                     "Hostname must be a valid DNS label and domainname must be a valid DNS name",
+	CodeContainerTopFailed:                           "Failed to list processes of container",
+	CodeContainerProcessNotFound:                     "Process not found in container",
+	CodeContainerSignalInvalid:                       "Signal is invalid, supported: HUP, INT, QUIT, KILL, USR1, USR2, TERM, CONT, STOP or 1-64",
+	CodeContainerKillProcessFailed:                   "Failed to kill process",
+	CodeContainerGpuFractionInvalid:                  "GPU fraction must be less than 1 and a multiple of the slot size, and can't be used together with GPU count",
+	CodeProjectionDisabled:                           "Projection is disabled, please start with --projection",
+	CodeProjectionRebuildFailed:                      "Failed to rebuild projection",
+	CodeContainerPatchStrategyInvalid:                "Patch strategy must be replace or blueGreen, and cutover hook is only used by blueGreen",
+	CodePortRepairFailed:                             "Failed to repair ports",
+	CodeContainerProfilerNotAllowed:                  "Profiler is not allowed, please start with --allowProfiler",
+	CodeContainerProfileFailed:                       "Failed to profile container",
+	CodeContainerLimitReached:                        "Host container limit reached, please stop some containers or raise the limit",
+	CodeContainerLimitInvalid:                        "Container limit must be greater than or equal to 0",
+	CodeResourceStatusFailed:                         "Failed to get resource status",
+	CodeVolumeEncryptionInvalid:                      "Encryption key id must be a file name in the secret dir, and can't be used together with size",
+	CodeVolumeEncryptionKeyUnavailable:               "Encryption key is unavailable in the secret dir",
+	CodeContainerCheckpointNotSupported:              "Checkpoint is not supported, it requires an experimental docker daemon with CRIU, and cuda-checkpoint for gpu containers",
+	CodeContainerCheckpointFailed:                    "Failed to checkpoint container",
+	CodeTokenActionsInvalid:                          "Token actions must not be empty and must be in: execute, terminal, logs, ttl must be between 0 and 3600",
+	CodeTokenCreateFailed:                            "Failed to create token",
+	CodeTokenIDCannotBeEmpty:                         "Token id cannot be empty",
+	CodeTokenRevokeFailed:                            "Failed to revoke token",
+	CodeTokenInvalid:                                 "Token is invalid, expired, used or not allowed for this action",
+	CodeContainerGpuLabelsInvalid:                    "GPU labels must not be empty or contain ',', and are only used together with GPU fraction or shared GPUs",
+	CodeContainerGpuConflict:                         "No GPU is available without sharing with a conflicting workload",
+	CodeContainerGpuOrderInvalid:                     "GPU order must be pci or allocation, and requires GPU count greater than 0 without CUDA_VISIBLE_DEVICES in env",
+	CodeWebhookInvalid:                               "Webhook name must not be empty or contain '/', url must be http or https, and events must be supported",
+	CodeWebhookSaveFailed:                            "Failed to save webhook",
+	CodeWebhookDeleteFailed:                          "Failed to delete webhook, webhook not found",
+	CodeContainerOomScoreAdjInvalid:                  "OOM score adjustment must be in -1000..1000",
+	CodeVolumeUsageGetFailed:                         "Failed to find containers by volume version",
+	CodeContainerSoftDeleteFailed:                    "Failed to soft delete container",
+	CodeContainerAlreadyArchived:                     "Container is already soft deleted",
+	CodeContainerNotArchived:                         "Container is not soft deleted",
+	CodeContainerUndeleteFailed:                      "Failed to undelete container",
+	CodeContainerRuntimeNotSupported:                 "Runtime is not registered in docker",
+	CodeContainerRuntimeGpuIncompatible:              "Runtime can't run containers requesting GPUs, see --gpuRuntimes",
+	CodeGpuReservationInvalid:                        "GPU reservation is not found, expired, used or holds a different number of GPUs",
+	CodeGpuReservationParamsInvalid:                  "GPU reservation count must be in 1..available GPUs and ttl must not exceed 7 days, a reservation token requires GPU count",
+	CodeGpuReservationCreateFailed:                   "Failed to reserve GPUs",
+	CodeGpuReservationReleaseFailed:                  "Failed to release GPU reservation",
+	CodeContainerNetworkBandwidthInvalid:             "Network bandwidth must not be negative",
+	CodeContainerTcNotAvailable:                      "tc is not available on the host, please install iproute2",
+	CodeVolumeOptionsInvalid:                         "Volume driver options are invalid, the local driver supports type, o, device and size",
+	CodeVolumeOptionsNoNeedPatch:                     "Volume doesn't need patch, as the driver options are the same before and after the update",
+	CodeJobTimeoutInvalid:                            "Job timeout must be in 0..86400 seconds",
+	CodeJobRunFailed:                                 "Failed to run job",
+	CodeGpuCountExceeded:                             "GPU count exceeds the number of GPUs on the host",
+	CodeContainerListFailed:                          "Failed to list containers",
+	CodeContainerVersionNotFound:                     "Container version is not found, its record or files may have been deleted",
+	CodeContainerLogsFailed:                          "Failed to get container logs",
+	CodeCopyNotFound:                                 "Copy is not found, the name must be a version created from an old version, e.g. foo-2",
+	CodeCopyGetProgressFailed:                        "Failed to get copy progress",
+	CodeGpuUnhealthy:                                 "The free GPUs are unhealthy, see the unhealthy GPUs of /resources/gpus",
+	CodeGpuListFailed:                                "Failed to list GPUs, the nvidia driver may be missing",
+	CodeContainerResourceExceedsHost:                 "Cpu or memory exceeds the capacity of the host",
+	CodeContainerCpusetInvalid:                       "Cpuset is invalid or not on the host, e.g. 0-3,8",
+	CodeContainerEnvPatchInvalid:                     "Env patch is invalid, the keys must not be empty or contain '=' and can't be both set and deleted",
+	CodeContainerImagePullFailed:                     "Failed to pull the image, please check the image name and the registry credentials",
+	CodeContainerHealthCheckInvalid:                  "Health check is invalid, exactly one of cmd and port must be set, the timeout and interval must not be negative",
+	CodeContainerNotReady:                            "Container is not ready before the health check timed out, it has been removed",
+	CodeContainerGpuUUIDsInvalid:                     "GPU uuids are invalid, they must be on the host, not duplicated and not more than the gpu count",
+	CodeGpuBusy:                                      "The requested GPU is held by another replicaSet or reservation",
+	CodeContainerMigProfileInvalid:                   "MIG profile is not on the host, or it's used together with gpu count, gpu fraction or a reservation",
+	CodeContainerPortConflict:                        "The requested host port is already in use",
+	CodeContainerIdempotencyKeyReused:                "Idempotency key is already used to create another replicaSet",
+	CodeContainerBindInvalid:                         "Bind is invalid, the type must be bind, volume or tmpfs, the propagation can only be set for a host path, e.g. rslave, the consistency must be consistent, cached or delegated",
+	CodeContainerShmSizeInvalid:                      "Shm size is invalid, it must be like 8GB and not greater than the memory limit",
+	CodeContainerRestartPolicyInvalid:                "Restart policy must be no, on-failure or unless-stopped, the maximum retry count can only be set for on-failure",
+	CodeVolumeSpaceGetFailed:                         "Failed to get the space used by the volume",
+	CodeVolumePending:                                "Volume is pending, the data is being copied to its latest version, please retry later",
+	CodeDockerNotFound:                               "The container, volume or image is not found in docker",
+	CodeDockerConflict:                               "The request conflicts with the state of docker, e.g. the name is in use or the volume is mounted",
+	CodeDockerUnauthorized:                           "The registry rejected the credentials, please check the registry auth file",
+	CodeDockerUnavailable:                            "Docker daemon is unavailable, please retry later",
+	CodeContainerExecInvalid:                         "Exec is invalid, the user must be like user, uid, user:group or uid:gid, the envs must be like KEY=VALUE, the detach keys must be like ctrl-p,q",
+	CodeContainerStatsFailed:                         "Failed to get the stats of the container",
+	CodeStateCheckFailed:                             "Failed to compare the replicaSets and volumes recorded in etcd with docker",
+	CodeContainerGpuConstraintsInvalid:               "GPU constraints are invalid, the excluded indexes must be on the host, the NUMA node must not be negative, they only apply to gpu count",
+	CodeGpuConstraintUnsatisfiable:                   "Not enough free GPUs satisfy the constraints",
+	CodeContainerRenameFailed:                        "Failed to rename container",
+	CodeVolumeExportFailed:                           "Failed to export volume",
+	CodeVolumeImportFailed:                           "Failed to import volume, the body must be a tar archive",
+	CodeVolumeDataNotOnHost:                          "Volume data is not on the host, only the local volumes can be exported or imported",
+	CodeContainerGpuShareInvalid:                     "Shared GPUs require GPU count greater than 0 without GPU uuids or a reservation, and max sharers must not be negative",
+	CodeWorkQueueFull:                                "Too many pending writes, please try again later",
+	CodeCopyRetrying:                                 "Failed to copy the data to the new version, it's retried in the background, check the copy progress",
+	CodeProjectionQueryFailed:                        "Failed to query projection",
+	CodeContainerMigGpuOrderUnsupported:              "GPU order can't be used together with a MIG profile, the MIG instances are numbered in the order they are applied",
 }
 
 func (c ResCode) Msg() string {
@@ -2,10 +2,39 @@ package routers
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
 )
 
+// allowedOrigins are the origins allowed to open the websockets besides the same origin, e.g. https://dashboard.example.com
+var allowedOrigins = map[string]struct{}{}
+
+// SetAllowedOrigins sets the origins allowed to open the websockets, the scheme and the host must match
+func SetAllowedOrigins(origins []string) {
+	allowedOrigins = make(map[string]struct{}, len(origins))
+	for _, origin := range origins {
+		allowedOrigins[strings.TrimSuffix(strings.ToLower(origin), "/")] = struct{}{}
+	}
+}
+
+// checkOrigin is the handshake of the websockets, a browser always sends the Origin, so that a page of another site
+// can't open a terminal with the cookies or the token of the user. The clients without Origin, e.g. a cli, are allowed.
+func checkOrigin(config *websocket.Config, r *http.Request) (err error) {
+	if config.Origin, err = websocket.Origin(config, r); err != nil {
+		return errors.Wrap(err, "websocket.Origin failed")
+	}
+	if config.Origin == nil || strings.EqualFold(config.Origin.Host, r.Host) {
+		return nil
+	}
+	if _, ok := allowedOrigins[strings.ToLower(config.Origin.Scheme+"://"+config.Origin.Host)]; ok {
+		return nil
+	}
+	return errors.Errorf("origin: %s is not allowed", config.Origin)
+}
+
 func Cors() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		method := c.Request.Method
@@ -0,0 +1,38 @@
+package routers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	SetAllowedOrigins([]string{"https://Dashboard.example.com/"})
+	defer SetAllowedOrigins(nil)
+
+	tests := []struct {
+		name    string
+		origin  string
+		wantErr bool
+	}{
+		{name: "no origin"},
+		{name: "same origin", origin: "http://api.example.com:2378"},
+		{name: "allowed", origin: "https://dashboard.example.com"},
+		{name: "allowed host with another scheme", origin: "http://dashboard.example.com", wantErr: true},
+		{name: "other site", origin: "https://evil.example.com", wantErr: true},
+		{name: "invalid", origin: "null", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://api.example.com:2378/api/v1/replicaSet/foo/terminal", nil)
+			if len(tt.origin) != 0 {
+				r.Header.Set("Origin", tt.origin)
+			}
+			err := checkOrigin(&websocket.Config{Version: websocket.ProtocolVersionHybi13}, r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkOrigin(%q) error = %v, wantErr %v", tt.origin, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+type DeadLetterHandler struct{}
+
+var dls services.DeadLetterService
+
+func (dh *DeadLetterHandler) RegisterRoute(g *gin.RouterGroup) {
+	// list the WorkQueue items which failed after all attempts
+	g.GET("/deadLetters", dh.List)
+	g.GET("/deadLetters/:id", dh.Info)
+	// put the item back to the WorkQueue
+	g.POST("/deadLetters/:id/requeue", dh.Requeue)
+}
+
+func (dh *DeadLetterHandler) List(c *gin.Context) {
+	letters, err := dls.ListDeadLetters()
+	if err != nil {
+		log.Errorf("services.ListDeadLetters failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeDeadLetterListFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"deadLetters": letters,
+	})
+}
+
+func (dh *DeadLetterHandler) Info(c *gin.Context) {
+	id := c.Param("id")
+	if len(id) == 0 {
+		log.Error("failed to get dead letter, id is empty")
+		ResponseError(c, CodeDeadLetterIDCannotBeEmpty)
+		return
+	}
+
+	letter, err := dls.GetDeadLetter(id)
+	if err != nil {
+		log.Errorf("services.GetDeadLetter failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeDeadLetterGetInfoFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"deadLetter": letter,
+	})
+}
+
+func (dh *DeadLetterHandler) Requeue(c *gin.Context) {
+	id := c.Param("id")
+	if len(id) == 0 {
+		log.Error("failed to requeue dead letter, id is empty")
+		ResponseError(c, CodeDeadLetterIDCannotBeEmpty)
+		return
+	}
+
+	if err := dls.RequeueDeadLetter(id); err != nil {
+		log.Errorf("services.RequeueDeadLetter failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeDeadLetterRequeueFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
@@ -0,0 +1,107 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+)
+
+type DiagnosticsHandler struct{}
+
+var ds services.DiagnosticsService
+
+func (dh *DiagnosticsHandler) RegisterRoute(g *gin.RouterGroup) {
+	g.GET("/diagnostics", dh.Report)
+	g.GET("/diagnostics/versions", dh.Versions)
+	g.POST("/diagnostics/versions/repair", dh.RepairVersions)
+	g.POST("/diagnostics/ports/repair", dh.RepairPorts)
+	g.GET("/diagnostics/workQueue", dh.WorkQueue)
+	g.GET("/diagnostics/copies", dh.Copies)
+	g.GET("/diagnostics/state", dh.State)
+}
+
+// Report the problems that need the attention of operators, e.g. the failed copies
+func (dh *DiagnosticsHandler) Report(c *gin.Context) {
+	report, err := ds.Report()
+	if err != nil {
+		log.Errorf("services.Report failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeDiagnosticsReportFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"report": report,
+	})
+}
+
+// Versions the latest version of each container and volume in memory
+func (dh *DiagnosticsHandler) Versions(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"versions": ds.GetVersionMaps(),
+	})
+}
+
+// WorkQueue the depth, counters and latency of the queue of the etcd writes
+func (dh *DiagnosticsHandler) WorkQueue(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"workQueue": workQueue.GetStats(),
+	})
+}
+
+// Copies the number of copies running and waiting for a slot
+func (dh *DiagnosticsHandler) Copies(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"copies": services.GetCopyQueueStats(),
+	})
+}
+
+// RepairPorts updates the host ports recorded in etcd to the live bindings, and returns the mismatches and conflicts,
+// the conflicts are only reported, they have to be resolved by operators.
+func (dh *DiagnosticsHandler) RepairPorts(c *gin.Context) {
+	report, err := ds.CheckPorts(true)
+	if err != nil {
+		log.Errorf("services.CheckPorts failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodePortRepairFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"report": report,
+	})
+}
+
+// RepairVersions rebuilds the version maps from etcd and docker, and returns the corrections
+func (dh *DiagnosticsHandler) RepairVersions(c *gin.Context) {
+	report, err := ds.RepairVersionMaps()
+	if err != nil {
+		log.Errorf("services.RepairVersionMaps failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeVersionRepairFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"report": report,
+	})
+}
+
+// State compares the replicaSets and volumes recorded in etcd with docker without changing anything,
+// the mismatches are repaired only at startup by --reconcilePrune and --reconcileImport, before the writes are served
+func (dh *DiagnosticsHandler) State(c *gin.Context) {
+	report, err := ds.CheckState(false, false)
+	if err != nil {
+		log.Errorf("services.CheckState failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeStateCheckFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"report": report,
+	})
+}
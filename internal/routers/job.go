@@ -0,0 +1,84 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// A job is a one-off container, e.g. a batch inference, the request blocks until the job exits,
+// and the result carries the exit code, the output and the artifacts. The job is not a replicaSet, it has no version.
+
+type JobHandler struct{}
+
+// maxJobTimeout is the max seconds a job runs
+const maxJobTimeout = 24 * 3600
+
+var js services.JobService
+
+func (jh *JobHandler) RegisterRoute(g *gin.RouterGroup) {
+	g.POST("/jobs", jh.Run)
+}
+
+// Run a job and wait for it to exit, the gpus are released and the container is removed afterwards
+func (jh *JobHandler) Run(c *gin.Context) {
+	var spec models.JobRun
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to run job, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.ImageName) == 0 {
+		log.Error("failed to run job, image name is empty")
+		ResponseError(c, CodeImageNameCannotBeEmpty)
+		return
+	}
+	if spec.GpuCount < 0 || spec.GpuCount > schedulers.GpuScheduler.AvailableGpuNums {
+		log.Errorf("failed to run job, gpu count: %d is not in 0..%d", spec.GpuCount, schedulers.GpuScheduler.AvailableGpuNums)
+		ResponseError(c, CodeGpuCountExceeded)
+		return
+	}
+	if spec.Timeout < 0 || spec.Timeout > maxJobTimeout {
+		log.Errorf("failed to run job, timeout: %d is not in 0..%d", spec.Timeout, maxJobTimeout)
+		ResponseError(c, CodeJobTimeoutInvalid)
+		return
+	}
+	if code := checkBinds(spec.Binds); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	result, err := js.RunJob(c.Request.Context(), &spec)
+	if err != nil {
+		log.Errorf("services.RunJob failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsGpuUnhealthyError(err) {
+			ResponseError(c, CodeGpuUnhealthy)
+			return
+		}
+		if xerrors.IsGpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerGpuNotEnough)
+			return
+		}
+		if xerrors.IsContainerLimitReachedError(err) {
+			ResponseError(c, CodeContainerLimitReached)
+			return
+		}
+		if xerrors.IsImagePullFailedError(err) {
+			ResponseError(c, CodeContainerImagePullFailed)
+			return
+		}
+		ResponseError(c, CodeJobRunFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"result": result,
+	})
+}
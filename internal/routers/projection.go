@@ -0,0 +1,86 @@
+package routers
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/projection"
+)
+
+// Projection is a read replica of the container and volume records,
+// it's used by dashboards to query the records without hammering etcd.
+
+type ProjectionHandler struct{}
+
+func (ph *ProjectionHandler) RegisterRoute(g *gin.RouterGroup) {
+	// query parameters: prefix, state, owner, minGpus
+	g.GET("/projections/containers", ph.Containers)
+	// query parameters: prefix, state
+	g.GET("/projections/volumes", ph.Volumes)
+	// rebuild the projection from etcd
+	g.POST("/projections/rebuild", ph.Rebuild)
+}
+
+func (ph *ProjectionHandler) Containers(c *gin.Context) {
+	ph.query(c, etcd.Containers)
+}
+
+func (ph *ProjectionHandler) Volumes(c *gin.Context) {
+	ph.query(c, etcd.Volumes)
+}
+
+func (ph *ProjectionHandler) query(c *gin.Context, resource etcd.Resource) {
+	if !projection.Enabled() {
+		log.Error("failed to query projection, projection is disabled")
+		ResponseError(c, CodeProjectionDisabled)
+		return
+	}
+
+	filter := projection.Filter{
+		Resource: resource,
+		Prefix:   c.Query("prefix"),
+		State:    c.Query("state"),
+		Owner:    c.Query("owner"),
+	}
+	if minGpus := c.Query("minGpus"); len(minGpus) != 0 {
+		var err error
+		if filter.MinGpus, err = strconv.Atoi(minGpus); err != nil {
+			log.Errorf("failed to query projection, minGpus: %s is invalid", minGpus)
+			ResponseError(c, CodeInvalidParams)
+			return
+		}
+	}
+
+	records, err := projection.Query(filter)
+	if err != nil {
+		log.Errorf("projection.Query failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeProjectionQueryFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"records": records,
+	})
+}
+
+func (ph *ProjectionHandler) Rebuild(c *gin.Context) {
+	if !projection.Enabled() {
+		log.Error("failed to rebuild projection, projection is disabled")
+		ResponseError(c, CodeProjectionDisabled)
+		return
+	}
+
+	if err := projection.Rebuild(); err != nil {
+		log.Errorf("projection.Rebuild failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeProjectionRebuildFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
@@ -1,15 +1,25 @@
 package routers
 
 import (
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ngaut/log"
 	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
 
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
 	"github.com/mayooot/gpu-docker-api/internal/services"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
 )
 
 // ReplicaSet is just an abstract concept, there is no concrete implementations,
@@ -24,12 +34,30 @@ func (rh *ReplicaSetHandler) RegisterRoute(g *gin.RouterGroup) {
 	g.POST("/replicaSet", rh.Run)
 	// commit replicaSet the current version of the container as an image
 	g.POST("/replicaSet/:name/commit", rh.Commit)
-	// execute a command in the replicaSet current version of the container
+	// execute a command in the replicaSet current version of the container, ?stream=true streams the output
 	g.POST("/replicaSet/:name/execute", rh.Execute)
+	// open an interactive terminal in the replicaSet current version of the container over websocket
+	g.GET("/replicaSet/:name/terminal", rh.Terminal)
+	// send a signal to a process in the replicaSet current version of the container
+	g.POST("/replicaSet/:name/kill", rh.Kill)
+	// run a privileged profiler in the pid namespace of the replicaSet current version of the container
+	g.POST("/replicaSet/:name/profile", rh.Profile)
+	// checkpoint the process state of the replicaSet current version of the container
+	g.POST("/replicaSet/:name/checkpoint", rh.Checkpoint)
+	// clone the replicaSet current version of the container as a new replicaSet
+	g.POST("/replicaSet/:name/clone", rh.Clone)
+	// rename the replicaSet by creating the next version under the new name, the history is kept
+	g.POST("/replicaSet/:name/rename", rh.Rename)
 
 	// update the replicaSet, such as change gpu, volume
 	// or replicating the container by create a new container.
 	g.PATCH("/replicaSet/:name", rh.Patch)
+	// set or delete the envs of the replicaSet by creating a new version
+	g.PATCH("/replicaSet/:name/env", rh.PatchEnv)
+	// replace the image of the replicaSet by creating a new version, the merged files are copied only if asked
+	g.PATCH("/replicaSet/:name/image", rh.PatchImage)
+	// publish or unpublish the ports of the replicaSet by creating a new version
+	g.PATCH("/replicaSet/:name/ports", rh.PatchPorts)
 	// rollback replicaSet the current version of the container toa specific version
 	g.PATCH("/replicaSet/:name/rollback", rh.Rollback)
 
@@ -47,13 +75,26 @@ func (rh *ReplicaSetHandler) RegisterRoute(g *gin.RouterGroup) {
 	// it will call `docker restart`.
 	g.PATCH("/replicaSet/:name/continue", rh.Continue)
 
+	// list the current version of all replicaSets, or all versions of a replicaSet
+	g.GET("/replicaSets", rh.List)
 	// get information about the current version of the replicaSet
 	g.GET("/replicaSet/:name", rh.Info)
 	// get information about all historical versions of the replicaSet
 	g.GET("/replicaSet/:name/history", rh.History)
+	// list the processes in the current version of the replicaSet container
+	g.GET("/replicaSet/:name/top", rh.Top)
+	// block until the current version of the replicaSet container exits
+	g.GET("/replicaSet/:name/wait", rh.Wait)
+	// stream the stdout and stderr of the current version of the replicaSet container
+	g.GET("/replicaSet/:name/logs", rh.Logs)
+	// get the cpu, memory, network, block io and gpu usage of the current version of the replicaSet container
+	g.GET("/replicaSet/:name/stats", rh.Stats)
+	// get the progress of copying the merged layer to a version of the replicaSet, the name is the version name
+	g.GET("/replicaSet/:name/copy", rh.CopyProgress)
 
 	// delete a replicaSet also delete the container and cannot be recovered.
 	g.DELETE("/replicaSet/:name", rh.Delete)
+	g.POST("/replicaSet/:name/undelete", rh.Undelete)
 }
 
 func (rh *ReplicaSetHandler) Info(c *gin.Context) {
@@ -68,7 +109,7 @@ func (rh *ReplicaSetHandler) Info(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.GetContainerInfo failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerGetInfoFailed)
+		responseDockerError(c, err, CodeContainerGetInfoFailed)
 		return
 	}
 
@@ -89,7 +130,7 @@ func (rh *ReplicaSetHandler) History(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.GetContainerHistory failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerGetHistoryFailed)
+		responseDockerError(c, err, CodeContainerGetHistoryFailed)
 		return
 	}
 
@@ -98,120 +139,1163 @@ func (rh *ReplicaSetHandler) History(c *gin.Context) {
 	})
 }
 
+// CopyProgress gets the bytes copied from the old version to the version of the replicaSet, e.g. foo-2
+func (rh *ReplicaSetHandler) CopyProgress(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get copy progress, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	record, err := cs.GetCopyProgress(name)
+	if err != nil {
+		log.Errorf("services.GetCopyProgress failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsCopyNotFoundError(err) {
+			ResponseError(c, CodeCopyNotFound)
+			return
+		}
+		responseDockerError(c, err, CodeCopyGetProgressFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"copy": record,
+	})
+}
+
+// List the metadata and the live status of the current version of all replicaSets,
+// if the query name is set, all versions of the replicaSet are listed.
+func (rh *ReplicaSetHandler) List(c *gin.Context) {
+	containers, err := cs.ListContainers(c.Query("name"))
+	if err != nil {
+		log.Errorf("services.ListContainers failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerListFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"containers": containers,
+	})
+}
+
+// Wait blocks until the latest version of the container exits and returns the exit code,
+// e.g. ?follow=true follows the new version if the container is patched or restarted while waiting.
+// If the client gives up the request, the wait will be canceled.
+func (rh *ReplicaSetHandler) Wait(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to wait container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var (
+		exitCode int64
+		err      error
+	)
+	if c.Query("follow") == "true" {
+		var code int
+		code, err = cs.WaitForContainer(c.Request.Context(), name)
+		exitCode = int64(code)
+	} else {
+		exitCode, err = cs.WaitContainer(c.Request.Context(), name)
+	}
+	if err != nil {
+		log.Errorf("services.WaitContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerWaitFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"exitCode": exitCode,
+	})
+}
+
+// Logs streams the stdout and stderr of the latest version of the container as plain text,
+// e.g. ?follow=true&tail=100&since=10m&timestamps=true, the follow ends when the client closes the request.
+func (rh *ReplicaSetHandler) Logs(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get container logs, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	opts := models.LogOptions{
+		Tail:  c.Query("tail"),
+		Since: c.Query("since"),
+	}
+	opts.Follow, _ = strconv.ParseBool(c.Query("follow"))
+	opts.Timestamps, _ = strconv.ParseBool(c.Query("timestamps"))
+
+	logs, err := cs.GetContainerLogs(c.Request.Context(), name, &opts)
+	if err != nil {
+		log.Errorf("services.GetContainerLogs failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerLogsFailed)
+		return
+	}
+	defer logs.Close()
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	buf := make([]byte, 32*1024)
+	c.Stream(func(w io.Writer) bool {
+		n, err := logs.Read(buf)
+		if n > 0 {
+			_, _ = w.Write(buf[:n])
+		}
+		return err == nil
+	})
+}
+
+// Stats returns a sample of the resource usage of the latest version of the container,
+// with ?stream=true the samples are sent as server-sent events every second until the client closes the request.
+func (rh *ReplicaSetHandler) Stats(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get container stats, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	stream, _ := strconv.ParseBool(c.Query("stream"))
+	samples, err := cs.GetContainerStats(c.Request.Context(), name, stream)
+	if err != nil {
+		log.Errorf("services.GetContainerStats failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerStatsFailed)
+		return
+	}
+
+	if !stream {
+		stats, ok := <-samples
+		if !ok {
+			log.Errorf("failed to get container stats, container: %s sent no stats", name)
+			ResponseError(c, CodeContainerStatsFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"stats": stats,
+		})
+		return
+	}
+
+	c.Stream(func(w io.Writer) bool {
+		stats, ok := <-samples
+		if ok {
+			c.SSEvent("stats", stats)
+		}
+		return ok
+	})
+}
+
 // Run a container consists of two parts: create and start
 func (rh *ReplicaSetHandler) Run(c *gin.Context) {
 	var spec models.ContainerRun
 	if err := c.ShouldBindJSON(&spec); err != nil {
-		log.Error("failed to create container, error:", err.Error())
+		log.Error("failed to create container, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if code := checkContainerRun(&spec); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	runContainer(c, &spec)
+}
+
+// checkGpuUUIDs validates the gpus requested by uuid, the busy gpus are rejected when they are applied
+func checkGpuUUIDs(spec *models.ContainerRun) ResCode {
+	if len(spec.GpuUUIDs) > spec.GpuCount || len(spec.ReservationToken) != 0 {
+		log.Errorf("failed to create container, gpu uuids: %v are more than gpu count: %d or used with a reservation",
+			spec.GpuUUIDs, spec.GpuCount)
+		return CodeContainerGpuUUIDsInvalid
+	}
+	status := schedulers.GpuScheduler.GetGpuStatus()
+	seen := make(map[string]struct{}, len(spec.GpuUUIDs))
+	for _, uuid := range spec.GpuUUIDs {
+		if _, ok := status[uuid]; !ok {
+			log.Errorf("failed to create container, gpu: %s is not on the host", uuid)
+			return CodeContainerGpuUUIDsInvalid
+		}
+		if _, ok := seen[uuid]; ok {
+			log.Errorf("failed to create container, gpu: %s is duplicated", uuid)
+			return CodeContainerGpuUUIDsInvalid
+		}
+		seen[uuid] = struct{}{}
+	}
+	return CodeSuccess
+}
+
+// checkMigProfile validates that the mig profile exists on the host, the free instances are checked when they are applied
+func checkMigProfile(spec *models.ContainerRun) ResCode {
+	if spec.MigCount < 0 || spec.GpuCount != 0 || spec.GpuFraction != 0 || len(spec.ReservationToken) != 0 {
+		log.Errorf("failed to create container, mig count: %d is negative or used together with the whole or fractional gpus",
+			spec.MigCount)
+		return CodeContainerMigProfileInvalid
+	}
+	if _, ok := schedulers.GpuScheduler.MigProfiles()[spec.MigProfile]; !ok {
+		log.Errorf("failed to create container, mig profile: %s is not on the host", spec.MigProfile)
+		return CodeContainerMigProfileInvalid
+	}
+	return CodeSuccess
+}
+
+// dnsLabelRegexp matches a RFC 1123 dns label
+var dnsLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// checkGpuOrder validates the gpu order, it only applies to whole gpus, the mig instances have no pci order
+func checkGpuOrder(spec *models.ContainerRun) ResCode {
+	if len(spec.MigProfile) != 0 {
+		log.Errorf("failed to create container, gpu order: %s can't be used together with mig profile: %s",
+			spec.GpuOrder, spec.MigProfile)
+		return CodeContainerMigGpuOrderUnsupported
+	}
+	if spec.GpuOrder != models.GpuOrderPci && spec.GpuOrder != models.GpuOrderAllocation {
+		log.Errorf("failed to create container, gpu order: %s is not supported", spec.GpuOrder)
+		return CodeContainerGpuOrderInvalid
+	}
+	if spec.GpuCount == 0 {
+		log.Error("failed to create container, gpu order requires gpu count greater than 0")
+		return CodeContainerGpuOrderInvalid
+	}
+	for _, e := range spec.Env {
+		if strings.HasPrefix(e, "CUDA_VISIBLE_DEVICES=") || strings.HasPrefix(e, "CUDA_DEVICE_ORDER=") {
+			log.Errorf("failed to create container, env: %s can't be set together with gpu order", e)
+			return CodeContainerGpuOrderInvalid
+		}
+	}
+	return CodeSuccess
+}
+
+// checkBinds checks the type and the options of the binds, the propagation can only be set for the host paths
+func checkBinds(binds []models.Bind) ResCode {
+	for i := range binds {
+		if !binds[i].Valid() {
+			log.Errorf("bind: %+v is invalid, propagation must be one of %v and only for a host path, "+
+				"consistency must be one of %v", binds[i], models.BindPropagations, models.BindConsistencies)
+			return CodeContainerBindInvalid
+		}
+		if binds[i].IsTmpfs() && len(binds[i].TmpfsSize) != 0 {
+			if size, err := utils.ToBytes(binds[i].TmpfsSize); err != nil || size <= 0 {
+				log.Errorf("bind: %+v is invalid, tmpfs size must be like 16GB", binds[i])
+				return CodeContainerBindInvalid
+			}
+		}
+	}
+	return CodeSuccess
+}
+
+// checkGpuConstraints validates the gpu constraints, they only limit the whole gpus applied from the free ones
+func checkGpuConstraints(spec *models.ContainerRun) ResCode {
+	constraints := spec.GpuConstraints
+	if spec.GpuCount == 0 || len(spec.ReservationToken) != 0 {
+		log.Error("failed to create container, gpu constraints are set without gpu count or with a reservation")
+		return CodeContainerGpuConstraintsInvalid
+	}
+	if constraints.NumaNode != nil && *constraints.NumaNode < 0 {
+		log.Errorf("failed to create container, numa node: %d is negative", *constraints.NumaNode)
+		return CodeContainerGpuConstraintsInvalid
+	}
+	if len(constraints.Exclude) == 0 {
+		return CodeSuccess
+	}
+	indexes, err := schedulers.GetGpuIndexes()
+	if err != nil {
+		log.Errorf("failed to create container, get gpu indexes failed, error: %v", err)
+		return CodeContainerGpuConstraintsInvalid
+	}
+	onHost := make(map[int]struct{}, len(indexes))
+	for _, index := range indexes {
+		onHost[index] = struct{}{}
+	}
+	for _, index := range constraints.Exclude {
+		if _, ok := onHost[index]; !ok {
+			log.Errorf("failed to create container, excluded gpu index: %d is not on the host", index)
+			return CodeContainerGpuConstraintsInvalid
+		}
+	}
+	return CodeSuccess
+}
+
+// checkPortPatch validates the ports published and unpublished by the patch, CodeSuccess means the patch is valid
+func checkPortPatch(spec *models.ContainerPortPatch) ResCode {
+	if len(spec.ContainerPorts) == 0 && len(spec.Ports) == 0 && len(spec.Remove) == 0 {
+		log.Error("invalid port patch, no port is published or unpublished")
+		return CodeInvalidParams
+	}
+	if code := checkPorts(spec.Remove, nil); code != CodeSuccess {
+		return code
+	}
+	return checkPorts(spec.ContainerPorts, spec.Ports)
+}
+
+// checkPorts validates the ports published by the container like ContainerRun, CodeSuccess means the ports are valid
+func checkPorts(containerPorts []string, ports []models.Port) ResCode {
+	seen := make(map[string]struct{}, len(containerPorts)+len(ports))
+	for _, port := range containerPorts {
+		number, protocol, found := strings.Cut(port, "/")
+		if !found {
+			protocol = models.ProtocolTcp
+		}
+		if n, err := strconv.Atoi(number); err != nil || n <= 0 || n > 65535 || !models.ValidProtocol(protocol) {
+			log.Errorf("invalid ports, container port: %s is invalid", port)
+			return CodeContainerPortInvalid
+		}
+		seen[number+"/"+protocol] = struct{}{}
+	}
+	hostPorts := make(map[string]struct{}, len(ports))
+	for _, port := range ports {
+		if len(port.Protocol) == 0 {
+			port.Protocol = models.ProtocolTcp
+		}
+		if !models.ValidProtocol(port.Protocol) {
+			log.Errorf("invalid ports, protocol: %s of port: %d is not supported", port.Protocol, port.ContainerPort)
+			return CodeContainerPortInvalid
+		}
+		key := fmt.Sprintf("%d/%s", port.ContainerPort, port.Protocol)
+		if _, ok := seen[key]; ok {
+			log.Errorf("invalid ports, container port: %s is duplicated", key)
+			return CodeContainerPortInvalid
+		}
+		seen[key] = struct{}{}
+		if port.ContainerPort <= 0 || port.ContainerPort > 65535 {
+			log.Errorf("invalid ports, container port: %d is invalid", port.ContainerPort)
+			return CodeContainerPortInvalid
+		}
+		if port.HostPort < 0 || port.HostPort > 65535 {
+			log.Errorf("invalid ports, host port: %d is invalid", port.HostPort)
+			return CodeContainerPortInvalid
+		}
+		if port.HostPort != 0 {
+			key = fmt.Sprintf("%d/%s", port.HostPort, port.Protocol)
+			if _, ok := hostPorts[key]; ok {
+				log.Errorf("invalid ports, host port: %s is duplicated", key)
+				return CodeContainerPortInvalid
+			}
+			hostPorts[key] = struct{}{}
+		}
+	}
+	return CodeSuccess
+}
+
+// checkContainerRun validates the spec of running a container, CodeSuccess means the spec is valid.
+// The StorageOptSize will be normalized to upper case.
+func checkContainerRun(spec *models.ContainerRun) ResCode {
+	if len(spec.ImageName) == 0 {
+		log.Error("failed to create container, image name is empty")
+		return CodeImageNameCannotBeEmpty
+	}
+
+	if len(spec.ReplicaSetName) == 0 {
+		log.Error("failed to create container, container name is empty")
+		return CodeContainerNameCannotBeEmpty
+	}
+
+	if spec.GpuCount < 0 {
+		log.Error("failed to create container, gpu count must be greater than 0")
+		return CodeGpuCountMustBeGreaterThanOrEqualZero
+	}
+	if len(spec.GpuUUIDs) != 0 {
+		if spec.GpuCount == 0 {
+			spec.GpuCount = len(spec.GpuUUIDs)
+		}
+		if code := checkGpuUUIDs(spec); code != CodeSuccess {
+			return code
+		}
+	}
+	if spec.GpuCount > schedulers.GpuScheduler.AvailableGpuNums {
+		log.Errorf("failed to create container, gpu count: %d exceeds the %d gpus on the host",
+			spec.GpuCount, schedulers.GpuScheduler.AvailableGpuNums)
+		return CodeGpuCountExceeded
+	}
+	if spec.GpuConstraints != nil {
+		if code := checkGpuConstraints(spec); code != CodeSuccess {
+			return code
+		}
+	}
+
+	if strings.Contains(spec.ReplicaSetName, "-") {
+		log.Error("failed to create container, container name cannot contain dash")
+		return CodeContainerNameCannotContainDash
+	}
+
+	if code := checkBinds(spec.Binds); code != CodeSuccess {
+		return code
+	}
+
+	if code := checkPorts(spec.ContainerPorts, spec.Ports); code != CodeSuccess {
+		return code
+	}
+
+	if len(spec.GpuDriverOptions) != 0 {
+		if spec.GpuCount == 0 {
+			log.Error("failed to create container, gpu driver options require gpu count greater than 0")
+			return CodeContainerGpuDriverOptionsInvalid
+		}
+		for k := range spec.GpuDriverOptions {
+			if _, ok := models.ReservedGpuDriverOptions[k]; ok || len(k) == 0 {
+				log.Errorf("failed to create container, gpu driver option: %s is not allowed", k)
+				return CodeContainerGpuDriverOptionsInvalid
+			}
+		}
+	}
+
+	if len(spec.Hostname) != 0 && !dnsLabelRegexp.MatchString(spec.Hostname) {
+		log.Errorf("failed to create container, hostname: %s is not a valid dns label", spec.Hostname)
+		return CodeContainerHostnameInvalid
+	}
+	if len(spec.Domainname) != 0 {
+		for _, label := range strings.Split(spec.Domainname, ".") {
+			if !dnsLabelRegexp.MatchString(label) {
+				log.Errorf("failed to create container, domainname: %s is not a valid dns name", spec.Domainname)
+				return CodeContainerHostnameInvalid
+			}
+		}
+	}
+
+	if len(spec.MigProfile) != 0 || spec.MigCount != 0 {
+		if spec.MigCount == 0 {
+			spec.MigCount = 1
+		}
+		if code := checkMigProfile(spec); code != CodeSuccess {
+			return code
+		}
+	}
+
+	if spec.GpuFraction != 0 {
+		slots := spec.GpuFraction * float64(schedulers.GpuScheduler.SlotsPerGpu)
+		if spec.GpuCount != 0 || spec.GpuFraction < 0 || spec.GpuFraction >= 1 || math.Abs(slots-math.Round(slots)) > 1e-9 || math.Round(slots) < 1 {
+			log.Errorf("failed to create container, gpu fraction: %v is invalid, slots per gpu: %d",
+				spec.GpuFraction, schedulers.GpuScheduler.SlotsPerGpu)
+			return CodeContainerGpuFractionInvalid
+		}
+	}
+
+	// the MPS clients share the gpu with each other, so the gpu is applied in shared mode
+	if spec.GpuMps {
+		spec.GpuShared = true
+	}
+	if spec.GpuShared || spec.GpuMaxSharers != 0 {
+		if !spec.GpuShared || spec.GpuCount == 0 || len(spec.GpuUUIDs) != 0 || len(spec.ReservationToken) != 0 || spec.GpuMaxSharers < 0 {
+			log.Errorf("failed to create container, gpu shared: %v with gpu count: %d, max sharers: %d is invalid",
+				spec.GpuShared, spec.GpuCount, spec.GpuMaxSharers)
+			return CodeContainerGpuShareInvalid
+		}
+	}
+
+	if len(spec.GpuLabels) != 0 {
+		if spec.GpuCount == 0 && spec.GpuFraction == 0 && len(spec.MigProfile) == 0 {
+			log.Errorf("failed to create container, gpu labels: %v are only used together with gpus", spec.GpuLabels)
+			return CodeContainerGpuLabelsInvalid
+		}
+		for _, label := range spec.GpuLabels {
+			if len(label) == 0 || strings.ContainsAny(label, ",:") {
+				log.Errorf("failed to create container, gpu label: %s is invalid", label)
+				return CodeContainerGpuLabelsInvalid
+			}
+		}
+	}
+
+	if len(spec.GpuOrder) != 0 {
+		if code := checkGpuOrder(spec); code != CodeSuccess {
+			return code
+		}
+	}
+
+	if len(spec.ReservationToken) != 0 && spec.GpuCount == 0 {
+		log.Error("failed to create container, reservation token requires gpu count greater than 0")
+		return CodeGpuReservationParamsInvalid
+	}
+
+	if spec.GpuMps && spec.GpuCount != 1 {
+		log.Errorf("failed to create container, mps only supports sharing one gpu, gpu count: %d", spec.GpuCount)
+		return CodeContainerGpuMpsInvalid
+	}
+
+	if len(spec.StorageOptSize) != 0 {
+		spec.StorageOptSize = strings.ToUpper(spec.StorageOptSize)
+		if _, err := utils.ToBytes(spec.StorageOptSize); err != nil {
+			log.Errorf("failed to create container, storage opt size: %s is not supported", spec.StorageOptSize)
+			return CodeContainerStorageOptSizeNotSupported
+		}
+	}
+
+	if spec.CpuRequest < 0 || spec.CpuLimit < 0 || (spec.CpuLimit > 0 && spec.CpuRequest > spec.CpuLimit) {
+		log.Errorf("failed to create container, cpu request: %v or cpu limit: %v is invalid", spec.CpuRequest, spec.CpuLimit)
+		return CodeContainerResourceRequestInvalid
+	}
+
+	var memoryRequest, memoryLimit int64
+	if len(spec.MemoryRequest) != 0 {
+		spec.MemoryRequest = strings.ToUpper(spec.MemoryRequest)
+		var err error
+		if memoryRequest, err = utils.ToBytes(spec.MemoryRequest); err != nil || memoryRequest <= 0 {
+			log.Errorf("failed to create container, memory request: %s is invalid", spec.MemoryRequest)
+			return CodeContainerResourceRequestInvalid
+		}
+	}
+	if len(spec.MemoryLimit) != 0 {
+		spec.MemoryLimit = strings.ToUpper(spec.MemoryLimit)
+		var err error
+		if memoryLimit, err = utils.ToBytes(spec.MemoryLimit); err != nil || memoryLimit <= 0 {
+			log.Errorf("failed to create container, memory limit: %s is invalid", spec.MemoryLimit)
+			return CodeContainerResourceRequestInvalid
+		}
+	}
+	if memoryLimit > 0 && memoryRequest > memoryLimit {
+		log.Errorf("failed to create container, memory request: %s is greater than memory limit: %s", spec.MemoryRequest, spec.MemoryLimit)
+		return CodeContainerResourceRequestInvalid
+	}
+	if len(spec.ShmSize) != 0 {
+		spec.ShmSize = strings.ToUpper(spec.ShmSize)
+		// the shared memory is charged to the memory of the container
+		if shmSize, err := utils.ToBytes(spec.ShmSize); err != nil || shmSize <= 0 || (memoryLimit > 0 && shmSize > memoryLimit) {
+			log.Errorf("failed to create container, shm size: %s is invalid or greater than memory limit: %s", spec.ShmSize, spec.MemoryLimit)
+			return CodeContainerShmSizeInvalid
+		}
+	}
+
+	// a limit beyond the host never takes effect, it's more likely a typo of the unit
+	status := schedulers.ResourceScheduler.GetResourceStatus()
+	if int64(max(spec.CpuRequest, spec.CpuLimit)*1e9) > status.CpuCapacity ||
+		max(memoryRequest, memoryLimit) > status.MemoryCapacity {
+		log.Errorf("failed to create container, cpu: %v/%v or memory: %s/%s exceeds the host, cpu capacity: %d, memory capacity: %d",
+			spec.CpuRequest, spec.CpuLimit, spec.MemoryRequest, spec.MemoryLimit, status.CpuCapacity, status.MemoryCapacity)
+		return CodeContainerResourceExceedsHost
+	}
+
+	if len(spec.CpusetCpus) != 0 {
+		if _, err := utils.ParseCpuset(spec.CpusetCpus, int(status.CpuCapacity/1e9)); err != nil {
+			log.Errorf("failed to create container, cpuset: %s is invalid or not on the host, cpu capacity: %d",
+				spec.CpusetCpus, status.CpuCapacity)
+			return CodeContainerCpusetInvalid
+		}
+	}
+
+	if spec.OomScoreAdj < -1000 || spec.OomScoreAdj > 1000 {
+		log.Errorf("failed to create container, oom score adj: %d is not in -1000..1000", spec.OomScoreAdj)
+		return CodeContainerOomScoreAdjInvalid
+	}
+
+	if spec.NetworkBandwidth != nil && (spec.NetworkBandwidth.Ingress < 0 || spec.NetworkBandwidth.Egress < 0) {
+		log.Errorf("failed to create container, network bandwidth: %+v is negative", *spec.NetworkBandwidth)
+		return CodeContainerNetworkBandwidthInvalid
+	}
+
+	if check := spec.HealthCheck; check != nil {
+		if (len(check.Cmd) == 0) == (check.Port == 0) || check.Port < 0 || check.Port > 65535 || check.Timeout < 0 || check.Interval < 0 {
+			log.Errorf("failed to create container, health check: %+v is invalid", *check)
+			return CodeContainerHealthCheckInvalid
+		}
+	}
+
+	if policy := spec.RestartPolicy; policy != nil {
+		if !slices.Contains(models.RestartPolicies, policy.Name) || policy.MaximumRetryCount < 0 ||
+			(policy.MaximumRetryCount > 0 && policy.Name != models.RestartPolicyOnFailure) {
+			log.Errorf("failed to create container, restart policy: %+v is invalid", *policy)
+			return CodeContainerRestartPolicyInvalid
+		}
+	}
+
+	return CodeSuccess
+}
+
+// responseContainerExisted responds the name of the replicaSet that already exists
+func responseContainerExisted(c *gin.Context, err error) {
+	var existed *xerrors.ContainerExistedError
+	if !errors.As(err, &existed) {
+		ResponseError(c, CodeContainerAlreadyExist)
+		return
+	}
+	ResponseErrorWithData(c, CodeContainerAlreadyExist, gin.H{
+		"replicaSetName": existed.Name,
+	})
+}
+
+// runContainer runs the container and writes the response, the spec with DryRun is only planned
+func runContainer(c *gin.Context, spec *models.ContainerRun) {
+	if spec.DryRun {
+		plan, err := cs.PlanGpuContainer(spec)
+		if err != nil {
+			log.Errorf("services.PlanGpuContainer failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			responseRunError(c, spec.GpuLabels, err, CodeContainerRunFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"dryRun": true,
+			"plan":   plan,
+		})
+		return
+	}
+
+	_, containerName, boundPorts, readiness, err := cs.RunGpuContainer(spec)
+	if err != nil {
+		log.Errorf("services.RunGpuContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseRunError(c, spec.GpuLabels, err, CodeContainerRunFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"name":      containerName,
+		"ports":     boundPorts,
+		"readiness": readiness,
+	})
+}
+
+// responseRunError maps the error of running, planning or cloning a container to the response code,
+// the conflicts on the shared gpus are explained by the labels of the new container, otherwise the fallback code
+func responseRunError(c *gin.Context, labels []string, err error, fallback ResCode) {
+	if xerrors.IsContainerExistedError(err) {
+		responseContainerExisted(c, err)
+		return
+	}
+	if xerrors.IsIdempotencyKeyReusedError(err) {
+		ResponseError(c, CodeContainerIdempotencyKeyReused)
+		return
+	}
+	if xerrors.IsImagePullFailedError(err) {
+		ResponseError(c, CodeContainerImagePullFailed)
+		return
+	}
+	if xerrors.IsContainerNotReadyError(err) {
+		ResponseError(c, CodeContainerNotReady)
+		return
+	}
+	if xerrors.IsGpuCountExceededError(err) {
+		ResponseError(c, CodeGpuCountExceeded)
+		return
+	}
+	if xerrors.IsGpuUnhealthyError(err) {
+		ResponseError(c, CodeGpuUnhealthy)
+		return
+	}
+	if xerrors.IsGpuBusyError(err) {
+		ResponseError(c, CodeGpuBusy)
+		return
+	}
+	if xerrors.IsGpuConstraintUnsatisfiableError(err) {
+		ResponseError(c, CodeGpuConstraintUnsatisfiable)
+		return
+	}
+	if xerrors.IsGpuNotFoundError(err) {
+		ResponseError(c, CodeContainerGpuUUIDsInvalid)
+		return
+	}
+	if xerrors.IsMigProfileNotFoundError(err) {
+		ResponseError(c, CodeContainerMigProfileInvalid)
+		return
+	}
+	if xerrors.IsGpuNotEnoughError(err) {
+		ResponseError(c, CodeContainerGpuNotEnough)
+		return
+	}
+	if xerrors.IsGpuConflictError(err) {
+		ResponseErrorWithData(c, CodeContainerGpuConflict, gin.H{
+			"conflicts": schedulers.GpuScheduler.ExplainConflicts(labels),
+		})
+		return
+	}
+	if xerrors.IsPortConflictError(err) {
+		ResponseErrorWithData(c, CodeContainerPortConflict, gin.H{
+			"conflict": err.Error(),
+		})
+		return
+	}
+	if xerrors.IsPortNotEnoughError(err) {
+		ResponseError(c, CodeContainerPortNotEnough)
+		return
+	}
+	if xerrors.IsResourceNotEnoughError(err) {
+		ResponseError(c, CodeContainerResourceNotEnough)
+		return
+	}
+	if xerrors.IsContainerLimitReachedError(err) {
+		ResponseError(c, CodeContainerLimitReached)
+		return
+	}
+	if xerrors.IsNvidiaRuntimeMissingError(err) {
+		ResponseError(c, CodeContainerNvidiaRuntimeMissing)
+		return
+	}
+	if xerrors.IsReservationInvalidError(err) {
+		ResponseError(c, CodeGpuReservationInvalid)
+		return
+	}
+	if xerrors.IsTcNotAvailableError(err) {
+		ResponseError(c, CodeContainerTcNotAvailable)
+		return
+	}
+	if xerrors.IsRuntimeNotSupportedError(err) {
+		ResponseError(c, CodeContainerRuntimeNotSupported)
+		return
+	}
+	if xerrors.IsRuntimeGpuIncompatibleError(err) {
+		ResponseError(c, CodeContainerRuntimeGpuIncompatible)
+		return
+	}
+	if xerrors.IsStorageOptNotSupportedError(err) {
+		ResponseError(c, CodeContainerStorageOptNotSupported)
+		return
+	}
+	responseDockerError(c, err, fallback)
+}
+
+// Commit the latest version of the container as image.
+// The image name is the default image id, or you can specify a new image name.
+func (rh *ReplicaSetHandler) Commit(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to commit container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ContainerCommit
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to commit container, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	imageName, err := cs.CommitContainer(name, spec)
+	if err != nil {
+		log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerCommitFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"imageName": imageName,
+	})
+}
+
+// Execute a command in the latest version of the running container and return the output,
+// with ?stream=true the output is streamed as plain text while the command runs
+func (rh *ReplicaSetHandler) Execute(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to execute container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ContainerExecute
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to execute container, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if code := checkContainerExecute(&spec); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	if stream, _ := strconv.ParseBool(c.Query("stream")); stream {
+		rh.executeStream(c, name, &spec)
+		return
+	}
+
+	result, err := cs.ExecuteContainer(name, &spec)
+	if err != nil {
+		log.Errorf("services.ExecuteContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerExecuteFailed)
+		return
+	}
+
+	// a command that exits with a non-zero code is still executed successfully, the caller checks the exit code
+	ResponseSuccess(c, gin.H{
+		"stdout":   result.Stdout,
+		"stderr":   result.Stderr,
+		"exitCode": result.ExitCode,
+	})
+}
+
+// execUserRegexp matches the user and the optional group of an exec, each is a name or an id
+var execUserRegexp = regexp.MustCompile(`^([a-z_][a-z0-9_.-]*\$?|[0-9]+)(:([a-z_][a-z0-9_.-]*\$?|[0-9]+))?$`)
+
+// checkContainerExecute validates the user and the envs of an exec, CodeSuccess means the spec is valid
+func checkContainerExecute(spec *models.ContainerExecute) ResCode {
+	if len(spec.User) != 0 && !execUserRegexp.MatchString(spec.User) {
+		log.Errorf("failed to execute container, user: %s is invalid", spec.User)
+		return CodeContainerExecInvalid
+	}
+	for _, e := range spec.Env {
+		if key, _, ok := strings.Cut(e, "="); !ok || len(key) == 0 {
+			log.Errorf("failed to execute container, env: %s is invalid", e)
+			return CodeContainerExecInvalid
+		}
+	}
+	if len(spec.DetachKeys) != 0 && !validDetachKeys(spec.DetachKeys) {
+		log.Errorf("failed to execute container, detach keys: %s are invalid", spec.DetachKeys)
+		return CodeContainerExecInvalid
+	}
+	return CodeSuccess
+}
+
+// validDetachKeys checks the detach keys in the format of docker, the keys are separated by ',',
+// each key is a printable character, DEL or ctrl- with one of a-z, @, [, \, ], ^ and _
+func validDetachKeys(keys string) bool {
+	for _, key := range strings.Split(keys, ",") {
+		if key == "DEL" {
+			continue
+		}
+		if ctrl, ok := strings.CutPrefix(key, "ctrl-"); ok {
+			if len(ctrl) != 1 || !(ctrl[0] >= 'a' && ctrl[0] <= 'z' || strings.Contains("@[\\]^_", ctrl)) {
+				return false
+			}
+			continue
+		}
+		if len(key) != 1 || key[0] <= ' ' || key[0] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// the size of the terminal if it's not specified
+const (
+	defaultTerminalRows = 24
+	defaultTerminalCols = 80
+)
+
+// Terminal opens an interactive exec with a tty over websocket, e.g. ?cmd=bash&workDir=/root&rows=40&cols=120&detachKeys=ctrl-a,d,
+// the default command is /bin/sh. The client sends the input and the resizes as json models.ExecMessage,
+// the output of the tty is sent in binary frames. The websocket is closed after the command exits or is detached.
+func (rh *ReplicaSetHandler) Terminal(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to open terminal, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	rows, cols := uint64(defaultTerminalRows), uint64(defaultTerminalCols)
+	var err error
+	if value := c.Query("rows"); len(value) != 0 {
+		if rows, err = strconv.ParseUint(value, 10, 16); err != nil || rows == 0 {
+			log.Errorf("failed to open terminal, rows: %s is invalid", value)
+			ResponseError(c, CodeInvalidParams)
+			return
+		}
+	}
+	if value := c.Query("cols"); len(value) != 0 {
+		if cols, err = strconv.ParseUint(value, 10, 16); err != nil || cols == 0 {
+			log.Errorf("failed to open terminal, cols: %s is invalid", value)
+			ResponseError(c, CodeInvalidParams)
+			return
+		}
+	}
+
+	// the exec is started before the upgrade, so its errors are responded as usual
+	spec := models.ContainerExecute{
+		WorkDir:    c.Query("workDir"),
+		Cmd:        c.QueryArray("cmd"),
+		Env:        c.QueryArray("env"),
+		User:       c.Query("user"),
+		DetachKeys: c.Query("detachKeys"),
+	}
+	if code := checkContainerExecute(&spec); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+	session, err := cs.ExecuteContainerInteractive(name, &spec, uint(rows), uint(cols))
+	if err != nil {
+		log.Errorf("services.ExecuteContainerInteractive failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerExecuteFailed)
+		return
+	}
+	defer session.Close()
+
+	websocket.Server{Handshake: checkOrigin, Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		go func() {
+			_, _ = io.Copy(ws, session)
+			_ = ws.Close()
+		}()
+
+		for {
+			var msg models.ExecMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case models.ExecMessageStdin:
+				if _, err := session.Write([]byte(msg.Data)); err != nil {
+					return
+				}
+			case models.ExecMessageResize:
+				if err := session.Resize(msg.Rows, msg.Cols); err != nil {
+					log.Warnf("failed to resize terminal of container: %s, error: %v", name, err)
+				}
+			}
+		}
+	}}.ServeHTTP(c.Writer, c.Request)
+}
+
+// executeStream writes the output of the command as plain text while it runs,
+// the command is killed if the client closes the request before it exits
+func (rh *ReplicaSetHandler) executeStream(c *gin.Context, name string, spec *models.ContainerExecute) {
+	output, err := cs.ExecuteContainerStream(name, spec)
+	if err != nil {
+		log.Errorf("services.ExecuteContainerStream failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerExecuteFailed)
+		return
+	}
+	defer output.Close()
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	buf := make([]byte, 32*1024)
+	c.Stream(func(w io.Writer) bool {
+		n, err := output.Read(buf)
+		if n > 0 {
+			_, _ = w.Write(buf[:n])
+		}
+		return err == nil
+	})
+}
+
+// Top lists the processes in the latest version of the container, the pids are on the host
+func (rh *ReplicaSetHandler) Top(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to top container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	top, err := cs.TopContainer(name)
+	if err != nil {
+		log.Errorf("services.TopContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeContainerTopFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"titles":    top.Titles,
+		"processes": top.Processes,
+	})
+}
+
+// Kill sends a signal to a process in the latest version of the container without restarting it
+func (rh *ReplicaSetHandler) Kill(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to kill process, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ProcessKill
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to kill process, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if err := cs.KillProcess(name, &spec); err != nil {
+		log.Errorf("services.KillProcess failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsProcessNotFoundError(err) {
+			ResponseError(c, CodeContainerProcessNotFound)
+			return
+		}
+		if xerrors.IsSignalInvalidError(err) {
+			ResponseError(c, CodeContainerSignalInvalid)
+			return
+		}
+		responseDockerError(c, err, CodeContainerKillProcessFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+// Profile runs a short-lived privileged profiler on the gpus of the latest version of the container,
+// and returns its output after it exits.
+func (rh *ReplicaSetHandler) Profile(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to profile container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ProfilerLaunch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to profile container, error:", err.Error())
 		ResponseError(c, CodeInvalidParams)
 		return
 	}
-
-	if len(spec.ImageName) == 0 {
-		log.Error("failed to create container, image name is empty")
-		ResponseError(c, CodeImageNameCannotBeEmpty)
+	if len(spec.Image) == 0 || spec.Timeout < 0 {
+		log.Errorf("failed to profile container, image: %s or timeout: %d is invalid", spec.Image, spec.Timeout)
+		ResponseError(c, CodeInvalidParams)
 		return
 	}
 
-	if len(spec.ReplicaSetName) == 0 {
-		log.Error("failed to create container, container name is empty")
-		ResponseError(c, CodeContainerNameCannotBeEmpty)
+	result, err := cs.LaunchProfiler(name, &spec)
+	if err != nil {
+		log.Errorf("services.LaunchProfiler failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsProfilerNotAllowedError(err) {
+			ResponseError(c, CodeContainerProfilerNotAllowed)
+			return
+		}
+		responseDockerError(c, err, CodeContainerProfileFailed)
 		return
 	}
 
-	if spec.GpuCount < 0 {
-		log.Error("failed to create container, gpu count must be greater than 0")
-		ResponseError(c, CodeGpuCountMustBeGreaterThanOrEqualZero)
+	ResponseSuccess(c, gin.H{
+		"result": result,
+	})
+}
+
+// Checkpoint the process state of the latest version of the container via CRIU,
+// the container using gpus can be checkpointed only if cuda-checkpoint is installed.
+func (rh *ReplicaSetHandler) Checkpoint(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to checkpoint container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
 		return
 	}
 
-	if strings.Contains(spec.ReplicaSetName, "-") {
-		log.Error("failed to create container, container name cannot contain dash")
-		ResponseError(c, CodeContainerNameCannotContainDash)
+	var spec models.CheckpointCreate
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to checkpoint container, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
 		return
 	}
 
-	_, containerName, err := cs.RunGpuContainer(&spec)
+	checkpoint, err := cs.CheckpointContainer(name, &spec)
 	if err != nil {
-		log.Errorf("services.RunGpuContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("services.CheckpointContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		if xerrors.IsContainerExistedError(err) {
-			ResponseError(c, CodeContainerAlreadyExist)
-			return
-		}
-		if xerrors.IsGpuNotEnoughError(err) {
-			ResponseError(c, CodeContainerGpuNotEnough)
-			return
-		}
-		if xerrors.IsPortNotEnoughError(err) {
-			ResponseError(c, CodeContainerPortNotEnough)
+		if xerrors.IsCheckpointNotSupportedError(err) {
+			ResponseError(c, CodeContainerCheckpointNotSupported)
 			return
 		}
-		ResponseError(c, CodeContainerRunFailed)
+		responseDockerError(c, err, CodeContainerCheckpointFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
-		"name": containerName,
+		"checkpoint": checkpoint,
 	})
 }
 
-// Commit the latest version of the container as image.
-// The image name is the default image id, or you can specify a new image name.
-func (rh *ReplicaSetHandler) Commit(c *gin.Context) {
+// Clone the latest version of the container as a new replicaSet,
+// the new replicaSet will apply for new gpus and ports.
+func (rh *ReplicaSetHandler) Clone(c *gin.Context) {
 	name := c.Param("name")
 	if len(name) == 0 {
-		log.Error("failed to commit container, name is empty")
+		log.Error("failed to clone container, name is empty")
 		ResponseError(c, CodeContainerNameCannotBeEmpty)
 		return
 	}
 
-	var spec models.ContainerCommit
+	var spec models.ContainerClone
 	if err := c.ShouldBindJSON(&spec); err != nil {
-		log.Error("failed to commit container, error:", err.Error())
+		log.Error("failed to clone container, error:", err.Error())
 		ResponseError(c, CodeInvalidParams)
 		return
 	}
 
-	imageName, err := cs.CommitContainer(name, spec)
+	if len(spec.NewReplicaSetName) == 0 {
+		log.Error("failed to clone container, new container name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	if strings.Contains(spec.NewReplicaSetName, "-") {
+		log.Error("failed to clone container, container name cannot contain dash")
+		ResponseError(c, CodeContainerNameCannotContainDash)
+		return
+	}
+
+	_, containerName, err := cs.CloneContainer(name, &spec)
 	if err != nil {
-		log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("services.CloneContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerCommitFailed)
+		// the clone has the anti-co-location labels of the source
+		responseRunError(c, schedulers.GpuScheduler.Labels(name), err, CodeContainerCloneFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
-		"imageName": imageName,
+		"containerName": containerName,
 	})
 }
 
-// Execute a command in the latest version of the running container and return the output
-func (rh *ReplicaSetHandler) Execute(c *gin.Context) {
+// Rename the replicaSet, the version number continues under the new name
+func (rh *ReplicaSetHandler) Rename(c *gin.Context) {
 	name := c.Param("name")
 	if len(name) == 0 {
-		log.Error("failed to execute container, name is empty")
+		log.Error("failed to rename container, name is empty")
 		ResponseError(c, CodeContainerNameCannotBeEmpty)
 		return
 	}
 
-	var spec models.ContainerExecute
+	var spec models.ContainerRename
 	if err := c.ShouldBindJSON(&spec); err != nil {
-		log.Error("failed to execute container, error:", err.Error())
+		log.Error("failed to rename container, error:", err.Error())
 		ResponseError(c, CodeInvalidParams)
 		return
 	}
 
-	resp, err := cs.ExecuteContainer(name, &spec)
+	if len(spec.NewReplicaSetName) == 0 {
+		log.Error("failed to rename container, new container name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	if strings.Contains(spec.NewReplicaSetName, "-") {
+		log.Error("failed to rename container, container name cannot contain dash")
+		ResponseError(c, CodeContainerNameCannotContainDash)
+		return
+	}
+
+	if spec.NewReplicaSetName == name {
+		log.Errorf("failed to rename container, the new name is the same as: %s", name)
+		ResponseError(c, CodeContainerAlreadyExist)
+		return
+	}
+
+	_, containerName, err := cs.RenameContainer(name, spec.NewReplicaSetName)
 	if err != nil {
-		log.Errorf("services.ExecuteContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("services.RenameContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerExecuteFailed)
+		if xerrors.IsContainerExistedError(err) {
+			responseContainerExisted(c, err)
+			return
+		}
+		if xerrors.IsContainerNotReadyError(err) {
+			ResponseError(c, CodeContainerNotReady)
+			return
+		}
+		if xerrors.IsPortNotEnoughError(err) {
+			ResponseError(c, CodeContainerPortNotEnough)
+			return
+		}
+		responseDockerError(c, err, CodeContainerRenameFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
-		"stdout": resp,
+		"containerName": containerName,
 	})
 }
 
@@ -219,6 +1303,7 @@ func (rh *ReplicaSetHandler) Execute(c *gin.Context) {
 // You can change the gpu, volume.
 // If you request body is empty(e.g. {}), it will recreate a container based on the existing configuration.
 // Then the old container will be deleted.
+// With the blueGreen strategy, the old container is deleted only after the new one is healthy and the cutover hook succeeds.
 func (rh *ReplicaSetHandler) Patch(c *gin.Context) {
 	name := c.Param("name")
 	if len(name) == 0 {
@@ -239,27 +1324,237 @@ func (rh *ReplicaSetHandler) Patch(c *gin.Context) {
 		ResponseError(c, CodeGpuCountMustBeGreaterThanOrEqualZero)
 		return
 	}
+	if spec.GpuPatch != nil && spec.GpuPatch.GpuCount > schedulers.GpuScheduler.AvailableGpuNums {
+		log.Errorf("failed to patch container, gpu count: %d exceeds the %d gpus on the host",
+			spec.GpuPatch.GpuCount, schedulers.GpuScheduler.AvailableGpuNums)
+		ResponseError(c, CodeGpuCountExceeded)
+		return
+	}
 
-	if spec.VolumePatch != nil && (spec.VolumePatch.OldBind.Format() == "" ||
-		spec.VolumePatch.NewBind.Format() == "") {
+	if spec.VolumePatch != nil && (spec.VolumePatch.OldBind == nil || spec.VolumePatch.OldBind.Format() == "" ||
+		spec.VolumePatch.NewBind == nil || !spec.VolumePatch.NewBind.Valid() || spec.VolumePatch.NewBind.IsTmpfs()) {
 		log.Errorf("failed to patch container,volume Patch Info is invalid: %v", spec.VolumePatch)
 		ResponseError(c, CodeInvalidParams)
 		return
 	}
+	if spec.EnvPatch != nil && !validEnvPatch(spec.EnvPatch) {
+		ResponseError(c, CodeContainerEnvPatchInvalid)
+		return
+	}
+	if spec.ImagePatch != nil && len(strings.TrimSpace(spec.ImagePatch.ImageName)) == 0 {
+		log.Error("failed to patch container, image name is empty")
+		ResponseError(c, CodeImageNameCannotBeEmpty)
+		return
+	}
+	if spec.PortPatch != nil {
+		if code := checkPortPatch(spec.PortPatch); code != CodeSuccess {
+			ResponseError(c, code)
+			return
+		}
+	}
+
+	switch spec.Strategy {
+	case "", models.PatchReplace:
+		if len(spec.CutoverHook) != 0 {
+			log.Errorf("failed to patch container, cutover hook: %s is only used by blue/green patch", spec.CutoverHook)
+			ResponseError(c, CodeContainerPatchStrategyInvalid)
+			return
+		}
+	case models.PatchBlueGreen:
+		if spec.Checkpoint {
+			log.Error("failed to patch container, checkpoint is not supported by blue/green patch")
+			ResponseError(c, CodeContainerPatchStrategyInvalid)
+			return
+		}
+		if len(spec.CutoverHook) != 0 {
+			if u, err := url.Parse(spec.CutoverHook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				log.Errorf("failed to patch container, cutover hook: %s is not a http url", spec.CutoverHook)
+				ResponseError(c, CodeContainerPatchStrategyInvalid)
+				return
+			}
+		}
+	default:
+		log.Errorf("failed to patch container, strategy: %s is invalid", spec.Strategy)
+		ResponseError(c, CodeContainerPatchStrategyInvalid)
+		return
+	}
 
 	_, containerName, err := cs.PatchContainer(name, &spec)
 	if err != nil {
 		log.Errorf("services.PatchContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerPatchFailed)
+		if xerrors.IsCheckpointNotSupportedError(err) {
+			ResponseError(c, CodeContainerCheckpointNotSupported)
+			return
+		}
+		responseDockerError(c, err, CodeContainerPatchFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"containerName": containerName,
+	})
+}
+
+// PatchEnv sets or deletes the envs of the current version by key, the gpus and volumes are kept
+func (rh *ReplicaSetHandler) PatchEnv(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to patch container env, container name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.EnvPatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Errorf("failed to patch container env, error: %v", err)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if !validEnvPatch(&spec) {
+		ResponseError(c, CodeContainerEnvPatchInvalid)
+		return
+	}
+
+	_, containerName, err := cs.PatchContainerEnv(name, &spec)
+	if err != nil {
+		log.Errorf("services.PatchContainerEnv failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsNoPatchRequiredError(err) {
+			ResponseError(c, CodeContainerNoNeedPatch)
+			return
+		}
+		responseDockerError(c, err, CodeContainerPatchFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"containerName": containerName,
+	})
+}
+
+// PatchImage replaces the image of the current version, e.g. to upgrade the cuda or pytorch tag,
+// the gpus, volumes and ports are kept, the response is the name and version of the new container.
+func (rh *ReplicaSetHandler) PatchImage(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to patch container image, container name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ImagePatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Errorf("failed to patch container image, error: %v", err)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	spec.ImageName = strings.TrimSpace(spec.ImageName)
+	if len(spec.ImageName) == 0 {
+		log.Error("failed to patch container image, image name is empty")
+		ResponseError(c, CodeImageNameCannotBeEmpty)
+		return
+	}
+
+	_, containerName, err := cs.PatchContainerImage(name, &spec)
+	if err != nil {
+		log.Errorf("services.PatchContainerImage failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsNoPatchRequiredError(err) {
+			ResponseError(c, CodeContainerNoNeedPatch)
+			return
+		}
+		if xerrors.IsImagePullFailedError(err) {
+			ResponseError(c, CodeContainerImagePullFailed)
+			return
+		}
+		responseDockerError(c, err, CodeContainerPatchFailed)
+		return
+	}
+
+	version, _ := strconv.ParseInt(strings.TrimPrefix(containerName, name+"-"), 10, 64)
+	ResponseSuccess(c, gin.H{
+		"containerName": containerName,
+		"version":       version,
+	})
+}
+
+// PatchPorts publishes or unpublishes the ports of the current version, the gpus and volumes are kept,
+// the response is the name and version of the new container and the host ports bound to it.
+func (rh *ReplicaSetHandler) PatchPorts(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to patch container ports, container name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ContainerPortPatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Errorf("failed to patch container ports, error: %v", err)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if code := checkPortPatch(&spec); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	_, containerName, ports, err := cs.PatchContainerPorts(name, &spec)
+	if err != nil {
+		log.Errorf("services.PatchContainerPorts failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsNoPatchRequiredError(err) {
+			ResponseError(c, CodeContainerNoNeedPatch)
+			return
+		}
+		if xerrors.IsPortConflictError(err) {
+			ResponseErrorWithData(c, CodeContainerPortConflict, gin.H{
+				"conflict": err.Error(),
+			})
+			return
+		}
+		if xerrors.IsPortNotEnoughError(err) {
+			ResponseError(c, CodeContainerPortNotEnough)
+			return
+		}
+		responseDockerError(c, err, CodeContainerPatchFailed)
 		return
 	}
 
+	version, _ := strconv.ParseInt(strings.TrimPrefix(containerName, name+"-"), 10, 64)
 	ResponseSuccess(c, gin.H{
 		"containerName": containerName,
+		"version":       version,
+		"ports":         ports,
 	})
 }
 
+// validEnvPatch checks that the keys are not empty, contain no '=' and are not both set and deleted
+func validEnvPatch(spec *models.EnvPatch) bool {
+	for key := range spec.Set {
+		if len(key) == 0 || strings.Contains(key, "=") {
+			log.Errorf("failed to patch container env, key: %s is invalid", key)
+			return false
+		}
+	}
+	for _, key := range spec.Delete {
+		if len(key) == 0 || strings.Contains(key, "=") {
+			log.Errorf("failed to patch container env, key: %s is invalid", key)
+			return false
+		}
+		if _, ok := spec.Set[key]; ok {
+			log.Errorf("failed to patch container env, key: %s is both set and deleted", key)
+			return false
+		}
+	}
+	if len(spec.Set) == 0 && len(spec.Delete) == 0 {
+		log.Error("failed to patch container env, nothing to set or delete")
+		return false
+	}
+	return true
+}
+
 // Rollback a container to a specific version
 func (rh *ReplicaSetHandler) Rollback(c *gin.Context) {
 	name := c.Param("name")
@@ -291,7 +1586,11 @@ func (rh *ReplicaSetHandler) Rollback(c *gin.Context) {
 			ResponseError(c, CodeContainerNoNeedRollback)
 			return
 		}
-		ResponseError(c, CodeContainerRollbackFailed)
+		if xerrors.IsContainerVersionNotFoundError(err) {
+			ResponseError(c, CodeContainerVersionNotFound)
+			return
+		}
+		responseDockerError(c, err, CodeContainerRollbackFailed)
 		return
 	}
 
@@ -313,7 +1612,7 @@ func (rh *ReplicaSetHandler) Pause(c *gin.Context) {
 	if err := cs.StopContainer(name, false, false, true); err != nil {
 		log.Errorf("services.StopContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerShutDownFailed)
+		responseDockerError(c, err, CodeContainerShutDownFailed)
 		return
 	}
 
@@ -330,14 +1629,18 @@ func (rh *ReplicaSetHandler) Continue(c *gin.Context) {
 		return
 	}
 
-	if err := cs.StartupContainer(name); err != nil {
+	boundPorts, warnings, err := cs.StartupContainer(name)
+	if err != nil {
 		log.Errorf("services.StartupContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerRestartFailed)
+		responseDockerError(c, err, CodeContainerRestartFailed)
 		return
 	}
 
-	ResponseSuccess(c, nil)
+	ResponseSuccess(c, gin.H{
+		"ports":    boundPorts,
+		"warnings": warnings,
+	})
 }
 
 // Stop the latest version of the container
@@ -353,7 +1656,7 @@ func (rh *ReplicaSetHandler) Stop(c *gin.Context) {
 	if err := cs.StopContainer(name, true, true, true); err != nil {
 		log.Errorf("services.StopContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerStopFailed)
+		responseDockerError(c, err, CodeContainerStopFailed)
 		return
 	}
 
@@ -374,7 +1677,7 @@ func (rh *ReplicaSetHandler) Restart(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerRestartFailed)
+		responseDockerError(c, err, CodeContainerRestartFailed)
 		return
 	}
 
@@ -392,12 +1695,116 @@ func (rh *ReplicaSetHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	if err := cs.DeleteContainer(name); err != nil {
+	// soft delete keeps the stopped container for post-mortem, e.g. ?soft=true&commitImage=true&exportLogs=true
+	if soft, _ := strconv.ParseBool(c.Query("soft")); soft {
+		var spec models.ContainerSoftDelete
+		spec.CommitImage, _ = strconv.ParseBool(c.Query("commitImage"))
+		spec.ExportLogs, _ = strconv.ParseBool(c.Query("exportLogs"))
+		archive, err := cs.SoftDeleteContainer(name, &spec)
+		if err != nil {
+			log.Errorf("services.SoftDeleteContainer failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsContainerArchivedError(err) {
+				ResponseError(c, CodeContainerAlreadyArchived)
+				return
+			}
+			responseDockerError(c, err, CodeContainerSoftDeleteFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"archive": archive,
+		})
+		return
+	}
+
+	// delete every version of the replicaSet, e.g. ?allVersions=true&force=true
+	if all, _ := strconv.ParseBool(c.Query("allVersions")); all {
+		force, _ := strconv.ParseBool(c.Query("force"))
+		report, err := cs.DeleteAllVersions(name, force)
+		if err != nil {
+			log.Errorf("services.DeleteAllVersions failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			responseDockerError(c, err, CodeContainerDeleteFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"report": report,
+		})
+		return
+	}
+
+	// stop gracefully before remove, e.g. ?graceful=true&stopTimeout=60
+	var spec models.ContainerDelete
+	spec.Graceful, _ = strconv.ParseBool(c.Query("graceful"))
+	if timeout := c.Query("stopTimeout"); len(timeout) != 0 {
+		var err error
+		if spec.StopTimeout, err = strconv.Atoi(timeout); err != nil || spec.StopTimeout < 0 {
+			log.Errorf("failed to delete container, stop timeout: %s is invalid", timeout)
+			ResponseError(c, CodeInvalidParams)
+			return
+		}
+	}
+
+	if err := cs.DeleteContainer(name, &spec); err != nil {
 		log.Errorf("services.DeleteContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerDeleteFailed)
+		responseDockerError(c, err, CodeContainerDeleteFailed)
 		return
 	}
 
 	ResponseSuccess(c, nil)
 }
+
+// Undelete restores a soft deleted container as a new version, before it's removed by the retention gc
+func (rh *ReplicaSetHandler) Undelete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to undelete container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	_, containerName, err := cs.UndeleteContainer(name)
+	if err != nil {
+		log.Errorf("services.UndeleteContainer failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsContainerNotArchivedError(err) {
+			ResponseError(c, CodeContainerNotArchived)
+			return
+		}
+		if xerrors.IsGpuCountExceededError(err) {
+			ResponseError(c, CodeGpuCountExceeded)
+			return
+		}
+		if xerrors.IsGpuUnhealthyError(err) {
+			ResponseError(c, CodeGpuUnhealthy)
+			return
+		}
+		if xerrors.IsGpuBusyError(err) {
+			ResponseError(c, CodeGpuBusy)
+			return
+		}
+		if xerrors.IsGpuConstraintUnsatisfiableError(err) {
+			ResponseError(c, CodeGpuConstraintUnsatisfiable)
+			return
+		}
+		if xerrors.IsGpuNotFoundError(err) {
+			ResponseError(c, CodeContainerGpuUUIDsInvalid)
+			return
+		}
+		if xerrors.IsMigProfileNotFoundError(err) {
+			ResponseError(c, CodeContainerMigProfileInvalid)
+			return
+		}
+		if xerrors.IsGpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerGpuNotEnough)
+			return
+		}
+		responseDockerError(c, err, CodeContainerUndeleteFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"containerName": containerName,
+	})
+}
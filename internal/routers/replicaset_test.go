@@ -0,0 +1,214 @@
+package routers
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+func TestCheckGpuOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		spec models.ContainerRun
+		want ResCode
+	}{
+		{name: "pci", spec: models.ContainerRun{GpuCount: 2, GpuOrder: models.GpuOrderPci}, want: CodeSuccess},
+		{name: "allocation", spec: models.ContainerRun{GpuCount: 1, GpuOrder: models.GpuOrderAllocation}, want: CodeSuccess},
+		{name: "unknown", spec: models.ContainerRun{GpuCount: 1, GpuOrder: "numa"}, want: CodeContainerGpuOrderInvalid},
+		{name: "no gpu", spec: models.ContainerRun{GpuOrder: models.GpuOrderPci}, want: CodeContainerGpuOrderInvalid},
+		{name: "mig", spec: models.ContainerRun{MigProfile: "1g.5gb", MigCount: 2, GpuOrder: models.GpuOrderPci},
+			want: CodeContainerMigGpuOrderUnsupported},
+		{name: "cuda visible devices in env", spec: models.ContainerRun{GpuCount: 1, GpuOrder: models.GpuOrderPci,
+			Env: []string{"CUDA_VISIBLE_DEVICES=0"}}, want: CodeContainerGpuOrderInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkGpuOrder(&tt.spec); got != tt.want {
+				t.Errorf("checkGpuOrder(%+v) = %d, want %d", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCheckGpuConstraints leaves out the excluded indexes, they are checked against the gpus of the host
+func TestCheckGpuConstraints(t *testing.T) {
+	node := func(n int) *int { return &n }
+	tests := []struct {
+		name string
+		spec models.ContainerRun
+		want ResCode
+	}{
+		{name: "numa node", spec: models.ContainerRun{GpuCount: 2, GpuConstraints: &models.GpuConstraints{NumaNode: node(1)}},
+			want: CodeSuccess},
+		{name: "no constraints", spec: models.ContainerRun{GpuCount: 1, GpuConstraints: &models.GpuConstraints{}}, want: CodeSuccess},
+		{name: "negative numa node", spec: models.ContainerRun{GpuCount: 1, GpuConstraints: &models.GpuConstraints{NumaNode: node(-1)}},
+			want: CodeContainerGpuConstraintsInvalid},
+		{name: "no gpu", spec: models.ContainerRun{GpuConstraints: &models.GpuConstraints{NumaNode: node(0)}},
+			want: CodeContainerGpuConstraintsInvalid},
+		{name: "reservation", spec: models.ContainerRun{GpuCount: 1, ReservationToken: "token",
+			GpuConstraints: &models.GpuConstraints{NumaNode: node(0)}}, want: CodeContainerGpuConstraintsInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkGpuConstraints(&tt.spec); got != tt.want {
+				t.Errorf("checkGpuConstraints(%+v) = %d, want %d", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPorts(t *testing.T) {
+	tests := []struct {
+		name           string
+		containerPorts []string
+		ports          []models.Port
+		want           ResCode
+	}{
+		{name: "default protocol", containerPorts: []string{"8888"}, ports: []models.Port{{ContainerPort: 80, HostPort: 8080}}, want: CodeSuccess},
+		{name: "tcp", containerPorts: []string{"8888/tcp"}, ports: []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "tcp"}}, want: CodeSuccess},
+		{name: "udp", containerPorts: []string{"5000/udp"}, ports: []models.Port{{ContainerPort: 53, HostPort: 5353, Protocol: "udp"}}, want: CodeSuccess},
+		{name: "sctp", containerPorts: []string{"132/sctp"}, ports: []models.Port{{ContainerPort: 38412, HostPort: 38412, Protocol: "sctp"}}, want: CodeSuccess},
+		{name: "unsupported container port protocol", containerPorts: []string{"8888/icmp"}, want: CodeContainerPortInvalid},
+		{name: "unsupported port protocol", ports: []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "quic"}}, want: CodeContainerPortInvalid},
+		{name: "upper case protocol", containerPorts: []string{"5000/UDP"}, want: CodeContainerPortInvalid},
+		{name: "empty protocol", containerPorts: []string{"5000/"}, want: CodeContainerPortInvalid},
+		{name: "same port of each protocol", containerPorts: []string{"5000", "5000/udp", "5000/sctp"}, want: CodeSuccess},
+		{name: "same host port of each protocol", ports: []models.Port{
+			{ContainerPort: 53, HostPort: 5353, Protocol: "tcp"},
+			{ContainerPort: 53, HostPort: 5353, Protocol: "udp"},
+			{ContainerPort: 53, HostPort: 5353, Protocol: "sctp"},
+		}, want: CodeSuccess},
+		{name: "duplicated with the default protocol", containerPorts: []string{"80"}, ports: []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "tcp"}},
+			want: CodeContainerPortInvalid},
+		{name: "duplicated udp", containerPorts: []string{"53/udp"}, ports: []models.Port{{ContainerPort: 53, HostPort: 5353, Protocol: "udp"}},
+			want: CodeContainerPortInvalid},
+		{name: "duplicated sctp host port", ports: []models.Port{
+			{ContainerPort: 132, HostPort: 1320, Protocol: "sctp"},
+			{ContainerPort: 133, HostPort: 1320, Protocol: "sctp"},
+		}, want: CodeContainerPortInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPorts(tt.containerPorts, tt.ports); got != tt.want {
+				t.Errorf("checkPorts(%v, %+v) = %d, want %d", tt.containerPorts, tt.ports, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBinds(t *testing.T) {
+	tests := []struct {
+		name string
+		bind models.Bind
+		want ResCode
+	}{
+		{name: "host path", bind: models.Bind{Src: "/data", Dest: "/data"}, want: CodeSuccess},
+		{name: "volume", bind: models.Bind{Src: "foo-1", Dest: "/data"}, want: CodeSuccess},
+		{name: "read-only", bind: models.Bind{Src: "/datasets", Dest: "/datasets", ReadOnly: true}, want: CodeSuccess},
+		{name: "read-only volume", bind: models.Bind{Src: "foo-1", Dest: "/data", ReadOnly: true}, want: CodeSuccess},
+		{name: "propagation", bind: models.Bind{Src: "/mnt", Dest: "/mnt", Propagation: "rslave"}, want: CodeSuccess},
+		{name: "all options", bind: models.Bind{Src: "/mnt", Dest: "/mnt", ReadOnly: true, Propagation: "rshared", Consistency: "cached"},
+			want: CodeSuccess},
+		{name: "propagation of a volume", bind: models.Bind{Src: "foo-1", Dest: "/data", Propagation: "rslave"}, want: CodeContainerBindInvalid},
+		{name: "unknown propagation", bind: models.Bind{Src: "/mnt", Dest: "/mnt", Propagation: "unbindable"}, want: CodeContainerBindInvalid},
+		{name: "consistency", bind: models.Bind{Src: "foo-1", Dest: "/data", Consistency: "delegated"}, want: CodeSuccess},
+		{name: "unknown consistency", bind: models.Bind{Src: "/data", Dest: "/data", Consistency: "eventual"}, want: CodeContainerBindInvalid},
+		{name: "no src", bind: models.Bind{Dest: "/data"}, want: CodeContainerBindInvalid},
+		{name: "options in dest", bind: models.Bind{Src: "/data", Dest: "/data:ro"}, want: CodeContainerBindInvalid},
+		{name: "typed host path", bind: models.Bind{Type: "bind", Src: "/data", Dest: "/data"}, want: CodeSuccess},
+		{name: "typed volume", bind: models.Bind{Type: "volume", Src: "foo-1", Dest: "/data"}, want: CodeSuccess},
+		{name: "volume named like a path", bind: models.Bind{Type: "volume", Src: "/data", Dest: "/data"}, want: CodeContainerBindInvalid},
+		{name: "relative host path", bind: models.Bind{Type: "bind", Src: "data", Dest: "/data"}, want: CodeContainerBindInvalid},
+		{name: "relative path without type", bind: models.Bind{Src: "./data", Dest: "/data"}, want: CodeContainerBindInvalid},
+		{name: "windows path", bind: models.Bind{Src: `C:\data`, Dest: "/data"}, want: CodeContainerBindInvalid},
+		{name: "relative dest", bind: models.Bind{Src: "foo-1", Dest: "data"}, want: CodeContainerBindInvalid},
+		{name: "propagation of a typed volume", bind: models.Bind{Type: "volume", Src: "foo-1", Dest: "/data", Propagation: "rslave"},
+			want: CodeContainerBindInvalid},
+		{name: "unknown type", bind: models.Bind{Type: "npipe", Src: "/data", Dest: "/data"}, want: CodeContainerBindInvalid},
+		{name: "tmpfs", bind: models.Bind{Type: "tmpfs", Dest: "/dev/shm"}, want: CodeSuccess},
+		{name: "tmpfs size", bind: models.Bind{Type: "tmpfs", Dest: "/dev/shm", TmpfsSize: "16GB"}, want: CodeSuccess},
+		{name: "invalid tmpfs size", bind: models.Bind{Type: "tmpfs", Dest: "/dev/shm", TmpfsSize: "16"}, want: CodeContainerBindInvalid},
+		{name: "tmpfs with src", bind: models.Bind{Type: "tmpfs", Src: "/data", Dest: "/dev/shm"}, want: CodeContainerBindInvalid},
+		{name: "tmpfs propagation", bind: models.Bind{Type: "tmpfs", Dest: "/dev/shm", Propagation: "rslave"}, want: CodeContainerBindInvalid},
+		{name: "tmpfs size of a host path", bind: models.Bind{Src: "/data", Dest: "/data", TmpfsSize: "1GB"}, want: CodeContainerBindInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkBinds([]models.Bind{tt.bind}); got != tt.want {
+				t.Errorf("checkBinds(%+v) = %d, want %d", tt.bind, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckContainerExecute(t *testing.T) {
+	tests := []struct {
+		name string
+		spec models.ContainerExecute
+		want ResCode
+	}{
+		{name: "empty", want: CodeSuccess},
+		{name: "user name", spec: models.ContainerExecute{User: "nobody"}, want: CodeSuccess},
+		{name: "uid", spec: models.ContainerExecute{User: "1000"}, want: CodeSuccess},
+		{name: "user and group", spec: models.ContainerExecute{User: "www-data:www-data"}, want: CodeSuccess},
+		{name: "uid and gid", spec: models.ContainerExecute{User: "1000:100"}, want: CodeSuccess},
+		{name: "user and gid", spec: models.ContainerExecute{User: "jovyan:100"}, want: CodeSuccess},
+		{name: "machine account", spec: models.ContainerExecute{User: "host$"}, want: CodeSuccess},
+		{name: "empty group", spec: models.ContainerExecute{User: "1000:"}, want: CodeContainerExecInvalid},
+		{name: "empty user", spec: models.ContainerExecute{User: ":100"}, want: CodeContainerExecInvalid},
+		{name: "upper case", spec: models.ContainerExecute{User: "Root"}, want: CodeContainerExecInvalid},
+		{name: "spaces", spec: models.ContainerExecute{User: "root; id"}, want: CodeContainerExecInvalid},
+		{name: "three parts", spec: models.ContainerExecute{User: "a:b:c"}, want: CodeContainerExecInvalid},
+		{name: "env", spec: models.ContainerExecute{Env: []string{"FOO=bar", "EMPTY=", "URL=a=b"}}, want: CodeSuccess},
+		{name: "env without value", spec: models.ContainerExecute{Env: []string{"FOO"}}, want: CodeContainerExecInvalid},
+		{name: "env without key", spec: models.ContainerExecute{Env: []string{"=bar"}}, want: CodeContainerExecInvalid},
+		{name: "detach keys", spec: models.ContainerExecute{DetachKeys: "ctrl-a,d"}, want: CodeSuccess},
+		{name: "invalid detach keys", spec: models.ContainerExecute{DetachKeys: "ctrl-"}, want: CodeContainerExecInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkContainerExecute(&tt.spec); got != tt.want {
+				t.Errorf("checkContainerExecute(%+v) = %d, want %d", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidDetachKeys(t *testing.T) {
+	tests := []struct {
+		keys string
+		want bool
+	}{
+		{keys: "ctrl-p,q", want: true},
+		{keys: "ctrl-a,d", want: true},
+		{keys: "ctrl-@", want: true},
+		{keys: "ctrl-[,ctrl-\\,ctrl-],ctrl-^,ctrl-_", want: true},
+		{keys: "ctrl-x,ctrl-y,ctrl-z", want: true},
+		{keys: "q", want: true},
+		{keys: "~,!", want: true},
+		{keys: "DEL", want: true},
+		{keys: "ctrl-p,DEL", want: true},
+		{keys: "", want: false},
+		{keys: "ctrl-", want: false},
+		{keys: "ctrl-p,", want: false},
+		{keys: ",q", want: false},
+		{keys: "ctrl-P", want: false},
+		{keys: "ctrl-1", want: false},
+		{keys: "ctrl-pq", want: false},
+		{keys: "ctrl+p", want: false},
+		{keys: "alt-p", want: false},
+		{keys: "ctrl-p, q", want: false},
+		{keys: "pq", want: false},
+		{keys: "del", want: false},
+		{keys: " ", want: false},
+		{keys: "\t", want: false},
+		{keys: "é", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keys, func(t *testing.T) {
+			if got := validDetachKeys(tt.keys); got != tt.want {
+				t.Errorf("validDetachKeys(%q) = %v, want %v", tt.keys, got, tt.want)
+			}
+		})
+	}
+}
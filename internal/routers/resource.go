@@ -1,23 +1,69 @@
 package routers
 
 import (
+	"math"
+
 	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
 
+	"github.com/mayooot/gpu-docker-api/internal/models"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
 type Resource struct{}
 
+// maxReservationTTL is the max seconds the gpus are held by a reservation
+const maxReservationTTL = 7 * 24 * 3600
+
+var (
+	rvs services.ReservationService
+	gs  services.GpuService
+)
+
 func (gh *Resource) RegisterRoute(g *gin.RouterGroup) {
 	g.GET("/resources/gpus", gh.GetGpus)
+	g.GET("/resources/gpus/devices", gh.ListGpus)
 	g.GET("resources/ports", gh.GetPorts)
+	g.GET("/resources/status", gh.GetStatus)
+	g.PATCH("/resources/containerLimit", gh.PatchContainerLimit)
+	g.POST("/resources/gpus/reservations", gh.ReserveGpus)
+	g.DELETE("/resources/gpus/reservations/:id", gh.ReleaseReservation)
+	g.POST("/resources/gpus/whatif", gh.WhatIf)
 }
 
 // GetGpus 0 means not used, 1 means used.
+// The reservations are the replicaSet and the external job id which hold the used gpus.
+// The unhealthy gpus are excluded from allocation, e.g. with uncorrectable ecc errors or fallen off the bus.
+// The gpus in mig mode are held by "mig:", their instances are listed in mig.
+// The shared gpus are listed with the replicaSets sharing them.
 func (gh *Resource) GetGpus(c *gin.Context) {
 	gpus := schedulers.GpuScheduler.GetGpuStatus()
 	ResponseSuccess(c, gin.H{
-		"gpus": gpus,
+		"gpus":         gpus,
+		"mig":          schedulers.GpuScheduler.GetMigDevices(),
+		"unhealthy":    schedulers.GpuScheduler.GetGpuHealth(),
+		"reservations": schedulers.GpuScheduler.GetGpuReservations(),
+		"slotsPerGpu":  schedulers.GpuScheduler.SlotsPerGpu,
+		"usedSlots":    schedulers.GpuScheduler.GetGpuSlots(),
+		"shared":       schedulers.GpuScheduler.GetSharedGpus(),
+	})
+}
+
+// ListGpus the index, memory in MiB, utilization, health and the containers of each gpu on the host
+func (gh *Resource) ListGpus(c *gin.Context) {
+	devices, err := gs.ListGpus()
+	if err != nil {
+		log.Errorf("services.ListGpus failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeGpuListFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"gpus": devices,
 	})
 }
 
@@ -28,3 +74,154 @@ func (gh *Resource) GetPorts(c *gin.Context) {
 		"ports": status,
 	})
 }
+
+// GetStatus the committed cpu and memory requests vs the capacity of the host,
+// cpu is in nano cpus and memory is in bytes.
+// The containers are the managed running containers vs the limit.
+func (gh *Resource) GetStatus(c *gin.Context) {
+	containers, err := services.GetContainerLimitStatus()
+	if err != nil {
+		log.Errorf("services.GetContainerLimitStatus failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeResourceStatusFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"status":     schedulers.ResourceScheduler.GetResourceStatus(),
+		"containers": containers,
+	})
+}
+
+// PatchContainerLimit changes the max number of managed running containers at runtime, 0 means unlimited
+func (gh *Resource) PatchContainerLimit(c *gin.Context) {
+	var spec models.ContainerLimitPatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to patch container limit, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if spec.Limit < 0 {
+		log.Errorf("failed to patch container limit, limit: %d must be greater than or equal to 0", spec.Limit)
+		ResponseError(c, CodeContainerLimitInvalid)
+		return
+	}
+
+	services.SetContainerLimit(spec.Limit)
+	log.Infof("container limit is changed to %d", spec.Limit)
+	ResponseSuccess(c, nil)
+}
+
+// ReserveGpus holds gpus for a future job, the token is passed as reservationToken when running the container.
+// The token is only returned once, the id is used to release the reservation early.
+func (gh *Resource) ReserveGpus(c *gin.Context) {
+	var spec models.TokenReservationCreate
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to reserve gpus, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if spec.Count <= 0 || spec.Count > schedulers.GpuScheduler.AvailableGpuNums || spec.TTL < 0 || spec.TTL > maxReservationTTL {
+		log.Errorf("failed to reserve gpus, count: %d or ttl: %d is invalid", spec.Count, spec.TTL)
+		ResponseError(c, CodeGpuReservationParamsInvalid)
+		return
+	}
+
+	token, record, err := rvs.ReserveGpus(&spec)
+	if err != nil {
+		log.Errorf("services.ReserveGpus failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsGpuUnhealthyError(err) {
+			ResponseError(c, CodeGpuUnhealthy)
+			return
+		}
+		if xerrors.IsGpuNotEnoughError(err) {
+			ResponseError(c, CodeContainerGpuNotEnough)
+			return
+		}
+		ResponseError(c, CodeGpuReservationCreateFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"token":       token,
+		"reservation": record,
+	})
+}
+
+func (gh *Resource) ReleaseReservation(c *gin.Context) {
+	id := c.Param("id")
+	if len(id) == 0 {
+		log.Error("failed to release reservation, id is empty")
+		ResponseError(c, CodeGpuReservationParamsInvalid)
+		return
+	}
+
+	if err := rvs.ReleaseReservation(id); err != nil {
+		log.Errorf("services.ReleaseReservation failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsReservationInvalidError(err) {
+			ResponseError(c, CodeGpuReservationInvalid)
+			return
+		}
+		ResponseError(c, CodeGpuReservationReleaseFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+// WhatIf explains whether the gpus of the container spec can be allocated now and why each gpu is eligible or rejected,
+// only replicaSetName and the gpu fields are used, they are validated as the ones of a run, nothing is allocated.
+func (gh *Resource) WhatIf(c *gin.Context) {
+	var spec models.ContainerRun
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to explain gpu allocation, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	var slots int
+	if spec.GpuFraction != 0 {
+		fraction := spec.GpuFraction * float64(schedulers.GpuScheduler.SlotsPerGpu)
+		slots = int(math.Round(fraction))
+		if spec.GpuCount != 0 || spec.GpuFraction < 0 || spec.GpuFraction >= 1 || math.Abs(fraction-float64(slots)) > 1e-9 || slots < 1 {
+			log.Errorf("failed to explain gpu allocation, gpu fraction: %v is invalid, slots per gpu: %d",
+				spec.GpuFraction, schedulers.GpuScheduler.SlotsPerGpu)
+			ResponseError(c, CodeContainerGpuFractionInvalid)
+			return
+		}
+	} else if len(spec.MigProfile) != 0 || spec.MigCount != 0 {
+		if spec.MigCount == 0 {
+			spec.MigCount = 1
+		}
+		if code := checkMigProfile(&spec); code != CodeSuccess {
+			ResponseError(c, code)
+			return
+		}
+	} else if spec.GpuCount <= 0 {
+		log.Errorf("failed to explain gpu allocation, gpu count: %d must be greater than 0", spec.GpuCount)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	result := schedulers.GpuScheduler.WhatIf(&schedulers.WhatIfRequest{
+		Owner:       spec.ReplicaSetName,
+		GpuCount:    spec.GpuCount,
+		UUIDs:       spec.GpuUUIDs,
+		Constraints: spec.GpuConstraints,
+		Slots:       slots,
+		Labels:      spec.GpuLabels,
+		Shared:      spec.GpuShared || spec.GpuMps,
+		MaxSharers:  spec.GpuMaxSharers,
+		Mps:         spec.GpuMps,
+		MigProfile:  spec.MigProfile,
+		MigCount:    spec.MigCount,
+	})
+	if spec.GpuCount > 0 && !spec.GpuShared && !spec.GpuMps && schedulers.ExternalProviderEnabled() {
+		result.Rationale += ", but the gpus are decided by the external scheduler"
+	}
+	ResponseSuccess(c, gin.H{
+		"whatIf": result,
+	})
+}
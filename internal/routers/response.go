@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
 type ResponseData struct {
@@ -20,6 +22,15 @@ func ResponseError(c *gin.Context, code ResCode) {
 	})
 }
 
+// ResponseErrorWithData responds the error with the data that explains it
+func ResponseErrorWithData(c *gin.Context, code ResCode, data interface{}) {
+	c.JSON(http.StatusOK, &ResponseData{
+		Code: code,
+		Msg:  code.Msg(),
+		Data: data,
+	})
+}
+
 func ResponseSuccess(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, &ResponseData{
 		Code: CodeSuccess,
@@ -27,3 +38,26 @@ func ResponseSuccess(c *gin.Context, data interface{}) {
 		Data: data,
 	})
 }
+
+// responseDockerError responds the code of the docker error in the chain of err,
+// so the clients can tell a missing object from a conflict or an unreachable daemon, otherwise the fallback code
+func responseDockerError(c *gin.Context, err error, fallback ResCode) {
+	switch {
+	case xerrors.IsDockerUnavailableError(err):
+		ResponseError(c, CodeDockerUnavailable)
+	case xerrors.IsDockerNotFoundError(err):
+		ResponseError(c, CodeDockerNotFound)
+	case xerrors.IsDockerConflictError(err):
+		ResponseError(c, CodeDockerConflict)
+	case xerrors.IsDockerUnauthorizedError(err):
+		ResponseError(c, CodeDockerUnauthorized)
+	case xerrors.IsWorkQueueFullError(err):
+		ResponseError(c, CodeWorkQueueFull)
+	case xerrors.IsVolumePendingError(err):
+		ResponseError(c, CodeVolumePending)
+	case xerrors.IsCopyRetryingError(err):
+		ResponseError(c, CodeCopyRetrying)
+	default:
+		ResponseError(c, fallback)
+	}
+}
@@ -0,0 +1,56 @@
+package routers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// TestResponseRunError responds the errors of run and clone the same way, only the fallback code differs
+func TestResponseRunError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		err      error
+		fallback ResCode
+		want     ResCode
+		wantData bool
+	}{
+		{name: "gpu not enough", err: errors.Wrap(xerrors.NewGpuNotEnoughError(), "apply"), fallback: CodeContainerCloneFailed,
+			want: CodeContainerGpuNotEnough},
+		{name: "image pull failed", err: xerrors.NewImagePullFailedError(), fallback: CodeContainerCloneFailed,
+			want: CodeContainerImagePullFailed},
+		{name: "port conflict", err: xerrors.NewPortConflictError(), fallback: CodeContainerCloneFailed,
+			want: CodeContainerPortConflict, wantData: true},
+		{name: "port not enough", err: xerrors.NewPortNotEnoughError(), fallback: CodeContainerRunFailed,
+			want: CodeContainerPortNotEnough},
+		{name: "run failed", err: errors.New("boom"), fallback: CodeContainerRunFailed, want: CodeContainerRunFailed},
+		{name: "clone failed", err: errors.New("boom"), fallback: CodeContainerCloneFailed, want: CodeContainerCloneFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			responseRunError(c, nil, tt.err, tt.fallback)
+
+			var resp struct {
+				Code ResCode         `json:"code"`
+				Data json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("json.Unmarshal(%s) error = %v", w.Body.String(), err)
+			}
+			if resp.Code != tt.want {
+				t.Errorf("responseRunError(%v) code = %d, want %d", tt.err, resp.Code, tt.want)
+			}
+			if hasData := string(resp.Data) != "null"; hasData != tt.wantData {
+				t.Errorf("responseRunError(%v) data = %s, want data %v", tt.err, resp.Data, tt.wantData)
+			}
+		})
+	}
+}
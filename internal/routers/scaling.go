@@ -0,0 +1,147 @@
+package routers
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// ScalingHandler serves the scaling groups, a group launches replicaSets from the same spec,
+// and the number of replicaSets tracks the target gpu utilization.
+type ScalingHandler struct{}
+
+var ss services.ScalingService
+
+func (sh *ScalingHandler) RegisterRoute(g *gin.RouterGroup) {
+	g.POST("/scalingGroups", sh.Create)
+	g.GET("/scalingGroups/:name", sh.Info)
+	// change the desired replicas or the auto-scaling target
+	g.PATCH("/scalingGroups/:name", sh.Patch)
+	// delete the scaling group and all of its replicas
+	g.DELETE("/scalingGroups/:name", sh.Delete)
+}
+
+func (sh *ScalingHandler) Create(c *gin.Context) {
+	var spec models.ScalingGroup
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to create scaling group, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Name) == 0 {
+		log.Error("failed to create scaling group, name is empty")
+		ResponseError(c, CodeScalingGroupNameCannotBeEmpty)
+		return
+	}
+
+	if strings.Contains(spec.Name, "-") {
+		log.Error("failed to create scaling group, name cannot contain dash")
+		ResponseError(c, CodeContainerNameCannotContainDash)
+		return
+	}
+
+	// the replicaSet name of each replica is generated by the scaling group
+	spec.Spec.ReplicaSetName = spec.Name
+	if code := checkContainerRun(&spec.Spec); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	status, err := ss.CreateScalingGroup(&spec)
+	if err != nil {
+		log.Errorf("services.CreateScalingGroup failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsScalingGroupExistedError(err) {
+			ResponseError(c, CodeScalingGroupExisted)
+			return
+		}
+		if xerrors.IsScalingGroupInvalidError(err) {
+			ResponseError(c, CodeScalingGroupInvalid)
+			return
+		}
+		ResponseError(c, CodeScalingGroupCreateFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"status": status,
+	})
+}
+
+func (sh *ScalingHandler) Info(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get scaling group info, name is empty")
+		ResponseError(c, CodeScalingGroupNameCannotBeEmpty)
+		return
+	}
+
+	status, err := ss.GetScalingGroup(name)
+	if err != nil {
+		log.Errorf("services.GetScalingGroup failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeScalingGroupGetInfoFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"status": status,
+	})
+}
+
+func (sh *ScalingHandler) Patch(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to patch scaling group, name is empty")
+		ResponseError(c, CodeScalingGroupNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.ScalingPatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to patch scaling group, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	status, err := ss.PatchScalingGroup(name, &spec)
+	if err != nil {
+		log.Errorf("services.PatchScalingGroup failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsScalingGroupInvalidError(err) {
+			ResponseError(c, CodeScalingGroupInvalid)
+			return
+		}
+		ResponseError(c, CodeScalingGroupPatchFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"status": status,
+	})
+}
+
+func (sh *ScalingHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete scaling group, name is empty")
+		ResponseError(c, CodeScalingGroupNameCannotBeEmpty)
+		return
+	}
+
+	if err := ss.DeleteScalingGroup(name); err != nil {
+		log.Errorf("services.DeleteScalingGroup failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeScalingGroupDeleteFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
@@ -0,0 +1,126 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// TemplateHandler serves the templates, a template is a ContainerRun spec with placeholders,
+// it's used to launch the same container repeatedly with only a few fields varying.
+type TemplateHandler struct{}
+
+var ts services.TemplateService
+
+func (th *TemplateHandler) RegisterRoute(g *gin.RouterGroup) {
+	g.POST("/templates", th.Save)
+	g.GET("/templates/:name", th.Info)
+	g.DELETE("/templates/:name", th.Delete)
+	// fill the placeholders with params and run a container via replicaSet
+	g.POST("/templates/:name/launch", th.Launch)
+}
+
+// Save a template, the template with the same name will be overwritten
+func (th *TemplateHandler) Save(c *gin.Context) {
+	var spec models.ContainerTemplate
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to save template, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Name) == 0 {
+		log.Error("failed to save template, name is empty")
+		ResponseError(c, CodeTemplateNameCannotBeEmpty)
+		return
+	}
+
+	if err := ts.SaveTemplate(&spec); err != nil {
+		log.Errorf("services.SaveTemplate failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeTemplateSaveFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+func (th *TemplateHandler) Info(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get template info, name is empty")
+		ResponseError(c, CodeTemplateNameCannotBeEmpty)
+		return
+	}
+
+	info, err := ts.GetTemplate(name)
+	if err != nil {
+		log.Errorf("services.GetTemplate failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeTemplateGetInfoFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"Info": info,
+	})
+}
+
+func (th *TemplateHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete template, name is empty")
+		ResponseError(c, CodeTemplateNameCannotBeEmpty)
+		return
+	}
+
+	if err := ts.DeleteTemplate(name); err != nil {
+		log.Errorf("services.DeleteTemplate failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeTemplateDeleteFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+// Launch fills the placeholders of the template with params, then runs a container.
+// The rendered spec must pass the same validation as running a container directly.
+func (th *TemplateHandler) Launch(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to launch template, name is empty")
+		ResponseError(c, CodeTemplateNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.TemplateLaunch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to launch template, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	run, err := ts.RenderTemplate(name, &spec)
+	if err != nil {
+		log.Errorf("services.RenderTemplate failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsTemplateParamsMissingError(err) {
+			ResponseError(c, CodeTemplateParamsMissing)
+			return
+		}
+		ResponseError(c, CodeTemplateRenderFailed)
+		return
+	}
+
+	if code := checkContainerRun(run); code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	runContainer(c, run)
+}
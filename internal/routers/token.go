@@ -0,0 +1,119 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// maxTokenTTL is the max seconds a token is valid
+const maxTokenTTL = 3600
+
+// TokenHandler issues the tokens, a token is a short-lived single-use credential of one replicaSet and the chosen actions,
+// dashboards hand it to users, so that they can operate the container without the access to the whole api.
+type TokenHandler struct{}
+
+var tks services.TokenService
+
+func (th *TokenHandler) RegisterRoute(g *gin.RouterGroup) {
+	g.POST("/replicaSet/:name/tokens", th.Create)
+	g.DELETE("/tokens/:id", th.Revoke)
+
+	// the endpoints honor the token in the header X-Access-Token or the query parameter token
+	var rh ReplicaSetHandler
+	shared := g.Group("/shared")
+	shared.POST("/replicaSet/:name/execute", TokenAuth(models.TokenActionExecute), rh.Execute)
+	shared.GET("/replicaSet/:name/terminal", TokenAuth(models.TokenActionTerminal), rh.Terminal)
+	shared.GET("/replicaSet/:name/logs", TokenAuth(models.TokenActionLogs), rh.Logs)
+}
+
+// TokenAuth consumes the token for the action on the replicaSet in the path, the request is aborted if it's invalid
+func TokenAuth(action models.TokenAction) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("X-Access-Token")
+		if len(token) == 0 {
+			token = c.Query("token")
+		}
+		if err := tks.UseToken(token, c.Param("name"), action); err != nil {
+			log.Errorf("services.UseToken failed, original error: %T %v", errors.Cause(err), err)
+			if xerrors.IsTokenInvalidError(err) {
+				ResponseError(c, CodeTokenInvalid)
+			} else {
+				ResponseError(c, CodeServeBusy)
+			}
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Create a token of the replicaSet for the actions, the token is returned only once
+func (th *TokenHandler) Create(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to create token, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.AccessTokenCreate
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to create token, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if len(spec.Actions) == 0 || spec.TTL < 0 || spec.TTL > maxTokenTTL {
+		log.Errorf("failed to create token, actions: %v or ttl: %d is invalid", spec.Actions, spec.TTL)
+		ResponseError(c, CodeTokenActionsInvalid)
+		return
+	}
+	for _, action := range spec.Actions {
+		if _, ok := models.TokenActions[action]; !ok {
+			log.Errorf("failed to create token, action: %s is invalid", action)
+			ResponseError(c, CodeTokenActionsInvalid)
+			return
+		}
+	}
+
+	token, record, err := tks.CreateToken(name, &spec)
+	if err != nil {
+		log.Errorf("services.CreateToken failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeTokenCreateFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"token":    token,
+		"id":       record.ID,
+		"expireAt": record.ExpireAt,
+	})
+}
+
+// Revoke a token by its id before it's used
+func (th *TokenHandler) Revoke(c *gin.Context) {
+	id := c.Param("id")
+	if len(id) == 0 {
+		log.Error("failed to revoke token, id is empty")
+		ResponseError(c, CodeTokenIDCannotBeEmpty)
+		return
+	}
+
+	if err := tks.RevokeToken(id); err != nil {
+		log.Errorf("services.RevokeToken failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsTokenInvalidError(err) {
+			ResponseError(c, CodeTokenInvalid)
+			return
+		}
+		ResponseError(c, CodeTokenRevokeFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
@@ -1,6 +1,11 @@
 package routers
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -10,21 +15,37 @@ import (
 	"github.com/mayooot/gpu-docker-api/internal/models"
 	"github.com/mayooot/gpu-docker-api/internal/services"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
 )
 
 type VolumeHandler struct{}
 
 var vs services.VolumeService
 
+// keyIDRegexp the key id is a file name in the secret dir, so it can't contain a path
+var keyIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 func (vh *VolumeHandler) RegisterRoute(g *gin.RouterGroup) {
 	g.POST("/volumes", vh.Create)
 	g.PATCH("/volumes/:name/size", vh.Patch)
+	g.PATCH("/volumes/:name/driver", vh.Migrate)
+	g.PATCH("/volumes/:name/options", vh.PatchOptions)
 	g.DELETE("/volumes/:name", vh.Delete)
 	g.GET("/volumes/:name", vh.Info)
+	g.GET("/volumes/:name/size", vh.Size)
 	g.GET("/volumes/:name/history", vh.History)
+	g.GET("/volumes/:name/copy", vh.CopyProgress)
+	g.GET("/volumes/:name/versions/:version/containers", vh.Containers)
+	g.PUT("/volumes/:name/retention", vh.SetRetention)
+	g.GET("/volumes/:name/retention", vh.GetRetention)
+	g.POST("/volumes/:name/prune", vh.Prune)
+	// export the latest version as a tar archive, or create a volume from a tar archive
+	g.GET("/volumes/:name/export", vh.Export)
+	g.POST("/volumes/import", vh.Import)
 }
 
 // Create a volume, you can specify the size and name
+// or the key id of the encryption, then the volume is created on an encrypted filesystem.
 func (vh *VolumeHandler) Create(c *gin.Context) {
 	var spec models.VolumeCreate
 	err := c.ShouldBindJSON(&spec)
@@ -46,6 +67,20 @@ func (vh *VolumeHandler) Create(c *gin.Context) {
 		return
 	}
 
+	if len(spec.Size) != 0 {
+		if spec.Size, err = utils.NormalizeSize(spec.Size); err != nil {
+			log.Errorf("failed to create volume, %v", err)
+			ResponseError(c, CodeVolumeSizeNotSupported)
+			return
+		}
+	}
+
+	if spec.Encryption != nil && (len(spec.Size) != 0 || !keyIDRegexp.MatchString(spec.Encryption.KeyID)) {
+		log.Errorf("failed to create volume, encryption: %+v is invalid, size: %s", *spec.Encryption, spec.Size)
+		ResponseError(c, CodeVolumeEncryptionInvalid)
+		return
+	}
+
 	resp, err := vs.CreateVolume(&spec)
 	if err != nil {
 		log.Errorf("services.CreateVolume failed, original error: %T %v", errors.Cause(err), err)
@@ -54,7 +89,11 @@ func (vh *VolumeHandler) Create(c *gin.Context) {
 			ResponseError(c, CodeVolumeExisted)
 			return
 		}
-		ResponseError(c, CodeVolumeCreateFailed)
+		if xerrors.IsEncryptionKeyUnavailableError(err) {
+			ResponseError(c, CodeVolumeEncryptionKeyUnavailable)
+			return
+		}
+		responseDockerError(c, err, CodeVolumeCreateFailed)
 		return
 	}
 
@@ -67,6 +106,7 @@ func (vh *VolumeHandler) Create(c *gin.Context) {
 // Patch the size of the latest version of an existing volume via create a new volume and copy the old volume data to the new volume.
 // Including expand and shrink of two operations, if the size is the same before and after the operation, it will be skipped.
 // If the size already used is larger than the size after shrink, then shrink operation will fail.
+// The new volume is pending while the data is copied, if the copy fails, it's removed and the old version is kept.
 func (vh *VolumeHandler) Patch(c *gin.Context) {
 	name := c.Param("name")
 	if len(name) == 0 {
@@ -81,13 +121,13 @@ func (vh *VolumeHandler) Patch(c *gin.Context) {
 		ResponseError(c, CodeInvalidParams)
 		return
 	}
-	spec.Size = strings.ToUpper(spec.Size)
-	unit := spec.Size[len(spec.Size)-2:]
-	if _, ok := models.VolumeSizeMap[unit]; !ok {
-		log.Errorf("failed to Patch volume size, size: %s is not supported", spec.Size)
+	size, err := utils.NormalizeSize(spec.Size)
+	if err != nil {
+		log.Errorf("failed to Patch volume size, %v", err)
 		ResponseError(c, CodeVolumeSizeNotSupported)
 		return
 	}
+	spec.Size = size
 
 	resp, err := vs.PatchVolumeSize(name, &spec)
 	if err != nil {
@@ -98,10 +138,18 @@ func (vh *VolumeHandler) Patch(c *gin.Context) {
 			return
 		}
 		if xerrors.IsVolumeSizeUsedGreaterThanReduced(err) {
-			ResponseError(c, CodeVolumePatchFailed)
+			ResponseError(c, CodeVolumeSizeUsedGreaterThanReduce)
+			return
+		}
+		if xerrors.IsVolumeInUseError(err) {
+			ResponseError(c, CodeVolumeInUse)
+			return
+		}
+		if xerrors.IsVolumePendingError(err) {
+			ResponseError(c, CodeVolumePending)
 			return
 		}
-		ResponseError(c, CodeVolumePatchFailed)
+		responseDockerError(c, err, CodeVolumePatchFailed)
 		return
 	}
 
@@ -111,6 +159,125 @@ func (vh *VolumeHandler) Patch(c *gin.Context) {
 	})
 }
 
+// PatchOptions merges the driver option changes into the latest version of an existing volume,
+// via create a new volume with the merged options and copy the old volume data to the new volume.
+// An empty value removes the option. If only the size of a plain local volume changes, it's the same as Patch,
+// otherwise containers using the volume must be stopped first.
+func (vh *VolumeHandler) PatchOptions(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to patch volume options, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.VolumeOptionsPatch
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to patch volume options, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if len(spec.DriverOpts) == 0 {
+		log.Error("failed to patch volume options, driver options are empty")
+		ResponseError(c, CodeVolumeOptionsInvalid)
+		return
+	}
+	if size, ok := spec.DriverOpts["size"]; ok && len(size) != 0 {
+		size, err := utils.NormalizeSize(size)
+		if err != nil {
+			log.Errorf("failed to patch volume options, %v", err)
+			ResponseError(c, CodeVolumeSizeNotSupported)
+			return
+		}
+		spec.DriverOpts["size"] = size
+	}
+
+	resp, err := vs.PatchVolumeOptions(name, &spec)
+	if err != nil {
+		log.Errorf("services.PatchVolumeOptions failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsNoPatchRequiredError(err) {
+			ResponseError(c, CodeVolumeOptionsNoNeedPatch)
+			return
+		}
+		if xerrors.IsVolumeOptionsInvalidError(err) {
+			ResponseError(c, CodeVolumeOptionsInvalid)
+			return
+		}
+		if xerrors.IsVolumeSizeUsedGreaterThanReduced(err) {
+			ResponseError(c, CodeVolumeSizeUsedGreaterThanReduce)
+			return
+		}
+		if xerrors.IsVolumeInUseError(err) {
+			ResponseError(c, CodeVolumeInUse)
+			return
+		}
+		if xerrors.IsVolumePendingError(err) {
+			ResponseError(c, CodeVolumePending)
+			return
+		}
+		responseDockerError(c, err, CodeVolumePatchFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"name":       resp.Name,
+		"driverOpts": resp.Options,
+	})
+}
+
+// Migrate the latest version of an existing volume to another storage driver,
+// via create a new volume on the target driver and copy the old volume data to the new volume.
+// Containers using the volume must be stopped first.
+func (vh *VolumeHandler) Migrate(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to migrate volume, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.VolumeMigrate
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to migrate volume, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Driver) == 0 {
+		log.Error("failed to migrate volume, driver is empty")
+		ResponseError(c, CodeVolumeDriverCannotBeEmpty)
+		return
+	}
+
+	resp, err := vs.MigrateVolume(name, &spec)
+	if err != nil {
+		log.Errorf("services.MigrateVolume failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsNoPatchRequiredError(err) {
+			ResponseError(c, CodeVolumeNoNeedMigrate)
+			return
+		}
+		if xerrors.IsVolumeInUseError(err) {
+			ResponseError(c, CodeVolumeInUse)
+			return
+		}
+		if xerrors.IsVolumePendingError(err) {
+			ResponseError(c, CodeVolumePending)
+			return
+		}
+		responseDockerError(c, err, CodeVolumeMigrateFailed)
+		return
+	}
+
+	// the data is copied in the background, the new version is pending until it's copied
+	ResponseSuccess(c, gin.H{
+		"name":    resp.Name,
+		"driver":  resp.Driver,
+		"pending": true,
+	})
+}
+
 // Delete a volume
 func (vh *VolumeHandler) Delete(c *gin.Context) {
 	name := c.Param("name")
@@ -120,10 +287,26 @@ func (vh *VolumeHandler) Delete(c *gin.Context) {
 		return
 	}
 
+	// delete every version of the volume, e.g. ?allVersions=true&force=true
+	if all, _ := strconv.ParseBool(c.Query("allVersions")); all {
+		force, _ := strconv.ParseBool(c.Query("force"))
+		report, err := vs.DeleteAllVersions(name, force)
+		if err != nil {
+			log.Errorf("services.DeleteAllVersions failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			responseDockerError(c, err, CodeVolumeDeleteFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"report": report,
+		})
+		return
+	}
+
 	if err := vs.DeleteVolume(name, true, true); err != nil {
 		log.Errorf("services.DeleteVolume failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeVolumeDeleteFailed)
+		responseDockerError(c, err, CodeVolumeDeleteFailed)
 		return
 	}
 
@@ -142,12 +325,44 @@ func (vh *VolumeHandler) Info(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.GetVolumeInfo failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeVolumeGetInfoFailed)
+		responseDockerError(c, err, CodeVolumeGetInfoFailed)
+		return
+	}
+	// the info is of the version promoted in etcd, the latest version may still be pending
+	status, latest, err := vs.GetVolumeStatus(name)
+	if err != nil {
+		log.Errorf("services.GetVolumeStatus failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeVolumeGetInfoFailed)
 		return
 	}
 
 	ResponseSuccess(c, gin.H{
-		"Info": info,
+		"Info":   info,
+		"status": status,
+		"latest": latest,
+	})
+}
+
+// Size gets the space used by the latest version of a volume and its size
+func (vh *VolumeHandler) Size(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get volume size, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	space, err := vs.GetVolumeUsage(name)
+	if err != nil {
+		log.Errorf("services.GetVolumeUsage failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeVolumeSpaceGetFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"space": space,
 	})
 }
 
@@ -163,7 +378,7 @@ func (vh *VolumeHandler) History(c *gin.Context) {
 	if err != nil {
 		log.Errorf("services.GetVolumeHistory failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeVolumeGetHistoryFailed)
+		responseDockerError(c, err, CodeVolumeGetHistoryFailed)
 		return
 	}
 
@@ -171,3 +386,224 @@ func (vh *VolumeHandler) History(c *gin.Context) {
 		"history": history,
 	})
 }
+
+// CopyProgress gets the bytes copied from the old version to the version of the volume, e.g. foo-2
+func (vh *VolumeHandler) CopyProgress(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get copy progress, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	record, err := vs.GetCopyProgress(name)
+	if err != nil {
+		log.Errorf("services.GetCopyProgress failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsCopyNotFoundError(err) {
+			ResponseError(c, CodeCopyNotFound)
+			return
+		}
+		responseDockerError(c, err, CodeCopyGetProgressFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"copy": record,
+	})
+}
+
+// SetRetention sets the retention policy of all versions of a volume,
+// the versions exceeding it will be pruned periodically.
+func (vh *VolumeHandler) SetRetention(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to set volume retention, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.VolumeRetention
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to set volume retention, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if spec.KeepLast < 0 || spec.KeepDays < 0 {
+		log.Errorf("failed to set volume retention, retention: %+v is invalid", spec)
+		ResponseError(c, CodeVolumeRetentionInvalid)
+		return
+	}
+
+	if err := vs.SetVolumeRetention(name, &spec); err != nil {
+		log.Errorf("services.SetVolumeRetention failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeVolumeRetentionSetFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+func (vh *VolumeHandler) GetRetention(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get volume retention, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	retention, err := vs.GetVolumeRetention(name)
+	if err != nil {
+		log.Errorf("services.GetVolumeRetention failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeVolumeRetentionGetFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"retention": retention,
+	})
+}
+
+// Prune the old versions of a volume according to the retention policy,
+// use query parameter dryRun=true to preview which versions will be removed.
+func (vh *VolumeHandler) Prune(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to prune volume, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	report, err := vs.PruneVolumeVersions(name, c.Query("dryRun") == "true")
+	if err != nil {
+		log.Errorf("services.PruneVolumeVersions failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeVolumePruneFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"report": report,
+	})
+}
+
+// Containers returns the container versions that mounted the version of the volume, e.g. to find the runs of a dataset
+func (vh *VolumeHandler) Containers(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to find containers by volume version, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil || version <= 0 {
+		log.Errorf("failed to find containers by volume version, version: %s is invalid", c.Param("version"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	usages, err := vs.FindContainersByVolumeVersion(name, version)
+	if err != nil {
+		log.Errorf("services.FindContainersByVolumeVersion failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeVolumeUsageGetFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"containers": usages,
+	})
+}
+
+// Export streams the data of the latest version of the volume as a tar archive
+func (vh *VolumeHandler) Export(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to export volume, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	archive, err := vs.ExportVolume(name)
+	if err != nil {
+		log.Errorf("services.ExportVolume failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsVolumePendingError(err) {
+			ResponseError(c, CodeVolumePending)
+			return
+		}
+		if xerrors.IsVolumeDataNotOnHostError(err) {
+			ResponseError(c, CodeVolumeDataNotOnHost)
+			return
+		}
+		responseDockerError(c, err, CodeVolumeExportFailed)
+		return
+	}
+	defer archive.Close()
+
+	c.Header("Content-Type", "application/x-tar")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar"))
+	c.Status(http.StatusOK)
+	if _, err = io.Copy(c.Writer, archive); err != nil {
+		log.Errorf("failed to export volume: %s, the archive is incomplete, error: %v", name, err)
+	}
+}
+
+// Import creates a volume from the tar archive in the body, the name and the size are in the query,
+// e.g. /volumes/import?name=foo&size=20GB
+func (vh *VolumeHandler) Import(c *gin.Context) {
+	spec := models.VolumeCreate{
+		Name: c.Query("name"),
+		Size: c.Query("size"),
+	}
+	if len(spec.Name) == 0 {
+		log.Error("failed to import volume, name is empty")
+		ResponseError(c, CodeVolumeNameCannotBeEmpty)
+		return
+	}
+
+	if strings.Contains(spec.Name, "-") {
+		log.Errorf("failed to import volume, volume name: %s must not contain '-'", spec.Name)
+		ResponseError(c, CodeVolumeNameNotContainsDash)
+		return
+	}
+
+	if strings.HasPrefix(spec.Name, "/") {
+		log.Errorf("failed to import volume, volume name: %s must not begin with '/'", spec.Name)
+		ResponseError(c, CodeVolumeNameNotBeginWithForwardSlash)
+		return
+	}
+
+	if len(spec.Size) != 0 {
+		var err error
+		if spec.Size, err = utils.NormalizeSize(spec.Size); err != nil {
+			log.Errorf("failed to import volume, %v", err)
+			ResponseError(c, CodeVolumeSizeNotSupported)
+			return
+		}
+	}
+
+	resp, err := vs.ImportVolume(&spec, c.Request.Body)
+	if err != nil {
+		log.Errorf("services.ImportVolume failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsVolumeExistedError(err) {
+			ResponseError(c, CodeVolumeExisted)
+			return
+		}
+		if xerrors.IsVolumeDataNotOnHostError(err) {
+			ResponseError(c, CodeVolumeDataNotOnHost)
+			return
+		}
+		responseDockerError(c, err, CodeVolumeImportFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"name": resp.Name,
+		"size": resp.Options["size"],
+	})
+}
@@ -0,0 +1,117 @@
+package routers
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+// WebhookHandler serves the webhooks notified of the lifecycle events of containers, volumes and gpus,
+// each event is posted as json with retries, and only to the webhooks subscribed to its type.
+type WebhookHandler struct{}
+
+var whs services.WebhookService
+
+func (wh *WebhookHandler) RegisterRoute(g *gin.RouterGroup) {
+	g.POST("/webhooks", wh.Save)
+	g.GET("/webhooks", wh.List)
+	g.DELETE("/webhooks/:name", wh.Delete)
+	// stream the events as server-sent events, e.g. ?types=container.created,container.deleted
+	g.GET("/events", wh.Events)
+}
+
+// Save a webhook, the webhook with the same name will be overwritten
+func (wh *WebhookHandler) Save(c *gin.Context) {
+	var spec models.Webhook
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Error("failed to save webhook, error:", err.Error())
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if len(spec.Name) == 0 || strings.Contains(spec.Name, "/") {
+		log.Errorf("failed to save webhook, name: %s is invalid", spec.Name)
+		ResponseError(c, CodeWebhookInvalid)
+		return
+	}
+	if u, err := url.Parse(spec.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		log.Errorf("failed to save webhook, url: %s is not a http url", spec.URL)
+		ResponseError(c, CodeWebhookInvalid)
+		return
+	}
+	for _, t := range spec.Events {
+		if _, ok := models.EventTypes[t]; !ok {
+			log.Errorf("failed to save webhook, event type: %s is not supported", t)
+			ResponseError(c, CodeWebhookInvalid)
+			return
+		}
+	}
+
+	if err := whs.SaveWebhook(&spec); err != nil {
+		log.Errorf("services.SaveWebhook failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		responseDockerError(c, err, CodeWebhookSaveFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+func (wh *WebhookHandler) List(c *gin.Context) {
+	ResponseSuccess(c, gin.H{
+		"webhooks": whs.ListWebhooks(),
+	})
+}
+
+func (wh *WebhookHandler) Delete(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete webhook, name is empty")
+		ResponseError(c, CodeWebhookInvalid)
+		return
+	}
+
+	if err := whs.DeleteWebhook(name); err != nil {
+		log.Errorf("services.DeleteWebhook failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeWebhookDeleteFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+// Events streams the lifecycle events as server-sent events until the client closes the request,
+// only the events emitted after the request are sent.
+func (wh *WebhookHandler) Events(c *gin.Context) {
+	var types []models.EventType
+	if query := c.Query("types"); len(query) != 0 {
+		for _, t := range strings.Split(query, ",") {
+			if _, ok := models.EventTypes[t]; !ok {
+				log.Errorf("failed to stream events, event type: %s is not supported", t)
+				ResponseError(c, CodeWebhookInvalid)
+				return
+			}
+			types = append(types, t)
+		}
+	}
+
+	events, cancel := whs.Subscribe(types)
+	defer cancel()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-events:
+			c.SSEvent(event.Type, event)
+			return true
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package schedulers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+)
+
+const gpuHealthCommand = "nvidia-smi --query-gpu=uuid,ecc.errors.uncorrected.volatile.total,retired_pages.pending --format=csv,noheader,nounits"
+
+// gpuLost is the reason of the gpu that is missing from nvidia-smi or reported as lost
+const gpuLost = "not reported by nvidia-smi, it may have fallen off the bus"
+
+// checkGpuHealth queries the health of all gpus and records the unhealthy ones, they are not allocated.
+// The last result is kept if nvidia-smi fails, so that a flaky query doesn't mark every gpu unhealthy.
+func (gs *gpuScheduler) checkGpuHealth() {
+	if gs.AvailableGpuNums == 0 {
+		return
+	}
+	health, err := queryGpuHealth()
+	if err != nil {
+		log.Warnf("schedulers.GpuScheduler, query gpu health failed, the last health is used, error: %v", err)
+		return
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	unhealthy := make(map[string]string)
+	for uuid := range gs.GpuStatusMap {
+		reason, ok := health[uuid]
+		if !ok {
+			reason = gpuLost
+		}
+		if len(reason) == 0 {
+			if _, ok = gs.unhealthy[uuid]; ok {
+				log.Infof("schedulers.GpuScheduler, gpu: %s is healthy again", uuid)
+			}
+			continue
+		}
+		if _, ok = gs.unhealthy[uuid]; !ok {
+			log.Errorf("schedulers.GpuScheduler, gpu: %s is unhealthy and excluded from allocation, reason: %s", uuid, reason)
+		}
+		unhealthy[uuid] = reason
+	}
+	gs.unhealthy = unhealthy
+}
+
+// queryGpuHealth returns the reason why each gpu is unhealthy, it's empty for a healthy gpu, the key is uuid
+func queryGpuHealth() (map[string]string, error) {
+	c := newCommand(gpuHealthCommand)
+	if err := c.Execute(); err != nil {
+		return nil, errors.Wrap(err, "cmd.Execute failed")
+	}
+	// nvidia-smi exits with an error if a gpu is lost, the rows of the other gpus are still printed
+	if c.ExitCode() != 0 && len(strings.TrimSpace(c.Stdout())) == 0 {
+		return nil, errors.Errorf("command: %s exit with code %d, output: %s", gpuHealthCommand, c.ExitCode(), c.Combined())
+	}
+
+	health := make(map[string]string)
+	for _, line := range strings.Split(c.Stdout(), "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) != 3 {
+			continue
+		}
+		uuid, ecc, pending := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]), strings.TrimSpace(fields[2])
+		var reasons []string
+		if strings.Contains(line, "GPU is lost") || strings.Contains(line, "Unknown Error") {
+			reasons = append(reasons, gpuLost)
+		}
+		// [N/A] and [Not Supported] mean the gpu has no ecc or page retirement
+		if n, err := strconv.Atoi(ecc); err == nil && n > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d uncorrectable ecc errors since the driver loaded", n))
+		}
+		if strings.EqualFold(pending, "Yes") {
+			reasons = append(reasons, "retired pages are pending, the gpu needs a reset")
+		}
+		health[uuid] = strings.Join(reasons, ", ")
+	}
+	return health, nil
+}
+
+// GetGpuHealth returns the reason why each unhealthy gpu is excluded from allocation, the key is uuid
+func (gs *gpuScheduler) GetGpuHealth() map[string]string {
+	gs.checkGpuHealth()
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	unhealthy := make(map[string]string, len(gs.unhealthy))
+	for uuid, reason := range gs.unhealthy {
+		unhealthy[uuid] = reason
+	}
+	return unhealthy
+}
+
+// unhealthyReasons joins the reasons of the unhealthy gpus for the error returned to the caller
+func (gs *gpuScheduler) unhealthyReasons(uuids []string) string {
+	reasons := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		reasons = append(reasons, fmt.Sprintf("gpu: %s %s", uuid, gs.unhealthy[uuid]))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
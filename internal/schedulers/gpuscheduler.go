@@ -2,23 +2,33 @@ package schedulers
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/commander-cli/cmd"
+	"github.com/ngaut/log"
 	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
 const (
-	allGpuUUIDCommand = "nvidia-smi --query-gpu=index,uuid --format=csv,noheader,nounits"
+	allGpuUUIDCommand     = "nvidia-smi --query-gpu=index,uuid --format=csv,noheader,nounits"
+	gpuUtilizationCommand = "nvidia-smi --query-gpu=uuid,utilization.gpu --format=csv,noheader,nounits"
+	gpuDeviceCommand      = "nvidia-smi --query-gpu=index,uuid,memory.total,memory.used,utilization.gpu --format=csv,noheader,nounits"
 
 	gpuStatusMapKey = "gpuStatusMapKey"
 )
 
+// newCommand creates the nvidia-smi commands, it's replaced by the tests
+var newCommand = cmd.NewCommand
+
 var GpuScheduler *gpuScheduler
 
 type gpu struct {
@@ -31,20 +41,113 @@ type gpuScheduler struct {
 
 	AvailableGpuNums int             `json:"availableGpuNums"`
 	GpuStatusMap     map[string]byte `json:"gpuStatusMap"`
+	// GpuOwnerMap records which replicaSet holds the gpu, the key is uuid and the value is replicaSet name.
+	// Reservations are held at the replicaSet level rather than the container version,
+	// so that the old and new versions don't count the same gpu twice during patch.
+	GpuOwnerMap map[string]string `json:"gpuOwnerMap"`
+	// JobMap records the external job id of the replicaSet, the key is replicaSet name and the value is job id.
+	JobMap map[string]string `json:"jobMap"`
+	// SlotsPerGpu is the number of slots the capacity of a gpu is divided into, e.g. 2 means half-card step.
+	// A whole-card request consumes all slots of a free gpu, a fractional request consumes some slots of a gpu.
+	SlotsPerGpu int `json:"slotsPerGpu"`
+	// GpuSlotMap records the slots used by fractional requests, the key is uuid,
+	// the value is the slots held by each replicaSet. The gpu is marked as used while any slot is held.
+	GpuSlotMap map[string]map[string]int `json:"gpuSlotMap"`
+	// GpuShareMap records the gpus assigned to several replicaSets in shared mode, the key is uuid.
+	// The gpu is marked as used while it's shared, so it's neither allocated exclusively nor fractionally.
+	GpuShareMap map[string]*SharedGpu `json:"gpuShareMap"`
+	// LabelMap records the anti-co-location labels of the replicaSet, the key is replicaSet name.
+	LabelMap map[string][]string `json:"labelMap"`
+	// conflicts are the labels that can't share a gpu with each other, they are set by flag at startup.
+	conflicts map[string]map[string]struct{}
+	// unhealthy records why the gpu is excluded from allocation, the key is uuid, it's queried before allocation.
+	unhealthy map[string]string
+	// MigOwnerMap records which replicaSet holds the mig instance, the key is the uuid of the instance.
+	MigOwnerMap map[string]string `json:"migOwnerMap"`
+	// migDevices are the mig instances on the host, they are queried before allocation.
+	migDevices []models.MigDevice
+}
+
+// SharedGpu is time-sliced by the replicaSets in Owners, MaxSharers is the smallest cap of the current sharers,
+// 0 means no limit. Caps records the cap of each sharer which set one, so that MaxSharers is relaxed when it leaves.
+// Mps means the gpu is shared through the MPS daemon by the MPS clients instead.
+type SharedGpu struct {
+	MaxSharers int                 `json:"maxSharers"`
+	Owners     map[string]struct{} `json:"owners"`
+	Caps       map[string]int      `json:"caps,omitempty"`
+	Mps        bool                `json:"mps,omitempty"`
+}
+
+// join adds the sharer with its cap, 0 means no limit
+func (s *SharedGpu) join(owner string, maxSharers int) {
+	s.Owners[owner] = struct{}{}
+	if maxSharers != 0 {
+		if s.Caps == nil {
+			s.Caps = make(map[string]int)
+		}
+		s.Caps[owner] = maxSharers
+	}
+	s.recap()
+}
+
+// leave removes the sharer and its cap
+func (s *SharedGpu) leave(owner string) {
+	delete(s.Owners, owner)
+	delete(s.Caps, owner)
+	s.recap()
+}
+
+// recap sets MaxSharers to the smallest cap of the current sharers
+func (s *SharedGpu) recap() {
+	s.MaxSharers = 0
+	for _, n := range s.Caps {
+		if s.MaxSharers == 0 || n < s.MaxSharers {
+			s.MaxSharers = n
+		}
+	}
 }
 
-func InitGPuScheduler() error {
+// GpuMode is how the gpus of a replicaSet are held
+type GpuMode int
+
+const (
+	// GpuModeWhole holds whole gpus or mig instances exclusively
+	GpuModeWhole GpuMode = iota
+	// GpuModeFraction holds some slots of a gpu
+	GpuModeFraction
+	// GpuModeShared time-slices gpus with other replicaSets
+	GpuModeShared
+)
+
+type GpuReservation struct {
+	Owner string `json:"owner"`
+	JobID string `json:"jobId,omitempty"`
+}
+
+func InitGPuScheduler(slotsPerGpu int) error {
 	var err error
 	GpuScheduler, err = initGpuFormEtcd()
 	if err != nil {
 		return errors.Wrap(err, "initFormEtcd failed")
 	}
 
+	if slotsPerGpu < 1 {
+		return errors.Errorf("slots per gpu must be greater than 0, slotsPerGpu: %d", slotsPerGpu)
+	}
+	// the slots held would be meant in the old size, e.g. 2 of 4 slots are a half gpu but 2 of 2 are a whole one
+	if len(GpuScheduler.GpuSlotMap) != 0 && GpuScheduler.SlotsPerGpu != slotsPerGpu {
+		return errors.Errorf("slots per gpu can't be changed from %d to %d while fractional gpus are held: %v",
+			GpuScheduler.SlotsPerGpu, slotsPerGpu, GpuScheduler.GpuSlotMap)
+	}
+	GpuScheduler.SlotsPerGpu = slotsPerGpu
+
 	if GpuScheduler.AvailableGpuNums == 0 || len(GpuScheduler.GpuStatusMap) == 0 {
 		// if it has not been initialized
 		gpus, err := getAllGpuUUID()
 		if err != nil {
-			return errors.Wrap(err, "getAllGpuUUID failed")
+			// e.g. the nvidia driver is not installed, the card-less containers can still run
+			log.Warnf("schedulers.InitGPuScheduler, getAllGpuUUID failed, no gpu is available, error: %v", err)
+			return nil
 		}
 
 		GpuScheduler.AvailableGpuNums = len(gpus)
@@ -71,43 +174,214 @@ func initGpuFormEtcd() (s *gpuScheduler, err error) {
 
 	s = &gpuScheduler{
 		GpuStatusMap: make(map[string]byte),
+		GpuOwnerMap:  make(map[string]string),
+		JobMap:       make(map[string]string),
 	}
 	if len(bytes) != 0 {
 		err = json.Unmarshal(bytes, &s)
 	}
+	if s.JobMap == nil {
+		s.JobMap = make(map[string]string)
+	}
+	if s.GpuSlotMap == nil {
+		s.GpuSlotMap = make(map[string]map[string]int)
+	}
+	if s.GpuShareMap == nil {
+		s.GpuShareMap = make(map[string]*SharedGpu)
+	}
+	if s.LabelMap == nil {
+		s.LabelMap = make(map[string][]string)
+	}
+	if s.MigOwnerMap == nil {
+		s.MigOwnerMap = make(map[string]string)
+	}
 	return s, err
 }
 
-// Apply for a specified number of gpus
-func (gs *gpuScheduler) Apply(num int) ([]string, error) {
-	if num <= 0 || num > gs.AvailableGpuNums {
-		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(gs.AvailableGpuNums))
+// Apply for a specified number of gpus for the replicaSet
+func (gs *gpuScheduler) Apply(owner string, num int) ([]string, error) {
+	return gs.ApplyUUIDs(owner, nil, num)
+}
+
+// ApplyUUIDs applies for the requested gpus by uuid and the rest of num from the free gpus,
+// the uuids are stable across reboots while the indexes are not.
+// It fails if any requested gpu is absent, unhealthy or held by others, nothing is applied then.
+func (gs *gpuScheduler) ApplyUUIDs(owner string, uuids []string, num int) ([]string, error) {
+	return gs.applyUUIDs(owner, uuids, num, nil)
+}
+
+// ApplyConstrained applies like ApplyUUIDs, but only the gpus satisfying the constraints are allocated
+func (gs *gpuScheduler) ApplyConstrained(owner string, uuids []string, num int, constraints *models.GpuConstraints) ([]string, error) {
+	allowed, err := allowedGpus(constraints)
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.AllowedGpus failed")
+	}
+	return gs.applyUUIDs(owner, uuids, num, allowed)
+}
+
+// PlanConstrained returns the gpus ApplyConstrained would allocate, nothing is allocated
+func (gs *gpuScheduler) PlanConstrained(uuids []string, num int, constraints *models.GpuConstraints) ([]string, error) {
+	allowed, err := allowedGpus(constraints)
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.AllowedGpus failed")
+	}
+	return gs.planUUIDs(uuids, num, allowed)
+}
+
+// planUUIDs returns the gpus applyUUIDs would allocate from the allowed gpus, nothing is allocated
+func (gs *gpuScheduler) planUUIDs(uuids []string, num int, allowed map[string]struct{}) ([]string, error) {
+	if err := gs.checkApply(uuids, num); err != nil {
+		return nil, err
+	}
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	return gs.pickGpus(uuids, num, allowed)
+}
+
+// applyUUIDs applies from the allowed gpus, nil allowed means all gpus are allowed
+func (gs *gpuScheduler) applyUUIDs(owner string, uuids []string, num int, allowed map[string]struct{}) ([]string, error) {
+	if err := gs.checkApply(uuids, num); err != nil {
+		return nil, err
 	}
 
 	gs.Lock()
 	defer gs.Unlock()
 
-	var availableGpus []string
-	for k, v := range gs.GpuStatusMap {
-		if v == 0 {
-			gs.GpuStatusMap[k] = 1
+	availableGpus, err := gs.pickGpus(uuids, num, allowed)
+	if err != nil {
+		if xerrors.IsGpuNotEnoughError(err) {
+			notify.Emit(models.EventGpuExhausted, owner, map[string]interface{}{
+				"requested": num,
+				"free":      len(availableGpus),
+			})
+		}
+		return nil, err
+	}
+
+	for _, k := range availableGpus {
+		gs.GpuStatusMap[k] = 1
+		gs.GpuOwnerMap[k] = owner
+	}
+
+	return availableGpus, nil
+}
+
+// checkApply checks the request against the host and refreshes the mig and health state before picking.
+// No gpu detected by nvidia-smi doesn't mean the nvidia runtime is missing, the missing runtime is told by
+// docker info at startup and the error of the container create.
+func (gs *gpuScheduler) checkApply(uuids []string, num int) error {
+	if num <= 0 {
+		return errors.Errorf("num: %d must be greater than 0", num)
+	}
+	if num > gs.AvailableGpuNums {
+		return errors.Wrapf(xerrors.NewGpuCountExceededError(), "requested: %d, gpus on the host: %d", num, gs.AvailableGpuNums)
+	}
+	if len(uuids) > num {
+		return errors.Errorf("requested uuids: %v are more than num: %d", uuids, num)
+	}
+	gs.checkMigDevices()
+	gs.checkGpuHealth()
+	return nil
+}
+
+// pickGpus picks the requested gpus and the rest of num from the free allowed gpus without marking them,
+// the caller must hold the lock. The gpus picked so far are returned with the GpuNotEnough error.
+func (gs *gpuScheduler) pickGpus(uuids []string, num int, allowed map[string]struct{}) ([]string, error) {
+	requested := make(map[string]struct{}, len(uuids))
+	for _, uuid := range uuids {
+		if _, ok := requested[uuid]; ok {
+			return nil, errors.Errorf("gpu: %s is requested twice", uuid)
+		}
+		status, ok := gs.GpuStatusMap[uuid]
+		if !ok {
+			return nil, errors.Wrapf(xerrors.NewGpuNotFoundError(), "gpu: %s", uuid)
+		}
+		if _, ok = gs.unhealthy[uuid]; ok {
+			return nil, errors.Wrap(xerrors.NewGpuUnhealthyError(), gs.unhealthyReasons([]string{uuid}))
+		}
+		if _, ok = allowed[uuid]; allowed != nil && !ok {
+			return nil, errors.Wrapf(xerrors.NewGpuConstraintUnsatisfiableError(), "gpu: %s is excluded by the constraints", uuid)
+		}
+		if status != 0 {
+			return nil, errors.Wrapf(xerrors.NewGpuBusyError(), "gpu: %s is %s", uuid, gs.heldReason(uuid))
+		}
+		requested[uuid] = struct{}{}
+	}
+
+	availableGpus := append([]string(nil), uuids...)
+	var unhealthyGpus []string
+	var excludedGpus int
+	// the gpus are picked in order, so that the plan is the same as the apply
+	for _, k := range gs.sortedGpus() {
+		if gs.GpuStatusMap[k] != 0 {
+			continue
+		}
+		if _, ok := requested[k]; ok {
+			continue
+		}
+		if _, ok := gs.unhealthy[k]; ok {
+			unhealthyGpus = append(unhealthyGpus, k)
+			continue
+		}
+		if _, ok := allowed[k]; allowed != nil && !ok {
+			excludedGpus++
+			continue
+		}
+		if len(availableGpus) < num {
 			availableGpus = append(availableGpus, k)
-			if len(availableGpus) == num {
-				break
-			}
 		}
 	}
 
 	if len(availableGpus) < num {
-		return nil, xerrors.NewGpuNotEnoughError()
+		if len(availableGpus)+len(unhealthyGpus) >= num {
+			return nil, errors.Wrapf(xerrors.NewGpuUnhealthyError(), "requested: %d, healthy free gpus: %d, %s",
+				num, len(availableGpus), gs.unhealthyReasons(unhealthyGpus))
+		}
+		if len(availableGpus)+excludedGpus >= num {
+			return nil, errors.Wrapf(xerrors.NewGpuConstraintUnsatisfiableError(), "requested: %d, free gpus satisfying the constraints: %d, excluded: %d",
+				num, len(availableGpus), excludedGpus)
+		}
+		return availableGpus, xerrors.NewGpuNotEnoughError()
 	}
-
 	return availableGpus, nil
 }
 
+// Occupy marks the gpus which are chosen by an external scheduler as used by the replicaSet,
+// it fails if any gpu is absent, unhealthy or held by others, nothing is marked then.
+func (gs *gpuScheduler) Occupy(owner string, gpus []string) error {
+	gs.Lock()
+	defer gs.Unlock()
+
+	occupied := make(map[string]struct{}, len(gpus))
+	for _, gpu := range gpus {
+		if _, ok := occupied[gpu]; ok {
+			return errors.Errorf("gpu: %s is returned twice", gpu)
+		}
+		occupied[gpu] = struct{}{}
+		status, ok := gs.GpuStatusMap[gpu]
+		if !ok {
+			return errors.Wrapf(xerrors.NewGpuNotFoundError(), "gpu: %s", gpu)
+		}
+		if _, ok = gs.unhealthy[gpu]; ok {
+			return errors.Wrap(xerrors.NewGpuUnhealthyError(), gs.unhealthyReasons([]string{gpu}))
+		}
+		// the external scheduler may return the gpus the replicaSet holds already, e.g. when it's patched
+		if status != 0 && gs.GpuOwnerMap[gpu] != owner {
+			return errors.Wrapf(xerrors.NewGpuBusyError(), "gpu: %s is %s", gpu, gs.heldReason(gpu))
+		}
+	}
+	for _, gpu := range gpus {
+		gs.GpuStatusMap[gpu] = 1
+		gs.GpuOwnerMap[gpu] = owner
+	}
+	return nil
+}
+
 // Restore a specified number of gpu
 func (gs *gpuScheduler) Restore(gpus []string) {
-	if len(gpus) <= 0 || len(gpus) > gs.AvailableGpuNums {
+	if len(gpus) <= 0 {
 		return
 	}
 
@@ -115,8 +389,494 @@ func (gs *gpuScheduler) Restore(gpus []string) {
 	defer gs.Unlock()
 
 	for _, gpu := range gpus {
+		if IsMigDevice(gpu) {
+			delete(gs.MigOwnerMap, gpu)
+			continue
+		}
+		if _, ok := gs.GpuStatusMap[gpu]; !ok {
+			continue
+		}
+		// the gpu shared by fractional requests is restored by RestoreFraction, and the shared one by RestoreShared
+		if _, ok := gs.GpuSlotMap[gpu]; ok {
+			continue
+		}
+		if _, ok := gs.GpuShareMap[gpu]; ok {
+			continue
+		}
 		gs.GpuStatusMap[gpu] = 0
+		delete(gs.GpuOwnerMap, gpu)
+	}
+}
+
+// ApplyFraction applies for some slots of a gpu for the replicaSet, it returns the uuid of the gpu.
+// If the replicaSet already holds the same slots, the gpu is returned directly.
+// The shared gpu with the fewest free slots that still fits is preferred, so that the whole gpus are kept free.
+func (gs *gpuScheduler) ApplyFraction(owner string, slots int) (string, error) {
+	if slots <= 0 || slots >= gs.SlotsPerGpu {
+		return "", errors.Errorf("slots must be greater than 0 and less than %d", gs.SlotsPerGpu)
+	}
+	gs.checkMigDevices()
+	gs.checkGpuHealth()
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	uuid, held := gs.fractionHeldBy(owner)
+	if len(uuid) != 0 && held == slots {
+		return uuid, nil
+	}
+
+	// the slots held are restored only after the new ones are picked, so they are kept if nothing fits
+	chosen, err := gs.pickFraction(owner, slots, gs.LabelMap[owner])
+	if err != nil {
+		if xerrors.IsGpuNotEnoughError(err) {
+			notify.Emit(models.EventGpuExhausted, owner, map[string]interface{}{
+				"requestedSlots": slots,
+				"slotsPerGpu":    gs.SlotsPerGpu,
+			})
+		}
+		return "", err
+	}
+
+	if len(uuid) != 0 {
+		gs.restoreFraction(owner, uuid)
+	}
+	if _, ok := gs.GpuSlotMap[chosen]; !ok {
+		gs.GpuSlotMap[chosen] = make(map[string]int)
+	}
+	gs.GpuSlotMap[chosen][owner] = slots
+	gs.GpuStatusMap[chosen] = 1
+	return chosen, nil
+}
+
+// PlanFraction returns the gpu ApplyFraction would apply the slots of for the replicaSet with the labels,
+// nothing is applied
+func (gs *gpuScheduler) PlanFraction(owner string, slots int, labels []string) (string, error) {
+	if slots <= 0 || slots >= gs.SlotsPerGpu {
+		return "", errors.Errorf("slots must be greater than 0 and less than %d", gs.SlotsPerGpu)
+	}
+	gs.checkMigDevices()
+	gs.checkGpuHealth()
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	if uuid, held := gs.fractionHeldBy(owner); len(uuid) != 0 && held == slots {
+		return uuid, nil
+	}
+	return gs.pickFraction(owner, slots, labels)
+}
+
+// pickFraction picks the gpu for the slots without marking it, the caller must hold the lock.
+// The slots already held by the replicaSet are not counted, as they are restored when the new slots are applied,
+// so a gpu held only by the replicaSet is free.
+func (gs *gpuScheduler) pickFraction(owner string, slots int, labels []string) (string, error) {
+	var (
+		chosen        string
+		free          = gs.SlotsPerGpu + 1
+		conflict      string
+		unhealthyGpus []string
+	)
+	for _, uuid := range gs.sortedGpus() {
+		used := gs.slotsUsedExcept(uuid, owner)
+		left := gs.SlotsPerGpu - used
+		if left < slots || left >= free {
+			continue
+		}
+		if _, ok := gs.unhealthy[uuid]; ok {
+			unhealthyGpus = append(unhealthyGpus, uuid)
+			continue
+		}
+		if used != 0 {
+			if other, label := gs.conflictOn(owner, labels, uuid); len(other) != 0 {
+				conflict = fmt.Sprintf("gpu: %s is shared with replicaSet: %s labeled %s", uuid, other, label)
+				continue
+			}
+		}
+		chosen, free = uuid, left
+	}
+	if len(chosen) == 0 {
+		if len(conflict) != 0 {
+			return "", errors.Wrap(xerrors.NewGpuConflictError(), conflict)
+		}
+		if len(unhealthyGpus) != 0 {
+			return "", errors.Wrap(xerrors.NewGpuUnhealthyError(), gs.unhealthyReasons(unhealthyGpus))
+		}
+		return "", errors.Wrapf(xerrors.NewGpuNotEnoughError(), "no gpu has %d of %d slots free", slots, gs.SlotsPerGpu)
+	}
+	return chosen, nil
+}
+
+// slotsUsedExcept returns the slots of the gpu used by the others than the owner, the caller must hold the lock.
+// A whole gpu consumes all slots, whether it's held exclusively, shared, in mig mode or reserved.
+func (gs *gpuScheduler) slotsUsedExcept(uuid, owner string) int {
+	owners, ok := gs.GpuSlotMap[uuid]
+	if !ok {
+		if gs.GpuStatusMap[uuid] != 0 {
+			return gs.SlotsPerGpu
+		}
+		return 0
+	}
+	var used int
+	for o, n := range owners {
+		if o != owner {
+			used += n
+		}
+	}
+	return used
+}
+
+// TransferFraction moves the slots held by from to to, e.g. when the replicaSet is renamed,
+// it returns the uuid of the gpu, which is empty if from holds no slots
+func (gs *gpuScheduler) TransferFraction(from, to string) string {
+	gs.Lock()
+	defer gs.Unlock()
+
+	uuid, slots := gs.fractionHeldBy(from)
+	if len(uuid) == 0 {
+		return ""
+	}
+	delete(gs.GpuSlotMap[uuid], from)
+	gs.GpuSlotMap[uuid][to] = slots
+	return uuid
+}
+
+// RestoreFraction restores the slots held by the replicaSet
+func (gs *gpuScheduler) RestoreFraction(owner string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if uuid, _ := gs.fractionHeldBy(owner); len(uuid) != 0 {
+		gs.restoreFraction(owner, uuid)
+	}
+}
+
+func (gs *gpuScheduler) fractionHeldBy(owner string) (string, int) {
+	for uuid, owners := range gs.GpuSlotMap {
+		if slots, ok := owners[owner]; ok {
+			return uuid, slots
+		}
+	}
+	return "", 0
+}
+
+func (gs *gpuScheduler) restoreFraction(owner, uuid string) {
+	delete(gs.GpuSlotMap[uuid], owner)
+	if len(gs.GpuSlotMap[uuid]) == 0 {
+		delete(gs.GpuSlotMap, uuid)
+		gs.GpuStatusMap[uuid] = 0
+	}
+}
+
+// GetGpuSlots returns the slots used of each gpu in use, a whole gpu consumes all slots
+func (gs *gpuScheduler) GetGpuSlots() map[string]int {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	used := make(map[string]int)
+	for uuid := range gs.GpuStatusMap {
+		if n := gs.slotsUsedExcept(uuid, ""); n != 0 {
+			used[uuid] = n
+		}
 	}
+	return used
+}
+
+// SetGpuConflicts sets the labels that can't share a gpu, each rule is a pair of labels, e.g. "inference:batch"
+func (gs *gpuScheduler) SetGpuConflicts(rules []string) error {
+	conflicts := make(map[string]map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		labels := strings.Split(rule, ":")
+		if len(labels) != 2 || len(labels[0]) == 0 || len(labels[1]) == 0 {
+			return errors.Errorf("gpu conflict rule: %s is invalid, format: label:label", rule)
+		}
+		for i, label := range labels {
+			if _, ok := conflicts[label]; !ok {
+				conflicts[label] = make(map[string]struct{})
+			}
+			conflicts[label][labels[1-i]] = struct{}{}
+		}
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+	gs.conflicts = conflicts
+	return nil
+}
+
+// SetLabels records the anti-co-location labels of the replicaSet, they are checked when a gpu is shared
+func (gs *gpuScheduler) SetLabels(owner string, labels []string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if len(labels) == 0 {
+		delete(gs.LabelMap, owner)
+		return
+	}
+	gs.LabelMap[owner] = labels
+}
+
+// Labels returns the anti-co-location labels of the replicaSet, e.g. to explain the conflicts of its clone
+func (gs *gpuScheduler) Labels(owner string) []string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	return append([]string(nil), gs.LabelMap[owner]...)
+}
+
+// RemoveLabels removes the anti-co-location labels of the replicaSet
+func (gs *gpuScheduler) RemoveLabels(owner string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	delete(gs.LabelMap, owner)
+}
+
+// ExplainConflicts describes the shared gpus which can't be used by a replicaSet with the labels
+func (gs *gpuScheduler) ExplainConflicts(labels []string) []string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	explanations := make([]string, 0)
+	for uuid := range gs.GpuSlotMap {
+		if other, label := gs.conflictOn("", labels, uuid); len(other) != 0 {
+			explanations = append(explanations, fmt.Sprintf("gpu: %s is shared with replicaSet: %s labeled %s", uuid, other, label))
+		}
+	}
+	for uuid := range gs.GpuShareMap {
+		if other, label := gs.conflictOn("", labels, uuid); len(other) != 0 {
+			explanations = append(explanations, fmt.Sprintf("gpu: %s is shared with replicaSet: %s labeled %s", uuid, other, label))
+		}
+	}
+	sort.Strings(explanations)
+	return explanations
+}
+
+// conflictOn returns the replicaSet on the gpu and its label which conflicts with the labels of the owner,
+// the replicaSets sharing the gpu are the ones holding its slots, sharing it or holding its mig instances.
+// A whole gpu is held exclusively, so its holder never shares it with another.
+func (gs *gpuScheduler) conflictOn(owner string, labels []string, uuid string) (string, string) {
+	for _, label := range labels {
+		for _, other := range append(gs.coOwners(uuid), gs.migOwners(uuid)...) {
+			if other == owner {
+				continue
+			}
+			for _, otherLabel := range gs.LabelMap[other] {
+				if _, ok := gs.conflicts[label][otherLabel]; ok {
+					return other, otherLabel
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// SetJob records the external job id of the replicaSet
+func (gs *gpuScheduler) SetJob(owner, jobID string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.JobMap[owner] = jobID
+}
+
+// RemoveJob removes the external job id of the replicaSet
+func (gs *gpuScheduler) RemoveJob(owner string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	delete(gs.JobMap, owner)
+}
+
+// Transfer hands the whole gpus and the mig instances held by one owner over to another,
+// e.g. from a reservation to the replicaSet, and returns the gpus transferred
+func (gs *gpuScheduler) Transfer(from, to string) []string {
+	gs.Lock()
+	defer gs.Unlock()
+
+	var gpus []string
+	for gpu, owner := range gs.GpuOwnerMap {
+		if owner == from && gs.GpuStatusMap[gpu] != 0 {
+			gs.GpuOwnerMap[gpu] = to
+			gpus = append(gpus, gpu)
+		}
+	}
+	for gpu, owner := range gs.MigOwnerMap {
+		if owner == from {
+			gs.MigOwnerMap[gpu] = to
+			gpus = append(gpus, gpu)
+		}
+	}
+	sort.Strings(gpus)
+	return gpus
+}
+
+// OwnedBy returns the whole gpus held by the owner
+func (gs *gpuScheduler) OwnedBy(owner string) []string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	var gpus []string
+	for gpu, o := range gs.GpuOwnerMap {
+		if o == owner && gs.GpuStatusMap[gpu] != 0 {
+			gpus = append(gpus, gpu)
+		}
+	}
+	sort.Strings(gpus)
+	return gpus
+}
+
+// RestoreOwner releases the whole gpus and the mig instances held by the replicaSet, whichever version uses them,
+// e.g. when its containers were removed outside. The fractional and shared gpus are restored by their own methods.
+// It returns the gpus released.
+func (gs *gpuScheduler) RestoreOwner(owner string) []string {
+	gs.Lock()
+	defer gs.Unlock()
+
+	var gpus []string
+	for gpu, o := range gs.GpuOwnerMap {
+		if o != owner {
+			continue
+		}
+		if _, ok := gs.GpuSlotMap[gpu]; ok {
+			continue
+		}
+		if _, ok := gs.GpuShareMap[gpu]; ok {
+			continue
+		}
+		gs.GpuStatusMap[gpu] = 0
+		delete(gs.GpuOwnerMap, gpu)
+		gpus = append(gpus, gpu)
+	}
+	for gpu, o := range gs.MigOwnerMap {
+		if o == owner {
+			delete(gs.MigOwnerMap, gpu)
+			gpus = append(gpus, gpu)
+		}
+	}
+	sort.Strings(gpus)
+	return gpus
+}
+
+// RestoreExcept releases the gpus held by the replicaSet in the modes other than mode, e.g. the shared gpus
+// of the current version when it's rolled back to a version of whole gpus. It returns the gpus released.
+func (gs *gpuScheduler) RestoreExcept(owner string, mode GpuMode) []string {
+	var gpus []string
+	if mode != GpuModeWhole {
+		gpus = append(gpus, gs.RestoreOwner(owner)...)
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	if mode != GpuModeFraction {
+		if uuid, _ := gs.fractionHeldBy(owner); len(uuid) != 0 {
+			gs.restoreFraction(owner, uuid)
+			gpus = append(gpus, uuid)
+		}
+	}
+	if mode != GpuModeShared {
+		gpus = append(gpus, gs.sharedBy(owner)...)
+		gs.restoreShared(owner)
+	}
+	sort.Strings(gpus)
+	return gpus
+}
+
+// Owners returns the owners of the gpus whose name begins with the prefix
+func (gs *gpuScheduler) Owners(prefix string) []string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	seen := make(map[string]struct{})
+	var owners []string
+	for gpu, owner := range gs.GpuOwnerMap {
+		if _, ok := seen[owner]; ok || gs.GpuStatusMap[gpu] == 0 || !strings.HasPrefix(owner, prefix) {
+			continue
+		}
+		seen[owner] = struct{}{}
+		owners = append(owners, owner)
+	}
+	return owners
+}
+
+// Reconcile makes the whole gpus held by replicaSets match the claims, the key is replicaSet name,
+// the value is the gpus used by its running container. The state saved at shutdown is stale after a crash,
+// so the free gpus in the claims are marked as used, and the gpus of replicaSets without claims are restored.
+// The gpus of the owners kept, e.g. the reservations, and of the fractional and shared requests are not touched.
+// It returns the number of gpus claimed and restored.
+func (gs *gpuScheduler) Reconcile(claims map[string][]string, kept func(owner string) bool) (claimed, restored int) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	for owner, gpus := range claims {
+		for _, gpu := range gpus {
+			if IsMigDevice(gpu) {
+				if gs.MigOwnerMap[gpu] != owner {
+					gs.MigOwnerMap[gpu] = owner
+					claimed++
+				}
+				continue
+			}
+			status, ok := gs.GpuStatusMap[gpu]
+			if !ok {
+				log.Warnf("schedulers.GpuScheduler, gpu: %s used by replicaSet: %s is not found on the host", gpu, owner)
+				continue
+			}
+			if _, ok = gs.GpuSlotMap[gpu]; ok {
+				continue
+			}
+			if _, ok = gs.GpuShareMap[gpu]; ok {
+				continue
+			}
+			if status != 0 && gs.GpuOwnerMap[gpu] != owner {
+				log.Warnf("schedulers.GpuScheduler, gpu: %s used by replicaSet: %s is held by: %s, it's used by both",
+					gpu, owner, gs.GpuOwnerMap[gpu])
+				continue
+			}
+			if status == 0 || gs.GpuOwnerMap[gpu] != owner {
+				gs.GpuStatusMap[gpu] = 1
+				gs.GpuOwnerMap[gpu] = owner
+				claimed++
+			}
+		}
+	}
+
+	for gpu, owner := range gs.GpuOwnerMap {
+		if _, ok := claims[owner]; ok || kept(owner) || gs.GpuStatusMap[gpu] == 0 {
+			continue
+		}
+		if _, ok := gs.GpuSlotMap[gpu]; ok {
+			continue
+		}
+		if _, ok := gs.GpuShareMap[gpu]; ok {
+			continue
+		}
+		gs.GpuStatusMap[gpu] = 0
+		delete(gs.GpuOwnerMap, gpu)
+		restored++
+	}
+	for gpu, owner := range gs.MigOwnerMap {
+		if _, ok := claims[owner]; ok || kept(owner) {
+			continue
+		}
+		delete(gs.MigOwnerMap, gpu)
+		restored++
+	}
+	return claimed, restored
+}
+
+// HeldBy returns the gpus in the given list which are still held by the replicaSet
+func (gs *gpuScheduler) HeldBy(owner string, gpus []string) []string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	held := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		if gs.GpuStatusMap[gpu] != 0 && gs.GpuOwnerMap[gpu] == owner {
+			held = append(held, gpu)
+		}
+	}
+	return held
 }
 
 func (gs *gpuScheduler) serialize() *string {
@@ -140,8 +900,26 @@ func (gs *gpuScheduler) GetGpuStatus() map[string]byte {
 	return copyMap
 }
 
+// GetGpuReservations returns the replicaSet and the external job id which hold each used gpu
+func (gs *gpuScheduler) GetGpuReservations() map[string]GpuReservation {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	reservations := make(map[string]GpuReservation, len(gs.GpuOwnerMap))
+	for uuid, owner := range gs.GpuOwnerMap {
+		if gs.GpuStatusMap[uuid] == 0 {
+			continue
+		}
+		reservations[uuid] = GpuReservation{
+			Owner: owner,
+			JobID: gs.JobMap[owner],
+		}
+	}
+	return reservations
+}
+
 func getAllGpuUUID() ([]*gpu, error) {
-	c := cmd.NewCommand(allGpuUUIDCommand)
+	c := newCommand(allGpuUUIDCommand)
 	err := c.Execute()
 	if err != nil {
 		return nil, errors.Wrap(err, "cmd.Execute failed")
@@ -154,6 +932,80 @@ func getAllGpuUUID() ([]*gpu, error) {
 	return gpuList, nil
 }
 
+// GetGpuIndexes returns the host index of each gpu, the key is uuid
+func GetGpuIndexes() (map[string]int, error) {
+	gpus, err := getAllGpuUUID()
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]int, len(gpus))
+	for _, g := range gpus {
+		indexes[*g.UUID] = g.Index
+	}
+	return indexes, nil
+}
+
+// GetGpuUtilization returns the utilization of each gpu in percent, the key is uuid
+func GetGpuUtilization() (map[string]int, error) {
+	c := newCommand(gpuUtilizationCommand)
+	if err := c.Execute(); err != nil {
+		return nil, errors.Wrap(err, "cmd.Execute failed")
+	}
+
+	utilization := make(map[string]int)
+	for _, line := range strings.Split(c.Stdout(), "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) != 2 {
+			continue
+		}
+		percent, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, errors.Errorf("invaild utilization: %s, ", fields[1])
+		}
+		utilization[fields[0]] = percent
+	}
+	return utilization, nil
+}
+
+// QueryGpuDevices returns the memory and utilization of each gpu on the host, ordered by index
+func QueryGpuDevices() ([]*models.GpuDevice, error) {
+	c := newCommand(gpuDeviceCommand)
+	if err := c.Execute(); err != nil {
+		return nil, errors.Wrap(err, "cmd.Execute failed")
+	}
+
+	devices := make([]*models.GpuDevice, 0)
+	for _, line := range strings.Split(c.Stdout(), "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) != 5 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, errors.Errorf("invaild index: %s, ", fields[0])
+		}
+		device := &models.GpuDevice{
+			Index:      index,
+			UUID:       strings.TrimSpace(fields[1]),
+			Containers: make([]string, 0),
+		}
+		// the fields of a lost gpu are [Unknown Error], they are left 0
+		device.MemoryTotal, _ = strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		device.MemoryUsed, _ = strconv.ParseInt(strings.TrimSpace(fields[3]), 10, 64)
+		device.UtilizationPercent, _ = strconv.Atoi(strings.TrimSpace(fields[4]))
+		devices = append(devices, device)
+	}
+	// nvidia-smi exits with an error code when a gpu is lost, the other gpus are still listed,
+	// without the driver it prints the failure to stdout
+	if c.ExitCode() != 0 && len(devices) == 0 {
+		return nil, errors.Errorf("command: %s exit with code %d, output: %s", gpuDeviceCommand, c.ExitCode(), c.Combined())
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Index < devices[j].Index
+	})
+	return devices, nil
+}
+
 func parseOutput(output string) (gpuList []*gpu, err error) {
 	lines := strings.Split(output, "\n")
 	gpuList = make([]*gpu, 0, len(lines))
@@ -177,3 +1029,284 @@ func parseOutput(output string) (gpuList []*gpu, err error) {
 	}
 	return
 }
+
+// WhatIfResult explains how the local GpuScheduler would place a gpu request, nothing is allocated
+type WhatIfResult struct {
+	Schedulable bool           `json:"schedulable"`
+	Gpus        []string       `json:"gpus"`
+	Candidates  []GpuCandidate `json:"candidates"`
+	Rationale   string         `json:"rationale"`
+}
+
+// GpuCandidate is a gpu considered by the request and why it's eligible or rejected
+type GpuCandidate struct {
+	UUID     string `json:"uuid"`
+	Eligible bool   `json:"eligible"`
+	Reason   string `json:"reason"`
+}
+
+// WhatIfRequest is the gpu request of a container spec, one of GpuCount, Slots and MigProfile is set
+type WhatIfRequest struct {
+	Owner       string
+	GpuCount    int
+	UUIDs       []string
+	Constraints *models.GpuConstraints
+	Slots       int
+	Labels      []string
+	Shared      bool
+	MaxSharers  int
+	Mps         bool
+	MigProfile  string
+	MigCount    int
+}
+
+// WhatIf explains the request in explain mode, the gpus are picked by the same Plan functions as the dry run,
+// so the decision is the one Apply would make now, and each gpu considered by the request is listed with why
+// it's eligible or rejected. The state of the scheduler is not changed.
+func (gs *gpuScheduler) WhatIf(req *WhatIfRequest) *WhatIfResult {
+	result := &WhatIfResult{
+		Gpus:       make([]string, 0),
+		Candidates: make([]GpuCandidate, 0),
+	}
+	if gs.AvailableGpuNums == 0 {
+		result.Rationale = "no gpu is detected on the host by nvidia-smi"
+		return result
+	}
+
+	var (
+		gpus    []string
+		allowed map[string]struct{}
+		err     error
+	)
+	switch {
+	case len(req.MigProfile) != 0:
+		gpus, err = gs.PlanMig(req.Owner, req.MigProfile, req.MigCount, req.Labels)
+	case req.Slots > 0:
+		var uuid string
+		if uuid, err = gs.PlanFraction(req.Owner, req.Slots, req.Labels); err == nil {
+			gpus = []string{uuid}
+		}
+	case req.Shared:
+		gpus, err = gs.PlanShared(req.Owner, req.GpuCount, req.MaxSharers, req.Mps)
+	default:
+		if allowed, err = allowedGpus(req.Constraints); err == nil {
+			gpus, err = gs.planUUIDs(req.UUIDs, req.GpuCount, allowed)
+		}
+	}
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	switch {
+	case len(req.MigProfile) != 0:
+		gs.explainMig(result, req.Owner, req.MigProfile, req.Labels)
+	case req.Slots > 0:
+		gs.explainFraction(result, req.Owner, req.Slots, req.Labels)
+	case req.Shared:
+		gs.explainShared(result, req.Owner, req.MaxSharers, req.Mps)
+	default:
+		gs.explainWhole(result, req.UUIDs, allowed)
+	}
+
+	if err != nil {
+		result.Rationale = err.Error()
+		return result
+	}
+	result.Schedulable = true
+	result.Gpus = gpus
+	switch {
+	case len(req.MigProfile) != 0:
+		result.Rationale = fmt.Sprintf("%d mig instances of profile: %s are free, %d are requested",
+			countEligible(result.Candidates), req.MigProfile, req.MigCount)
+	case req.Slots > 0:
+		result.Rationale = fmt.Sprintf("gpu: %s fits %d slots, the shared gpu with the fewest free slots is preferred to a free gpu",
+			gpus[0], req.Slots)
+	case req.Shared:
+		result.Rationale = fmt.Sprintf("%d gpus can be shared, %d are requested, the gpus with the fewest sharers are preferred",
+			countEligible(result.Candidates), req.GpuCount)
+	default:
+		result.Rationale = fmt.Sprintf("%d of %d gpus are eligible, %d are requested",
+			countEligible(result.Candidates), gs.AvailableGpuNums, req.GpuCount)
+	}
+	return result
+}
+
+func countEligible(candidates []GpuCandidate) int {
+	var n int
+	for _, candidate := range candidates {
+		if candidate.Eligible {
+			n++
+		}
+	}
+	return n
+}
+
+// sortedGpus returns the uuids of the gpus in order, the caller must hold the lock
+func (gs *gpuScheduler) sortedGpus() []string {
+	uuids := make([]string, 0, len(gs.GpuStatusMap))
+	for uuid := range gs.GpuStatusMap {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+func (gs *gpuScheduler) explainWhole(result *WhatIfResult, requested []string, allowed map[string]struct{}) {
+	for _, uuid := range gs.sortedGpus() {
+		candidate := GpuCandidate{UUID: uuid}
+		reason, unhealthy := gs.unhealthy[uuid]
+		_, ok := allowed[uuid]
+		switch {
+		case unhealthy:
+			candidate.Reason = "unhealthy, " + reason
+		case allowed != nil && !ok:
+			candidate.Reason = "excluded by the constraints"
+		case gs.GpuStatusMap[uuid] == 0:
+			candidate.Eligible, candidate.Reason = true, "free"
+			if contains(requested, uuid) {
+				candidate.Reason = "free, requested by uuid"
+			}
+		case len(gs.GpuSlotMap[uuid]) != 0:
+			candidate.Reason = fmt.Sprintf("shared by fractional requests of %s, a whole gpu is required", gs.slotOwners(uuid))
+		default:
+			candidate.Reason = gs.heldReason(uuid)
+		}
+		result.Candidates = append(result.Candidates, candidate)
+	}
+}
+
+func (gs *gpuScheduler) explainFraction(result *WhatIfResult, owner string, slots int, labels []string) {
+	for _, uuid := range gs.sortedGpus() {
+		candidate := GpuCandidate{UUID: uuid}
+		owners, ok := gs.GpuSlotMap[uuid]
+		used := gs.slotsUsedExcept(uuid, owner)
+		reason, unhealthy := gs.unhealthy[uuid]
+		switch {
+		case unhealthy:
+			candidate.Reason = "unhealthy, " + reason
+		case ok && owners[owner] == slots:
+			candidate.Eligible, candidate.Reason = true, "already held by the replicaSet"
+		case ok && used == 0:
+			// the slots held by the replicaSet itself are restored before applying
+			candidate.Eligible, candidate.Reason = true, "free after the slots of the replicaSet are restored"
+		case ok:
+			left := gs.SlotsPerGpu - used
+			if left < slots {
+				candidate.Reason = fmt.Sprintf("only %d of %d slots are free, %d are requested", left, gs.SlotsPerGpu, slots)
+			} else if other, label := gs.conflictOn(owner, labels, uuid); len(other) != 0 {
+				candidate.Reason = fmt.Sprintf("shared with replicaSet: %s labeled %s", other, label)
+			} else {
+				candidate.Eligible = true
+				candidate.Reason = fmt.Sprintf("%d of %d slots are free", left, gs.SlotsPerGpu)
+			}
+		case gs.GpuStatusMap[uuid] == 0:
+			candidate.Eligible, candidate.Reason = true, "free"
+		default:
+			candidate.Reason = gs.heldReason(uuid)
+		}
+		result.Candidates = append(result.Candidates, candidate)
+	}
+}
+
+func (gs *gpuScheduler) explainShared(result *WhatIfResult, owner string, maxSharers int, mps bool) {
+	for _, uuid := range gs.sortedGpus() {
+		candidate := GpuCandidate{UUID: uuid}
+		s, ok := gs.GpuShareMap[uuid]
+		reason, unhealthy := gs.unhealthy[uuid]
+		switch {
+		case unhealthy:
+			candidate.Reason = "unhealthy, " + reason
+		case ok:
+			_, joined := s.Owners[owner]
+			n := len(s.Owners) + 1
+			other, label := gs.conflictOn(owner, gs.LabelMap[owner], uuid)
+			switch {
+			case joined:
+				candidate.Reason = "already shared by the replicaSet"
+			case s.Mps && !mps:
+				candidate.Reason = "shared through the MPS daemon, only the MPS clients can share it"
+			case !s.Mps && mps:
+				candidate.Reason = "time-sliced by the replicaSets, the MPS clients can't share it"
+			case s.MaxSharers != 0 && n > s.MaxSharers:
+				candidate.Reason = fmt.Sprintf("shared by %d replicaSets, the cap of the sharers is %d", len(s.Owners), s.MaxSharers)
+			case maxSharers != 0 && n > maxSharers:
+				candidate.Reason = fmt.Sprintf("shared by %d replicaSets, the requested cap is %d", len(s.Owners), maxSharers)
+			case len(other) != 0:
+				candidate.Reason = fmt.Sprintf("shared with replicaSet: %s labeled %s", other, label)
+			default:
+				candidate.Eligible = true
+				candidate.Reason = fmt.Sprintf("shared by %d replicaSets", len(s.Owners))
+			}
+		case gs.GpuStatusMap[uuid] == 0:
+			candidate.Eligible, candidate.Reason = true, "free"
+		case len(gs.GpuSlotMap[uuid]) != 0:
+			candidate.Reason = fmt.Sprintf("shared by fractional requests of %s", gs.slotOwners(uuid))
+		default:
+			candidate.Reason = gs.heldReason(uuid)
+		}
+		result.Candidates = append(result.Candidates, candidate)
+	}
+}
+
+// explainMig lists the mig instances of the profile
+func (gs *gpuScheduler) explainMig(result *WhatIfResult, owner, profile string, labels []string) {
+	for _, device := range gs.migDevices {
+		if device.Profile != profile {
+			continue
+		}
+		candidate := GpuCandidate{UUID: device.UUID}
+		reason, unhealthy := gs.unhealthy[device.GpuUUID]
+		holder, held := gs.MigOwnerMap[device.UUID]
+		other, label := gs.conflictOn(owner, labels, device.GpuUUID)
+		switch {
+		case held:
+			candidate.Reason = fmt.Sprintf("held by replicaSet: %s", holder)
+		case unhealthy:
+			candidate.Reason = fmt.Sprintf("gpu: %s is unhealthy, %s", device.GpuUUID, reason)
+		case len(other) != 0:
+			candidate.Reason = fmt.Sprintf("gpu: %s is shared with replicaSet: %s labeled %s", device.GpuUUID, other, label)
+		default:
+			candidate.Eligible, candidate.Reason = true, "free"
+		}
+		result.Candidates = append(result.Candidates, candidate)
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// heldReason tells who holds the whole gpu, a reservation or a replicaSet with its external job
+func (gs *gpuScheduler) heldReason(uuid string) string {
+	if _, ok := gs.GpuShareMap[uuid]; ok {
+		return fmt.Sprintf("shared by replicaSets: %s", gs.shareOwners(uuid))
+	}
+	owner, ok := gs.GpuOwnerMap[uuid]
+	if !ok {
+		return "used by an unknown owner"
+	}
+	if owner == migOwner {
+		return "in mig mode, it's shared by the mig instances"
+	}
+	if strings.HasPrefix(owner, "reservation:") {
+		return fmt.Sprintf("held by reservation: %s", strings.TrimPrefix(owner, "reservation:"))
+	}
+	if jobID, ok := gs.JobMap[owner]; ok {
+		return fmt.Sprintf("held by replicaSet: %s, job id: %s", owner, jobID)
+	}
+	return fmt.Sprintf("held by replicaSet: %s", owner)
+}
+
+func (gs *gpuScheduler) slotOwners(uuid string) string {
+	owners := make([]string, 0, len(gs.GpuSlotMap[uuid]))
+	for owner, n := range gs.GpuSlotMap[uuid] {
+		owners = append(owners, fmt.Sprintf("%s (%d slots)", owner, n))
+	}
+	sort.Strings(owners)
+	return strings.Join(owners, ", ")
+}
@@ -0,0 +1,1234 @@
+package schedulers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/commander-cli/cmd"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// newTestGpuScheduler returns a scheduler of the free gpus without etcd, each gpu takes slotsPerGpu slots
+func newTestGpuScheduler(slotsPerGpu int, uuids ...string) *gpuScheduler {
+	gs := &gpuScheduler{
+		AvailableGpuNums: len(uuids),
+		GpuStatusMap:     make(map[string]byte, len(uuids)),
+		GpuOwnerMap:      make(map[string]string),
+		JobMap:           make(map[string]string),
+		SlotsPerGpu:      slotsPerGpu,
+		GpuSlotMap:       make(map[string]map[string]int),
+		GpuShareMap:      make(map[string]*SharedGpu),
+		LabelMap:         make(map[string][]string),
+		MigOwnerMap:      make(map[string]string),
+		unhealthy:        make(map[string]string),
+	}
+	for _, uuid := range uuids {
+		gs.GpuStatusMap[uuid] = 0
+	}
+	return gs
+}
+
+// hold marks the gpus as used by the owner
+func (gs *gpuScheduler) hold(owner string, uuids ...string) {
+	for _, uuid := range uuids {
+		gs.GpuStatusMap[uuid] = 1
+		gs.GpuOwnerMap[uuid] = owner
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	keptReservations := func(owner string) bool {
+		return strings.HasPrefix(owner, "reservation:")
+	}
+	tests := []struct {
+		name         string
+		held         map[string]string
+		claims       map[string][]string
+		wantOwners   map[string]string
+		wantClaimed  int
+		wantRestored int
+	}{
+		{
+			name:        "claim the running replicaSet",
+			claims:      map[string][]string{"train": {"gpu-0"}},
+			wantOwners:  map[string]string{"gpu-0": "train"},
+			wantClaimed: 1,
+		},
+		{
+			name:         "restore the stopped replicaSet",
+			held:         map[string]string{"gpu-0": "train"},
+			wantOwners:   map[string]string{},
+			wantRestored: 1,
+		},
+		{
+			name:       "keep the running job",
+			held:       map[string]string{"gpu-1": "job:job-0123456789abcdef"},
+			claims:     map[string][]string{"job:job-0123456789abcdef": {"gpu-1"}},
+			wantOwners: map[string]string{"gpu-1": "job:job-0123456789abcdef"},
+		},
+		{
+			name:         "restore the job which is gone",
+			held:         map[string]string{"gpu-1": "job:job-0123456789abcdef"},
+			wantOwners:   map[string]string{},
+			wantRestored: 1,
+		},
+		{
+			name:       "keep the reservation",
+			held:       map[string]string{"gpu-0": "reservation:abc"},
+			wantOwners: map[string]string{"gpu-0": "reservation:abc"},
+		},
+		{
+			name:       "don't take the gpu of another owner",
+			held:       map[string]string{"gpu-0": "reservation:abc"},
+			claims:     map[string][]string{"train": {"gpu-0"}},
+			wantOwners: map[string]string{"gpu-0": "reservation:abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1")
+			for uuid, owner := range tt.held {
+				gs.hold(owner, uuid)
+			}
+			claimed, restored := gs.Reconcile(tt.claims, keptReservations)
+			if claimed != tt.wantClaimed || restored != tt.wantRestored {
+				t.Errorf("Reconcile() = %d, %d, want %d, %d", claimed, restored, tt.wantClaimed, tt.wantRestored)
+			}
+			if !reflect.DeepEqual(gs.GpuOwnerMap, tt.wantOwners) {
+				t.Errorf("Reconcile() owners = %v, want %v", gs.GpuOwnerMap, tt.wantOwners)
+			}
+			for uuid, status := range gs.GpuStatusMap {
+				if _, ok := tt.wantOwners[uuid]; ok != (status != 0) {
+					t.Errorf("Reconcile() gpu: %s status = %d, owned: %v", uuid, status, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      map[string]string
+		mig       map[string]string
+		slots     map[string]map[string]int
+		owner     string
+		want      []string
+		wantOwned map[string]string
+	}{
+		{
+			name:      "whole gpus of any version",
+			held:      map[string]string{"gpu-0": "train", "gpu-1": "train", "gpu-2": "infer"},
+			owner:     "train",
+			want:      []string{"gpu-0", "gpu-1"},
+			wantOwned: map[string]string{"gpu-2": "infer"},
+		},
+		{
+			name:      "mig instances",
+			mig:       map[string]string{"MIG-a": "train", "MIG-b": "infer"},
+			owner:     "train",
+			want:      []string{"MIG-a"},
+			wantOwned: map[string]string{},
+		},
+		{
+			name:      "fractional gpus are kept",
+			held:      map[string]string{"gpu-0": "train"},
+			slots:     map[string]map[string]int{"gpu-0": {"train": 1}},
+			owner:     "train",
+			want:      nil,
+			wantOwned: map[string]string{"gpu-0": "train"},
+		},
+		{
+			name:      "nothing held",
+			held:      map[string]string{"gpu-0": "infer"},
+			owner:     "train",
+			want:      nil,
+			wantOwned: map[string]string{"gpu-0": "infer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(2, "gpu-0", "gpu-1", "gpu-2")
+			for uuid, owner := range tt.held {
+				gs.hold(owner, uuid)
+			}
+			for uuid, owner := range tt.mig {
+				gs.MigOwnerMap[uuid] = owner
+			}
+			for uuid, slots := range tt.slots {
+				gs.GpuSlotMap[uuid] = slots
+			}
+			if got := gs.RestoreOwner(tt.owner); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RestoreOwner() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gs.GpuOwnerMap, tt.wantOwned) {
+				t.Errorf("RestoreOwner() owners = %v, want %v", gs.GpuOwnerMap, tt.wantOwned)
+			}
+			if _, ok := gs.MigOwnerMap["MIG-a"]; ok && tt.owner == "train" {
+				t.Errorf("RestoreOwner() mig instance of %s is kept", tt.owner)
+			}
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name    string
+		held    map[string]string
+		mig     map[string]string
+		want    []string
+		wantMig map[string]string
+	}{
+		{
+			name:    "whole gpus",
+			held:    map[string]string{"gpu-0": "foo", "gpu-1": "other"},
+			want:    []string{"gpu-0"},
+			wantMig: map[string]string{},
+		},
+		{
+			name:    "mig instances",
+			mig:     map[string]string{"MIG-a": "foo", "MIG-b": "other"},
+			want:    []string{"MIG-a"},
+			wantMig: map[string]string{"MIG-a": "bar", "MIG-b": "other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1")
+			for uuid, owner := range tt.held {
+				gs.hold(owner, uuid)
+			}
+			for uuid, owner := range tt.mig {
+				gs.MigOwnerMap[uuid] = owner
+			}
+			if got := gs.Transfer("foo", "bar"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Transfer() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gs.MigOwnerMap, tt.wantMig) {
+				t.Errorf("Transfer() mig owners = %v, want %v", gs.MigOwnerMap, tt.wantMig)
+			}
+			for uuid, owner := range gs.GpuOwnerMap {
+				if owner == "foo" {
+					t.Errorf("Transfer() gpu: %s is still held by foo", uuid)
+				}
+			}
+		})
+	}
+}
+
+// TestRestoreExcept rolls back between the modes, the gpus held in the other modes are released
+func TestRestoreExcept(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      map[string]string
+		slots     map[string]map[string]int
+		shared    []string
+		mode      GpuMode
+		want      []string
+		wantOwned map[string]string
+	}{
+		{
+			name:      "shared to whole",
+			held:      map[string]string{"gpu-1": "train"},
+			shared:    []string{"gpu-0"},
+			mode:      GpuModeWhole,
+			want:      []string{"gpu-0"},
+			wantOwned: map[string]string{"gpu-1": "train"},
+		},
+		{
+			name:      "whole to shared",
+			held:      map[string]string{"gpu-1": "train", "gpu-2": "infer"},
+			shared:    []string{"gpu-0"},
+			mode:      GpuModeShared,
+			want:      []string{"gpu-1"},
+			wantOwned: map[string]string{"gpu-2": "infer"},
+		},
+		{
+			name:      "fraction to whole",
+			held:      map[string]string{"gpu-1": "train"},
+			slots:     map[string]map[string]int{"gpu-0": {"train": 1}},
+			mode:      GpuModeWhole,
+			want:      []string{"gpu-0"},
+			wantOwned: map[string]string{"gpu-1": "train"},
+		},
+		{
+			name:      "same mode",
+			held:      map[string]string{"gpu-1": "train"},
+			mode:      GpuModeWhole,
+			want:      nil,
+			wantOwned: map[string]string{"gpu-1": "train"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(2, "gpu-0", "gpu-1", "gpu-2")
+			for uuid, owner := range tt.held {
+				gs.hold(owner, uuid)
+			}
+			for uuid, slots := range tt.slots {
+				gs.GpuSlotMap[uuid] = slots
+				gs.GpuStatusMap[uuid] = 1
+			}
+			for _, uuid := range tt.shared {
+				gs.GpuShareMap[uuid] = &SharedGpu{Owners: map[string]struct{}{"train": {}}}
+				gs.GpuStatusMap[uuid] = 1
+			}
+			if got := gs.RestoreExcept("train", tt.mode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RestoreExcept() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gs.GpuOwnerMap, tt.wantOwned) {
+				t.Errorf("RestoreExcept() owners = %v, want %v", gs.GpuOwnerMap, tt.wantOwned)
+			}
+			for _, uuid := range tt.want {
+				if gs.GpuStatusMap[uuid] != 0 {
+					t.Errorf("RestoreExcept() gpu: %s is not free", uuid)
+				}
+			}
+		})
+	}
+}
+
+func TestWhatIf(t *testing.T) {
+	tests := []struct {
+		name            string
+		setup           func(gs *gpuScheduler)
+		req             WhatIfRequest
+		wantSchedulable bool
+		wantGpus        []string
+		wantEligible    []string
+	}{
+		{
+			name:            "whole",
+			setup:           func(gs *gpuScheduler) { gs.hold("other", "gpu-0") },
+			req:             WhatIfRequest{Owner: "train", GpuCount: 1},
+			wantSchedulable: true,
+			wantGpus:        []string{"gpu-1"},
+			wantEligible:    []string{"gpu-1", "gpu-2"},
+		},
+		{
+			name:         "whole not enough",
+			setup:        func(gs *gpuScheduler) { gs.hold("other", "gpu-0", "gpu-1") },
+			req:          WhatIfRequest{Owner: "train", GpuCount: 2},
+			wantEligible: []string{"gpu-2"},
+		},
+		{
+			name:            "requested uuid",
+			req:             WhatIfRequest{Owner: "train", GpuCount: 1, UUIDs: []string{"gpu-2"}},
+			wantSchedulable: true,
+			wantGpus:        []string{"gpu-2"},
+			wantEligible:    []string{"gpu-0", "gpu-1", "gpu-2"},
+		},
+		{
+			name:         "requested uuid is busy",
+			setup:        func(gs *gpuScheduler) { gs.hold("other", "gpu-2") },
+			req:          WhatIfRequest{Owner: "train", GpuCount: 1, UUIDs: []string{"gpu-2"}},
+			wantEligible: []string{"gpu-0", "gpu-1"},
+		},
+		{
+			name:            "constraints",
+			req:             WhatIfRequest{Owner: "train", GpuCount: 1, Constraints: &models.GpuConstraints{Exclude: []int{0}}},
+			wantSchedulable: true,
+			wantGpus:        []string{"gpu-1"},
+			wantEligible:    []string{"gpu-1", "gpu-2"},
+		},
+		{
+			name: "fraction prefers the shared gpu",
+			setup: func(gs *gpuScheduler) {
+				gs.GpuSlotMap["gpu-1"] = map[string]int{"other": 1}
+				gs.GpuStatusMap["gpu-1"] = 1
+			},
+			req:             WhatIfRequest{Owner: "train", Slots: 1},
+			wantSchedulable: true,
+			wantGpus:        []string{"gpu-1"},
+			wantEligible:    []string{"gpu-0", "gpu-1", "gpu-2"},
+		},
+		{
+			name: "fraction conflicts with the label",
+			setup: func(gs *gpuScheduler) {
+				gs.hold("other", "gpu-0", "gpu-2")
+				gs.GpuSlotMap["gpu-1"] = map[string]int{"other": 1}
+				gs.GpuStatusMap["gpu-1"] = 1
+				gs.LabelMap["other"] = []string{"inference"}
+				gs.conflicts = map[string]map[string]struct{}{
+					"training":  {"inference": {}},
+					"inference": {"training": {}},
+				}
+			},
+			req: WhatIfRequest{Owner: "train", Slots: 1, Labels: []string{"training"}},
+		},
+		{
+			name: "fraction already held",
+			setup: func(gs *gpuScheduler) {
+				gs.GpuSlotMap["gpu-2"] = map[string]int{"train": 1}
+				gs.GpuStatusMap["gpu-2"] = 1
+			},
+			req:             WhatIfRequest{Owner: "train", Slots: 1},
+			wantSchedulable: true,
+			wantGpus:        []string{"gpu-2"},
+			wantEligible:    []string{"gpu-0", "gpu-1", "gpu-2"},
+		},
+		{
+			name: "shared prefers the shared gpu",
+			setup: func(gs *gpuScheduler) {
+				gs.GpuShareMap["gpu-2"] = &SharedGpu{Owners: map[string]struct{}{"other": {}}}
+				gs.GpuStatusMap["gpu-2"] = 1
+			},
+			req:             WhatIfRequest{Owner: "train", GpuCount: 1, Shared: true},
+			wantSchedulable: true,
+			wantGpus:        []string{"gpu-2"},
+			wantEligible:    []string{"gpu-0", "gpu-1", "gpu-2"},
+		},
+		{
+			name: "shared cap is reached",
+			setup: func(gs *gpuScheduler) {
+				gs.hold("other", "gpu-0", "gpu-1")
+				gs.GpuShareMap["gpu-2"] = &SharedGpu{MaxSharers: 1, Owners: map[string]struct{}{"other": {}}}
+				gs.GpuStatusMap["gpu-2"] = 1
+			},
+			req: WhatIfRequest{Owner: "train", GpuCount: 1, Shared: true},
+		},
+		{
+			name: "mig",
+			setup: func(gs *gpuScheduler) {
+				gs.migDevices = []models.MigDevice{
+					{UUID: "MIG-0", Profile: "1g.5gb", GpuUUID: "gpu-0"},
+					{UUID: "MIG-1", Profile: "1g.5gb", GpuUUID: "gpu-0"},
+					{UUID: "MIG-2", Profile: "3g.20gb", GpuUUID: "gpu-0"},
+				}
+				gs.MigOwnerMap["MIG-0"] = "other"
+			},
+			req:             WhatIfRequest{Owner: "train", MigProfile: "1g.5gb", MigCount: 1},
+			wantSchedulable: true,
+			wantGpus:        []string{"MIG-1"},
+			wantEligible:    []string{"MIG-1"},
+		},
+		{
+			name: "mig not enough",
+			setup: func(gs *gpuScheduler) {
+				gs.migDevices = []models.MigDevice{{UUID: "MIG-0", Profile: "1g.5gb", GpuUUID: "gpu-0"}}
+			},
+			req:          WhatIfRequest{Owner: "train", MigProfile: "1g.5gb", MigCount: 2},
+			wantEligible: []string{"MIG-0"},
+		},
+	}
+	defer func(allowed func(*models.GpuConstraints) (map[string]struct{}, error)) {
+		allowedGpus = allowed
+	}(allowedGpus)
+	// the gpu of index i is gpu-i
+	allowedGpus = func(constraints *models.GpuConstraints) (map[string]struct{}, error) {
+		if constraints == nil {
+			return nil, nil
+		}
+		allowed := make(map[string]struct{})
+		for i := 0; i < 3; i++ {
+			if !constraints.Excludes(i) {
+				allowed[fmt.Sprintf("gpu-%d", i)] = struct{}{}
+			}
+		}
+		return allowed, nil
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(2, "gpu-0", "gpu-1", "gpu-2")
+			if tt.setup != nil {
+				tt.setup(gs)
+			}
+			before := gs.serialize()
+			result := gs.WhatIf(&tt.req)
+			if result.Schedulable != tt.wantSchedulable {
+				t.Fatalf("WhatIf() schedulable = %v, want %v, rationale: %s", result.Schedulable, tt.wantSchedulable, result.Rationale)
+			}
+			if tt.wantSchedulable && !reflect.DeepEqual(result.Gpus, tt.wantGpus) {
+				t.Errorf("WhatIf() gpus = %v, want %v", result.Gpus, tt.wantGpus)
+			}
+			eligible := make([]string, 0)
+			for _, candidate := range result.Candidates {
+				if candidate.Eligible {
+					eligible = append(eligible, candidate.UUID)
+				}
+			}
+			if want := append([]string{}, tt.wantEligible...); !reflect.DeepEqual(eligible, want) {
+				t.Errorf("WhatIf() eligible = %v, want %v, candidates: %+v", eligible, want, result.Candidates)
+			}
+			if len(result.Rationale) == 0 {
+				t.Error("WhatIf() rationale is empty")
+			}
+			if after := gs.serialize(); *after != *before {
+				t.Errorf("WhatIf() changed the scheduler, before: %s, after: %s", *before, *after)
+			}
+		})
+	}
+}
+
+func TestOccupy(t *testing.T) {
+	tests := []struct {
+		name       string
+		held       map[string]string
+		unhealthy  []string
+		gpus       []string
+		wantOwners map[string]string
+		wantErr    func(error) bool
+	}{
+		{
+			name:       "free",
+			gpus:       []string{"gpu-0", "gpu-1"},
+			wantOwners: map[string]string{"gpu-0": "train", "gpu-1": "train"},
+		},
+		{
+			name:       "held by the replicaSet",
+			held:       map[string]string{"gpu-0": "train"},
+			gpus:       []string{"gpu-0", "gpu-1"},
+			wantOwners: map[string]string{"gpu-0": "train", "gpu-1": "train"},
+		},
+		{
+			name:       "held by another replicaSet",
+			held:       map[string]string{"gpu-1": "other"},
+			gpus:       []string{"gpu-0", "gpu-1"},
+			wantOwners: map[string]string{"gpu-1": "other"},
+			wantErr:    xerrors.IsGpuBusyError,
+		},
+		{
+			name:       "held by a reservation",
+			held:       map[string]string{"gpu-0": "reservation:abc"},
+			gpus:       []string{"gpu-0"},
+			wantOwners: map[string]string{"gpu-0": "reservation:abc"},
+			wantErr:    xerrors.IsGpuBusyError,
+		},
+		{
+			name:       "not found",
+			gpus:       []string{"gpu-0", "gpu-9"},
+			wantOwners: map[string]string{},
+			wantErr:    xerrors.IsGpuNotFoundError,
+		},
+		{
+			name:       "unhealthy",
+			unhealthy:  []string{"gpu-1"},
+			gpus:       []string{"gpu-1"},
+			wantOwners: map[string]string{},
+			wantErr:    xerrors.IsGpuUnhealthyError,
+		},
+		{
+			name:       "returned twice",
+			gpus:       []string{"gpu-0", "gpu-0"},
+			wantOwners: map[string]string{},
+			wantErr:    func(err error) bool { return err != nil },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1")
+			for uuid, owner := range tt.held {
+				gs.hold(owner, uuid)
+			}
+			for _, uuid := range tt.unhealthy {
+				gs.unhealthy[uuid] = "ecc errors"
+			}
+			err := gs.Occupy("train", tt.gpus)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Occupy(%v) error = %v", tt.gpus, err)
+			}
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Fatalf("Occupy(%v) error = %v, want another error", tt.gpus, err)
+			}
+			if !reflect.DeepEqual(gs.GpuOwnerMap, tt.wantOwners) {
+				t.Errorf("Occupy(%v) owners = %v, want %v", tt.gpus, gs.GpuOwnerMap, tt.wantOwners)
+			}
+		})
+	}
+}
+
+func TestCheckApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		gpus    []string
+		uuids   []string
+		num     int
+		wantErr func(error) bool
+	}{
+		{name: "enough", gpus: []string{"gpu-0", "gpu-1"}, num: 2},
+		{name: "no gpu on the host", num: 1, wantErr: xerrors.IsGpuCountExceededError},
+		{name: "more than the host", gpus: []string{"gpu-0"}, num: 2, wantErr: xerrors.IsGpuCountExceededError},
+		{name: "zero", gpus: []string{"gpu-0"}, wantErr: func(err error) bool { return err != nil }},
+		{name: "more uuids than num", gpus: []string{"gpu-0", "gpu-1"}, uuids: []string{"gpu-0", "gpu-1"}, num: 1,
+			wantErr: func(err error) bool { return err != nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, tt.gpus...)
+			err := gs.checkApply(tt.uuids, tt.num)
+			if xerrors.IsNvidiaRuntimeMissingError(err) {
+				t.Fatalf("checkApply() error = %v, the nvidia runtime is not told by the scheduler", err)
+			}
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("checkApply() error = %v", err)
+			}
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Errorf("checkApply() error = %v, want another error", err)
+			}
+		})
+	}
+}
+
+// slotApply is an apply of slots, 0 slots means a whole gpu
+type slotApply struct {
+	owner string
+	slots int
+}
+
+// TestApplySlots mixes the whole and fractional requests on a host of 2 gpus with 2 slots each
+func TestApplySlots(t *testing.T) {
+	tests := []struct {
+		name      string
+		applies   []slotApply
+		wantGpus  []string
+		wantSlots map[string]int
+	}{
+		{
+			name:      "a whole gpu and two halves",
+			applies:   []slotApply{{"whole", 0}, {"half-a", 1}, {"half-b", 1}},
+			wantGpus:  []string{"gpu-0", "gpu-1", "gpu-1"},
+			wantSlots: map[string]int{"gpu-0": 2, "gpu-1": 2},
+		},
+		{
+			name:      "the halves first",
+			applies:   []slotApply{{"half-a", 1}, {"half-b", 1}, {"whole", 0}},
+			wantGpus:  []string{"gpu-0", "gpu-0", "gpu-1"},
+			wantSlots: map[string]int{"gpu-0": 2, "gpu-1": 2},
+		},
+		{
+			name:      "no slot is left for a half",
+			applies:   []slotApply{{"whole-a", 0}, {"whole-b", 0}, {"half", 1}},
+			wantGpus:  []string{"gpu-0", "gpu-1", ""},
+			wantSlots: map[string]int{"gpu-0": 2, "gpu-1": 2},
+		},
+		{
+			name:      "no whole gpu is left after the halves on both gpus",
+			applies:   []slotApply{{"half-a", 1}, {"whole-a", 0}, {"half-b", 1}, {"whole-b", 0}},
+			wantGpus:  []string{"gpu-0", "gpu-1", "gpu-0", ""},
+			wantSlots: map[string]int{"gpu-0": 2, "gpu-1": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(2, "gpu-0", "gpu-1")
+			for i, apply := range tt.applies {
+				var (
+					got []string
+					err error
+				)
+				if apply.slots == 0 {
+					got, err = gs.Apply(apply.owner, 1)
+				} else {
+					var uuid string
+					uuid, err = gs.ApplyFraction(apply.owner, apply.slots)
+					got = []string{uuid}
+				}
+				if len(tt.wantGpus[i]) == 0 {
+					if !xerrors.IsGpuNotEnoughError(err) {
+						t.Fatalf("apply %+v = %v, %v, want gpu not enough", apply, got, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("apply %+v error = %v", apply, err)
+				}
+				if !reflect.DeepEqual(got, []string{tt.wantGpus[i]}) {
+					t.Errorf("apply %+v = %v, want %s", apply, got, tt.wantGpus[i])
+				}
+			}
+			if got := gs.GetGpuSlots(); !reflect.DeepEqual(got, tt.wantSlots) {
+				t.Errorf("GetGpuSlots() = %v, want %v", got, tt.wantSlots)
+			}
+		})
+	}
+}
+
+// TestApplyFractionAgain applies other slots for the replicaSet holding some, the slots held are kept if nothing fits
+func TestApplyFractionAgain(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      map[string]map[string]int
+		whole     []string
+		slots     int
+		want      string
+		wantErr   bool
+		wantSlots map[string]map[string]int
+	}{
+		{
+			name:      "the same slots",
+			held:      map[string]map[string]int{"gpu-1": {"train": 2}},
+			slots:     2,
+			want:      "gpu-1",
+			wantSlots: map[string]map[string]int{"gpu-1": {"train": 2}},
+		},
+		{
+			name:      "more slots on the gpu held only by the replicaSet",
+			held:      map[string]map[string]int{"gpu-0": {"train": 1}},
+			whole:     []string{"gpu-1"},
+			slots:     3,
+			want:      "gpu-0",
+			wantSlots: map[string]map[string]int{"gpu-0": {"train": 3}},
+		},
+		{
+			name:      "more slots on another gpu",
+			held:      map[string]map[string]int{"gpu-0": {"train": 1, "other": 2}},
+			slots:     3,
+			want:      "gpu-1",
+			wantSlots: map[string]map[string]int{"gpu-0": {"other": 2}, "gpu-1": {"train": 3}},
+		},
+		{
+			name:      "nothing fits",
+			held:      map[string]map[string]int{"gpu-0": {"train": 1, "other": 2}},
+			whole:     []string{"gpu-1"},
+			slots:     3,
+			wantErr:   true,
+			wantSlots: map[string]map[string]int{"gpu-0": {"train": 1, "other": 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(4, "gpu-0", "gpu-1")
+			for uuid, owners := range tt.held {
+				gs.GpuSlotMap[uuid] = owners
+				gs.GpuStatusMap[uuid] = 1
+			}
+			gs.hold("whole", tt.whole...)
+
+			got, err := gs.ApplyFraction("train", tt.slots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyFraction() = %s, %v, wantErr %v", got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ApplyFraction() = %s, want %s", got, tt.want)
+			}
+			if !reflect.DeepEqual(gs.GpuSlotMap, tt.wantSlots) {
+				t.Errorf("ApplyFraction() slots = %v, want %v", gs.GpuSlotMap, tt.wantSlots)
+			}
+			for uuid := range tt.wantSlots {
+				if gs.GpuStatusMap[uuid] == 0 {
+					t.Errorf("ApplyFraction() gpu: %s is free, it's held by the slots", uuid)
+				}
+			}
+		})
+	}
+}
+
+// TestApplyMigLabels applies a mig instance for a replicaSet labeled inference, inference conflicts with batch
+func TestApplyMigLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      map[string]string
+		labels    map[string][]string
+		want      []string
+		wantError func(error) bool
+	}{
+		{name: "no instance held", want: []string{"MIG-0"}},
+		{
+			name:   "the gpu is shared with a replicaSet of no conflict",
+			held:   map[string]string{"MIG-0": "web"},
+			labels: map[string][]string{"web": {"inference"}},
+			want:   []string{"MIG-1"},
+		},
+		{
+			name:   "the gpu is shared with a batch replicaSet",
+			held:   map[string]string{"MIG-0": "batch-job"},
+			labels: map[string][]string{"batch-job": {"batch"}},
+			want:   []string{"MIG-2"},
+		},
+		{
+			name:      "both gpus are shared with batch replicaSets",
+			held:      map[string]string{"MIG-0": "batch-job", "MIG-2": "batch-job2"},
+			labels:    map[string][]string{"batch-job": {"batch"}, "batch-job2": {"batch"}},
+			wantError: xerrors.IsGpuConflictError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1")
+			gs.hold(migOwner, "gpu-0", "gpu-1")
+			gs.migDevices = []models.MigDevice{
+				{UUID: "MIG-0", Profile: "1g.5gb", GpuUUID: "gpu-0"},
+				{UUID: "MIG-1", Profile: "1g.5gb", GpuUUID: "gpu-0"},
+				{UUID: "MIG-2", Profile: "1g.5gb", GpuUUID: "gpu-1"},
+			}
+			if err := gs.SetGpuConflicts([]string{"inference:batch"}); err != nil {
+				t.Fatal(err)
+			}
+			for uuid, owner := range tt.held {
+				gs.MigOwnerMap[uuid] = owner
+			}
+			for owner, labels := range tt.labels {
+				gs.SetLabels(owner, labels)
+			}
+			gs.SetLabels("serve", []string{"inference"})
+
+			plan, planErr := gs.PlanMig("serve", "1g.5gb", 1, []string{"inference"})
+			got, err := gs.ApplyMig("serve", "1g.5gb", 1)
+			if tt.wantError != nil {
+				if !tt.wantError(err) || !tt.wantError(planErr) {
+					t.Fatalf("ApplyMig() = %v, %v, PlanMig() error = %v, want a conflict", got, err, planErr)
+				}
+				return
+			}
+			if err != nil || planErr != nil {
+				t.Fatalf("ApplyMig() error = %v, PlanMig() error = %v", err, planErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(plan, tt.want) {
+				t.Errorf("ApplyMig() = %v, PlanMig() = %v, want %v", got, plan, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyUUIDs requests gpus by uuid on a host of 3 gpus, gpu-2 is held by bar
+func TestApplyUUIDs(t *testing.T) {
+	isErr := func(err error) bool { return err != nil }
+	tests := []struct {
+		name    string
+		uuids   []string
+		num     int
+		allowed map[string]struct{}
+		want    []string
+		wantErr func(error) bool
+	}{
+		{name: "by count", num: 2, want: []string{"gpu-0", "gpu-1"}},
+		{name: "by uuid", uuids: []string{"gpu-1"}, num: 1, want: []string{"gpu-1"}},
+		{name: "mixed", uuids: []string{"gpu-1"}, num: 2, want: []string{"gpu-1", "gpu-0"}},
+		{name: "absent", uuids: []string{"gpu-9"}, num: 1, wantErr: xerrors.IsGpuNotFoundError},
+		{name: "busy", uuids: []string{"gpu-2"}, num: 1, wantErr: xerrors.IsGpuBusyError},
+		{name: "one of them busy", uuids: []string{"gpu-0", "gpu-2"}, num: 2, wantErr: xerrors.IsGpuBusyError},
+		{name: "duplicated", uuids: []string{"gpu-0", "gpu-0"}, num: 2, wantErr: isErr},
+		{name: "more uuids than num", uuids: []string{"gpu-0", "gpu-1"}, num: 1, wantErr: isErr},
+		{name: "the rest is not enough", uuids: []string{"gpu-0"}, num: 3, wantErr: xerrors.IsGpuNotEnoughError},
+		{name: "excluded", uuids: []string{"gpu-1"}, num: 1, allowed: map[string]struct{}{"gpu-0": {}},
+			wantErr: xerrors.IsGpuConstraintUnsatisfiableError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1", "gpu-2")
+			gs.hold("bar", "gpu-2")
+			got, err := gs.applyUUIDs("foo", tt.uuids, tt.num, tt.allowed)
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("applyUUIDs(%v, %d) = %v, %v, want another error", tt.uuids, tt.num, got, err)
+				}
+				if owners := gs.OwnedBy("foo"); len(owners) != 0 {
+					t.Errorf("gpus held by foo after the failed apply = %v, want none", owners)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyUUIDs(%v, %d) error = %v", tt.uuids, tt.num, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applyUUIDs(%v, %d) = %v, want %v", tt.uuids, tt.num, got, tt.want)
+			}
+		})
+	}
+}
+
+// patchStep patches the gpu count of the replicaSet whose old version uses the gpus in old, the way
+// services.patchGpu does: the gpus still held are kept, the rest is applied or restored
+type patchStep struct {
+	owner   string
+	old     []string
+	count   int
+	wantErr bool
+}
+
+// TestInterleavedPatches patches two replicaSets on a host of 4 gpus, foo holds gpu-0 and gpu-1 and bar holds
+// gpu-2 and gpu-3, the old and new versions of a replicaSet must not count the same gpus twice
+func TestInterleavedPatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []patchStep
+		wantOwned map[string]int
+	}{
+		{
+			name:      "down then up",
+			steps:     []patchStep{{owner: "foo", old: []string{"gpu-0", "gpu-1"}, count: 1}, {owner: "bar", old: []string{"gpu-2", "gpu-3"}, count: 3}},
+			wantOwned: map[string]int{"foo": 1, "bar": 3},
+		},
+		{
+			name: "up waits for the down",
+			steps: []patchStep{
+				{owner: "bar", old: []string{"gpu-2", "gpu-3"}, count: 3, wantErr: true},
+				{owner: "foo", old: []string{"gpu-0", "gpu-1"}, count: 1},
+				{owner: "bar", old: []string{"gpu-2", "gpu-3"}, count: 3},
+			},
+			wantOwned: map[string]int{"foo": 1, "bar": 3},
+		},
+		{
+			name: "same count again",
+			steps: []patchStep{
+				{owner: "foo", old: []string{"gpu-0", "gpu-1"}, count: 2},
+				{owner: "bar", old: []string{"gpu-2", "gpu-3"}, count: 2},
+				{owner: "foo", old: []string{"gpu-0", "gpu-1"}, count: 2},
+			},
+			wantOwned: map[string]int{"foo": 2, "bar": 2},
+		},
+		{
+			name: "old version of a rollback lists the gpus of another replicaSet",
+			steps: []patchStep{
+				{owner: "foo", old: []string{"gpu-0", "gpu-1"}, count: 1},
+				{owner: "foo", old: []string{"gpu-1", "gpu-2"}, count: 2},
+			},
+			wantOwned: map[string]int{"foo": 2, "bar": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1", "gpu-2", "gpu-3")
+			gs.hold("foo", "gpu-0", "gpu-1")
+			gs.hold("bar", "gpu-2", "gpu-3")
+			for _, step := range tt.steps {
+				held := gs.HeldBy(step.owner, step.old)
+				var err error
+				if step.count > len(held) {
+					_, err = gs.Apply(step.owner, step.count-len(held))
+				} else {
+					gs.Restore(held[:len(held)-step.count])
+				}
+				if (err != nil) != step.wantErr {
+					t.Fatalf("patch %+v error = %v, wantErr %v", step, err, step.wantErr)
+				}
+				if err != nil && !xerrors.IsGpuNotEnoughError(err) {
+					t.Errorf("patch %+v error = %v, want gpu not enough", step, err)
+				}
+			}
+			for owner, want := range tt.wantOwned {
+				if got := gs.OwnedBy(owner); len(got) != want {
+					t.Errorf("OwnedBy(%s) = %v, want %d gpus", owner, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestApplyCount applies the gpus by count on a host of 4 gpus, bar holds gpu-3 if held is set
+func TestApplyCount(t *testing.T) {
+	isErr := func(err error) bool { return err != nil }
+	tests := []struct {
+		name    string
+		num     int
+		held    bool
+		want    []string
+		wantErr func(error) bool
+	}{
+		{name: "0", num: 0, wantErr: isErr},
+		{name: "1", num: 1, want: []string{"gpu-0"}},
+		{name: "2", num: 2, want: []string{"gpu-0", "gpu-1"}},
+		{name: "4", num: 4, want: []string{"gpu-0", "gpu-1", "gpu-2", "gpu-3"}},
+		{name: "more than the host", num: 5, wantErr: xerrors.IsGpuCountExceededError},
+		{name: "3 of the free gpus", num: 3, held: true, want: []string{"gpu-0", "gpu-1", "gpu-2"}},
+		{name: "oversubscribed", num: 4, held: true, wantErr: xerrors.IsGpuNotEnoughError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1", "gpu-2", "gpu-3")
+			if tt.held {
+				gs.hold("bar", "gpu-3")
+			}
+			got, err := gs.Apply("foo", tt.num)
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("Apply(%d) = %v, %v, want another error", tt.num, got, err)
+				}
+				if owned := gs.OwnedBy("foo"); len(owned) != 0 {
+					t.Errorf("OwnedBy(foo) after the failed apply = %v, want none", owned)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply(%d) error = %v", tt.num, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply(%d) = %v, want %v", tt.num, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeNvidiaSmi puts a nvidia-smi shim on the PATH, it prints the output and exits with the code
+func fakeNvidiaSmi(t *testing.T, output string, code int) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the nvidia-smi shim is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "output"), []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeNvidiaSmiScript(t, dir, fmt.Sprintf("cat '%s'\nexit %d", filepath.Join(dir, "output"), code))
+}
+
+// fakeNvidiaSmiScript puts a nvidia-smi shim on the PATH, it is written into dir and runs the body of the shell script
+func fakeNvidiaSmiScript(t *testing.T, dir, body string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "nvidia-smi"), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the commands run without the environment of the process, so the shim is found by the PATH of the command
+	create := newCommand
+	t.Cleanup(func() { newCommand = create })
+	newCommand = func(command string, options ...func(*cmd.Command)) *cmd.Command {
+		path := cmd.EnvVars{"PATH": dir + string(os.PathListSeparator) + os.Getenv("PATH")}
+		return cmd.NewCommand(command, append(options, cmd.WithEnvironmentVariables(path))...)
+	}
+}
+
+func TestQueryGpuDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		code    int
+		want    []models.GpuDevice
+		wantErr bool
+	}{
+		{
+			name: "ordered by index",
+			output: "1, GPU-b, 81920, 40960, 75\n" +
+				"0, GPU-a, 81920, 0, 0\n",
+			want: []models.GpuDevice{
+				{Index: 0, UUID: "GPU-a", MemoryTotal: 81920},
+				{Index: 1, UUID: "GPU-b", MemoryTotal: 81920, MemoryUsed: 40960, UtilizationPercent: 75},
+			},
+		},
+		{
+			name: "lost gpu",
+			output: "0, GPU-a, 24576, 1024, 3\n" +
+				"1, GPU-b, [Unknown Error], [Unknown Error], [Unknown Error]\n",
+			code: 15,
+			want: []models.GpuDevice{
+				{Index: 0, UUID: "GPU-a", MemoryTotal: 24576, MemoryUsed: 1024, UtilizationPercent: 3},
+				{Index: 1, UUID: "GPU-b"},
+			},
+		},
+		{
+			name:   "no gpus",
+			output: "",
+			want:   []models.GpuDevice{},
+		},
+		{
+			name:    "no driver",
+			output:  "NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver.\n",
+			code:    9,
+			wantErr: true,
+		},
+		{
+			name:    "invalid index",
+			output:  "x, GPU-a, 24576, 0, 0\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeNvidiaSmi(t, tt.output, tt.code)
+			devices, err := QueryGpuDevices()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("QueryGpuDevices() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]models.GpuDevice, 0, len(devices))
+			for _, device := range devices {
+				if device.Containers == nil {
+					t.Errorf("QueryGpuDevices() containers of %s = nil, want empty", device.UUID)
+				}
+				device.Containers = nil
+				got = append(got, *device)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryGpuDevices() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeTopology fakes nvidia-smi with 4 healthy gpus, gpu-0 and gpu-1 are on NUMA node 0, gpu-2 and gpu-3 on node 1
+func fakeTopology(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the nvidia-smi shim is a shell script")
+	}
+	fakeNvidiaSmiScript(t, t.TempDir(), `case "$*" in
+*pci.bus_id*) printf '0, gpu-0, 00000000:36:00.0\n1, gpu-1, 00000000:37:00.0\n2, gpu-2, 00000000:B6:00.0\n3, gpu-3, 00000000:B7:00.0\n' ;;
+*) printf 'gpu-0, 0, No\ngpu-1, 0, No\ngpu-2, 0, No\ngpu-3, 0, No\n' ;;
+esac`)
+	dir := t.TempDir()
+	for id, node := range map[string]string{"0000:36:00.0": "0", "0000:37:00.0": "0", "0000:b6:00.0": "1", "0000:b7:00.0": "1"} {
+		if err := os.MkdirAll(filepath.Join(dir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id, "numa_node"), []byte(node+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := pciDevicesDir
+	t.Cleanup(func() { pciDevicesDir = old })
+	pciDevicesDir = dir
+}
+
+func TestAllowedGpus(t *testing.T) {
+	node := func(n int) *int { return &n }
+	tests := []struct {
+		name        string
+		constraints *models.GpuConstraints
+		want        []string
+	}{
+		{name: "no constraints", constraints: &models.GpuConstraints{}},
+		{name: "exclude", constraints: &models.GpuConstraints{Exclude: []int{0, 2}}, want: []string{"gpu-1", "gpu-3"}},
+		{name: "exclude not on the host", constraints: &models.GpuConstraints{Exclude: []int{7}},
+			want: []string{"gpu-0", "gpu-1", "gpu-2", "gpu-3"}},
+		{name: "numa node", constraints: &models.GpuConstraints{NumaNode: node(1)}, want: []string{"gpu-2", "gpu-3"}},
+		{name: "exclude on the numa node", constraints: &models.GpuConstraints{Exclude: []int{2}, NumaNode: node(1)},
+			want: []string{"gpu-3"}},
+		{name: "numa node without gpus", constraints: &models.GpuConstraints{NumaNode: node(2)}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeTopology(t)
+			allowed, err := AllowedGpus(tt.constraints)
+			if err != nil {
+				t.Fatalf("AllowedGpus(%+v) error = %v", tt.constraints, err)
+			}
+			if tt.want == nil {
+				if allowed != nil {
+					t.Errorf("AllowedGpus(%+v) = %v, want all gpus allowed", tt.constraints, allowed)
+				}
+				return
+			}
+			got := make([]string, 0, len(allowed))
+			for uuid := range allowed {
+				got = append(got, uuid)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllowedGpus(%+v) = %v, want %v", tt.constraints, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumaNode(t *testing.T) {
+	fakeTopology(t)
+	tests := []struct {
+		busID string
+		want  int
+	}{
+		{busID: "00000000:36:00.0", want: 0},
+		{busID: "00000000:B7:00.0", want: 1},
+		{busID: "0000:b6:00.0", want: 1},
+		{busID: "00000000:01:00.0", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.busID, func(t *testing.T) {
+			if got := numaNode(tt.busID); got != tt.want {
+				t.Errorf("numaNode(%q) = %d, want %d", tt.busID, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyConstrained applies on the host of fakeTopology, gpu-3 is held by bar
+func TestApplyConstrained(t *testing.T) {
+	node := func(n int) *int { return &n }
+	tests := []struct {
+		name        string
+		uuids       []string
+		num         int
+		constraints *models.GpuConstraints
+		want        []string
+		wantErr     func(error) bool
+	}{
+		{name: "exclude", num: 2, constraints: &models.GpuConstraints{Exclude: []int{0}}, want: []string{"gpu-1", "gpu-2"}},
+		{name: "numa node", num: 2, constraints: &models.GpuConstraints{NumaNode: node(0)}, want: []string{"gpu-0", "gpu-1"}},
+		{name: "requested uuid on the numa node", uuids: []string{"gpu-2"}, num: 1,
+			constraints: &models.GpuConstraints{NumaNode: node(1)}, want: []string{"gpu-2"}},
+		{name: "requested uuid excluded", uuids: []string{"gpu-0"}, num: 1,
+			constraints: &models.GpuConstraints{Exclude: []int{0}}, wantErr: xerrors.IsGpuConstraintUnsatisfiableError},
+		{name: "requested uuid off the numa node", uuids: []string{"gpu-0"}, num: 1,
+			constraints: &models.GpuConstraints{NumaNode: node(1)}, wantErr: xerrors.IsGpuConstraintUnsatisfiableError},
+		{name: "excluded too many", num: 2, constraints: &models.GpuConstraints{Exclude: []int{0, 1}},
+			wantErr: xerrors.IsGpuConstraintUnsatisfiableError},
+		{name: "numa node busy", num: 2, constraints: &models.GpuConstraints{NumaNode: node(1)},
+			wantErr: xerrors.IsGpuConstraintUnsatisfiableError},
+		{name: "numa node without gpus", num: 1, constraints: &models.GpuConstraints{NumaNode: node(2)},
+			wantErr: xerrors.IsGpuConstraintUnsatisfiableError},
+		{name: "not enough without constraints", num: 4, wantErr: xerrors.IsGpuNotEnoughError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeTopology(t)
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1", "gpu-2", "gpu-3")
+			gs.hold("bar", "gpu-3")
+			got, err := gs.ApplyConstrained("foo", tt.uuids, tt.num, tt.constraints)
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("ApplyConstrained(%v, %d, %+v) = %v, %v, want another error", tt.uuids, tt.num, tt.constraints, got, err)
+				}
+				if owners := gs.OwnedBy("foo"); len(owners) != 0 {
+					t.Errorf("gpus held by foo after the failed apply = %v, want none", owners)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyConstrained(%v, %d, %+v) error = %v", tt.uuids, tt.num, tt.constraints, err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ApplyConstrained(%v, %d, %+v) = %v, want %v", tt.uuids, tt.num, tt.constraints, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestGpuExhaustedEvent applies on a host of 3 gpus, gpu-2 is held by bar, only the lack of free gpus is streamed
+func TestGpuExhaustedEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		uuids   []string
+		num     int
+		allowed map[string]struct{}
+		want    map[string]interface{}
+	}{
+		{name: "not enough", num: 3, want: map[string]interface{}{"requested": 3, "free": 2}},
+		{name: "the rest is not enough", uuids: []string{"gpu-0"}, num: 3, want: map[string]interface{}{"requested": 3, "free": 2}},
+		{name: "applied", num: 2},
+		{name: "busy", uuids: []string{"gpu-2"}, num: 1},
+		{name: "excluded", uuids: []string{"gpu-1"}, num: 1, allowed: map[string]struct{}{"gpu-0": {}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1", "gpu-2")
+			gs.hold("bar", "gpu-2")
+			events, cancel := notify.Subscribe([]models.EventType{models.EventGpuExhausted})
+			defer cancel()
+			_, _ = gs.applyUUIDs("foo", tt.uuids, tt.num, tt.allowed)
+
+			var got []models.Event
+			for len(events) > 0 {
+				got = append(got, <-events)
+			}
+			if tt.want == nil {
+				if len(got) != 0 {
+					t.Errorf("applyUUIDs(%v, %d) streamed %+v, want none", tt.uuids, tt.num, got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Name != "foo" || !reflect.DeepEqual(got[0].Data, tt.want) {
+				t.Errorf("applyUUIDs(%v, %d) streamed %+v, want the exhaustion of foo with %v", tt.uuids, tt.num, got, tt.want)
+			}
+		})
+	}
+}
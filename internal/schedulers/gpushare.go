@@ -0,0 +1,223 @@
+package schedulers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// ApplyShared applies for num gpus for the replicaSet in shared mode, the gpus may be assigned to other shared
+// replicaSets too, they are time-sliced by the nvidia device plugin. maxSharers caps the replicaSets on each gpu,
+// 0 means no limit, the smallest cap of the sharers of a gpu is honored. If the replicaSet already shares num gpus,
+// they are returned directly.
+// The shared gpus with the fewest sharers are preferred to the free gpus, so that the whole gpus are kept free.
+// The gpus shared through the MPS daemon are only shared by the MPS clients, the others by the time-sliced sharers.
+func (gs *gpuScheduler) ApplyShared(owner string, num, maxSharers int, mps bool) ([]string, error) {
+	if err := gs.checkApply(nil, num); err != nil {
+		return nil, err
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	if held := gs.sharedBy(owner); len(held) != 0 {
+		if len(held) == num {
+			return held, nil
+		}
+		gs.restoreShared(owner)
+	}
+
+	uuids, err := gs.pickShared(owner, num, maxSharers, mps)
+	if err != nil {
+		if xerrors.IsGpuNotEnoughError(err) {
+			notify.Emit(models.EventGpuExhausted, owner, map[string]interface{}{
+				"requested": num,
+				"shared":    true,
+			})
+		}
+		return nil, err
+	}
+	for _, uuid := range uuids {
+		shared, ok := gs.GpuShareMap[uuid]
+		if !ok {
+			shared = &SharedGpu{Owners: make(map[string]struct{}), Mps: mps}
+			gs.GpuShareMap[uuid] = shared
+		}
+		shared.join(owner, maxSharers)
+		gs.GpuStatusMap[uuid] = 1
+	}
+	return uuids, nil
+}
+
+// PlanShared returns the gpus ApplyShared would assign, nothing is assigned
+func (gs *gpuScheduler) PlanShared(owner string, num, maxSharers int, mps bool) ([]string, error) {
+	if err := gs.checkApply(nil, num); err != nil {
+		return nil, err
+	}
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	return gs.pickShared(owner, num, maxSharers, mps)
+}
+
+// pickShared picks num gpus the replicaSet can share without marking them, the caller must hold the lock.
+// A shared gpu fits if it's shared the same way, through MPS or not, and neither its MaxSharers nor maxSharers
+// is exceeded by one more sharer.
+func (gs *gpuScheduler) pickShared(owner string, num, maxSharers int, mps bool) ([]string, error) {
+	type candidate struct {
+		uuid    string
+		sharers int
+	}
+	var (
+		shared        []candidate
+		free          []string
+		unhealthyGpus []string
+		conflict      string
+	)
+	for uuid, s := range gs.GpuShareMap {
+		if _, ok := gs.unhealthy[uuid]; ok {
+			unhealthyGpus = append(unhealthyGpus, uuid)
+			continue
+		}
+		if _, ok := s.Owners[owner]; ok || s.Mps != mps {
+			continue
+		}
+		n := len(s.Owners) + 1
+		if (s.MaxSharers != 0 && n > s.MaxSharers) || (maxSharers != 0 && n > maxSharers) {
+			continue
+		}
+		if other, label := gs.conflictOn(owner, gs.LabelMap[owner], uuid); len(other) != 0 {
+			conflict = fmt.Sprintf("gpu: %s is shared with replicaSet: %s labeled %s", uuid, other, label)
+			continue
+		}
+		shared = append(shared, candidate{uuid, len(s.Owners)})
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		if shared[i].sharers != shared[j].sharers {
+			return shared[i].sharers < shared[j].sharers
+		}
+		return shared[i].uuid < shared[j].uuid
+	})
+	for uuid, v := range gs.GpuStatusMap {
+		if v != 0 {
+			continue
+		}
+		if _, ok := gs.unhealthy[uuid]; ok {
+			unhealthyGpus = append(unhealthyGpus, uuid)
+			continue
+		}
+		free = append(free, uuid)
+	}
+	sort.Strings(free)
+
+	uuids := make([]string, 0, num)
+	for _, c := range shared {
+		if len(uuids) < num {
+			uuids = append(uuids, c.uuid)
+		}
+	}
+	for _, uuid := range free {
+		if len(uuids) < num {
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	if len(uuids) < num {
+		if len(conflict) != 0 {
+			return nil, errors.Wrap(xerrors.NewGpuConflictError(), conflict)
+		}
+		if len(uuids)+len(unhealthyGpus) >= num {
+			return nil, errors.Wrapf(xerrors.NewGpuUnhealthyError(), "requested: %d, healthy gpus that can be shared: %d, %s",
+				num, len(uuids), gs.unhealthyReasons(unhealthyGpus))
+		}
+		return uuids, xerrors.NewGpuNotEnoughError()
+	}
+	return uuids, nil
+}
+
+// RestoreShared releases the gpus shared by the replicaSet, a gpu is free again when its last sharer is released
+func (gs *gpuScheduler) RestoreShared(owner string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.restoreShared(owner)
+}
+
+func (gs *gpuScheduler) restoreShared(owner string) {
+	for uuid, s := range gs.GpuShareMap {
+		if _, ok := s.Owners[owner]; !ok {
+			continue
+		}
+		s.leave(owner)
+		if len(s.Owners) == 0 {
+			delete(gs.GpuShareMap, uuid)
+			gs.GpuStatusMap[uuid] = 0
+		}
+	}
+}
+
+// TransferShared moves the gpus shared by from to to, e.g. when the replicaSet is renamed,
+// and returns the gpus transferred
+func (gs *gpuScheduler) TransferShared(from, to string) []string {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gpus := gs.sharedBy(from)
+	for _, uuid := range gpus {
+		s := gs.GpuShareMap[uuid]
+		maxSharers := s.Caps[from]
+		s.leave(from)
+		s.join(to, maxSharers)
+	}
+	return gpus
+}
+
+// sharedBy returns the gpus shared by the replicaSet, the caller must hold the lock
+func (gs *gpuScheduler) sharedBy(owner string) []string {
+	var gpus []string
+	for uuid, s := range gs.GpuShareMap {
+		if _, ok := s.Owners[owner]; ok {
+			gpus = append(gpus, uuid)
+		}
+	}
+	sort.Strings(gpus)
+	return gpus
+}
+
+// GetSharedGpus returns the replicaSets sharing each shared gpu
+func (gs *gpuScheduler) GetSharedGpus() map[string][]string {
+	gs.RLock()
+	defer gs.RUnlock()
+
+	sharers := make(map[string][]string, len(gs.GpuShareMap))
+	for uuid := range gs.GpuShareMap {
+		sharers[uuid] = gs.coOwners(uuid)
+	}
+	return sharers
+}
+
+func (gs *gpuScheduler) shareOwners(uuid string) string {
+	return strings.Join(gs.coOwners(uuid), ", ")
+}
+
+// coOwners returns the replicaSets holding slots of the gpu or sharing it, sorted by name
+func (gs *gpuScheduler) coOwners(uuid string) []string {
+	owners := make([]string, 0)
+	for owner := range gs.GpuSlotMap[uuid] {
+		owners = append(owners, owner)
+	}
+	if s, ok := gs.GpuShareMap[uuid]; ok {
+		for owner := range s.Owners {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
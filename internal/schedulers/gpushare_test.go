@@ -0,0 +1,211 @@
+package schedulers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type shareApply struct {
+	owner      string
+	maxSharers int
+}
+
+// TestApplyShared applies one shared gpu for each sharer in turn, the smallest cap of the sharers is honored
+func TestApplyShared(t *testing.T) {
+	tests := []struct {
+		name           string
+		applies        []shareApply
+		wantGpus       []string
+		wantMaxSharers map[string]int
+	}{
+		{
+			name:           "no limit",
+			applies:        []shareApply{{"a", 0}, {"b", 0}, {"c", 0}},
+			wantGpus:       []string{"gpu-0", "gpu-0", "gpu-0"},
+			wantMaxSharers: map[string]int{"gpu-0": 0},
+		},
+		{
+			name:           "the first cap",
+			applies:        []shareApply{{"a", 2}, {"b", 0}, {"c", 0}},
+			wantGpus:       []string{"gpu-0", "gpu-0", "gpu-1"},
+			wantMaxSharers: map[string]int{"gpu-0": 2, "gpu-1": 0},
+		},
+		{
+			name:           "a later cap is stricter",
+			applies:        []shareApply{{"a", 4}, {"b", 2}, {"c", 0}},
+			wantGpus:       []string{"gpu-0", "gpu-0", "gpu-1"},
+			wantMaxSharers: map[string]int{"gpu-0": 2, "gpu-1": 0},
+		},
+		{
+			name:           "the cap of the new sharer is exceeded",
+			applies:        []shareApply{{"a", 0}, {"b", 0}, {"c", 2}},
+			wantGpus:       []string{"gpu-0", "gpu-0", "gpu-1"},
+			wantMaxSharers: map[string]int{"gpu-0": 0, "gpu-1": 2},
+		},
+		{
+			name:           "all gpus are full",
+			applies:        []shareApply{{"a", 1}, {"b", 1}, {"c", 1}},
+			wantGpus:       []string{"gpu-0", "gpu-1", ""},
+			wantMaxSharers: map[string]int{"gpu-0": 1, "gpu-1": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1")
+			for i, apply := range tt.applies {
+				uuids, err := gs.ApplyShared(apply.owner, 1, apply.maxSharers, false)
+				if len(tt.wantGpus[i]) == 0 {
+					if err == nil {
+						t.Fatalf("ApplyShared(%s) = %v, want an error", apply.owner, uuids)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("ApplyShared(%s) error = %v", apply.owner, err)
+				}
+				if !reflect.DeepEqual(uuids, []string{tt.wantGpus[i]}) {
+					t.Errorf("ApplyShared(%s) = %v, want %s", apply.owner, uuids, tt.wantGpus[i])
+				}
+			}
+			got := make(map[string]int, len(gs.GpuShareMap))
+			for uuid, s := range gs.GpuShareMap {
+				got[uuid] = s.MaxSharers
+			}
+			if !reflect.DeepEqual(got, tt.wantMaxSharers) {
+				t.Errorf("MaxSharers = %v, want %v", got, tt.wantMaxSharers)
+			}
+		})
+	}
+}
+
+// TestApplySharedMps applies one gpu for each sharer in turn, the MPS clients only share the gpus with each other
+func TestApplySharedMps(t *testing.T) {
+	type mpsApply struct {
+		owner string
+		mps   bool
+	}
+	tests := []struct {
+		name       string
+		applies    []mpsApply
+		maxSharers int
+		wantGpus   []string
+	}{
+		{
+			name:     "the mps clients share a gpu",
+			applies:  []mpsApply{{"a", true}, {"b", true}, {"c", true}},
+			wantGpus: []string{"gpu-0", "gpu-0", "gpu-0"},
+		},
+		{
+			name:     "the mps clients don't share the time-sliced gpu",
+			applies:  []mpsApply{{"a", false}, {"b", true}, {"c", true}},
+			wantGpus: []string{"gpu-0", "gpu-1", "gpu-1"},
+		},
+		{
+			name:     "the time-sliced sharers don't share the mps gpu",
+			applies:  []mpsApply{{"a", true}, {"b", false}, {"c", true}, {"d", false}},
+			wantGpus: []string{"gpu-0", "gpu-1", "gpu-0", "gpu-1"},
+		},
+		{
+			name:       "no gpu is left for the mps client",
+			applies:    []mpsApply{{"a", false}, {"b", false}, {"c", true}},
+			maxSharers: 1,
+			wantGpus:   []string{"gpu-0", "gpu-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0", "gpu-1")
+			for i, apply := range tt.applies {
+				uuids, err := gs.ApplyShared(apply.owner, 1, tt.maxSharers, apply.mps)
+				if i >= len(tt.wantGpus) {
+					if !xerrors.IsGpuNotEnoughError(err) {
+						t.Fatalf("ApplyShared(%s) = %v, %v, want gpu not enough", apply.owner, uuids, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("ApplyShared(%s) error = %v", apply.owner, err)
+				}
+				if !reflect.DeepEqual(uuids, []string{tt.wantGpus[i]}) {
+					t.Errorf("ApplyShared(%s) = %v, want %s", apply.owner, uuids, tt.wantGpus[i])
+				}
+				if s := gs.GpuShareMap[uuids[0]]; s.Mps != apply.mps {
+					t.Errorf("ApplyShared(%s) gpu: %s mps = %v, want %v", apply.owner, uuids[0], s.Mps, apply.mps)
+				}
+			}
+		})
+	}
+}
+
+// TestRestoreShared releases a sharer, the cap it set is relaxed and the gpu is free after the last sharer
+func TestRestoreShared(t *testing.T) {
+	tests := []struct {
+		name           string
+		applies        []shareApply
+		restore        string
+		wantMaxSharers map[string]int
+		wantFree       bool
+	}{
+		{
+			name:           "the strictest sharer leaves",
+			applies:        []shareApply{{"a", 4}, {"b", 2}},
+			restore:        "b",
+			wantMaxSharers: map[string]int{"gpu-0": 4},
+		},
+		{
+			name:           "another sharer leaves",
+			applies:        []shareApply{{"a", 4}, {"b", 2}},
+			restore:        "a",
+			wantMaxSharers: map[string]int{"gpu-0": 2},
+		},
+		{
+			name:           "the last sharer leaves",
+			applies:        []shareApply{{"a", 2}},
+			restore:        "a",
+			wantMaxSharers: map[string]int{},
+			wantFree:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newTestGpuScheduler(1, "gpu-0")
+			for _, apply := range tt.applies {
+				if _, err := gs.ApplyShared(apply.owner, 1, apply.maxSharers, false); err != nil {
+					t.Fatalf("ApplyShared(%s) error = %v", apply.owner, err)
+				}
+			}
+			gs.RestoreShared(tt.restore)
+			got := make(map[string]int, len(gs.GpuShareMap))
+			for uuid, s := range gs.GpuShareMap {
+				got[uuid] = s.MaxSharers
+			}
+			if !reflect.DeepEqual(got, tt.wantMaxSharers) {
+				t.Errorf("MaxSharers = %v, want %v", got, tt.wantMaxSharers)
+			}
+			if free := gs.GpuStatusMap["gpu-0"] == 0; free != tt.wantFree {
+				t.Errorf("gpu-0 free = %v, want %v", free, tt.wantFree)
+			}
+		})
+	}
+}
+
+func TestTransferShared(t *testing.T) {
+	gs := newTestGpuScheduler(1, "gpu-0")
+	for _, apply := range []shareApply{{"foo", 2}, {"other", 0}} {
+		if _, err := gs.ApplyShared(apply.owner, 1, apply.maxSharers, false); err != nil {
+			t.Fatalf("ApplyShared(%s) error = %v", apply.owner, err)
+		}
+	}
+	if got := gs.TransferShared("foo", "bar"); !reflect.DeepEqual(got, []string{"gpu-0"}) {
+		t.Errorf("TransferShared() = %v, want [gpu-0]", got)
+	}
+	s := gs.GpuShareMap["gpu-0"]
+	if _, ok := s.Owners["foo"]; ok {
+		t.Errorf("TransferShared() gpu-0 is still shared by foo")
+	}
+	if s.Caps["bar"] != 2 || s.MaxSharers != 2 {
+		t.Errorf("TransferShared() caps = %v, MaxSharers = %d, want the cap of foo moved to bar", s.Caps, s.MaxSharers)
+	}
+}
@@ -0,0 +1,92 @@
+package schedulers
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+const gpuTopologyCommand = "nvidia-smi --query-gpu=index,uuid,pci.bus_id --format=csv,noheader,nounits"
+
+// pciDevicesDir is where the kernel exposes the NUMA node of each pci device, it's replaced by the tests
+var pciDevicesDir = "/sys/bus/pci/devices"
+
+// GpuTopology is the host index and the NUMA node of a gpu, the node is -1 if the host has no NUMA
+type GpuTopology struct {
+	Index    int
+	NumaNode int
+}
+
+// QueryGpuTopology returns the topology of each gpu, the key is uuid
+func QueryGpuTopology() (map[string]GpuTopology, error) {
+	c := newCommand(gpuTopologyCommand)
+	if err := c.Execute(); err != nil {
+		return nil, errors.Wrap(err, "cmd.Execute failed")
+	}
+
+	topology := make(map[string]GpuTopology)
+	for _, line := range strings.Split(c.Stdout(), "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) != 3 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, errors.Errorf("invaild index: %s, ", fields[0])
+		}
+		topology[strings.TrimSpace(fields[1])] = GpuTopology{
+			Index:    index,
+			NumaNode: numaNode(strings.TrimSpace(fields[2])),
+		}
+	}
+	return topology, nil
+}
+
+// numaNode reads the NUMA node of the gpu by its pci bus id, e.g. 00000000:36:00.0,
+// nvidia-smi prints the domain in 8 digits while sysfs names the device with 4, e.g. 0000:36:00.0
+func numaNode(busID string) int {
+	id := strings.ToLower(busID)
+	if len(id) > len("0000:00:00.0") {
+		id = id[len(id)-len("0000:00:00.0"):]
+	}
+	bytes, err := os.ReadFile(filepath.Join(pciDevicesDir, id, "numa_node"))
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(bytes)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// allowedGpus is replaced in tests, the topology is queried by nvidia-smi
+var allowedGpus = AllowedGpus
+
+// AllowedGpus returns the uuids of the gpus satisfying the constraints, nil means all gpus are allowed
+func AllowedGpus(constraints *models.GpuConstraints) (map[string]struct{}, error) {
+	if constraints == nil || (len(constraints.Exclude) == 0 && constraints.NumaNode == nil) {
+		return nil, nil
+	}
+	topology, err := QueryGpuTopology()
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.QueryGpuTopology failed")
+	}
+
+	allowed := make(map[string]struct{}, len(topology))
+	for uuid, t := range topology {
+		if constraints.Excludes(t.Index) {
+			continue
+		}
+		if constraints.NumaNode != nil && *constraints.NumaNode != t.NumaNode {
+			continue
+		}
+		allowed[uuid] = struct{}{}
+	}
+	return allowed, nil
+}
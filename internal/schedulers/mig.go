@@ -0,0 +1,229 @@
+package schedulers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	migDeviceCommand = "nvidia-smi -L"
+	// migOwner holds the gpus in mig mode, so that they are shared by the mig instances instead of allocated as a whole
+	migOwner = "mig:"
+)
+
+var (
+	// e.g. GPU 0: NVIDIA A100-SXM4-40GB (UUID: GPU-5d5ba0d6-d33d-2b2c-524d-9e3d8d2b8a77)
+	gpuListRegexp = regexp.MustCompile(`^GPU\s+\d+:.*\(UUID:\s*(GPU-[^)]+)\)`)
+	// e.g.   MIG 1g.5gb      Device  0: (UUID: MIG-c6d4f1ef-42e4-5de3-91c7-45d71c87eb3f)
+	migListRegexp = regexp.MustCompile(`^\s+MIG\s+(\S+)\s+Device\s+\d+:\s*\(UUID:\s*(MIG-[^)]+)\)`)
+)
+
+// IsMigDevice means the device id is a mig instance rather than a whole gpu
+func IsMigDevice(id string) bool {
+	return strings.HasPrefix(id, "MIG-")
+}
+
+// checkMigDevices discovers the mig instances, the gpus in mig mode are held by migOwner.
+// The last result is kept if nvidia-smi fails.
+func (gs *gpuScheduler) checkMigDevices() {
+	if gs.AvailableGpuNums == 0 {
+		return
+	}
+	devices, err := queryMigDevices()
+	if err != nil {
+		log.Warnf("schedulers.GpuScheduler, query mig devices failed, the last devices are used, error: %v", err)
+		return
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	parents := make(map[string]struct{})
+	for _, device := range devices {
+		parents[device.GpuUUID] = struct{}{}
+	}
+	for uuid := range parents {
+		if _, ok := gs.GpuStatusMap[uuid]; !ok || gs.GpuOwnerMap[uuid] == migOwner {
+			continue
+		}
+		if gs.GpuStatusMap[uuid] != 0 {
+			log.Warnf("schedulers.GpuScheduler, gpu: %s is in mig mode but %s", uuid, gs.heldReason(uuid))
+			continue
+		}
+		gs.GpuStatusMap[uuid] = 1
+		gs.GpuOwnerMap[uuid] = migOwner
+		log.Infof("schedulers.GpuScheduler, gpu: %s is in mig mode, it's shared by the mig instances", uuid)
+	}
+	// the mig mode is disabled
+	for uuid, owner := range gs.GpuOwnerMap {
+		if _, ok := parents[uuid]; ok || owner != migOwner {
+			continue
+		}
+		gs.GpuStatusMap[uuid] = 0
+		delete(gs.GpuOwnerMap, uuid)
+		log.Infof("schedulers.GpuScheduler, gpu: %s is not in mig mode any more", uuid)
+	}
+	gs.migDevices = devices
+}
+
+func queryMigDevices() ([]models.MigDevice, error) {
+	c := newCommand(migDeviceCommand)
+	if err := c.Execute(); err != nil {
+		return nil, errors.Wrap(err, "cmd.Execute failed")
+	}
+	if c.ExitCode() != 0 {
+		return nil, errors.Errorf("command: %s exit with code %d, output: %s", migDeviceCommand, c.ExitCode(), c.Combined())
+	}
+
+	var (
+		devices []models.MigDevice
+		parent  string
+	)
+	for _, line := range strings.Split(c.Stdout(), "\n") {
+		if m := gpuListRegexp.FindStringSubmatch(line); m != nil {
+			parent = m[1]
+			continue
+		}
+		if m := migListRegexp.FindStringSubmatch(line); m != nil && len(parent) != 0 {
+			devices = append(devices, models.MigDevice{UUID: m[2], Profile: m[1], GpuUUID: parent})
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].UUID < devices[j].UUID
+	})
+	return devices, nil
+}
+
+// ApplyMig applies for num mig instances of the profile, e.g. 1g.5gb, for the replicaSet, the instances of
+// the unhealthy gpus and of the gpus shared with a replicaSet of a conflicting label are not applied.
+func (gs *gpuScheduler) ApplyMig(owner, profile string, num int) ([]string, error) {
+	if num <= 0 {
+		return nil, errors.Errorf("num: %d must be greater than 0", num)
+	}
+	gs.checkMigDevices()
+	gs.checkGpuHealth()
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	applied, err := gs.pickMig(owner, profile, num, gs.LabelMap[owner])
+	if err != nil {
+		if xerrors.IsGpuNotEnoughError(err) {
+			notify.Emit(models.EventGpuExhausted, owner, map[string]interface{}{
+				"requested":  num,
+				"free":       len(applied),
+				"migProfile": profile,
+			})
+		}
+		return nil, err
+	}
+
+	for _, uuid := range applied {
+		gs.MigOwnerMap[uuid] = owner
+	}
+	return applied, nil
+}
+
+// PlanMig returns the mig instances ApplyMig would apply for the replicaSet with the labels, nothing is applied
+func (gs *gpuScheduler) PlanMig(owner, profile string, num int, labels []string) ([]string, error) {
+	if num <= 0 {
+		return nil, errors.Errorf("num: %d must be greater than 0", num)
+	}
+	gs.checkMigDevices()
+	gs.checkGpuHealth()
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	return gs.pickMig(owner, profile, num, labels)
+}
+
+// pickMig picks the free mig instances of the profile, the caller must hold the lock. The instances on a gpu
+// whose other instances are held by a replicaSet of a conflicting label are skipped, the instances of a gpu
+// are a way of sharing it. The instances picked so far are returned with the GpuNotEnough error.
+func (gs *gpuScheduler) pickMig(owner, profile string, num int, labels []string) ([]string, error) {
+	var (
+		found    bool
+		conflict string
+	)
+	applied := make([]string, 0, num)
+	for _, device := range gs.migDevices {
+		if device.Profile != profile {
+			continue
+		}
+		found = true
+		if _, ok := gs.MigOwnerMap[device.UUID]; ok {
+			continue
+		}
+		if _, ok := gs.unhealthy[device.GpuUUID]; ok {
+			continue
+		}
+		if other, label := gs.conflictOn(owner, labels, device.GpuUUID); len(other) != 0 {
+			conflict = fmt.Sprintf("gpu: %s is shared with replicaSet: %s labeled %s", device.GpuUUID, other, label)
+			continue
+		}
+		if len(applied) < num {
+			applied = append(applied, device.UUID)
+		}
+	}
+	if !found {
+		return nil, errors.Wrapf(xerrors.NewMigProfileNotFoundError(), "profile: %s", profile)
+	}
+	if len(applied) < num {
+		if len(conflict) != 0 {
+			return applied, errors.Wrap(xerrors.NewGpuConflictError(), conflict)
+		}
+		return applied, errors.Wrapf(xerrors.NewGpuNotEnoughError(), "profile: %s, requested: %d, free: %d", profile, num, len(applied))
+	}
+	return applied, nil
+}
+
+// migOwners returns the replicaSets holding the mig instances of the gpu, the caller must hold the lock
+func (gs *gpuScheduler) migOwners(gpuUUID string) []string {
+	owners := make([]string, 0)
+	for _, device := range gs.migDevices {
+		if owner, ok := gs.MigOwnerMap[device.UUID]; ok && device.GpuUUID == gpuUUID && !contains(owners, owner) {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// GetMigDevices returns the mig instances on the host with the replicaSets holding them
+func (gs *gpuScheduler) GetMigDevices() []models.MigDevice {
+	gs.checkMigDevices()
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	devices := make([]models.MigDevice, 0, len(gs.migDevices))
+	for _, device := range gs.migDevices {
+		device.Owner = gs.MigOwnerMap[device.UUID]
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// MigProfiles returns the mig profiles on the host, e.g. 1g.5gb and 3g.20gb
+func (gs *gpuScheduler) MigProfiles() map[string]struct{} {
+	gs.checkMigDevices()
+
+	gs.RLock()
+	defer gs.RUnlock()
+
+	profiles := make(map[string]struct{})
+	for _, device := range gs.migDevices {
+		profiles[device.Profile] = struct{}{}
+	}
+	return profiles
+}
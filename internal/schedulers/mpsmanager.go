@@ -0,0 +1,246 @@
+package schedulers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/commander-cli/cmd"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	mpsStartCommand = "nvidia-cuda-mps-control -d"
+	mpsQuitCommand  = "echo quit | nvidia-cuda-mps-control"
+	mpsCheckCommand = "echo get_server_list | nvidia-cuda-mps-control"
+
+	mpsRegistrationMapKey = "mpsRegistrationMapKey"
+)
+
+var MpsManager *mpsManager
+
+// mpsManager manages the lifecycle of the MPS control daemon of each gpu,
+// the daemon is started when the first sharing container arrives and stopped when the last one leaves.
+type mpsManager struct {
+	sync.Mutex
+
+	pipeDir string
+	logDir  string
+	// RegistrationMap records the replicaSets which share the gpu through MPS,
+	// the key is uuid and the value is the set of replicaSet names.
+	RegistrationMap map[string]map[string]struct{} `json:"registrationMap"`
+}
+
+func InitMpsManager(pipeDir, logDir string) error {
+	var err error
+	MpsManager, err = initMpsFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+	MpsManager.pipeDir = pipeDir
+	MpsManager.logDir = logDir
+	return nil
+}
+
+func CloseMpsManager() error {
+	// the daemons are not stopped, the sharing containers are still running
+	return etcd.Put(etcd.Gpus, mpsRegistrationMapKey, MpsManager.serialize())
+}
+
+func initMpsFormEtcd() (m *mpsManager, err error) {
+	bytes, err := etcd.GetValue(etcd.Gpus, mpsRegistrationMapKey)
+	if err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			err = nil
+		} else {
+			return m, err
+		}
+	}
+
+	m = &mpsManager{
+		RegistrationMap: make(map[string]map[string]struct{}),
+	}
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &m)
+	}
+	return m, err
+}
+
+// PipeDir returns the pipe directory of the MPS control daemon of the gpu on the host
+func (m *mpsManager) PipeDir(uuid string) string {
+	return filepath.Join(m.pipeDir, uuid)
+}
+
+// Register sets the gpus shared by the replicaSet through MPS, and returns the gpus registered before,
+// so that the caller can register them again if the container fails to run.
+// The daemon is started on the gpu that has no sharing replicaSet, and stopped on the gpu that has no one left.
+func (m *mpsManager) Register(owner string, uuids []string) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	previous := m.registered(owner)
+	want := make(map[string]struct{}, len(uuids))
+	for _, uuid := range uuids {
+		want[uuid] = struct{}{}
+	}
+
+	for _, uuid := range uuids {
+		owners, ok := m.RegistrationMap[uuid]
+		if !ok || len(owners) == 0 {
+			if err := m.start(uuid); err != nil {
+				m.set(owner, previous)
+				return previous, errors.WithMessagef(err, "start mps daemon failed, gpu: %s", uuid)
+			}
+			owners = make(map[string]struct{})
+			m.RegistrationMap[uuid] = owners
+		}
+		owners[owner] = struct{}{}
+	}
+
+	for _, uuid := range previous {
+		if _, ok := want[uuid]; !ok {
+			m.release(owner, uuid)
+		}
+	}
+	return previous, nil
+}
+
+// Release all the gpus shared by the replicaSet
+func (m *mpsManager) Release(owner string) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, uuid := range m.registered(owner) {
+		m.release(owner, uuid)
+	}
+}
+
+// set registers the replicaSet on exactly the gpus, it is used to undo a failed Register
+func (m *mpsManager) set(owner string, uuids []string) {
+	want := make(map[string]struct{}, len(uuids))
+	for _, uuid := range uuids {
+		want[uuid] = struct{}{}
+	}
+	for _, uuid := range m.registered(owner) {
+		if _, ok := want[uuid]; !ok {
+			m.release(owner, uuid)
+		}
+	}
+}
+
+func (m *mpsManager) release(owner, uuid string) {
+	owners := m.RegistrationMap[uuid]
+	delete(owners, owner)
+	if len(owners) != 0 {
+		return
+	}
+	delete(m.RegistrationMap, uuid)
+	if err := m.stop(uuid); err != nil {
+		log.Errorf("schedulers.MpsManager, stop mps daemon failed, gpu: %s, error: %v", uuid, err)
+	}
+}
+
+func (m *mpsManager) registered(owner string) []string {
+	var uuids []string
+	for uuid, owners := range m.RegistrationMap {
+		if _, ok := owners[owner]; ok {
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+func (m *mpsManager) start(uuid string) error {
+	pipeDir, logDir := m.PipeDir(uuid), filepath.Join(m.logDir, uuid)
+	for _, dir := range []string{pipeDir, logDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "os.MkdirAll failed, dir: %s", dir)
+		}
+	}
+	if err := m.execute(uuid, mpsStartCommand); err != nil {
+		return err
+	}
+	log.Infof("schedulers.MpsManager, mps daemon of gpu: %s started, pipe dir: %s, log dir: %s", uuid, pipeDir, logDir)
+	return nil
+}
+
+func (m *mpsManager) stop(uuid string) error {
+	if err := m.execute(uuid, mpsQuitCommand); err != nil {
+		return err
+	}
+	log.Infof("schedulers.MpsManager, mps daemon of gpu: %s stopped", uuid)
+	return nil
+}
+
+// alive checks whether the daemon of the gpu is still accepting commands
+func (m *mpsManager) alive(uuid string) bool {
+	return m.execute(uuid, mpsCheckCommand) == nil
+}
+
+func (m *mpsManager) execute(uuid, command string) error {
+	c := cmd.NewCommand(command, cmd.WithInheritedEnvironment(cmd.EnvVars{
+		"CUDA_VISIBLE_DEVICES":    uuid,
+		"CUDA_MPS_PIPE_DIRECTORY": m.PipeDir(uuid),
+		"CUDA_MPS_LOG_DIRECTORY":  filepath.Join(m.logDir, uuid),
+	}))
+	if err := c.Execute(); err != nil {
+		return errors.Wrapf(err, "cmd.Execute failed, command: %s", command)
+	}
+	if c.ExitCode() != 0 {
+		return errors.Errorf("command: %s exit with code %d, output: %s", command, c.ExitCode(), c.Combined())
+	}
+	return nil
+}
+
+func (m *mpsManager) serialize() *string {
+	m.Lock()
+	defer m.Unlock()
+
+	bytes, _ := json.Marshal(m)
+	tmp := string(bytes)
+	return &tmp
+}
+
+// MpsMonitorLoop restarts the daemons that crashed, the replicaSets that shared the gpu are kept registered,
+// they reconnect to the new daemon through the same pipe directory.
+func MpsMonitorLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			MpsManager.check()
+		}
+	}
+}
+
+func (m *mpsManager) check() {
+	m.Lock()
+	defer m.Unlock()
+
+	for uuid, owners := range m.RegistrationMap {
+		if len(owners) == 0 || m.alive(uuid) {
+			continue
+		}
+		log.Errorf("schedulers.MpsManager, mps daemon of gpu: %s is not alive, restart it", uuid)
+		if err := m.start(uuid); err != nil {
+			log.Errorf("schedulers.MpsManager, restart mps daemon failed, gpu: %s, error: %v", uuid, err)
+			continue
+		}
+		for owner := range owners {
+			log.Infof("schedulers.MpsManager, replicaSet: %s is re-registered to mps daemon of gpu: %s", owner, uuid)
+		}
+	}
+}
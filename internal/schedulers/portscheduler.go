@@ -24,6 +24,9 @@ type portScheduler struct {
 	EndPort        int
 	AvailableCount int
 	UsedPortSet    map[string]struct{}
+	// reserved are the host ports requested by the containers being created, they are not bound until the containers
+	// start, so they are neither applied nor reserved again meanwhile, they are not saved to etcd
+	reserved map[string]struct{}
 }
 
 func InitPortScheduler(portRange string) error {
@@ -72,6 +75,12 @@ func initPortFormEtcd() (s *portScheduler, err error) {
 
 // Apply for a specified number of ports
 func (ps *portScheduler) Apply(num int) ([]string, error) {
+	return ps.ApplyExclude(num, nil)
+}
+
+// ApplyExclude apply for a specified number of ports, but skip the ports in exclude,
+// e.g. the ephemeral ports which are assigned by docker and are not recorded in UsedPortSet.
+func (ps *portScheduler) ApplyExclude(num int, exclude map[string]struct{}) ([]string, error) {
 	if num <= 0 || num > ps.AvailableCount {
 		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(ps.AvailableCount))
 	}
@@ -79,10 +88,39 @@ func (ps *portScheduler) Apply(num int) ([]string, error) {
 	ps.Lock()
 	defer ps.Unlock()
 
+	availablePorts, err := ps.pickPorts(num, exclude)
+	if err != nil {
+		return nil, err
+	}
+	for _, port := range availablePorts {
+		ps.UsedPortSet[port] = struct{}{}
+	}
+	return availablePorts, nil
+}
+
+// PlanExclude returns the ports ApplyExclude would apply, nothing is applied
+func (ps *portScheduler) PlanExclude(num int, exclude map[string]struct{}) ([]string, error) {
+	if num <= 0 || num > ps.AvailableCount {
+		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(ps.AvailableCount))
+	}
+
+	ps.RLock()
+	defer ps.RUnlock()
+
+	return ps.pickPorts(num, exclude)
+}
+
+// pickPorts picks the free ports from the lowest without marking them, the caller must hold the lock
+func (ps *portScheduler) pickPorts(num int, exclude map[string]struct{}) ([]string, error) {
 	var availablePorts []string
 	for i := ps.StartPort; i <= ps.EndPort; i++ {
+		if _, ok := exclude[strconv.Itoa(i)]; ok {
+			continue
+		}
+		if _, ok := ps.reserved[strconv.Itoa(i)]; ok {
+			continue
+		}
 		if _, ok := ps.UsedPortSet[strconv.Itoa(i)]; !ok {
-			ps.UsedPortSet[strconv.Itoa(i)] = struct{}{}
 			availablePorts = append(availablePorts, strconv.Itoa(i))
 			if len(availablePorts) == num {
 				break
@@ -93,10 +131,42 @@ func (ps *portScheduler) Apply(num int) ([]string, error) {
 	if len(availablePorts) < num {
 		return nil, xerrors.NewPortNotEnoughError()
 	}
-
 	return availablePorts, nil
 }
 
+// Reserve reserves the requested host ports until Unreserve, it fails if a port is applied or reserved already,
+// nothing is reserved then
+func (ps *portScheduler) Reserve(ports []string) error {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, port := range ports {
+		if _, ok := ps.UsedPortSet[port]; ok {
+			return errors.Wrapf(xerrors.NewPortConflictError(), "host port: %s is applied by another container", port)
+		}
+		if _, ok := ps.reserved[port]; ok {
+			return errors.Wrapf(xerrors.NewPortConflictError(), "host port: %s is requested by another container being created", port)
+		}
+	}
+	if ps.reserved == nil {
+		ps.reserved = make(map[string]struct{})
+	}
+	for _, port := range ports {
+		ps.reserved[port] = struct{}{}
+	}
+	return nil
+}
+
+// Unreserve releases the ports reserved, the ports bound by the started container are skipped by boundHostPorts then
+func (ps *portScheduler) Unreserve(ports []string) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, port := range ports {
+		delete(ps.reserved, port)
+	}
+}
+
 // Restore a specified number of ports
 func (ps *portScheduler) Restore(ports []string) {
 	if len(ports) <= 0 || len(ports) > ps.AvailableCount {
@@ -111,6 +181,28 @@ func (ps *portScheduler) Restore(ports []string) {
 	}
 }
 
+// Rebind replaces the ports recorded for a container by its live bindings, the recorded ports which are not bound
+// any more are freed and the live ports in the range are marked as used, so that they are not applied again
+func (ps *portScheduler) Rebind(recorded, live []string) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	bound := make(map[string]struct{}, len(live))
+	for _, port := range live {
+		bound[port] = struct{}{}
+	}
+	for _, port := range recorded {
+		if _, ok := bound[port]; !ok {
+			delete(ps.UsedPortSet, port)
+		}
+	}
+	for port := range bound {
+		if p, err := strconv.Atoi(port); err == nil && p >= ps.StartPort && p <= ps.EndPort {
+			ps.UsedPortSet[port] = struct{}{}
+		}
+	}
+}
+
 func (ps *portScheduler) serialize() *string {
 	ps.RLock()
 	defer ps.RUnlock()
@@ -0,0 +1,146 @@
+package schedulers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestPortScheduler(start, end int, used ...string) *portScheduler {
+	ps := &portScheduler{
+		StartPort:      start,
+		EndPort:        end,
+		AvailableCount: end - start + 1,
+		UsedPortSet:    make(map[string]struct{}),
+	}
+	for _, port := range used {
+		ps.UsedPortSet[port] = struct{}{}
+	}
+	return ps
+}
+
+func usedPorts(ps *portScheduler) []string {
+	ports := make([]string, 0, len(ps.UsedPortSet))
+	for port := range ps.UsedPortSet {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name     string
+		used     []string
+		recorded []string
+		live     []string
+		want     []string
+	}{
+		{
+			name:     "unchanged",
+			used:     []string{"40000", "40001"},
+			recorded: []string{"40000"},
+			live:     []string{"40000"},
+			want:     []string{"40000", "40001"},
+		},
+		{
+			name:     "moved",
+			used:     []string{"40000", "40001"},
+			recorded: []string{"40000"},
+			live:     []string{"40002"},
+			want:     []string{"40001", "40002"},
+		},
+		{
+			name:     "live port out of range is not marked",
+			used:     []string{"40000"},
+			recorded: []string{"40000"},
+			live:     []string{"32768"},
+			want:     []string{},
+		},
+		{
+			name:     "not bound any more",
+			used:     []string{"40000", "40001"},
+			recorded: []string{"40000", "40001"},
+			live:     nil,
+			want:     []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestPortScheduler(40000, 40009, tt.used...)
+			ps.Rebind(tt.recorded, tt.live)
+			if got := usedPorts(ps); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rebind() used ports = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		used    []string
+		exclude map[string]struct{}
+		num     int
+		want    []string
+		wantErr bool
+	}{
+		{name: "lowest free", used: []string{"40000"}, num: 2, want: []string{"40001", "40002"}},
+		{name: "excluded", exclude: map[string]struct{}{"40000": {}}, num: 1, want: []string{"40001"}},
+		{name: "not enough", used: []string{"40000", "40001"}, num: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestPortScheduler(40000, 40002, tt.used...)
+			got, err := ps.pickPorts(tt.num, tt.exclude)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pickPorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pickPorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		used     []string
+		reserved []string
+		ports    []string
+		wantErr  bool
+		wantPick []string
+	}{
+		{name: "free", ports: []string{"40000"}, wantPick: []string{"40001"}},
+		{name: "out of the range", ports: []string{"8080"}, wantPick: []string{"40000"}},
+		{name: "applied already", used: []string{"40000"}, ports: []string{"40000"}, wantErr: true},
+		{name: "reserved by another create", reserved: []string{"40001"}, ports: []string{"40000", "40001"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTestPortScheduler(40000, 40009, tt.used...)
+			if err := ps.Reserve(tt.reserved); err != nil {
+				t.Fatalf("Reserve(%v) error = %v", tt.reserved, err)
+			}
+			err := ps.Reserve(tt.ports)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reserve(%v) error = %v, wantErr %v", tt.ports, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, ok := ps.reserved["40000"]; ok && len(tt.used) == 0 {
+					t.Errorf("Reserve(%v) reserved 40000 although it failed", tt.ports)
+				}
+				return
+			}
+			got, err := ps.ApplyExclude(1, nil)
+			if err != nil || !reflect.DeepEqual(got, tt.wantPick) {
+				t.Errorf("ApplyExclude() = %v, %v, want %v", got, err, tt.wantPick)
+			}
+			ps.Unreserve(tt.ports)
+			if len(ps.reserved) != 0 {
+				t.Errorf("Unreserve(%v) left %v reserved", tt.ports, ps.reserved)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package schedulers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const externalProviderTimeout = 10 * time.Second
+
+// Provider decides which gpus a new container uses, the local GpuScheduler is the default
+var Provider SchedulerProvider = &localProvider{}
+
+// SchedulerProvider returns the device ids of the gpus to use for the container.
+// The gpus returned are marked as used by the replicaSet in GpuScheduler, so they can be restored as usual.
+type SchedulerProvider interface {
+	Allocate(spec *models.ContainerRun) ([]string, error)
+}
+
+// InitSchedulerProvider uses the external scheduler if the url is not empty
+func InitSchedulerProvider(url string) {
+	if len(url) == 0 {
+		return
+	}
+	Provider = &externalProvider{
+		url:    url,
+		client: &http.Client{Timeout: externalProviderTimeout},
+	}
+}
+
+// ExternalProviderEnabled means the gpus of whole-card requests are decided by the external scheduler
+func ExternalProviderEnabled() bool {
+	_, ok := Provider.(*externalProvider)
+	return ok
+}
+
+type localProvider struct{}
+
+func (p *localProvider) Allocate(spec *models.ContainerRun) ([]string, error) {
+	return GpuScheduler.ApplyConstrained(spec.ReplicaSetName, spec.GpuUUIDs, spec.GpuCount, spec.GpuConstraints)
+}
+
+// externalProvider asks a cluster scheduler for the placement, the scheduler owns the decision,
+// gpu-docker-api just honors it.
+type externalProvider struct {
+	url    string
+	client *http.Client
+}
+
+type externalAllocation struct {
+	DeviceIDs []string `json:"deviceIds"`
+}
+
+func (p *externalProvider) Allocate(spec *models.ContainerRun) ([]string, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal failed")
+	}
+
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "http.Post failed, url: %s", p.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("external scheduler returned status %d, url: %s", resp.StatusCode, p.url)
+	}
+
+	var allocation externalAllocation
+	if err = json.NewDecoder(resp.Body).Decode(&allocation); err != nil {
+		return nil, errors.Wrap(err, "json.Decode failed")
+	}
+	if len(allocation.DeviceIDs) != spec.GpuCount {
+		return nil, errors.Errorf("external scheduler returned %d gpus, but %d gpus are requested",
+			len(allocation.DeviceIDs), spec.GpuCount)
+	}
+	// the requested uuids are part of the spec, the scheduler must honor them
+	for _, uuid := range spec.GpuUUIDs {
+		if !slices.Contains(allocation.DeviceIDs, uuid) {
+			return nil, errors.Errorf("external scheduler returned %v without the requested gpu: %s", allocation.DeviceIDs, uuid)
+		}
+	}
+
+	// so are the constraints
+	allowed, err := AllowedGpus(spec.GpuConstraints)
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.AllowedGpus failed")
+	}
+	for _, uuid := range allocation.DeviceIDs {
+		if _, ok := allowed[uuid]; allowed != nil && !ok {
+			return nil, errors.Wrapf(xerrors.NewGpuConstraintUnsatisfiableError(), "external scheduler returned the gpu: %s excluded by the constraints", uuid)
+		}
+	}
+
+	if err = GpuScheduler.Occupy(spec.ReplicaSetName, allocation.DeviceIDs); err != nil {
+		return nil, errors.WithMessage(err, "GpuScheduler.Occupy failed")
+	}
+	return allocation.DeviceIDs, nil
+}
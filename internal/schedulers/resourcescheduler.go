@@ -0,0 +1,145 @@
+package schedulers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const committedMapKey = "committedMapKey"
+
+var ResourceScheduler *resourceScheduler
+
+// resourceScheduler accounts the cpu and memory requests of replicaSets against the capacity of the host,
+// the limits are enforced by cgroup and are not counted here, so a container can burst beyond its request.
+type resourceScheduler struct {
+	sync.RWMutex
+
+	CpuCapacity    int64 `json:"cpuCapacity"`
+	MemoryCapacity int64 `json:"memoryCapacity"`
+	// CommittedMap records the requests held by each replicaSet, the key is replicaSet name.
+	CommittedMap map[string]models.ResourceRequests `json:"committedMap"`
+}
+
+type ResourceStatus struct {
+	CpuCapacity     int64 `json:"cpuCapacity"`
+	CpuCommitted    int64 `json:"cpuCommitted"`
+	MemoryCapacity  int64 `json:"memoryCapacity"`
+	MemoryCommitted int64 `json:"memoryCommitted"`
+}
+
+func InitResourceScheduler() error {
+	var err error
+	ResourceScheduler, err = initResourceFormEtcd()
+	if err != nil {
+		return errors.Wrap(err, "initFormEtcd failed")
+	}
+
+	// the capacity is always read from docker, the host may be resized between restarts
+	info, err := docker.Cli.Info(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "docker.Info failed")
+	}
+	ResourceScheduler.CpuCapacity = int64(info.NCPU) * 1e9
+	ResourceScheduler.MemoryCapacity = info.MemTotal
+	return nil
+}
+
+func CloseResourceScheduler() error {
+	return etcd.Put(etcd.Reserves, committedMapKey, ResourceScheduler.serialize())
+}
+
+func initResourceFormEtcd() (s *resourceScheduler, err error) {
+	bytes, err := etcd.GetValue(etcd.Reserves, committedMapKey)
+	if err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			err = nil
+		} else {
+			return s, err
+		}
+	}
+
+	s = &resourceScheduler{
+		CommittedMap: make(map[string]models.ResourceRequests),
+	}
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &s)
+	}
+	return s, err
+}
+
+// Apply reserves the requests for the replicaSet, the requests already held by the replicaSet will be replaced
+func (rs *resourceScheduler) Apply(owner string, req models.ResourceRequests) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if err := rs.fits(owner, req); err != nil {
+		return err
+	}
+	rs.CommittedMap[owner] = req
+	return nil
+}
+
+// Check returns the error Apply would return, nothing is reserved
+func (rs *resourceScheduler) Check(owner string, req models.ResourceRequests) error {
+	rs.RLock()
+	defer rs.RUnlock()
+
+	return rs.fits(owner, req)
+}
+
+func (rs *resourceScheduler) fits(owner string, req models.ResourceRequests) error {
+	cpu, memory := rs.committed()
+	held := rs.CommittedMap[owner]
+	if cpu-held.NanoCpus+req.NanoCpus > rs.CpuCapacity ||
+		memory-held.MemoryBytes+req.MemoryBytes > rs.MemoryCapacity {
+		return xerrors.NewResourceNotEnoughError()
+	}
+	return nil
+}
+
+// Restore the requests held by the replicaSet
+func (rs *resourceScheduler) Restore(owner string) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	delete(rs.CommittedMap, owner)
+}
+
+func (rs *resourceScheduler) committed() (cpu, memory int64) {
+	for _, req := range rs.CommittedMap {
+		cpu += req.NanoCpus
+		memory += req.MemoryBytes
+	}
+	return
+}
+
+func (rs *resourceScheduler) serialize() *string {
+	rs.RLock()
+	defer rs.RUnlock()
+
+	bytes, _ := json.Marshal(rs)
+	tmp := string(bytes)
+	return &tmp
+}
+
+// GetResourceStatus get the committed requests and the capacity
+func (rs *resourceScheduler) GetResourceStatus() ResourceStatus {
+	rs.RLock()
+	defer rs.RUnlock()
+
+	cpu, memory := rs.committed()
+	return ResourceStatus{
+		CpuCapacity:     rs.CpuCapacity,
+		CpuCommitted:    cpu,
+		MemoryCapacity:  rs.MemoryCapacity,
+		MemoryCommitted: memory,
+	}
+}
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// archiveImageSuffix is the suffix of the repository of the images committed by soft delete, e.g. foo-archive:2
+const archiveImageSuffix = "-archive"
+
+// SoftDeleteContainer stops the latest version of the container and releases its gpus, ports and requests,
+// the container is kept for post-mortem until ArchiveRetention, it can be restored by UndeleteContainer before that.
+func (rs *ReplicaSetService) SoftDeleteContainer(name string, spec *models.ContainerSoftDelete) (*models.ContainerArchive, error) {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.GetContainerInfo failed")
+	}
+	if info.Archive != nil {
+		return nil, errors.Wrapf(xerrors.NewContainerArchivedError(), "container: %s", name)
+	}
+
+	ctx := context.Background()
+	if err = docker.Cli.ContainerStop(ctx, ctrVersionName, container.StopOptions{}); err != nil {
+		return nil, errors.WithMessage(err, "docker.ContainerStop failed")
+	}
+
+	now := time.Now()
+	archive := &models.ContainerArchive{
+		ContainerName: ctrVersionName,
+		ArchiveTime:   now.Format("2006-01-02 15:04:05"),
+		ExpireTime:    now.Add(cfg.ArchiveRetention).Format("2006-01-02 15:04:05"),
+	}
+	if spec.CommitImage {
+		archive.Image = fmt.Sprintf("%s%s:%d", name, archiveImageSuffix, version)
+		_, err = docker.Cli.ContainerCommit(ctx, ctrVersionName, types.ContainerCommitOptions{
+			Reference: archive.Image,
+			Comment:   fmt.Sprintf("container name %s, archive time: %s", ctrVersionName, archive.ArchiveTime),
+		})
+		if err != nil {
+			return nil, errors.WithMessage(err, "docker.ContainerCommit failed")
+		}
+	}
+	if spec.ExportLogs {
+		archive.LogFile, err = exportLogs(ctx, ctrVersionName, info.Config != nil && info.Config.Tty)
+		if err != nil {
+			return nil, errors.WithMessage(err, "services.exportLogs failed")
+		}
+	}
+
+	// the gpus held by the replicaSet are released, the gpus of a stopped container may be held by others now
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	schedulers.GpuScheduler.Restore(schedulers.GpuScheduler.HeldBy(name, uuids))
+	schedulers.GpuScheduler.RestoreFraction(name)
+	schedulers.GpuScheduler.RestoreShared(name)
+	schedulers.ResourceScheduler.Restore(name)
+	schedulers.MpsManager.Release(name)
+	ports, err := rs.containerPortBindings(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerPortBindings failed")
+	}
+	schedulers.PortScheduler.Restore(ports)
+
+	info.Archive = archive
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Containers,
+		Key:      name,
+		Value:    info.Serialize(),
+	})
+
+	notify.Emit(models.EventContainerDeleted, name, map[string]interface{}{
+		"containerName": ctrVersionName,
+		"soft":          true,
+		"expireTime":    archive.ExpireTime,
+	})
+	log.Infof("services.SoftDeleteContainer, container: %s archived, %d gpus and %d ports released, it expires at %s",
+		ctrVersionName, len(uuids), len(ports), archive.ExpireTime)
+	return archive, nil
+}
+
+// UndeleteContainer restarts the soft deleted container as a new version, the gpus and ports are applied again
+func (rs *ReplicaSetService) UndeleteContainer(name string) (id, newContainerName string, err error) {
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.GetContainerInfo failed")
+	}
+	if info.Archive == nil {
+		return id, newContainerName, errors.Wrapf(xerrors.NewContainerNotArchivedError(), "container: %s", name)
+	}
+
+	// the new version is saved without the archive
+	id, newContainerName, err = rs.RestartContainer(name)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.RestartContainer failed")
+	}
+	log.Infof("services.UndeleteContainer, container: %s restored as %s", info.Archive.ContainerName, newContainerName)
+	return
+}
+
+// PruneArchivedContainers removes the soft deleted containers whose retention expired with their archive images and logs,
+// the archives no longer referenced, e.g. of the restored containers, are removed once they are older than the retention
+func (rs *ReplicaSetService) PruneArchivedContainers() {
+	kvs, err := etcd.List(etcd.Containers)
+	if err != nil {
+		log.Errorf("services.PruneArchivedContainers, etcd.List failed, error: %v", err)
+		return
+	}
+
+	now := time.Now()
+	// the images and logs of the archives kept
+	referenced := make(map[string]struct{})
+	for name, value := range kvs {
+		var info models.EtcdContainerInfo
+		if err = json.Unmarshal(value, &info); err != nil || info.Archive == nil {
+			continue
+		}
+		expireTime, err := time.ParseInLocation("2006-01-02 15:04:05", info.Archive.ExpireTime, time.Local)
+		if err == nil && !now.Before(expireTime) {
+			if err = rs.purgeArchivedContainer(name, &info); err == nil {
+				continue
+			}
+			log.Errorf("services.PruneArchivedContainers, container: %s remove failed, error: %v", info.Archive.ContainerName, err)
+		}
+		referenced[info.Archive.Image] = struct{}{}
+		referenced[info.Archive.LogFile] = struct{}{}
+	}
+
+	deadline := now.Add(-cfg.ArchiveRetention)
+	pruneArchiveLogs(cfg.ArchiveDir, referenced, deadline)
+	pruneArchiveImages(context.Background(), referenced, deadline)
+}
+
+// pruneArchiveLogs removes the logs exported before the deadline which are not referenced
+func pruneArchiveLogs(dir string, referenced map[string]struct{}, deadline time.Time) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("services.pruneArchiveLogs, os.ReadDir failed, dir: %s, error: %v", dir, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.Type().IsRegular() || filepath.Ext(path) != ".log" {
+			continue
+		}
+		if _, ok := referenced[path]; ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(deadline) {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			log.Errorf("services.pruneArchiveLogs, os.Remove failed, path: %s, error: %v", path, err)
+			continue
+		}
+		log.Infof("services.pruneArchiveLogs, archived logs: %s removed", path)
+	}
+}
+
+// pruneArchiveImages removes the archive images committed before the deadline which are not referenced
+func pruneArchiveImages(ctx context.Context, referenced map[string]struct{}, deadline time.Time) {
+	images, err := docker.Cli.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", "*"+archiveImageSuffix)),
+	})
+	if err != nil {
+		log.Errorf("services.pruneArchiveImages, docker.ImageList failed, error: %v", err)
+		return
+	}
+	for _, image := range images {
+		if time.Unix(image.Created, 0).After(deadline) {
+			continue
+		}
+		for _, tag := range image.RepoTags {
+			if _, ok := referenced[tag]; ok || !strings.Contains(tag, archiveImageSuffix+":") {
+				continue
+			}
+			if err = removeArchiveImage(ctx, tag); err != nil {
+				log.Errorf("services.pruneArchiveImages, image: %s remove failed, error: %v", tag, err)
+				continue
+			}
+			log.Infof("services.pruneArchiveImages, archive image: %s removed", tag)
+		}
+	}
+}
+
+// removeArchiveImage untags the archive image, the layers are removed with the last tag
+func removeArchiveImage(ctx context.Context, image string) error {
+	_, err := docker.Cli.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.Wrapf(err, "docker.ImageRemove failed, image: %s", image)
+	}
+	return nil
+}
+
+// purgeArchivedContainer removes the soft deleted container, its resources have been released when it was archived
+func (rs *ReplicaSetService) purgeArchivedContainer(name string, info *models.EtcdContainerInfo) error {
+	ctx := context.Background()
+	endVolumeUsage(ctx, info.Archive.ContainerName)
+	err := docker.Cli.ContainerRemove(ctx, info.Archive.ContainerName, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.WithMessage(err, "docker.ContainerRemove failed")
+	}
+	// the image and the logs are removed after the container, a failure leaves them to the next sweep
+	if len(info.Archive.Image) != 0 {
+		if err = removeArchiveImage(ctx, info.Archive.Image); err != nil {
+			log.Errorf("services.purgeArchivedContainer, %v", err)
+		}
+	}
+	if len(info.Archive.LogFile) != 0 {
+		if err = os.Remove(info.Archive.LogFile); err != nil && !os.IsNotExist(err) {
+			log.Errorf("services.purgeArchivedContainer, os.Remove failed, path: %s, error: %v", info.Archive.LogFile, err)
+		}
+	}
+
+	schedulers.GpuScheduler.RemoveJob(name)
+	schedulers.GpuScheduler.RemoveLabels(name)
+	vmap.ContainerVersionMap.Remove(name)
+	workQueue.Enqueue(etcd.DelKey{
+		Resource: etcd.Containers,
+		Key:      name,
+	})
+
+	notify.Emit(models.EventContainerDeleted, name, map[string]interface{}{
+		"containerName": info.Archive.ContainerName,
+		"archived":      true,
+	})
+	log.Infof("services.purgeArchivedContainer, archived container: %s removed", info.Archive.ContainerName)
+	return nil
+}
+
+// exportLogs writes the logs of the container to the archive directory and returns the path of the file
+func exportLogs(ctx context.Context, ctrVersionName string, tty bool) (string, error) {
+	if err := os.MkdirAll(cfg.ArchiveDir, 0755); err != nil {
+		return "", errors.Wrapf(err, "os.MkdirAll failed, dir: %s", cfg.ArchiveDir)
+	}
+	path := filepath.Join(cfg.ArchiveDir, ctrVersionName+".log")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "os.Create failed, path: %s", path)
+	}
+	defer f.Close()
+
+	logs, err := docker.Cli.ContainerLogs(ctx, ctrVersionName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "docker.ContainerLogs failed, name: %s", ctrVersionName)
+	}
+	defer logs.Close()
+
+	// the output of a tty container is not multiplexed
+	if tty {
+		_, err = io.Copy(f, logs)
+	} else {
+		_, err = stdcopy.StdCopy(f, f, logs)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "write logs failed, path: %s", path)
+	}
+	return path, nil
+}
+
+func ArchiveGcLoop(ctx context.Context, interval time.Duration) {
+	var rs ReplicaSetService
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rs.PruneArchivedContainers()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
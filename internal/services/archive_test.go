@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+)
+
+func TestPruneArchiveLogs(t *testing.T) {
+	deadline := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		file       string
+		modTime    time.Time
+		referenced bool
+		wantKept   bool
+	}{
+		{name: "expired", file: "foo-1.log", modTime: deadline.Add(-time.Minute)},
+		{name: "not expired", file: "foo-1.log", modTime: deadline.Add(time.Minute), wantKept: true},
+		{name: "referenced", file: "foo-1.log", modTime: deadline.Add(-time.Minute), referenced: true, wantKept: true},
+		{name: "not a log", file: "notes.txt", modTime: deadline.Add(-time.Minute), wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, []byte("logs"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, tt.modTime, tt.modTime); err != nil {
+				t.Fatal(err)
+			}
+			referenced := map[string]struct{}{}
+			if tt.referenced {
+				referenced[path] = struct{}{}
+			}
+			pruneArchiveLogs(dir, referenced, deadline)
+			if _, err := os.Stat(path); (err == nil) != tt.wantKept {
+				t.Errorf("pruneArchiveLogs() kept %s = %v, want %v", tt.file, err == nil, tt.wantKept)
+			}
+		})
+	}
+
+	// the directory is created by the first export
+	pruneArchiveLogs(filepath.Join(t.TempDir(), "missing"), nil, deadline)
+}
+
+func TestPruneArchiveImages(t *testing.T) {
+	deadline := time.Now().Add(-time.Hour)
+	images := []types.ImageSummary{
+		{ID: "sha256:1", RepoTags: []string{"foo-archive:1"}, Created: deadline.Add(-time.Minute).Unix()},
+		{ID: "sha256:2", RepoTags: []string{"foo-archive:2", "bar-archive:1"}, Created: deadline.Add(-time.Minute).Unix()},
+		{ID: "sha256:3", RepoTags: []string{"foo-archive:3"}, Created: deadline.Add(time.Minute).Unix()},
+		{ID: "sha256:4", RepoTags: []string{"my-archive-tool:latest"}, Created: deadline.Add(-time.Minute).Unix()},
+	}
+	var (
+		mu      sync.Mutex
+		removed []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/images/json"):
+			_ = json.NewEncoder(w).Encode(images)
+		case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/images/"):
+			name, _ := url.PathUnescape(r.URL.Path[strings.Index(r.URL.Path, "/images/")+len("/images/"):])
+			mu.Lock()
+			removed = append(removed, name)
+			mu.Unlock()
+			_ = json.NewEncoder(w).Encode([]types.ImageDeleteResponseItem{{Untagged: name}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *client.Client) { docker.Cli = old }(docker.Cli)
+	docker.Cli = cli
+
+	pruneArchiveImages(context.Background(), map[string]struct{}{"bar-archive:1": {}}, deadline)
+	sort.Strings(removed)
+	if want := []string{"foo-archive:1", "foo-archive:2"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed images = %v, want %v", removed, want)
+	}
+}
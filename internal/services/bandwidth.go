@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// The bandwidth is shaped by tc on the host side of the veth pair of the container,
+// the traffic leaving the host veth is received by the container, so the ingress of the container is shaped by tbf,
+// and the traffic entering the host veth is sent by the container, so the egress of the container is policed.
+// The veth is recreated whenever the container starts, so the shaping is applied after every start.
+
+const (
+	// containerInterface is the interface of the bridge network inside the container
+	containerInterface = "eth0"
+	// minBandwidthBurst is the min bytes of the bucket, a too small bucket can't reach the rate
+	minBandwidthBurst = 32 * 1024
+)
+
+// checkTc checks whether tc of iproute2 is installed on the host
+func checkTc() error {
+	if err := runTc("-V"); err != nil {
+		return errors.Wrapf(xerrors.NewTcNotAvailableError(), "error: %v", err)
+	}
+	return nil
+}
+
+// shapeBandwidth applies the bandwidth limit to the running container, the previous shaping is replaced
+func shapeBandwidth(ctx context.Context, id string, bw *models.NetworkBandwidth) error {
+	veth, err := hostVeth(ctx, id)
+	if err != nil {
+		return errors.WithMessage(err, "services.hostVeth failed")
+	}
+	clearShaping(veth)
+
+	if bw.Ingress > 0 {
+		err = runTc("qdisc", "add", "dev", veth, "root", "tbf", "rate", fmt.Sprintf("%dbit", bw.Ingress),
+			"burst", fmt.Sprintf("%db", bandwidthBurst(bw.Ingress)), "latency", "400ms")
+		if err != nil {
+			return errors.WithMessage(err, "shape ingress failed")
+		}
+	}
+	if bw.Egress > 0 {
+		if err = runTc("qdisc", "add", "dev", veth, "handle", "ffff:", "ingress"); err != nil {
+			clearShaping(veth)
+			return errors.WithMessage(err, "add ingress qdisc failed")
+		}
+		err = runTc("filter", "add", "dev", veth, "parent", "ffff:", "protocol", "all", "prio", "1", "u32", "match", "u32", "0", "0",
+			"police", "rate", fmt.Sprintf("%dbit", bw.Egress), "burst", fmt.Sprintf("%db", bandwidthBurst(bw.Egress)), "drop", "flowid", ":1")
+		if err != nil {
+			clearShaping(veth)
+			return errors.WithMessage(err, "shape egress failed")
+		}
+	}
+	log.Infof("services.shapeBandwidth, container: %s veth: %s is shaped, ingress: %dbit/s, egress: %dbit/s",
+		id, veth, bw.Ingress, bw.Egress)
+	return nil
+}
+
+// unshapeBandwidth removes the shaping of the container before it's removed, a stopped container has no veth
+func unshapeBandwidth(ctx context.Context, name string) {
+	resp, err := docker.Cli.ContainerInspect(ctx, name)
+	if err != nil || resp.State == nil || resp.State.Pid == 0 {
+		return
+	}
+	veth, err := hostVeth(ctx, name)
+	if err != nil {
+		log.Errorf("services.unshapeBandwidth, container: %s veth not found, error: %v", name, err)
+		return
+	}
+	clearShaping(veth)
+}
+
+// clearShaping deletes the qdiscs added by shapeBandwidth, the qdiscs that don't exist are ignored
+func clearShaping(veth string) {
+	_ = runTc("qdisc", "del", "dev", veth, "root")
+	_ = runTc("qdisc", "del", "dev", veth, "ingress")
+}
+
+// runTc runs tc with the args without a shell, the name of the veth is never interpreted
+func runTc(args ...string) error {
+	output, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "tc %s failed, output: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// hostVeth resolves the host side of the veth pair of the container,
+// the iflink of the interface inside the container is the ifindex of its peer on the host.
+func hostVeth(ctx context.Context, id string) (string, error) {
+	resp, err := docker.Cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return "", errors.Wrapf(err, "docker.ContainerInspect failed, id: %s", id)
+	}
+	if resp.State == nil || resp.State.Pid == 0 {
+		return "", errors.Errorf("container: %s is not running", id)
+	}
+
+	// the sysfs mounted in the container shows the interfaces of its network namespace, it's read through docker,
+	// so the pid of the container on the host is not needed
+	output, err := execInContainer(ctx, id, []string{"cat", fmt.Sprintf("/sys/class/net/%s/iflink", containerInterface)})
+	if err != nil {
+		return "", errors.WithMessagef(err, "container: %s has no veth, the network mode may be host or none", id)
+	}
+	iflink, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return "", errors.Wrapf(err, "container: %s iflink: %s is invalid", id, output)
+	}
+
+	links, err := filepath.Glob("/sys/class/net/*/ifindex")
+	if err != nil {
+		return "", errors.Wrap(err, "filepath.Glob failed")
+	}
+	for _, link := range links {
+		if ifindex, err := readSysInt(link); err == nil && ifindex == iflink {
+			return filepath.Base(filepath.Dir(link)), nil
+		}
+	}
+	return "", errors.Errorf("the peer of container: %s with ifindex: %d not found on host", id, iflink)
+}
+
+func readSysInt(path string) (int, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "os.ReadFile failed, path: %s", path)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(bytes)))
+}
+
+// bandwidthBurst returns the bytes sent in 100ms at the rate
+func bandwidthBurst(rate int64) int64 {
+	return max(rate/8/10, minBandwidthBurst)
+}
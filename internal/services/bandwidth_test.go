@@ -0,0 +1,22 @@
+package services
+
+import "testing"
+
+func TestBandwidthBurst(t *testing.T) {
+	tests := []struct {
+		name string
+		rate int64
+		want int64
+	}{
+		{name: "slow link keeps the min bucket", rate: 1_000_000, want: minBandwidthBurst},
+		{name: "100ms at 1gbit", rate: 1_000_000_000, want: 12_500_000},
+		{name: "at the min", rate: minBandwidthBurst * 80, want: minBandwidthBurst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bandwidthBurst(tt.rate); got != tt.want {
+				t.Errorf("bandwidthBurst(%d) = %d, want %d", tt.rate, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	// healthyTimeout is how long the new version has to become healthy
+	healthyTimeout = 2 * time.Minute
+	// stableDuration is how long the new version without a health check has to keep running
+	stableDuration = 5 * time.Second
+	// cutoverHookTimeout is how long the cutover hook has to respond
+	cutoverHookTimeout = 30 * time.Second
+)
+
+// blueGreenPatchContainer launches the new version alongside the old one with its own gpus and ports,
+// the old version is stopped and its gpus are released only after the new version is healthy and the cutover hook succeeds.
+// If anything fails, the old version keeps serving and the new one is removed.
+func (rs *ReplicaSetService) blueGreenPatchContainer(name string, spec *models.PatchRequest) (id, newContainerName string, err error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return id, newContainerName, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	// get the container info
+	ctx := context.Background()
+	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	if err != nil {
+		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+	}
+	info := &models.EtcdContainerInfo{}
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+
+	// both versions run at the same time, so they can't share anything that is held by the replicaSet
+	if info.GpuSlots > 0 || info.GpuShared || info.GpuMps {
+		return id, newContainerName, errors.Errorf("container: %s shares a gpu, blue/green patch is not supported", name)
+	}
+	for _, port := range info.Ports {
+		if port.HostPort != 0 {
+			return id, newContainerName, errors.Errorf("container: %s binds the fixed host port %d, blue/green patch is not supported", name, port.HostPort)
+		}
+	}
+
+	// the new version applies for its own gpus, the old version keeps serving with the current ones
+	oldUuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	gpuCount := len(oldUuids)
+	if spec.GpuPatch != nil {
+		gpuCount = spec.GpuPatch.GpuCount
+	}
+	var newUuids []string
+	if gpuCount > 0 {
+		newUuids, err = schedulers.GpuScheduler.ApplyConstrained(name, nil, gpuCount, info.GpuConstraints)
+		if err != nil {
+			return id, newContainerName, errors.WithMessage(err, "GpuScheduler.ApplyConstrained failed")
+		}
+		info.HostConfig.DeviceRequests = rs.newContainerResource(newUuids, infoDeviceOptions(info)).DeviceRequests
+		log.Infof("services.blueGreenPatchContainer, container: %s apply %d gpus for the new version, uuids: %+v", name, gpuCount, newUuids)
+	} else {
+		info.HostConfig.DeviceRequests = nil
+	}
+	defer func() {
+		if err != nil {
+			schedulers.GpuScheduler.Restore(newUuids)
+		}
+	}()
+
+	// update volume info
+	info, err = rs.patchVolume(spec.VolumePatch, info)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "patchVolume failed")
+	}
+	info = rs.patchEnv(spec.EnvPatch, info)
+	// the blue version keeps running beside the green one, so the ports it binds are conflicts
+	if err = rs.patchPorts(ctx, "", spec.PortPatch, info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "patchPorts failed")
+	}
+	if err = rs.patchImage(ctx, spec.ImagePatch, info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "patchImage failed")
+	}
+
+	// host ports of the new version are applied in runContainer
+	id, newContainerName, kv, err := rs.runContainerWith(ctx, name, info, runOptions{deferReadiness: true})
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "runContainer failed")
+	}
+	defer func() {
+		if err != nil {
+			rs.removeGreen(name, version, newContainerName)
+		}
+	}()
+
+	oldContainerName := info.ContainerName
+	if spec.ImagePatch == nil || spec.ImagePatch.CopyMerged {
+		err = copyWithRetry(ctx, etcd.Containers, oldContainerName, newContainerName, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+			return utils.CopyOldMergedToNewContainerMerged(ctx, oldContainerName, newContainerName, progress)
+		}, nil)
+		if err != nil {
+			return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		}
+	}
+
+	// the probe runs after the merged files are copied, the old version keeps serving until it passes
+	if err = awaitReadiness(ctx, &kv); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.awaitReadiness failed")
+	}
+
+	var newInfo models.EtcdContainerInfo
+	_ = json.Unmarshal([]byte(*kv.Value), &newInfo)
+	record := &models.CutoverRecord{
+		ReplicaSetName: name,
+		From:           ctrVersionName,
+		To:             newContainerName,
+		BoundPorts:     newInfo.BoundPorts,
+		Hook:           spec.CutoverHook,
+	}
+	defer func() {
+		record.Succeeded = err == nil
+		if err != nil {
+			record.Error = err.Error()
+		}
+		record.Time = time.Now().Format("2006-01-02 15:04:05")
+		workQueue.Enqueue(etcd.PutKeyValue{
+			Resource: etcd.Cutovers,
+			Key:      newContainerName,
+			Value:    record.Serialize(),
+		})
+	}()
+
+	if err = waitHealthy(ctx, newContainerName); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.waitHealthy failed")
+	}
+	if err = callCutoverHook(spec.CutoverHook, record); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.callCutoverHook failed")
+	}
+
+	// the traffic is on the new version, stop the old one and release its gpus
+	err = setToMergeMap(ctrVersionName, version)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "setToMergeMap failed")
+	}
+	// the gpus are released only after the old version is removed, it may still be running on them
+	if err := rs.DeleteContainerForUpdate(ctrVersionName); err != nil {
+		// the cutover is done, the old version will be removed by the next delete
+		log.Errorf("services.blueGreenPatchContainer, container: %s delete old version failed, its %d gpus are kept, error: %v",
+			ctrVersionName, len(oldUuids), err)
+	} else {
+		schedulers.GpuScheduler.Restore(oldUuids)
+		log.Infof("services.blueGreenPatchContainer, container: %s restore %d gpus of the old version, uuids: %+v",
+			ctrVersionName, len(oldUuids), oldUuids)
+	}
+
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Containers,
+		Key:      kv.Key,
+		Value:    kv.Value,
+	})
+
+	log.Infof("services.blueGreenPatchContainer, container: %s cut over from %s to %s successfully", name, ctrVersionName, newContainerName)
+	return
+}
+
+// removeGreen removes the new version which failed to take over, the version number is given back
+// unless a newer version has been created meanwhile
+func (rs *ReplicaSetService) removeGreen(name string, version int64, newContainerName string) {
+	if err := rs.DeleteContainerForUpdate(newContainerName); err != nil {
+		log.Errorf("services.removeGreen, container: %s delete failed, error: %v", newContainerName, err)
+	}
+	if _, newVersion, ok := splitVersionName(newContainerName); ok {
+		vmap.ContainerVersionMap.Release(name, newVersion)
+	}
+	log.Infof("services.removeGreen, container: %s removed, %s-%d keeps serving", newContainerName, name, version)
+}
+
+// waitHealthy waits until the container is healthy, the container without a health check
+// has to keep running for a while instead.
+func waitHealthy(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		resp, err := docker.Cli.ContainerInspect(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+		}
+		state := resp.State
+		if state == nil || !state.Running {
+			return errors.Errorf("container: %s is not running", name)
+		}
+		if state.Health != nil {
+			switch state.Health.Status {
+			case types.Healthy:
+				return nil
+			case types.Unhealthy:
+				return errors.Errorf("container: %s is unhealthy", name)
+			}
+		} else if time.Since(start) >= stableDuration {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("container: %s is not healthy in %s", name, healthyTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// callCutoverHook posts the record to the hook, it's skipped if the hook is empty
+func callCutoverHook(hook string, record *models.CutoverRecord) error {
+	if len(hook) == 0 {
+		return nil
+	}
+
+	client := &http.Client{Timeout: cutoverHookTimeout}
+	resp, err := client.Post(hook, "application/json", bytes.NewReader([]byte(*record.Serialize())))
+	if err != nil {
+		return errors.Wrapf(err, "http.Post failed, url: %s", hook)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("cutover hook returned status %d, url: %s", resp.StatusCode, hook)
+	}
+	return nil
+}
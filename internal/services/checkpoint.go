@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/commander-cli/cmd"
+	"github.com/docker/docker/api/types"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// The process state is checkpointed by CRIU through the experimental `docker checkpoint`.
+// CRIU can't dump the state on the gpu, so the cuda processes are suspended by cuda-checkpoint first,
+// which moves their gpu state into host memory, and they are resumed after restored.
+
+// CheckpointContainer checkpoints the process state of the latest version of the container,
+// if exit is true the container is stopped after the checkpoint.
+func (rs *ReplicaSetService) CheckpointContainer(name string, spec *models.CheckpointCreate) (*models.ContainerCheckpoint, error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.GetContainerInfo failed")
+	}
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	if err = checkCheckpointSupported(context.Background(), &info, len(uuids)); err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := rs.checkpoint(ctrVersionName, len(uuids) > 0, spec.Exit)
+	if err != nil {
+		return nil, err
+	}
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Checkpoints,
+		Key:      checkpoint.ID,
+		Value:    checkpoint.Serialize(),
+	})
+	return checkpoint, nil
+}
+
+// checkCheckpointSupported returns an unsupported error if the state of the container can't be checkpointed,
+// the gpus means the number of gpus used by the container.
+func checkCheckpointSupported(ctx context.Context, info *models.EtcdContainerInfo, gpus int) error {
+	dockerInfo, err := docker.Cli.Info(ctx)
+	if err != nil {
+		return errors.Wrap(err, "docker.Info failed")
+	}
+	if !dockerInfo.ExperimentalBuild {
+		return errors.Wrap(xerrors.NewCheckpointNotSupportedError(), "docker daemon is not running in experimental mode")
+	}
+	if info.GpuSlots > 0 || info.GpuShared || info.GpuMps {
+		return errors.Wrap(xerrors.NewCheckpointNotSupportedError(), "the state of a shared gpu can't be checkpointed")
+	}
+	if gpus > 0 && !cfg.CudaCheckpoint {
+		return errors.Wrap(xerrors.NewCheckpointNotSupportedError(), "the gpu state can't be checkpointed without cuda-checkpoint")
+	}
+	return nil
+}
+
+// checkpoint suspends the cuda processes if the container uses gpus, then checkpoints the container
+func (rs *ReplicaSetService) checkpoint(ctrVersionName string, cuda, exit bool) (*models.ContainerCheckpoint, error) {
+	ctx := context.Background()
+	var suspended []string
+	if cuda {
+		var err error
+		suspended, err = rs.toggleCudaProcesses(ctx, ctrVersionName, "running")
+		if err != nil {
+			return nil, errors.WithMessage(err, "services.toggleCudaProcesses failed")
+		}
+	}
+
+	checkpoint := &models.ContainerCheckpoint{
+		ID:         fmt.Sprintf("%s-%d", ctrVersionName, time.Now().Unix()),
+		Dir:        filepath.Join(cfg.CheckpointDir, strings.Split(ctrVersionName, "-")[0]),
+		Container:  ctrVersionName,
+		Cuda:       cuda,
+		Exit:       exit,
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	err := docker.Cli.CheckpointCreate(ctx, ctrVersionName, types.CheckpointCreateOptions{
+		CheckpointID:  checkpoint.ID,
+		CheckpointDir: checkpoint.Dir,
+		Exit:          exit,
+	})
+	if err != nil || !exit {
+		// the processes keep running in the container, resume them on the gpu
+		if _, toggleErr := rs.toggleCudaProcesses(ctx, ctrVersionName, "checkpointed"); toggleErr != nil {
+			log.Errorf("services.checkpoint, container: %s resume cuda processes: %v failed, error: %v",
+				ctrVersionName, suspended, toggleErr)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.CheckpointCreate failed, name: %s", ctrVersionName)
+	}
+
+	log.Infof("services.checkpoint, container: %s checkpointed, id: %s, dir: %s, cuda processes: %v",
+		ctrVersionName, checkpoint.ID, checkpoint.Dir, suspended)
+	return checkpoint, nil
+}
+
+// restoreFromCheckpoint starts the stopped container from the checkpoint, it's used to keep the old version serving
+func (rs *ReplicaSetService) restoreFromCheckpoint(ctrVersionName string, checkpoint *models.ContainerCheckpoint) error {
+	ctx := context.Background()
+	err := docker.Cli.ContainerStart(ctx, ctrVersionName, types.ContainerStartOptions{
+		CheckpointID:  checkpoint.ID,
+		CheckpointDir: checkpoint.Dir,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerStart failed, name: %s, checkpoint: %s", ctrVersionName, checkpoint.ID)
+	}
+	if checkpoint.Cuda {
+		if _, err = rs.toggleCudaProcesses(ctx, ctrVersionName, "checkpointed"); err != nil {
+			return errors.WithMessage(err, "services.toggleCudaProcesses failed")
+		}
+	}
+	return nil
+}
+
+// toggleCudaProcesses toggles the processes of the container which are in the state between running and checkpointed,
+// and returns the host pids toggled.
+func (rs *ReplicaSetService) toggleCudaProcesses(ctx context.Context, ctrVersionName, state string) ([]string, error) {
+	top, err := docker.Cli.ContainerTop(ctx, ctrVersionName, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerTop failed, name: %s", ctrVersionName)
+	}
+	pidIndex := -1
+	for i, title := range top.Titles {
+		if title == "PID" {
+			pidIndex = i
+			break
+		}
+	}
+	if pidIndex < 0 {
+		return nil, errors.Errorf("container: %s top has no PID column", ctrVersionName)
+	}
+
+	var toggled []string
+	for _, process := range top.Processes {
+		pid := process[pidIndex]
+		if _, err = strconv.Atoi(pid); err != nil {
+			continue
+		}
+		// the processes which don't use cuda report an error, they are skipped
+		c := cmd.NewCommand("cuda-checkpoint --get-state --pid " + pid)
+		if err = c.Execute(); err != nil || c.ExitCode() != 0 || strings.TrimSpace(c.Stdout()) != state {
+			continue
+		}
+		c = cmd.NewCommand("cuda-checkpoint --toggle --pid " + pid)
+		if err = c.Execute(); err != nil {
+			return toggled, errors.Wrapf(err, "cmd.Execute failed, pid: %s", pid)
+		}
+		if c.ExitCode() != 0 {
+			return toggled, errors.Errorf("cuda-checkpoint exit with code %d, pid: %s, output: %s", c.ExitCode(), pid, c.Combined())
+		}
+		toggled = append(toggled, pid)
+	}
+	return toggled, nil
+}
+
+// checkpointForPatch checkpoints and stops the old version before it's replaced by the new version
+func (rs *ReplicaSetService) checkpointForPatch(ctx context.Context, ctrVersionName string, spec *models.PatchRequest, info *models.EtcdContainerInfo) (*models.ContainerCheckpoint, error) {
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	// the restored cuda processes expect the same gpus as before
+	if len(uuids) > 0 && spec.GpuPatch != nil && spec.GpuPatch.GpuCount != len(uuids) {
+		return nil, errors.Wrapf(xerrors.NewCheckpointNotSupportedError(),
+			"the gpu count of container: %s can't be changed from %d to %d", ctrVersionName, len(uuids), spec.GpuPatch.GpuCount)
+	}
+	if err = checkCheckpointSupported(ctx, info, len(uuids)); err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := rs.checkpoint(ctrVersionName, len(uuids) > 0, true)
+	if err != nil {
+		return nil, err
+	}
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Checkpoints,
+		Key:      checkpoint.ID,
+		Value:    checkpoint.Serialize(),
+	})
+	return checkpoint, nil
+}
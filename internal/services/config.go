@@ -0,0 +1,65 @@
+package services
+
+import (
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// Config is the runtime configuration of services, it's set by command line flags at startup.
+type Config struct {
+	// HelperImage is the image of the short-lived container that used to copy data between volumes
+	// whose mountpoint is not accessible from the host, e.g. nfs volume.
+	HelperImage string
+	// CopyMaxAttempts is the max attempts of copying data from the old version to the new version
+	CopyMaxAttempts int
+	// CopyRetryBackoff is the wait time before the first retry, and it doubles after each retry
+	CopyRetryBackoff time.Duration
+	// CopyConcurrency is the max number of copies running at the same time, the others are queued, 0 means unlimited
+	CopyConcurrency int
+	// CopyWithCp copies the merged layers with cp instead of the native copy
+	CopyWithCp bool
+	// FrameworkEnv maps a framework to the envs injected for a fractional gpu or a MPS client, separated by ';',
+	// {fraction}, {percent}, {memoryMB} and {reservedMB} in the value are replaced with the share of the gpu,
+	// e.g. "XLA_PYTHON_CLIENT_MEM_FRACTION={fraction}", the envs of "mps" are injected into every MPS client
+	FrameworkEnv map[string]string
+	// AllowProfiler allows running privileged profiler containers against the managed containers
+	AllowProfiler bool
+	// MaxContainers is the max number of managed running containers on the host, 0 means unlimited
+	MaxContainers int
+	// EncryptionDir is the root directory of the encrypted filesystems of volumes
+	EncryptionDir string
+	// SecretDir is the directory where the secret store renders the keys of encrypted volumes, one file per key
+	SecretDir string
+	// CheckpointDir is the root directory of the checkpoints of containers
+	CheckpointDir string
+	// CudaCheckpoint means cuda-checkpoint is installed, so the containers using gpus can be checkpointed
+	CudaCheckpoint bool
+	// ArchiveDir is the directory of the logs exported by soft delete
+	ArchiveDir string
+	// ArchiveRetention is how long a soft deleted container is kept before it's removed
+	ArchiveRetention time.Duration
+	// GpuRuntimes are the runtimes that can run the containers requesting gpus, e.g. runc and nvidia
+	GpuRuntimes []string
+	// RegistryAuthFile is the credential file of the private registries written by docker login,
+	// empty means the images are pulled anonymously
+	RegistryAuthFile string
+	// DefaultShmSize is the bytes of /dev/shm of the containers using gpus if it's not requested, 0 means the default of docker
+	DefaultShmSize int64
+	// DockerTimeout bounds the docker calls of a request, 0 means no timeout
+	DockerTimeout time.Duration
+	// ExecTimeout bounds the output of a command executed by ExecuteContainer, 0 means no timeout
+	ExecTimeout time.Duration
+	// ReconcilePrune and ReconcileImport fix the mismatches between etcd and docker found at startup
+	ReconcilePrune  bool
+	ReconcileImport bool
+}
+
+var cfg Config
+
+func InitConfig(c Config) {
+	cfg = c
+	SetContainerLimit(c.MaxContainers)
+	SetCopyConcurrency(c.CopyConcurrency)
+	utils.SetCopyWithCp(c.CopyWithCp)
+}
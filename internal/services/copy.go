@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	// copyProgressInterval is the interval of saving the progress of a running copy to etcd
+	copyProgressInterval = 10 * time.Second
+	// copyMaxBackoff caps the wait time between the attempts of a copy
+	copyMaxBackoff = 5 * time.Minute
+)
+
+// runningCopies are the copies in progress, the key is the name of the new version
+var runningCopies sync.Map
+
+// copySlots limits the copies running at the same time, so that a burst of patches doesn't saturate the disk,
+// it's nil if the copies are not limited
+var (
+	copySlots    chan struct{}
+	activeCopies atomic.Int64
+	queuedCopies atomic.Int64
+)
+
+// SetCopyConcurrency sets the max number of copies running at the same time, 0 means unlimited
+func SetCopyConcurrency(n int) {
+	if n > 0 {
+		copySlots = make(chan struct{}, n)
+	}
+}
+
+// acquireCopySlot waits until a copy can run or ctx is done, the returned func releases the slot
+func acquireCopySlot(ctx context.Context, rc *runningCopy) (func(), error) {
+	if copySlots != nil {
+		select {
+		case copySlots <- struct{}{}:
+		default:
+			rc.Lock()
+			rc.record.Status = models.CopyQueued
+			rc.Unlock()
+			queuedCopies.Add(1)
+			select {
+			case copySlots <- struct{}{}:
+				queuedCopies.Add(-1)
+			case <-ctx.Done():
+				queuedCopies.Add(-1)
+				return nil, errors.Wrap(ctx.Err(), "wait for a copy slot")
+			}
+		}
+	}
+	rc.Lock()
+	rc.record.Status = models.CopyRunning
+	rc.Unlock()
+	activeCopies.Add(1)
+	return func() {
+		activeCopies.Add(-1)
+		if copySlots != nil {
+			<-copySlots
+		}
+	}, nil
+}
+
+// copyAttempt runs an attempt of the copy in a slot, the slot is released however the attempt ends
+func copyAttempt(ctx context.Context, rc *runningCopy, copyFn func(*utils.CopyProgress) (utils.CopyStats, error)) (utils.CopyStats, error) {
+	release, err := acquireCopySlot(ctx, rc)
+	if err != nil {
+		return utils.CopyStats{}, err
+	}
+	defer release()
+	return copyFn(rc.progress)
+}
+
+// GetCopyQueueStats returns the number of copies running and waiting for a slot
+func GetCopyQueueStats() *models.CopyQueueStats {
+	return &models.CopyQueueStats{
+		Limit:  cap(copySlots),
+		Active: activeCopies.Load(),
+		Queued: queuedCopies.Load(),
+	}
+}
+
+type runningCopy struct {
+	sync.Mutex
+	record   *models.CopyRecord
+	progress *utils.CopyProgress
+}
+
+// snapshot returns a copy of the record with the bytes counted so far
+func (rc *runningCopy) snapshot() *models.CopyRecord {
+	rc.Lock()
+	defer rc.Unlock()
+
+	record := *rc.record
+	record.Errors = append([]string(nil), rc.record.Errors...)
+	record.CopiedBytes, record.TotalBytes = rc.progress.Bytes()
+	return &record
+}
+
+// retriedFunc is called with the result of the retries run in the background after the first attempt of a copy failed
+type retriedFunc func(err error)
+
+// putCopyRecord puts the record of the copy to etcd, it's replaced by the tests
+var putCopyRecord = func(dest string, record *models.CopyRecord) error {
+	return etcd.Put(etcd.Copies, dest, record.Serialize())
+}
+
+// copyWithRetry copies the data from the old version to the new version,
+// it retries with exponential backoff until CopyMaxAttempts is reached, the failure that another attempt
+// can't fix, e.g. a canceled copy or a missing source, is not retried.
+// Every attempt is recorded in etcd by the name of the new version. The copy stops waiting for a slot or a retry
+// once ctx is done, the running attempt is stopped by copyFn itself.
+//
+// copyFn returns the files copied, skipped and cloned by reflink by the attempt, the copy that resumes from
+// the files copied by the previous attempts records the files skipped.
+// The bytes copied are saved to etcd periodically while the copy is running, see GetCopyProgress.
+// Each attempt waits for a slot of CopyConcurrency, and the slot is released during the backoff.
+//
+// Only the first attempt runs in the caller. If it failed and can be retried, the retries run in the background,
+// the CopyRetrying error is returned and retried is called with the result of the retries, so that the caller
+// completes or rolls back the new version then. If retried is nil, e.g. the caller rolls back the new version
+// as soon as the copy fails, all attempts run in the caller.
+func copyWithRetry(ctx context.Context, resource etcd.Resource, src, dest string,
+	copyFn func(*utils.CopyProgress) (utils.CopyStats, error), retried retriedFunc) error {
+	return startCopy(resource, src, dest).run(ctx, copyFn, retried)
+}
+
+// copyInBackground copies like copyWithRetry, but all the attempts run in the background and done is called
+// with the result. The new version is pending as soon as it returns, so it's not used until the copy is finished.
+func copyInBackground(resource etcd.Resource, src, dest string,
+	copyFn func(*utils.CopyProgress) (utils.CopyStats, error), done retriedFunc) {
+	rc := startCopy(resource, src, dest)
+	go func() {
+		done(rc.run(context.Background(), copyFn, nil))
+	}()
+}
+
+// startCopy records the copy as running, in memory and in etcd
+func startCopy(resource etcd.Resource, src, dest string) *runningCopy {
+	rc := &runningCopy{
+		record: &models.CopyRecord{
+			Resource:  resource,
+			Src:       src,
+			Dest:      dest,
+			Status:    models.CopyRunning,
+			StartTime: time.Now().Format("2006-01-02 15:04:05"),
+		},
+		progress: new(utils.CopyProgress),
+	}
+	runningCopies.Store(dest, rc)
+
+	// the running record marks the new version as pending, it's put before the copy starts,
+	// so that the new version is still pending if the copy is interrupted by a restart
+	if err := putCopyRecord(dest, rc.snapshot()); err != nil {
+		log.Errorf("services.copyWithRetry, put the record of copy %s to etcd failed, error: %v", dest, err)
+	}
+	return rc
+}
+
+// run runs the attempts of the copy recorded by startCopy, see copyWithRetry
+func (rc *runningCopy) run(ctx context.Context, copyFn func(*utils.CopyProgress) (utils.CopyStats, error), retried retriedFunc) error {
+	resource, dest := rc.record.Resource, rc.record.Dest
+
+	// the progress is put to etcd synchronously and stopped before the final record is put,
+	// so that a stale progress never overwrites the final record
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(copyProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := putCopyRecord(dest, rc.snapshot()); err != nil {
+				log.Errorf("services.copyWithRetry, put the progress of copy %s to etcd failed, error: %v", dest, err)
+			}
+		}
+	}()
+	finish := func(err error) {
+		close(stop)
+		<-stopped
+		rc.finish(err)
+		runningCopies.Delete(dest)
+	}
+
+	maxAttempts := max(cfg.CopyMaxAttempts, 1)
+	err := rc.attempt(ctx, 1, maxAttempts, copyFn)
+	if err == nil || !rc.retryable(ctx, err, 1, maxAttempts) {
+		finish(err)
+		return err
+	}
+	retry := func(err error) error {
+		backoff := cfg.CopyRetryBackoff
+		for attempt := 2; attempt <= maxAttempts; attempt++ {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff = min(backoff*2, copyMaxBackoff)
+			if err = rc.attempt(ctx, attempt, maxAttempts, copyFn); err == nil || !rc.retryable(ctx, err, attempt, maxAttempts) {
+				break
+			}
+		}
+		finish(err)
+		return err
+	}
+	if retried == nil {
+		return retry(err)
+	}
+
+	go func() {
+		retried(retry(err))
+	}()
+	return errors.Wrapf(xerrors.NewCopyRetryingError(), "copy %s to %s, error: %v", resource, dest, err)
+}
+
+// attempt runs an attempt of the copy and records it
+func (rc *runningCopy) attempt(ctx context.Context, attempt, maxAttempts int,
+	copyFn func(*utils.CopyProgress) (utils.CopyStats, error)) error {
+	rc.Lock()
+	rc.record.Attempts = attempt
+	rc.Unlock()
+	stats, err := copyAttempt(ctx, rc, copyFn)
+
+	rc.Lock()
+	defer rc.Unlock()
+	rc.record.CopiedFiles, rc.record.SkippedFiles = stats.Copied, stats.Skipped
+	rc.record.ClonedFiles = stats.Cloned
+	rc.record.Reflink = stats.Cloned > 0 && stats.Cloned == stats.Copied
+	if stats.Skipped > 0 {
+		rc.record.Resumed = true
+	}
+	if err != nil {
+		rc.record.Errors = append(rc.record.Errors, err.Error())
+		log.Errorf("services.copyWithRetry, copy %s from %s to %s failed, attempt: %d/%d, error: %v",
+			rc.record.Resource, rc.record.Src, rc.record.Dest, attempt, maxAttempts, err)
+	}
+	return err
+}
+
+// retryable means another attempt may fix the failed attempt
+func (rc *runningCopy) retryable(ctx context.Context, err error, attempt, maxAttempts int) bool {
+	if permanentCopyError(err) || ctx.Err() != nil {
+		log.Errorf("services.copyWithRetry, copy %s to %s is not retried, the error is permanent",
+			rc.record.Resource, rc.record.Dest)
+		return false
+	}
+	return attempt < maxAttempts
+}
+
+// finish records the result of the copy, the new version is not pending any more once it's finished
+func (rc *runningCopy) finish(err error) {
+	record := rc.snapshot()
+	record.Status = models.CopySucceeded
+	if err != nil {
+		record.Status = models.CopyFailed
+	}
+	record.EndTime = time.Now().Format("2006-01-02 15:04:05")
+	if putErr := putCopyRecord(record.Dest, record); putErr != nil {
+		log.Errorf("services.copyWithRetry, put the record of copy %s to etcd failed, it's queued, error: %v", record.Dest, putErr)
+		workQueue.Enqueue(etcd.PutKeyValue{
+			Resource: etcd.Copies,
+			Key:      record.Dest,
+			Value:    record.Serialize(),
+		})
+	}
+}
+
+// permanentCopyError means the copy fails the same way however many times it's retried
+func permanentCopyError(err error) bool {
+	cause := errors.Cause(err)
+	return errors.Is(cause, context.Canceled) || errors.Is(cause, os.ErrNotExist)
+}
+
+// getCopyProgress returns the record of the copy to the new version of the resource,
+// the bytes of a running copy are read from memory, others are read from etcd.
+func getCopyProgress(resource etcd.Resource, name string) (*models.CopyRecord, error) {
+	var record *models.CopyRecord
+	if v, ok := runningCopies.Load(name); ok {
+		record = v.(*runningCopy).snapshot()
+	} else {
+		bytes, err := etcd.GetValue(etcd.Copies, name)
+		if err != nil {
+			if xerrors.IsNotExistInEtcdError(err) {
+				return nil, xerrors.NewCopyNotFoundError()
+			}
+			return nil, errors.WithMessage(err, "etcd.GetValue failed")
+		}
+		record = new(models.CopyRecord)
+		if err = json.Unmarshal(bytes, record); err != nil {
+			return nil, errors.Wrapf(err, "json.Unmarshal failed, copy: %s", name)
+		}
+	}
+	if record.Resource != resource {
+		return nil, xerrors.NewCopyNotFoundError()
+	}
+	return record, nil
+}
+
+// copySources returns the sources of the unfinished copies of the resource, they are read while the copy runs,
+// so they must not be removed. Both the copies running in memory and the ones recorded in etcd are returned.
+func copySources(resource etcd.Resource) (map[string]struct{}, error) {
+	sources := make(map[string]struct{})
+	runningCopies.Range(func(_, v interface{}) bool {
+		if record := v.(*runningCopy).snapshot(); record.Resource == resource && !record.Finished() {
+			sources[record.Src] = struct{}{}
+		}
+		return true
+	})
+	kvs, err := listRecords(etcd.Copies)
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.List failed")
+	}
+	for dest, value := range kvs {
+		var record models.CopyRecord
+		if err = json.Unmarshal(value, &record); err != nil {
+			log.Errorf("services.copySources, the record of copy %s is invalid, error: %v", dest, err)
+			continue
+		}
+		if record.Resource == resource && !record.Finished() {
+			sources[record.Src] = struct{}{}
+		}
+	}
+	return sources, nil
+}
+
+// incompleteContainer marks the new version of the container as incomplete, because the copy failed
+func incompleteContainer(kv etcd.PutKeyValue) etcd.PutKeyValue {
+	var info models.EtcdContainerInfo
+	_ = json.Unmarshal([]byte(*kv.Value), &info)
+	info.Incomplete = true
+	kv.Value = info.Serialize()
+	return kv
+}
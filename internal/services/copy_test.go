@@ -0,0 +1,361 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+func newTestRunningCopy() *runningCopy {
+	return &runningCopy{record: &models.CopyRecord{Status: models.CopyRunning}, progress: new(utils.CopyProgress)}
+}
+
+// TestCopyAttempt runs more copies than the limit, at most limit of them run at the same time
+func TestCopyAttempt(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		copies int
+	}{
+		{name: "one at a time", limit: 1, copies: 4},
+		{name: "more copies than slots", limit: 2, copies: 8},
+		{name: "fewer copies than slots", limit: 4, copies: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetCopyConcurrency(tt.limit)
+			defer func() { copySlots = nil }()
+
+			var running, peak atomic.Int64
+			copyFn := func(*utils.CopyProgress) (utils.CopyStats, error) {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				running.Add(-1)
+				return utils.CopyStats{}, nil
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < tt.copies; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := copyAttempt(context.Background(), newTestRunningCopy(), copyFn); err != nil {
+						t.Errorf("copyAttempt() error = %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if want := int64(min(tt.limit, tt.copies)); peak.Load() > want {
+				t.Errorf("%d copies ran at the same time, want at most %d", peak.Load(), want)
+			}
+			if stats := GetCopyQueueStats(); stats.Active != 0 || stats.Queued != 0 {
+				t.Errorf("GetCopyQueueStats() = %+v, want no active or queued copies", stats)
+			}
+		})
+	}
+}
+
+// TestAcquireCopySlotCanceled stops waiting for a slot once ctx is done, the slot held is not leaked
+func TestAcquireCopySlotCanceled(t *testing.T) {
+	SetCopyConcurrency(1)
+	defer func() { copySlots = nil }()
+
+	release, err := acquireCopySlot(context.Background(), newTestRunningCopy())
+	if err != nil {
+		t.Fatalf("acquireCopySlot() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rc := newTestRunningCopy()
+	if _, err = acquireCopySlot(ctx, rc); err == nil {
+		t.Fatal("acquireCopySlot() with a canceled ctx succeeded, want an error")
+	}
+	if !permanentCopyError(err) {
+		t.Errorf("permanentCopyError(%v) = false, the canceled copy must not be retried", err)
+	}
+	if rc.record.Status != models.CopyQueued {
+		t.Errorf("status = %s, want %s", rc.record.Status, models.CopyQueued)
+	}
+
+	release()
+	release, err = acquireCopySlot(context.Background(), newTestRunningCopy())
+	if err != nil {
+		t.Fatalf("acquireCopySlot() after release error = %v", err)
+	}
+	release()
+	if stats := GetCopyQueueStats(); stats.Active != 0 || stats.Queued != 0 {
+		t.Errorf("GetCopyQueueStats() = %+v, want no active or queued copies", stats)
+	}
+}
+
+// TestCopyWithRetry fails the first attempts of a copy, the retries run in the background if retried is set
+func TestCopyWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		failures     int
+		failure      error
+		background   bool
+		wantErr      bool
+		wantRetrying bool
+		wantRetried  bool
+		wantAttempts int
+		wantStatus   models.CopyStatus
+	}{
+		{
+			name:         "succeeded at once",
+			maxAttempts:  3,
+			wantAttempts: 1,
+			wantStatus:   models.CopySucceeded,
+		},
+		{
+			name:         "2 failures then success in the caller",
+			maxAttempts:  3,
+			failures:     2,
+			failure:      errors.New("input/output error"),
+			wantAttempts: 3,
+			wantStatus:   models.CopySucceeded,
+		},
+		{
+			name:         "2 failures then success in the background",
+			maxAttempts:  3,
+			failures:     2,
+			failure:      errors.New("input/output error"),
+			background:   true,
+			wantErr:      true,
+			wantRetrying: true,
+			wantRetried:  true,
+			wantAttempts: 3,
+			wantStatus:   models.CopySucceeded,
+		},
+		{
+			name:         "attempts exhausted in the background",
+			maxAttempts:  3,
+			failures:     3,
+			failure:      errors.New("input/output error"),
+			background:   true,
+			wantErr:      true,
+			wantRetrying: true,
+			wantRetried:  true,
+			wantAttempts: 3,
+			wantStatus:   models.CopyFailed,
+		},
+		{
+			name:         "permanent error",
+			maxAttempts:  3,
+			failures:     3,
+			failure:      os.ErrNotExist,
+			background:   true,
+			wantErr:      true,
+			wantAttempts: 1,
+			wantStatus:   models.CopyFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(put func(string, *models.CopyRecord) error, c Config) {
+				putCopyRecord, cfg = put, c
+			}(putCopyRecord, cfg)
+			var mu sync.Mutex
+			var final *models.CopyRecord
+			putCopyRecord = func(dest string, record *models.CopyRecord) error {
+				mu.Lock()
+				defer mu.Unlock()
+				final = record
+				return nil
+			}
+			cfg.CopyMaxAttempts, cfg.CopyRetryBackoff = tt.maxAttempts, time.Millisecond
+
+			var attempts int
+			copyFn := func(*utils.CopyProgress) (utils.CopyStats, error) {
+				attempts++
+				if attempts <= tt.failures {
+					return utils.CopyStats{}, tt.failure
+				}
+				return utils.CopyStats{}, nil
+			}
+			done := make(chan error, 1)
+			var retried retriedFunc
+			if tt.background {
+				retried = func(err error) { done <- err }
+			}
+
+			err := copyWithRetry(context.Background(), etcd.Containers, "foo-1", "foo-2", copyFn, retried)
+			if (err != nil) != tt.wantErr || xerrors.IsCopyRetryingError(err) != tt.wantRetrying {
+				t.Fatalf("copyWithRetry() error = %v, wantErr %v, wantRetrying %v", err, tt.wantErr, tt.wantRetrying)
+			}
+			if tt.wantRetried {
+				select {
+				case err = <-done:
+				case <-time.After(time.Second):
+					t.Fatal("retried is not called")
+				}
+				if (err != nil) != (tt.wantStatus == models.CopyFailed) {
+					t.Errorf("retried() error = %v, want status %s", err, tt.wantStatus)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if final == nil || final.Attempts != tt.wantAttempts || final.Status != tt.wantStatus {
+				t.Errorf("final record = %+v, want %d attempts and status %s", final, tt.wantAttempts, tt.wantStatus)
+			}
+			if _, ok := runningCopies.Load("foo-2"); ok {
+				t.Error("the finished copy is still running")
+			}
+		})
+	}
+}
+
+// TestCopyInBackground asserts the new version is pending as soon as the copy is started, until it ends
+func TestCopyInBackground(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		wantErr    bool
+		wantStatus models.CopyStatus
+	}{
+		{name: "copied", wantStatus: models.CopySucceeded},
+		{name: "copied by a retry", failures: 1, wantStatus: models.CopySucceeded},
+		{name: "failed", failures: 2, wantErr: true, wantStatus: models.CopyFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(put func(string, *models.CopyRecord) error, c Config) {
+				putCopyRecord, cfg = put, c
+			}(putCopyRecord, cfg)
+			var mu sync.Mutex
+			var final *models.CopyRecord
+			putCopyRecord = func(dest string, record *models.CopyRecord) error {
+				mu.Lock()
+				defer mu.Unlock()
+				final = record
+				return nil
+			}
+			cfg.CopyMaxAttempts, cfg.CopyRetryBackoff = 2, time.Millisecond
+
+			release := make(chan struct{})
+			var attempts int
+			copyFn := func(*utils.CopyProgress) (utils.CopyStats, error) {
+				<-release
+				attempts++
+				if attempts <= tt.failures {
+					return utils.CopyStats{}, errors.New("input/output error")
+				}
+				return utils.CopyStats{}, nil
+			}
+			done := make(chan error, 1)
+			copyInBackground(etcd.Volumes, "bar-1", "bar-2", copyFn, func(err error) { done <- err })
+			if !pending("bar-2") {
+				t.Error("the new version is not pending while it's copied")
+			}
+			close(release)
+
+			select {
+			case err := <-done:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("done() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("done is not called")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if final == nil || final.Status != tt.wantStatus {
+				t.Errorf("final record = %+v, want status %s", final, tt.wantStatus)
+			}
+			if _, ok := runningCopies.Load("bar-2"); ok {
+				t.Error("the finished copy is still running")
+			}
+		})
+	}
+}
+
+// TestCopySources lists the sources of the unfinished volume copies, both running in memory and recorded in etcd
+func TestCopySources(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  []models.CopyRecord
+		recorded map[string]string
+		want     []string
+	}{
+		{
+			name:    "running",
+			running: []models.CopyRecord{{Resource: etcd.Volumes, Src: "foo-1", Dest: "foo-2", Status: models.CopyRunning}},
+			want:    []string{"foo-1"},
+		},
+		{
+			// the retries run in the background after the first attempt failed
+			name:    "queued for a retry",
+			running: []models.CopyRecord{{Resource: etcd.Volumes, Src: "foo-1", Dest: "foo-2", Status: models.CopyQueued}},
+			want:    []string{"foo-1"},
+		},
+		{
+			name:     "interrupted by a restart",
+			recorded: map[string]string{"bar-3": `{"resource":"volumes","src":"bar-2","dest":"bar-3","status":"running"}`},
+			want:     []string{"bar-2"},
+		},
+		{
+			name: "finished",
+			recorded: map[string]string{
+				"foo-2": `{"resource":"volumes","src":"foo-1","dest":"foo-2","status":"succeeded"}`,
+				"foo-3": `{"resource":"volumes","src":"foo-2","dest":"foo-3","status":"failed"}`,
+			},
+		},
+		{
+			name:     "container copies",
+			running:  []models.CopyRecord{{Resource: etcd.Containers, Src: "foo-1", Dest: "foo-2", Status: models.CopyRunning}},
+			recorded: map[string]string{"bar-2": `{"resource":"containers","src":"bar-1","dest":"bar-2","status":"running"}`},
+		},
+		{
+			name:     "invalid record",
+			recorded: map[string]string{"foo-2": `{`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.running {
+				runningCopies.Store(tt.running[i].Dest, &runningCopy{record: &tt.running[i], progress: new(utils.CopyProgress)})
+				defer runningCopies.Delete(tt.running[i].Dest)
+			}
+			defer func(list func(etcd.Resource) (map[string][]byte, error)) { listRecords = list }(listRecords)
+			listRecords = func(etcd.Resource) (map[string][]byte, error) {
+				kvs := make(map[string][]byte, len(tt.recorded))
+				for dest, value := range tt.recorded {
+					kvs[dest] = []byte(value)
+				}
+				return kvs, nil
+			}
+
+			sources, err := copySources(etcd.Volumes)
+			if err != nil {
+				t.Fatalf("copySources() error = %v", err)
+			}
+			got := make([]string, 0, len(sources))
+			for src := range sources {
+				got = append(got, src)
+			}
+			if want := append([]string{}, tt.want...); !reflect.DeepEqual(got, want) {
+				t.Errorf("copySources() = %v, want %v", got, want)
+			}
+		})
+	}
+}
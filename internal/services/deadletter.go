@@ -0,0 +1,74 @@
+package services
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+)
+
+type DeadLetterService struct{}
+
+// ListDeadLetters returns the WorkQueue items which failed after all attempts, the oldest first
+func (ds *DeadLetterService) ListDeadLetters() ([]*models.DeadLetter, error) {
+	kvs, err := etcd.List(etcd.DeadLetters)
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.List failed")
+	}
+
+	letters := make([]*models.DeadLetter, 0, len(kvs))
+	for key, value := range kvs {
+		var letter models.DeadLetter
+		if err = json.Unmarshal(value, &letter); err != nil {
+			log.Errorf("services.ListDeadLetters, dead letter: %s json.Unmarshal failed, error: %v", key, err)
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].ID < letters[j].ID
+	})
+	return letters, nil
+}
+
+func (ds *DeadLetterService) GetDeadLetter(id string) (*models.DeadLetter, error) {
+	value, err := etcd.GetValue(etcd.DeadLetters, id)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.DeadLetters, id))
+	}
+	var letter models.DeadLetter
+	if err = json.Unmarshal(value, &letter); err != nil {
+		return nil, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	return &letter, nil
+}
+
+// RequeueDeadLetter puts the item back to the WorkQueue with fresh attempts, and removes the dead letter
+func (ds *DeadLetterService) RequeueDeadLetter(id string) error {
+	letter, err := ds.GetDeadLetter(id)
+	if err != nil {
+		return errors.WithMessage(err, "services.GetDeadLetter failed")
+	}
+
+	// the letter is kept if the queue is full, so it can be requeued later
+	var item interface{} = etcd.DelKey{Resource: letter.Resource, Key: letter.Key}
+	if letter.Kind == models.DeadLetterPut {
+		item = etcd.PutKeyValue{Resource: letter.Resource, Key: letter.Key, Value: letter.Value}
+	}
+	if err = workQueue.TryEnqueue(item); err != nil {
+		return errors.WithMessage(err, "workQueue.TryEnqueue failed")
+	}
+
+	if err = etcd.Del(etcd.DeadLetters, id); err != nil {
+		return errors.WithMessagef(err, "etcd.Del failed, key: %s", etcd.ResourcePrefix(etcd.DeadLetters, id))
+	}
+
+	log.Infof("services.RequeueDeadLetter, dead letter: %s requeued, kind: %s, resource: %s, key: %s",
+		id, letter.Kind, letter.Resource, letter.Key)
+	return nil
+}
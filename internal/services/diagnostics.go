@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+type DiagnosticsService struct{}
+
+// Report collects the problems that need the attention of operators
+func (ds *DiagnosticsService) Report() (*models.DiagnosticsReport, error) {
+	kvs, err := etcd.List(etcd.Copies)
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.List failed")
+	}
+
+	report := &models.DiagnosticsReport{
+		FailedCopies: make([]*models.CopyRecord, 0),
+	}
+	for key, value := range kvs {
+		var record models.CopyRecord
+		if err = json.Unmarshal(value, &record); err != nil {
+			log.Errorf("services.Report, copy record: %s json.Unmarshal failed, error: %v", key, err)
+			continue
+		}
+		if record.Status == models.CopyFailed {
+			report.FailedCopies = append(report.FailedCopies, &record)
+		}
+	}
+
+	report.Ports, err = ds.CheckPorts(false)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.CheckPorts failed")
+	}
+	return report, nil
+}
+
+// CheckPorts compares the host ports recorded in etcd with the live bindings of the latest version of each container,
+// the stopped containers are compared by the recorded ports only when looking for conflicts.
+// If repair is true, the records are updated to the live bindings asynchronously.
+func (ds *DiagnosticsService) CheckPorts(repair bool) (*models.PortReport, error) {
+	kvs, err := etcd.List(etcd.Containers)
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.List failed")
+	}
+
+	ctx := context.Background()
+	report := &models.PortReport{
+		Mismatches: make([]*models.PortMismatch, 0),
+		Conflicts:  make([]*models.PortConflict, 0),
+		Repaired:   repair,
+	}
+	claims := make(map[string][]string)
+	for key, value := range kvs {
+		var info models.EtcdContainerInfo
+		if err = json.Unmarshal(value, &info); err != nil {
+			log.Errorf("services.CheckPorts, container: %s json.Unmarshal failed, error: %v", key, err)
+			continue
+		}
+
+		claimed := info.BoundPorts
+		resp, err := docker.Cli.ContainerInspect(ctx, info.ContainerName)
+		if err != nil {
+			if !client.IsErrNotFound(err) {
+				return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", info.ContainerName)
+			}
+		} else if resp.State != nil && resp.State.Running && resp.NetworkSettings != nil {
+			live := make(map[string]string, len(resp.NetworkSettings.Ports))
+			for k, bindings := range resp.NetworkSettings.Ports {
+				if len(bindings) > 0 {
+					live[string(k)] = bindings[0].HostPort
+				}
+			}
+			if !utils.EqualStringMap(info.BoundPorts, live) {
+				report.Mismatches = append(report.Mismatches, &models.PortMismatch{
+					Container: info.ContainerName,
+					Recorded:  info.BoundPorts,
+					Live:      live,
+				})
+				log.Infof("services.CheckPorts, container: %s recorded ports: %+v differ from live bindings: %+v",
+					info.ContainerName, info.BoundPorts, live)
+				if repair {
+					// the scheduler follows the live bindings first, so that the ports persisted are never applied again
+					schedulers.PortScheduler.Rebind(utils.StringMapValues(info.BoundPorts), utils.StringMapValues(live))
+					info.BoundPorts = live
+					workQueue.Enqueue(etcd.PutKeyValue{
+						Resource: etcd.Containers,
+						Key:      key,
+						Value:    info.Serialize(),
+					})
+				}
+			}
+			claimed = live
+		}
+
+		for _, hostPort := range claimed {
+			if len(hostPort) != 0 {
+				claims[hostPort] = append(claims[hostPort], info.ContainerName)
+			}
+		}
+	}
+
+	for hostPort, containers := range claims {
+		if len(containers) > 1 {
+			sort.Strings(containers)
+			report.Conflicts = append(report.Conflicts, &models.PortConflict{HostPort: hostPort, Containers: containers})
+			log.Errorf("services.CheckPorts, host port: %s is claimed by containers: %+v", hostPort, containers)
+		}
+	}
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		return report.Mismatches[i].Container < report.Mismatches[j].Container
+	})
+	sort.Slice(report.Conflicts, func(i, j int) bool {
+		return report.Conflicts[i].HostPort < report.Conflicts[j].HostPort
+	})
+	return report, nil
+}
+
+// PortCheckLoop repairs the host ports recorded in etcd periodically
+func PortCheckLoop(ctx context.Context, interval time.Duration) {
+	var ds DiagnosticsService
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := ds.CheckPorts(true); err != nil {
+				log.Errorf("services.PortCheckLoop, check ports failed, error: %v", err)
+			}
+		}
+	}
+}
+
+// GetVersionMaps returns the latest version of each container and volume in memory
+func (ds *DiagnosticsService) GetVersionMaps() *models.VersionMaps {
+	return &models.VersionMaps{
+		Containers: vmap.ContainerVersionMap.Snapshot(),
+		Volumes:    vmap.VolumeVersionMap.Snapshot(),
+	}
+}
+
+// RepairVersionMaps rebuilds the version maps from etcd and docker.
+// The latest version is the greater one of the version recorded in etcd and the latest version existing in docker,
+// the entries that neither etcd nor docker knows will be removed.
+func (ds *DiagnosticsService) RepairVersionMaps() (*models.VersionRepairReport, error) {
+	ctx := context.Background()
+
+	containers, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "docker.ContainerList failed")
+	}
+	containerNames := make([]string, 0, len(containers))
+	for _, ctr := range containers {
+		for _, name := range ctr.Names {
+			containerNames = append(containerNames, strings.TrimPrefix(name, "/"))
+		}
+	}
+	ctrCorrections, err := repairVersionMap(etcd.Containers, vmap.ContainerVersionMap, containerNames)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.repairVersionMap failed")
+	}
+
+	volumes, err := docker.Cli.VolumeList(ctx, volume.ListOptions{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "docker.VolumeList failed")
+	}
+	volumeNames := make([]string, 0, len(volumes.Volumes))
+	for _, vol := range volumes.Volumes {
+		volumeNames = append(volumeNames, vol.Name)
+	}
+	volCorrections, err := repairVersionMap(etcd.Volumes, vmap.VolumeVersionMap, volumeNames)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.repairVersionMap failed")
+	}
+
+	if len(ctrCorrections) != 0 || len(volCorrections) != 0 {
+		if err = vmap.SaveVersionMap(); err != nil {
+			return nil, errors.WithMessage(err, "version.SaveVersionMap failed")
+		}
+	}
+
+	return &models.VersionRepairReport{
+		Containers: ctrCorrections,
+		Volumes:    volCorrections,
+	}, nil
+}
+
+// ReconcileVersions repairs the version maps before serving, the maps are saved to etcd at shutdown,
+// so they are stale after a crash and the next version may collide with an existing container or volume.
+func ReconcileVersions() error {
+	var ds DiagnosticsService
+	report, err := ds.RepairVersionMaps()
+	if err != nil {
+		return errors.WithMessage(err, "services.RepairVersionMaps failed")
+	}
+	log.Infof("services.ReconcileVersions, %d container versions and %d volume versions corrected",
+		len(report.Containers), len(report.Volumes))
+	return nil
+}
+
+// versionMap is implemented by the ContainerVersionMap and VolumeVersionMap
+type versionMap interface {
+	Snapshot() map[string]int64
+	Set(string, int64)
+	Remove(string)
+}
+
+// listRecords lists the records of the resource in etcd, it's replaced by the tests
+var listRecords = etcd.List
+
+// repairVersionMap corrects the version map of the resource, the names are the resources existing in docker
+func repairVersionMap(resource etcd.Resource, vm versionMap, names []string) ([]*models.VersionCorrection, error) {
+	kvs, err := listRecords(resource)
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.List failed")
+	}
+
+	// the version recorded in etcd
+	recorded := make(map[string]int64, len(kvs))
+	for key, value := range kvs {
+		var info struct {
+			Version int64 `json:"version"`
+		}
+		if err = json.Unmarshal(value, &info); err != nil {
+			log.Errorf("services.repairVersionMap, %s: %s json.Unmarshal failed, error: %v", resource, key, err)
+			continue
+		}
+		recorded[key] = info.Version
+	}
+
+	// the latest version existing in docker
+	existing := make(map[string]int64, len(names))
+	for _, name := range names {
+		idx := strings.LastIndex(name, "-")
+		if idx <= 0 {
+			continue
+		}
+		version, err := strconv.ParseInt(name[idx+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		if version > existing[name[:idx]] {
+			existing[name[:idx]] = version
+		}
+	}
+
+	current := vm.Snapshot()
+	bases := make(map[string]struct{}, len(recorded)+len(current))
+	for base := range recorded {
+		bases[base] = struct{}{}
+	}
+	for base := range current {
+		bases[base] = struct{}{}
+	}
+
+	corrections := make([]*models.VersionCorrection, 0)
+	for base := range bases {
+		want, reason := recorded[base], "recorded in etcd"
+		if existing[base] > want {
+			want, reason = existing[base], "latest version existing in docker"
+		}
+		if current[base] == want {
+			continue
+		}
+
+		correction := &models.VersionCorrection{Name: base, Old: current[base], New: want, Reason: reason}
+		if want == 0 {
+			correction.Reason = "not found in etcd and docker"
+			vm.Remove(base)
+		} else {
+			vm.Set(base, want)
+		}
+		corrections = append(corrections, correction)
+		log.Infof("services.repairVersionMap, %s: %s version corrected from %d to %d, reason: %s",
+			resource, base, correction.Old, correction.New, correction.Reason)
+	}
+	return corrections, nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// TestRepairVersionMap simulates a restart, the version map saved at the last shutdown is stale,
+// the next container has to get the version after the greatest one in etcd and docker
+func TestRepairVersionMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		saved    map[string]int64
+		recorded map[string]string
+		existing []string
+		wantNext map[string]int64
+		wantGone []string
+	}{
+		{
+			name:     "nothing saved",
+			recorded: map[string]string{"foo": `{"version":2}`},
+			existing: []string{"foo-1", "foo-2"},
+			wantNext: map[string]int64{"foo": 3},
+		},
+		{
+			name:     "saved before the latest create",
+			saved:    map[string]int64{"foo": 1},
+			recorded: map[string]string{"foo": `{"version":3}`},
+			existing: []string{"foo-3"},
+			wantNext: map[string]int64{"foo": 4},
+		},
+		{
+			name:     "created in docker but not written to etcd",
+			saved:    map[string]int64{"foo": 2},
+			recorded: map[string]string{"foo": `{"version":2}`},
+			existing: []string{"foo-2", "foo-5", "foo-bar", "bar"},
+			wantNext: map[string]int64{"foo": 6},
+		},
+		{
+			name:     "base name with a dash",
+			recorded: map[string]string{"foo-bar": `{"version":1}`},
+			existing: []string{"foo-bar-1", "foo-bar-4"},
+			wantNext: map[string]int64{"foo-bar": 5},
+		},
+		{
+			name:     "up to date",
+			saved:    map[string]int64{"foo": 2},
+			recorded: map[string]string{"foo": `{"version":2}`},
+			existing: []string{"foo-2"},
+			wantNext: map[string]int64{"foo": 3},
+		},
+		{
+			name:     "deleted",
+			saved:    map[string]int64{"foo": 2, "bar": 1},
+			recorded: map[string]string{"bar": `{"version":1}`, "baz": `invalid`},
+			existing: []string{"bar-1"},
+			wantNext: map[string]int64{"bar": 2},
+			wantGone: []string{"foo", "baz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(list func(etcd.Resource) (map[string][]byte, error)) { listRecords = list }(listRecords)
+			listRecords = func(etcd.Resource) (map[string][]byte, error) {
+				kvs := make(map[string][]byte, len(tt.recorded))
+				for key, value := range tt.recorded {
+					kvs[key] = []byte(value)
+				}
+				return kvs, nil
+			}
+			vm := vmap.NewVersionMap()
+			for name, version := range tt.saved {
+				vm.Set(name, version)
+			}
+
+			if _, err := repairVersionMap(etcd.Containers, vm, tt.existing); err != nil {
+				t.Fatalf("repairVersionMap() error = %v", err)
+			}
+			for name, want := range tt.wantNext {
+				if got := vm.Next(name); got != want {
+					t.Errorf("Next(%s) after repair = %d, want %d", name, got, want)
+				}
+			}
+			for _, name := range tt.wantGone {
+				if vm.Exist(name) {
+					t.Errorf("%s exists after repair, want removed", name)
+				}
+			}
+		})
+	}
+}
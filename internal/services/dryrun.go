@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// PlanGpuContainer runs the checks of RunGpuContainer for the spec with DryRun and returns what would be created,
+// the schedulers are only queried, the image is not pulled, and nothing is created in docker or written to etcd.
+func (rs *ReplicaSetService) PlanGpuContainer(spec *models.ContainerRun) (*models.ContainerRunPlan, error) {
+	var hostConfig container.HostConfig
+	ctx, cancel := dockerContext()
+	defer cancel()
+
+	err := rs.preflight(ctx, spec, &hostConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	version, _ := vmap.ContainerVersionMap.Get(spec.ReplicaSetName)
+	plan := &models.ContainerRunPlan{
+		ContainerName: fmt.Sprintf("%s-%d", spec.ReplicaSetName, version+1),
+		DeviceIDs:     make([]string, 0),
+		Ports:         make(map[string]string),
+		Warnings:      make([]string, 0),
+	}
+
+	// the pull is the slowest step of a run, it's only reported
+	if spec.ForcePull {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("image: %s will be pulled again", spec.ImageName))
+	} else if _, _, err = docker.Cli.ImageInspectWithRaw(ctx, spec.ImageName); err != nil {
+		if !client.IsErrNotFound(err) {
+			return nil, errors.Wrapf(err, "docker.ImageInspectWithRaw failed, image: %s", spec.ImageName)
+		}
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("image: %s is not on the host, it will be pulled", spec.ImageName))
+	}
+
+	requests, err := setResourceLimits(spec, &hostConfig)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.setResourceLimits failed")
+	}
+	if requests != nil {
+		if err = schedulers.ResourceScheduler.Check(spec.ReplicaSetName, *requests); err != nil {
+			return nil, errors.Wrapf(err, "ResourceScheduler.Check failed, spec: %+v", spec)
+		}
+	}
+
+	if err = rs.planGpus(spec, plan); err != nil {
+		return nil, err
+	}
+	if err = rs.planPorts(ctx, spec, plan); err != nil {
+		return nil, err
+	}
+
+	if err = setBinds(&hostConfig, spec.Binds); err != nil {
+		return nil, errors.WithMessage(err, "services.setBinds failed")
+	}
+	if err = setShmSize(spec, &hostConfig); err != nil {
+		return nil, errors.WithMessage(err, "services.setShmSize failed")
+	}
+	plan.Binds = hostConfig.Binds
+	for i := range spec.Binds {
+		bind := &spec.Binds[i]
+		if bind.IsTmpfs() || bind.IsHostPath() {
+			continue
+		}
+		if _, err = docker.Cli.VolumeInspect(ctx, bind.Src); err != nil {
+			if !client.IsErrNotFound(err) {
+				return nil, errors.Wrapf(err, "docker.VolumeInspect failed, volume: %s", bind.Src)
+			}
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("volume: %s doesn't exist, docker will create it empty", bind.Src))
+		}
+	}
+	return plan, nil
+}
+
+// preflight runs the checks of the spec shared by RunGpuContainer and PlanGpuContainer, nothing is applied.
+// The runtime and the storage options are set to the host config.
+func (rs *ReplicaSetService) preflight(ctx context.Context, spec *models.ContainerRun, hostConfig *container.HostConfig) error {
+	exist, err := rs.existContainer(ctx, spec.ReplicaSetName)
+	if err != nil {
+		return errors.WithMessage(err, "services.existContainer failed")
+	}
+	if exist {
+		return errors.Wrapf(xerrors.NewContainerExistedError(spec.ReplicaSetName), "container %s", spec.ReplicaSetName)
+	}
+
+	// protect the host from too many containers, it's independent of the gpus
+	if err = checkContainerLimit(ctx); err != nil {
+		return errors.WithMessage(err, "services.checkContainerLimit failed")
+	}
+
+	if len(spec.Runtime) != 0 {
+		if err = checkRuntime(ctx, spec.Runtime, spec.GpuCount > 0 || spec.GpuFraction > 0 || len(spec.MigProfile) != 0); err != nil {
+			return errors.WithMessage(err, "services.checkRuntime failed")
+		}
+		hostConfig.Runtime = spec.Runtime
+	}
+
+	// the bandwidth is shaped only if requested, tc must be installed
+	if spec.NetworkBandwidth != nil && spec.NetworkBandwidth.Ingress == 0 && spec.NetworkBandwidth.Egress == 0 {
+		spec.NetworkBandwidth = nil
+	}
+	if spec.NetworkBandwidth != nil {
+		if err = checkTc(); err != nil {
+			return errors.WithMessage(err, "services.checkTc failed")
+		}
+	}
+
+	// limit the size of the container's writable layer
+	if len(spec.StorageOptSize) != 0 {
+		if err = rs.checkStorageOptSupported(ctx); err != nil {
+			return errors.WithMessage(err, "services.checkStorageOptSupported failed")
+		}
+		hostConfig.StorageOpt = map[string]string{"size": spec.StorageOptSize}
+	}
+
+	// the requested host ports must be free, otherwise docker fails to start the container after everything is applied
+	if err = checkHostPortConflicts(ctx, spec.Ports, ""); err != nil {
+		return errors.WithMessage(err, "services.checkHostPortConflicts failed")
+	}
+	return nil
+}
+
+// planGpus picks the gpus, the mig instances or the slots RunGpuContainer would apply for
+func (rs *ReplicaSetService) planGpus(spec *models.ContainerRun, plan *models.ContainerRunPlan) error {
+	switch {
+	case spec.GpuCount > 0 && len(spec.ReservationToken) != 0:
+		record, err := getReservation(tokenID(spec.ReservationToken), spec.GpuCount)
+		if err != nil {
+			return errors.WithMessage(err, "services.getReservation failed")
+		}
+		plan.DeviceIDs = record.Gpus
+	case spec.GpuCount > 0 && spec.GpuShared:
+		uuids, err := schedulers.GpuScheduler.PlanShared(spec.ReplicaSetName, spec.GpuCount, spec.GpuMaxSharers, spec.GpuMps)
+		if err != nil {
+			return errors.Wrapf(err, "GpuScheduler.PlanShared failed, spec: %+v", spec)
+		}
+		plan.DeviceIDs = uuids
+	case spec.GpuCount > 0 && schedulers.ExternalProviderEnabled():
+		plan.Warnings = append(plan.Warnings, "the gpus are decided by the external scheduler when the container is run")
+	case spec.GpuCount > 0:
+		uuids, err := schedulers.GpuScheduler.PlanConstrained(spec.GpuUUIDs, spec.GpuCount, spec.GpuConstraints)
+		if err != nil {
+			return errors.Wrapf(err, "GpuScheduler.PlanConstrained failed, spec: %+v", spec)
+		}
+		plan.DeviceIDs = uuids
+	}
+
+	if len(spec.MigProfile) != 0 {
+		uuids, err := schedulers.GpuScheduler.PlanMig(spec.ReplicaSetName, spec.MigProfile, spec.MigCount, spec.GpuLabels)
+		if err != nil {
+			return errors.Wrapf(err, "GpuScheduler.PlanMig failed, spec: %+v", spec)
+		}
+		plan.DeviceIDs = uuids
+	}
+
+	if spec.GpuFraction > 0 {
+		plan.GpuSlots = int(math.Round(spec.GpuFraction * float64(schedulers.GpuScheduler.SlotsPerGpu)))
+		uuid, err := schedulers.GpuScheduler.PlanFraction(spec.ReplicaSetName, plan.GpuSlots, spec.GpuLabels)
+		if err != nil {
+			return errors.Wrapf(err, "GpuScheduler.PlanFraction failed, spec: %+v", spec)
+		}
+		plan.DeviceIDs = []string{uuid}
+	}
+	return nil
+}
+
+// planPorts binds the requested host ports as requested and picks the rest from the port range
+func (rs *ReplicaSetService) planPorts(ctx context.Context, spec *models.ContainerRun, plan *models.ContainerRunPlan) error {
+	for _, port := range spec.Ports {
+		hostPort := ""
+		if port.HostPort != 0 {
+			hostPort = strconv.Itoa(port.HostPort)
+		}
+		plan.Ports[string(portKey(port))] = hostPort
+	}
+
+	var applyPorts []string
+	for _, port := range spec.ContainerPorts {
+		if _, ok := plan.Ports[string(containerPortKey(port))]; !ok {
+			applyPorts = append(applyPorts, string(containerPortKey(port)))
+			plan.Ports[string(containerPortKey(port))] = ""
+		}
+	}
+	if len(applyPorts) == 0 {
+		return nil
+	}
+	bound, err := rs.boundHostPorts(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "services.boundHostPorts failed")
+	}
+	hostPorts, err := schedulers.PortScheduler.PlanExclude(len(applyPorts), bound)
+	if err != nil {
+		return errors.Wrapf(err, "PortScheduler.PlanExclude failed, spec: %+v", spec)
+	}
+	for i, port := range applyPorts {
+		plan.Ports[port] = hostPorts[i]
+	}
+	return nil
+}
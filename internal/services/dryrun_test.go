@@ -0,0 +1,146 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// newFakeDockerAPI serves the containers, images and volumes on the host, the requests other than GET are recorded
+func newFakeDockerAPI(t *testing.T, containers []types.Container, images, volumes []string) *[]string {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		changes []string
+	)
+	found := func(names []string, name string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			mu.Lock()
+			changes = append(changes, r.Method+" "+r.URL.Path)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 3 && parts[1] == "containers" && parts[2] == "json":
+			_ = json.NewEncoder(w).Encode(containers)
+			return
+		case len(parts) >= 4 && parts[1] == "images" && parts[len(parts)-1] == "json":
+			if name := strings.Join(parts[2:len(parts)-1], "/"); found(images, name) {
+				_ = json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:" + name})
+				return
+			}
+		case len(parts) == 3 && parts[1] == "volumes":
+			if found(volumes, parts[2]) {
+				_ = json.NewEncoder(w).Encode(volume.Volume{Name: parts[2]})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "not found: " + r.URL.Path})
+	}))
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := docker.Cli
+	docker.Cli = cli
+	t.Cleanup(func() {
+		docker.Cli = old
+		_ = cli.Close()
+		server.Close()
+	})
+	return &changes
+}
+
+// TestPlanGpuContainer asserts the plan has no side effects, nothing is created in docker or queued to etcd
+func TestPlanGpuContainer(t *testing.T) {
+	tests := []struct {
+		name         string
+		containers   []types.Container
+		images       []string
+		volumes      []string
+		forcePull    bool
+		wantName     string
+		wantWarnings int
+		wantExisted  bool
+	}{
+		{name: "image and volume on the host", images: []string{"busybox"}, volumes: []string{"data"}, wantName: "foo-3"},
+		{name: "image is pulled", volumes: []string{"data"}, wantName: "foo-3", wantWarnings: 1},
+		{name: "image is pulled again", images: []string{"busybox"}, volumes: []string{"data"}, forcePull: true, wantName: "foo-3", wantWarnings: 1},
+		{name: "volume is created empty", images: []string{"busybox"}, wantName: "foo-3", wantWarnings: 1},
+		{
+			name:        "container exists",
+			containers:  []types.Container{{Names: []string{"/foo-2"}, Labels: map[string]string{managedLabel: "true"}}},
+			images:      []string{"busybox"},
+			wantExisted: true,
+		},
+	}
+	workQueue.InitWorkQueue(8)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := newFakeDockerAPI(t, tt.containers, tt.images, tt.volumes)
+			vmap.ContainerVersionMap = vmap.NewVersionMap()
+			vmap.ContainerVersionMap.Set("foo", 2)
+			enqueued := workQueue.GetStats().Enqueued
+
+			spec := &models.ContainerRun{
+				ReplicaSetName: "foo",
+				ImageName:      "busybox",
+				ForcePull:      tt.forcePull,
+				Binds:          []models.Bind{{Src: "data", Dest: "/data"}},
+				DryRun:         true,
+			}
+			plan, err := new(ReplicaSetService).PlanGpuContainer(spec)
+			if tt.wantExisted {
+				if !xerrors.IsContainerExistedError(err) {
+					t.Fatalf("PlanGpuContainer() error = %v, want container existed", err)
+				}
+			} else if err != nil {
+				t.Fatalf("PlanGpuContainer() error = %v", err)
+			} else {
+				if plan.ContainerName != tt.wantName {
+					t.Errorf("PlanGpuContainer() container name = %s, want %s", plan.ContainerName, tt.wantName)
+				}
+				if len(plan.Warnings) != tt.wantWarnings {
+					t.Errorf("PlanGpuContainer() warnings = %v, want %d", plan.Warnings, tt.wantWarnings)
+				}
+				if want := []string{"data:/data"}; !reflect.DeepEqual(plan.Binds, want) {
+					t.Errorf("PlanGpuContainer() binds = %v, want %v", plan.Binds, want)
+				}
+			}
+
+			if len(*changes) != 0 {
+				t.Errorf("PlanGpuContainer() changed docker: %v", *changes)
+			}
+			if got := workQueue.GetStats().Enqueued; got != enqueued {
+				t.Errorf("PlanGpuContainer() queued %d items to etcd", got-enqueued)
+			}
+			if got, _ := vmap.ContainerVersionMap.Get("foo"); got != 2 {
+				t.Errorf("PlanGpuContainer() version = %d, want 2", got)
+			}
+		})
+	}
+}
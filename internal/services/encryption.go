@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// An encrypted volume is a gocryptfs filesystem, the cipher directory holds the encrypted data at rest,
+// and the plain directory is the decrypted view which is bound to the local docker volume.
+// The key is a file rendered into the secret directory by the secret store (e.g. vault agent), it is never saved to etcd.
+
+const encryptionGocryptfs = "gocryptfs"
+
+func encryptionDir(volVersionName string) string {
+	return filepath.Join(cfg.EncryptionDir, volVersionName)
+}
+
+func cipherDir(volVersionName string) string {
+	return filepath.Join(encryptionDir(volVersionName), "cipher")
+}
+
+func plainDir(volVersionName string) string {
+	return filepath.Join(encryptionDir(volVersionName), "plain")
+}
+
+// keyFile returns the file of the key in the secret directory, the key must exist and not be empty
+func keyFile(keyID string) (string, error) {
+	if len(cfg.SecretDir) == 0 {
+		return "", errors.Wrap(xerrors.NewEncryptionKeyUnavailableError(), "secret dir is not configured")
+	}
+	path := filepath.Join(cfg.SecretDir, keyID)
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() || stat.Size() == 0 {
+		return "", errors.Wrapf(xerrors.NewEncryptionKeyUnavailableError(), "key id: %s", keyID)
+	}
+	return path, nil
+}
+
+// setupEncryption initializes and mounts the encrypted filesystem of the volume version,
+// and returns the driver options of the local volume which binds the plain directory.
+func setupEncryption(volVersionName string, enc *models.VolumeEncryption) (map[string]string, error) {
+	passfile, err := keyFile(enc.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, plain := cipherDir(volVersionName), plainDir(volVersionName)
+	for _, dir := range []string{cipher, plain} {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "os.MkdirAll failed, dir: %s", dir)
+		}
+	}
+	if err = execute("gocryptfs", "-init", "-q", "-passfile", passfile, cipher); err != nil {
+		_ = os.RemoveAll(encryptionDir(volVersionName))
+		return nil, errors.WithMessage(err, "gocryptfs init failed")
+	}
+	if err = mountEncryption(volVersionName, enc); err != nil {
+		_ = os.RemoveAll(encryptionDir(volVersionName))
+		return nil, err
+	}
+
+	enc.Type = encryptionGocryptfs
+	enc.CipherDir = cipher
+	return map[string]string{"type": "none", "o": "bind", "device": plain}, nil
+}
+
+// mountEncryption mounts the plain directory of the volume version if it's not mounted, e.g. after the host restarted
+func mountEncryption(volVersionName string, enc *models.VolumeEncryption) error {
+	plain := plainDir(volVersionName)
+	if execute("mountpoint", "-q", plain) == nil {
+		return nil
+	}
+	passfile, err := keyFile(enc.KeyID)
+	if err != nil {
+		return err
+	}
+	// other users is allowed, because the processes in the container may not run as root
+	if err = execute("gocryptfs", "-q", "-allow_other", "-passfile", passfile, cipherDir(volVersionName), plain); err != nil {
+		return errors.WithMessagef(err, "gocryptfs mount failed, volume: %s", volVersionName)
+	}
+	log.Infof("services.mountEncryption, encrypted volume: %s mounted on %s", volVersionName, plain)
+	return nil
+}
+
+func unmountEncryption(volVersionName string) error {
+	plain := plainDir(volVersionName)
+	if execute("mountpoint", "-q", plain) != nil {
+		return nil
+	}
+	if err := execute("fusermount", "-u", plain); err != nil {
+		return errors.WithMessagef(err, "fusermount failed, volume: %s", volVersionName)
+	}
+	log.Infof("services.unmountEncryption, encrypted volume: %s unmounted", volVersionName)
+	return nil
+}
+
+// removeEncryption unmounts the encrypted filesystem and removes the encrypted data of the volume version
+func removeEncryption(volVersionName string) error {
+	if !isEncrypted(volVersionName) {
+		return nil
+	}
+	if err := unmountEncryption(volVersionName); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(encryptionDir(volVersionName)); err != nil {
+		return errors.Wrapf(err, "os.RemoveAll failed, dir: %s", encryptionDir(volVersionName))
+	}
+	return nil
+}
+
+func isEncrypted(volVersionName string) bool {
+	if len(cfg.EncryptionDir) == 0 || strings.ContainsRune(volVersionName, filepath.Separator) {
+		return false
+	}
+	_, err := os.Stat(cipherDir(volVersionName))
+	return err == nil
+}
+
+// mountEncryptedBinds mounts the encrypted volumes bound by the container before it starts
+func (vs *VolumeService) mountEncryptedBinds(binds []string) error {
+	for _, bind := range binds {
+		src := strings.SplitN(bind, ":", 2)[0]
+		if !isEncrypted(src) {
+			continue
+		}
+		// the info of all versions is kept under the name without the version
+		info, err := vs.GetVolumeInfo(replicaSetOf(src))
+		if err != nil {
+			return errors.WithMessage(err, "services.GetVolumeInfo failed")
+		}
+		if info.Encryption == nil {
+			return errors.Errorf("volume: %s has no encryption info in etcd", src)
+		}
+		if err = mountEncryption(src, info.Encryption); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmountUnusedEncryption unmounts the encrypted volumes bound by a removed container which are not used
+// by any other container, so that the decrypted view is not left on the host.
+func (vs *VolumeService) unmountUnusedEncryption(ctx context.Context, binds []string) {
+	for _, bind := range binds {
+		name := strings.SplitN(bind, ":", 2)[0]
+		if !isEncrypted(name) {
+			continue
+		}
+		used, err := vs.volumeUsedBy(ctx, name, false)
+		if err != nil || len(used) > 0 {
+			continue
+		}
+		if err = unmountEncryption(name); err != nil {
+			log.Errorf("services.unmountUnusedEncryption, volume: %s unmount failed, error: %v", name, err)
+		}
+	}
+}
+
+// execute runs the command with the args without a shell, the paths and the key file are never interpreted
+func execute(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s %s failed, output: %s", name, strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
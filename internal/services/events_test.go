@@ -0,0 +1,105 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// TestVolumeEvents runs the volume operations on the versions foo-1 and foo-2, and checks the events streamed by them
+func TestVolumeEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      func(vs *VolumeService) error
+		want    []models.Event
+		wantErr bool
+	}{
+		{
+			name: "create",
+			op: func(vs *VolumeService) error {
+				_, err := vs.CreateVolume(&models.VolumeCreate{Name: "bar", Size: "10GB"})
+				return err
+			},
+			want: []models.Event{{Type: models.EventVolumeCreated, Name: "bar", Version: 1,
+				Data: map[string]interface{}{"volumeName": "bar-1", "size": "10GB"}}},
+		},
+		{
+			name: "create existed",
+			op: func(vs *VolumeService) error {
+				_, err := vs.CreateVolume(&models.VolumeCreate{Name: "foo"})
+				return err
+			},
+			wantErr: true,
+		},
+		{
+			name: "delete the latest",
+			op:   func(vs *VolumeService) error { return vs.DeleteVolume("foo", true, true) },
+			want: []models.Event{{Type: models.EventVolumeDeleted, Name: "foo", Version: 2,
+				Data: map[string]interface{}{"volumeName": "foo-2"}}},
+		},
+		{
+			// the versions deleted one by one are reported once by the deletion of all versions
+			name: "delete a version and keep the record",
+			op:   func(vs *VolumeService) error { return vs.DeleteVolume("foo-1", false, false) },
+		},
+		{
+			name: "delete all versions",
+			op: func(vs *VolumeService) error {
+				_, err := vs.DeleteAllVersions("foo", false)
+				return err
+			},
+			want: []models.Event{{Type: models.EventVolumeDeleted, Name: "foo",
+				Data: map[string]interface{}{"volumeNames": []string{"foo-1", "foo-2"}}}},
+		},
+		{
+			name:    "delete a missing version",
+			op:      func(vs *VolumeService) error { return vs.DeleteVolume("foo-3", false, true) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workQueue.InitWorkQueue(8)
+			newListDocker(t, nil, []listedResource{managed("foo", 1, nil), managed("foo", 2, nil)})
+			old := vmap.VolumeVersionMap
+			defer func() { vmap.VolumeVersionMap = old }()
+			vmap.VolumeVersionMap = vmap.NewVersionMap()
+			vmap.VolumeVersionMap.Set("foo", 2)
+			// the copies to the versions are finished, so they are not pending
+			for _, name := range []string{"foo-1", "foo-2"} {
+				runningCopies.Store(name, &runningCopy{
+					record:   &models.CopyRecord{Resource: etcd.Volumes, Dest: name, Status: models.CopySucceeded},
+					progress: new(utils.CopyProgress),
+				})
+				defer runningCopies.Delete(name)
+			}
+
+			events, cancel := notify.Subscribe(nil)
+			defer cancel()
+			if err := tt.op(new(VolumeService)); (err != nil) != tt.wantErr {
+				t.Fatalf("%s error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			got := make([]models.Event, 0)
+			for len(events) > 0 {
+				event := <-events
+				if len(event.Time) == 0 {
+					t.Errorf("event %s of %s has no time", event.Type, event.Name)
+				}
+				event.Time = ""
+				got = append(got, event)
+			}
+			if tt.want == nil {
+				tt.want = []models.Event{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s streamed %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// slowExec is the docker side of a hijacked exec connection, it writes the output after the delay and exits
+func slowExec(conn net.Conn, delay time.Duration, stdout, stderr string) {
+	defer conn.Close()
+	time.Sleep(delay)
+	_, _ = stdcopy.NewStdWriter(conn, stdcopy.Stdout).Write([]byte(stdout))
+	_, _ = stdcopy.NewStdWriter(conn, stdcopy.Stderr).Write([]byte(stderr))
+}
+
+func TestReadExecOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "fast", delay: 0, timeout: time.Second},
+		{name: "slow output", delay: 100 * time.Millisecond, timeout: time.Second},
+		{name: "no timeout", delay: 100 * time.Millisecond, timeout: 0},
+		{name: "slower than the timeout", delay: time.Second, timeout: 50 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go slowExec(server, tt.delay, "out", "err")
+			hijacked := types.HijackedResponse{Conn: client, Reader: bufio.NewReader(client)}
+			defer hijacked.Close()
+
+			stdout, stderr, err := readExecOutput(hijacked, tt.timeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readExecOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (stdout != "out" || stderr != "err") {
+				t.Errorf("readExecOutput() = %q, %q, want %q, %q", stdout, stderr, "out", "err")
+			}
+		})
+	}
+}
+
+// newExecDocker serves the exec api of docker, the commands are run on the host with the envs instead of in the container,
+// it returns the configs of the execs created
+func newExecDocker(t *testing.T) func() []types.ExecConfig {
+	t.Helper()
+	var (
+		mu        sync.Mutex
+		configs   = make(map[string]types.ExecConfig)
+		created   []types.ExecConfig
+		exitCodes = make(map[string]int)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case parts[1] == "containers" && parts[3] == "exec":
+			var config types.ExecConfig
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id := fmt.Sprintf("exec-%d", len(configs))
+			configs[id] = config
+			created = append(created, config)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(types.IDResponse{ID: id})
+		case parts[1] == "exec" && parts[3] == "start":
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Write([]byte("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.multiplexed-stream\r\n" +
+				"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n"))
+			config := configs[parts[2]]
+			c := exec.Command(config.Cmd[0], config.Cmd[1:]...)
+			c.Env = append(os.Environ(), config.Env...)
+			c.Stdout = stdcopy.NewStdWriter(conn, stdcopy.Stdout)
+			c.Stderr = stdcopy.NewStdWriter(conn, stdcopy.Stderr)
+			err = c.Run()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCodes[parts[2]] = exitErr.ExitCode()
+			} else if err != nil {
+				exitCodes[parts[2]] = 127
+			}
+		case parts[1] == "exec" && parts[3] == "json":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(types.ContainerExecInspect{ExecID: parts[2], ExitCode: exitCodes[parts[2]]})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := docker.Cli
+	docker.Cli = cli
+	t.Cleanup(func() {
+		docker.Cli = old
+		_ = cli.Close()
+		server.Close()
+	})
+	return func() []types.ExecConfig {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]types.ExecConfig(nil), created...)
+	}
+}
+
+func TestExecuteContainer(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not found")
+	}
+	tests := []struct {
+		name string
+		cmd  []string
+		want models.ExecResult
+		// the message of a command not found differs between the shells
+		ignoreStderr bool
+	}{
+		{name: "succeeded", cmd: []string{"sh", "-c", "echo foo"}, want: models.ExecResult{Stdout: "foo\n"}},
+		{name: "exit code 3", cmd: []string{"sh", "-c", "exit 3"}, want: models.ExecResult{ExitCode: 3}},
+		{name: "stderr", cmd: []string{"sh", "-c", "echo foo; echo bar >&2; exit 1"},
+			want: models.ExecResult{Stdout: "foo\n", Stderr: "bar\n", ExitCode: 1}},
+		{name: "command not found", cmd: []string{"sh", "-c", "gpu-docker-api-not-found"}, want: models.ExecResult{ExitCode: 127},
+			ignoreStderr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newExecDocker(t)
+			old := vmap.ContainerVersionMap
+			defer func() { vmap.ContainerVersionMap = old }()
+			vmap.ContainerVersionMap = vmap.NewVersionMap()
+			vmap.ContainerVersionMap.Set("foo", 1)
+
+			var rs ReplicaSetService
+			result, err := rs.ExecuteContainer("foo", &models.ContainerExecute{Cmd: tt.cmd})
+			if err != nil {
+				t.Fatalf("ExecuteContainer() error = %v", err)
+			}
+			if tt.ignoreStderr {
+				result.Stderr = ""
+			}
+			if *result != tt.want {
+				t.Errorf("ExecuteContainer() = %+v, want %+v", *result, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecConfig(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not found")
+	}
+	tests := []struct {
+		name       string
+		spec       models.ContainerExecute
+		wantStdout string
+		wantDir    string
+	}{
+		{name: "default", spec: models.ContainerExecute{Cmd: []string{"sh", "-c", `printf %s "$FOO"`}}, wantDir: "/"},
+		{
+			name:       "env",
+			spec:       models.ContainerExecute{Cmd: []string{"sh", "-c", `printf '%s %s' "$FOO" "$BAR"`}, Env: []string{"FOO=foo", "BAR=a b"}},
+			wantStdout: "foo a b",
+			wantDir:    "/",
+		},
+		{name: "user", spec: models.ContainerExecute{Cmd: []string{"true"}, User: "1000:1000"}, wantDir: "/"},
+		{name: "user and work dir", spec: models.ContainerExecute{Cmd: []string{"true"}, User: "nobody", WorkDir: "/tmp"}, wantDir: "/tmp"},
+		{name: "detach keys", spec: models.ContainerExecute{Cmd: []string{"true"}, DetachKeys: "ctrl-a,d"}, wantDir: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FOO", "")
+			created := newExecDocker(t)
+			old := vmap.ContainerVersionMap
+			defer func() { vmap.ContainerVersionMap = old }()
+			vmap.ContainerVersionMap = vmap.NewVersionMap()
+			vmap.ContainerVersionMap.Set("foo", 1)
+
+			var rs ReplicaSetService
+			result, err := rs.ExecuteContainer("foo", &tt.spec)
+			if err != nil {
+				t.Fatalf("ExecuteContainer() error = %v", err)
+			}
+			if result.Stdout != tt.wantStdout {
+				t.Errorf("ExecuteContainer() stdout = %q, want %q", result.Stdout, tt.wantStdout)
+			}
+			configs := created()
+			if len(configs) != 1 {
+				t.Fatalf("%d execs created, want 1", len(configs))
+			}
+			config := configs[0]
+			wantDetachKeys := tt.spec.DetachKeys
+			if len(wantDetachKeys) == 0 {
+				wantDetachKeys = defaultDetachKeys
+			}
+			if config.DetachKeys != wantDetachKeys {
+				t.Errorf("exec config detach keys = %q, want %q", config.DetachKeys, wantDetachKeys)
+			}
+			if !reflect.DeepEqual(config.Env, tt.spec.Env) || config.User != tt.spec.User || config.WorkingDir != tt.wantDir ||
+				!reflect.DeepEqual(config.Cmd, tt.spec.Cmd) {
+				t.Errorf("exec config = env: %v, user: %q, work dir: %q, cmd: %v, want env: %v, user: %q, work dir: %q, cmd: %v",
+					config.Env, config.User, config.WorkingDir, config.Cmd, tt.spec.Env, tt.spec.User, tt.wantDir, tt.spec.Cmd)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+)
+
+type GpuService struct{}
+
+// ListGpus returns the gpus on the host with their memory, utilization, NUMA node and health,
+// the containers of each gpu are derived from the device requests of the replicaSets saved in etcd.
+func (gs *GpuService) ListGpus() ([]*models.GpuDevice, error) {
+	devices, err := schedulers.QueryGpuDevices()
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.QueryGpuDevices failed")
+	}
+
+	kvs, err := listRecords(etcd.Containers)
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.List failed")
+	}
+
+	// the topology isn't necessary for the list, the nodes are unknown if it fails
+	topology, err := schedulers.QueryGpuTopology()
+	if err != nil {
+		log.Warnf("services.ListGpus, query gpu topology failed, error: %v", err)
+	}
+
+	assignGpus(devices, kvs, topology, schedulers.GpuScheduler.GetGpuHealth(), schedulers.GpuScheduler.GetGpuReservations())
+	return devices, nil
+}
+
+// assignGpus sets the NUMA node, health, owner and containers of the devices, the kvs are the replicaSets saved in etcd
+func assignGpus(devices []*models.GpuDevice, kvs map[string][]byte, topology map[string]schedulers.GpuTopology,
+	unhealthy map[string]string, reservations map[string]schedulers.GpuReservation) {
+	containers := make(map[string][]string)
+	for key, value := range kvs {
+		var info models.EtcdContainerInfo
+		if err := json.Unmarshal(value, &info); err != nil {
+			log.Errorf("services.ListGpus, container: %s json.Unmarshal failed, error: %v", key, err)
+			continue
+		}
+		// the gpus of a soft deleted container have been released
+		if info.Archive != nil {
+			continue
+		}
+		for _, uuid := range infoDeviceIDs(&info) {
+			containers[uuid] = append(containers[uuid], info.ContainerName)
+		}
+	}
+
+	for _, device := range devices {
+		device.NumaNode = -1
+		if t, ok := topology[device.UUID]; ok {
+			device.NumaNode = t.NumaNode
+		}
+		device.UnhealthyReason = unhealthy[device.UUID]
+		device.Healthy = len(device.UnhealthyReason) == 0
+		device.Owner = reservations[device.UUID].Owner
+		if names, ok := containers[device.UUID]; ok {
+			sort.Strings(names)
+			device.Containers = names
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+)
+
+// gpuRecord returns the etcd value of the container version with the gpus
+func gpuRecord(t *testing.T, name string, archived bool, uuids ...string) []byte {
+	t.Helper()
+	info := models.EtcdContainerInfo{
+		ContainerName: name,
+		HostConfig:    &container.HostConfig{},
+	}
+	if len(uuids) > 0 {
+		info.HostConfig.DeviceRequests = []container.DeviceRequest{{Driver: "nvidia", DeviceIDs: uuids}}
+	}
+	if archived {
+		info.Archive = &models.ContainerArchive{}
+	}
+	bytes, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes
+}
+
+func TestAssignGpus(t *testing.T) {
+	tests := []struct {
+		name           string
+		kvs            map[string][]byte
+		topology       map[string]schedulers.GpuTopology
+		unhealthy      map[string]string
+		reservations   map[string]schedulers.GpuReservation
+		wantContainers map[string][]string
+		wantOwners     map[string]string
+		wantNodes      map[string]int
+		wantUnhealthy  []string
+	}{
+		{
+			name:           "free",
+			kvs:            map[string][]byte{"foo": gpuRecord(t, "foo-1", false)},
+			wantContainers: map[string][]string{"GPU-a": {}, "GPU-b": {}},
+		},
+		{
+			name: "assigned",
+			kvs: map[string][]byte{
+				"foo": gpuRecord(t, "foo-2", false, "GPU-a", "GPU-b"),
+				"bar": gpuRecord(t, "bar-1", false, "GPU-c"),
+			},
+			reservations: map[string]schedulers.GpuReservation{
+				"GPU-a": {Owner: "foo"}, "GPU-b": {Owner: "foo"}, "GPU-c": {Owner: "bar"},
+			},
+			wantContainers: map[string][]string{"GPU-a": {"foo-2"}, "GPU-b": {"foo-2"}},
+			wantOwners:     map[string]string{"GPU-a": "foo", "GPU-b": "foo"},
+		},
+		{
+			name: "shared",
+			kvs: map[string][]byte{
+				"foo": gpuRecord(t, "foo-1", false, "GPU-a"),
+				"bar": gpuRecord(t, "bar-3", false, "GPU-a"),
+			},
+			wantContainers: map[string][]string{"GPU-a": {"bar-3", "foo-1"}, "GPU-b": {}},
+		},
+		{
+			name: "archived and invalid records",
+			kvs: map[string][]byte{
+				"foo": gpuRecord(t, "foo-1", true, "GPU-a"),
+				"bar": []byte("invalid"),
+			},
+			wantContainers: map[string][]string{"GPU-a": {}, "GPU-b": {}},
+		},
+		{
+			name:           "reserved by a token",
+			reservations:   map[string]schedulers.GpuReservation{"GPU-b": {Owner: "reservation-1"}},
+			wantContainers: map[string][]string{"GPU-a": {}, "GPU-b": {}},
+			wantOwners:     map[string]string{"GPU-b": "reservation-1"},
+		},
+		{
+			name:           "unhealthy",
+			unhealthy:      map[string]string{"GPU-a": "xid 79"},
+			wantContainers: map[string][]string{"GPU-a": {}, "GPU-b": {}},
+			wantUnhealthy:  []string{"GPU-a"},
+		},
+		{
+			name:           "topology",
+			topology:       map[string]schedulers.GpuTopology{"GPU-a": {Index: 0, NumaNode: 1}},
+			wantContainers: map[string][]string{"GPU-a": {}, "GPU-b": {}},
+			wantNodes:      map[string]int{"GPU-a": 1, "GPU-b": -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices := []*models.GpuDevice{
+				{Index: 0, UUID: "GPU-a", Containers: make([]string, 0)},
+				{Index: 1, UUID: "GPU-b", Containers: make([]string, 0)},
+			}
+			assignGpus(devices, tt.kvs, tt.topology, tt.unhealthy, tt.reservations)
+
+			containers, owners, nodes := make(map[string][]string), make(map[string]string), make(map[string]int)
+			unhealthy := make([]string, 0)
+			for _, device := range devices {
+				containers[device.UUID] = device.Containers
+				if len(device.Owner) != 0 {
+					owners[device.UUID] = device.Owner
+				}
+				nodes[device.UUID] = device.NumaNode
+				if !device.Healthy {
+					if device.UnhealthyReason != tt.unhealthy[device.UUID] {
+						t.Errorf("unhealthy reason of %s = %q, want %q", device.UUID, device.UnhealthyReason, tt.unhealthy[device.UUID])
+					}
+					unhealthy = append(unhealthy, device.UUID)
+				}
+			}
+			if !reflect.DeepEqual(containers, tt.wantContainers) {
+				t.Errorf("containers = %v, want %v", containers, tt.wantContainers)
+			}
+			if tt.wantOwners == nil {
+				tt.wantOwners = map[string]string{}
+			}
+			if !reflect.DeepEqual(owners, tt.wantOwners) {
+				t.Errorf("owners = %v, want %v", owners, tt.wantOwners)
+			}
+			if tt.wantNodes == nil {
+				tt.wantNodes = map[string]int{"GPU-a": -1, "GPU-b": -1}
+			}
+			if !reflect.DeepEqual(nodes, tt.wantNodes) {
+				t.Errorf("NUMA nodes = %v, want %v", nodes, tt.wantNodes)
+			}
+			if tt.wantUnhealthy == nil {
+				tt.wantUnhealthy = []string{}
+			}
+			if !reflect.DeepEqual(unhealthy, tt.wantUnhealthy) {
+				t.Errorf("unhealthy = %v, want %v", unhealthy, tt.wantUnhealthy)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// idempotencyTTL is how long the result of a create is replayed for the same key,
+// it covers the retries of a client after a timeout or a lost response
+const idempotencyTTL = 24 * time.Hour
+
+// keyLocks serializes the creates with the same idempotency key in this process,
+// the lock of a key is removed when no one holds or waits for it
+type keyLocks struct {
+	sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+var idempotencyLocks = &keyLocks{locks: make(map[string]*keyLock)}
+
+// lock locks the key and returns the function that unlocks it
+func (kl *keyLocks) lock(key string) func() {
+	kl.Lock()
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyLock{}
+		kl.locks[key] = l
+	}
+	l.refs++
+	kl.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(kl.locks, key)
+		}
+		kl.Unlock()
+	}
+}
+
+// getIdempotencyRecord returns the result of the create with the key, nil if it's not processed or expired
+func getIdempotencyRecord(key string) (*models.IdempotencyRecord, error) {
+	bytes, err := etcd.GetValue(etcd.Idempotencies, key)
+	if err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return nil, nil
+		}
+		return nil, errors.WithMessage(err, "etcd.GetValue failed")
+	}
+	var record models.IdempotencyRecord
+	if err = json.Unmarshal(bytes, &record); err != nil {
+		return nil, errors.Wrapf(err, "json.Unmarshal failed, key: %s", key)
+	}
+	return &record, nil
+}
+
+// putIdempotencyRecord records the result of a successful create, the container is already created,
+// so the failure is only logged, a retry with the key creates the container again and fails with container existed
+func putIdempotencyRecord(record *models.IdempotencyRecord) {
+	if err := etcd.PutWithTTL(etcd.Idempotencies, record.Key, record.Serialize(), idempotencyTTL); err != nil {
+		log.Errorf("services.putIdempotencyRecord, record the idempotency key: %s of container: %s failed, error: %+v",
+			record.Key, record.ContainerName, err)
+	}
+}
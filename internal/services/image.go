@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// pullMaxAttempts is the max attempts of pulling an image, docker keeps the layers already downloaded,
+	// so a retry resumes from them
+	pullMaxAttempts = 3
+	pullBackoff     = 2 * time.Second
+	// pullLogInterval is the interval of logging the progress of the downloading layers
+	pullLogInterval = 10 * time.Second
+
+	dockerHubRegistry = "docker.io"
+)
+
+// pullMessage is a line of the progress stream of docker pull
+type pullMessage struct {
+	Status   string `json:"status"`
+	ID       string `json:"id"`
+	Progress string `json:"progress"`
+	Error    string `json:"error"`
+}
+
+// dockerConfig is the credential file written by docker login, e.g. ~/.docker/config.json
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+}
+
+// ensureImage pulls the image if it's not on the host, or always if force is set, e.g. for a moving tag like latest
+func ensureImage(ctx context.Context, image string, force bool) error {
+	if !force {
+		_, _, err := docker.Cli.ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return errors.Wrapf(err, "docker.ImageInspectWithRaw failed, image: %s", image)
+		}
+	}
+
+	// a pull of a large image takes longer than the timeout of the docker calls, it's bounded by the attempts
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	backoff := pullBackoff
+	for attempt := 1; attempt <= pullMaxAttempts; attempt++ {
+		if err = pullImage(ctx, image); err == nil {
+			return nil
+		}
+		log.Errorf("services.ensureImage, pull image: %s failed, attempt: %d/%d, error: %v", image, attempt, pullMaxAttempts, err)
+		if permanentPullError(err) {
+			log.Errorf("services.ensureImage, pull image: %s is not retried, the error is permanent", image)
+			break
+		}
+		if attempt < pullMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return errors.Wrapf(xerrors.NewImagePullFailedError(), "image: %s, error: %v", image, err)
+}
+
+// permanentPullMessages are the failures of a pull reported in the stream that another attempt can't fix
+var permanentPullMessages = []string{
+	"not found",
+	"manifest unknown",
+	"does not exist",
+	"unauthorized",
+	"denied",
+	"invalid reference format",
+}
+
+// permanentPullError means the pull fails the same way however many times it's retried,
+// e.g. the image or its tag doesn't exist, or the registry rejects the credential
+func permanentPullError(err error) bool {
+	// errdefs looks through the wrapping errors, the cause of pkg/errors would strip the kind of the error
+	if errdefs.IsNotFound(err) || errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) || errdefs.IsInvalidParameter(err) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, permanent := range permanentPullMessages {
+		if strings.Contains(msg, permanent) {
+			return true
+		}
+	}
+	return false
+}
+
+func pullImage(ctx context.Context, image string) error {
+	auth, err := registryAuth(image)
+	if err != nil {
+		return errors.WithMessage(err, "services.registryAuth failed")
+	}
+
+	log.Infof("services.pullImage, image: %s is pulling", image)
+	reader, err := docker.Cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return errors.Wrapf(err, "docker.ImagePull failed, image: %s", image)
+	}
+	defer reader.Close()
+
+	// the failure of the pull is reported in the stream rather than the response
+	decoder := json.NewDecoder(reader)
+	lastLog := time.Now()
+	for {
+		var msg pullMessage
+		if err = decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrapf(err, "decode the pull progress failed, image: %s", image)
+		}
+		if len(msg.Error) != 0 {
+			return errors.Errorf("pull image: %s failed, error: %s", image, msg.Error)
+		}
+		// the progress of a downloading layer is reported many times a second
+		if len(msg.Progress) != 0 {
+			if time.Since(lastLog) < pullLogInterval {
+				continue
+			}
+			lastLog = time.Now()
+		}
+		log.Infof("services.pullImage, image: %s, layer: %s %s %s", image, msg.ID, msg.Status, msg.Progress)
+	}
+	log.Infof("services.pullImage, image: %s pulled successfully", image)
+	return nil
+}
+
+// registryAuth returns the encoded credential of the registry of the image from --registryAuthFile,
+// empty means the image is pulled anonymously.
+func registryAuth(image string) (string, error) {
+	if len(cfg.RegistryAuthFile) == 0 {
+		return "", nil
+	}
+	bytes, err := os.ReadFile(cfg.RegistryAuthFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "os.ReadFile failed, path: %s", cfg.RegistryAuthFile)
+	}
+	var conf dockerConfig
+	if err = json.Unmarshal(bytes, &conf); err != nil {
+		return "", errors.Wrapf(err, "json.Unmarshal failed, path: %s", cfg.RegistryAuthFile)
+	}
+
+	domain := imageRegistry(image)
+	for server, entry := range conf.Auths {
+		if normalizeRegistry(server) != domain {
+			continue
+		}
+		auth := registry.AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: server,
+		}
+		if len(entry.Auth) != 0 {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return "", errors.Wrapf(err, "decode the auth of registry: %s failed", server)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return registry.EncodeAuthConfig(auth)
+	}
+	return "", nil
+}
+
+// imageRegistry returns the registry of the image, the first component is a registry
+// only if it looks like a host, e.g. harbor.example.com/ai/pytorch or localhost:5000/pytorch.
+func imageRegistry(image string) string {
+	first, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		return dockerHubRegistry
+	}
+	return normalizeRegistry(first)
+}
+
+// normalizeRegistry strips the scheme and path of the server in the credential file,
+// the docker hub is saved as https://index.docker.io/v1/.
+func normalizeRegistry(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server, _, _ = strings.Cut(server, "/")
+	if server == "index.docker.io" || server == "registry-1.docker.io" {
+		return dockerHubRegistry
+	}
+	return server
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestPermanentPullError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "not found", err: errdefs.NotFound(errors.New("manifest for foo:bar not found")), want: true},
+		{name: "unauthorized", err: errdefs.Unauthorized(errors.New("authentication required")), want: true},
+		{name: "denied in the stream", err: errors.New("pull image: foo failed, error: pull access denied for foo"), want: true},
+		{name: "unknown manifest in the stream", err: errors.New("pull image: foo failed, error: manifest unknown"), want: true},
+		{name: "invalid reference", err: errdefs.InvalidParameter(errors.New("invalid reference format")), want: true},
+		{name: "reset connection", err: errors.New("read tcp: connection reset by peer")},
+		{name: "unavailable registry", err: errdefs.Unavailable(errors.New("service unavailable"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permanentPullError(tt.err); got != tt.want {
+				t.Errorf("permanentPullError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEnsureImagePermanent asserts a pull failed permanently is not retried
+func TestEnsureImagePermanent(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		stream string
+	}{
+		{name: "repository not found", status: http.StatusNotFound},
+		{name: "unauthorized", status: http.StatusUnauthorized},
+		{name: "denied in the stream", status: http.StatusOK, stream: `{"error":"pull access denied for private/train"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pulls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/images/create") {
+					pulls.Add(1)
+					w.WriteHeader(tt.status)
+					if tt.status != http.StatusOK {
+						_ = json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("status %d", tt.status)})
+						return
+					}
+					_, _ = w.Write([]byte(tt.stream))
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(map[string]string{"message": "no such image"})
+			}))
+			defer server.Close()
+			cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+			defer func(old *client.Client) { docker.Cli = old }(docker.Cli)
+			docker.Cli = cli
+
+			err = ensureImage(context.Background(), "private/train:v1", false)
+			if !xerrors.IsImagePullFailedError(err) {
+				t.Fatalf("ensureImage() error = %v, want image pull failed", err)
+			}
+			if got := pulls.Load(); got != 1 {
+				t.Errorf("ensureImage() pulled %d times, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+)
+
+const (
+	// defaultJobTimeout is the max time the job runs if the timeout is not requested
+	defaultJobTimeout = time.Hour
+	// maxJobOutput is the max bytes of stdout and stderr each, maxJobArtifacts is the max bytes of the artifacts
+	maxJobOutput    = 4 << 20
+	maxJobArtifacts = 64 << 20
+	// jobOwnerPrefix is the prefix of the gpu owner of a job, ':' is not allowed in container names,
+	// so a job never shares the owner with a replicaSet
+	jobOwnerPrefix = "job:"
+	// jobNamePrefix is the prefix of the container name of a job, the rest is 16 hex digits
+	jobNamePrefix = "job-"
+)
+
+var jobNameRegexp = regexp.MustCompile("^" + jobNamePrefix + "[0-9a-f]{16}$")
+
+// isJobName whether the container is the one of a job
+func isJobName(name string) bool {
+	return jobNameRegexp.MatchString(name)
+}
+
+type JobService struct{}
+
+// RunJob runs a one-off container and blocks until it exits, the job is killed if it runs beyond the timeout
+// or ctx is canceled, e.g. the client disconnects. The exit code, the output and the artifacts are collected
+// after the job exits, then the container is removed and the gpus are released.
+func (js *JobService) RunJob(ctx context.Context, spec *models.JobRun) (*models.JobResult, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, errors.Wrap(err, "rand.Read failed")
+	}
+	name := jobNamePrefix + hex.EncodeToString(raw)
+	result := &models.JobResult{Name: name}
+
+	// the job is not listed as a managed container, so it holds the reservation until it exits
+	release, err := reserveContainer(ctx, "")
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.reserveContainer failed")
+	}
+	defer release()
+	// pull the image before applying for the gpus, like a replicaSet
+	if err := ensureImage(ctx, spec.ImageName, false); err != nil {
+		return nil, errors.WithMessage(err, "services.ensureImage failed")
+	}
+
+	hostConfig := &container.HostConfig{}
+	if err := setBinds(hostConfig, spec.Binds); err != nil {
+		return nil, errors.WithMessage(err, "services.setBinds failed")
+	}
+	if spec.GpuCount > 0 {
+		owner := jobOwnerPrefix + name
+		uuids, err := schedulers.GpuScheduler.Apply(owner, spec.GpuCount)
+		if err != nil {
+			return nil, errors.Wrapf(err, "GpuScheduler.Apply failed, spec: %+v", spec)
+		}
+		defer schedulers.GpuScheduler.Restore(uuids)
+		var rs ReplicaSetService
+		hostConfig.DeviceRequests = rs.newContainerResource(uuids, nil).DeviceRequests
+		result.Gpus = uuids
+	}
+
+	resp, err := docker.Cli.ContainerCreate(ctx, &container.Config{
+		Image: spec.ImageName,
+		Cmd:   spec.Cmd,
+		Env:   spec.Env,
+	}, hostConfig, nil, nil, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerCreate failed, name: %s", name)
+	}
+	// AutoRemove would remove the container before the output and the artifacts are collected
+	defer func() {
+		if err := docker.Cli.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Errorf("services.RunJob, job: %s remove failed, error: %v", name, err)
+		}
+	}()
+
+	timeout := defaultJobTimeout
+	if spec.Timeout > 0 {
+		timeout = time.Duration(spec.Timeout) * time.Second
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	statusCh, errCh := docker.Cli.ContainerWait(waitCtx, resp.ID, container.WaitConditionNextExit)
+	if err = docker.Cli.ContainerStart(context.WithoutCancel(ctx), resp.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerStart failed, name: %s", name)
+	}
+	result.StartTime = time.Now().Format("2006-01-02 15:04:05")
+	log.Infof("services.RunJob, job: %s started, image: %s, gpus: %v, timeout: %s", name, spec.ImageName, result.Gpus, timeout)
+
+	select {
+	case status := <-statusCh:
+		result.ExitCode = status.StatusCode
+	case err = <-errCh:
+		if waitCtx.Err() == nil {
+			return nil, errors.Wrapf(err, "docker.ContainerWait failed, name: %s", name)
+		}
+		// the job is killed, its exit code is read after it stops
+		killCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+		exitCode, err := killJob(killCtx, resp.ID)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "services.killJob failed, name: %s", name)
+		}
+		if ctx.Err() != nil {
+			log.Infof("services.RunJob, job: %s killed with code %d, the request is canceled", name, exitCode)
+			return nil, errors.Wrapf(ctx.Err(), "job: %s is canceled", name)
+		}
+		result.TimedOut = true
+		result.ExitCode = exitCode
+	}
+	result.FinishTime = time.Now().Format("2006-01-02 15:04:05")
+	// the output is collected even if the client disconnects meanwhile
+	ctx = context.WithoutCancel(ctx)
+
+	if err = collectJobOutput(ctx, resp.ID, result); err != nil {
+		return nil, errors.WithMessagef(err, "services.collectJobOutput failed, name: %s", name)
+	}
+	if len(spec.ArtifactPath) != 0 {
+		if result.Artifacts, err = copyJobArtifacts(ctx, resp.ID, spec.ArtifactPath); err != nil {
+			return nil, errors.WithMessagef(err, "services.copyJobArtifacts failed, name: %s", name)
+		}
+	}
+
+	log.Infof("services.RunJob, job: %s exit with code %d, timed out: %v", name, result.ExitCode, result.TimedOut)
+	return result, nil
+}
+
+// killJob kills the job and returns its exit code after it stops
+func killJob(ctx context.Context, id string) (int64, error) {
+	statusCh, errCh := docker.Cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	if err := docker.Cli.ContainerKill(ctx, id, "SIGKILL"); err != nil {
+		return 0, errors.Wrapf(err, "docker.ContainerKill failed, id: %s", id)
+	}
+	select {
+	case status := <-statusCh:
+		return status.StatusCode, nil
+	case err := <-errCh:
+		return 0, errors.Wrapf(err, "docker.ContainerWait failed, id: %s", id)
+	}
+}
+
+func collectJobOutput(ctx context.Context, id string, result *models.JobResult) error {
+	logs, err := docker.Cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerLogs failed, id: %s", id)
+	}
+	defer logs.Close()
+
+	stdout, stderr := &cappedBuffer{max: maxJobOutput}, &cappedBuffer{max: maxJobOutput}
+	if _, err = stdcopy.StdCopy(stdout, stderr, logs); err != nil {
+		return errors.Wrapf(err, "stdcopy.StdCopy failed, id: %s", id)
+	}
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.OutputTruncated = stdout.truncated || stderr.truncated
+	return nil
+}
+
+// copyJobArtifacts copies the path out of the stopped container as a tar archive
+func copyJobArtifacts(ctx context.Context, id, path string) ([]byte, error) {
+	reader, _, err := docker.Cli.CopyFromContainer(ctx, id, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.CopyFromContainer failed, id: %s, path: %s", id, path)
+	}
+	defer reader.Close()
+
+	archive, err := io.ReadAll(io.LimitReader(reader, maxJobArtifacts+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read artifacts failed, id: %s, path: %s", id, path)
+	}
+	if len(archive) > maxJobArtifacts {
+		return nil, errors.Errorf("artifacts of path: %s exceed %d bytes", path, maxJobArtifacts)
+	}
+	return archive, nil
+}
+
+// cappedBuffer keeps the first max bytes written and discards the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if left := b.max - b.Len(); len(p) > left {
+		b.truncated = true
+		b.Buffer.Write(p[:max(left, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.Buffer.String() + fmt.Sprintf("\n... truncated to %d bytes", b.max)
+	}
+	return b.Buffer.String()
+}
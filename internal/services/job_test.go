@@ -0,0 +1,52 @@
+package services
+
+import "testing"
+
+func TestIsJobName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "job-0123456789abcdef", want: true},
+		{name: "job-0123456789abcde", want: false},
+		{name: "job-0123456789ABCDEF", want: false},
+		{name: "job-1", want: false},
+		{name: "myjob-0123456789abcdef", want: false},
+		{name: "job-0123456789abcdef-1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isJobName(tt.name); got != tt.want {
+				t.Errorf("isJobName(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		writes        []string
+		max           int
+		wantBytes     string
+		wantTruncated bool
+	}{
+		{name: "under the cap", writes: []string{"ab", "cd"}, max: 8, wantBytes: "abcd"},
+		{name: "at the cap", writes: []string{"abcd"}, max: 4, wantBytes: "abcd"},
+		{name: "over the cap", writes: []string{"ab", "cdef"}, max: 4, wantBytes: "abcd", wantTruncated: true},
+		{name: "after the cap", writes: []string{"abcd", "ef"}, max: 4, wantBytes: "abcd", wantTruncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &cappedBuffer{max: tt.max}
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := b.Buffer.String(); got != tt.wantBytes || b.truncated != tt.wantTruncated {
+				t.Errorf("cappedBuffer = %q, truncated: %v, want %q, %v", got, b.truncated, tt.wantBytes, tt.wantTruncated)
+			}
+		})
+	}
+}
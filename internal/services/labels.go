@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+)
+
+// the labels of the containers and volumes created by the service, so they can be told apart in docker
+const (
+	managedLabel  = "gpu-docker-api.managed"
+	baseNameLabel = "gpu-docker-api.base-name"
+	versionLabel  = "gpu-docker-api.version"
+)
+
+// setManagedLabels marks the version of the replicaSet or volume as managed, the labels copied from
+// the previous version are overwritten
+func setManagedLabels(labels map[string]string, base string, version int64) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string, 3)
+	}
+	labels[managedLabel] = "true"
+	labels[baseNameLabel] = base
+	labels[versionLabel] = strconv.FormatInt(version, 10)
+	return labels
+}
+
+// managedFilters matches the versions of the base name labeled by the service
+func managedFilters(base string) filters.Args {
+	return filters.NewArgs(
+		filters.KeyValuePair{Key: "label", Value: managedLabel + "=true"},
+		filters.KeyValuePair{Key: "label", Value: baseNameLabel + "=" + base},
+	)
+}
+
+// allManagedFilters matches all the containers and volumes labeled by the service
+func allManagedFilters() filters.Args {
+	return filters.NewArgs(filters.KeyValuePair{Key: "label", Value: managedLabel + "=true"})
+}
+
+// legacyFilters matches the versions of the base name by the name, the versions created before the labels have none.
+// The name filter of docker is a regexp matched against the name with and without the leading '/',
+// so the base name is quoted and the version must end the name, e.g. train doesn't match trainer-1 or train-a-1.
+func legacyFilters(base string) filters.Args {
+	return filters.NewArgs(filters.KeyValuePair{Key: "name", Value: fmt.Sprintf("^/?%s-[0-9]+$", regexp.QuoteMeta(base))})
+}
+
+// isVersionOf whether the name is a version of the base name
+func isVersionOf(name, base string) bool {
+	b, _, ok := splitVersionName(strings.TrimPrefix(name, "/"))
+	return ok && b == base
+}
+
+// listContainerVersions returns the containers of the versions of the replicaSet, the stopped ones are included if all is set
+func listContainerVersions(ctx context.Context, base string, all bool) ([]types.Container, error) {
+	labeled, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{All: all, Filters: managedFilters(base)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerList failed, base name: %s", base)
+	}
+	legacy, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{All: all, Filters: legacyFilters(base)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerList failed, base name: %s", base)
+	}
+	for _, ctr := range legacy {
+		// a labeled container matched by the name belongs to another replicaSet or is listed already
+		if _, ok := ctr.Labels[managedLabel]; ok || len(ctr.Names) == 0 || !isVersionOf(ctr.Names[0], base) {
+			continue
+		}
+		labeled = append(labeled, ctr)
+	}
+	return labeled, nil
+}
+
+// listVolumeVersions returns the volumes of the versions of the volume
+func listVolumeVersions(ctx context.Context, base string) ([]*volume.Volume, error) {
+	labeled, err := docker.Cli.VolumeList(ctx, volume.ListOptions{Filters: managedFilters(base)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.VolumeList failed, base name: %s", base)
+	}
+	legacy, err := docker.Cli.VolumeList(ctx, volume.ListOptions{Filters: legacyFilters(base)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.VolumeList failed, base name: %s", base)
+	}
+	volumes := labeled.Volumes
+	for _, vol := range legacy.Volumes {
+		if _, ok := vol.Labels[managedLabel]; ok || !isVersionOf(vol.Name, base) {
+			continue
+		}
+		volumes = append(volumes, vol)
+	}
+	return volumes, nil
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+)
+
+// listedResource is a container or volume listed by the fake docker, a volume is never stopped
+type listedResource struct {
+	name    string
+	labels  map[string]string
+	stopped bool
+}
+
+// newListDocker serves the list api of docker with the label and name filters, the names are matched like docker,
+// as a regexp against the name with and without the leading '/'. The volumes created and removed are listed accordingly.
+func newListDocker(t *testing.T, containers, volumes []listedResource) {
+	t.Helper()
+	var mu sync.Mutex
+	volumes = append([]listedResource(nil), volumes...)
+	matched := func(r *http.Request, resources []listedResource, all bool) ([]listedResource, error) {
+		args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+		if err != nil {
+			return nil, err
+		}
+		list := make([]listedResource, 0, len(resources))
+		for _, res := range resources {
+			if res.stopped && !all {
+				continue
+			}
+			if !args.MatchKVList("label", res.labels) {
+				continue
+			}
+			if args.Contains("name") && !args.Match("name", "/"+res.name) && !args.Match("name", res.name) {
+				continue
+			}
+			list = append(list, res)
+		}
+		return list, nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/volumes/create"):
+			var opt volume.CreateOptions
+			if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			volumes = append(volumes, listedResource{name: opt.Name, labels: opt.Labels})
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(volume.Volume{Name: opt.Name, Driver: opt.Driver, Labels: opt.Labels, Options: opt.DriverOpts})
+		case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/volumes/"):
+			name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			for i, res := range volumes {
+				if res.name == name {
+					volumes = append(volumes[:i], volumes[i+1:]...)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			list, err := matched(r, containers, r.URL.Query().Get("all") == "1")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp := make([]types.Container, 0, len(list))
+			for _, res := range list {
+				resp = append(resp, types.Container{Names: []string{"/" + res.name}, Labels: res.labels})
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		case strings.HasSuffix(r.URL.Path, "/volumes"):
+			list, err := matched(r, volumes, true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp := volume.ListResponse{Volumes: make([]*volume.Volume, 0, len(list))}
+			for _, res := range list {
+				resp.Volumes = append(resp.Volumes, &volume.Volume{Name: res.name, Labels: res.labels})
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := docker.Cli
+	docker.Cli = cli
+	t.Cleanup(func() {
+		docker.Cli = old
+		_ = cli.Close()
+		server.Close()
+	})
+}
+
+// managed returns the resource of the version created by the service
+func managed(base string, version int64, labels map[string]string) listedResource {
+	return listedResource{
+		name:   base + "-" + strconv.FormatInt(version, 10),
+		labels: setManagedLabels(labels, base, version),
+	}
+}
+
+func TestSetManagedLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		base    string
+		version int64
+		want    map[string]string
+	}{
+		{
+			name:    "no labels",
+			base:    "foo",
+			version: 1,
+			want:    map[string]string{managedLabel: "true", baseNameLabel: "foo", versionLabel: "1"},
+		},
+		{
+			name:    "user labels are kept",
+			labels:  map[string]string{"team": "infra"},
+			base:    "foo",
+			version: 2,
+			want:    map[string]string{"team": "infra", managedLabel: "true", baseNameLabel: "foo", versionLabel: "2"},
+		},
+		{
+			name:    "copied from the previous version",
+			labels:  map[string]string{managedLabel: "true", baseNameLabel: "foo", versionLabel: "2"},
+			base:    "foo",
+			version: 3,
+			want:    map[string]string{managedLabel: "true", baseNameLabel: "foo", versionLabel: "3"},
+		},
+		{
+			name:    "copied from another replicaSet",
+			labels:  map[string]string{managedLabel: "true", baseNameLabel: "foo", versionLabel: "5"},
+			base:    "bar",
+			version: 1,
+			want:    map[string]string{managedLabel: "true", baseNameLabel: "bar", versionLabel: "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := setManagedLabels(tt.labels, tt.base, tt.version); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setManagedLabels(%v, %s, %d) = %v, want %v", tt.labels, tt.base, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestListVersions creates the versions with the labels and lists them by the labels,
+// the versions created before the labels are listed by the name
+func TestListVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []listedResource
+		base      string
+		want      []string
+	}{
+		{
+			name:      "labeled",
+			resources: []listedResource{managed("foo", 1, nil), managed("foo", 2, map[string]string{"team": "infra"})},
+			base:      "foo",
+			want:      []string{"foo-1", "foo-2"},
+		},
+		{
+			name:      "legacy",
+			resources: []listedResource{{name: "foo-1"}, managed("foo", 2, nil)},
+			base:      "foo",
+			want:      []string{"foo-1", "foo-2"},
+		},
+		{
+			name:      "renamed",
+			resources: []listedResource{{name: "foo-1", labels: setManagedLabels(nil, "bar", 1)}, managed("bar", 2, nil)},
+			base:      "foo",
+			want:      []string{},
+		},
+		{
+			name:      "created by others",
+			resources: []listedResource{{name: "foo-1", labels: map[string]string{managedLabel: "false"}}, managed("foo", 2, nil)},
+			base:      "foo",
+			want:      []string{"foo-2"},
+		},
+		{
+			name:      "none",
+			resources: []listedResource{managed("bar", 1, nil)},
+			base:      "foo",
+			want:      []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newListDocker(t, tt.resources, tt.resources)
+
+			containers, err := listContainerVersions(context.Background(), tt.base, false)
+			if err != nil {
+				t.Fatalf("listContainerVersions() error = %v", err)
+			}
+			got := make([]string, 0, len(containers))
+			for _, ctr := range containers {
+				got = append(got, strings.TrimPrefix(ctr.Names[0], "/"))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listContainerVersions(%s) = %v, want %v", tt.base, got, tt.want)
+			}
+
+			volumes, err := listVolumeVersions(context.Background(), tt.base)
+			if err != nil {
+				t.Fatalf("listVolumeVersions() error = %v", err)
+			}
+			got = make([]string, 0, len(volumes))
+			for _, vol := range volumes {
+				got = append(got, vol.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listVolumeVersions(%s) = %v, want %v", tt.base, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistVersions(t *testing.T) {
+	// the base names overlap, job is a prefix of job2 and jobs, and job-a-1 looks like a version of job-a
+	resources := []listedResource{
+		managed("job2", 1, nil),
+		managed("jobs", 3, nil),
+		{name: "job2-2"},
+		{name: "jobs-4"},
+		{name: "job-a-1"},
+		{name: "myjob-1"},
+		{name: "job-x"},
+		{name: "stopped-1", stopped: true},
+		{name: "trainer-1", labels: setManagedLabels(nil, "trainer", 1), stopped: true},
+	}
+	tests := []struct {
+		base     string
+		want     bool
+		versions []string
+	}{
+		{base: "job", versions: []string{}},
+		{base: "job2", want: true, versions: []string{"job2-1", "job2-2"}},
+		{base: "jobs", want: true, versions: []string{"jobs-3", "jobs-4"}},
+		{base: "job-a", want: true, versions: []string{"job-a-1"}},
+		{base: "jo", versions: []string{}},
+		{base: "job.", versions: []string{}},
+		{base: "j.b2", versions: []string{}},
+		{base: "stopped", want: true, versions: []string{"stopped-1"}},
+		{base: "trainer", want: true, versions: []string{"trainer-1"}},
+		{base: "train", versions: []string{}},
+	}
+	newListDocker(t, resources, resources)
+	for _, tt := range tests {
+		t.Run(tt.base, func(t *testing.T) {
+			var rs ReplicaSetService
+			exist, err := rs.existContainer(context.Background(), tt.base)
+			if err != nil {
+				t.Fatalf("existContainer(%s) error = %v", tt.base, err)
+			}
+			if exist != tt.want {
+				t.Errorf("existContainer(%s) = %v, want %v", tt.base, exist, tt.want)
+			}
+			containers, err := listContainerVersions(context.Background(), tt.base, true)
+			if err != nil {
+				t.Fatalf("listContainerVersions(%s) error = %v", tt.base, err)
+			}
+			versions := make([]string, 0, len(containers))
+			for _, ctr := range containers {
+				versions = append(versions, strings.TrimPrefix(ctr.Names[0], "/"))
+			}
+			sort.Strings(versions)
+			if !reflect.DeepEqual(versions, tt.versions) {
+				t.Errorf("listContainerVersions(%s) = %v, want %v", tt.base, versions, tt.versions)
+			}
+
+			var vs VolumeService
+			exist, err = vs.existVolume(context.Background(), tt.base)
+			if err != nil {
+				t.Fatalf("existVolume(%s) error = %v", tt.base, err)
+			}
+			if exist != tt.want {
+				t.Errorf("existVolume(%s) = %v, want %v", tt.base, exist, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// containerLimit is the max number of managed running containers on the host, 0 means unlimited
+var containerLimit atomic.Int64
+
+// SetContainerLimit changes the max number of managed running containers at runtime,
+// it's not persisted, the flag is used again after restart.
+func SetContainerLimit(limit int) {
+	containerLimit.Store(int64(limit))
+}
+
+// containerReservations are the containers being created or started, they are counted as running
+// until they are started, so that the concurrent creates can't exceed the limit together
+var containerReservations struct {
+	sync.Mutex
+	reserved int
+}
+
+// GetContainerLimitStatus returns the number of managed running containers and the limit
+func GetContainerLimitStatus() (*models.ContainerLimitStatus, error) {
+	running, err := listManagedContainers(context.Background())
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.listManagedContainers failed")
+	}
+	containerReservations.Lock()
+	defer containerReservations.Unlock()
+	return &models.ContainerLimitStatus{
+		Limit:    int(containerLimit.Load()),
+		Running:  len(running),
+		Reserved: containerReservations.reserved,
+	}, nil
+}
+
+// checkContainerLimit returns an error if one more container exceeds the limit, nothing is reserved,
+// it fails the request early, before anything is applied for
+func checkContainerLimit(ctx context.Context) error {
+	release, err := reserveContainer(ctx, "")
+	release()
+	return err
+}
+
+// reserveContainer reserves a place for the container to be created or started, the caller releases it
+// after the container is started or failed to start. Nothing is reserved if the limit is 0
+// or the container replaces the running version replaced, e.g. the restart of a running container.
+func reserveContainer(ctx context.Context, replaced string) (release func(), err error) {
+	limit := int(containerLimit.Load())
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	containerReservations.Lock()
+	defer containerReservations.Unlock()
+
+	running, err := listManagedContainers(ctx)
+	if err != nil {
+		return func() {}, errors.WithMessage(err, "services.listManagedContainers failed")
+	}
+	if _, ok := running[replaced]; ok && len(replaced) != 0 {
+		return func() {}, nil
+	}
+	if len(running)+containerReservations.reserved >= limit {
+		return func() {}, errors.Wrapf(xerrors.NewContainerLimitReachedError(), "running: %d, reserved: %d, limit: %d",
+			len(running), containerReservations.reserved, limit)
+	}
+	containerReservations.reserved++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			containerReservations.Lock()
+			containerReservations.reserved--
+			containerReservations.Unlock()
+		})
+	}, nil
+}
+
+// listManagedContainers lists the running containers which are a version of a replicaSet, it's replaced by the tests
+var listManagedContainers = runningManagedContainers
+
+func runningManagedContainers(ctx context.Context) (map[string]struct{}, error) {
+	list, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "docker.ContainerList failed")
+	}
+
+	versions := vmap.ContainerVersionMap.Snapshot()
+	running := make(map[string]struct{}, len(list))
+	for _, ctr := range list {
+		for _, name := range ctr.Names {
+			name = strings.TrimPrefix(name, "/")
+			idx := strings.LastIndex(name, "-")
+			if idx <= 0 {
+				continue
+			}
+			if _, ok := versions[name[:idx]]; ok {
+				running[name] = struct{}{}
+				break
+			}
+		}
+	}
+	return running, nil
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestReserveContainer(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		running  []string
+		reserved int
+		replaced string
+		wantErr  bool
+	}{
+		{name: "unlimited", running: []string{"foo-1", "bar-1"}, reserved: 3},
+		{name: "under the limit", limit: 2, running: []string{"foo-1"}},
+		{name: "limit reached by running", limit: 2, running: []string{"foo-1", "bar-1"}, wantErr: true},
+		{name: "limit reached by reserved", limit: 2, running: []string{"foo-1"}, reserved: 1, wantErr: true},
+		{name: "replaces a running version", limit: 2, running: []string{"foo-1", "bar-1"}, replaced: "foo-1"},
+		{name: "replaces a stopped version", limit: 2, running: []string{"foo-1", "bar-1"}, replaced: "baz-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(list func(context.Context) (map[string]struct{}, error)) {
+				listManagedContainers = list
+				SetContainerLimit(0)
+			}(listManagedContainers)
+			listManagedContainers = func(context.Context) (map[string]struct{}, error) {
+				running := make(map[string]struct{}, len(tt.running))
+				for _, name := range tt.running {
+					running[name] = struct{}{}
+				}
+				return running, nil
+			}
+			SetContainerLimit(tt.limit)
+
+			var releases []func()
+			defer func() {
+				for _, release := range releases {
+					release()
+				}
+			}()
+			for i := 0; i < tt.reserved; i++ {
+				release, err := reserveContainer(context.Background(), "")
+				if err != nil {
+					t.Fatalf("reserveContainer() #%d error = %v", i, err)
+				}
+				releases = append(releases, release)
+			}
+
+			release, err := reserveContainer(context.Background(), tt.replaced)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reserveContainer(%q) error = %v, wantErr %v", tt.replaced, err, tt.wantErr)
+			}
+			if tt.wantErr && !xerrors.IsContainerLimitReachedError(err) {
+				t.Errorf("reserveContainer(%q) error = %v, want limit reached", tt.replaced, err)
+			}
+			before := containerReservations.reserved
+			release()
+			release()
+			if want := before - 1; !tt.wantErr && tt.limit > 0 && len(tt.replaced) == 0 && containerReservations.reserved != want {
+				t.Errorf("reserved after release = %d, want %d", containerReservations.reserved, want)
+			}
+		})
+	}
+}
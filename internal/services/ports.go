@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// portProtocol returns the protocol of the port, tcp if it's not set
+func portProtocol(port models.Port) string {
+	if len(port.Protocol) == 0 {
+		return models.ProtocolTcp
+	}
+	return port.Protocol
+}
+
+// checkHostPortConflicts fails if a requested host port is bound by another container or a process on the host,
+// so that the create fails with the port named instead of a confusing error of docker start.
+// The ports bound by the versions of self are not conflicts, the current version is replaced by the new one,
+// self is empty if no version is replaced, e.g. for a create or a blue/green patch.
+func checkHostPortConflicts(ctx context.Context, ports []models.Port, self string) error {
+	var requested []models.Port
+	for _, port := range ports {
+		if port.HostPort != 0 {
+			requested = append(requested, port)
+		}
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+
+	holders, err := publishedHostPorts(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "services.publishedHostPorts failed")
+	}
+	unpublished, err := checkPublishedPorts(requested, holders, self)
+	if err != nil {
+		return err
+	}
+	for _, port := range unpublished {
+		protocol := portProtocol(port)
+		if err = listenHostPort(port.HostPort, protocol); err != nil {
+			return errors.Wrapf(xerrors.NewPortConflictError(), "host port: %d/%s is in use on the host, error: %v",
+				port.HostPort, protocol, err)
+		}
+	}
+	return nil
+}
+
+// publishedHostPorts returns the container publishing each host port, the key is like 8080/tcp.
+// The ports of the running containers are listed directly, the stopped containers are inspected,
+// because they bind their ports again when started.
+func publishedHostPorts(ctx context.Context) (map[string]string, error) {
+	list, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, errors.WithMessage(err, "docker.ContainerList failed")
+	}
+	holders := make(map[string]string)
+	for _, ctr := range list {
+		if len(ctr.Names) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(ctr.Names[0], "/")
+		if ctr.State == "running" {
+			for _, port := range ctr.Ports {
+				if port.PublicPort != 0 {
+					holders[fmt.Sprintf("%d/%s", port.PublicPort, port.Type)] = name
+				}
+			}
+			continue
+		}
+		resp, err := docker.Cli.ContainerInspect(ctx, ctr.ID)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+		}
+		if resp.HostConfig == nil {
+			continue
+		}
+		for k, bindings := range resp.HostConfig.PortBindings {
+			for _, binding := range bindings {
+				if len(binding.HostPort) != 0 && binding.HostPort != "0" {
+					holders[binding.HostPort+"/"+k.Proto()] = name
+				}
+			}
+		}
+	}
+	return holders, nil
+}
+
+// checkPublishedPorts fails if a requested host port is published by a container other than the versions of self,
+// it returns the ports published by no container, they are checked on the host then.
+func checkPublishedPorts(requested []models.Port, holders map[string]string, self string) ([]models.Port, error) {
+	var unpublished []models.Port
+	for _, port := range requested {
+		key := fmt.Sprintf("%d/%s", port.HostPort, portProtocol(port))
+		holder, ok := holders[key]
+		if !ok {
+			unpublished = append(unpublished, port)
+			continue
+		}
+		if len(self) == 0 || !isVersionOf(holder, self) {
+			return nil, errors.Wrapf(xerrors.NewPortConflictError(), "host port: %s is bound by container: %s", key, holder)
+		}
+	}
+	return unpublished, nil
+}
+
+// containerPortKey returns the port of ContainerPorts, e.g. 8888 or 5000/udp, the default protocol is tcp
+func containerPortKey(port string) nat.Port {
+	if strings.Contains(port, "/") {
+		return nat.Port(port)
+	}
+	return nat.Port(port + "/" + models.ProtocolTcp)
+}
+
+// listenHostPort tries to listen on the port and closes it at once, it fails if the port is in use.
+// The sctp ports can't be listened by the standard library, only the containers are checked for them.
+func listenHostPort(port int, protocol string) error {
+	address := ":" + strconv.Itoa(port)
+	switch protocol {
+	case models.ProtocolSctp:
+		return nil
+	case models.ProtocolUdp:
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// mergePorts applies the patch to the port bindings of the info, the removed ports are unpublished first,
+// the ports returned are the ones whose host port is requested newly, changed is false if the bindings are the same.
+// The host ports applied from the port range are applied again by runContainer.
+func mergePorts(info *models.EtcdContainerInfo, spec *models.ContainerPortPatch) (added []models.Port, changed bool) {
+	requested := make(map[nat.Port]models.Port, len(info.Ports))
+	for _, port := range info.Ports {
+		requested[portKey(port)] = port
+	}
+	if info.HostConfig.PortBindings == nil {
+		info.HostConfig.PortBindings = make(nat.PortMap)
+	}
+	if info.Config.ExposedPorts == nil {
+		info.Config.ExposedPorts = make(nat.PortSet)
+	}
+
+	for _, port := range spec.Remove {
+		k := containerPortKey(port)
+		if _, ok := info.HostConfig.PortBindings[k]; ok {
+			delete(info.HostConfig.PortBindings, k)
+			delete(info.Config.ExposedPorts, k)
+			delete(requested, k)
+			changed = true
+		}
+	}
+	for _, port := range spec.ContainerPorts {
+		k := containerPortKey(port)
+		_, published := info.HostConfig.PortBindings[k]
+		if _, ok := requested[k]; ok || !published {
+			changed = true
+		}
+		delete(requested, k)
+		info.HostConfig.PortBindings[k] = nil
+		info.Config.ExposedPorts[k] = struct{}{}
+	}
+	for _, port := range spec.Ports {
+		port.Protocol = portProtocol(port)
+		k := portKey(port)
+		old, ok := requested[k]
+		if !ok || old.HostPort != port.HostPort {
+			changed = true
+			if port.HostPort != 0 {
+				added = append(added, port)
+			}
+		}
+		requested[k] = port
+		info.HostConfig.PortBindings[k] = nil
+		info.Config.ExposedPorts[k] = struct{}{}
+	}
+
+	info.Ports = make([]models.Port, 0, len(requested))
+	for _, port := range requested {
+		info.Ports = append(info.Ports, port)
+	}
+	sort.Slice(info.Ports, func(i, j int) bool {
+		return portKey(info.Ports[i]) < portKey(info.Ports[j])
+	})
+	return added, changed
+}
+
+// inspectBoundPorts returns the host ports actually bound to the running container, e.g. "22/tcp": "40001",
+// the ephemeral ports requested with HostPort 0 are assigned by docker when the container starts.
+func inspectBoundPorts(ctx context.Context, name string) (map[string]string, error) {
+	resp, err := docker.Cli.ContainerInspect(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+	}
+	boundPorts := make(map[string]string)
+	if resp.NetworkSettings == nil {
+		return boundPorts, nil
+	}
+	for k, bindings := range resp.NetworkSettings.Ports {
+		if len(bindings) > 0 {
+			boundPorts[string(k)] = bindings[0].HostPort
+		}
+	}
+	return boundPorts, nil
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func newTestPortInfo(ports []models.Port, published ...string) *models.EtcdContainerInfo {
+	info := &models.EtcdContainerInfo{
+		Config:     &container.Config{ExposedPorts: make(nat.PortSet)},
+		HostConfig: &container.HostConfig{PortBindings: make(nat.PortMap)},
+		Ports:      ports,
+	}
+	for _, port := range published {
+		info.HostConfig.PortBindings[nat.Port(port)] = nil
+		info.Config.ExposedPorts[nat.Port(port)] = struct{}{}
+	}
+	for _, port := range ports {
+		info.HostConfig.PortBindings[portKey(port)] = nil
+		info.Config.ExposedPorts[portKey(port)] = struct{}{}
+	}
+	return info
+}
+
+func TestMergePorts(t *testing.T) {
+	tests := []struct {
+		name          string
+		ports         []models.Port
+		published     []string
+		patch         *models.ContainerPortPatch
+		wantAdded     []models.Port
+		wantChanged   bool
+		wantPublished []string
+		wantPorts     []models.Port
+	}{
+		{
+			name:          "add a port from the range",
+			published:     []string{"22/tcp"},
+			patch:         &models.ContainerPortPatch{ContainerPorts: []string{"8888"}},
+			wantChanged:   true,
+			wantPublished: []string{"22/tcp", "8888/tcp"},
+			wantPorts:     []models.Port{},
+		},
+		{
+			name:          "add a host port",
+			published:     []string{"22/tcp"},
+			patch:         &models.ContainerPortPatch{Ports: []models.Port{{ContainerPort: 53, HostPort: 5353, Protocol: "udp"}}},
+			wantAdded:     []models.Port{{ContainerPort: 53, HostPort: 5353, Protocol: "udp"}},
+			wantChanged:   true,
+			wantPublished: []string{"22/tcp", "53/udp"},
+			wantPorts:     []models.Port{{ContainerPort: 53, HostPort: 5353, Protocol: "udp"}},
+		},
+		{
+			name:          "remove a host port",
+			ports:         []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "tcp"}},
+			published:     []string{"22/tcp"},
+			patch:         &models.ContainerPortPatch{Remove: []string{"80"}},
+			wantChanged:   true,
+			wantPublished: []string{"22/tcp"},
+			wantPorts:     []models.Port{},
+		},
+		{
+			name:          "move a host port",
+			ports:         []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "tcp"}},
+			patch:         &models.ContainerPortPatch{Remove: []string{"80"}, Ports: []models.Port{{ContainerPort: 81, HostPort: 8080}}},
+			wantAdded:     []models.Port{{ContainerPort: 81, HostPort: 8080, Protocol: "tcp"}},
+			wantChanged:   true,
+			wantPublished: []string{"81/tcp"},
+			wantPorts:     []models.Port{{ContainerPort: 81, HostPort: 8080, Protocol: "tcp"}},
+		},
+		{
+			name:          "unchanged",
+			ports:         []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "tcp"}},
+			published:     []string{"22/tcp"},
+			patch:         &models.ContainerPortPatch{ContainerPorts: []string{"22"}, Ports: []models.Port{{ContainerPort: 80, HostPort: 8080}}},
+			wantPublished: []string{"22/tcp", "80/tcp"},
+			wantPorts:     []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "tcp"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := newTestPortInfo(tt.ports, tt.published...)
+			added, changed := mergePorts(info, tt.patch)
+			if !reflect.DeepEqual(added, tt.wantAdded) || changed != tt.wantChanged {
+				t.Errorf("mergePorts() = %v, %v, want %v, %v", added, changed, tt.wantAdded, tt.wantChanged)
+			}
+			published := make([]string, 0, len(info.HostConfig.PortBindings))
+			for k := range info.HostConfig.PortBindings {
+				published = append(published, string(k))
+			}
+			sort.Strings(published)
+			if !reflect.DeepEqual(published, tt.wantPublished) {
+				t.Errorf("mergePorts() published = %v, want %v", published, tt.wantPublished)
+			}
+			if !reflect.DeepEqual(info.Ports, tt.wantPorts) {
+				t.Errorf("mergePorts() ports = %v, want %v", info.Ports, tt.wantPorts)
+			}
+		})
+	}
+}
+
+func TestCheckPublishedPorts(t *testing.T) {
+	holders := map[string]string{"8080/tcp": "foo-2", "5353/udp": "bar-1"}
+	tests := []struct {
+		name            string
+		requested       []models.Port
+		self            string
+		wantUnpublished []models.Port
+		wantConflict    bool
+	}{
+		{
+			name:         "bound by another replicaSet",
+			requested:    []models.Port{{ContainerPort: 53, HostPort: 5353, Protocol: "udp"}},
+			self:         "foo",
+			wantConflict: true,
+		},
+		{
+			name:      "bound by the current version",
+			requested: []models.Port{{ContainerPort: 81, HostPort: 8080}},
+			self:      "foo",
+		},
+		{
+			name:         "bound by the blue version",
+			requested:    []models.Port{{ContainerPort: 81, HostPort: 8080}},
+			wantConflict: true,
+		},
+		{
+			name:            "same number of another protocol",
+			requested:       []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "udp"}},
+			self:            "bar",
+			wantUnpublished: []models.Port{{ContainerPort: 80, HostPort: 8080, Protocol: "udp"}},
+		},
+		{
+			name:         "a replicaSet with the same prefix",
+			requested:    []models.Port{{ContainerPort: 80, HostPort: 8080}, {ContainerPort: 22, HostPort: 2222}},
+			self:         "fo",
+			wantConflict: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unpublished, err := checkPublishedPorts(tt.requested, holders, tt.self)
+			if tt.wantConflict {
+				if !xerrors.IsPortConflictError(err) {
+					t.Fatalf("checkPublishedPorts() error = %v, want a port conflict", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkPublishedPorts() error = %v", err)
+			}
+			if !reflect.DeepEqual(unpublished, tt.wantUnpublished) {
+				t.Errorf("checkPublishedPorts() = %v, want %v", unpublished, tt.wantUnpublished)
+			}
+		})
+	}
+}
+
+func TestPortProtocols(t *testing.T) {
+	tests := []struct {
+		name          string
+		containerPort string
+		port          models.Port
+		want          nat.Port
+	}{
+		{name: "default", containerPort: "8888", port: models.Port{ContainerPort: 8888, HostPort: 8080}, want: "8888/tcp"},
+		{name: "tcp", containerPort: "8888/tcp", port: models.Port{ContainerPort: 8888, HostPort: 8080, Protocol: "tcp"}, want: "8888/tcp"},
+		{name: "udp", containerPort: "8888/udp", port: models.Port{ContainerPort: 8888, HostPort: 8080, Protocol: "udp"}, want: "8888/udp"},
+		{name: "sctp", containerPort: "8888/sctp", port: models.Port{ContainerPort: 8888, HostPort: 8080, Protocol: "sctp"}, want: "8888/sctp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerPortKey(tt.containerPort); got != tt.want {
+				t.Errorf("containerPortKey(%s) = %s, want %s", tt.containerPort, got, tt.want)
+			}
+			if got := portKey(tt.port); got != tt.want {
+				t.Errorf("portKey(%+v) = %s, want %s", tt.port, got, tt.want)
+			}
+
+			// the new versions of patches and restarts are created from the etcd record
+			bytes, err := json.Marshal(newTestPortInfo([]models.Port{tt.port}, string(containerPortKey(tt.containerPort))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var info models.EtcdContainerInfo
+			if err = json.Unmarshal(bytes, &info); err != nil {
+				t.Fatal(err)
+			}
+			if got := portKey(info.Ports[0]); got != tt.want {
+				t.Errorf("portKey of the etcd record = %s, want %s", got, tt.want)
+			}
+			if _, ok := info.HostConfig.PortBindings[tt.want]; !ok {
+				t.Errorf("port bindings of the etcd record = %v, want %s", info.HostConfig.PortBindings, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenHostPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		bound    string
+		protocol string
+		wantErr  bool
+	}{
+		{name: "tcp bound by tcp", bound: "tcp", protocol: "tcp", wantErr: true},
+		{name: "udp bound by udp", bound: "udp", protocol: "udp", wantErr: true},
+		{name: "default bound by tcp", bound: "tcp", protocol: "", wantErr: true},
+		{name: "tcp bound by udp", bound: "udp", protocol: "tcp"},
+		{name: "udp bound by tcp", bound: "tcp", protocol: "udp"},
+		{name: "sctp isn't checked", bound: "tcp", protocol: "sctp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var port int
+			if tt.bound == "udp" {
+				conn, err := net.ListenPacket("udp", ":0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				port = conn.LocalAddr().(*net.UDPAddr).Port
+			} else {
+				listener, err := net.Listen("tcp", ":0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				port = listener.Addr().(*net.TCPAddr).Port
+			}
+
+			if err := listenHostPort(port, tt.protocol); (err != nil) != tt.wantErr {
+				t.Errorf("listenHostPort(%d, %s) error = %v, wantErr %v", port, tt.protocol, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	defaultReadinessTimeout  = 2 * time.Minute
+	defaultReadinessInterval = 2 * time.Second
+	// readinessDialTimeout is how long a connection to the port of the health check may take
+	readinessDialTimeout = 3 * time.Second
+)
+
+// waitReady polls the health check until it passes, the container has to keep running meanwhile.
+// The port is dialed through the bound host port if it's published, otherwise through the ip of the container.
+func waitReady(ctx context.Context, id string, check *models.HealthCheck, boundPorts map[string]string) (*models.Readiness, error) {
+	timeout, interval := defaultReadinessTimeout, defaultReadinessInterval
+	if check.Timeout > 0 {
+		timeout = time.Duration(check.Timeout) * time.Second
+	}
+	if check.Interval > 0 {
+		interval = time.Duration(check.Interval) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	readiness := &models.Readiness{}
+	var lastErr error
+	for {
+		resp, err := docker.Cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return readiness, errors.Wrapf(err, "docker.ContainerInspect failed, id: %s", id)
+		}
+		if resp.State == nil || !resp.State.Running {
+			return readiness, errors.Wrapf(xerrors.NewContainerNotReadyError(), "container: %s exited before it's ready", resp.Name)
+		}
+
+		readiness.Attempts++
+		if len(check.Cmd) != 0 {
+			lastErr = execProbe(ctx, id, check.Cmd)
+		} else {
+			lastErr = dialProbe(ctx, probeAddress(resp, check.Port, boundPorts))
+		}
+		if lastErr == nil {
+			readiness.Elapsed = time.Since(start).Round(100 * time.Millisecond).String()
+			log.Infof("services.waitReady, container: %s is ready after %s, attempts: %d", resp.Name, readiness.Elapsed, readiness.Attempts)
+			return readiness, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return readiness, errors.Wrapf(xerrors.NewContainerNotReadyError(), "container: %s is not ready in %s, attempts: %d, last error: %v",
+				resp.Name, timeout, readiness.Attempts, lastErr)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// awaitReadiness waits for the health check of the version recorded in kv and saves the readiness in kv,
+// it's used with deferReadiness by the callers that copy the merged files into the new version.
+func awaitReadiness(ctx context.Context, kv *etcd.PutKeyValue) error {
+	var info models.EtcdContainerInfo
+	if err := json.Unmarshal([]byte(*kv.Value), &info); err != nil {
+		return errors.Wrapf(err, "json.Unmarshal failed, key: %s", kv.Key)
+	}
+	if info.HealthCheck == nil {
+		return nil
+	}
+	// the health check has its own timeout
+	readiness, err := waitReady(context.WithoutCancel(ctx), info.ContainerName, info.HealthCheck, info.BoundPorts)
+	if err != nil {
+		return errors.WithMessagef(err, "services.waitReady failed, name: %s", info.ContainerName)
+	}
+	info.Readiness = readiness
+	kv.Value = info.Serialize()
+	return nil
+}
+
+// execProbe runs the cmd in the container, it passes if the cmd exits with 0
+func execProbe(ctx context.Context, id string, cmd []string) error {
+	execCreate, err := docker.Cli.ContainerExecCreate(ctx, id, types.ExecConfig{
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerExecCreate failed, id: %s", id)
+	}
+	hijackedResp, err := docker.Cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{})
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerExecAttach failed, id: %s", id)
+	}
+	var buf bytes.Buffer
+	_, _ = stdcopy.StdCopy(&buf, &buf, hijackedResp.Reader)
+	hijackedResp.Close()
+
+	inspect, err := docker.Cli.ContainerExecInspect(ctx, execCreate.ID)
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerExecInspect failed, id: %s", id)
+	}
+	if inspect.ExitCode != 0 {
+		return errors.Errorf("cmd: %v exit with code %d, output: %s", cmd, inspect.ExitCode, buf.String())
+	}
+	return nil
+}
+
+// dialProbe passes if the address accepts a tcp connection
+func dialProbe(ctx context.Context, address string) error {
+	dialer := net.Dialer{Timeout: readinessDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "net.Dial failed, address: %s", address)
+	}
+	_ = conn.Close()
+	return nil
+}
+
+func probeAddress(resp types.ContainerJSON, port int, boundPorts map[string]string) string {
+	if hostPort, ok := boundPorts[fmt.Sprintf("%d/tcp", port)]; ok && len(hostPort) != 0 {
+		return net.JoinHostPort("127.0.0.1", hostPort)
+	}
+	ip := "127.0.0.1"
+	if resp.NetworkSettings != nil {
+		if len(resp.NetworkSettings.IPAddress) != 0 {
+			ip = resp.NetworkSettings.IPAddress
+		}
+		for _, endpoint := range resp.NetworkSettings.Networks {
+			if endpoint != nil && len(endpoint.IPAddress) != 0 {
+				ip = endpoint.IPAddress
+				break
+			}
+		}
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
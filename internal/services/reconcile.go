@@ -0,0 +1,312 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// ReconcileGpuClaims rebuilds the whole gpus held by replicaSets from the container info in etcd before serving,
+// the gpus recorded in the latest version are claimed only if its container is running,
+// the stopped containers have released their gpus. The gpus of a job are claimed while its container is running,
+// the reservations are kept until they expire.
+func ReconcileGpuClaims() error {
+	kvs, err := etcd.List(etcd.Containers)
+	if err != nil {
+		return errors.WithMessage(err, "etcd.List failed")
+	}
+
+	ctx := context.Background()
+	list, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "docker.ContainerList failed")
+	}
+	running := make(map[string]struct{}, len(list))
+	claims := make(map[string][]string)
+	for _, ctr := range list {
+		for _, name := range ctr.Names {
+			running[strings.TrimPrefix(name, "/")] = struct{}{}
+		}
+		// a version of a replicaSet is labeled, even if its name looks like a job
+		if _, ok := ctr.Labels[managedLabel]; ok || len(ctr.Names) == 0 || !isJobName(strings.TrimPrefix(ctr.Names[0], "/")) {
+			continue
+		}
+		name := strings.TrimPrefix(ctr.Names[0], "/")
+		resp, err := docker.Cli.ContainerInspect(ctx, ctr.ID)
+		if err != nil {
+			return errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+		}
+		if resp.HostConfig != nil && len(resp.HostConfig.DeviceRequests) > 0 {
+			claims[jobOwnerPrefix+name] = resp.HostConfig.DeviceRequests[0].DeviceIDs
+		}
+	}
+
+	for key, value := range kvs {
+		var info models.EtcdContainerInfo
+		if err = json.Unmarshal(value, &info); err != nil {
+			log.Errorf("services.ReconcileGpuClaims, container: %s json.Unmarshal failed, error: %v", key, err)
+			continue
+		}
+		// the slots of a fractional gpu and the shared gpus are kept as saved
+		if info.GpuSlots > 0 || info.GpuShared || info.Archive != nil {
+			continue
+		}
+		if _, ok := running[info.ContainerName]; !ok {
+			continue
+		}
+		name, _, ok := splitVersionName(info.ContainerName)
+		if uuids := infoDeviceIDs(&info); ok && len(uuids) > 0 {
+			claims[name] = uuids
+		}
+	}
+
+	claimed, restored := schedulers.GpuScheduler.Reconcile(claims, func(owner string) bool {
+		return strings.HasPrefix(owner, reservationOwnerPrefix)
+	})
+	log.Infof("services.ReconcileGpuClaims, %d replicaSets are using gpus, %d gpus claimed, %d gpus restored",
+		len(claims), claimed, restored)
+	return nil
+}
+
+// ReconcileState compares the replicaSets and volumes recorded in etcd with docker before serving,
+// the service may have crashed between the docker call and the etcd write. The mismatches are logged,
+// the stale records are pruned with --reconcilePrune and the unknown resources are imported with --reconcileImport.
+func ReconcileState() error {
+	var ds DiagnosticsService
+	report, err := ds.CheckState(cfg.ReconcilePrune, cfg.ReconcileImport)
+	if err != nil {
+		return errors.WithMessage(err, "services.CheckState failed")
+	}
+	log.Infof("services.ReconcileState, %d stale containers, %d stale volumes, %d unknown containers, %d unknown volumes",
+		len(report.StaleContainers), len(report.StaleVolumes), len(report.UnknownContainers), len(report.UnknownVolumes))
+	return nil
+}
+
+// CheckState finds the replicaSets and volumes recorded in etcd without any version in docker, and the containers
+// and volumes labeled by the service in docker without a record in etcd. The soft deleted replicaSets are not stale,
+// neither are the ones whose versions were created before the labels. The resources not labeled by the service are
+// never imported, they may belong to anyone else on the host.
+// If prune is true, the stale records are deleted, if imports is true, the record of an unknown resource is created
+// from its latest version in docker, its history starts from the imported version.
+// The records are written synchronously, so the version maps and the gpu claims rebuilt after it see them,
+// it must only repair at startup, before the async writes of the requests may race with it.
+func (ds *DiagnosticsService) CheckState(prune, imports bool) (*models.StateReport, error) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+
+	containers, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: allManagedFilters()})
+	if err != nil {
+		return nil, errors.Wrap(err, "docker.ContainerList failed")
+	}
+	containerNames := make([]string, 0, len(containers))
+	for _, ctr := range containers {
+		for _, name := range ctr.Names {
+			containerNames = append(containerNames, strings.TrimPrefix(name, "/"))
+		}
+	}
+	volumes, err := docker.Cli.VolumeList(ctx, volume.ListOptions{Filters: allManagedFilters()})
+	if err != nil {
+		return nil, errors.Wrap(err, "docker.VolumeList failed")
+	}
+	volumeNames := make([]string, 0, len(volumes.Volumes))
+	for _, vol := range volumes.Volumes {
+		volumeNames = append(volumeNames, vol.Name)
+	}
+
+	report := &models.StateReport{}
+	report.StaleContainers, report.UnknownContainers, err = checkResourceState(ctx, etcd.Containers, containerNames, prune, imports)
+	if err != nil {
+		return nil, err
+	}
+	report.StaleVolumes, report.UnknownVolumes, err = checkResourceState(ctx, etcd.Volumes, volumeNames, prune, imports)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkResourceState compares the records of the resource with the names existing in docker,
+// the version map follows the pruned and imported records, the gpus of an imported replicaSet are claimed at the next start.
+func checkResourceState(ctx context.Context, resource etcd.Resource, names []string, prune, imports bool) (stale, unknown []*models.StateMismatch, err error) {
+	vm := vmap.ContainerVersionMap
+	if resource == etcd.Volumes {
+		vm = vmap.VolumeVersionMap
+	}
+
+	kvs, err := etcd.List(resource)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "etcd.List failed")
+	}
+
+	// the latest version of each base name existing in docker
+	existing := make(map[string]int64, len(names))
+	for _, name := range names {
+		if base, version, ok := splitVersionName(name); ok && version > existing[base] {
+			existing[base] = version
+		}
+	}
+
+	stale = make([]*models.StateMismatch, 0)
+	for key, value := range kvs {
+		if _, ok := existing[key]; ok {
+			continue
+		}
+		legacy, err := latestVersion(ctx, resource, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if legacy > 0 {
+			continue
+		}
+		var info struct {
+			Version int64                    `json:"version"`
+			Archive *models.ContainerArchive `json:"archive"`
+		}
+		if err = json.Unmarshal(value, &info); err != nil {
+			log.Errorf("services.CheckState, %s: %s json.Unmarshal failed, error: %v", resource, key, err)
+			continue
+		}
+		// the container of a soft deleted replicaSet may have been removed on purpose
+		if info.Archive != nil {
+			continue
+		}
+
+		mismatch := &models.StateMismatch{Name: key, Latest: fmt.Sprintf("%s-%d", key, info.Version)}
+		log.Warnf("services.CheckState, %s: %s is recorded in etcd, but no version exists in docker", resource, mismatch.Latest)
+		if prune {
+			if err = etcd.Del(resource, key); err != nil {
+				return nil, nil, errors.Wrapf(err, "etcd.Del failed, key: %s", etcd.ResourcePrefix(resource, key))
+			}
+			vm.Remove(key)
+			mismatch.Fixed = true
+			log.Infof("services.CheckState, %s: %s stale record pruned", resource, key)
+		}
+		stale = append(stale, mismatch)
+	}
+
+	unknown = make([]*models.StateMismatch, 0)
+	for base, version := range existing {
+		if _, ok := kvs[base]; ok {
+			continue
+		}
+		mismatch := &models.StateMismatch{Name: base, Latest: fmt.Sprintf("%s-%d", base, version)}
+		log.Warnf("services.CheckState, %s: %s exists in docker, but isn't recorded in etcd", resource, mismatch.Latest)
+		if imports {
+			if err = importResource(ctx, resource, base, version); err != nil {
+				return nil, nil, err
+			}
+			vm.Set(base, version)
+			mismatch.Fixed = true
+			log.Infof("services.CheckState, %s: %s imported", resource, mismatch.Latest)
+		}
+		unknown = append(unknown, mismatch)
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Name < stale[j].Name
+	})
+	sort.Slice(unknown, func(i, j int) bool {
+		return unknown[i].Name < unknown[j].Name
+	})
+	return stale, unknown, nil
+}
+
+// latestVersion returns the latest version of the base name existing in docker, labeled or not, 0 if there's none
+func latestVersion(ctx context.Context, resource etcd.Resource, base string) (int64, error) {
+	var names []string
+	switch resource {
+	case etcd.Containers:
+		containers, err := listContainerVersions(ctx, base, true)
+		if err != nil {
+			return 0, err
+		}
+		for _, ctr := range containers {
+			names = append(names, ctr.Names...)
+		}
+	case etcd.Volumes:
+		volumes, err := listVolumeVersions(ctx, base)
+		if err != nil {
+			return 0, err
+		}
+		for _, vol := range volumes {
+			names = append(names, vol.Name)
+		}
+	}
+
+	var latest int64
+	for _, name := range names {
+		if b, version, ok := splitVersionName(strings.TrimPrefix(name, "/")); ok && b == base && version > latest {
+			latest = version
+		}
+	}
+	return latest, nil
+}
+
+// importResource records the version of the container or volume existing in docker in etcd
+func importResource(ctx context.Context, resource etcd.Resource, base string, version int64) error {
+	versionName := fmt.Sprintf("%s-%d", base, version)
+	var value *string
+	switch resource {
+	case etcd.Containers:
+		resp, err := docker.Cli.ContainerInspect(ctx, versionName)
+		if err != nil {
+			return errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", versionName)
+		}
+		info := &models.EtcdContainerInfo{
+			Version:       version,
+			CreateTime:    formatDockerTime(resp.Created),
+			Config:        resp.Config,
+			HostConfig:    resp.HostConfig,
+			ContainerName: versionName,
+		}
+		if resp.NetworkSettings != nil {
+			info.NetworkingConfig = &network.NetworkingConfig{EndpointsConfig: resp.NetworkSettings.Networks}
+		}
+		value = info.Serialize()
+	case etcd.Volumes:
+		resp, err := docker.Cli.VolumeInspect(ctx, versionName)
+		if err != nil {
+			return errors.Wrapf(err, "docker.VolumeInspect failed, name: %s", versionName)
+		}
+		info := &models.EtcdVolumeInfo{
+			Version:    version,
+			CreateTime: formatDockerTime(resp.CreatedAt),
+			Opt: &volume.CreateOptions{
+				Name:       versionName,
+				Driver:     resp.Driver,
+				DriverOpts: resp.Options,
+				Labels:     resp.Labels,
+			},
+		}
+		value = info.Serialize()
+	}
+
+	if err := etcd.Put(resource, base, value); err != nil {
+		return errors.WithMessage(err, "etcd.Put failed")
+	}
+	return nil
+}
+
+// formatDockerTime formats the RFC 3339 time of docker like the create time recorded by the service
+func formatDockerTime(value string) string {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return value
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// RenameContainer moves the replicaSet to a new base name by creating the next version under it,
+// the gpus, slots and requests are handed over instead of applied again, and the merged files are copied.
+// The version continues from the old base, e.g. foo-3 is renamed to bar-4, and the history in etcd is moved,
+// so the versions before the rename can still be rolled back to. The older versions of the old base
+// which are still in docker keep their names until they are deleted.
+func (rs *ReplicaSetService) RenameContainer(name, newName string) (id, newContainerName string, err error) {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return id, newContainerName, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	// the versions of the new base must not clash with the containers or the history of another replicaSet
+	ctx := context.Background()
+	exist, err := rs.existContainer(ctx, newName)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.existContainer failed")
+	}
+	// the new base is claimed at once, so a concurrent rename or create of it fails
+	if exist || !vmap.ContainerVersionMap.Claim(newName, version) {
+		return id, newContainerName, errors.Wrapf(xerrors.NewContainerExistedError(newName), "container %s", newName)
+	}
+	// the resources are handed back unless the new version has taken over with its data
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			vmap.ContainerVersionMap.Unclaim(newName, version)
+		}
+	}()
+
+	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	if err != nil {
+		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+	}
+	info := &models.EtcdContainerInfo{}
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	if info.Archive != nil {
+		return id, newContainerName, errors.Errorf("container: %s is archived, restore it before renaming", name)
+	}
+	history, err := etcd.GetRevisionRange(etcd.Containers, name)
+	if err != nil {
+		return id, newContainerName, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+	}
+
+	// hand over the resources held by the old base, they are handed back if the new version fails
+	schedulers.GpuScheduler.Transfer(name, newName)
+	schedulers.GpuScheduler.TransferFraction(name, newName)
+	schedulers.GpuScheduler.TransferShared(name, newName)
+	if info.Requests != nil {
+		schedulers.ResourceScheduler.Restore(name)
+		_ = schedulers.ResourceScheduler.Apply(newName, *info.Requests)
+	}
+	if jobID := info.Config.Labels[jobIDLabel]; len(jobID) != 0 {
+		schedulers.GpuScheduler.SetJob(newName, jobID)
+	}
+	if labels := info.Config.Labels[gpuLabelsLabel]; len(labels) != 0 {
+		schedulers.GpuScheduler.SetLabels(newName, strings.Split(labels, ","))
+	}
+	defer func() {
+		if !handedOver {
+			schedulers.GpuScheduler.Transfer(newName, name)
+			schedulers.GpuScheduler.TransferFraction(newName, name)
+			schedulers.GpuScheduler.TransferShared(newName, name)
+			if info.Requests != nil {
+				schedulers.ResourceScheduler.Restore(newName)
+				_ = schedulers.ResourceScheduler.Apply(name, *info.Requests)
+			}
+			schedulers.GpuScheduler.RemoveJob(newName)
+			schedulers.GpuScheduler.RemoveLabels(newName)
+		}
+	}()
+
+	info.RenameFrom = ctrVersionName
+	id, newContainerName, kv, err := rs.runContainerWith(ctx, newName, info, runOptions{deferReadiness: true, replaces: ctrVersionName})
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "runContainer failed")
+	}
+
+	err = copyWithRetry(ctx, etcd.Containers, ctrVersionName, newContainerName, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+		return utils.CopyOldMergedToNewContainerMerged(ctx, ctrVersionName, newContainerName, progress)
+	}, nil)
+	if err != nil {
+		// the old version keeps running with its data, so the new version is removed and the resources are handed back
+		if removeErr := rs.DeleteContainerForUpdate(newContainerName); removeErr != nil {
+			log.Errorf("services.RenameContainer, container: %s remove failed, error: %v", newContainerName, removeErr)
+		}
+		if info.GpuMps {
+			schedulers.MpsManager.Release(newName)
+		}
+		return id, "", errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+	}
+	handedOver = true
+	if info.GpuMps {
+		schedulers.MpsManager.Release(name)
+	}
+	schedulers.GpuScheduler.RemoveJob(name)
+	schedulers.GpuScheduler.RemoveLabels(name)
+
+	// the history is replayed from the oldest revision, so the new key has the same versions to roll back to,
+	// the saved merged layers are found by the container names in the history
+	for i := len(history) - 1; i >= 0; i-- {
+		value := string(history[i].Value)
+		if err = etcd.Put(etcd.Containers, newName, &value); err != nil {
+			return id, newContainerName, errors.WithMessagef(err, "etcd.Put failed, key: %s", etcd.ResourcePrefix(etcd.Containers, newName))
+		}
+	}
+
+	// the old version is replaced like a patch, its ports are restored but its gpus are held by the new base
+	if err = setToMergeMap(ctrVersionName, version); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "setToMergeMap failed")
+	}
+	if err = rs.DeleteContainerForUpdate(ctrVersionName); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
+	}
+
+	vmap.ContainerVersionMap.Remove(name)
+	workQueue.Enqueue(etcd.DelKey{
+		Resource: etcd.Containers,
+		Key:      name,
+	})
+
+	// the probe runs after the merged files are copied and the old version is removed
+	if err = awaitReadiness(ctx, &kv); err != nil {
+		workQueue.Enqueue(kv)
+		return id, newContainerName, errors.WithMessage(err, "services.awaitReadiness failed")
+	}
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Containers,
+		Key:      kv.Key,
+		Value:    kv.Value,
+	})
+
+	log.Infof("services.RenameContainer, container: %s rename to %s successfully", ctrVersionName, newContainerName)
+	notify.Emit(models.EventContainerRenamed, newName, map[string]interface{}{
+		"containerName": newContainerName,
+		"renameFrom":    ctrVersionName,
+	})
+	return
+}
@@ -5,15 +5,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/ngaut/log"
@@ -23,6 +30,7 @@ import (
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
 	vmap "github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
@@ -33,25 +41,111 @@ import (
 type ReplicaSetService struct{}
 
 // RunGpuContainer just sets the parameters, the real run a container is in the `runContainer`
-func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, containerName string, err error) {
+func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, containerName string, boundPorts map[string]string, readiness *models.Readiness, err error) {
 	var (
 		config           container.Config
 		hostConfig       container.HostConfig
 		networkingConfig network.NetworkingConfig
 		platform         ocispec.Platform
 	)
-	ctx := context.Background()
+	ctx, cancel := dockerContext()
+	defer cancel()
+
+	// the creates with the same key wait for each other, so only the first one creates the container,
+	// the others replay its result
+	if key := spec.IdempotencyKey; len(key) != 0 {
+		unlock := idempotencyLocks.lock(key)
+		defer unlock()
+
+		var record *models.IdempotencyRecord
+		if record, err = getIdempotencyRecord(key); err != nil {
+			return id, containerName, boundPorts, readiness, errors.WithMessage(err, "services.getIdempotencyRecord failed")
+		}
+		if record != nil {
+			if record.ReplicaSetName != spec.ReplicaSetName {
+				return id, containerName, boundPorts, readiness, errors.Wrapf(xerrors.NewIdempotencyKeyReusedError(),
+					"key: %s is used by replicaSet: %s", key, record.ReplicaSetName)
+			}
+			log.Infof("services.RunGpuContainer, idempotency key: %s is processed, return container: %s", key, record.ContainerName)
+			return record.ID, record.ContainerName, record.BoundPorts, record.Readiness, nil
+		}
+		defer func() {
+			if err == nil {
+				putIdempotencyRecord(&models.IdempotencyRecord{
+					Key:            key,
+					ReplicaSetName: spec.ReplicaSetName,
+					ID:             id,
+					ContainerName:  containerName,
+					BoundPorts:     boundPorts,
+					Readiness:      readiness,
+					CreateTime:     time.Now().Format("2006-01-02 15:04:05"),
+				})
+			}
+		}()
+	}
+
+	// check the spec before applying for gpu, so that the gpu will not be leaked
+	if err = rs.preflight(ctx, spec, &hostConfig); err != nil {
+		return id, containerName, boundPorts, readiness, err
+	}
 
-	if rs.existContainer(spec.ReplicaSetName) {
-		return id, containerName, errors.Wrapf(xerrors.NewContainerExistedError(), "container %s", spec.ReplicaSetName)
+	// pull the image before applying for resources, a pull may take minutes,
+	// so the timeout of the docker calls restarts after it
+	if err = ensureImage(ctx, spec.ImageName, spec.ForcePull); err != nil {
+		return id, containerName, boundPorts, readiness, errors.WithMessage(err, "services.ensureImage failed")
+	}
+	ctx, cancel = dockerContext()
+	defer cancel()
+
+	// reserve the cpu and memory requests, the limits are enforced by cgroup
+	requests, err := setResourceLimits(spec, &hostConfig)
+	if err != nil {
+		return id, containerName, boundPorts, readiness, errors.WithMessage(err, "services.setResourceLimits failed")
+	}
+	if requests != nil {
+		if err = schedulers.ResourceScheduler.Apply(spec.ReplicaSetName, *requests); err != nil {
+			return id, containerName, boundPorts, readiness, errors.Wrapf(err, "ResourceScheduler.Apply failed, spec: %+v", spec)
+		}
+		defer func() {
+			if err != nil {
+				schedulers.ResourceScheduler.Restore(spec.ReplicaSetName)
+			}
+		}()
 	}
 
 	config = container.Config{
-		Image:     spec.ImageName,
-		Cmd:       spec.Cmd,
-		Env:       spec.Env,
-		OpenStdin: true,
-		Tty:       true,
+		Image:      spec.ImageName,
+		Cmd:        spec.Cmd,
+		Env:        spec.Env,
+		Hostname:   spec.Hostname,
+		Domainname: spec.Domainname,
+		OpenStdin:  true,
+		Tty:        true,
+	}
+
+	// correlate the container and the gpu reservation with the external job
+	if len(spec.JobID) != 0 {
+		config.Labels = map[string]string{jobIDLabel: spec.JobID}
+		schedulers.GpuScheduler.SetJob(spec.ReplicaSetName, spec.JobID)
+		defer func() {
+			if err != nil {
+				schedulers.GpuScheduler.RemoveJob(spec.ReplicaSetName)
+			}
+		}()
+	}
+
+	// the anti-co-location labels are checked when the gpu is shared, they are kept in the container labels for clone
+	if len(spec.GpuLabels) != 0 {
+		if config.Labels == nil {
+			config.Labels = make(map[string]string, 1)
+		}
+		config.Labels[gpuLabelsLabel] = strings.Join(spec.GpuLabels, ",")
+		schedulers.GpuScheduler.SetLabels(spec.ReplicaSetName, spec.GpuLabels)
+		defer func() {
+			if err != nil {
+				schedulers.GpuScheduler.RemoveLabels(spec.ReplicaSetName)
+			}
+		}()
 	}
 
 	// bind port
@@ -59,26 +153,119 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 		hostConfig.PortBindings = make(nat.PortMap, len(spec.ContainerPorts))
 		config.ExposedPorts = make(nat.PortSet, len(spec.ContainerPorts))
 		for _, port := range spec.ContainerPorts {
-			config.ExposedPorts[nat.Port(port+"/tcp")] = struct{}{}
-			hostConfig.PortBindings[nat.Port(port+"/tcp")] = nil
+			config.ExposedPorts[containerPortKey(port)] = struct{}{}
+			hostConfig.PortBindings[containerPortKey(port)] = nil
+		}
+	}
+	for _, port := range spec.Ports {
+		if hostConfig.PortBindings == nil {
+			hostConfig.PortBindings = make(nat.PortMap, len(spec.Ports))
+			config.ExposedPorts = make(nat.PortSet, len(spec.Ports))
 		}
+		config.ExposedPorts[portKey(port)] = struct{}{}
+		hostConfig.PortBindings[portKey(port)] = nil
 	}
 
 	// bind gpu resource
 	if spec.GpuCount > 0 {
-		uuids, err := schedulers.GpuScheduler.Apply(spec.GpuCount)
+		var uuids []string
+		if len(spec.ReservationToken) != 0 {
+			// the gpus held by the reservation are used instead of allocating
+			var rollback func()
+			uuids, rollback, err = consumeReservation(spec.ReservationToken, spec.ReplicaSetName, spec.GpuCount)
+			if err != nil {
+				return id, containerName, boundPorts, readiness, errors.WithMessage(err, "services.consumeReservation failed")
+			}
+			defer func() {
+				if err != nil {
+					rollback()
+				}
+			}()
+		} else if spec.GpuShared {
+			// the shared gpus are always assigned by the local GpuScheduler like the fractional gpu
+			uuids, err = schedulers.GpuScheduler.ApplyShared(spec.ReplicaSetName, spec.GpuCount, spec.GpuMaxSharers, spec.GpuMps)
+			if err != nil {
+				return id, containerName, boundPorts, readiness, errors.Wrapf(err, "GpuScheduler.ApplyShared failed, spec: %+v", spec)
+			}
+			defer func() {
+				if err != nil {
+					schedulers.GpuScheduler.RestoreShared(spec.ReplicaSetName)
+				}
+			}()
+			// the MPS daemon limits each client to its share of the gpu, so do the frameworks
+			if spec.GpuMps && spec.GpuMaxSharers > 0 && len(uuids) == 1 {
+				share := 1 / float64(spec.GpuMaxSharers)
+				config.Env = injectFrameworkEnv(config.Env, frameworkMps, uuids[0], share)
+				config.Env = injectFrameworkEnv(config.Env, spec.GpuFramework, uuids[0], share)
+			}
+		} else {
+			uuids, err = schedulers.Provider.Allocate(spec)
+			if err != nil {
+				return id, containerName, boundPorts, readiness, errors.Wrapf(err, "Provider.Allocate failed, spec: %+v", spec)
+			}
+			// the gpus of both providers are marked as used in GpuScheduler, so they are restored there
+			defer func() {
+				if err != nil {
+					schedulers.GpuScheduler.Restore(uuids)
+				}
+			}()
+		}
+		hostConfig.DeviceRequests = rs.newContainerResource(uuids, spec.GpuDriverOptions).DeviceRequests
+		log.Infof("services.RunGpuContainer, container: %s apply %d gpus, uuids: %+v, job id: %s",
+			spec.ReplicaSetName+"-0", len(uuids), uuids, spec.JobID)
+	}
+
+	// bind mig instances, the ids of the instances are passed to the nvidia runtime like the uuids of the gpus
+	if len(spec.MigProfile) != 0 {
+		var uuids []string
+		uuids, err = schedulers.GpuScheduler.ApplyMig(spec.ReplicaSetName, spec.MigProfile, spec.MigCount)
+		if err != nil {
+			return id, containerName, boundPorts, readiness, errors.Wrapf(err, "GpuScheduler.ApplyMig failed, spec: %+v", spec)
+		}
+		defer func() {
+			if err != nil {
+				schedulers.GpuScheduler.Restore(uuids)
+			}
+		}()
+		hostConfig.DeviceRequests = rs.newContainerResource(uuids, spec.GpuDriverOptions).DeviceRequests
+		log.Infof("services.RunGpuContainer, container: %s apply %d mig instances of profile: %s, uuids: %+v",
+			spec.ReplicaSetName+"-0", len(uuids), spec.MigProfile, uuids)
+	}
+
+	// bind a part of a gpu, the fractional gpu is always allocated by the local GpuScheduler
+	var gpuSlots int
+	if spec.GpuFraction > 0 {
+		gpuSlots = int(math.Round(spec.GpuFraction * float64(schedulers.GpuScheduler.SlotsPerGpu)))
+		var uuid string
+		uuid, err = schedulers.GpuScheduler.ApplyFraction(spec.ReplicaSetName, gpuSlots)
 		if err != nil {
-			return id, containerName, errors.Wrapf(err, "GpuScheduler.Apply failed, spec: %+v", spec)
+			return id, containerName, boundPorts, readiness, errors.Wrapf(err, "GpuScheduler.ApplyFraction failed, spec: %+v", spec)
 		}
-		hostConfig.Resources = rs.newContainerResource(uuids)
-		log.Infof("services.RunGpuContainer, container: %s apply %d gpus, uuids: %+v", spec.ReplicaSetName+"-0", len(uuids), uuids)
+		defer func() {
+			if err != nil {
+				schedulers.GpuScheduler.RestoreFraction(spec.ReplicaSetName)
+			}
+		}()
+		hostConfig.DeviceRequests = rs.newContainerResource([]string{uuid}, spec.GpuDriverOptions).DeviceRequests
+		log.Infof("services.RunGpuContainer, container: %s apply %d/%d slots of gpu: %s",
+			spec.ReplicaSetName+"-0", gpuSlots, schedulers.GpuScheduler.SlotsPerGpu, uuid)
+		// let the framework in the container limit its gpu memory to the fraction
+		config.Env = injectFrameworkEnv(config.Env, spec.GpuFramework, uuid, float64(gpuSlots)/float64(schedulers.GpuScheduler.SlotsPerGpu))
 	}
 
 	// bind volume
-	hostConfig.Binds = make([]string, 0, len(spec.Binds))
-	for i := range spec.Binds {
-		// Binds
-		hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s", spec.Binds[i].Src, spec.Binds[i].Dest))
+	if err = setBinds(&hostConfig, spec.Binds); err != nil {
+		return id, containerName, boundPorts, readiness, errors.WithMessage(err, "services.setBinds failed")
+	}
+	if err = setShmSize(spec, &hostConfig); err != nil {
+		return id, containerName, boundPorts, readiness, errors.WithMessage(err, "services.setShmSize failed")
+	}
+	// the policy is kept in the host config of etcd, so the patched versions inherit it
+	if spec.RestartPolicy != nil {
+		hostConfig.RestartPolicy = container.RestartPolicy{
+			Name:              spec.RestartPolicy.Name,
+			MaximumRetryCount: spec.RestartPolicy.MaximumRetryCount,
+		}
 	}
 
 	// create and start
@@ -87,64 +274,326 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 		HostConfig:       &hostConfig,
 		NetworkingConfig: &networkingConfig,
 		Platform:         &platform,
+		Ports:            spec.Ports,
+		Requests:         requests,
+		GpuMps:           spec.GpuMps,
+		GpuSlots:         gpuSlots,
+		GpuShared:        spec.GpuShared,
+		GpuMaxSharers:    spec.GpuMaxSharers,
+		GpuConstraints:   spec.GpuConstraints,
+		GpuUUIDs:         spec.GpuUUIDs,
+		GpuOrder:         spec.GpuOrder,
+		NetworkBandwidth: spec.NetworkBandwidth,
+		HealthCheck:      spec.HealthCheck,
 	})
 	if err != nil {
-		return id, containerName, errors.Wrapf(err, "serivce.runContainer failed, spec: %+v", spec)
+		return id, containerName, boundPorts, readiness, errors.Wrapf(err, "serivce.runContainer failed, spec: %+v", spec)
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Enqueue(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
+
+	var val models.EtcdContainerInfo
+	_ = json.Unmarshal([]byte(*kv.Value), &val)
+	boundPorts, readiness = val.BoundPorts, val.Readiness
+	notify.Emit(models.EventContainerCreated, spec.ReplicaSetName, map[string]interface{}{
+		"containerName": containerName,
+		"gpus":          infoDeviceIDs(&val),
+	})
 	return
 }
 
-func (rs *ReplicaSetService) DeleteContainer(name string) error {
+// DeleteContainer removes the latest version of the replicaSet and releases its resources,
+// the container is stopped gracefully first if the spec asks for it, a nil spec force removes it.
+func (rs *ReplicaSetService) DeleteContainer(name string, spec *models.ContainerDelete) error {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
 		return errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 
+	// the resources of a soft deleted container have been released
+	if info, err := rs.GetContainerInfo(name); err == nil && info.Archive != nil {
+		return rs.purgeArchivedContainer(name, &info)
+	}
+
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
 	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
 	if err != nil {
 		return errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 	}
+
+	// the gpus are still used until the container exits, so it's stopped before they are released,
+	// the stop timeout is added to the timeout of the docker calls
+	ctx, cancel := dockerContext()
+	defer cancel()
+	force := true
+	if spec != nil && spec.Graceful {
+		stopTimeout := time.Duration(max(spec.StopTimeout, defaultStopTimeout)) * time.Second
+		stopCtx, stopCancel := context.WithTimeout(context.WithoutCancel(ctx), stopTimeout+cleanupTimeout+cfg.DockerTimeout)
+		force = !stopGracefully(stopCtx, ctrVersionName, spec.StopTimeout)
+		stopCancel()
+	}
+
 	schedulers.GpuScheduler.Restore(uuids)
+	schedulers.GpuScheduler.RestoreFraction(name)
+	schedulers.GpuScheduler.RestoreShared(name)
+	schedulers.GpuScheduler.RemoveJob(name)
+	schedulers.GpuScheduler.RemoveLabels(name)
 
 	ports, err := rs.containerPortBindings(ctrVersionName)
 	if err != nil {
 		return errors.WithMessage(err, "services.containerPortBindings failed")
 	}
 	schedulers.PortScheduler.Restore(ports)
+	schedulers.ResourceScheduler.Restore(name)
+	schedulers.MpsManager.Release(name)
 
 	// delete the version number and asynchronously delete the container info in etcd
 	vmap.ContainerVersionMap.Remove(strings.Split(name, "-")[0])
-	workQueue.Queue <- etcd.DelKey{
+	workQueue.Enqueue(etcd.DelKey{
 		Resource: etcd.Containers,
 		Key:      name,
-	}
+	})
 
-	err = docker.Cli.ContainerRemove(context.TODO(),
+	// the encrypted volumes bound by the container are unmounted after it's removed
+	var binds []string
+	if resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName); err == nil && resp.HostConfig != nil {
+		binds = resp.HostConfig.Binds
+	}
+	endVolumeUsage(ctx, ctrVersionName)
+	unshapeBandwidth(ctx, ctrVersionName)
+	err = docker.Cli.ContainerRemove(ctx,
 		fmt.Sprintf("%s-%d", name, version),
-		types.ContainerRemoveOptions{Force: true})
+		types.ContainerRemoveOptions{Force: force})
+	if err != nil && !force {
+		log.Warnf("services.DeleteContainer, container: %s remove failed after the graceful stop, force remove it, error: %v", ctrVersionName, err)
+		err = docker.Cli.ContainerRemove(ctx, ctrVersionName, types.ContainerRemoveOptions{Force: true})
+	}
 	if err != nil {
 		return errors.WithMessage(err, "docker.Cli.ContainerRemove failed")
 	}
 
+	// don't leave the decrypted view of the encrypted volumes on the host
+	var vs VolumeService
+	vs.unmountUnusedEncryption(ctx, binds)
+
 	log.Infof("services.DeleteContainer, container: %s delete successfully", fmt.Sprintf("%s-%d", name, version))
 	log.Infof("services.DeleteContainer, container: %s will be del etcd info and version record", name)
+	notify.Emit(models.EventContainerDeleted, name, map[string]interface{}{
+		"containerName": fmt.Sprintf("%s-%d", name, version),
+		"gpus":          uuids,
+	})
 	return nil
 }
 
-func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.ContainerExecute) (resp *string, err error) {
+// DeleteAllVersions removes every version of the replicaSet, e.g. the old versions kept by a failed copy,
+// then the record and the version number are deleted if nothing is left. The latest version is deleted by
+// DeleteContainer to release its resources, the running versions are kept unless force is set.
+// It's idempotent, nothing is reported if the replicaSet has no version.
+func (rs *ReplicaSetService) DeleteAllVersions(name string, force bool) (*models.ContainerDeleteReport, error) {
+	ctx := context.Background()
+	list, err := listContainerVersions(ctx, name, true)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.listContainerVersions failed")
+	}
+
+	report := &models.ContainerDeleteReport{
+		Removed: make([]string, 0),
+		Running: make([]string, 0),
+		Failed:  make([]string, 0),
+	}
+	latest, hasLatest := vmap.ContainerVersionMap.Get(name)
+	latestName := fmt.Sprintf("%s-%d", name, latest)
+	latestFound := false
+	// the host ports of the versions removed here, DeleteContainer releases the ones of the latest version
+	var ports []string
+	for _, ctr := range list {
+		if len(ctr.Names) == 0 {
+			continue
+		}
+		ctrVersionName := strings.TrimPrefix(ctr.Names[0], "/")
+		if !isVersionOf(ctrVersionName, name) {
+			continue
+		}
+		if ctr.State == "running" && !force {
+			report.Running = append(report.Running, ctrVersionName)
+			if hasLatest && ctrVersionName == latestName {
+				latestFound = true
+			}
+			continue
+		}
+
+		if hasLatest && ctrVersionName == latestName {
+			latestFound = true
+			if err = rs.DeleteContainer(name, nil); err != nil {
+				log.Errorf("services.DeleteAllVersions, container: %s delete failed, error: %v", ctrVersionName, err)
+				report.Failed = append(report.Failed, ctrVersionName)
+				continue
+			}
+		} else {
+			bindings, err := rs.containerPortBindings(ctrVersionName)
+			if err != nil {
+				log.Errorf("services.DeleteAllVersions, container: %s port bindings not found, error: %v", ctrVersionName, err)
+			}
+			endVolumeUsage(ctx, ctrVersionName)
+			err = docker.Cli.ContainerRemove(ctx, ctrVersionName, types.ContainerRemoveOptions{Force: true})
+			if err != nil {
+				log.Errorf("services.DeleteAllVersions, container: %s remove failed, error: %v", ctrVersionName, err)
+				report.Failed = append(report.Failed, ctrVersionName)
+				continue
+			}
+			ports = append(ports, bindings...)
+		}
+		report.Removed = append(report.Removed, ctrVersionName)
+	}
+	if len(report.Running) != 0 || len(report.Failed) != 0 {
+		log.Infof("services.DeleteAllVersions, replicaSet: %s is partly deleted, report: %+v", name, *report)
+		return report, nil
+	}
+
+	// the latest version may have been removed outside, release what's held by the replicaSet name
+	// and the host ports recorded for it
+	if hasLatest && !latestFound {
+		if info, err := rs.GetContainerInfo(name); err == nil && info.HostConfig != nil {
+			for _, bindings := range info.HostConfig.PortBindings {
+				if len(bindings) != 0 && len(bindings[0].HostPort) != 0 && bindings[0].HostPort != "0" {
+					ports = append(ports, bindings[0].HostPort)
+				}
+			}
+		}
+		schedulers.GpuScheduler.RestoreFraction(name)
+		schedulers.GpuScheduler.RestoreShared(name)
+		schedulers.GpuScheduler.RemoveJob(name)
+		schedulers.GpuScheduler.RemoveLabels(name)
+		schedulers.ResourceScheduler.Restore(name)
+		schedulers.MpsManager.Release(name)
+	}
+	// the whole gpus are held by the replicaSet name, a running version other than the latest may still hold some
+	if gpus := schedulers.GpuScheduler.RestoreOwner(name); len(gpus) != 0 {
+		log.Infof("services.DeleteAllVersions, replicaSet: %s gpus: %v released", name, gpus)
+	}
+	schedulers.PortScheduler.Restore(ports)
+	vmap.ContainerVersionMap.Remove(name)
+	workQueue.Enqueue(etcd.DelKey{
+		Resource: etcd.Containers,
+		Key:      name,
+	})
+	_ = os.RemoveAll(filepath.Dir(mergedPath(latestName)))
+
+	log.Infof("services.DeleteAllVersions, replicaSet: %s all versions deleted, report: %+v", name, *report)
+	return report, nil
+}
+
+// ExecuteContainer runs a short command and returns its whole output and exit code, use ExecuteContainerStream for the long ones.
+// The create and the attach are bounded by --dockerTimeout, the output by --execTimeout.
+func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.ContainerExecute) (*models.ExecResult, error) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+	execID, hijackedResp, err := startExec(ctx, name, exec, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer hijackedResp.Close()
+
+	stdout, stderr, err := readExecOutput(hijackedResp, cfg.ExecTimeout)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "services.readExecOutput failed, name: %s, spec: %+v", name, exec)
+	}
+
+	// the output ends when the command exits, so the exit code is known
+	ctx, cancel = dockerContext()
+	defer cancel()
+	inspect, err := docker.Cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerExecInspect failed, name: %s, exec: %s", name, execID)
+	}
+	log.Infof("services.ExecuteContainer, container: %s execute successfully, exec: %+v, exit code: %d", name, exec, inspect.ExitCode)
+	return &models.ExecResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		ExitCode: inspect.ExitCode,
+	}, nil
+}
+
+// readExecOutput reads the multiplexed output of the exec until the command exits, 0 timeout means no timeout.
+// The hijacked connection doesn't follow a ctx, so the read is stopped by the deadline of the connection.
+func readExecOutput(hijackedResp types.HijackedResponse, timeout time.Duration) (string, string, error) {
+	if timeout > 0 {
+		_ = hijackedResp.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, hijackedResp.Reader); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", "", errors.Wrapf(err, "the command doesn't exit in %s", timeout)
+		}
+		return "", "", errors.Wrap(err, "stdcopy.StdCopy failed")
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+// execInContainer runs the command in the container without a shell and returns its stdout,
+// a non-zero exit code is an error with the stderr
+func execInContainer(ctx context.Context, id string, cmd []string) (string, error) {
+	execCreate, err := docker.Cli.ContainerExecCreate(ctx, id, types.ExecConfig{
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "docker.ContainerExecCreate failed, id: %s", id)
+	}
+	hijackedResp, err := docker.Cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", errors.Wrapf(err, "docker.ContainerExecAttach failed, id: %s", id)
+	}
+	defer hijackedResp.Close()
+
+	stdout, stderr, err := readExecOutput(hijackedResp, cfg.ExecTimeout)
+	if err != nil {
+		return "", errors.WithMessagef(err, "services.readExecOutput failed, id: %s, cmd: %v", id, cmd)
+	}
+	inspect, err := docker.Cli.ContainerExecInspect(ctx, execCreate.ID)
+	if err != nil {
+		return "", errors.Wrapf(err, "docker.ContainerExecInspect failed, id: %s", id)
+	}
+	if inspect.ExitCode != 0 {
+		return "", errors.Errorf("command: %v exit with code %d, stderr: %s", cmd, inspect.ExitCode, strings.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
+
+// ExecuteContainerStream runs a command and returns its stdout and stderr demultiplexed as they are produced,
+// the stream isn't bounded by the timeout of the docker calls. If the caller closes it before the command exits,
+// the connection to docker is closed, the command gets SIGPIPE when it writes the output after that.
+func (rs *ReplicaSetService) ExecuteContainerStream(name string, exec *models.ContainerExecute) (io.ReadCloser, error) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+	execID, hijackedResp, err := startExec(ctx, name, exec, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(writer, writer, hijackedResp.Reader)
+		_ = writer.CloseWithError(err)
+	}()
+	log.Infof("services.ExecuteContainerStream, container: %s execute started, exec: %+v", name, exec)
+	return &execStream{PipeReader: reader, hijackedResp: hijackedResp, execID: execID}, nil
+}
+
+// startExec creates the exec of the command in the latest version of the container and attaches to it,
+// a non-nil tty attaches the stdin and allocates a tty of the size [rows, cols], the output isn't multiplexed then.
+func startExec(ctx context.Context, name string, exec *models.ContainerExecute, tty *[2]uint) (string, types.HijackedResponse, error) {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
-		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return "", types.HijackedResponse{}, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 
 	workDir := "/"
@@ -155,35 +604,125 @@ func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.Containe
 	if len(exec.Cmd) != 0 {
 		cmd = exec.Cmd
 	}
+	detachKeys := defaultDetachKeys
+	if len(exec.DetachKeys) != 0 {
+		detachKeys = exec.DetachKeys
+	}
 
-	ctx := context.Background()
 	execCreate, err := docker.Cli.ContainerExecCreate(ctx, fmt.Sprintf("%s-%d", name, version), types.ExecConfig{
 		AttachStderr: true,
 		AttachStdout: true,
 		Detach:       true,
-		DetachKeys:   "ctrl-p,q",
+		AttachStdin:  tty != nil,
+		Tty:          tty != nil,
+		ConsoleSize:  tty,
+		DetachKeys:   detachKeys,
 		WorkingDir:   workDir,
 		Cmd:          cmd,
+		Env:          exec.Env,
+		User:         exec.User,
 	})
 	if err != nil {
-		return resp, errors.Wrapf(err, "docker.ContainerExecCreate failed, name: %s, spec: %+v", name, exec)
+		return "", types.HijackedResponse{}, errors.Wrapf(err, "docker.ContainerExecCreate failed, name: %s, spec: %+v", name, exec)
 	}
 
-	hijackedResp, err := docker.Cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{})
-	defer hijackedResp.Close()
+	hijackedResp, err := docker.Cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{
+		Tty:         tty != nil,
+		ConsoleSize: tty,
+	})
 	if err != nil {
-		return resp, errors.Wrapf(err, "docker.ContainerExecAttach failed, name: %s, spec: %+v", name, exec)
+		return "", types.HijackedResponse{}, errors.Wrapf(err, "docker.ContainerExecAttach failed, name: %s, spec: %+v", name, exec)
 	}
+	return execCreate.ID, hijackedResp, nil
+}
 
-	var buf bytes.Buffer
-	_, _ = stdcopy.StdCopy(&buf, &buf, hijackedResp.Reader)
-	str := buf.String()
-	resp = &str
-	log.Infof("services.ExecuteContainer, container: %s execute successfully, exec: %+v", name, exec)
-	return
+// defaultShell is the command of an interactive exec if it's not specified
+var defaultShell = []string{"/bin/sh"}
+
+// defaultDetachKeys is the key sequence to detach from an exec if it's not specified, the same as docker
+const defaultDetachKeys = "ctrl-p,q"
+
+// ExecuteContainerInteractive runs a command with the stdin attached and a tty of rows and cols, e.g. a shell,
+// the caller writes the input to the session and reads the output from it. The command keeps running
+// if it's detached by the detach keys, otherwise it gets the hangup when the session is closed.
+func (rs *ReplicaSetService) ExecuteContainerInteractive(name string, exec *models.ContainerExecute, rows, cols uint) (*ExecSession, error) {
+	if len(exec.Cmd) == 0 {
+		exec.Cmd = defaultShell
+	}
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+	execID, hijackedResp, err := startExec(ctx, name, exec, &[2]uint{rows, cols})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("services.ExecuteContainerInteractive, container: %s session started, exec: %+v", name, exec)
+	return &ExecSession{hijackedResp: hijackedResp, execID: execID}, nil
+}
+
+// ExecSession is the tty of an interactive exec
+type ExecSession struct {
+	hijackedResp types.HijackedResponse
+	execID       string
+}
+
+// Read reads the output of the tty, it returns io.EOF after the command exits or is detached
+func (s *ExecSession) Read(b []byte) (int, error) {
+	return s.hijackedResp.Reader.Read(b)
+}
+
+// Write writes the input to the tty
+func (s *ExecSession) Write(b []byte) (int, error) {
+	return s.hijackedResp.Conn.Write(b)
+}
+
+// Resize changes the size of the tty after the terminal of the user is resized
+func (s *ExecSession) Resize(rows, cols uint) error {
+	ctx, cancel := dockerContext()
+	defer cancel()
+	if err := docker.Cli.ContainerExecResize(ctx, s.execID, types.ResizeOptions{Height: rows, Width: cols}); err != nil {
+		return errors.Wrapf(err, "docker.ContainerExecResize failed, exec: %s", s.execID)
+	}
+	return nil
+}
+
+func (s *ExecSession) Close() error {
+	s.hijackedResp.Close()
+	return nil
+}
+
+// execStream is the demultiplexed output of an exec, closing it closes the connection to docker.
+// Docker has no api to stop an exec, and the pid it reports is in the pid namespace of the host,
+// so the command is not killed, it stops by the broken pipe of its output.
+type execStream struct {
+	*io.PipeReader
+	hijackedResp types.HijackedResponse
+	execID       string
+	once         sync.Once
+}
+
+func (s *execStream) Close() error {
+	s.once.Do(func() {
+		_ = s.PipeReader.Close()
+		s.hijackedResp.Close()
+		log.Infof("services.ExecuteContainerStream, exec: %s closed", s.execID)
+	})
+	return nil
 }
 
 func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchRequest) (id, newContainerName string, err error) {
+	defer func() {
+		if err == nil {
+			notify.Emit(models.EventContainerPatched, name, map[string]interface{}{
+				"containerName": newContainerName,
+				"strategy":      spec.Strategy,
+			})
+		}
+	}()
+	if spec.Strategy == models.PatchBlueGreen {
+		return rs.blueGreenPatchContainer(name, spec)
+	}
+
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
@@ -202,6 +741,29 @@ func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchReque
 		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
+	// checkpoint the process state of the old version, it will be restored on the new version
+	var checkpoint *models.ContainerCheckpoint
+	if spec.Checkpoint {
+		checkpoint, err = rs.checkpointForPatch(ctx, ctrVersionName, spec, info)
+		if err != nil {
+			return id, newContainerName, errors.WithMessage(err, "services.checkpointForPatch failed")
+		}
+		info.Checkpoint = checkpoint
+		defer func() {
+			// the new version is not running, keep the old version serving from the checkpoint
+			if err != nil && len(newContainerName) == 0 {
+				if restoreErr := rs.restoreFromCheckpoint(ctrVersionName, checkpoint); restoreErr != nil {
+					log.Errorf("services.PatchContainer, container: %s restore from checkpoint: %s failed, error: %v",
+						ctrVersionName, checkpoint.ID, restoreErr)
+				}
+			}
+		}()
+	}
+
+	if err = rs.patchImage(ctx, spec.ImagePatch, info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "patchImage failed")
+	}
+
 	// update gpu info
 	info, err = rs.patchGpu(ctrVersionName, spec.GpuPatch, info)
 	if err != nil {
@@ -213,17 +775,34 @@ func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchReque
 	if err != nil {
 		return id, newContainerName, errors.WithMessage(err, "patchVolume failed")
 	}
+	info = rs.patchEnv(spec.EnvPatch, info)
+	if err = rs.patchPorts(ctx, name, spec.PortPatch, info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "patchPorts failed")
+	}
 
 	// create a new container to replace the old one
-	id, newContainerName, kv, err := rs.runContainer(ctx, name, info)
+	id, newContainerName, kv, err := rs.runContainerWith(ctx, name, info, runOptions{deferReadiness: true})
 	if err != nil {
 		return id, newContainerName, errors.WithMessage(err, "runContainer failed")
 	}
+	// resume the restored cuda processes on the gpus
+	if checkpoint != nil && checkpoint.Cuda {
+		if _, err := rs.toggleCudaProcesses(ctx, newContainerName, "checkpointed"); err != nil {
+			log.Errorf("services.PatchContainer, container: %s resume cuda processes failed, error: %v", newContainerName, err)
+		}
+	}
 
-	// copy the old container's merged files to the new container
-	err = utils.CopyOldMergedToNewContainerMerged(info.ContainerName, newContainerName)
-	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+	// copy the old container's merged files to the new container,
+	// if it failed, the old container is kept and the new version is marked as incomplete
+	oldContainerName := info.ContainerName
+	if spec.ImagePatch == nil || spec.ImagePatch.CopyMerged {
+		err = copyWithRetry(ctx, etcd.Containers, oldContainerName, newContainerName, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+			return utils.CopyOldMergedToNewContainerMerged(ctx, oldContainerName, newContainerName, progress)
+		}, rs.replaceRetried(ctrVersionName, version, kv))
+		if err != nil {
+			workQueue.Enqueue(incompleteContainer(kv))
+			return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		}
 	}
 
 	// delete the old container
@@ -238,11 +817,17 @@ func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchReque
 		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	// the probe runs after the merged files are copied and the old version is removed
+	if err = awaitReadiness(ctx, &kv); err != nil {
+		workQueue.Enqueue(kv)
+		return id, newContainerName, errors.WithMessage(err, "services.awaitReadiness failed")
+	}
+
+	workQueue.Enqueue(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.PatchContainer, container: %s patch configuration successfully", name)
 	return
@@ -257,44 +842,73 @@ func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.Rollbac
 	if spec.Version == version {
 		return "", xerrors.NewNoRollbackRequiredError()
 	}
+	if spec.Version > version {
+		return "", errors.Wrapf(xerrors.NewContainerVersionNotFoundError(), "container: %s version: %d, latest version: %d", name, spec.Version, version)
+	}
 
 	// get revision info form etcd
-	value, err := etcd.GetRevision(etcd.Containers, name, spec.Version)
+	info, err := rs.containerVersionInfo(name, spec.Version)
 	if err != nil {
-		return "", errors.WithMessage(err, "etcd.GetRevisionRange failed")
+		return "", errors.WithMessage(err, "services.containerVersionInfo failed")
 	}
-	info := &models.EtcdContainerInfo{}
-	if err = json.Unmarshal(value, &info); err != nil {
-		return "", errors.WithMessage(err, "json.Unmarshal failed")
+
+	// the merged layer of the target version is saved when it was replaced,
+	// check it before the gpu is patched, so that nothing is changed if it's missing
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+	src := mergedPath(info.ContainerName)
+	if spec.FromCurrent {
+		src, err = utils.GetContainerMergedLayer(ctrVersionName)
+		if err != nil {
+			return "", errors.WithMessage(err, "utils.GetContainerMergedLayer failed")
+		}
+	} else if err = utils.IsDir(src); err != nil {
+		return "", errors.Wrapf(xerrors.NewContainerVersionNotFoundError(), "container: %s version: %d merged layer: %s not found", name, spec.Version, src)
+	}
+
+	// the gpus of the current version may be held in another mode, e.g. shared while the target version
+	// holds whole gpus, they are released after the gpus of the target version are applied
+	current, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return "", errors.WithMessage(err, "services.GetContainerInfo failed")
 	}
 
 	// compare gpu info
-	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
-	info, err = rs.patchGpu(ctrVersionName, &models.GpuPatch{
-		GpuCount: len(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs),
-	}, info)
+	if info.GpuSlots > 0 {
+		err = rs.applyFraction(name, info)
+	} else if info.GpuShared {
+		err = rs.applyShared(name, info)
+	} else if gpuMode(&current) != schedulers.GpuModeWhole {
+		// the gpus of the current container are not whole gpus, so they can't be patched
+		err = rs.applyWhole(name, info)
+	} else {
+		info, err = rs.patchGpu(ctrVersionName, &models.GpuPatch{
+			GpuCount: len(infoDeviceIDs(info)),
+		}, info)
+	}
 	if err != nil {
 		return "", errors.WithMessage(err, "patchGpu failed")
 	}
+	if released := schedulers.GpuScheduler.RestoreExcept(name, gpuMode(info)); len(released) != 0 {
+		log.Infof("services.RollbackContainer, replicaSet: %s released the gpus of the current version: %+v", name, released)
+	}
 
 	// create a new container to replace the old one
-	_, newContainerName, kv, err := rs.runContainer(context.TODO(), name, info)
+	_, newContainerName, kv, err := rs.runContainerWith(context.TODO(), name, info, runOptions{deferReadiness: true})
 	if err != nil {
 		return "", errors.WithMessage(err, "runContainer failed")
 	}
 
-	// copy the old container's merged files to the new container
-	src, ok := vmap.ContainerMergeMap.Get(info.Version)
-	if !ok {
-		return "", errors.Errorf("container: %s version: %d merge path not found in ContainerMergeMap", info.ContainerName, info.Version)
-	}
+	// copy the merged files of the target version or the current version to the new container
 	dest, err := utils.GetContainerMergedLayer(newContainerName)
 	if err != nil {
 		return "", errors.WithMessage(err, "utils.GetContainerMergedLayer failed")
 	}
 
-	err = utils.CopyDir(src, dest)
+	err = copyWithRetry(context.TODO(), etcd.Containers, src, newContainerName, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+		return utils.CopyDir(context.TODO(), src, dest, progress)
+	}, rs.replaceRetried(ctrVersionName, version, kv))
 	if err != nil {
+		workQueue.Enqueue(incompleteContainer(kv))
 		return "", errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
 	}
 
@@ -310,79 +924,372 @@ func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.Rollbac
 		return "", errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	// the probe runs after the merged files are copied and the old version is removed
+	if err = awaitReadiness(context.TODO(), &kv); err != nil {
+		workQueue.Enqueue(kv)
+		return newContainerName, errors.WithMessage(err, "services.awaitReadiness failed")
+	}
+
+	workQueue.Enqueue(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.RollbackContainer, container: %s patch configuration successfully", ctrVersionName)
+	notify.Emit(models.EventContainerPatched, name, map[string]interface{}{
+		"containerName": newContainerName,
+		"rollbackTo":    spec.Version,
+	})
 	return newContainerName, nil
 }
 
-func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
-	if spec == nil {
-		return info, nil
+// CloneContainer creates a new replicaSet based on the latest version of an existing replicaSet.
+// The new replicaSet will apply for new gpus and ports, and record which container it was cloned from.
+func (rs *ReplicaSetService) CloneContainer(name string, spec *models.ContainerClone) (id, newContainerName string, err error) {
+	defer func() {
+		if err == nil {
+			notify.Emit(models.EventContainerCreated, spec.NewReplicaSetName, map[string]interface{}{
+				"containerName": newContainerName,
+				"cloneFrom":     name,
+			})
+		}
+	}()
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return id, newContainerName, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
-	uuids, err := rs.containerDeviceRequestsDeviceIDs(name)
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	// get the container info
+	ctx := context.Background()
+	exist, err := rs.existContainer(ctx, spec.NewReplicaSetName)
 	if err != nil {
-		return info, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+		return id, newContainerName, errors.WithMessage(err, "services.existContainer failed")
+	}
+	if exist {
+		return id, newContainerName, errors.Wrapf(xerrors.NewContainerExistedError(spec.NewReplicaSetName), "container %s", spec.NewReplicaSetName)
+	}
+	if err = checkContainerLimit(ctx); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.checkContainerLimit failed")
+	}
+	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	if err != nil {
+		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+	}
+	info := &models.EtcdContainerInfo{}
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
-	if len(uuids) == spec.GpuCount {
-		return info, nil
+	// reserve the same cpu and memory requests for the new replicaSet
+	if info.Requests != nil {
+		if err = schedulers.ResourceScheduler.Apply(spec.NewReplicaSetName, *info.Requests); err != nil {
+			return id, newContainerName, errors.WithMessage(err, "ResourceScheduler.Apply failed")
+		}
 	}
 
-	if spec.GpuCount > len(uuids) {
-		// lift gpu configuration
-		applyGpus := spec.GpuCount - len(uuids)
-		uuids, err := schedulers.GpuScheduler.Apply(applyGpus)
-		log.Infof("services.PatchContainerGpuInfo, container: %s apply %d gpus, uuids: %+v", name, applyGpus, uuids)
-		if err != nil {
-			return info, errors.WithMessage(err, "GpuScheduler.Apply failed")
+	// apply for new gpus, the gpus of the source container can not be shared
+	var uuids []string
+	// the clone has the same anti-co-location labels as the source
+	if labels := info.Config.Labels[gpuLabelsLabel]; len(labels) != 0 && (info.GpuSlots > 0 || info.GpuShared) {
+		schedulers.GpuScheduler.SetLabels(spec.NewReplicaSetName, strings.Split(labels, ","))
+	}
+	if info.GpuSlots > 0 {
+		if err = rs.applyFraction(spec.NewReplicaSetName, info); err != nil {
+			schedulers.ResourceScheduler.Restore(spec.NewReplicaSetName)
+			schedulers.GpuScheduler.RemoveLabels(spec.NewReplicaSetName)
+			return id, newContainerName, errors.WithMessage(err, "services.applyFraction failed")
 		}
-		if applyGpus == spec.GpuCount {
-			// no gpu was used before.
-			info.HostConfig.Resources = rs.newContainerResource(uuids)
-			log.Infof("services.PatchContainerGpuInfo, container: %s change to card container, now use %d gpus, uuids: %s",
-				name, len(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs), info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
-		} else {
-			// before using gpu
-			info.HostConfig.Resources.DeviceRequests[0].DeviceIDs = append(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs, uuids...)
-			log.Infof("services.PatchContainerGpuInfo, container: %s upgrad %d gpu configuration, now use %d gpus, uuids: %+v",
-				name, applyGpus, len(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs), info.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
+	} else if info.GpuShared {
+		if err = rs.applyShared(spec.NewReplicaSetName, info); err != nil {
+			schedulers.ResourceScheduler.Restore(spec.NewReplicaSetName)
+			schedulers.GpuScheduler.RemoveLabels(spec.NewReplicaSetName)
+			return id, newContainerName, errors.WithMessage(err, "services.applyShared failed")
 		}
-	} else {
-		restoreGpus := len(uuids) - spec.GpuCount
-		schedulers.GpuScheduler.Restore(uuids[:restoreGpus])
-		log.Infof("services.PatchContainerGpuInfo, container: %s restore %d gpus, uuids: %+v",
-			name, len(uuids[:restoreGpus]), uuids[:restoreGpus])
-		if len(uuids[:spec.GpuCount]) == 0 {
-			// change to no using gpu
-			info.HostConfig.Resources = container.Resources{}
-			log.Infof("services.PatchContainerGpuInfo, container: %s change to cardless container", name)
-		} else {
-			// lower gpu configuration
-			info.HostConfig.Resources.DeviceRequests[0].DeviceIDs = uuids[restoreGpus:]
-			log.Infof("services.PatchContainerGpuInfo, container: %s reduce %d gpu configuration, now use %d gpus, uuids: %+v",
-				name, restoreGpus, len(uuids[:restoreGpus]), uuids[:restoreGpus])
+	} else if count := len(infoDeviceIDs(info)); count > 0 {
+		uuids, err = schedulers.GpuScheduler.ApplyConstrained(spec.NewReplicaSetName, nil, count, info.GpuConstraints)
+		if err != nil {
+			schedulers.ResourceScheduler.Restore(spec.NewReplicaSetName)
+			return id, newContainerName, errors.WithMessage(err, "GpuScheduler.ApplyConstrained failed")
 		}
+		info.HostConfig.DeviceRequests[0].DeviceIDs = uuids
+		log.Infof("services.CloneContainer, container: %s apply %d gpus, uuids: %+v", spec.NewReplicaSetName, len(uuids), uuids)
+	}
+	info.CloneFrom = ctrVersionName
+	// the clone belongs to the same external job as the source
+	if jobID := info.Config.Labels[jobIDLabel]; len(jobID) != 0 {
+		schedulers.GpuScheduler.SetJob(spec.NewReplicaSetName, jobID)
 	}
 
-	return info, nil
-}
-
-func (rs *ReplicaSetService) patchVolume(spec *models.VolumePatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
-	if spec == nil {
+	// host ports will be reapplied in runContainer
+	id, newContainerName, kv, err := rs.runContainerWith(ctx, spec.NewReplicaSetName, info, runOptions{deferReadiness: true})
+	if err != nil {
+		schedulers.GpuScheduler.Restore(uuids)
+		schedulers.GpuScheduler.RestoreFraction(spec.NewReplicaSetName)
+		schedulers.GpuScheduler.RestoreShared(spec.NewReplicaSetName)
+		schedulers.ResourceScheduler.Restore(spec.NewReplicaSetName)
+		schedulers.GpuScheduler.RemoveJob(spec.NewReplicaSetName)
+		schedulers.GpuScheduler.RemoveLabels(spec.NewReplicaSetName)
+		return id, newContainerName, errors.WithMessage(err, "runContainer failed")
+	}
+
+	if spec.CopyMerged {
+		err = copyWithRetry(ctx, etcd.Containers, ctrVersionName, newContainerName, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+			return utils.CopyOldMergedToNewContainerMerged(ctx, ctrVersionName, newContainerName, progress)
+		}, rs.cloneRetried(spec.NewReplicaSetName, newContainerName, kv))
+		// the clone is pending until the retries end, otherwise it's removed with the gpus released
+		if xerrors.IsCopyRetryingError(err) {
+			workQueue.Enqueue(incompleteContainer(kv))
+			return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		}
+		if err != nil {
+			rs.rollbackClone(spec.NewReplicaSetName, newContainerName)
+			return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		}
+	}
+
+	// the probe runs after the merged files are copied
+	if err = awaitReadiness(ctx, &kv); err != nil {
+		workQueue.Enqueue(kv)
+		return id, newContainerName, errors.WithMessage(err, "services.awaitReadiness failed")
+	}
+
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Containers,
+		Key:      kv.Key,
+		Value:    kv.Value,
+	})
+
+	log.Infof("services.CloneContainer, container: %s clone to %s successfully", ctrVersionName, newContainerName)
+	return
+}
+
+func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	if spec == nil {
+		return info, nil
+	}
+	if info.GpuSlots > 0 {
+		return info, errors.Errorf("container: %s uses a fractional gpu, patching gpu count is not supported", name)
+	}
+	if info.GpuShared {
+		return info, errors.Errorf("container: %s uses shared gpus, patching gpu count is not supported", name)
+	}
+	// the gpus currently used by the container, the info may come from an old revision (e.g. rollback),
+	// so the device ids in info can not be trusted
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(name)
+	if err != nil {
+		return info, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+
+	if len(uuids) == spec.GpuCount {
+		if len(uuids) != 0 {
+			info.HostConfig.DeviceRequests = rs.newContainerResource(uuids, infoDeviceOptions(info)).DeviceRequests
+		}
 		return info, nil
 	}
 
-	if spec.OldBind.Format() == spec.NewBind.Format() {
+	if spec.GpuCount > len(uuids) {
+		// lift gpu configuration
+		applyGpus := spec.GpuCount - len(uuids)
+		// the gpus requested by uuid which the container doesn't use, e.g. after a rollback, are requested again
+		missing := missingGpus(info.GpuUUIDs, uuids)
+		if len(missing) > applyGpus {
+			missing = missing[:applyGpus]
+		}
+		newUuids, err := schedulers.GpuScheduler.ApplyConstrained(replicaSetOf(name), missing, applyGpus, info.GpuConstraints)
+		log.Infof("services.PatchContainerGpuInfo, container: %s apply %d gpus, uuids: %+v", name, applyGpus, newUuids)
+		if err != nil {
+			return info, errors.WithMessage(err, "GpuScheduler.ApplyConstrained failed")
+		}
+		info.HostConfig.DeviceRequests = rs.newContainerResource(append(uuids, newUuids...), infoDeviceOptions(info)).DeviceRequests
+		if applyGpus == spec.GpuCount {
+			// no gpu was used before.
+			log.Infof("services.PatchContainerGpuInfo, container: %s change to card container, now use %d gpus, uuids: %s",
+				name, len(info.HostConfig.DeviceRequests[0].DeviceIDs), info.HostConfig.DeviceRequests[0].DeviceIDs)
+		} else {
+			// before using gpu
+			log.Infof("services.PatchContainerGpuInfo, container: %s upgrad %d gpu configuration, now use %d gpus, uuids: %+v",
+				name, applyGpus, len(info.HostConfig.DeviceRequests[0].DeviceIDs), info.HostConfig.DeviceRequests[0].DeviceIDs)
+		}
+	} else {
+		restoreGpus := len(uuids) - spec.GpuCount
+		// the gpus requested by uuid are kept as long as possible
+		uuids = releaseOrder(uuids, info.GpuUUIDs)
+		info.GpuUUIDs = slices.DeleteFunc(slices.Clone(info.GpuUUIDs), func(uuid string) bool {
+			return !slices.Contains(uuids[restoreGpus:], uuid)
+		})
+		schedulers.GpuScheduler.Restore(uuids[:restoreGpus])
+		log.Infof("services.PatchContainerGpuInfo, container: %s restore %d gpus, uuids: %+v",
+			name, len(uuids[:restoreGpus]), uuids[:restoreGpus])
+		if spec.GpuCount == 0 {
+			// change to no using gpu
+			info.HostConfig.DeviceRequests = nil
+			log.Infof("services.PatchContainerGpuInfo, container: %s change to cardless container", name)
+		} else {
+			// lower gpu configuration
+			info.HostConfig.DeviceRequests = rs.newContainerResource(uuids[restoreGpus:], infoDeviceOptions(info)).DeviceRequests
+			log.Infof("services.PatchContainerGpuInfo, container: %s reduce %d gpu configuration, now use %d gpus, uuids: %+v",
+				name, restoreGpus, len(uuids[restoreGpus:]), uuids[restoreGpus:])
+		}
+	}
+
+	return info, nil
+}
+
+// missingGpus returns the requested gpus which are not in the uuids
+func missingGpus(requested, uuids []string) []string {
+	var missing []string
+	for _, uuid := range requested {
+		if !slices.Contains(uuids, uuid) {
+			missing = append(missing, uuid)
+		}
+	}
+	return missing
+}
+
+// releaseOrder orders the gpus so that the ones not requested by uuid come first and are released first
+func releaseOrder(uuids, requested []string) []string {
+	ordered := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if !slices.Contains(requested, uuid) {
+			ordered = append(ordered, uuid)
+		}
+	}
+	for _, uuid := range uuids {
+		if slices.Contains(requested, uuid) {
+			ordered = append(ordered, uuid)
+		}
+	}
+	return ordered
+}
+
+// PatchContainerEnv creates a new version with the envs patched, the gpus and volumes are kept
+func (rs *ReplicaSetService) PatchContainerEnv(name string, spec *models.EnvPatch) (id, newContainerName string, err error) {
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.GetContainerInfo failed")
+	}
+	if slices.Equal(mergeEnv(info.Config.Env, spec), info.Config.Env) {
+		return id, newContainerName, errors.Wrapf(xerrors.NewNoPatchRequiredError(), "container: %s", name)
+	}
+	return rs.PatchContainer(name, &models.PatchRequest{EnvPatch: spec})
+}
+
+// PatchContainerImage creates a new version with the image replaced, the gpus, volumes and ports are kept
+func (rs *ReplicaSetService) PatchContainerImage(name string, spec *models.ImagePatch) (id, newContainerName string, err error) {
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "services.GetContainerInfo failed")
+	}
+	if info.Config.Image == spec.ImageName {
+		return id, newContainerName, errors.Wrapf(xerrors.NewNoPatchRequiredError(), "container: %s image: %s", name, spec.ImageName)
+	}
+	return rs.PatchContainer(name, &models.PatchRequest{ImagePatch: spec})
+}
+
+// PatchContainerPorts creates a new version with the ports published or unpublished, the gpus and volumes are kept,
+// the ports returned are the host ports bound to the new version, e.g. "22/tcp": "40001".
+func (rs *ReplicaSetService) PatchContainerPorts(name string, spec *models.ContainerPortPatch) (id, newContainerName string, ports map[string]string, err error) {
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		return id, newContainerName, nil, errors.WithMessage(err, "services.GetContainerInfo failed")
+	}
+	if _, changed := mergePorts(&info, spec); !changed {
+		return id, newContainerName, nil, errors.Wrapf(xerrors.NewNoPatchRequiredError(), "container: %s", name)
+	}
+	id, newContainerName, err = rs.PatchContainer(name, &models.PatchRequest{PortPatch: spec})
+	if err != nil {
+		return id, newContainerName, nil, err
+	}
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+	if ports, err = inspectBoundPorts(ctx, newContainerName); err != nil {
+		return id, newContainerName, nil, errors.WithMessage(err, "services.inspectBoundPorts failed")
+	}
+	return id, newContainerName, ports, nil
+}
+
+// patchPorts merges the ports into the info, the host ports requested newly must not be in use,
+// except by the current version of self which is replaced, see checkHostPortConflicts
+func (rs *ReplicaSetService) patchPorts(ctx context.Context, self string, spec *models.ContainerPortPatch, info *models.EtcdContainerInfo) error {
+	if spec == nil {
+		return nil
+	}
+	added, _ := mergePorts(info, spec)
+	if err := checkHostPortConflicts(ctx, added, self); err != nil {
+		return errors.WithMessage(err, "services.checkHostPortConflicts failed")
+	}
+	return nil
+}
+
+// patchImage pulls the new image before the old version is touched, so that a wrong tag changes nothing
+func (rs *ReplicaSetService) patchImage(ctx context.Context, spec *models.ImagePatch, info *models.EtcdContainerInfo) error {
+	if spec == nil {
+		return nil
+	}
+	if err := ensureImage(ctx, spec.ImageName, false); err != nil {
+		return errors.WithMessage(err, "services.ensureImage failed")
+	}
+	info.Config.Image = spec.ImageName
+	return nil
+}
+
+func (rs *ReplicaSetService) patchEnv(spec *models.EnvPatch, info *models.EtcdContainerInfo) *models.EtcdContainerInfo {
+	if spec == nil {
+		return info
+	}
+	info.Config.Env = mergeEnv(info.Config.Env, spec)
+	return info
+}
+
+// mergeEnv applies the patch to the envs, the order of the kept keys is not changed and the new keys are appended in order.
+// If a key appears several times, docker uses the last one, so the last value is kept at the position of the first one.
+func mergeEnv(env []string, spec *models.EnvPatch) []string {
+	keys := make([]string, 0, len(env))
+	values := make(map[string]string, len(env))
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = kv
+	}
+
+	deleted := make(map[string]struct{}, len(spec.Delete))
+	for _, key := range spec.Delete {
+		deleted[key] = struct{}{}
+	}
+	added := make([]string, 0, len(spec.Set))
+	for key, value := range spec.Set {
+		if _, ok := values[key]; !ok {
+			added = append(added, key)
+		}
+		values[key] = key + "=" + value
+	}
+	sort.Strings(added)
+
+	merged := make([]string, 0, len(keys)+len(added))
+	for _, key := range append(keys, added...) {
+		if _, ok := deleted[key]; !ok {
+			merged = append(merged, values[key])
+		}
+	}
+	return merged
+}
+
+func (rs *ReplicaSetService) patchVolume(spec *models.VolumePatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	if spec == nil {
 		return info, nil
 	}
 
+	// the old bind is matched without the options, so that the options can be changed by the patch,
+	// even if the old bind of the patch is the same as the new one, e.g. to remove ro
+	old := fmt.Sprintf("%s:%s", spec.OldBind.Src, spec.OldBind.Dest)
 	for i := range info.HostConfig.Binds {
-		if info.HostConfig.Binds[i] == spec.OldBind.Format() {
+		if bindWithoutOptions(info.HostConfig.Binds[i]) == old {
 			info.HostConfig.Binds[i] = spec.NewBind.Format()
 			break
 		}
@@ -390,6 +1297,41 @@ func (rs *ReplicaSetService) patchVolume(spec *models.VolumePatch, info *models.
 	return info, nil
 }
 
+// setBinds sets the binds of the volumes and host paths, and the tmpfs mounts, which are not binds in docker
+func setBinds(hostConfig *container.HostConfig, binds []models.Bind) error {
+	hostConfig.Binds = make([]string, 0, len(binds))
+	for i := range binds {
+		if !binds[i].IsTmpfs() {
+			hostConfig.Binds = append(hostConfig.Binds, binds[i].Format())
+			continue
+		}
+		var options []string
+		if binds[i].ReadOnly {
+			options = append(options, "ro")
+		}
+		if len(binds[i].TmpfsSize) != 0 {
+			size, err := utils.ToBytes(binds[i].TmpfsSize)
+			if err != nil {
+				return errors.WithMessagef(err, "utils.ToBytes failed, tmpfs size: %s", binds[i].TmpfsSize)
+			}
+			options = append(options, fmt.Sprintf("size=%d", size))
+		}
+		if hostConfig.Tmpfs == nil {
+			hostConfig.Tmpfs = make(map[string]string)
+		}
+		hostConfig.Tmpfs[binds[i].Dest] = strings.Join(options, ",")
+	}
+	return nil
+}
+
+// bindWithoutOptions returns the src:dest of the bind, e.g. /data:/data for /data:/data:ro
+func bindWithoutOptions(bind string) string {
+	if parts := strings.SplitN(bind, ":", 3); len(parts) == 3 {
+		return parts[0] + ":" + parts[1]
+	}
+	return bind
+}
+
 func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restorePort, isLatest bool) error {
 	if isLatest {
 		// get the latest version number
@@ -409,6 +1351,12 @@ func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restorePort,
 		schedulers.GpuScheduler.Restore(uuids)
 		log.Infof("services.StopContainer, container: %s restore %d gpus, uuids: %+v",
 			name, len(uuids), uuids)
+		// the cpu and memory requests and the MPS sharing are released along with the gpus
+		owner := replicaSetOf(name)
+		schedulers.GpuScheduler.RestoreFraction(owner)
+		schedulers.GpuScheduler.RestoreShared(owner)
+		schedulers.ResourceScheduler.Restore(owner)
+		schedulers.MpsManager.Release(owner)
 	}
 
 	// whether to restore port resources
@@ -441,6 +1389,8 @@ func (rs *ReplicaSetService) DeleteContainerForUpdate(name string) error {
 	schedulers.PortScheduler.Restore(ports)
 	log.Infof("services.DeleteContainerForUpdate, container: %s restore %d ports: %+v",
 		name, len(ports), ports)
+	endVolumeUsage(context.TODO(), name)
+	unshapeBandwidth(context.TODO(), name)
 
 	// delete container
 	err = docker.Cli.ContainerRemove(context.TODO(),
@@ -453,6 +1403,42 @@ func (rs *ReplicaSetService) DeleteContainerForUpdate(name string) error {
 	return nil
 }
 
+// mergedPath returns the directory where the merged layer of the container version is saved when it's replaced
+func mergedPath(ctrVersionName string) string {
+	dir, _ := os.Getwd()
+	return filepath.Join(dir, "merges", strings.Split(ctrVersionName, "-")[0], ctrVersionName)
+}
+
+// containerVersionInfo returns the info of the version of the replicaSet saved in etcd,
+// the version is the version of the container rather than the version of the etcd key,
+// which also changes when the info is updated, e.g. marked as incomplete.
+func (rs *ReplicaSetService) containerVersionInfo(name string, version int64) (*models.EtcdContainerInfo, error) {
+	revisions, err := etcd.GetRevisionRange(etcd.Containers, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+	}
+	values := make([]etcd.Value, 0, len(revisions))
+	for _, revision := range revisions {
+		values = append(values, revision.Value)
+	}
+	return findVersionInfo(name, version, values)
+}
+
+// findVersionInfo returns the info of the version in the values of the revisions, which are from the newest to the oldest,
+// the version is not found if its record has been deleted, e.g. the replicaSet was deleted and created again
+func findVersionInfo(name string, version int64, values []etcd.Value) (*models.EtcdContainerInfo, error) {
+	for _, value := range values {
+		info := &models.EtcdContainerInfo{}
+		if err := json.Unmarshal(value, info); err != nil {
+			return nil, errors.Wrapf(err, "json.Unmarshal failed, value: %s", value)
+		}
+		if info.Version == version {
+			return info, nil
+		}
+	}
+	return nil, errors.Wrapf(xerrors.NewContainerVersionNotFoundError(), "container: %s version: %d", name, version)
+}
+
 func setToMergeMap(name string, version int64) error {
 	var err error
 	defer func() {
@@ -465,12 +1451,10 @@ func setToMergeMap(name string, version int64) error {
 	if err != nil {
 		return errors.WithMessagef(err, "utils.GetContainerMergedLayer failed, container: %s", name)
 	}
-	layer := "merges"
-	dir, _ := os.Getwd()
-	path := filepath.Join(dir, layer, strings.Split(name, "-")[0], name)
+	path := mergedPath(name)
 	_ = os.MkdirAll(path, 0755)
 
-	err = utils.CopyDir(mergedDir, path)
+	_, err = utils.CopyDir(context.Background(), mergedDir, path, nil)
 	if err != nil {
 		return errors.WithMessagef(err, "utils.CopyDir failed, container: %s", name)
 	}
@@ -478,21 +1462,63 @@ func setToMergeMap(name string, version int64) error {
 	return nil
 }
 
-func (rs *ReplicaSetService) StartupContainer(name string) error {
+// StartupContainer restarts the latest version in place, it returns the host ports bound after the restart,
+// docker may assign other ephemeral ports, so they are updated in etcd.
+// The error is returned only if the container is not restarted, the failures after the restart are returned as warnings.
+func (rs *ReplicaSetService) StartupContainer(name string) (boundPorts map[string]string, warnings []string, err error) {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
-		return errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return nil, nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 
-	err := docker.Cli.ContainerRestart(context.TODO(),
-		fmt.Sprintf("%s-%d", name, version),
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+	// a stopped container counts against the container limit once it's started again
+	release, err := reserveContainer(context.TODO(), ctrVersionName)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "services.reserveContainer failed")
+	}
+	defer release()
+	err = docker.Cli.ContainerRestart(context.TODO(),
+		ctrVersionName,
 		container.StopOptions{})
 	if err != nil {
-		return errors.WithMessagef(err, "docker.ContainerRestart failed, name: %s", name)
+		return nil, nil, errors.WithMessagef(err, "docker.ContainerRestart failed, name: %s", name)
 	}
 
-	return nil
+	warnings = make([]string, 0)
+	warn := func(format string, args ...interface{}) {
+		warning := fmt.Sprintf(format, args...)
+		log.Warnf("services.StartupContainer, container: %s restarted, but %s", ctrVersionName, warning)
+		warnings = append(warnings, warning)
+	}
+
+	boundPorts, err = inspectBoundPorts(context.TODO(), ctrVersionName)
+	if err != nil {
+		warn("the bound ports are unknown, error: %v", err)
+	}
+	info, err := rs.GetContainerInfo(name)
+	if err != nil {
+		warn("the network bandwidth is not shaped and the bound ports are not recorded, error: %v", err)
+		return boundPorts, warnings, nil
+	}
+	// the veth is recreated by the restart
+	if info.NetworkBandwidth != nil {
+		if err = shapeBandwidth(context.TODO(), ctrVersionName, info.NetworkBandwidth); err != nil {
+			warn("the network bandwidth is not shaped, error: %v", err)
+		}
+	}
+
+	if boundPorts != nil && !utils.EqualStringMap(info.BoundPorts, boundPorts) {
+		log.Infof("services.StartupContainer, container: %s bound ports changed from %+v to %+v", ctrVersionName, info.BoundPorts, boundPorts)
+		info.BoundPorts = boundPorts
+		workQueue.Enqueue(etcd.PutKeyValue{
+			Resource: etcd.Containers,
+			Key:      name,
+			Value:    info.Serialize(),
+		})
+	}
+	return boundPorts, warnings, nil
 }
 
 // RestartContainer will reapply gpu and port,
@@ -522,26 +1548,57 @@ func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName
 		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
+	// reserve the cpu and memory requests again, they are released when the container is stopped
+	if info.Requests != nil {
+		if err = schedulers.ResourceScheduler.Apply(name, *info.Requests); err != nil {
+			return id, newContainerName, errors.WithMessage(err, "ResourceScheduler.Apply failed")
+		}
+	}
+
 	// check whether the container is using gpu
-	if len(uuids) != 0 {
-		// apply for gpu
-		availableGpus, err := schedulers.GpuScheduler.Apply(len(uuids))
-		if err != nil {
-			return id, newContainerName, errors.WithMessage(err, "GpuScheduler.Apply failed")
+	if info.GpuSlots > 0 {
+		// the slots are reused if they are still held, otherwise apply for them again
+		if err = rs.applyFraction(name, info); err != nil {
+			return id, newContainerName, errors.WithMessage(err, "services.applyFraction failed")
+		}
+	} else if info.GpuShared {
+		// the shared gpus are reused if they are still shared by the replicaSet
+		if err = rs.applyShared(name, info); err != nil {
+			return id, newContainerName, errors.WithMessage(err, "services.applyShared failed")
+		}
+	} else if len(uuids) != 0 {
+		// if the container was not stopped, the gpus are still held by this replicaSet,
+		// reuse them instead of applying again, otherwise the gpus will be counted twice
+		held := schedulers.GpuScheduler.HeldBy(name, uuids)
+		if len(held) == len(uuids) {
+			log.Infof("services.RestartContainer, container: %s reuse %d gpus, uuids: %+v", ctrVersionName, len(held), held)
+			info.HostConfig.DeviceRequests = rs.newContainerResource(held, infoDeviceOptions(info)).DeviceRequests
+		} else {
+			schedulers.GpuScheduler.Restore(held)
+			// apply for gpu
+			availableGpus, err := schedulers.GpuScheduler.ApplyConstrained(name, info.GpuUUIDs, len(uuids), info.GpuConstraints)
+			if err != nil {
+				return id, newContainerName, errors.WithMessage(err, "GpuScheduler.ApplyConstrained failed")
+			}
+			log.Infof("services.RestartContainer, container: %s apply %d gpus, uuids: %+v", ctrVersionName, len(availableGpus), availableGpus)
+			info.HostConfig.DeviceRequests = rs.newContainerResource(availableGpus, infoDeviceOptions(info)).DeviceRequests
 		}
-		log.Infof("services.RestartContainer, container: %s apply %d gpus, uuids: %+v", ctrVersionName, len(availableGpus), availableGpus)
-		info.HostConfig.Resources.DeviceRequests[0].DeviceIDs = availableGpus
 	}
 
 	//  create a container to replace the old one
-	id, newContainerName, kv, err := rs.runContainer(ctx, name, info)
+	id, newContainerName, kv, err := rs.runContainerWith(ctx, name, info, runOptions{deferReadiness: true})
 	if err != nil {
 		return id, newContainerName, errors.WithMessage(err, "services.runContainer failed")
 	}
 
-	// copy the old container's merged files to the new container
-	err = utils.CopyOldMergedToNewContainerMerged(info.ContainerName, newContainerName)
+	// copy the old container's merged files to the new container,
+	// if it failed, the old container is kept and the new version is marked as incomplete
+	oldContainerName := info.ContainerName
+	err = copyWithRetry(ctx, etcd.Containers, oldContainerName, newContainerName, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+		return utils.CopyOldMergedToNewContainerMerged(ctx, oldContainerName, newContainerName, progress)
+	}, rs.replaceRetried(ctrVersionName, version, kv))
 	if err != nil {
+		workQueue.Enqueue(incompleteContainer(kv))
 		return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
 	}
 
@@ -557,11 +1614,17 @@ func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName
 		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	// the probe runs after the merged files are copied and the old version is removed
+	if err = awaitReadiness(ctx, &kv); err != nil {
+		workQueue.Enqueue(kv)
+		return id, newContainerName, errors.WithMessage(err, "services.awaitReadiness failed")
+	}
+
+	workQueue.Enqueue(etcd.PutKeyValue{
 		Resource: etcd.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
 	log.Infof("services.RestartContainer, container restart successfully, "+
 		"old container name: %s, new container name: %s, "+
@@ -569,6 +1632,128 @@ func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName
 	return
 }
 
+// TopContainer lists the processes of the latest version of the container, the pids are on the host
+func (rs *ReplicaSetService) TopContainer(name string) (container.ContainerTopOKBody, error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return container.ContainerTopOKBody{}, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+
+	top, err := docker.Cli.ContainerTop(context.Background(), fmt.Sprintf("%s-%d", name, version), nil)
+	if err != nil {
+		return top, errors.WithMessagef(err, "docker.ContainerTop failed, name: %s", name)
+	}
+	return top, nil
+}
+
+// LaunchProfiler runs a short-lived privileged profiler container which shares the pid namespace and the gpus
+// of the latest version of the container, and returns its output.
+// The gpus are not applied from GpuScheduler, the profiler only observes the cards of the target.
+func (rs *ReplicaSetService) LaunchProfiler(name string, spec *models.ProfilerLaunch) (*models.ProfilerResult, error) {
+	if !cfg.AllowProfiler {
+		return nil, xerrors.NewProfilerNotAllowedError()
+	}
+
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	hostConfig := &container.HostConfig{
+		Privileged: true,
+		PidMode:    container.PidMode("container:" + ctrVersionName),
+	}
+	if len(uuids) > 0 {
+		hostConfig.DeviceRequests = rs.newContainerResource(uuids, nil).DeviceRequests
+	}
+
+	timeout := defaultProfilerTimeout
+	if spec.Timeout > 0 {
+		timeout = time.Duration(spec.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err = ensureImage(ctx, spec.Image, false); err != nil {
+		return nil, errors.WithMessage(err, "services.ensureImage failed")
+	}
+	resp, err := docker.Cli.ContainerCreate(ctx, &container.Config{
+		Image: spec.Image,
+		Cmd:   spec.Cmd,
+	}, hostConfig, nil, nil, "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerCreate failed, image: %s", spec.Image)
+	}
+	defer func() {
+		// the context may be expired, the profiler is removed with another one
+		_ = docker.Cli.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+	}()
+
+	statusCh, errCh := docker.Cli.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	if err = docker.Cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerStart failed, id: %s", resp.ID)
+	}
+
+	result := &models.ProfilerResult{}
+	select {
+	case status := <-statusCh:
+		result.ExitCode = status.StatusCode
+	case err = <-errCh:
+		return nil, errors.Wrapf(err, "docker.ContainerWait failed, id: %s, timeout: %s", resp.ID, timeout)
+	}
+
+	logs, err := docker.Cli.ContainerLogs(context.Background(), resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerLogs failed, id: %s", resp.ID)
+	}
+	defer logs.Close()
+	var buf bytes.Buffer
+	_, _ = stdcopy.StdCopy(&buf, &buf, logs)
+	result.Output = buf.String()
+
+	log.Infof("services.LaunchProfiler, profiler: %s of container: %s exit with code %d",
+		spec.Image, ctrVersionName, result.ExitCode)
+	return result, nil
+}
+
+// KillProcess sends a signal to a process of the latest version of the container, the pid is the one on the host
+// listed by TopContainer. The process is held by a pidfd while it's checked to be listed by docker,
+// so the signal never reaches a process which reused the pid outside the container.
+func (rs *ReplicaSetService) KillProcess(name string, spec *models.ProcessKill) error {
+	signal, err := parseSignal(spec.Signal)
+	if err != nil {
+		return err
+	}
+
+	err = utils.SignalProcess(spec.Pid, syscall.Signal(signal), func() error {
+		top, err := rs.TopContainer(name)
+		if err != nil {
+			return errors.WithMessage(err, "services.TopContainer failed")
+		}
+		if !topContainsPid(top, spec.Pid) {
+			return errors.Wrapf(xerrors.NewProcessNotFoundError(), "container: %s, pid: %d", name, spec.Pid)
+		}
+		return nil
+	})
+	if err != nil {
+		// the process has exited before the pidfd is opened
+		if errors.Is(err, syscall.ESRCH) {
+			return errors.Wrapf(xerrors.NewProcessNotFoundError(), "container: %s, pid: %d", name, spec.Pid)
+		}
+		return errors.WithMessage(err, "utils.SignalProcess failed")
+	}
+
+	log.Infof("services.KillProcess, container: %s process: %d killed with signal %d", name, spec.Pid, signal)
+	return nil
+}
+
 func (rs *ReplicaSetService) CommitContainer(name string, spec models.ContainerCommit) (imageName string, err error) {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
@@ -596,27 +1781,151 @@ func (rs *ReplicaSetService) CommitContainer(name string, spec models.ContainerC
 	return imageName, err
 }
 
-func (rs *ReplicaSetService) GetContainerInfo(name string) (info models.EtcdContainerInfo, err error) {
-	infoBytes, err := etcd.GetValue(etcd.Containers, name)
-	if err != nil {
-		return info, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+// WaitContainer blocks until the latest version of the container exits and returns its exit code.
+// If the container has already exited, the exit code of the last state is returned immediately.
+// The wait will be given up when the ctx is canceled.
+func (rs *ReplicaSetService) WaitContainer(ctx context.Context, name string) (exitCode int64, err error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return exitCode, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
-	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return info, errors.WithMessage(err, "json.Unmarshal failed")
+	exitCode, err = waitVersion(ctx, ctrVersionName)
+	if ctx.Err() != nil {
+		return exitCode, errors.Wrapf(ctx.Err(), "wait container canceled, name: %s", ctrVersionName)
 	}
-	return
-}
-
-func (rs *ReplicaSetService) GetContainerHistory(name string) ([]*models.ContainerHistoryItem, error) {
-	replicaSet, err := etcd.GetRevisionRange(etcd.Containers, name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s",
-			etcd.ResourcePrefix(etcd.Containers, name))
+		return exitCode, err
 	}
+	log.Infof("services.WaitContainer, container: %s exited, exit code: %d", ctrVersionName, exitCode)
+	return exitCode, nil
+}
 
-	resp := make([]*models.ContainerHistoryItem, 0, len(replicaSet))
-	for _, combine := range replicaSet {
+// WaitForContainer runs the container to completion, it blocks until the workload of the container exits
+// and returns its exit code. Unlike WaitContainer, if the version is replaced while waiting,
+// e.g. by patch or restart, the new version is waited instead, so that the exit code is the one
+// of the workload rather than of the removal.
+// The wait will be given up when the ctx is canceled.
+func (rs *ReplicaSetService) WaitForContainer(ctx context.Context, name string) (exitCode int, err error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return exitCode, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+
+	for {
+		ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+		code, err := waitVersion(ctx, ctrVersionName)
+		if ctx.Err() != nil {
+			return int(code), errors.Wrapf(ctx.Err(), "wait container canceled, name: %s", ctrVersionName)
+		}
+		if latest, ok := vmap.ContainerVersionMap.Get(name); ok && latest != version {
+			log.Infof("services.WaitForContainer, container: %s is replaced by version: %d while waiting", ctrVersionName, latest)
+			version = latest
+			continue
+		}
+		if err != nil {
+			return int(code), err
+		}
+		log.Infof("services.WaitForContainer, container: %s exited, exit code: %d", ctrVersionName, code)
+		return int(code), nil
+	}
+}
+
+// waitVersion blocks until the container version is not running and returns its exit code
+func waitVersion(ctx context.Context, ctrVersionName string) (int64, error) {
+	resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", ctrVersionName)
+	}
+	if resp.State != nil && !resp.State.Running && !resp.State.Restarting && !resp.State.Paused {
+		log.Infof("services.waitVersion, container: %s has already exited, exit code: %d", ctrVersionName, resp.State.ExitCode)
+		return int64(resp.State.ExitCode), nil
+	}
+
+	statusCh, errCh := docker.Cli.ContainerWait(ctx, ctrVersionName, container.WaitConditionNotRunning)
+	select {
+	case status := <-statusCh:
+		if status.Error != nil {
+			return status.StatusCode, errors.Errorf("docker.ContainerWait failed, name: %s, error: %s", ctrVersionName, status.Error.Message)
+		}
+		return status.StatusCode, nil
+	case err = <-errCh:
+		return 0, errors.Wrapf(err, "docker.ContainerWait failed, name: %s", ctrVersionName)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// GetContainerLogs returns the stdout and stderr of the latest version of the container,
+// the output of a container without tty is multiplexed by docker, it's demultiplexed here, so the stream is plain text.
+// If the logs are followed, the stream ends when the ctx is canceled.
+func (rs *ReplicaSetService) GetContainerLogs(ctx context.Context, name string, opts *models.LogOptions) (io.ReadCloser, error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", ctrVersionName)
+	}
+
+	logs, err := docker.Cli.ContainerLogs(ctx, ctrVersionName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Tail:       opts.Tail,
+		Since:      opts.Since,
+		Timestamps: opts.Timestamps,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerLogs failed, name: %s", ctrVersionName)
+	}
+	if resp.Config != nil && resp.Config.Tty {
+		return logs, nil
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(writer, writer, logs)
+		_ = logs.Close()
+		_ = writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+func (rs *ReplicaSetService) GetContainerInfo(name string) (info models.EtcdContainerInfo, err error) {
+	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	if err != nil {
+		return info, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+	}
+
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return info, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	return
+}
+
+// GetCopyProgress returns the copy of the merged layer to the container version, e.g. foo-2,
+// a running copy reports the bytes copied so far.
+func (rs *ReplicaSetService) GetCopyProgress(ctrVersionName string) (*models.CopyRecord, error) {
+	return getCopyProgress(etcd.Containers, ctrVersionName)
+}
+
+func (rs *ReplicaSetService) GetContainerHistory(name string) ([]*models.ContainerHistoryItem, error) {
+	replicaSet, err := etcd.GetRevisionRange(etcd.Containers, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s",
+			etcd.ResourcePrefix(etcd.Containers, name))
+	}
+
+	resp := make([]*models.ContainerHistoryItem, 0, len(replicaSet))
+	for _, combine := range replicaSet {
 		var info models.EtcdContainerInfo
 		err := json.Unmarshal(combine.Value, &info)
 		if err != nil {
@@ -631,12 +1940,115 @@ func (rs *ReplicaSetService) GetContainerHistory(name string) ([]*models.Contain
 	return resp, nil
 }
 
+// ListContainers lists the latest version of all replicaSets, or all versions of the replicaSet if the name is not empty,
+// the live status of each version is read from docker.
+func (rs *ReplicaSetService) ListContainers(name string) ([]*models.ContainerListItem, error) {
+	var values [][]byte
+	if len(name) == 0 {
+		kvs, err := etcd.List(etcd.Containers)
+		if err != nil {
+			return nil, errors.WithMessage(err, "etcd.List failed")
+		}
+		for _, value := range kvs {
+			values = append(values, value)
+		}
+	} else {
+		revisions, err := etcd.GetRevisionRange(etcd.Containers, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s",
+				etcd.ResourcePrefix(etcd.Containers, name))
+		}
+		for _, revision := range revisions {
+			values = append(values, revision.Value)
+		}
+	}
+
+	list, err := docker.Cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "docker.ContainerList failed")
+	}
+	states := make(map[string]string, len(list))
+	for _, ctr := range list {
+		for _, n := range ctr.Names {
+			states[strings.TrimPrefix(n, "/")] = ctr.State
+		}
+	}
+
+	// a version may be saved more than once, e.g. the bound ports are repaired, the last one is kept
+	items := make(map[string]*models.ContainerListItem, len(values))
+	for _, value := range values {
+		var info models.EtcdContainerInfo
+		if err = json.Unmarshal(value, &info); err != nil {
+			return nil, errors.Wrapf(err, "json.Unmarshal failed, value: %s", value)
+		}
+		replicaSetName, _, _ := splitVersionName(info.ContainerName)
+		item := &models.ContainerListItem{
+			ReplicaSetName: replicaSetName,
+			ContainerName:  info.ContainerName,
+			Version:        info.Version,
+			Gpus:           infoDeviceIDs(&info),
+			Ports:          info.BoundPorts,
+			CreateTime:     info.CreateTime,
+			Status:         "removed",
+		}
+		if info.Config != nil {
+			item.Image = info.Config.Image
+		}
+		if info.HostConfig != nil {
+			item.Binds = info.HostConfig.Binds
+		}
+		if state, ok := states[info.ContainerName]; ok {
+			item.Status = state
+		}
+		items[info.ContainerName] = item
+	}
+
+	resp := make([]*models.ContainerListItem, 0, len(items))
+	for _, item := range items {
+		resp = append(resp, item)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].ReplicaSetName != resp[j].ReplicaSetName {
+			return resp[i].ReplicaSetName < resp[j].ReplicaSetName
+		}
+		return resp[i].Version < resp[j].Version
+	})
+	return resp, nil
+}
+
+// runOptions change how runContainer brings the new version up
+type runOptions struct {
+	// deferReadiness leaves the health check to the caller, which waits by awaitReadiness
+	// after the merged files are copied, so that the probe checks the version with its data
+	deferReadiness bool
+	// replaces is the version replaced by the new version if it's not the latest version of the name,
+	// e.g. the version of the old name of a rename
+	replaces string
+}
+
 // It will only be executed based on the `docker.client.ContainerCreate`
 func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info *models.EtcdContainerInfo) (string, string, etcd.PutKeyValue, error) {
+	return rs.runContainerWith(ctx, name, info, runOptions{})
+}
+
+func (rs *ReplicaSetService) runContainerWith(ctx context.Context, name string, info *models.EtcdContainerInfo, opts runOptions) (string, string, etcd.PutKeyValue, error) {
+	if err := checkPendingBinds(info.HostConfig.Binds); err != nil {
+		return "", "", etcd.PutKeyValue{}, err
+	}
+
+	// the new version of a running version doesn't count against the container limit
+	replaced := opts.replaces
+	if latest, ok := vmap.ContainerVersionMap.Get(name); ok && len(replaced) == 0 {
+		replaced = fmt.Sprintf("%s-%d", name, latest)
+	}
+	release, err := reserveContainer(ctx, replaced)
+	if err != nil {
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.reserveContainer failed")
+	}
+	defer release()
+
 	// set the version number
-	version, _ := vmap.ContainerVersionMap.Get(name)
-	version = version + 1
-	vmap.ContainerVersionMap.Set(name, version)
+	version := vmap.ContainerVersionMap.Next(name)
 
 	// add the version number to the env
 	isExist := false
@@ -650,52 +2062,172 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 	if !isExist {
 		info.Config.Env = append(info.Config.Env, fmt.Sprintf("CONTAINER_VERSION=%d", version))
 	}
+	info.Config.Labels = setManagedLabels(info.Config.Labels, name, version)
 
-	var err error
 	defer func() {
 		// if run container failed, clear the version number
 		if err != nil {
-			if version == 1 {
-				vmap.ContainerVersionMap.Remove(name)
-			} else {
-				vmap.ContainerVersionMap.Set(name, version-1)
-			}
+			vmap.ContainerVersionMap.Release(name, version)
 		}
 	}()
 
-	// apply for some host port
-	if info.HostConfig.PortBindings != nil && len(info.HostConfig.PortBindings) > 0 {
-		availableOSPorts, err := schedulers.PortScheduler.Apply(len(info.HostConfig.PortBindings))
+	// share the gpus through MPS, the daemon of the gpu is started when the first sharing container arrives
+	if info.GpuMps {
+		var previous []string
+		previous, err = schedulers.MpsManager.Register(name, infoDeviceIDs(info))
+		if err != nil {
+			return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "MpsManager.Register failed")
+		}
+		defer func() {
+			if err != nil {
+				_, _ = schedulers.MpsManager.Register(name, previous)
+			}
+		}()
+		if err = setMpsConfig(info); err != nil {
+			return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.setMpsConfig failed")
+		}
+	}
+
+	// the always policy recorded before it's rejected would start the superseded versions when docker restarts
+	if info.HostConfig.RestartPolicy.Name == "always" {
+		log.Warnf("services.runContainer, replicaSet: %s restart policy always is replaced by unless-stopped", name)
+		info.HostConfig.RestartPolicy.Name = "unless-stopped"
+	}
+
+	// the gpus may be changed by patch, so the order is set on every version
+	if err = setGpuOrder(info); err != nil {
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.setGpuOrder failed")
+	}
+
+	// apply for some host port, the ports with a requested host port are bound as requested
+	requestedPorts := make(map[nat.Port]models.Port, len(info.Ports))
+	for _, port := range info.Ports {
+		requestedPorts[portKey(port)] = port
+	}
+	// the requested host ports are reserved until the container is started,
+	// so that they are neither applied from the range nor requested by the concurrent creates
+	var reservedPorts []string
+	for _, port := range requestedPorts {
+		if port.HostPort != 0 {
+			reservedPorts = append(reservedPorts, strconv.Itoa(port.HostPort))
+		}
+	}
+	if err = schedulers.PortScheduler.Reserve(reservedPorts); err != nil {
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "PortScheduler.Reserve failed")
+	}
+	defer schedulers.PortScheduler.Unreserve(reservedPorts)
+
+	var availableOSPorts []string
+	if applyPorts := len(info.HostConfig.PortBindings) - len(requestedPorts); applyPorts > 0 {
+		// skip the host ports which are bound by other containers, e.g. ephemeral ports
+		var bound map[string]struct{}
+		bound, err = rs.boundHostPorts(ctx)
+		if err != nil {
+			return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.boundHostPorts failed")
+		}
+		availableOSPorts, err = schedulers.PortScheduler.ApplyExclude(applyPorts, bound)
 		if err != nil {
 			return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "Portscheduler.Apply failed, info: %+v", info)
 		}
-		var index int
-		for k := range info.HostConfig.PortBindings {
-			info.HostConfig.PortBindings[k] = []nat.PortBinding{{
-				HostPort: availableOSPorts[index],
-			}}
-			index++
+	}
+	defer func() {
+		if err != nil {
+			schedulers.PortScheduler.Restore(availableOSPorts)
+		}
+	}()
+	var index int
+	for k := range info.HostConfig.PortBindings {
+		if port, ok := requestedPorts[k]; ok {
+			// empty host port means docker assigns an ephemeral port
+			hostPort := ""
+			if port.HostPort != 0 {
+				hostPort = strconv.Itoa(port.HostPort)
+			}
+			info.HostConfig.PortBindings[k] = []nat.PortBinding{{HostPort: hostPort}}
+			continue
 		}
+		info.HostConfig.PortBindings[k] = []nat.PortBinding{{
+			HostPort: availableOSPorts[index],
+		}}
+		index++
 	}
 
 	// generate container name with version and save creation time
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 	info.CreateTime = time.Now().Format("2006-01-02 15:04:05")
 
+	// the encrypted volumes are not mounted after the host restarted
+	var vs VolumeService
+	if err = vs.mountEncryptedBinds(info.HostConfig.Binds); err != nil {
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.mountEncryptedBinds failed")
+	}
+
+	// the image may have been removed since the old version was created, e.g. by a rollback to an old version
+	if err = ensureImage(ctx, info.Config.Image, false); err != nil {
+		return "", "", etcd.PutKeyValue{}, errors.WithMessage(err, "services.ensureImage failed")
+	}
+
 	// create container
 	resp, err := docker.Cli.ContainerCreate(ctx, info.Config, info.HostConfig, info.NetworkingConfig, info.Platform, ctrVersionName)
 	if err != nil {
+		// e.g. "--storage-opt is supported only for overlay over xfs with 'pquota' mount option"
+		if len(info.HostConfig.StorageOpt) != 0 && strings.Contains(err.Error(), "storage-opt") {
+			err = errors.Wrapf(xerrors.NewStorageOptNotSupportedError(), "docker.ContainerCreate failed, name: %s, error: %v", ctrVersionName, err)
+			return "", "", etcd.PutKeyValue{}, err
+		}
+		if isNvidiaRuntimeMissing(err) {
+			err = errors.Wrapf(xerrors.NewNvidiaRuntimeMissingError(), "docker.ContainerCreate failed, name: %s, error: %v", ctrVersionName, err)
+			return "", "", etcd.PutKeyValue{}, err
+		}
+		// docker may have created the container after the request timed out
+		if ctx.Err() != nil {
+			removeContainer(ctx, ctrVersionName)
+		}
 		return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "docker.ContainerCreate failed, name: %s", ctrVersionName)
 	}
 
-	// start container
-	if err = docker.Cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		_ = docker.Cli.ContainerRemove(ctx,
-			resp.ID,
-			types.ContainerRemoveOptions{Force: true})
+	// start container, the process state is restored if there is a checkpoint
+	var startOptions types.ContainerStartOptions
+	if info.Checkpoint != nil {
+		startOptions.CheckpointID = info.Checkpoint.ID
+		startOptions.CheckpointDir = info.Checkpoint.Dir
+	}
+	if err = docker.Cli.ContainerStart(ctx, resp.ID, startOptions); err != nil {
+		removeContainer(ctx, resp.ID)
+		if isNvidiaRuntimeMissing(err) {
+			err = errors.Wrapf(xerrors.NewNvidiaRuntimeMissingError(), "docker.ContainerStart failed, id: %s, name: %s, error: %v", resp.ID, ctrVersionName, err)
+			return "", "", etcd.PutKeyValue{}, err
+		}
 		return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "docker.ContainerStart failed, id: %s, name: %s", resp.ID, ctrVersionName)
 	}
 
+	// read the host ports actually bound, the ephemeral ports are known only after start
+	boundPorts := make(map[string]string, len(info.HostConfig.PortBindings))
+	if len(info.HostConfig.PortBindings) > 0 {
+		if boundPorts, err = inspectBoundPorts(ctx, resp.ID); err != nil {
+			log.Errorf("services.runContainer, container: %s bound ports are unknown, error: %v", ctrVersionName, err)
+			boundPorts, err = map[string]string{}, nil
+		}
+	}
+
+	// the veth exists only after start
+	if info.NetworkBandwidth != nil {
+		if err = shapeBandwidth(ctx, resp.ID, info.NetworkBandwidth); err != nil {
+			removeContainer(ctx, resp.ID)
+			return "", "", etcd.PutKeyValue{}, errors.WithMessagef(err, "services.shapeBandwidth failed, name: %s", ctrVersionName)
+		}
+	}
+
+	// wait for the application inside, the version is not usable until it's ready
+	var readiness *models.Readiness
+	if info.HealthCheck != nil && !opts.deferReadiness {
+		// the health check has its own timeout
+		if readiness, err = waitReady(context.WithoutCancel(ctx), resp.ID, info.HealthCheck, boundPorts); err != nil {
+			removeContainer(ctx, resp.ID)
+			return "", "", etcd.PutKeyValue{}, errors.WithMessagef(err, "services.waitReady failed, name: %s", ctrVersionName)
+		}
+	}
+
 	// creation info is added to etcd asynchronously
 	val := &models.EtcdContainerInfo{
 		Config:           info.Config,
@@ -705,7 +2237,25 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 		ContainerName:    ctrVersionName,
 		Version:          version,
 		CreateTime:       info.CreateTime,
-	}
+		CloneFrom:        info.CloneFrom,
+		RenameFrom:       info.RenameFrom,
+		Ports:            info.Ports,
+		BoundPorts:       boundPorts,
+		Requests:         info.Requests,
+		GpuMps:           info.GpuMps,
+		GpuSlots:         info.GpuSlots,
+		GpuShared:        info.GpuShared,
+		GpuMaxSharers:    info.GpuMaxSharers,
+		GpuConstraints:   info.GpuConstraints,
+		GpuUUIDs:         info.GpuUUIDs,
+		GpuOrder:         info.GpuOrder,
+		GpuIndexes:       info.GpuIndexes,
+		NetworkBandwidth: info.NetworkBandwidth,
+		HealthCheck:      info.HealthCheck,
+		Readiness:        readiness,
+	}
+
+	recordVolumeUsage(ctrVersionName, info.HostConfig.Binds, info.CreateTime)
 
 	log.Infof("services.runContainer, container: %s run successfully", ctrVersionName)
 	return resp.ID,
@@ -718,17 +2268,23 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 		nil
 }
 
-// Check whether the container exists
-func (rs *ReplicaSetService) existContainer(name string) bool {
-	ctx := context.Background()
-	list, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{
-		Filters: filters.NewArgs(filters.KeyValuePair{Key: "name", Value: fmt.Sprintf("^%s-", name)}),
-	})
-	if err != nil || len(list) == 0 {
-		return false
+// removeContainer force removes the container created by a failed run, it works even if the ctx is done
+func removeContainer(ctx context.Context, id string) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	if err := docker.Cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil && !xerrors.IsDockerNotFoundError(err) {
+		log.Errorf("services.removeContainer, container: %s remove failed, error: %v", id, err)
 	}
+}
 
-	return len(list) > 0
+// existContainer whether any version of the replicaSet exists, the stopped versions count,
+// otherwise a replicaSet with the same name would overwrite the record of the stopped one
+func (rs *ReplicaSetService) existContainer(ctx context.Context, name string) (bool, error) {
+	list, err := listContainerVersions(ctx, name, true)
+	if err != nil {
+		return false, errors.WithMessage(err, "services.listContainerVersions failed")
+	}
+	return len(list) > 0, nil
 }
 
 func (rs *ReplicaSetService) containerDeviceRequestsDeviceIDs(name string) ([]string, error) {
@@ -743,6 +2299,23 @@ func (rs *ReplicaSetService) containerDeviceRequestsDeviceIDs(name string) ([]st
 	return resp.HostConfig.DeviceRequests[0].DeviceIDs, nil
 }
 
+// boundHostPorts returns the host ports bound by all containers, the stopped ones bind them again when started
+func (rs *ReplicaSetService) boundHostPorts(ctx context.Context) (map[string]struct{}, error) {
+	holders, err := publishedHostPorts(ctx)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.publishedHostPorts failed")
+	}
+	bound := make(map[string]struct{}, len(holders))
+	for key := range holders {
+		bound[strings.SplitN(key, "/", 2)[0]] = struct{}{}
+	}
+	return bound, nil
+}
+
+func portKey(port models.Port) nat.Port {
+	return nat.Port(fmt.Sprintf("%d/%s", port.ContainerPort, portProtocol(port)))
+}
+
 func (rs *ReplicaSetService) containerPortBindings(name string) ([]string, error) {
 	ctx := context.Background()
 	resp, err := docker.Cli.ContainerInspect(ctx, name)
@@ -754,16 +2327,525 @@ func (rs *ReplicaSetService) containerPortBindings(name string) ([]string, error
 	}
 	var ports []string
 	for _, v := range resp.HostConfig.PortBindings {
+		// the ephemeral ports are not applied from the port range
+		if len(v) == 0 || len(v[0].HostPort) == 0 || v[0].HostPort == "0" {
+			continue
+		}
 		ports = append(ports, v[0].HostPort)
 	}
 	return ports, nil
 }
 
-func (rs *ReplicaSetService) newContainerResource(uuids []string) container.Resources {
+// checkStorageOptSupported checks whether the storage driver of docker daemon can limit the size of container's writable layer.
+// overlay2 only supports it when the backing filesystem is xfs and mounted with pquota,
+// the pquota can not be detected here, it will be caught when the container is created.
+func (rs *ReplicaSetService) checkStorageOptSupported(ctx context.Context) error {
+	info, err := docker.Cli.Info(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "docker.Info failed")
+	}
+
+	switch info.Driver {
+	case "overlay2":
+		for _, status := range info.DriverStatus {
+			if len(status) == 2 && status[0] == "Backing Filesystem" && status[1] == "xfs" {
+				return nil
+			}
+		}
+		return errors.Wrapf(xerrors.NewStorageOptNotSupportedError(), "driver: %s, driver status: %v", info.Driver, info.DriverStatus)
+	case "devicemapper", "btrfs", "zfs", "windowsfilter":
+		return nil
+	default:
+		return errors.Wrapf(xerrors.NewStorageOptNotSupportedError(), "driver: %s", info.Driver)
+	}
+}
+
+// infoDeviceIDs returns the gpu device ids recorded in the container info
+func infoDeviceIDs(info *models.EtcdContainerInfo) []string {
+	if info.HostConfig == nil || len(info.HostConfig.DeviceRequests) == 0 {
+		return []string{}
+	}
+	return info.HostConfig.DeviceRequests[0].DeviceIDs
+}
+
+// gpuMode returns how the gpus recorded in the container info are held
+func gpuMode(info *models.EtcdContainerInfo) schedulers.GpuMode {
+	switch {
+	case info.GpuSlots > 0:
+		return schedulers.GpuModeFraction
+	case info.GpuShared:
+		return schedulers.GpuModeShared
+	default:
+		return schedulers.GpuModeWhole
+	}
+}
+
+// infoDeviceOptions returns the gpu driver options recorded in the container info
+func infoDeviceOptions(info *models.EtcdContainerInfo) map[string]string {
+	if info.HostConfig == nil || len(info.HostConfig.DeviceRequests) == 0 {
+		return nil
+	}
+	return info.HostConfig.DeviceRequests[0].Options
+}
+
+// signals that can be sent to the process in the container by name
+var signals = map[string]int{
+	"HUP":  1,
+	"INT":  2,
+	"QUIT": 3,
+	"KILL": 9,
+	"USR1": 10,
+	"USR2": 12,
+	"TERM": 15,
+	"CONT": 18,
+	"STOP": 19,
+}
+
+// parseSignal parses the signal name, e.g. TERM or SIGTERM, or the signal number, the default is TERM
+func parseSignal(signal string) (int, error) {
+	if len(signal) == 0 {
+		return signals["TERM"], nil
+	}
+	if num, err := strconv.Atoi(signal); err == nil {
+		if num <= 0 || num > 64 {
+			return 0, errors.Wrapf(xerrors.NewSignalInvalidError(), "signal: %s", signal)
+		}
+		return num, nil
+	}
+	num, ok := signals[strings.TrimPrefix(strings.ToUpper(signal), "SIG")]
+	if !ok {
+		return 0, errors.Wrapf(xerrors.NewSignalInvalidError(), "signal: %s", signal)
+	}
+	return num, nil
+}
+
+func topContainsPid(top container.ContainerTopOKBody, pid int) bool {
+	index := -1
+	for i, title := range top.Titles {
+		if title == "PID" {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+	for _, process := range top.Processes {
+		if len(process) > index && process[index] == strconv.Itoa(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFraction applies for the slots of a gpu recorded in info for the replicaSet, and updates the device requests
+func (rs *ReplicaSetService) applyFraction(owner string, info *models.EtcdContainerInfo) error {
+	uuid, err := schedulers.GpuScheduler.ApplyFraction(owner, info.GpuSlots)
+	if err != nil {
+		return errors.WithMessage(err, "GpuScheduler.ApplyFraction failed")
+	}
+	info.HostConfig.DeviceRequests = rs.newContainerResource([]string{uuid}, infoDeviceOptions(info)).DeviceRequests
+	log.Infof("services.applyFraction, replicaSet: %s apply %d/%d slots of gpu: %s",
+		owner, info.GpuSlots, schedulers.GpuScheduler.SlotsPerGpu, uuid)
+	return nil
+}
+
+// replaceRetried completes the new version whose data is copied by the retries in the background, like a copy
+// which succeeded at once, the old version is replaced if it's set. If the retries failed too, the new version
+// is left incomplete and the old version is kept, see copyWithRetry.
+func (rs *ReplicaSetService) replaceRetried(oldVersionName string, oldVersion int64, kv etcd.PutKeyValue) retriedFunc {
+	return func(err error) {
+		if err != nil {
+			log.Errorf("services.replaceRetried, copy data to the new version of key: %s failed after retries, it's incomplete, error: %v",
+				kv.Key, err)
+			return
+		}
+		if len(oldVersionName) != 0 {
+			if err = setToMergeMap(oldVersionName, oldVersion); err != nil {
+				log.Errorf("services.replaceRetried, setToMergeMap of %s failed, error: %v", oldVersionName, err)
+				return
+			}
+			if err = rs.DeleteContainerForUpdate(oldVersionName); err != nil {
+				log.Errorf("services.replaceRetried, delete the old version: %s failed, error: %v", oldVersionName, err)
+				return
+			}
+		}
+		if err = awaitReadiness(context.Background(), &kv); err != nil {
+			log.Errorf("services.replaceRetried, the new version of key: %s is not ready, error: %v", kv.Key, err)
+		}
+		workQueue.Enqueue(kv)
+		log.Infof("services.replaceRetried, the data of the new version of key: %s is copied by the retries", kv.Key)
+	}
+}
+
+// cloneRetried completes the clone copied by the retries, or removes it if the retries failed
+func (rs *ReplicaSetService) cloneRetried(name, containerName string, kv etcd.PutKeyValue) retriedFunc {
+	completed := rs.replaceRetried("", 0, kv)
+	return func(err error) {
+		if err == nil {
+			completed(nil)
+			return
+		}
+		log.Errorf("services.cloneRetried, copy data to the clone: %s failed after retries, it's removed, error: %v", containerName, err)
+		rs.rollbackClone(name, containerName)
+		workQueue.Enqueue(etcd.DelKey{
+			Resource: etcd.Containers,
+			Key:      name,
+		})
+	}
+}
+
+// rollbackClone removes the clone whose data failed to be copied, and releases the gpus, ports and resources held by it
+func (rs *ReplicaSetService) rollbackClone(name, containerName string) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+
+	ports, err := rs.containerPortBindings(containerName)
+	if err != nil {
+		log.Errorf("services.rollbackClone, get the ports of the clone: %s failed, error: %v", containerName, err)
+	}
+	endVolumeUsage(ctx, containerName)
+	unshapeBandwidth(ctx, containerName)
+	if err = docker.Cli.ContainerRemove(ctx, containerName, types.ContainerRemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+		log.Errorf("services.rollbackClone, remove the clone: %s failed, error: %v", containerName, err)
+	}
+
+	gpus := schedulers.GpuScheduler.RestoreOwner(name)
+	schedulers.GpuScheduler.RestoreFraction(name)
+	schedulers.GpuScheduler.RestoreShared(name)
+	schedulers.GpuScheduler.RemoveJob(name)
+	schedulers.GpuScheduler.RemoveLabels(name)
+	schedulers.PortScheduler.Restore(ports)
+	schedulers.ResourceScheduler.Restore(name)
+	schedulers.MpsManager.Release(name)
+	vmap.ContainerVersionMap.Remove(name)
+	log.Infof("services.rollbackClone, the clone: %s is removed, gpus: %v and ports: %v released", containerName, gpus, ports)
+}
+
+// applyWhole applies for as many whole gpus as recorded in info for the replicaSet, and updates the device requests
+func (rs *ReplicaSetService) applyWhole(owner string, info *models.EtcdContainerInfo) error {
+	num := len(infoDeviceIDs(info))
+	if num == 0 {
+		return nil
+	}
+	uuids, err := schedulers.GpuScheduler.ApplyConstrained(owner, nil, num, info.GpuConstraints)
+	if err != nil {
+		return errors.WithMessage(err, "GpuScheduler.ApplyConstrained failed")
+	}
+	info.HostConfig.DeviceRequests = rs.newContainerResource(uuids, infoDeviceOptions(info)).DeviceRequests
+	log.Infof("services.applyWhole, replicaSet: %s apply %d gpus, uuids: %+v", owner, num, uuids)
+	return nil
+}
+
+// applyShared applies for the shared gpus recorded in info for the replicaSet, and updates the device requests
+func (rs *ReplicaSetService) applyShared(owner string, info *models.EtcdContainerInfo) error {
+	uuids, err := schedulers.GpuScheduler.ApplyShared(owner, len(infoDeviceIDs(info)), info.GpuMaxSharers, info.GpuMps)
+	if err != nil {
+		return errors.WithMessage(err, "GpuScheduler.ApplyShared failed")
+	}
+	info.HostConfig.DeviceRequests = rs.newContainerResource(uuids, infoDeviceOptions(info)).DeviceRequests
+	log.Infof("services.applyShared, replicaSet: %s share %d gpus, uuids: %+v", owner, len(uuids), uuids)
+	return nil
+}
+
+// jobIDLabel is the container label of the external job id
+const jobIDLabel = "gpu-docker-api.job-id"
+
+// gpuLabelsLabel is the container label of the anti-co-location labels, separated by ','
+const gpuLabelsLabel = "gpu-docker-api.gpu-labels"
+
+// defaultProfilerTimeout is the max time the profiler runs if the timeout is not requested
+const defaultProfilerTimeout = 5 * time.Minute
+
+// frameworkMps is the framework of the envs injected into every MPS client
+const frameworkMps = "mps"
+
+// gpuMemoryTotal returns the memory of the gpu in MiB, 0 if it's unknown
+var gpuMemoryTotal = func(uuid string) int64 {
+	devices, err := schedulers.QueryGpuDevices()
+	if err != nil {
+		log.Errorf("services.gpuMemoryTotal, query the gpus failed, error: %v", err)
+		return 0
+	}
+	for _, device := range devices {
+		if device.UUID == uuid {
+			return device.MemoryTotal
+		}
+	}
+	return 0
+}
+
+// injectFrameworkEnv appends the memory fraction envs of the framework for the fraction of the gpu, the envs set
+// by the user are kept, and nothing is injected if the framework is unknown. The envs of the memory in MiB are skipped
+// if the memory of the gpu is unknown.
+func injectFrameworkEnv(env []string, framework, uuid string, fraction float64) []string {
+	if len(framework) == 0 {
+		return env
+	}
+	templates, ok := cfg.FrameworkEnv[strings.ToLower(framework)]
+	if !ok {
+		log.Infof("services.injectFrameworkEnv, framework: %s is unknown, no env is injected", framework)
+		return env
+	}
+
+	set := make(map[string]struct{}, len(env))
+	for _, e := range env {
+		set[strings.SplitN(e, "=", 2)[0]] = struct{}{}
+	}
+	values := []string{
+		"{fraction}", strconv.FormatFloat(fraction, 'f', 2, 64),
+		"{percent}", strconv.Itoa(int(math.Round(fraction * 100))),
+	}
+	memory := int64(-1)
+	for _, template := range strings.Split(templates, ";") {
+		template = strings.TrimSpace(template)
+		if !strings.Contains(template, "=") {
+			continue
+		}
+		key := strings.SplitN(template, "=", 2)[0]
+		if _, ok := set[key]; ok {
+			continue
+		}
+		if strings.Contains(template, "MB}") {
+			if memory < 0 {
+				memory = gpuMemoryTotal(uuid)
+				share := int64(math.Floor(fraction * float64(memory)))
+				values = append(values, "{memoryMB}", strconv.FormatInt(share, 10), "{reservedMB}", strconv.FormatInt(memory-share, 10))
+			}
+			if memory == 0 {
+				log.Warnf("services.injectFrameworkEnv, the memory of gpu: %s is unknown, env: %s is not injected", uuid, key)
+				continue
+			}
+		}
+		env = append(env, strings.NewReplacer(values...).Replace(template))
+	}
+	return env
+}
+
+// isNvidiaRuntimeMissing whether the error is returned by docker daemon because no driver can handle the gpu request,
+// e.g. `could not select device driver "" with capabilities: [[gpu]]`
+func isNvidiaRuntimeMissing(err error) bool {
+	return strings.Contains(err.Error(), "could not select device driver")
+}
+
+// NvidiaRuntimeAvailable checks whether the nvidia runtime is registered in docker daemon,
+// docker can also run gpu containers through the nvidia hook without the runtime, so it is only a hint.
+func NvidiaRuntimeAvailable() bool {
+	info, err := docker.Cli.Info(context.Background())
+	if err != nil {
+		log.Errorf("services.NvidiaRuntimeAvailable, docker.Info failed, error: %v", err)
+		return false
+	}
+	_, ok := info.Runtimes["nvidia"]
+	return ok
+}
+
+// checkRuntime checks whether the runtime is registered in docker daemon,
+// and whether it can run gpu containers if gpus are requested, e.g. runsc can't without nvproxy.
+func checkRuntime(ctx context.Context, runtime string, useGpu bool) error {
+	info, err := docker.Cli.Info(ctx)
+	if err != nil {
+		return errors.Wrap(err, "docker.Info failed")
+	}
+	if _, ok := info.Runtimes[runtime]; !ok {
+		registered := make([]string, 0, len(info.Runtimes))
+		for name := range info.Runtimes {
+			registered = append(registered, name)
+		}
+		sort.Strings(registered)
+		return errors.Wrapf(xerrors.NewRuntimeNotSupportedError(), "runtime: %s, registered runtimes: %v", runtime, registered)
+	}
+	if !useGpu {
+		return nil
+	}
+	for _, r := range cfg.GpuRuntimes {
+		if r == runtime {
+			return nil
+		}
+	}
+	return errors.Wrapf(xerrors.NewRuntimeGpuIncompatibleError(), "runtime: %s, gpu runtimes: %v", runtime, cfg.GpuRuntimes)
+}
+
+const mpsContainerPipeDir = "/tmp/nvidia-mps"
+
+// setMpsConfig binds the pipe directory of the MPS daemon into the container,
+// a MPS client can only connect to one daemon, so only one gpu can be shared.
+func setMpsConfig(info *models.EtcdContainerInfo) error {
+	uuids := infoDeviceIDs(info)
+	if len(uuids) > 1 {
+		return errors.Errorf("mps only supports sharing one gpu, but the container uses %d gpus", len(uuids))
+	}
+
+	binds := make([]string, 0, len(info.HostConfig.Binds)+1)
+	for _, bind := range info.HostConfig.Binds {
+		if !strings.HasSuffix(bind, ":"+mpsContainerPipeDir) {
+			binds = append(binds, bind)
+		}
+	}
+	env := make([]string, 0, len(info.Config.Env)+1)
+	for _, e := range info.Config.Env {
+		if !strings.HasPrefix(e, "CUDA_MPS_PIPE_DIRECTORY=") {
+			env = append(env, e)
+		}
+	}
+	if len(uuids) == 1 {
+		binds = append(binds, fmt.Sprintf("%s:%s", schedulers.MpsManager.PipeDir(uuids[0]), mpsContainerPipeDir))
+		env = append(env, "CUDA_MPS_PIPE_DIRECTORY="+mpsContainerPipeDir)
+		// the MPS clients communicate with the daemon through the shared memory of the host
+		info.HostConfig.IpcMode = "host"
+	}
+	info.HostConfig.Binds = binds
+	info.Config.Env = env
+	return nil
+}
+
+// setGpuOrder numbers the gpus inside the container by CUDA_VISIBLE_DEVICES, which accepts uuids,
+// the devices visible to the container are not changed.
+func setGpuOrder(info *models.EtcdContainerInfo) error {
+	info.GpuIndexes = nil
+	if len(info.GpuOrder) == 0 {
+		return nil
+	}
+
+	env := make([]string, 0, len(info.Config.Env)+2)
+	for _, e := range info.Config.Env {
+		if !strings.HasPrefix(e, "CUDA_VISIBLE_DEVICES=") && !strings.HasPrefix(e, "CUDA_DEVICE_ORDER=") {
+			env = append(env, e)
+		}
+	}
+	info.Config.Env = env
+
+	uuids := append([]string(nil), infoDeviceIDs(info)...)
+	if len(uuids) == 0 {
+		return nil
+	}
+	hostIndexes, err := schedulers.GetGpuIndexes()
+	if err != nil {
+		return errors.WithMessage(err, "schedulers.GetGpuIndexes failed")
+	}
+	if info.GpuOrder == models.GpuOrderPci {
+		sort.SliceStable(uuids, func(i, j int) bool {
+			return hostIndexes[uuids[i]] < hostIndexes[uuids[j]]
+		})
+	}
+
+	info.GpuIndexes = make([]models.GpuIndex, 0, len(uuids))
+	for i, uuid := range uuids {
+		hostIndex, ok := hostIndexes[uuid]
+		if !ok {
+			return errors.Errorf("gpu: %s not found on the host", uuid)
+		}
+		info.GpuIndexes = append(info.GpuIndexes, models.GpuIndex{Index: i, HostIndex: hostIndex, UUID: uuid})
+	}
+	info.Config.Env = append(info.Config.Env,
+		"CUDA_DEVICE_ORDER=PCI_BUS_ID", "CUDA_VISIBLE_DEVICES="+strings.Join(uuids, ","))
+	return nil
+}
+
+// setResourceLimits sets the cpu and memory limits of the container and returns the requests need to be reserved,
+// nil means the container requests nothing. The sizes have been validated by the router.
+func setResourceLimits(spec *models.ContainerRun, hostConfig *container.HostConfig) (*models.ResourceRequests, error) {
+	requests := models.ResourceRequests{NanoCpus: int64(spec.CpuRequest * 1e9)}
+	if spec.CpuLimit > 0 {
+		hostConfig.NanoCPUs = int64(spec.CpuLimit * 1e9)
+		if requests.NanoCpus == 0 {
+			requests.NanoCpus = hostConfig.NanoCPUs
+		}
+	}
+	if requests.NanoCpus > 0 {
+		// the cpu request is the relative weight when the cpu is contended, 1 core is 1024 shares
+		hostConfig.CPUShares = max(requests.NanoCpus*1024/1e9, 2)
+	}
+
+	if len(spec.MemoryRequest) != 0 {
+		bytes, err := utils.ToBytes(spec.MemoryRequest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "utils.ToBytes failed, memory request: %s", spec.MemoryRequest)
+		}
+		requests.MemoryBytes = bytes
+	}
+	if len(spec.MemoryLimit) != 0 {
+		bytes, err := utils.ToBytes(spec.MemoryLimit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "utils.ToBytes failed, memory limit: %s", spec.MemoryLimit)
+		}
+		hostConfig.Memory = bytes
+		if requests.MemoryBytes == 0 {
+			requests.MemoryBytes = bytes
+		}
+	}
+	if requests.MemoryBytes > 0 {
+		// the memory request is the soft limit, it takes effect when the host is low on memory
+		hostConfig.MemoryReservation = requests.MemoryBytes
+	}
+
+	hostConfig.CpusetCpus = spec.CpusetCpus
+	hostConfig.OomScoreAdj = spec.OomScoreAdj
+	if spec.OomKillDisable {
+		hostConfig.OomKillDisable = &spec.OomKillDisable
+		if hostConfig.Memory == 0 {
+			log.Warnf("services.setResourceLimits, oom-kill of container: %s is disabled without a memory limit, "+
+				"it may hang the host when the host is out of memory", spec.ReplicaSetName)
+		}
+	}
+
+	if requests.NanoCpus == 0 && requests.MemoryBytes == 0 {
+		return nil, nil
+	}
+	return &requests, nil
+}
+
+// setShmSize sets the size of /dev/shm, the default 64MB of docker crashes the data loader workers of pytorch
+// with bus error, so the containers using gpus get the --defaultShmSize if the size is not set.
+// It's kept in the host config of etcd, so the patched versions inherit it.
+func setShmSize(spec *models.ContainerRun, hostConfig *container.HostConfig) error {
+	if len(spec.ShmSize) != 0 {
+		bytes, err := utils.ToBytes(spec.ShmSize)
+		if err != nil {
+			return errors.Wrapf(err, "utils.ToBytes failed, shm size: %s", spec.ShmSize)
+		}
+		hostConfig.ShmSize = bytes
+		return nil
+	}
+	// the mps clients use the shared memory of the host, and a tmpfs on /dev/shm replaces the one of docker
+	if _, ok := hostConfig.Tmpfs["/dev/shm"]; ok || spec.GpuMps {
+		return nil
+	}
+	if spec.GpuCount > 0 || spec.GpuFraction > 0 || len(spec.MigProfile) != 0 {
+		hostConfig.ShmSize = cfg.DefaultShmSize
+	}
+	return nil
+}
+
+// newContainerResource the device ids and capabilities are managed by the service,
+// the options are passed through to the nvidia driver.
+func (rs *ReplicaSetService) newContainerResource(uuids []string, options map[string]string) container.Resources {
 	return container.Resources{DeviceRequests: []container.DeviceRequest{{
 		Driver:       "nvidia",
 		DeviceIDs:    uuids,
 		Capabilities: [][]string{{"gpu"}},
-		Options:      nil,
+		Options:      options,
 	}}}
 }
+
+// defaultStopTimeout is how long a container has to exit after SIGTERM in a graceful delete
+const defaultStopTimeout = 30
+
+// stopGracefully sends SIGTERM and waits for the container to exit, docker kills it after the timeout.
+// It returns false if the stop failed, then the container has to be force removed.
+func stopGracefully(ctx context.Context, name string, timeout int) bool {
+	if timeout <= 0 {
+		timeout = defaultStopTimeout
+	}
+	start := time.Now()
+	if err := docker.Cli.ContainerStop(ctx, name, container.StopOptions{Timeout: &timeout}); err != nil {
+		log.Errorf("services.stopGracefully, container: %s stop failed, it will be force removed, error: %v", name, err)
+		return false
+	}
+	if elapsed := time.Since(start); elapsed >= time.Duration(timeout)*time.Second {
+		log.Warnf("services.stopGracefully, container: %s didn't exit in %ds after SIGTERM, it's killed", name, timeout)
+	} else {
+		log.Infof("services.stopGracefully, container: %s exited in %s after SIGTERM", name, elapsed.Round(time.Millisecond))
+	}
+	return true
+}
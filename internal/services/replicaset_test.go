@@ -0,0 +1,514 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		signal  string
+		want    int
+		wantErr bool
+	}{
+		{signal: "", want: 15},
+		{signal: "KILL", want: 9},
+		{signal: "sigterm", want: 15},
+		{signal: "SIGUSR1", want: 10},
+		{signal: "2", want: 2},
+		{signal: "0", wantErr: true},
+		{signal: "65", wantErr: true},
+		{signal: "BOGUS", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.signal, func(t *testing.T) {
+			got, err := parseSignal(tt.signal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSignal(%q) error = %v, wantErr %v", tt.signal, err, tt.wantErr)
+			}
+			if tt.wantErr && !xerrors.IsSignalInvalidError(err) {
+				t.Errorf("parseSignal(%q) error = %v, want signal invalid", tt.signal, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSignal(%q) = %d, want %d", tt.signal, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopContainsPid(t *testing.T) {
+	top := container.ContainerTopOKBody{
+		Titles:    []string{"UID", "PID", "PPID", "CMD"},
+		Processes: [][]string{{"root", "1200", "1100", "python"}, {"root", "1201", "1200", "worker"}},
+	}
+	tests := []struct {
+		name string
+		top  container.ContainerTopOKBody
+		pid  int
+		want bool
+	}{
+		{name: "listed", top: top, pid: 1201, want: true},
+		{name: "parent pid only", top: top, pid: 1100, want: false},
+		{name: "not listed", top: top, pid: 1, want: false},
+		{name: "no pid column", top: container.ContainerTopOKBody{Titles: []string{"CMD"}, Processes: [][]string{{"1200"}}}, pid: 1200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := topContainsPid(tt.top, tt.pid); got != tt.want {
+				t.Errorf("topContainsPid(%d) = %v, want %v", tt.pid, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeContainer is a container served by the fake docker api, a running container exits with waitCode
+// when it's waited, unless block is set, the wait then lasts until the request is canceled
+type fakeContainer struct {
+	running  bool
+	exitCode int
+	waitCode int64
+	block    bool
+	onWait   func()
+	binds    []string
+}
+
+// newFakeDocker points docker.Cli to a fake docker api serving the inspect and wait of the containers
+func newFakeDocker(t *testing.T, containers map[string]*fakeContainer) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 || parts[1] != "containers" {
+			http.NotFound(w, r)
+			return
+		}
+		ctr, ok := containers[parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + parts[2]})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch parts[3] {
+		case "json":
+			_ = json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+				Name:       "/" + parts[2],
+				State:      &types.ContainerState{Running: ctr.running, ExitCode: ctr.exitCode},
+				HostConfig: &container.HostConfig{Binds: ctr.binds},
+			}})
+		case "wait":
+			if ctr.onWait != nil {
+				ctr.onWait()
+			}
+			if ctr.block {
+				<-r.Context().Done()
+				return
+			}
+			_ = json.NewEncoder(w).Encode(container.WaitResponse{StatusCode: ctr.waitCode})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := docker.Cli
+	docker.Cli = cli
+	t.Cleanup(func() {
+		docker.Cli = old
+		_ = cli.Close()
+		server.Close()
+	})
+}
+
+func TestWaitContainer(t *testing.T) {
+	tests := []struct {
+		name         string
+		containers   map[string]*fakeContainer
+		follow       bool
+		want         int
+		wantErr      bool
+		wantCanceled bool
+	}{
+		{
+			name:       "exited already",
+			containers: map[string]*fakeContainer{"foo-1": {exitCode: 3}},
+			want:       3,
+		},
+		{
+			name:       "exited while waiting",
+			containers: map[string]*fakeContainer{"foo-1": {running: true, waitCode: 3}},
+			want:       3,
+		},
+		{
+			name: "replaced while waiting",
+			containers: map[string]*fakeContainer{
+				"foo-1": {running: true, waitCode: 137, onWait: func() { vmap.ContainerVersionMap.Set("foo", 2) }},
+				"foo-2": {running: true, waitCode: 3},
+			},
+			want: 137,
+		},
+		{
+			name: "replaced while waiting and followed",
+			containers: map[string]*fakeContainer{
+				"foo-1": {running: true, waitCode: 137, onWait: func() { vmap.ContainerVersionMap.Set("foo", 2) }},
+				"foo-2": {running: true, waitCode: 3},
+			},
+			follow: true,
+			want:   3,
+		},
+		{
+			name:         "canceled",
+			containers:   map[string]*fakeContainer{"foo-1": {running: true, block: true}},
+			wantErr:      true,
+			wantCanceled: true,
+		},
+		{
+			name:    "not found",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newFakeDocker(t, tt.containers)
+			vmap.ContainerVersionMap = vmap.NewVersionMap()
+			vmap.ContainerVersionMap.Set("foo", 1)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			var (
+				rs   ReplicaSetService
+				got  int
+				err  error
+				code int64
+			)
+			if tt.follow {
+				got, err = rs.WaitForContainer(ctx, "foo")
+			} else {
+				code, err = rs.WaitContainer(ctx, "foo")
+				got = int(code)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wait error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantCanceled && ctx.Err() == nil {
+				t.Errorf("wait error = %v, want canceled", err)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicaSetOf(t *testing.T) {
+	tests := []struct {
+		versionName string
+		want        string
+	}{
+		{versionName: "train-1", want: "train"},
+		{versionName: "my-train-12", want: "my-train"},
+		{versionName: "my-train", want: "my-train"},
+		{versionName: "train", want: "train"},
+		{versionName: "-1", want: "-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.versionName, func(t *testing.T) {
+			if got := replicaSetOf(tt.versionName); got != tt.want {
+				t.Errorf("replicaSetOf(%q) = %q, want %q", tt.versionName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectFrameworkEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       []string
+		framework string
+		fraction  float64
+		memory    int64
+		want      []string
+	}{
+		{name: "no framework", env: []string{"A=1"}, fraction: 0.5, want: []string{"A=1"}},
+		{name: "unknown framework", framework: "mxnet", fraction: 0.5, want: nil},
+		{name: "jax", framework: "JAX", fraction: 0.25, want: []string{"XLA_PYTHON_CLIENT_MEM_FRACTION=0.25"}},
+		{
+			name:      "tensorflow",
+			framework: "tensorflow",
+			fraction:  0.25,
+			memory:    40960,
+			want:      []string{"TF_FORCE_GPU_ALLOW_GROWTH=true", "TF_DEVICE_MIN_SYS_MEMORY_IN_MB=30720"},
+		},
+		{
+			name:      "tensorflow on a gpu of unknown memory",
+			framework: "tensorflow",
+			fraction:  0.25,
+			want:      []string{"TF_FORCE_GPU_ALLOW_GROWTH=true"},
+		},
+		{name: "pytorch", framework: "pytorch", fraction: 0.5, want: []string{"PYTORCH_CUDA_ALLOC_CONF=garbage_collection_threshold:0.50"}},
+		{
+			name:      "mps",
+			framework: frameworkMps,
+			fraction:  1.0 / 3,
+			memory:    24576,
+			want:      []string{"CUDA_MPS_ACTIVE_THREAD_PERCENTAGE=33", "CUDA_MPS_PINNED_DEVICE_MEM_LIMIT=0=8192M"},
+		},
+		{
+			name:      "the env of the user is kept",
+			env:       []string{"XLA_PYTHON_CLIENT_MEM_FRACTION=0.9"},
+			framework: "jax",
+			fraction:  0.5,
+			want:      []string{"XLA_PYTHON_CLIENT_MEM_FRACTION=0.9"},
+		},
+	}
+	defer func(frameworkEnv map[string]string, memoryTotal func(string) int64) {
+		cfg.FrameworkEnv, gpuMemoryTotal = frameworkEnv, memoryTotal
+	}(cfg.FrameworkEnv, gpuMemoryTotal)
+	cfg.FrameworkEnv = map[string]string{
+		"jax":        "XLA_PYTHON_CLIENT_MEM_FRACTION={fraction}",
+		"tensorflow": "TF_FORCE_GPU_ALLOW_GROWTH=true;TF_DEVICE_MIN_SYS_MEMORY_IN_MB={reservedMB}",
+		"pytorch":    "PYTORCH_CUDA_ALLOC_CONF=garbage_collection_threshold:{fraction}",
+		"mps":        "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE={percent};CUDA_MPS_PINNED_DEVICE_MEM_LIMIT=0={memoryMB}M",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gpuMemoryTotal = func(uuid string) int64 {
+				if uuid != "gpu-0" {
+					t.Errorf("gpuMemoryTotal(%s), want gpu-0", uuid)
+				}
+				return tt.memory
+			}
+			got := injectFrameworkEnv(tt.env, tt.framework, "gpu-0", tt.fraction)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("injectFrameworkEnv(%v, %s, %v) = %v, want %v", tt.env, tt.framework, tt.fraction, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		uuids       []string
+		requested   []string
+		want        []string
+		wantMissing []string
+	}{
+		{name: "none requested", uuids: []string{"gpu-0", "gpu-1"}, want: []string{"gpu-0", "gpu-1"}},
+		{name: "requested last", uuids: []string{"gpu-0", "gpu-1", "gpu-2"}, requested: []string{"gpu-0"},
+			want: []string{"gpu-1", "gpu-2", "gpu-0"}},
+		{name: "all requested", uuids: []string{"gpu-0", "gpu-1"}, requested: []string{"gpu-1", "gpu-0"},
+			want: []string{"gpu-0", "gpu-1"}},
+		{name: "requested but not used", uuids: []string{"gpu-1"}, requested: []string{"gpu-0", "gpu-1"},
+			want: []string{"gpu-1"}, wantMissing: []string{"gpu-0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := releaseOrder(tt.uuids, tt.requested); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("releaseOrder(%v, %v) = %v, want %v", tt.uuids, tt.requested, got, tt.want)
+			}
+			if got := missingGpus(tt.requested, tt.uuids); !reflect.DeepEqual(got, tt.wantMissing) {
+				t.Errorf("missingGpus(%v, %v) = %v, want %v", tt.requested, tt.uuids, got, tt.wantMissing)
+			}
+		})
+	}
+}
+
+// TestRollbackVersion rolls foo, whose latest version is 3, back to the versions that can't be rolled back to,
+// nothing is read from etcd or docker before they are rejected
+func TestRollbackVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		rsName  string
+		version int64
+		wantErr func(error) bool
+	}{
+		{name: "current version", rsName: "foo", version: 3, wantErr: xerrors.IsNoRollbackRequiredError},
+		{name: "newer than the latest", rsName: "foo", version: 4, wantErr: xerrors.IsContainerVersionNotFoundError},
+		{name: "unknown replicaSet", rsName: "bar", version: 1, wantErr: func(err error) bool { return err != nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmap.ContainerVersionMap = vmap.NewVersionMap()
+			vmap.ContainerVersionMap.Set("foo", 3)
+			var rs ReplicaSetService
+			_, err := rs.RollbackContainer(tt.rsName, &models.RollbackRequest{Version: tt.version})
+			if !tt.wantErr(err) {
+				t.Errorf("RollbackContainer(%s, %d) error = %v, want another error", tt.rsName, tt.version, err)
+			}
+		})
+	}
+}
+
+func TestFindVersionInfo(t *testing.T) {
+	// the revisions of foo, version 2 was deleted with the replicaSet, which was created again
+	values := []etcd.Value{
+		[]byte(`{"version":3,"containerName":"foo-3"}`),
+		[]byte(`{"version":1,"containerName":"foo-1"}`),
+	}
+	tests := []struct {
+		name     string
+		version  int64
+		values   []etcd.Value
+		want     string
+		notFound bool
+	}{
+		{name: "latest", version: 3, values: values, want: "foo-3"},
+		{name: "older", version: 1, values: values, want: "foo-1"},
+		{name: "deleted", version: 2, values: values, notFound: true},
+		{name: "no revisions", version: 1, notFound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := findVersionInfo("foo", tt.version, tt.values)
+			if tt.notFound {
+				if !xerrors.IsContainerVersionNotFoundError(err) {
+					t.Errorf("findVersionInfo(%d) = %+v, %v, want version not found", tt.version, info, err)
+				}
+				return
+			}
+			if err != nil || info.ContainerName != tt.want {
+				t.Errorf("findVersionInfo(%d) = %+v, %v, want %s", tt.version, info, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := findVersionInfo("foo", 1, []etcd.Value{[]byte("{")}); err == nil || xerrors.IsContainerVersionNotFoundError(err) {
+		t.Errorf("findVersionInfo() of an invalid value error = %v, want the unmarshal error", err)
+	}
+}
+
+func TestSetBinds(t *testing.T) {
+	tests := []struct {
+		name      string
+		binds     []models.Bind
+		wantBinds []string
+		wantTmpfs map[string]string
+	}{
+		{
+			name:      "no options",
+			binds:     []models.Bind{{Src: "/data", Dest: "/data"}, {Src: "foo-1", Dest: "/root/foo"}},
+			wantBinds: []string{"/data:/data", "foo-1:/root/foo"},
+		},
+		{
+			name:      "read-only",
+			binds:     []models.Bind{{Src: "/datasets", Dest: "/datasets", ReadOnly: true}},
+			wantBinds: []string{"/datasets:/datasets:ro"},
+		},
+		{
+			name:      "propagation",
+			binds:     []models.Bind{{Src: "/mnt", Dest: "/mnt", Propagation: "rslave"}},
+			wantBinds: []string{"/mnt:/mnt:rslave"},
+		},
+		{
+			name:      "consistency",
+			binds:     []models.Bind{{Src: "foo-1", Dest: "/data", Consistency: "cached"}},
+			wantBinds: []string{"foo-1:/data:cached"},
+		},
+		{
+			name:      "all options",
+			binds:     []models.Bind{{Src: "/mnt", Dest: "/mnt", ReadOnly: true, Propagation: "rshared", Consistency: "delegated"}},
+			wantBinds: []string{"/mnt:/mnt:ro,rshared,delegated"},
+		},
+		{
+			name:      "typed",
+			binds:     []models.Bind{{Type: "bind", Src: "/data", Dest: "/data"}, {Type: "volume", Src: "foo-1", Dest: "/root/foo"}},
+			wantBinds: []string{"/data:/data", "foo-1:/root/foo"},
+		},
+		{
+			name: "tmpfs",
+			binds: []models.Bind{
+				{Src: "foo-1", Dest: "/root/foo"},
+				{Type: "tmpfs", Dest: "/dev/shm", TmpfsSize: "16GB"},
+				{Type: "tmpfs", Dest: "/scratch"},
+				{Type: "tmpfs", Dest: "/cache", ReadOnly: true, TmpfsSize: "1MB"},
+			},
+			wantBinds: []string{"foo-1:/root/foo"},
+			wantTmpfs: map[string]string{"/dev/shm": "size=17179869184", "/scratch": "", "/cache": "ro,size=1048576"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hostConfig container.HostConfig
+			if err := setBinds(&hostConfig, tt.binds); err != nil {
+				t.Fatalf("setBinds() error = %v", err)
+			}
+			if !reflect.DeepEqual(hostConfig.Binds, tt.wantBinds) {
+				t.Errorf("setBinds() binds = %v, want %v", hostConfig.Binds, tt.wantBinds)
+			}
+			if !reflect.DeepEqual(hostConfig.Tmpfs, tt.wantTmpfs) {
+				t.Errorf("setBinds() tmpfs = %v, want %v", hostConfig.Tmpfs, tt.wantTmpfs)
+			}
+		})
+	}
+}
+
+func TestPatchVolume(t *testing.T) {
+	tests := []struct {
+		name  string
+		binds []string
+		patch *models.VolumePatch
+		want  []string
+	}{
+		{
+			name:  "replaced",
+			binds: []string{"foo-1:/data", "/datasets:/datasets"},
+			patch: &models.VolumePatch{OldBind: &models.Bind{Src: "foo-1", Dest: "/data"}, NewBind: &models.Bind{Src: "foo-2", Dest: "/data"}},
+			want:  []string{"foo-2:/data", "/datasets:/datasets"},
+		},
+		{
+			name:  "options added",
+			binds: []string{"/datasets:/datasets"},
+			patch: &models.VolumePatch{
+				OldBind: &models.Bind{Src: "/datasets", Dest: "/datasets"},
+				NewBind: &models.Bind{Src: "/datasets", Dest: "/datasets", ReadOnly: true, Propagation: "rslave"},
+			},
+			want: []string{"/datasets:/datasets:ro,rslave"},
+		},
+		{
+			name:  "matched without the options",
+			binds: []string{"/datasets:/datasets:ro"},
+			patch: &models.VolumePatch{
+				OldBind: &models.Bind{Src: "/datasets", Dest: "/datasets"},
+				NewBind: &models.Bind{Src: "/datasets", Dest: "/datasets"},
+			},
+			want: []string{"/datasets:/datasets"},
+		},
+		{
+			name:  "not found",
+			binds: []string{"foo-1:/data"},
+			patch: &models.VolumePatch{OldBind: &models.Bind{Src: "bar-1", Dest: "/data"}, NewBind: &models.Bind{Src: "bar-2", Dest: "/data"}},
+			want:  []string{"foo-1:/data"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rs ReplicaSetService
+			info := &models.EtcdContainerInfo{HostConfig: &container.HostConfig{Binds: tt.binds}}
+			info, err := rs.patchVolume(tt.patch, info)
+			if err != nil {
+				t.Fatalf("patchVolume() error = %v", err)
+			}
+			if !reflect.DeepEqual(info.HostConfig.Binds, tt.want) {
+				t.Errorf("patchVolume() binds = %v, want %v", info.HostConfig.Binds, tt.want)
+			}
+		})
+	}
+}
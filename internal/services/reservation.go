@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	defaultReservationTTL = time.Hour
+	// reservationOwnerPrefix is the owner of the gpus held by a reservation in GpuScheduler,
+	// it never clashes with a replicaSet, because ':' is not allowed in container names.
+	reservationOwnerPrefix = "reservation:"
+)
+
+type ReservationService struct{}
+
+// ReserveGpus holds the gpus for a future job and returns the token and the reservation,
+// the token is passed to RunGpuContainer to use the gpus, they are reclaimed if the token is not used within the ttl.
+func (rvs *ReservationService) ReserveGpus(spec *models.TokenReservationCreate) (string, *models.TokenReservation, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, errors.Wrap(err, "rand.Read failed")
+	}
+	token := hex.EncodeToString(raw)
+	id := tokenID(token)
+
+	gpus, err := schedulers.GpuScheduler.Apply(reservationOwner(id), spec.Count)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "GpuScheduler.Apply failed")
+	}
+
+	ttl := defaultReservationTTL
+	if spec.TTL > 0 {
+		ttl = time.Duration(spec.TTL) * time.Second
+	}
+	record := &models.TokenReservation{
+		ID:         id,
+		Gpus:       gpus,
+		ExpireAt:   time.Now().Add(ttl).Unix(),
+		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if err = etcd.PutWithTTL(etcd.GpuReservations, id, record.Serialize(), ttl); err != nil {
+		schedulers.GpuScheduler.Restore(gpus)
+		return "", nil, errors.WithMessage(err, "etcd.PutWithTTL failed")
+	}
+
+	log.Infof("services.ReserveGpus, reservation: %s holds %d gpus: %v, expire at: %d", id, len(gpus), gpus, record.ExpireAt)
+	return token, record, nil
+}
+
+// ReleaseReservation releases the gpus of the reservation before it expires
+func (rvs *ReservationService) ReleaseReservation(id string) error {
+	if _, err := etcd.Take(etcd.GpuReservations, id); err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return errors.Wrapf(xerrors.NewReservationInvalidError(), "reservation: %s not found", id)
+		}
+		return errors.WithMessage(err, "etcd.Take failed")
+	}
+
+	gpus := schedulers.GpuScheduler.OwnedBy(reservationOwner(id))
+	schedulers.GpuScheduler.Restore(gpus)
+	log.Infof("services.ReleaseReservation, reservation: %s released %d gpus: %v", id, len(gpus), gpus)
+	return nil
+}
+
+// ReclaimExpiredReservations restores the gpus of the reservations whose lease expired
+func (rvs *ReservationService) ReclaimExpiredReservations() {
+	for _, owner := range schedulers.GpuScheduler.Owners(reservationOwnerPrefix) {
+		id := strings.TrimPrefix(owner, reservationOwnerPrefix)
+		if _, err := etcd.GetValue(etcd.GpuReservations, id); !xerrors.IsNotExistInEtcdError(err) {
+			continue
+		}
+		gpus := schedulers.GpuScheduler.OwnedBy(owner)
+		schedulers.GpuScheduler.Restore(gpus)
+		log.Infof("services.ReclaimExpiredReservations, reservation: %s expired, %d gpus reclaimed: %v", id, len(gpus), gpus)
+	}
+}
+
+// getReservation reads the reservation which must hold count gpus, it's not consumed
+func getReservation(id string, count int) (models.TokenReservation, error) {
+	var record models.TokenReservation
+	bytes, err := etcd.GetValue(etcd.GpuReservations, id)
+	if err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return record, errors.Wrapf(xerrors.NewReservationInvalidError(), "reservation: %s not found", id)
+		}
+		return record, errors.WithMessage(err, "etcd.GetValue failed")
+	}
+	if err = json.Unmarshal(bytes, &record); err != nil {
+		return record, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	if len(record.Gpus) != count {
+		return record, errors.Wrapf(xerrors.NewReservationInvalidError(),
+			"reservation: %s holds %d gpus, but %d gpus are requested", id, len(record.Gpus), count)
+	}
+	return record, nil
+}
+
+// consumeReservation hands the gpus of the reservation over to the replicaSet, a reservation can only be used once.
+// The returned rollback gives the gpus back to the reservation if the container fails to run.
+func consumeReservation(token, name string, count int) ([]string, func(), error) {
+	id := tokenID(token)
+	record, err := getReservation(id, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = etcd.Take(etcd.GpuReservations, id); err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return nil, nil, errors.Wrapf(xerrors.NewReservationInvalidError(), "reservation: %s is used", id)
+		}
+		return nil, nil, errors.WithMessage(err, "etcd.Take failed")
+	}
+
+	owner := reservationOwner(id)
+	gpus := schedulers.GpuScheduler.Transfer(owner, name)
+	if len(gpus) != len(record.Gpus) {
+		// some gpus have been reclaimed, the reservation can't be trusted
+		schedulers.GpuScheduler.Restore(gpus)
+		return nil, nil, errors.Wrapf(xerrors.NewReservationInvalidError(), "reservation: %s is expired", id)
+	}
+
+	rollback := func() {
+		gpus := schedulers.GpuScheduler.Transfer(name, owner)
+		ttl := time.Until(time.Unix(record.ExpireAt, 0))
+		if ttl <= 0 {
+			schedulers.GpuScheduler.Restore(gpus)
+			return
+		}
+		if err := etcd.PutWithTTL(etcd.GpuReservations, id, record.Serialize(), ttl); err != nil {
+			log.Errorf("services.consumeReservation, reservation: %s restore failed, gpus are released, error: %v", id, err)
+			schedulers.GpuScheduler.Restore(gpus)
+		}
+	}
+	log.Infof("services.consumeReservation, reservation: %s used by replicaSet: %s, gpus: %v", id, name, gpus)
+	return gpus, rollback, nil
+}
+
+func reservationOwner(id string) string {
+	return reservationOwnerPrefix + id
+}
+
+func ReservationGcLoop(ctx context.Context, interval time.Duration) {
+	var rvs ReservationService
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rvs.ReclaimExpiredReservations()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// scalingMu serializes the changes of scaling groups, between the api and the controller
+var scalingMu sync.Mutex
+
+type ScalingService struct {
+	rs ReplicaSetService
+}
+
+// CreateScalingGroup saves the scaling group and launches the replicas immediately
+func (ss *ScalingService) CreateScalingGroup(group *models.ScalingGroup) (*models.ScalingGroupStatus, error) {
+	if err := checkScalingGroup(group); err != nil {
+		return nil, err
+	}
+
+	scalingMu.Lock()
+	defer scalingMu.Unlock()
+
+	if _, err := etcd.GetValue(etcd.Scalings, group.Name); err == nil {
+		return nil, errors.Wrapf(xerrors.NewScalingGroupExistedError(), "scaling group %s", group.Name)
+	} else if !xerrors.IsNotExistInEtcdError(err) {
+		return nil, errors.WithMessage(err, "etcd.GetValue failed")
+	}
+
+	group.Members = nil
+	if err := ss.reconcile(group, nil); err != nil {
+		return nil, errors.WithMessage(err, "services.reconcile failed")
+	}
+	return ss.status(group), nil
+}
+
+func (ss *ScalingService) GetScalingGroup(name string) (*models.ScalingGroupStatus, error) {
+	group, err := getScalingGroup(name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.getScalingGroup failed")
+	}
+	return ss.status(group), nil
+}
+
+// PatchScalingGroup changes the desired replicas or the auto-scaling target, the replicas are adjusted immediately
+func (ss *ScalingService) PatchScalingGroup(name string, patch *models.ScalingPatch) (*models.ScalingGroupStatus, error) {
+	scalingMu.Lock()
+	defer scalingMu.Unlock()
+
+	group, err := getScalingGroup(name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.getScalingGroup failed")
+	}
+
+	if patch.Replicas != nil {
+		group.Replicas = *patch.Replicas
+	}
+	if patch.MinReplicas != nil {
+		group.MinReplicas = *patch.MinReplicas
+	}
+	if patch.MaxReplicas != nil {
+		group.MaxReplicas = *patch.MaxReplicas
+	}
+	if patch.TargetGpuUtilization != nil {
+		group.TargetGpuUtilization = *patch.TargetGpuUtilization
+	}
+	if err = checkScalingGroup(group); err != nil {
+		return nil, err
+	}
+
+	if err = ss.reconcile(group, nil); err != nil {
+		return nil, errors.WithMessage(err, "services.reconcile failed")
+	}
+	return ss.status(group), nil
+}
+
+// DeleteScalingGroup deletes all the replicas and the scaling group
+func (ss *ScalingService) DeleteScalingGroup(name string) error {
+	scalingMu.Lock()
+	defer scalingMu.Unlock()
+
+	group, err := getScalingGroup(name)
+	if err != nil {
+		return errors.WithMessage(err, "services.getScalingGroup failed")
+	}
+
+	for len(group.Members) > 0 {
+		member := group.Members[len(group.Members)-1]
+		if err = ss.rs.DeleteContainer(member, nil); err != nil {
+			_ = etcd.Put(etcd.Scalings, group.Name, group.Serialize())
+			return errors.WithMessagef(err, "services.DeleteContainer failed, replica: %s", member)
+		}
+		group.Members = group.Members[:len(group.Members)-1]
+	}
+
+	if err = etcd.Del(etcd.Scalings, name); err != nil {
+		return errors.WithMessage(err, "etcd.Del failed")
+	}
+	log.Infof("services.DeleteScalingGroup, scaling group: %s deleted successfully", name)
+	return nil
+}
+
+// ScalingLoop adjusts the replicas of all scaling groups periodically
+func ScalingLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var ss ScalingService
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ss.reconcileAll()
+		}
+	}
+}
+
+func (ss *ScalingService) reconcileAll() {
+	kvs, err := etcd.List(etcd.Scalings)
+	if err != nil {
+		log.Errorf("services.ScalingLoop, etcd.List failed, error: %v", err)
+		return
+	}
+	if len(kvs) == 0 {
+		return
+	}
+
+	utilization, err := schedulers.GetGpuUtilization()
+	if err != nil {
+		log.Errorf("services.ScalingLoop, GetGpuUtilization failed, error: %v", err)
+	}
+
+	scalingMu.Lock()
+	defer scalingMu.Unlock()
+	for key, value := range kvs {
+		var group models.ScalingGroup
+		if err = json.Unmarshal(value, &group); err != nil {
+			log.Errorf("services.ScalingLoop, scaling group: %s json.Unmarshal failed, error: %v", key, err)
+			continue
+		}
+		if err = ss.reconcile(&group, utilization); err != nil {
+			log.Errorf("services.ScalingLoop, scaling group: %s reconcile failed, error: %v", key, err)
+		}
+	}
+}
+
+// reconcile launches or removes replicas to make the number of replicas equal to the desired number.
+// If the utilization is given and the group has a target, the desired number is calculated from the
+// average gpu utilization of the replicas, like the kubernetes HPA does.
+// The scaling up stops when the gpus are not enough, it will be retried in the next round.
+func (ss *ScalingService) reconcile(group *models.ScalingGroup, utilization map[string]int) error {
+	// the replicas may be deleted by hand
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		if vmap.ContainerVersionMap.Exist(member) {
+			members = append(members, member)
+		}
+	}
+	group.Members = members
+
+	if group.TargetGpuUtilization > 0 && utilization != nil && len(members) > 0 {
+		if average, ok := ss.averageUtilization(members, utilization); ok {
+			desired := int(math.Ceil(float64(len(members)) * average / float64(group.TargetGpuUtilization)))
+			if desired != group.Replicas {
+				log.Infof("services.reconcile, scaling group: %s average gpu utilization: %.1f%%, target: %d%%, replicas: %d -> %d",
+					group.Name, average, group.TargetGpuUtilization, group.Replicas, desired)
+			}
+			group.Replicas = desired
+		}
+	}
+	group.Replicas = min(max(group.Replicas, group.MinReplicas), group.MaxReplicas)
+
+	var err error
+	for index := 0; len(group.Members) < group.Replicas; index++ {
+		name := fmt.Sprintf("%s_%d", group.Name, index)
+		if vmap.ContainerVersionMap.Exist(name) {
+			continue
+		}
+
+		var spec models.ContainerRun
+		bytes, _ := json.Marshal(group.Spec)
+		_ = json.Unmarshal(bytes, &spec)
+		spec.ReplicaSetName = name
+
+		if _, _, _, _, err = ss.rs.RunGpuContainer(&spec); err != nil {
+			if xerrors.IsContainerExistedError(err) {
+				err = nil
+				continue
+			}
+			log.Errorf("services.reconcile, scaling group: %s launch replica: %s failed, error: %v", group.Name, name, err)
+			break
+		}
+		group.Members = append(group.Members, name)
+		log.Infof("services.reconcile, scaling group: %s launch replica: %s successfully", group.Name, name)
+	}
+
+	for len(group.Members) > group.Replicas {
+		member := group.Members[len(group.Members)-1]
+		if err = ss.rs.DeleteContainer(member, nil); err != nil {
+			log.Errorf("services.reconcile, scaling group: %s remove replica: %s failed, error: %v", group.Name, member, err)
+			break
+		}
+		group.Members = group.Members[:len(group.Members)-1]
+		log.Infof("services.reconcile, scaling group: %s remove replica: %s successfully", group.Name, member)
+	}
+
+	if putErr := etcd.Put(etcd.Scalings, group.Name, group.Serialize()); putErr != nil {
+		return errors.WithMessage(putErr, "etcd.Put failed")
+	}
+	return err
+}
+
+// averageUtilization of all gpus used by the replicas, false means the replicas use no gpu
+func (ss *ScalingService) averageUtilization(members []string, utilization map[string]int) (float64, bool) {
+	var total, count int
+	for _, member := range members {
+		for _, uuid := range ss.memberGpus(member) {
+			total += utilization[uuid]
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return float64(total) / float64(count), true
+}
+
+func (ss *ScalingService) memberGpus(member string) []string {
+	version, _ := vmap.ContainerVersionMap.Get(member)
+	uuids, err := ss.rs.containerDeviceRequestsDeviceIDs(fmt.Sprintf("%s-%d", member, version))
+	if err != nil {
+		log.Errorf("services.memberGpus, replica: %s get gpus failed, error: %v", member, err)
+	}
+	return uuids
+}
+
+func (ss *ScalingService) status(group *models.ScalingGroup) *models.ScalingGroupStatus {
+	utilization, _ := schedulers.GetGpuUtilization()
+	status := &models.ScalingGroupStatus{
+		Group:    group,
+		Replicas: make([]*models.ScalingReplica, 0, len(group.Members)),
+	}
+	for _, member := range group.Members {
+		version, _ := vmap.ContainerVersionMap.Get(member)
+		replica := &models.ScalingReplica{
+			ReplicaSetName: member,
+			ContainerName:  fmt.Sprintf("%s-%d", member, version),
+			Gpus:           ss.memberGpus(member),
+		}
+		if utilization != nil && len(replica.Gpus) > 0 {
+			replica.Utilization = make(map[string]int, len(replica.Gpus))
+			for _, uuid := range replica.Gpus {
+				replica.Utilization[uuid] = utilization[uuid]
+			}
+		}
+		status.Replicas = append(status.Replicas, replica)
+	}
+	return status
+}
+
+func getScalingGroup(name string) (*models.ScalingGroup, error) {
+	bytes, err := etcd.GetValue(etcd.Scalings, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Scalings, name))
+	}
+	var group models.ScalingGroup
+	if err = json.Unmarshal(bytes, &group); err != nil {
+		return nil, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	return &group, nil
+}
+
+func checkScalingGroup(group *models.ScalingGroup) error {
+	if group.MinReplicas < 0 || group.MaxReplicas < 1 || group.MinReplicas > group.MaxReplicas {
+		return errors.Wrapf(xerrors.NewScalingGroupInvalidError(), "min replicas: %d, max replicas: %d",
+			group.MinReplicas, group.MaxReplicas)
+	}
+	if group.Replicas < group.MinReplicas || group.Replicas > group.MaxReplicas {
+		return errors.Wrapf(xerrors.NewScalingGroupInvalidError(), "replicas: %d must be between %d and %d",
+			group.Replicas, group.MinReplicas, group.MaxReplicas)
+	}
+	if group.TargetGpuUtilization < 0 || group.TargetGpuUtilization > 100 {
+		return errors.Wrapf(xerrors.NewScalingGroupInvalidError(), "target gpu utilization: %d must be between 0 and 100",
+			group.TargetGpuUtilization)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// GetContainerStats returns the samples of the resource usage of the latest version of the container,
+// together with the usage of its gpus. Without stream only one sample is sent, otherwise a sample is sent
+// every second until the ctx is canceled or the container stops. The channel is closed after the last sample.
+func (rs *ReplicaSetService) GetContainerStats(ctx context.Context, name string, stream bool) (<-chan *models.ContainerStats, error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+
+	resp, err := docker.Cli.ContainerStats(ctx, ctrVersionName, stream)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerStats failed, name: %s", ctrVersionName)
+	}
+
+	samples := make(chan *models.ContainerStats)
+	go func() {
+		defer close(samples)
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var v types.StatsJSON
+			if err := decoder.Decode(&v); err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.Warnf("services.GetContainerStats, container: %s decode stats failed, error: %v", ctrVersionName, err)
+				}
+				return
+			}
+			stats := parseContainerStats(&v)
+			stats.ContainerName = ctrVersionName
+			stats.Gpus = gpuStats(uuids)
+
+			select {
+			case samples <- stats:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return samples, nil
+}
+
+// parseContainerStats calculates the usage of a stats sample of docker the same way as docker stats
+func parseContainerStats(v *types.StatsJSON) *models.ContainerStats {
+	stats := &models.ContainerStats{
+		Read:        v.Read,
+		MemoryLimit: v.MemoryStats.Limit,
+		Pids:        v.PidsStats.Current,
+	}
+
+	cpuDelta := float64(v.CPUStats.CPUUsage.TotalUsage) - float64(v.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(v.CPUStats.SystemUsage) - float64(v.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(v.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(v.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CpuPercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+
+	// the inactive page cache can be reclaimed, it's total_inactive_file in cgroup v1 and inactive_file in v2
+	stats.MemoryUsage = v.MemoryStats.Usage
+	if cache, ok := v.MemoryStats.Stats["total_inactive_file"]; ok && cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	} else if cache, ok = v.MemoryStats.Stats["inactive_file"]; ok && cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	}
+	if stats.MemoryLimit > 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+
+	for _, network := range v.Networks {
+		stats.NetworkRx += network.RxBytes
+		stats.NetworkTx += network.TxBytes
+	}
+	for _, entry := range v.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			stats.BlockRead += entry.Value
+		case "write":
+			stats.BlockWrite += entry.Value
+		}
+	}
+	return stats
+}
+
+// gpuStats returns the usage of the gpus by uuid, the mig instances aren't listed by nvidia-smi and are skipped.
+// The stats of the container are still returned if nvidia-smi fails.
+func gpuStats(uuids []string) []*models.GpuStats {
+	if len(uuids) == 0 {
+		return nil
+	}
+	devices, err := schedulers.QueryGpuDevices()
+	if err != nil {
+		log.Warnf("services.GetContainerStats, query gpu devices failed, error: %v", err)
+		return nil
+	}
+
+	stats := make([]*models.GpuStats, 0, len(uuids))
+	for _, device := range devices {
+		for _, uuid := range uuids {
+			if device.UUID == uuid {
+				stats = append(stats, &models.GpuStats{
+					UUID:               device.UUID,
+					MemoryTotal:        device.MemoryTotal,
+					MemoryUsed:         device.MemoryUsed,
+					UtilizationPercent: device.UtilizationPercent,
+				})
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// the stats payloads recorded from docker 24 on cgroup v2 and cgroup v1, trimmed to the fields that are parsed
+const (
+	cgroupV2Stats = `{
+		"read": "2026-10-14T16:00:01.5Z",
+		"preread": "2026-10-14T16:00:00.5Z",
+		"pids_stats": {"current": 12, "limit": 4915},
+		"blkio_stats": {
+			"io_service_bytes_recursive": [
+				{"major": 259, "minor": 0, "op": "read", "value": 4096},
+				{"major": 259, "minor": 0, "op": "write", "value": 8192},
+				{"major": 259, "minor": 1, "op": "read", "value": 1024}
+			]
+		},
+		"cpu_stats": {
+			"cpu_usage": {"total_usage": 2500000000, "usage_in_kernelmode": 100000000, "usage_in_usermode": 2400000000},
+			"system_cpu_usage": 1000000000000,
+			"online_cpus": 8
+		},
+		"precpu_stats": {
+			"cpu_usage": {"total_usage": 2000000000, "usage_in_kernelmode": 90000000, "usage_in_usermode": 1910000000},
+			"system_cpu_usage": 996000000000,
+			"online_cpus": 8
+		},
+		"memory_stats": {
+			"usage": 1073741824,
+			"stats": {"active_file": 1048576, "anon": 536870912, "file": 536870912, "inactive_file": 268435456},
+			"limit": 8589934592
+		},
+		"name": "/foo-1",
+		"id": "4cc6d2a4d2b8",
+		"networks": {
+			"eth0": {"rx_bytes": 1000, "rx_packets": 10, "tx_bytes": 2000, "tx_packets": 20},
+			"eth1": {"rx_bytes": 500, "rx_packets": 5, "tx_bytes": 250, "tx_packets": 2}
+		}
+	}`
+	cgroupV1Stats = `{
+		"read": "2026-10-14T16:00:01Z",
+		"preread": "2026-10-14T16:00:00Z",
+		"pids_stats": {"current": 3},
+		"blkio_stats": {
+			"io_service_bytes_recursive": [
+				{"major": 8, "minor": 0, "op": "Read", "value": 2048},
+				{"major": 8, "minor": 0, "op": "Write", "value": 512},
+				{"major": 8, "minor": 0, "op": "Sync", "value": 2560},
+				{"major": 8, "minor": 0, "op": "Async", "value": 0},
+				{"major": 8, "minor": 0, "op": "Total", "value": 2560}
+			]
+		},
+		"cpu_stats": {
+			"cpu_usage": {"total_usage": 600000000, "percpu_usage": [150000000, 150000000, 150000000, 150000000]},
+			"system_cpu_usage": 20000000000
+		},
+		"precpu_stats": {
+			"cpu_usage": {"total_usage": 400000000, "percpu_usage": [100000000, 100000000, 100000000, 100000000]},
+			"system_cpu_usage": 16000000000
+		},
+		"memory_stats": {
+			"usage": 209715200,
+			"stats": {"cache": 104857600, "total_inactive_file": 52428800, "inactive_file": 52428800},
+			"limit": 1048576000
+		},
+		"name": "/bar-2",
+		"networks": {"eth0": {"rx_bytes": 42, "tx_bytes": 24}}
+	}`
+	// the first sample of a stream has no previous sample, and a container without a network has no networks
+	firstSampleStats = `{
+		"read": "2026-10-14T16:00:00Z",
+		"preread": "0001-01-01T00:00:00Z",
+		"pids_stats": {"current": 1},
+		"blkio_stats": {"io_service_bytes_recursive": null},
+		"cpu_stats": {"cpu_usage": {"total_usage": 100000000}, "system_cpu_usage": 5000000000, "online_cpus": 2},
+		"precpu_stats": {"cpu_usage": {"total_usage": 0}},
+		"memory_stats": {"usage": 4096, "stats": {"inactive_file": 8192}}
+	}`
+)
+
+func TestParseContainerStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    models.ContainerStats
+	}{
+		{
+			name:    "cgroup v2",
+			payload: cgroupV2Stats,
+			want: models.ContainerStats{
+				Read:          time.Date(2026, 10, 14, 16, 0, 1, 500000000, time.UTC),
+				CpuPercent:    100,
+				MemoryUsage:   805306368,
+				MemoryLimit:   8589934592,
+				MemoryPercent: 9.375,
+				NetworkRx:     1500,
+				NetworkTx:     2250,
+				BlockRead:     5120,
+				BlockWrite:    8192,
+				Pids:          12,
+			},
+		},
+		{
+			name:    "cgroup v1",
+			payload: cgroupV1Stats,
+			want: models.ContainerStats{
+				Read:          time.Date(2026, 10, 14, 16, 0, 1, 0, time.UTC),
+				CpuPercent:    20,
+				MemoryUsage:   157286400,
+				MemoryLimit:   1048576000,
+				MemoryPercent: 15,
+				NetworkRx:     42,
+				NetworkTx:     24,
+				BlockRead:     2048,
+				BlockWrite:    512,
+				Pids:          3,
+			},
+		},
+		{
+			name:    "first sample",
+			payload: firstSampleStats,
+			want: models.ContainerStats{
+				Read:        time.Date(2026, 10, 14, 16, 0, 0, 0, time.UTC),
+				CpuPercent:  4,
+				MemoryUsage: 4096,
+				Pids:        1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v types.StatsJSON
+			if err := json.Unmarshal([]byte(tt.payload), &v); err != nil {
+				t.Fatal(err)
+			}
+			got := parseContainerStats(&v)
+			if !got.Read.Equal(tt.want.Read) {
+				t.Errorf("parseContainerStats() read = %v, want %v", got.Read, tt.want.Read)
+			}
+			if math.Abs(got.CpuPercent-tt.want.CpuPercent) > 1e-9 || math.Abs(got.MemoryPercent-tt.want.MemoryPercent) > 1e-9 {
+				t.Errorf("parseContainerStats() cpu = %v%%, memory = %v%%, want %v%%, %v%%",
+					got.CpuPercent, got.MemoryPercent, tt.want.CpuPercent, tt.want.MemoryPercent)
+			}
+			got.Read, got.CpuPercent, got.MemoryPercent = tt.want.Read, tt.want.CpuPercent, tt.want.MemoryPercent
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseContainerStats() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
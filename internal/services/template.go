@@ -0,0 +1,115 @@
+package services
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// placeholderRegexp matches placeholders like {{tag}} or {{ tag }}
+var placeholderRegexp = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+type TemplateService struct{}
+
+// SaveTemplate saves the template to etcd asynchronously, the template with the same name will be overwritten
+func (ts *TemplateService) SaveTemplate(spec *models.ContainerTemplate) error {
+	bytes, err := json.Marshal(spec)
+	if err != nil {
+		return errors.WithMessage(err, "json.Marshal failed")
+	}
+	value := string(bytes)
+	if err = workQueue.TryEnqueue(etcd.PutKeyValue{
+		Resource: etcd.Templates,
+		Key:      spec.Name,
+		Value:    &value,
+	}); err != nil {
+		return errors.WithMessage(err, "workQueue.TryEnqueue failed")
+	}
+
+	log.Infof("services.SaveTemplate, template: %s saved successfully, params: %v", spec.Name, templateParams(value))
+	return nil
+}
+
+func (ts *TemplateService) GetTemplate(name string) (spec models.ContainerTemplate, err error) {
+	bytes, err := etcd.GetValue(etcd.Templates, name)
+	if err != nil {
+		return spec, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Templates, name))
+	}
+	if err = json.Unmarshal(bytes, &spec); err != nil {
+		return spec, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	return
+}
+
+func (ts *TemplateService) DeleteTemplate(name string) error {
+	if _, err := etcd.GetValue(etcd.Templates, name); err != nil {
+		return errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Templates, name))
+	}
+	if err := workQueue.TryEnqueue(etcd.DelKey{
+		Resource: etcd.Templates,
+		Key:      name,
+	}); err != nil {
+		return errors.WithMessage(err, "workQueue.TryEnqueue failed")
+	}
+	log.Infof("services.DeleteTemplate, template: %s will be deleted", name)
+	return nil
+}
+
+// RenderTemplate fills the placeholders of the template with params,
+// all placeholders must be supplied, otherwise an error will be returned.
+func (ts *TemplateService) RenderTemplate(name string, spec *models.TemplateLaunch) (*models.ContainerRun, error) {
+	bytes, err := etcd.GetValue(etcd.Templates, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Templates, name))
+	}
+
+	var missing []string
+	for _, param := range templateParams(string(bytes)) {
+		if _, ok := spec.Params[param]; !ok {
+			missing = append(missing, param)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.Wrapf(xerrors.NewTemplateParamsMissingError(), "template: %s, missing params: %v", name, missing)
+	}
+
+	rendered := placeholderRegexp.ReplaceAllStringFunc(string(bytes), func(placeholder string) string {
+		param := placeholderRegexp.FindStringSubmatch(placeholder)[1]
+		// escape the value, because it will be placed in a json string
+		escaped, _ := json.Marshal(spec.Params[param])
+		return strings.Trim(string(escaped), `"`)
+	})
+
+	var tmpl models.ContainerTemplate
+	if err = json.Unmarshal([]byte(rendered), &tmpl); err != nil {
+		return nil, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	if len(spec.ReplicaSetName) != 0 {
+		tmpl.Spec.ReplicaSetName = spec.ReplicaSetName
+	}
+
+	log.Infof("services.RenderTemplate, template: %s rendered successfully, spec: %+v", name, tmpl.Spec)
+	return &tmpl.Spec, nil
+}
+
+// templateParams returns the names of all placeholders, duplicates are removed
+func templateParams(tmpl string) []string {
+	seen := make(map[string]struct{})
+	params := make([]string, 0)
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := seen[match[1]]; ok {
+			continue
+		}
+		seen[match[1]] = struct{}{}
+		params = append(params, match[1])
+	}
+	return params
+}
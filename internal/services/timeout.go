@@ -0,0 +1,25 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// cleanupTimeout bounds the removal of the resources created by a request that failed or timed out
+const cleanupTimeout = 30 * time.Second
+
+// dockerContext bounds the docker calls of a request by --dockerTimeout, so a hung docker daemon
+// doesn't block the request forever, 0 means no timeout. The pull of images, the copy of data and
+// the health check may take longer, they are detached from the timeout by context.WithoutCancel.
+func dockerContext() (context.Context, context.CancelFunc) {
+	if cfg.DockerTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), cfg.DockerTimeout)
+}
+
+// cleanupContext is used to remove what's created before the ctx is done, e.g. the container created
+// by docker after the request timed out, it's not canceled along with the ctx.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
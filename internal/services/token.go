@@ -0,0 +1,136 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const defaultTokenTTL = 5 * time.Minute
+
+type TokenService struct{}
+
+// CreateToken mints a single-use token of the replicaSet for the actions, and returns the token and its record.
+// The token is saved to etcd synchronously, so it can be used as soon as it's returned.
+func (ts *TokenService) CreateToken(name string, spec *models.AccessTokenCreate) (string, *models.AccessToken, error) {
+	if !vmap.ContainerVersionMap.Exist(name) {
+		return "", nil, errors.Errorf("container: %s not found in ContainerVersionMap", name)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, errors.Wrap(err, "rand.Read failed")
+	}
+	token := hex.EncodeToString(raw)
+
+	ttl := defaultTokenTTL
+	if spec.TTL > 0 {
+		ttl = time.Duration(spec.TTL) * time.Second
+	}
+	record := &models.AccessToken{
+		ID:             tokenID(token),
+		ReplicaSetName: name,
+		Actions:        spec.Actions,
+		ExpireAt:       time.Now().Add(ttl).Unix(),
+		CreateTime:     time.Now().Format("2006-01-02 15:04:05"),
+	}
+	ts.pruneExpiredTokens()
+	if err := etcd.Put(etcd.Tokens, record.ID, record.Serialize()); err != nil {
+		return "", nil, errors.WithMessage(err, "etcd.Put failed")
+	}
+
+	log.Infof("services.CreateToken, token: %s of replicaSet: %s created, actions: %v, expire at: %d",
+		record.ID, name, record.Actions, record.ExpireAt)
+	return token, record, nil
+}
+
+// UseToken consumes the token if it's valid for the action on the replicaSet, a token can only be used once.
+// The token is validated before it's consumed, so a request with the wrong replicaSet or action
+// doesn't burn it, and of the concurrent requests with a valid token only one consumes it.
+func (ts *TokenService) UseToken(token, name string, action models.TokenAction) error {
+	id := tokenID(token)
+	kv, err := etcd.GetRevisionValue(etcd.Tokens, id)
+	if err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return errors.Wrapf(xerrors.NewTokenInvalidError(), "token: %s not found", id)
+		}
+		return errors.WithMessage(err, "etcd.GetRevisionValue failed")
+	}
+	var record models.AccessToken
+	if err = json.Unmarshal(kv.Value, &record); err != nil {
+		return errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	if err = checkToken(&record, name, action, time.Now()); err != nil {
+		return err
+	}
+
+	consumed, err := etcd.DelIfRevision(etcd.Tokens, id, kv.ModRevision)
+	if err != nil {
+		return errors.WithMessage(err, "etcd.DelIfRevision failed")
+	}
+	if !consumed {
+		return errors.Wrapf(xerrors.NewTokenInvalidError(), "token: %s is used or revoked", id)
+	}
+	log.Infof("services.UseToken, token: %s of replicaSet: %s used for %s", id, name, action)
+	return nil
+}
+
+// checkToken returns the TokenInvalid error if the token doesn't allow the action on the replicaSet at now
+func checkToken(record *models.AccessToken, name string, action models.TokenAction, now time.Time) error {
+	if now.Unix() > record.ExpireAt {
+		return errors.Wrapf(xerrors.NewTokenInvalidError(), "token: %s expired at %d", record.ID, record.ExpireAt)
+	}
+	if record.ReplicaSetName != name {
+		return errors.Wrapf(xerrors.NewTokenInvalidError(), "token: %s is not for replicaSet: %s", record.ID, name)
+	}
+	for _, allowed := range record.Actions {
+		if allowed == action {
+			return nil
+		}
+	}
+	return errors.Wrapf(xerrors.NewTokenInvalidError(), "token: %s doesn't allow action: %s", record.ID, action)
+}
+
+// RevokeToken deletes the token by its id
+func (ts *TokenService) RevokeToken(id string) error {
+	if _, err := etcd.Take(etcd.Tokens, id); err != nil {
+		if xerrors.IsNotExistInEtcdError(err) {
+			return errors.Wrapf(xerrors.NewTokenInvalidError(), "token: %s not found", id)
+		}
+		return errors.WithMessage(err, "etcd.Take failed")
+	}
+	log.Infof("services.RevokeToken, token: %s revoked", id)
+	return nil
+}
+
+// pruneExpiredTokens deletes the tokens which expired without being used
+func (ts *TokenService) pruneExpiredTokens() {
+	kvs, err := etcd.List(etcd.Tokens)
+	if err != nil {
+		log.Errorf("services.pruneExpiredTokens, etcd.List failed, error: %v", err)
+		return
+	}
+	now := time.Now().Unix()
+	for id, value := range kvs {
+		var record models.AccessToken
+		if err = json.Unmarshal(value, &record); err != nil || now > record.ExpireAt {
+			_ = etcd.Del(etcd.Tokens, id)
+		}
+	}
+}
+
+// tokenID is the sha256 of the token, so a leak of etcd doesn't leak the tokens
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
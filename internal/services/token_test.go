@@ -0,0 +1,43 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestCheckToken(t *testing.T) {
+	now := time.Unix(1000, 0)
+	record := &models.AccessToken{
+		ID:             "id",
+		ReplicaSetName: "foo",
+		Actions:        []models.TokenAction{models.TokenActionExecute, models.TokenActionTerminal},
+		ExpireAt:       now.Unix(),
+	}
+	tests := []struct {
+		name    string
+		rs      string
+		action  models.TokenAction
+		now     time.Time
+		wantErr bool
+	}{
+		{name: "execute", rs: "foo", action: models.TokenActionExecute, now: now},
+		{name: "terminal", rs: "foo", action: models.TokenActionTerminal, now: now},
+		{name: "expired", rs: "foo", action: models.TokenActionExecute, now: now.Add(time.Second), wantErr: true},
+		{name: "other replicaSet", rs: "bar", action: models.TokenActionExecute, now: now, wantErr: true},
+		{name: "action not allowed", rs: "foo", action: models.TokenActionLogs, now: now, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkToken(record, tt.rs, tt.action, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !xerrors.IsTokenInvalidError(err) {
+				t.Errorf("checkToken() error = %v, want token invalid", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+)
+
+// FindContainersByVolumeVersion returns the container versions that mounted the volume version,
+// in the order they started, so that a result can be traced back to the exact data it consumed.
+func (vs *VolumeService) FindContainersByVolumeVersion(name string, version int64) ([]*models.VolumeUsage, error) {
+	kvs, err := etcd.ListPrefix(etcd.VolumeUsages, fmt.Sprintf("%s-%d/", name, version))
+	if err != nil {
+		return nil, errors.WithMessage(err, "etcd.ListPrefix failed")
+	}
+
+	usages := make([]*models.VolumeUsage, 0, len(kvs))
+	for key, value := range kvs {
+		var usage models.VolumeUsage
+		if err = json.Unmarshal(value, &usage); err != nil {
+			log.Errorf("services.FindContainersByVolumeVersion, volume usage: %s is invalid, error: %v", key, err)
+			continue
+		}
+		usages = append(usages, &usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].StartTime != usages[j].StartTime {
+			return usages[i].StartTime < usages[j].StartTime
+		}
+		return usages[i].ContainerName < usages[j].ContainerName
+	})
+	return usages, nil
+}
+
+// volumeUsages are the usages recorded since the start by key, until they end. The end of a usage is taken from here
+// instead of etcd, where the start of it may not be written yet by the WorkQueue.
+var volumeUsages sync.Map
+
+// putVolumeUsage writes the usage to etcd through the WorkQueue, it's replaced by the tests
+var putVolumeUsage = func(key string, usage *models.VolumeUsage) {
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.VolumeUsages,
+		Key:      key,
+		Value:    usage.Serialize(),
+	})
+}
+
+// recordVolumeUsage indexes the managed volume versions mounted by the container version, the host paths are skipped
+func recordVolumeUsage(ctrVersionName string, binds []string, startTime string) {
+	replicaSetName, ctrVersion, ok := splitVersionName(ctrVersionName)
+	if !ok {
+		return
+	}
+	for _, volVersionName := range usedVolumeVersions(binds) {
+		volumeName, volVersion, _ := splitVersionName(volVersionName)
+		usage := &models.VolumeUsage{
+			VolumeName:       volumeName,
+			VolumeVersion:    volVersion,
+			ReplicaSetName:   replicaSetName,
+			ContainerVersion: ctrVersion,
+			ContainerName:    ctrVersionName,
+			StartTime:        startTime,
+		}
+		key := volVersionName + "/" + ctrVersionName
+		volumeUsages.Store(key, usage)
+		putVolumeUsage(key, usage)
+	}
+}
+
+// endVolumeUsage sets the end time of the volume usages of the container version before it's removed
+func endVolumeUsage(ctx context.Context, ctrVersionName string) {
+	resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName)
+	if err != nil || resp.HostConfig == nil {
+		log.Errorf("services.endVolumeUsage, container: %s inspect failed, the end of volume usage is unknown, error: %v",
+			ctrVersionName, err)
+		return
+	}
+
+	endTime := time.Now().Format("2006-01-02 15:04:05")
+	for _, volVersionName := range usedVolumeVersions(resp.HostConfig.Binds) {
+		key := volVersionName + "/" + ctrVersionName
+		usage, ok := recordedVolumeUsage(key)
+		if !ok {
+			continue
+		}
+		usage.EndTime = endTime
+		putVolumeUsage(key, usage)
+	}
+}
+
+// recordedVolumeUsage returns a copy of the usage, the ones recorded before the start are read from etcd
+func recordedVolumeUsage(key string) (*models.VolumeUsage, bool) {
+	if v, ok := volumeUsages.LoadAndDelete(key); ok {
+		usage := *v.(*models.VolumeUsage)
+		return &usage, true
+	}
+	value, err := etcd.GetValue(etcd.VolumeUsages, key)
+	if err != nil {
+		return nil, false
+	}
+	var usage models.VolumeUsage
+	if err = json.Unmarshal(value, &usage); err != nil {
+		return nil, false
+	}
+	return &usage, true
+}
+
+// usedVolumeVersions returns the versioned names of the managed volumes in the binds
+func usedVolumeVersions(binds []string) []string {
+	var names []string
+	for _, bind := range binds {
+		src := strings.Split(bind, ":")[0]
+		if strings.HasPrefix(src, "/") {
+			continue
+		}
+		if name, _, ok := splitVersionName(src); ok && vmap.VolumeVersionMap.Exist(name) {
+			names = append(names, src)
+		}
+	}
+	return names
+}
+
+// replicaSetOf returns the replicaSet of the version, e.g. "foo-bar" of "foo-bar-2", or the name itself if it's not a version
+func replicaSetOf(versionName string) string {
+	if base, _, ok := splitVersionName(versionName); ok {
+		return base
+	}
+	return versionName
+}
+
+// splitVersionName splits a versioned name, e.g. "data-2" into "data" and 2
+func splitVersionName(versionName string) (string, int64, bool) {
+	idx := strings.LastIndex(versionName, "-")
+	if idx <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.ParseInt(versionName[idx+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return versionName[:idx], version, true
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+func TestUsedVolumeVersions(t *testing.T) {
+	old := vmap.VolumeVersionMap
+	defer func() { vmap.VolumeVersionMap = old }()
+	vmap.VolumeVersionMap = vmap.NewVersionMap()
+	vmap.VolumeVersionMap.Set("data", 2)
+	vmap.VolumeVersionMap.Set("my-data", 1)
+
+	tests := []struct {
+		name  string
+		binds []string
+		want  []string
+	}{
+		{name: "managed", binds: []string{"data-2:/data"}, want: []string{"data-2"}},
+		{name: "dash in the name", binds: []string{"my-data-1:/data:ro"}, want: []string{"my-data-1"}},
+		{name: "host path", binds: []string{"/data-2:/data"}},
+		{name: "not managed", binds: []string{"other-1:/data", "data:/data"}},
+		{name: "mixed", binds: []string{"/host:/host", "data-1:/old", "data-2:/new"}, want: []string{"data-1", "data-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usedVolumeVersions(tt.binds); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("usedVolumeVersions(%v) = %v, want %v", tt.binds, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEndVolumeUsage ends the usages right after they are recorded, before the WorkQueue writes them to etcd
+func TestEndVolumeUsage(t *testing.T) {
+	old := vmap.VolumeVersionMap
+	defer func() { vmap.VolumeVersionMap = old }()
+	vmap.VolumeVersionMap = vmap.NewVersionMap()
+	vmap.VolumeVersionMap.Set("data", 2)
+
+	var puts []models.VolumeUsage
+	defer func(put func(string, *models.VolumeUsage)) { putVolumeUsage = put }(putVolumeUsage)
+	putVolumeUsage = func(key string, usage *models.VolumeUsage) {
+		puts = append(puts, *usage)
+	}
+
+	binds := []string{"data-1:/old", "/host:/host", "data-2:/new"}
+	newFakeDocker(t, map[string]*fakeContainer{"train-3": {binds: binds}})
+	recordVolumeUsage("train-3", binds, "2026-10-14 10:00:00")
+	endVolumeUsage(context.Background(), "train-3")
+
+	if len(puts) != 4 {
+		t.Fatalf("puts = %+v, want the start and the end of 2 usages", puts)
+	}
+	for i, start := range puts[:2] {
+		end := puts[i+2]
+		if len(start.EndTime) != 0 || len(end.EndTime) == 0 {
+			t.Errorf("end time of the start = %q and the end = %q, want only the end set", start.EndTime, end.EndTime)
+		}
+		end.EndTime = ""
+		if !reflect.DeepEqual(end, start) {
+			t.Errorf("end of the usage = %+v, want %+v", end, start)
+		}
+	}
+	if puts[0].VolumeVersion != 1 || puts[1].VolumeVersion != 2 || puts[0].ContainerVersion != 3 {
+		t.Errorf("usages = %+v, want data-1 and data-2 used by train-3", puts[:2])
+	}
+	if _, ok := volumeUsages.Load("data-1/train-3"); ok {
+		t.Error("usage of data-1 is kept in memory after it ended")
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/ngaut/log"
@@ -15,6 +20,7 @@ import (
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
 	vmap "github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
@@ -23,9 +29,22 @@ import (
 
 type VolumeService struct{}
 
+// localDriverOpts are the options supported by the local driver
+var localDriverOpts = map[string]struct{}{
+	"type":   {},
+	"o":      {},
+	"device": {},
+	"size":   {},
+}
+
 func (vs *VolumeService) CreateVolume(spec *models.VolumeCreate) (resp volume.Volume, err error) {
-	ctx := context.Background()
-	if vs.existVolume(spec.Name) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+	exist, err := vs.existVolume(ctx, spec.Name)
+	if err != nil {
+		return resp, errors.WithMessage(err, "services.existVolume failed")
+	}
+	if exist {
 		return resp, errors.Wrapf(xerrors.NewVolumeExistedError(), "volume %s", spec.Name)
 	}
 
@@ -37,52 +56,73 @@ func (vs *VolumeService) CreateVolume(spec *models.VolumeCreate) (resp volume.Vo
 		opt.DriverOpts = map[string]string{"size": spec.Size}
 	}
 
-	resp, kv, err := vs.createVolume(ctx, spec.Name, models.EtcdVolumeInfo{Opt: &opt})
+	resp, kv, err := vs.createVolume(ctx, spec.Name, models.EtcdVolumeInfo{Opt: &opt, Encryption: spec.Encryption})
 	if err != nil {
 		return resp, errors.WithMessage(err, "services.createVolume failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Enqueue(etcd.PutKeyValue{
 		Resource: etcd.Volumes,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
+	notify.Emit(models.EventVolumeCreated, spec.Name, map[string]interface{}{
+		"volumeName": resp.Name,
+		"size":       spec.Size,
+	})
 	return
 }
 
 // It will only be executed based on the `docker.client.ContainerCreate`
 func (vs *VolumeService) createVolume(ctx context.Context, name string, info models.EtcdVolumeInfo) (resp volume.Volume, kv etcd.PutKeyValue, err error) {
 	// set the version number
-	version, _ := vmap.VolumeVersionMap.Get(name)
-	version = version + 1
-	vmap.VolumeVersionMap.Set(name, version)
+	version := vmap.VolumeVersionMap.Next(name)
 
 	defer func() {
 		// if run container failed, clear the version number
 		if err != nil {
-			if version == 1 {
-				vmap.VolumeVersionMap.Remove(name)
-			} else {
-				vmap.VolumeVersionMap.Set(name, version-1)
-			}
+			vmap.VolumeVersionMap.Release(name, version)
 		}
 	}()
 
 	// generate name and save creation time
 	info.Opt.Name = fmt.Sprintf("%s-%d", name, version)
+	info.Opt.Labels = setManagedLabels(info.Opt.Labels, name, version)
 	info.CreateTime = time.Now().Format("2006-01-02 15:04:05")
 
+	// the local volume binds the decrypted view of the encrypted filesystem
+	if info.Encryption != nil {
+		info.Opt.DriverOpts, err = setupEncryption(info.Opt.Name, info.Encryption)
+		if err != nil {
+			return resp, kv, errors.WithMessage(err, "services.setupEncryption failed")
+		}
+		defer func() {
+			if err != nil {
+				_ = removeEncryption(info.Opt.Name)
+			}
+		}()
+	}
+
 	// create volume
 	resp, err = docker.Cli.VolumeCreate(ctx, *info.Opt)
 	if err != nil {
+		// docker may have created the volume after the request timed out
+		if ctx.Err() != nil {
+			cleanupCtx, cancel := cleanupContext(ctx)
+			_ = docker.Cli.VolumeRemove(cleanupCtx, info.Opt.Name, true)
+			cancel()
+		}
 		return resp, kv, errors.Wrapf(err, "docker.VolumeCreate failed, opt: %+v", info)
 	}
 
 	// creation info is added to etcd asynchronously
 	val := &models.EtcdVolumeInfo{
-		Opt:        info.Opt,
-		Version:    version,
-		CreateTime: info.CreateTime,
+		Opt:          info.Opt,
+		Version:      version,
+		CreateTime:   info.CreateTime,
+		Migration:    info.Migration,
+		Encryption:   info.Encryption,
+		OptionsPatch: info.OptionsPatch,
 	}
 	kv = etcd.PutKeyValue{
 		Resource: etcd.Volumes,
@@ -94,61 +134,151 @@ func (vs *VolumeService) createVolume(ctx context.Context, name string, info mod
 	return
 }
 
+// PatchVolumeSize patches the size option of the latest version, see PatchVolumeOptions
 func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (resp volume.Volume, err error) {
+	return vs.PatchVolumeOptions(name, &models.VolumeOptionsPatch{
+		DriverOpts: map[string]string{"size": spec.Size},
+	})
+}
+
+// PatchVolumeOptions merges the driver option changes into the latest version of the volume,
+// an empty value removes the option, then a new version is created with the merged options and the data is copied.
+// The changes are recorded in the info of the new version, so they are listed in the history.
+func (vs *VolumeService) PatchVolumeOptions(name string, spec *models.VolumeOptionsPatch) (resp volume.Volume, err error) {
+	var changes map[string]models.VolumeOptionChange
+	defer func() {
+		if err == nil {
+			notify.Emit(models.EventVolumePatched, name, map[string]interface{}{
+				"volumeName": resp.Name,
+				"size":       resp.Options["size"],
+				"changes":    changes,
+			})
+		}
+	}()
 	// get the latest version number
 	version, ok := vmap.VolumeVersionMap.Get(name)
 	if !ok {
-		return resp, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return resp, errors.Errorf("volume: %s version: %d not found in VolumeVersionMap", name, version)
 	}
 	volVersionName := fmt.Sprintf("%s-%d", name, version)
+	if pending(volVersionName) {
+		return resp, errors.Wrapf(xerrors.NewVolumePendingError(), "volume: %s", volVersionName)
+	}
 
-	ctx := context.Background()
+	ctx, cancel := dockerContext()
+	defer cancel()
 	infoBytes, err := etcd.GetValue(etcd.Volumes, name)
 	if err != nil {
-		return resp, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return resp, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Volumes, name))
 	}
 	var info models.EtcdVolumeInfo
 	if err = json.Unmarshal(infoBytes, &info); err != nil {
 		return resp, errors.WithMessage(err, "json.Unmarshal failed")
 	}
 
-	preSize := info.Opt.DriverOpts["size"]
-	preSizeBytes, _ := utils.ToBytes(preSize)
-	patchSize := spec.Size
-	patchSizeBytes, _ := utils.ToBytes(patchSize)
+	if info.Encryption != nil {
+		return resp, errors.Errorf("volume: %s is encrypted, patching driver options is not supported", volVersionName)
+	}
 
-	if patchSize == preSize {
+	preOpts := info.Opt.DriverOpts
+	opts, changes := mergeDriverOpts(preOpts, spec.DriverOpts)
+	// the same size in another unit, e.g. 1TB and 1024GB, doesn't need a new version
+	if change, ok := changes["size"]; ok && len(change.Old) != 0 && len(change.New) != 0 {
+		preSizeBytes, preErr := utils.ToBytes(change.Old)
+		patchSizeBytes, patchErr := utils.ToBytes(change.New)
+		if preErr == nil && patchErr == nil && preSizeBytes == patchSizeBytes {
+			opts["size"] = change.Old
+			delete(changes, "size")
+		}
+	}
+	if len(changes) == 0 {
 		return resp, errors.Wrapf(xerrors.NewNoPatchRequiredError(), "volume: %s", volVersionName)
 	}
+	if err = validateDriverOpts(info.Opt.Driver, opts); err != nil {
+		return resp, errors.WithMessagef(err, "volume: %s", volVersionName)
+	}
 
-	// check whether the size after shrink is larger than used size
-	if patchSizeBytes < preSizeBytes {
-		mountpoint, err := utils.GetVolumeMountPoint(volVersionName)
+	// a plain local volume is a directory on the host, its data is copied directly,
+	// otherwise the new options change how the volume is mounted, so it's copied via a helper container
+	hostCopy := info.Opt.Driver == "local" && len(preOpts["type"]) == 0 && len(opts["type"]) == 0
+	if !hostCopy {
+		// running containers may write to the volume during the copy
+		running, err := vs.volumeUsedBy(ctx, volVersionName, true)
 		if err != nil {
-			return resp, errors.WithMessage(err, "services.volumeMountpoint failed")
+			return resp, errors.WithMessage(err, "services.volumeUsedBy failed")
+		}
+		if len(running) > 0 {
+			return resp, errors.Wrapf(xerrors.NewVolumeInUseError(), "volume: %s, running containers: %v", volVersionName, running)
 		}
-		usedSize, err := utils.DirSize(mountpoint)
+		// the helper container copies the data, its image is pulled before the new volume is created
+		if err = ensureImage(ctx, cfg.HelperImage, false); err != nil {
+			return resp, errors.WithMessage(err, "services.ensureImage failed")
+		}
+	}
+
+	// check whether the size after shrink is larger than used size, the data would be truncated by the copy,
+	// an old size that can't be parsed is treated as unlimited
+	if change, ok := changes["size"]; ok && hostCopy && len(change.New) != 0 {
+		patchSizeBytes, err := utils.ToBytes(change.New)
 		if err != nil {
-			return resp, errors.Wrapf(err, "utils.DirSize failed, volume: %s, mountpoint: %s", volVersionName, mountpoint)
+			return resp, errors.Wrapf(xerrors.NewVolumeOptionsInvalidError(), "size: %s, error: %v", change.New, err)
 		}
+		preSizeBytes, err := utils.ToBytes(change.Old)
+		if err != nil || patchSizeBytes < preSizeBytes {
+			mountpoint, err := utils.GetVolumeMountPoint(volVersionName)
+			if err != nil {
+				return resp, errors.WithMessage(err, "services.volumeMountpoint failed")
+			}
+			usedSize, err := utils.DirSize(mountpoint)
+			if err != nil {
+				return resp, errors.Wrapf(err, "utils.DirSize failed, volume: %s, mountpoint: %s", volVersionName, mountpoint)
+			}
 
-		if usedSize > patchSizeBytes {
-			return resp, errors.Wrapf(xerrors.NewVolumeSizeUsedGreaterThanReduced(),
-				"volume: %s, usedSize: %d, patchSize: %d", volVersionName, usedSize, patchSizeBytes)
+			if usedSize > patchSizeBytes {
+				return resp, errors.Wrapf(xerrors.NewVolumeSizeUsedGreaterThanReduced(),
+					"volume: %s, usedSize: %d, patchSize: %d", volVersionName, usedSize, patchSizeBytes)
+			}
 		}
 	}
 
-	info.Opt.DriverOpts["size"] = patchSize
+	info.Opt.DriverOpts = opts
+	info.Migration = nil
+	info.OptionsPatch = &models.VolumeOptionsRecord{
+		From:    volVersionName,
+		Changes: changes,
+	}
 
-	// create a new volume to replace the old one
+	// create a new volume to replace the old one, it's pending until the data is copied,
+	// then it's promoted by recording it in etcd and the old volume is deleted
 	resp, kv, err := vs.createVolume(ctx, name, info)
 	if err != nil {
 		return resp, errors.WithMessage(err, "services.createVolume failed")
 	}
 
-	err = utils.CopyOldMountPointToContainerMountPoint(resp.Name, resp.Name)
+	// copy the old volume's data to the new volume,
+	// if it failed, the new volume is removed and the old volume is still the latest version,
+	// unless the copy is retried in the background, then the new volume is pending until the retries end
+	retried := vs.promoteRetried(name, volVersionName, resp.Name, kv, true)
+	if hostCopy {
+		err = copyWithRetry(context.WithoutCancel(ctx), etcd.Volumes, volVersionName, resp.Name, func(progress *utils.CopyProgress) (utils.CopyStats, error) {
+			return utils.CopyOldMountPointToContainerMountPoint(volVersionName, resp.Name, progress)
+		}, retried)
+	} else {
+		// the copy takes longer than the timeout of the docker calls
+		err = copyWithRetry(context.WithoutCancel(ctx), etcd.Volumes, volVersionName, resp.Name, func(*utils.CopyProgress) (utils.CopyStats, error) {
+			return utils.CopyStats{}, vs.copyVolumeByContainer(context.WithoutCancel(ctx), volVersionName, resp.Name)
+		}, retried)
+	}
+	if xerrors.IsCopyRetryingError(err) {
+		return resp, errors.WithMessage(err, "copy volume data failed")
+	}
 	if err != nil {
-		return resp, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		cleanupCtx, cancel := cleanupContext(ctx)
+		removeNewVolume(cleanupCtx, name, resp.Name, forceRemoveVolume)
+		cancel()
+		log.Errorf("services.PatchVolumeOptions, copy data to volume: %s failed, it's removed, the latest version is still: %s",
+			resp.Name, volVersionName)
+		return resp, errors.WithMessage(err, "copy volume data failed")
 	}
 
 	// delete the old volume
@@ -157,17 +287,69 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 		return resp, errors.WithMessage(err, "services.DeleteVolume failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
+	workQueue.Enqueue(etcd.PutKeyValue{
 		Resource: etcd.Volumes,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+	})
 
-	log.Infof("services.PatchVolumeSize, volume size patched successfully, old name: %s, old size: %s, new name: %s, new size: %s",
-		name, preSize, resp.Name, patchSize)
+	log.Infof("services.PatchVolumeOptions, volume driver options patched successfully, old name: %s, new name: %s, changes: %+v",
+		volVersionName, resp.Name, changes)
 	return
 }
 
+// mergeDriverOpts applies the patch to the options, an empty value removes the option,
+// and returns the merged options and the options actually changed.
+func mergeDriverOpts(opts, patch map[string]string) (map[string]string, map[string]models.VolumeOptionChange) {
+	merged := make(map[string]string, len(opts)+len(patch))
+	for k, v := range opts {
+		merged[k] = v
+	}
+	changes := make(map[string]models.VolumeOptionChange)
+	for k, v := range patch {
+		old := merged[k]
+		if old == v {
+			continue
+		}
+		if len(v) == 0 {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+		changes[k] = models.VolumeOptionChange{Old: old, New: v}
+	}
+	if len(merged) == 0 {
+		merged = nil
+	}
+	return merged, changes
+}
+
+// validateDriverOpts validates the options of the local driver before the volume is created,
+// the options of other drivers are validated by the driver itself when creating.
+func validateDriverOpts(driver string, opts map[string]string) error {
+	if driver != "local" {
+		return nil
+	}
+	for k := range opts {
+		if _, ok := localDriverOpts[k]; !ok {
+			return errors.Wrapf(xerrors.NewVolumeOptionsInvalidError(), "option: %s is not supported by the local driver", k)
+		}
+	}
+	if size, ok := opts["size"]; ok {
+		if bytes, err := utils.ToBytes(size); err != nil || bytes <= 0 {
+			return errors.Wrapf(xerrors.NewVolumeOptionsInvalidError(), "size: %s is invalid", size)
+		}
+	}
+	// the device is mounted with the type and the mount options, e.g. type=nfs, o=addr=10.0.0.1,rw, device=:/data
+	if (len(opts["o"]) != 0 || len(opts["device"]) != 0) && len(opts["type"]) == 0 {
+		return errors.Wrap(xerrors.NewVolumeOptionsInvalidError(), "type is required with o or device")
+	}
+	if len(opts["type"]) != 0 && len(opts["device"]) == 0 {
+		return errors.Wrapf(xerrors.NewVolumeOptionsInvalidError(), "device is required with type: %s", opts["type"])
+	}
+	return nil
+}
+
 // DeleteVolume deletes a specific version of volume or the latest version of volume.
 // If deleteRecord is true, etcd info about this volume and VolumeVersionMap record are deleted.
 func (vs *VolumeService) DeleteVolume(name string, isLatest, deleteRecord bool) error {
@@ -179,24 +361,144 @@ func (vs *VolumeService) DeleteVolume(name string, isLatest, deleteRecord bool)
 		}
 		name = fmt.Sprintf("%s-%d", name, version)
 	}
+	// the info of all versions is kept under the name without the version
+	base := name
+	if b, _, ok := splitVersionName(name); ok {
+		base = b
+	}
 	if deleteRecord {
 		log.Infof("services.DeleteVolume, volume: %s will be del etcd info and version record", name)
-		vmap.VolumeVersionMap.Remove(strings.Split(name, "-")[0])
-		workQueue.Queue <- etcd.DelKey{
+		vmap.VolumeVersionMap.Remove(base)
+		workQueue.Enqueue(etcd.DelKey{
 			Resource: etcd.Volumes,
-			Key:      name,
-		}
+			Key:      base,
+		})
 	}
 
-	err := docker.Cli.VolumeRemove(context.TODO(), name, true)
+	ctx, cancel := dockerContext()
+	defer cancel()
+	err := docker.Cli.VolumeRemove(ctx, name, true)
 	if err != nil {
 		return errors.WithMessage(err, "docker.VolumeRemove failed")
 	}
+	// the encrypted data is removed along with the volume
+	if err = removeEncryption(name); err != nil {
+		return errors.WithMessage(err, "services.removeEncryption failed")
+	}
 
 	log.Infof("services.DeleteVolume, volume deleted successfully, name: %s", name)
+	if deleteRecord {
+		notify.Emit(models.EventVolumeDeleted, base, map[string]interface{}{
+			"volumeName": name,
+		})
+	}
 	return nil
 }
 
+// DeleteAllVersions deletes every version of the volume, e.g. foo-1, foo-2, then the version record,
+// the etcd info and the retention policy are cleaned up. The versions mounted by containers are kept and reported,
+// docker doesn't remove a volume mounted by any container. With force, the containers mounting a version are removed
+// first, the running ones are stopped and their gpus and ports are released, even if they are the latest versions.
+func (vs *VolumeService) DeleteAllVersions(name string, force bool) (*models.VolumeDeleteReport, error) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+	volumes, err := listVolumeVersions(ctx, name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.listVolumeVersions failed")
+	}
+
+	report := &models.VolumeDeleteReport{
+		Removed: make([]string, 0),
+		InUse:   make(map[string][]string),
+		Failed:  make([]string, 0),
+	}
+	for _, vol := range volumes {
+		if base, _, ok := splitVersionName(vol.Name); !ok || base != name {
+			continue
+		}
+		if pending(vol.Name) {
+			log.Errorf("services.DeleteAllVersions, volume: %s is pending, the data is being copied to it", vol.Name)
+			report.Failed = append(report.Failed, vol.Name)
+			continue
+		}
+		containers, err := vs.volumeUsedBy(ctx, vol.Name, false)
+		if err != nil {
+			log.Errorf("services.DeleteAllVersions, volume: %s list the containers failed, error: %v", vol.Name, err)
+			report.Failed = append(report.Failed, vol.Name)
+			continue
+		}
+		if len(containers) != 0 && force {
+			containers = vs.removeMountingContainers(ctx, vol.Name, containers)
+		}
+		if len(containers) != 0 {
+			report.InUse[vol.Name] = containers
+			continue
+		}
+
+		if err = vs.DeleteVolume(vol.Name, false, false); err != nil {
+			log.Errorf("services.DeleteAllVersions, volume: %s delete failed, error: %v", vol.Name, err)
+			report.Failed = append(report.Failed, vol.Name)
+			continue
+		}
+		report.Removed = append(report.Removed, vol.Name)
+	}
+	if len(report.InUse) != 0 || len(report.Failed) != 0 {
+		log.Infof("services.DeleteAllVersions, volume: %s is partly deleted, report: %+v", name, *report)
+		return report, nil
+	}
+
+	vmap.VolumeVersionMap.Remove(name)
+	workQueue.Enqueue(etcd.DelKey{
+		Resource: etcd.Volumes,
+		Key:      name,
+	})
+	workQueue.Enqueue(etcd.DelKey{
+		Resource: etcd.Retentions,
+		Key:      name,
+	})
+	notify.Emit(models.EventVolumeDeleted, name, map[string]interface{}{
+		"volumeNames": report.Removed,
+	})
+
+	log.Infof("services.DeleteAllVersions, volume: %s all versions deleted, report: %+v", name, *report)
+	return report, nil
+}
+
+// stopMountingContainer stops the running container mounting a volume to delete and releases its gpus and ports
+var stopMountingContainer = func(ctrVersionName string) error {
+	var rs ReplicaSetService
+	return rs.StopContainer(ctrVersionName, true, true, false)
+}
+
+// removeMountingContainers removes the containers mounting the volume version, the running ones are stopped first,
+// and returns the containers that are still mounting it
+func (vs *VolumeService) removeMountingContainers(ctx context.Context, volVersionName string, containers []string) []string {
+	running, err := vs.volumeUsedBy(ctx, volVersionName, true)
+	if err != nil {
+		log.Errorf("services.removeMountingContainers, volume: %s list the running containers failed, error: %v", volVersionName, err)
+		return containers
+	}
+
+	kept := make([]string, 0)
+	for _, ctrVersionName := range containers {
+		if slices.Contains(running, ctrVersionName) {
+			if err = stopMountingContainer(ctrVersionName); err != nil {
+				log.Errorf("services.removeMountingContainers, container: %s stop failed, error: %v", ctrVersionName, err)
+				kept = append(kept, ctrVersionName)
+				continue
+			}
+		}
+		endVolumeUsage(ctx, ctrVersionName)
+		if err = docker.Cli.ContainerRemove(ctx, ctrVersionName, types.ContainerRemoveOptions{}); err != nil {
+			log.Errorf("services.removeMountingContainers, container: %s remove failed, error: %v", ctrVersionName, err)
+			kept = append(kept, ctrVersionName)
+			continue
+		}
+		log.Infof("services.removeMountingContainers, container: %s mounting volume: %s is removed", ctrVersionName, volVersionName)
+	}
+	return kept
+}
+
 func (vs *VolumeService) GetVolumeInfo(name string) (info models.EtcdVolumeInfo, err error) {
 	infoBytes, err := etcd.GetValue(etcd.Volumes, name)
 	if err != nil {
@@ -209,6 +511,148 @@ func (vs *VolumeService) GetVolumeInfo(name string) (info models.EtcdVolumeInfo,
 	return
 }
 
+// GetVolumeUsage measures the space used by the latest version of the volume by walking its directory on the host
+func (vs *VolumeService) GetVolumeUsage(name string) (*models.VolumeSpace, error) {
+	version, ok := vmap.VolumeVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("volume: %s version: %d not found in VolumeVersionMap", name, version)
+	}
+	volVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+	resp, err := docker.Cli.VolumeInspect(ctx, volVersionName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.VolumeInspect failed, name: %s", volVersionName)
+	}
+	space := &models.VolumeSpace{
+		VolumeName: volVersionName,
+		Driver:     resp.Driver,
+		Size:       resp.Options["size"],
+		UsedBytes:  -1,
+	}
+	if len(space.Size) != 0 {
+		if space.SizeBytes, err = utils.ToBytes(space.Size); err != nil {
+			return nil, errors.WithMessagef(err, "utils.ToBytes failed, volume: %s, size: %s", volVersionName, space.Size)
+		}
+	}
+
+	var dir string
+	dir, space.Reason = volumeDataDir(resp)
+	if len(dir) != 0 {
+		if space.UsedBytes, err = utils.DirSize(dir); err != nil {
+			return nil, errors.Wrapf(err, "utils.DirSize failed, volume: %s, dir: %s", volVersionName, dir)
+		}
+	}
+	return space, nil
+}
+
+// volumeDataDir returns the directory of the data of the volume on the host, or why the data is not on the host,
+// the directory of a plain local volume is its mountpoint, a local volume bound to a host path uses the device.
+func volumeDataDir(resp volume.Volume) (dir, reason string) {
+	switch {
+	case resp.Driver != "local":
+		return "", fmt.Sprintf("the data of driver: %s is not on the host", resp.Driver)
+	case len(resp.Options["type"]) == 0:
+		return resp.Mountpoint, ""
+	case resp.Options["type"] == "none" && strings.Contains(resp.Options["o"], "bind"):
+		return resp.Options["device"], ""
+	default:
+		return "", fmt.Sprintf("the data of type: %s is not on the host", resp.Options["type"])
+	}
+}
+
+// GetVolumeStatus returns the status of the latest version of the volume, it's pending while the data of the old version
+// is copied to it, the clients must not mount it until it's ready
+func (vs *VolumeService) GetVolumeStatus(name string) (models.VolumeStatus, string, error) {
+	version, ok := vmap.VolumeVersionMap.Get(name)
+	if !ok {
+		return "", "", errors.Errorf("volume: %s version: %d not found in VolumeVersionMap", name, version)
+	}
+	volVersionName := fmt.Sprintf("%s-%d", name, version)
+	if pending(volVersionName) {
+		return models.VolumePending, volVersionName, nil
+	}
+	return models.VolumeReady, volVersionName, nil
+}
+
+// pending means the data is being copied to the volume version, it's not promoted to the latest version in etcd yet.
+// The copy is recorded in etcd before it starts, so a version left by a copy interrupted by a restart is still pending,
+// a volume whose record can't be read is treated as pending too.
+func pending(volVersionName string) bool {
+	record, err := getCopyProgress(etcd.Volumes, volVersionName)
+	if err != nil {
+		if xerrors.IsCopyNotFoundError(err) {
+			return false
+		}
+		log.Errorf("services.pending, get the copy to volume: %s failed, it's treated as pending, error: %v", volVersionName, err)
+		return true
+	}
+	return !record.Finished()
+}
+
+// checkPendingBinds rejects the binds of the pending volumes, the container would see the data partly copied
+func checkPendingBinds(binds []string) error {
+	for _, bind := range binds {
+		src := strings.SplitN(bind, ":", 2)[0]
+		if strings.HasPrefix(src, "/") {
+			continue
+		}
+		if pending(src) {
+			return errors.Wrapf(xerrors.NewVolumePendingError(), "volume: %s", src)
+		}
+	}
+	return nil
+}
+
+// removeNewVolume removes the new version of the volume whose data failed to be copied,
+// the old version is kept as the latest version.
+func removeNewVolume(ctx context.Context, name, newVolName string, remove func(context.Context, string) error) {
+	if err := remove(ctx, newVolName); err != nil {
+		log.Errorf("services.removeNewVolume, remove volume: %s failed, it's left on the host, error: %v", newVolName, err)
+	}
+	if _, newVersion, ok := splitVersionName(newVolName); ok {
+		vmap.VolumeVersionMap.Release(name, newVersion)
+	}
+}
+
+func forceRemoveVolume(ctx context.Context, name string) error {
+	return docker.Cli.VolumeRemove(ctx, name, true)
+}
+
+// promoteRetried promotes the new version of the volume whose data is copied by the retries in the background,
+// like a copy which succeeded at once, the old version is deleted if deleteOld is set.
+// If the retries failed too, the new volume is removed and the old version is still the latest version.
+func (vs *VolumeService) promoteRetried(name, oldVolName, newVolName string, kv etcd.PutKeyValue, deleteOld bool) retriedFunc {
+	return func(err error) {
+		if err != nil {
+			ctx, cancel := dockerContext()
+			removeNewVolume(ctx, name, newVolName, forceRemoveVolume)
+			cancel()
+			log.Errorf("services.promoteRetried, copy data to volume: %s failed after retries, it's removed, the latest version is still: %s",
+				newVolName, oldVolName)
+			return
+		}
+		if deleteOld {
+			if err = vs.DeleteVolume(oldVolName, false, false); err != nil {
+				log.Errorf("services.promoteRetried, delete the old volume: %s failed, error: %v", oldVolName, err)
+			}
+		}
+		workQueue.Enqueue(etcd.PutKeyValue{
+			Resource: etcd.Volumes,
+			Key:      kv.Key,
+			Value:    kv.Value,
+		})
+		log.Infof("services.promoteRetried, the data of volume: %s is copied by the retries, it replaces: %s", newVolName, oldVolName)
+	}
+}
+
+// GetCopyProgress returns the copy of the data to the volume version, e.g. foo-2,
+// a running copy reports the bytes copied so far.
+func (vs *VolumeService) GetCopyProgress(volVersionName string) (*models.CopyRecord, error) {
+	return getCopyProgress(etcd.Volumes, volVersionName)
+}
+
 func (vs *VolumeService) GetVolumeHistory(name string) ([]*models.VolumeHistoryItem, error) {
 	replicaSet, err := etcd.GetRevisionRange(etcd.Volumes, name)
 	if err != nil {
@@ -233,14 +677,318 @@ func (vs *VolumeService) GetVolumeHistory(name string) ([]*models.VolumeHistoryI
 	return resp, nil
 }
 
-func (vs *VolumeService) existVolume(name string) bool {
-	ctx := context.Background()
-	list, err := docker.Cli.VolumeList(ctx, volume.ListOptions{
-		Filters: filters.NewArgs(filters.KeyValuePair{Key: "name", Value: fmt.Sprintf("^%s-", name)}),
+// existVolume whether any version of the volume exists
+func (vs *VolumeService) existVolume(ctx context.Context, name string) (bool, error) {
+	volumes, err := listVolumeVersions(ctx, name)
+	if err != nil {
+		return false, errors.WithMessage(err, "services.listVolumeVersions failed")
+	}
+	return len(volumes) > 0, nil
+}
+
+// SetVolumeRetention saves the retention policy of the volume to etcd asynchronously
+func (vs *VolumeService) SetVolumeRetention(name string, spec *models.VolumeRetention) error {
+	if !vmap.VolumeVersionMap.Exist(name) {
+		return errors.Errorf("volume: %s not found in VolumeVersionMap", name)
+	}
+
+	bytes, _ := json.Marshal(spec)
+	value := string(bytes)
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Retentions,
+		Key:      name,
+		Value:    &value,
+	})
+	log.Infof("services.SetVolumeRetention, volume: %s retention policy: %+v", name, *spec)
+	return nil
+}
+
+func (vs *VolumeService) GetVolumeRetention(name string) (spec models.VolumeRetention, err error) {
+	bytes, err := etcd.GetValue(etcd.Retentions, name)
+	if err != nil {
+		return spec, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Retentions, name))
+	}
+	if err = json.Unmarshal(bytes, &spec); err != nil {
+		return spec, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+	return
+}
+
+// PruneVolumeVersions removes the old versions of the volume which exceed the retention policy.
+// If dryRun is true, nothing will be removed, only the report is returned.
+// Nothing is pruned while the latest version is pending, and a version being copied from is kept.
+func (vs *VolumeService) PruneVolumeVersions(name string, dryRun bool) (*models.VolumePruneReport, error) {
+	spec, err := vs.GetVolumeRetention(name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.GetVolumeRetention failed")
+	}
+	latest, ok := vmap.VolumeVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("volume: %s version: %d not found in VolumeVersionMap", name, latest)
+	}
+
+	// the data of the latest version is still copied from an older one
+	if latestName := fmt.Sprintf("%s-%d", name, latest); pending(latestName) {
+		return nil, errors.Wrapf(xerrors.NewVolumePendingError(), "volume: %s", latestName)
+	}
+	sources, err := copySources(etcd.Volumes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.copySources failed")
+	}
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+	volumes, err := listVolumeVersions(ctx, name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.listVolumeVersions failed")
+	}
+
+	// sort by version from new to old
+	type volVersion struct {
+		version int64
+		vol     *volume.Volume
+	}
+	versions := make([]volVersion, 0, len(volumes))
+	for _, vol := range volumes {
+		parts := strings.Split(vol.Name, "-")
+		if len(parts) != 2 || parts[0] != name {
+			continue
+		}
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, volVersion{version: version, vol: vol})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version > versions[j].version
 	})
-	if err != nil || len(list.Volumes) == 0 {
-		return false
+
+	report := &models.VolumePruneReport{
+		DryRun:  dryRun,
+		Removed: make([]string, 0),
+		InUse:   make([]string, 0),
+		Failed:  make([]string, 0),
+	}
+	for i, v := range versions {
+		if v.version == latest {
+			continue
+		}
+		if spec.KeepLast > 0 && i < spec.KeepLast {
+			continue
+		}
+		if spec.KeepDays > 0 {
+			createdAt, err := time.Parse(time.RFC3339, v.vol.CreatedAt)
+			if err == nil && time.Since(createdAt) < time.Duration(spec.KeepDays)*24*time.Hour {
+				continue
+			}
+		}
+		if spec.KeepLast == 0 && spec.KeepDays == 0 {
+			continue
+		}
+
+		if _, ok := sources[v.vol.Name]; ok {
+			log.Infof("services.PruneVolumeVersions, volume: %s is kept, the data is being copied from it", v.vol.Name)
+			report.InUse = append(report.InUse, v.vol.Name)
+			continue
+		}
+		inUse, err := vs.volumeInUse(ctx, v.vol.Name)
+		if err != nil || inUse {
+			report.InUse = append(report.InUse, v.vol.Name)
+			continue
+		}
+
+		size, _ := utils.DirSize(v.vol.Mountpoint)
+		if !dryRun {
+			if err = docker.Cli.VolumeRemove(ctx, v.vol.Name, false); err != nil {
+				log.Errorf("services.PruneVolumeVersions, volume: %s remove failed, error: %v", v.vol.Name, err)
+				report.Failed = append(report.Failed, v.vol.Name)
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, v.vol.Name)
+		report.ReclaimedBytes += size
 	}
 
-	return len(list.Volumes) > 0
+	log.Infof("services.PruneVolumeVersions, volume: %s prune successfully, report: %+v", name, *report)
+	return report, nil
+}
+
+// PruneAllVolumeVersions prunes all volumes that have a retention policy
+func (vs *VolumeService) PruneAllVolumeVersions() {
+	kvs, err := etcd.List(etcd.Retentions)
+	if err != nil {
+		log.Errorf("services.PruneAllVolumeVersions, etcd.List failed, error: %v", err)
+		return
+	}
+	for name := range kvs {
+		if _, err = vs.PruneVolumeVersions(name, false); xerrors.IsVolumePendingError(err) {
+			log.Infof("services.PruneAllVolumeVersions, volume: %s is skipped, error: %v", name, err)
+		} else if err != nil {
+			log.Errorf("services.PruneAllVolumeVersions, volume: %s prune failed, error: %v", name, err)
+		}
+	}
+}
+
+// VolumeRetentionLoop prunes the volume versions according to the retention policy periodically
+func VolumeRetentionLoop(ctx context.Context, interval time.Duration) {
+	var vs VolumeService
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			vs.PruneAllVolumeVersions()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// volumeInUse checks whether the volume is used by any container, including the stopped containers
+func (vs *VolumeService) volumeInUse(ctx context.Context, name string) (bool, error) {
+	names, err := vs.volumeUsedBy(ctx, name, false)
+	return len(names) > 0, err
+}
+
+// volumeUsedBy returns the names of containers that use the volume
+func (vs *VolumeService) volumeUsedBy(ctx context.Context, name string, onlyRunning bool) ([]string, error) {
+	args := filters.NewArgs(filters.KeyValuePair{Key: "volume", Value: name})
+	if onlyRunning {
+		args.Add("status", "running")
+	}
+	list, err := docker.Cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     !onlyRunning,
+		Filters: args,
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "docker.ContainerList failed")
+	}
+
+	names := make([]string, 0, len(list))
+	for _, ctr := range list {
+		if len(ctr.Names) > 0 {
+			names = append(names, strings.TrimPrefix(ctr.Names[0], "/"))
+		}
+	}
+	return names, nil
+}
+
+// MigrateVolume creates a new version of the volume on another storage driver and copies the data to it.
+// The data is copied by a short-lived helper container, because the mountpoint of some drivers (e.g. nfs)
+// is not accessible from the host. The old version is kept and can be pruned by the retention policy.
+// Containers using the volume must be stopped first, then patch them to use the new version.
+// The copy runs in the background, the new version is pending until it's copied, see GetCopyProgress,
+// then it's promoted to the latest version, or it's removed if the copy failed.
+func (vs *VolumeService) MigrateVolume(name string, spec *models.VolumeMigrate) (resp volume.Volume, err error) {
+	// get the latest version number
+	version, ok := vmap.VolumeVersionMap.Get(name)
+	if !ok {
+		return resp, errors.Errorf("volume: %s version: %d not found in VolumeVersionMap", name, version)
+	}
+	volVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+	infoBytes, err := etcd.GetValue(etcd.Volumes, name)
+	if err != nil {
+		return resp, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Volumes, name))
+	}
+	var info models.EtcdVolumeInfo
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return resp, errors.WithMessage(err, "json.Unmarshal failed")
+	}
+
+	if info.Encryption != nil {
+		return resp, errors.Errorf("volume: %s is encrypted, migrating is not supported", volVersionName)
+	}
+	if pending(volVersionName) {
+		return resp, errors.Wrapf(xerrors.NewVolumePendingError(), "volume: %s", volVersionName)
+	}
+
+	if info.Opt.Driver == spec.Driver && utils.EqualStringMap(info.Opt.DriverOpts, spec.DriverOpts) {
+		return resp, errors.Wrapf(xerrors.NewNoPatchRequiredError(), "volume: %s", volVersionName)
+	}
+
+	// running containers may write to the volume during the copy
+	running, err := vs.volumeUsedBy(ctx, volVersionName, true)
+	if err != nil {
+		return resp, errors.WithMessage(err, "services.volumeUsedBy failed")
+	}
+	if len(running) > 0 {
+		return resp, errors.Wrapf(xerrors.NewVolumeInUseError(), "volume: %s, running containers: %v", volVersionName, running)
+	}
+
+	info.Migration = &models.VolumeMigration{
+		From:       volVersionName,
+		FromDriver: info.Opt.Driver,
+		ToDriver:   spec.Driver,
+	}
+	info.Opt.Driver = spec.Driver
+	info.Opt.DriverOpts = spec.DriverOpts
+
+	// the helper container copies the data, its image is pulled before the new volume is created
+	if err = ensureImage(ctx, cfg.HelperImage, false); err != nil {
+		return resp, errors.WithMessage(err, "services.ensureImage failed")
+	}
+
+	// create a new volume on the target driver
+	resp, kv, err := vs.createVolume(ctx, name, info)
+	if err != nil {
+		return resp, errors.WithMessage(err, "services.createVolume failed")
+	}
+
+	// the copy takes longer than a request, the new volume is promoted or removed when it ends
+	promote := vs.promoteRetried(name, volVersionName, resp.Name, kv, false)
+	newVolName, fromDriver := resp.Name, info.Migration.FromDriver
+	copyInBackground(etcd.Volumes, volVersionName, newVolName, func(*utils.CopyProgress) (utils.CopyStats, error) {
+		return utils.CopyStats{}, vs.copyVolumeByContainer(context.Background(), volVersionName, newVolName)
+	}, func(err error) {
+		promote(err)
+		if err != nil {
+			return
+		}
+		notify.Emit(models.EventVolumePatched, name, map[string]interface{}{
+			"volumeName": newVolName,
+			"driver":     spec.Driver,
+		})
+		log.Infof("services.MigrateVolume, volume migrated successfully, old name: %s, old driver: %s, new name: %s, new driver: %s",
+			volVersionName, fromDriver, newVolName, spec.Driver)
+	})
+
+	log.Infof("services.MigrateVolume, volume: %s is migrating to: %s on driver: %s", volVersionName, newVolName, spec.Driver)
+	return resp, nil
+}
+
+// copyVolumeByContainer copies all data from src volume to dest volume via a helper container
+func (vs *VolumeService) copyVolumeByContainer(ctx context.Context, src, dest string) error {
+	resp, err := docker.Cli.ContainerCreate(ctx,
+		&container.Config{
+			Image: cfg.HelperImage,
+			Cmd:   []string{"sh", "-c", "cp -a /from/. /to/"},
+		},
+		&container.HostConfig{
+			Binds: []string{fmt.Sprintf("%s:/from:ro", src), fmt.Sprintf("%s:/to", dest)},
+		}, nil, nil, "")
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerCreate failed, image: %s", cfg.HelperImage)
+	}
+	defer func() {
+		_ = docker.Cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	}()
+
+	statusCh, errCh := docker.Cli.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	if err = docker.Cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return errors.Wrapf(err, "docker.ContainerStart failed, id: %s", resp.ID)
+	}
+
+	select {
+	case status := <-statusCh:
+		if status.StatusCode != 0 {
+			return errors.Errorf("copy from %s to %s failed, exit code: %d", src, dest, status.StatusCode)
+		}
+	case err = <-errCh:
+		return errors.Wrapf(err, "docker.ContainerWait failed, id: %s", resp.ID)
+	}
+	return nil
 }
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// TestRemoveNewVolume follows a patch whose copy failed, the old version is still the latest version,
+// even if the new volume can't be removed
+func TestRemoveNewVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		removeErr error
+	}{
+		{name: "removed"},
+		{name: "remove failed", removeErr: errors.New("volume is in use")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmap.VolumeVersionMap = vmap.NewVersionMap()
+			vmap.VolumeVersionMap.Set("foo", 1)
+			newVersion := vmap.VolumeVersionMap.Next("foo")
+			if newVersion != 2 {
+				t.Fatalf("Next(foo) = %d, want 2", newVersion)
+			}
+
+			var removed string
+			removeNewVolume(context.Background(), "foo", "foo-2", func(_ context.Context, name string) error {
+				removed = name
+				return tt.removeErr
+			})
+			if removed != "foo-2" {
+				t.Errorf("removed volume = %q, want foo-2", removed)
+			}
+			if got, _ := vmap.VolumeVersionMap.Get("foo"); got != 1 {
+				t.Errorf("latest version = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestCheckPendingBinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  models.CopyStatus
+		binds   []string
+		wantErr bool
+	}{
+		{name: "host path", status: models.CopyRunning, binds: []string{"/bar-2:/data"}},
+		{name: "running copy", status: models.CopyRunning, binds: []string{"bar-2:/data:ro"}, wantErr: true},
+		{name: "queued copy", status: models.CopyQueued, binds: []string{"bar-2:/data"}, wantErr: true},
+		{name: "finished copy", status: models.CopySucceeded, binds: []string{"bar-2:/data"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runningCopies.Store("bar-2", &runningCopy{
+				record:   &models.CopyRecord{Resource: etcd.Volumes, Dest: "bar-2", Status: tt.status},
+				progress: new(utils.CopyProgress),
+			})
+			defer runningCopies.Delete("bar-2")
+
+			err := checkPendingBinds(tt.binds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkPendingBinds(%v) error = %v, wantErr %v", tt.binds, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// mount is a container mounting a volume version
+type mount struct {
+	volume  string
+	running bool
+}
+
+// newFakeVolumeAPI serves the managed versions of the volume foo and the containers mounting them,
+// docker refuses to remove a volume mounted by any container
+func newFakeVolumeAPI(t *testing.T, volumes []string, mounts map[string]*mount) {
+	t.Helper()
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "volumes":
+			list := volume.ListResponse{}
+			for _, name := range volumes {
+				list.Volumes = append(list.Volumes, &volume.Volume{
+					Name:   name,
+					Labels: map[string]string{managedLabel: "true", baseNameLabel: "foo"},
+				})
+			}
+			_ = json.NewEncoder(w).Encode(list)
+			return
+		case r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "containers" && parts[2] == "json":
+			args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+			if err != nil {
+				t.Errorf("filters.FromJSON() error = %v", err)
+			}
+			list := make([]types.Container, 0)
+			for name, m := range mounts {
+				if args.ExactMatch("volume", m.volume) && (!args.Contains("status") || m.running) {
+					list = append(list, types.Container{Names: []string{"/" + name}})
+				}
+			}
+			_ = json.NewEncoder(w).Encode(list)
+			return
+		case r.Method == http.MethodGet && len(parts) == 4 && parts[1] == "containers":
+			if _, ok := mounts[parts[2]]; ok {
+				_ = json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+					Name:       "/" + parts[2],
+					HostConfig: &container.HostConfig{},
+				}})
+				return
+			}
+		case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "containers":
+			if m, ok := mounts[parts[2]]; ok && !m.running {
+				delete(mounts, parts[2])
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "volumes":
+			for _, m := range mounts {
+				if m.volume == parts[2] {
+					w.WriteHeader(http.StatusConflict)
+					_ = json.NewEncoder(w).Encode(map[string]string{"message": "volume is in use"})
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": "not found: " + r.URL.Path})
+	}))
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := docker.Cli
+	docker.Cli = cli
+	t.Cleanup(func() {
+		docker.Cli = old
+		_ = cli.Close()
+		server.Close()
+	})
+}
+
+// TestDeleteAllVersions deletes the versions foo-1 and foo-2, the ones mounted by containers are kept unless forced
+func TestDeleteAllVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		mounts      map[string]*mount
+		force       bool
+		stopErr     error
+		wantRemoved []string
+		wantInUse   map[string][]string
+		wantStopped []string
+	}{
+		{
+			name:        "not mounted",
+			wantRemoved: []string{"foo-1", "foo-2"},
+			wantInUse:   map[string][]string{},
+		},
+		{
+			name:        "mounted by a running container",
+			mounts:      map[string]*mount{"bar-1": {volume: "foo-1", running: true}},
+			wantRemoved: []string{"foo-2"},
+			wantInUse:   map[string][]string{"foo-1": {"bar-1"}},
+		},
+		{
+			name:        "mounted by a stopped container",
+			mounts:      map[string]*mount{"bar-1": {volume: "foo-2"}},
+			wantRemoved: []string{"foo-1"},
+			wantInUse:   map[string][]string{"foo-2": {"bar-1"}},
+		},
+		{
+			name: "forced",
+			mounts: map[string]*mount{
+				"bar-1": {volume: "foo-1", running: true},
+				"bar-2": {volume: "foo-2"},
+			},
+			force:       true,
+			wantRemoved: []string{"foo-1", "foo-2"},
+			wantInUse:   map[string][]string{},
+			wantStopped: []string{"bar-1"},
+		},
+		{
+			name:        "forced but the stop failed",
+			mounts:      map[string]*mount{"bar-1": {volume: "foo-1", running: true}},
+			force:       true,
+			stopErr:     errors.New("stop timeout"),
+			wantRemoved: []string{"foo-2"},
+			wantInUse:   map[string][]string{"foo-1": {"bar-1"}},
+		},
+	}
+	workQueue.InitWorkQueue(8)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mounts == nil {
+				tt.mounts = make(map[string]*mount)
+			}
+			newFakeVolumeAPI(t, []string{"foo-1", "foo-2"}, tt.mounts)
+			vmap.VolumeVersionMap = vmap.NewVersionMap()
+			vmap.VolumeVersionMap.Set("foo", 2)
+			// the copies to the versions are finished, so they are not pending
+			for _, name := range []string{"foo-1", "foo-2"} {
+				runningCopies.Store(name, &runningCopy{
+					record:   &models.CopyRecord{Resource: etcd.Volumes, Dest: name, Status: models.CopySucceeded},
+					progress: new(utils.CopyProgress),
+				})
+				defer runningCopies.Delete(name)
+			}
+
+			stopped := make([]string, 0)
+			defer func(stop func(string) error) { stopMountingContainer = stop }(stopMountingContainer)
+			stopMountingContainer = func(ctrVersionName string) error {
+				if tt.stopErr != nil {
+					return tt.stopErr
+				}
+				stopped = append(stopped, ctrVersionName)
+				tt.mounts[ctrVersionName].running = false
+				return nil
+			}
+
+			report, err := new(VolumeService).DeleteAllVersions("foo", tt.force)
+			if err != nil {
+				t.Fatalf("DeleteAllVersions() error = %v", err)
+			}
+			sort.Strings(report.Removed)
+			if !reflect.DeepEqual(report.Removed, tt.wantRemoved) {
+				t.Errorf("DeleteAllVersions() removed = %v, want %v", report.Removed, tt.wantRemoved)
+			}
+			if !reflect.DeepEqual(report.InUse, tt.wantInUse) {
+				t.Errorf("DeleteAllVersions() in use = %v, want %v", report.InUse, tt.wantInUse)
+			}
+			if len(report.Failed) != 0 {
+				t.Errorf("DeleteAllVersions() failed = %v", report.Failed)
+			}
+			if len(tt.wantStopped) != 0 && !reflect.DeepEqual(stopped, tt.wantStopped) {
+				t.Errorf("DeleteAllVersions() stopped = %v, want %v", stopped, tt.wantStopped)
+			}
+			// the version record is kept until every version is deleted
+			if _, ok := vmap.VolumeVersionMap.Get("foo"); ok != (len(tt.wantInUse) != 0) {
+				t.Errorf("DeleteAllVersions() version record kept = %v, want %v", ok, len(tt.wantInUse) != 0)
+			}
+		})
+	}
+}
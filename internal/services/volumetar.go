@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/volume"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// ExportVolume streams the data of the latest version of the volume as a tar archive, the archive is written
+// while it's read, so a large volume is never buffered. The containers using the volume may change it meanwhile,
+// stop them for a consistent snapshot. Closing the reader stops the export.
+func (vs *VolumeService) ExportVolume(name string) (io.ReadCloser, error) {
+	version, ok := vmap.VolumeVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("volume: %s version: %d not found in VolumeVersionMap", name, version)
+	}
+	volVersionName := fmt.Sprintf("%s-%d", name, version)
+	if pending(volVersionName) {
+		return nil, errors.Wrapf(xerrors.NewVolumePendingError(), "volume: %s", volVersionName)
+	}
+
+	ctx, cancel := dockerContext()
+	defer cancel()
+	resp, err := docker.Cli.VolumeInspect(ctx, volVersionName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.VolumeInspect failed, name: %s", volVersionName)
+	}
+	dir, reason := volumeDataDir(resp)
+	if len(dir) == 0 {
+		return nil, errors.Wrapf(xerrors.NewVolumeDataNotOnHostError(), "volume: %s, %s", volVersionName, reason)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := utils.TarTree(context.Background(), dir, pw)
+		if err != nil {
+			log.Errorf("services.ExportVolume, export volume: %s failed, error: %v", volVersionName, err)
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	log.Infof("services.ExportVolume, volume: %s is being exported, dir: %s", volVersionName, dir)
+	return pr, nil
+}
+
+// ImportVolume creates a new volume like CreateVolume and extracts the tar archive read from r into it,
+// the volume is removed if the archive can't be extracted, e.g. it's truncated or larger than the size.
+func (vs *VolumeService) ImportVolume(spec *models.VolumeCreate, r io.Reader) (resp volume.Volume, err error) {
+	ctx, cancel := dockerContext()
+	defer cancel()
+	exist, err := vs.existVolume(ctx, spec.Name)
+	if err != nil {
+		return resp, errors.WithMessage(err, "services.existVolume failed")
+	}
+	if exist {
+		return resp, errors.Wrapf(xerrors.NewVolumeExistedError(), "volume %s", spec.Name)
+	}
+
+	opt := volume.CreateOptions{Driver: "local", Name: spec.Name}
+	if len(spec.Size) != 0 {
+		opt.DriverOpts = map[string]string{"size": spec.Size}
+	}
+	resp, kv, err := vs.createVolume(ctx, spec.Name, models.EtcdVolumeInfo{Opt: &opt})
+	if err != nil {
+		return resp, errors.WithMessage(err, "services.createVolume failed")
+	}
+	defer func() {
+		if err != nil {
+			cleanupCtx, cancel := cleanupContext(ctx)
+			_ = docker.Cli.VolumeRemove(cleanupCtx, resp.Name, true)
+			cancel()
+			if _, version, ok := splitVersionName(resp.Name); ok {
+				vmap.VolumeVersionMap.Release(spec.Name, version)
+			}
+		}
+	}()
+
+	dir, reason := volumeDataDir(resp)
+	if len(dir) == 0 {
+		return resp, errors.Wrapf(xerrors.NewVolumeDataNotOnHostError(), "volume: %s, %s", resp.Name, reason)
+	}
+	// the upload is bounded by the client rather than the timeout of the docker calls
+	if err = utils.UntarTree(context.WithoutCancel(ctx), r, dir); err != nil {
+		return resp, errors.WithMessagef(err, "utils.UntarTree failed, volume: %s", resp.Name)
+	}
+
+	workQueue.Enqueue(etcd.PutKeyValue{
+		Resource: etcd.Volumes,
+		Key:      kv.Key,
+		Value:    kv.Value,
+	})
+	log.Infof("services.ImportVolume, volume: %s imported successfully, dir: %s", resp.Name, dir)
+	notify.Emit(models.EventVolumeCreated, spec.Name, map[string]interface{}{
+		"volumeName": resp.Name,
+		"size":       spec.Size,
+		"imported":   true,
+	})
+	return
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/notify"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type WebhookService struct{}
+
+// SaveWebhook subscribes the webhook to the events, the webhook with the same name will be overwritten
+func (ws *WebhookService) SaveWebhook(spec *models.Webhook) error {
+	spec.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	// nothing is changed yet, so the request is rejected if the writes are backed up
+	if err := workQueue.TryEnqueue(etcd.PutKeyValue{
+		Resource: etcd.Webhooks,
+		Key:      spec.Name,
+		Value:    spec.Serialize(),
+	}); err != nil {
+		return errors.WithMessage(err, "workQueue.TryEnqueue failed")
+	}
+	notify.Set(spec)
+	log.Infof("services.SaveWebhook, webhook: %s saved successfully, url: %s, events: %v", spec.Name, spec.URL, spec.Events)
+	return nil
+}
+
+func (ws *WebhookService) ListWebhooks() []*models.Webhook {
+	return notify.Webhooks()
+}
+
+func (ws *WebhookService) DeleteWebhook(name string) error {
+	if !notify.Remove(name) {
+		return xerrors.NewNotExistInEtcdError()
+	}
+	workQueue.Enqueue(etcd.DelKey{
+		Resource: etcd.Webhooks,
+		Key:      name,
+	})
+	log.Infof("services.DeleteWebhook, webhook: %s will be deleted", name)
+	return nil
+}
+
+// Subscribe streams the events of the types, empty types means all, the cancel must be called when it's done
+func (ws *WebhookService) Subscribe(types []models.EventType) (<-chan models.Event, func()) {
+	return notify.Subscribe(types)
+}
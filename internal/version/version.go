@@ -2,6 +2,7 @@ package version
 
 import (
 	"encoding/json"
+	"sync"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
@@ -24,6 +25,9 @@ type (
 
 type versionMap map[name]version
 
+// mu guards both version maps, the containers and volumes are created concurrently by the handlers
+var mu sync.RWMutex
+
 func InitVersionMap() error {
 	var err error
 	ContainerVersionMap, err = initVersionMapFormEtcd(containerVersionMapKey)
@@ -40,6 +44,11 @@ func InitVersionMap() error {
 }
 
 func CloseVersionMap() error {
+	return SaveVersionMap()
+}
+
+// SaveVersionMap persists the version maps to etcd immediately, e.g. after they are repaired
+func SaveVersionMap() error {
 	if err := etcd.Put(etcd.Versions, containerVersionMapKey, ContainerVersionMap.serialize()); err != nil {
 		return err
 	}
@@ -50,29 +59,105 @@ func CloseVersionMap() error {
 }
 
 func (vm *versionMap) serialize() *string {
+	mu.RLock()
+	defer mu.RUnlock()
+
 	bytes, _ := json.Marshal(vm)
 	tmp := string(bytes)
 	return &tmp
 }
 
 func (vm *versionMap) Set(key name, value version) {
+	mu.Lock()
+	defer mu.Unlock()
+
 	(*vm)[key] = value
 }
 
 func (vm *versionMap) Get(key name) (version, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
 	v, ok := (*vm)[key]
 	return v, ok
 }
 
 func (vm *versionMap) Exist(key name) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
 	_, ok := (*vm)[key]
 	return ok
 }
 
 func (vm *versionMap) Remove(key name) {
+	mu.Lock()
+	defer mu.Unlock()
+
 	delete(*vm, key)
 }
 
+// Next increments the version atomically and returns it, so the concurrent creates never get the same version
+func (vm *versionMap) Next(key name) version {
+	mu.Lock()
+	defer mu.Unlock()
+
+	(*vm)[key]++
+	return (*vm)[key]
+}
+
+// Release gives back the version returned by Next if the create failed,
+// it's given back only if no one has got a newer version, otherwise the newer version is kept.
+func (vm *versionMap) Release(key name, value version) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if (*vm)[key] != value {
+		return
+	}
+	if value <= 1 {
+		delete(*vm, key)
+	} else {
+		(*vm)[key] = value - 1
+	}
+}
+
+// Claim sets the version of the key only if it has none, and reports whether it's set,
+// e.g. a rename takes over the new base name, so the concurrent creates or renames never get the same name
+func (vm *versionMap) Claim(key name, value version) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := (*vm)[key]; ok {
+		return false
+	}
+	(*vm)[key] = value
+	return true
+}
+
+// Unclaim removes the key claimed by Claim if the version is still the claimed one or a version got by Next after it,
+// the key claimed by another one since is kept
+func (vm *versionMap) Unclaim(key name, value version) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v, ok := (*vm)[key]; ok && (v == value || v == value+1) {
+		delete(*vm, key)
+	}
+}
+
+// Snapshot returns a copy of the version map
+func (vm *versionMap) Snapshot() map[name]version {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	m := make(map[name]version, len(*vm))
+	for k, v := range *vm {
+		m[k] = v
+	}
+	return m
+}
+
 func initVersionMapFormEtcd(key string) (vm *versionMap, err error) {
 	bytes, err := etcd.GetValue(etcd.Versions, key)
 	if err != nil {
@@ -83,14 +168,15 @@ func initVersionMapFormEtcd(key string) (vm *versionMap, err error) {
 		}
 	}
 
-	vm = newVersionMap()
+	vm = NewVersionMap()
 	if len(bytes) != 0 {
 		err = json.Unmarshal(bytes, &vm)
 	}
 	return vm, err
 }
 
-func newVersionMap() *versionMap {
+// NewVersionMap returns an empty version map
+func NewVersionMap() *versionMap {
 	m := make(versionMap)
 	return &m
 }
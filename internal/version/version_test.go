@@ -0,0 +1,175 @@
+package version
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestRenameCounter follows the version counter of a rename, the new base continues from the old one
+func TestRenameCounter(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    map[name]version
+		from        name
+		to          name
+		created     bool
+		wantClaimed bool
+		wantTo      version
+		wantToExist bool
+	}{
+		{
+			name:        "renamed",
+			existing:    map[name]version{"foo": 3},
+			from:        "foo",
+			to:          "bar",
+			created:     true,
+			wantClaimed: true,
+			wantTo:      4,
+			wantToExist: true,
+		},
+		{
+			name:        "new version failed",
+			existing:    map[name]version{"foo": 3},
+			from:        "foo",
+			to:          "bar",
+			wantClaimed: true,
+		},
+		{
+			name:        "new base exists",
+			existing:    map[name]version{"foo": 3, "bar": 1},
+			from:        "foo",
+			to:          "bar",
+			wantTo:      1,
+			wantToExist: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVersionMap()
+			for k, v := range tt.existing {
+				vm.Set(k, v)
+			}
+			current, _ := vm.Get(tt.from)
+
+			claimed := vm.Claim(tt.to, current)
+			if claimed != tt.wantClaimed {
+				t.Fatalf("Claim(%s, %d) = %v, want %v", tt.to, current, claimed, tt.wantClaimed)
+			}
+			if claimed {
+				next := vm.Next(tt.to)
+				if next != current+1 {
+					t.Errorf("Next(%s) = %d, want %d", tt.to, next, current+1)
+				}
+				if tt.created {
+					vm.Remove(tt.from)
+				} else {
+					vm.Release(tt.to, next)
+					vm.Unclaim(tt.to, current)
+				}
+			}
+
+			got, ok := vm.Get(tt.to)
+			if ok != tt.wantToExist || got != tt.wantTo {
+				t.Errorf("Get(%s) = %d, %v, want %d, %v", tt.to, got, ok, tt.wantTo, tt.wantToExist)
+			}
+			if _, ok = vm.Get(tt.from); ok == tt.created {
+				t.Errorf("Get(%s) exists: %v after the rename, created: %v", tt.from, ok, tt.created)
+			}
+		})
+	}
+}
+
+func TestUnclaim(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   version
+		claimed   version
+		wantExist bool
+	}{
+		{name: "claimed", current: 3, claimed: 3},
+		{name: "next after claimed", current: 4, claimed: 3},
+		{name: "claimed by another since", current: 1, claimed: 3, wantExist: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVersionMap()
+			vm.Set("bar", tt.current)
+			vm.Unclaim("bar", tt.claimed)
+			if ok := vm.Exist("bar"); ok != tt.wantExist {
+				t.Errorf("Unclaim() exist = %v, want %v", ok, tt.wantExist)
+			}
+		})
+	}
+}
+
+// TestConcurrentNext fires the concurrent creates of the same base name, some of them fail and give back the version,
+// the versions of the succeeded creates have to be unique
+func TestConcurrentNext(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  version
+		creates   int
+		failEvery int
+	}{
+		{name: "new base", creates: 50},
+		{name: "existing base", existing: 7, creates: 50},
+		{name: "every third fails", creates: 50, failEvery: 3},
+		{name: "all fail", existing: 2, creates: 50, failEvery: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVersionMap()
+			if tt.existing > 0 {
+				vm.Set("foo", tt.existing)
+			}
+
+			var (
+				wg       sync.WaitGroup
+				start    = make(chan struct{})
+				versions = make(chan version, tt.creates)
+			)
+			for i := 0; i < tt.creates; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+					v := vm.Next("foo")
+					if tt.failEvery > 0 && i%tt.failEvery == 0 {
+						vm.Release("foo", v)
+						return
+					}
+					versions <- v
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+			close(versions)
+
+			seen := make(map[version]struct{}, tt.creates)
+			var latest version
+			for v := range versions {
+				if _, ok := seen[v]; ok {
+					t.Fatalf("version %d is got by two creates", v)
+				}
+				if v <= tt.existing {
+					t.Errorf("version %d is not after the existing version %d", v, tt.existing)
+				}
+				seen[v] = struct{}{}
+				if v > latest {
+					latest = v
+				}
+			}
+			succeeded := tt.creates
+			if tt.failEvery > 0 {
+				succeeded -= (tt.creates + tt.failEvery - 1) / tt.failEvery
+			}
+			if len(seen) != succeeded {
+				t.Errorf("%d creates succeeded, want %d", len(seen), succeeded)
+			}
+			// a version given back after a newer one is got is kept, so the version may be after the latest one
+			if got, _ := vm.Get("foo"); got < latest || got < tt.existing {
+				t.Errorf("Get(foo) = %d, want at least the latest version %d", got, latest)
+			}
+		})
+	}
+}
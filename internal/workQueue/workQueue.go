@@ -2,57 +2,222 @@ package workQueue
 
 import (
 	"context"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ngaut/log"
 
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/projection"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
-const _maxContainerCount = 110
+const (
+	// DefaultSize is the capacity of the queue if it's not set by flag
+	DefaultSize = 110
 
-var Queue chan interface{}
+	// _maxAttempts is the number of attempts before an item is moved to the dead-letter store
+	_maxAttempts = 5
+)
+
+// _retryInterval is the wait before the second attempt, it grows with the attempts
+var _retryInterval = time.Second
+
+// queue is bounded, the items are written by a single consumer in the order they are enqueued,
+// so the writes of the same key never overtake each other
+var queue chan *task
+
+// task is an etcd.PutKeyValue or etcd.DelKey with the attempt history
+type task struct {
+	item     interface{}
+	attempts int
+	errors   []string
+	enqueued time.Time
+}
+
+// stats are the counters of the queue, the latency is from enqueue to the end of the last attempt
+var stats struct {
+	enqueued     atomic.Int64
+	rejected     atomic.Int64
+	blocked      atomic.Int64
+	processed    atomic.Int64
+	failed       atomic.Int64
+	latencyTotal atomic.Int64
+	latencyMax   atomic.Int64
+	latencyLast  atomic.Int64
+}
+
+func InitWorkQueue(size int) {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	queue = make(chan *task, size)
+}
+
+// Enqueue queues the item which must not be lost, e.g. the record of a container which is created already.
+// The producer waits for a place if the queue is full, the consumer frees one within the bounded attempts of an item,
+// use TryEnqueue to reject the request instead when nothing is done yet.
+func Enqueue(item interface{}) {
+	t := &task{item: item, enqueued: time.Now()}
+	if err := tryEnqueue(t); err == nil {
+		return
+	}
+	stats.blocked.Add(1)
+	log.Warnf("workQueue.Enqueue, queue is full, capacity: %d, wait for a place", cap(queue))
+	queue <- t
+	stats.enqueued.Add(1)
+}
 
-func InitWorkQueue() {
-	Queue = make(chan interface{}, _maxContainerCount)
+// TryEnqueue queues the item without blocking, it returns an error if the queue is full,
+// so the caller can reject the request before anything is changed
+func TryEnqueue(item interface{}) error {
+	return tryEnqueue(&task{item: item, enqueued: time.Now()})
 }
 
+func tryEnqueue(t *task) error {
+	select {
+	case queue <- t:
+		stats.enqueued.Add(1)
+		return nil
+	default:
+		stats.rejected.Add(1)
+		return xerrors.NewWorkQueueFullError()
+	}
+}
+
+// SyncLoop writes the items one by one until ctx is done, then the items left in the queue are written before it returns,
+// the caller adds it to wg
 func SyncLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
 	for {
 		select {
-		case v := <-Queue:
-			switch v := v.(type) {
-			case etcd.PutKeyValue:
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := etcd.Put(v.Resource, v.Key, v.Value); err != nil {
-						log.Error(err.Error())
-						Queue <- v
-						return
-					}
-					log.Infof("put to etcd successfully, resource %s, key: %s, value: %s", v.Resource, v.Key, *v.Value)
-				}()
-			case etcd.DelKey:
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := etcd.Del(v.Resource, v.Key); err != nil {
-						log.Error(err.Error())
-						Queue <- v
-						return
-					}
-					log.Infof("delete etcd key successfully, resource %s, key: %s", v.Resource, v.Key)
-				}()
-			default:
-				//	nothing to do
-			}
+		case t := <-queue:
+			process(ctx, t)
 		case <-ctx.Done():
+			for {
+				select {
+				case t := <-queue:
+					process(ctx, t)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// process writes the item, a failed write is retried in place up to _maxAttempts, so the later items of the same key
+// wait for it, then it's moved to the dead-letter store. The retries don't wait after ctx is done.
+func process(ctx context.Context, t *task) {
+	for {
+		err := applyItem(t.item)
+		if err == nil {
+			observe(t, true)
+			return
+		}
+		log.Error(err.Error())
+		t.attempts++
+		t.errors = append(t.errors, err.Error())
+		if t.attempts >= _maxAttempts {
+			observe(t, false)
+			deadLetter(t)
 			return
 		}
+		select {
+		case <-time.After(_retryInterval * time.Duration(t.attempts)):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// applyItem writes the item, it's replaced by the tests which run without etcd
+var applyItem = apply
+
+// apply writes the item to etcd and the projection
+func apply(item interface{}) error {
+	switch v := item.(type) {
+	case etcd.PutKeyValue:
+		revision, err := etcd.PutRevision(v.Resource, v.Key, v.Value)
+		if err != nil {
+			return err
+		}
+		log.Infof("put to etcd successfully, resource %s, key: %s, value: %s", v.Resource, v.Key, *v.Value)
+		projection.Apply(v, revision)
+	case etcd.DelKey:
+		revision, err := etcd.DelRevision(v.Resource, v.Key)
+		if err != nil {
+			return err
+		}
+		log.Infof("delete etcd key successfully, resource %s, key: %s", v.Resource, v.Key)
+		projection.Apply(v, revision)
+	}
+	return nil
+}
+
+// observe records the latency of the task when it's done
+func observe(t *task, ok bool) {
+	if ok {
+		stats.processed.Add(1)
+	} else {
+		stats.failed.Add(1)
+	}
+	latency := time.Since(t.enqueued).Milliseconds()
+	stats.latencyTotal.Add(latency)
+	stats.latencyLast.Store(latency)
+	for {
+		prev := stats.latencyMax.Load()
+		if latency <= prev || stats.latencyMax.CompareAndSwap(prev, latency) {
+			break
+		}
+	}
+}
+
+// deadLetter moves the task to the dead-letter store after all attempts failed
+func deadLetter(t *task) {
+	letter := &models.DeadLetter{
+		ID:         strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attempts:   t.attempts,
+		Errors:     t.errors,
+		FailedTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	switch v := t.item.(type) {
+	case etcd.PutKeyValue:
+		letter.Kind, letter.Resource, letter.Key, letter.Value = models.DeadLetterPut, v.Resource, v.Key, v.Value
+	case etcd.DelKey:
+		letter.Kind, letter.Resource, letter.Key = models.DeadLetterDel, v.Resource, v.Key
+	}
+
+	// the etcd may still be unavailable, the letter is logged in full so that it can be recovered by hand
+	if err := etcd.Put(etcd.DeadLetters, letter.ID, letter.Serialize()); err != nil {
+		log.Errorf("workQueue.deadLetter, put dead letter to etcd failed, letter: %s, error: %v", *letter.Serialize(), err)
+		return
+	}
+	log.Errorf("workQueue.deadLetter, item failed after %d attempts, moved to dead letter: %s", t.attempts, letter.ID)
+}
+
+// GetStats returns the depth and the counters of the queue
+func GetStats() *models.WorkQueueStats {
+	s := &models.WorkQueueStats{
+		Capacity:      cap(queue),
+		Depth:         len(queue),
+		Enqueued:      stats.enqueued.Load(),
+		Rejected:      stats.rejected.Load(),
+		Blocked:       stats.blocked.Load(),
+		Processed:     stats.processed.Load(),
+		Failed:        stats.failed.Load(),
+		LastLatencyMs: stats.latencyLast.Load(),
+		MaxLatencyMs:  stats.latencyMax.Load(),
+	}
+	if done := s.Processed + s.Failed; done > 0 {
+		s.AvgLatencyMs = stats.latencyTotal.Load() / done
 	}
+	return s
 }
 
 func Close() {
-	close(Queue)
+	close(queue)
 }
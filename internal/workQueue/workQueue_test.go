@@ -0,0 +1,117 @@
+package workQueue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+func TestTryEnqueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		items    int
+		rejected int
+	}{
+		{name: "room left", size: 3, items: 2},
+		{name: "exactly full", size: 2, items: 2},
+		{name: "full", size: 2, items: 4, rejected: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitWorkQueue(tt.size)
+			rejected := 0
+			for i := 0; i < tt.items; i++ {
+				if err := TryEnqueue(etcd.DelKey{Resource: etcd.Templates, Key: "t"}); err != nil {
+					if !xerrors.IsWorkQueueFullError(err) {
+						t.Fatalf("TryEnqueue() error = %v, want work queue full", err)
+					}
+					rejected++
+				}
+			}
+			if rejected != tt.rejected {
+				t.Errorf("TryEnqueue() rejected %d, want %d", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+// TestSyncLoop checks the items are written in order by one consumer, and a failed item is retried before the next
+func TestSyncLoop(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		failures map[string]int
+		want     []string
+	}{
+		{
+			name: "in order",
+			keys: []string{"a", "b", "a"},
+			want: []string{"a", "b", "a"},
+		},
+		{
+			name:     "retried in place",
+			keys:     []string{"a", "b"},
+			failures: map[string]int{"a": 2},
+			want:     []string{"a", "a", "a", "b"},
+		},
+	}
+
+	defer func(f func(interface{}) error, interval time.Duration) {
+		applyItem, _retryInterval = f, interval
+	}(applyItem, _retryInterval)
+	_retryInterval = time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				attempts []string
+				failures = make(map[string]int, len(tt.failures))
+			)
+			for k, v := range tt.failures {
+				failures[k] = v
+			}
+			done := make(chan struct{}, len(tt.want))
+			applyItem = func(item interface{}) error {
+				mu.Lock()
+				defer mu.Unlock()
+				key := item.(etcd.DelKey).Key
+				attempts = append(attempts, key)
+				done <- struct{}{}
+				if failures[key] > 0 {
+					failures[key]--
+					return errors.New("etcd unavailable")
+				}
+				return nil
+			}
+			InitWorkQueue(len(tt.keys))
+			for _, key := range tt.keys {
+				Enqueue(etcd.DelKey{Resource: etcd.Templates, Key: key})
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go SyncLoop(ctx, &wg)
+			for range tt.want {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatal("SyncLoop() timed out")
+				}
+			}
+			cancel()
+			wg.Wait()
+
+			if !reflect.DeepEqual(attempts, tt.want) {
+				t.Errorf("SyncLoop() attempts = %v, want %v", attempts, tt.want)
+			}
+		})
+	}
+}
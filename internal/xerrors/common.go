@@ -7,6 +7,9 @@ import (
 const (
 	noPatchRequired    = "no patch required"
 	noRollbackRequired = "no rollback required"
+	copyNotFound       = "copy not found"
+	workQueueFull      = "work queue full"
+	copyRetrying       = "copy retrying"
 )
 
 func NewNoPatchRequiredError() error {
@@ -30,3 +33,36 @@ func IsNoRollbackRequiredError(err error) bool {
 	}
 	return errors.Cause(err).Error() == noRollbackRequired
 }
+
+func NewCopyNotFoundError() error {
+	return errors.New(copyNotFound)
+}
+
+func IsCopyNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == copyNotFound
+}
+
+func NewWorkQueueFullError() error {
+	return errors.New(workQueueFull)
+}
+
+func IsWorkQueueFullError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == workQueueFull
+}
+
+func NewCopyRetryingError() error {
+	return errors.New(copyRetrying)
+}
+
+func IsCopyRetryingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == copyRetrying
+}
@@ -4,10 +4,38 @@ import (
 	"github.com/pkg/errors"
 )
 
-const containerExisted = "container existed"
+const (
+	containerExisted         = "container existed"
+	storageOptNotSupported   = "storage opt not supported"
+	nvidiaRuntimeMissing     = "nvidia runtime missing, please install nvidia-container-toolkit"
+	processNotFound          = "process not found in container"
+	signalInvalid            = "signal invalid"
+	profilerNotAllowed       = "profiler not allowed, please start with --allowProfiler"
+	containerLimitReached    = "host container limit reached"
+	checkpointNotSupported   = "checkpoint not supported"
+	containerArchived        = "container archived"
+	containerNotArchived     = "container not archived"
+	runtimeNotSupported      = "runtime not registered in docker"
+	runtimeGpuIncompatible   = "runtime doesn't support gpus"
+	tcNotAvailable           = "tc not available, please install iproute2"
+	containerVersionNotFound = "container version not found"
+	imagePullFailed          = "image pull failed"
+	containerNotReady        = "container not ready"
+	idempotencyKeyReused     = "idempotency key reused by another replicaSet"
+)
+
+// ContainerExistedError carries the name of the replicaSet that already exists, the callers get it by errors.As,
+// the message is always containerExisted, so IsContainerExistedError still works
+type ContainerExistedError struct {
+	Name string
+}
+
+func (e *ContainerExistedError) Error() string {
+	return containerExisted
+}
 
-func NewContainerExistedError() error {
-	return errors.New(containerExisted)
+func NewContainerExistedError(name string) error {
+	return &ContainerExistedError{Name: name}
 }
 
 func IsContainerExistedError(err error) bool {
@@ -16,3 +44,179 @@ func IsContainerExistedError(err error) bool {
 	}
 	return errors.Cause(err).Error() == containerExisted
 }
+
+func NewStorageOptNotSupportedError() error {
+	return errors.New(storageOptNotSupported)
+}
+
+func IsStorageOptNotSupportedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == storageOptNotSupported
+}
+
+func NewNvidiaRuntimeMissingError() error {
+	return errors.New(nvidiaRuntimeMissing)
+}
+
+func IsNvidiaRuntimeMissingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == nvidiaRuntimeMissing
+}
+
+func NewProcessNotFoundError() error {
+	return errors.New(processNotFound)
+}
+
+func IsProcessNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == processNotFound
+}
+
+func NewSignalInvalidError() error {
+	return errors.New(signalInvalid)
+}
+
+func IsSignalInvalidError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == signalInvalid
+}
+
+func NewContainerLimitReachedError() error {
+	return errors.New(containerLimitReached)
+}
+
+func IsContainerLimitReachedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == containerLimitReached
+}
+
+func NewCheckpointNotSupportedError() error {
+	return errors.New(checkpointNotSupported)
+}
+
+func IsCheckpointNotSupportedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == checkpointNotSupported
+}
+
+func NewProfilerNotAllowedError() error {
+	return errors.New(profilerNotAllowed)
+}
+
+func IsProfilerNotAllowedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == profilerNotAllowed
+}
+
+func NewContainerArchivedError() error {
+	return errors.New(containerArchived)
+}
+
+func IsContainerArchivedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == containerArchived
+}
+
+func NewContainerNotArchivedError() error {
+	return errors.New(containerNotArchived)
+}
+
+func IsContainerNotArchivedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == containerNotArchived
+}
+
+func NewRuntimeNotSupportedError() error {
+	return errors.New(runtimeNotSupported)
+}
+
+func IsRuntimeNotSupportedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == runtimeNotSupported
+}
+
+func NewRuntimeGpuIncompatibleError() error {
+	return errors.New(runtimeGpuIncompatible)
+}
+
+func IsRuntimeGpuIncompatibleError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == runtimeGpuIncompatible
+}
+
+func NewTcNotAvailableError() error {
+	return errors.New(tcNotAvailable)
+}
+
+func IsTcNotAvailableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == tcNotAvailable
+}
+
+func NewContainerVersionNotFoundError() error {
+	return errors.New(containerVersionNotFound)
+}
+
+func IsContainerVersionNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == containerVersionNotFound
+}
+
+func NewImagePullFailedError() error {
+	return errors.New(imagePullFailed)
+}
+
+func IsImagePullFailedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == imagePullFailed
+}
+
+func NewContainerNotReadyError() error {
+	return errors.New(containerNotReady)
+}
+
+func IsContainerNotReadyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == containerNotReady
+}
+
+func NewIdempotencyKeyReusedError() error {
+	return errors.New(idempotencyKeyReused)
+}
+
+func IsIdempotencyKeyReusedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == idempotencyKeyReused
+}
@@ -0,0 +1,30 @@
+package xerrors
+
+import (
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// The errors of the docker daemon keep their types through the wrapping of pkg/errors,
+// so the callers can tell them apart while the wrapped message is still logged.
+
+// IsDockerNotFoundError means the container, volume, image or network doesn't exist in docker
+func IsDockerNotFoundError(err error) bool {
+	return err != nil && errdefs.IsNotFound(err)
+}
+
+// IsDockerConflictError means the request conflicts with the state of docker,
+// e.g. the name is in use, or the volume is mounted by a container
+func IsDockerConflictError(err error) bool {
+	return err != nil && errdefs.IsConflict(err)
+}
+
+// IsDockerUnauthorizedError means the registry rejected the credentials
+func IsDockerUnauthorizedError(err error) bool {
+	return err != nil && (errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err))
+}
+
+// IsDockerUnavailableError means the docker daemon is unreachable or not ready
+func IsDockerUnavailableError(err error) bool {
+	return err != nil && (client.IsErrConnectionFailed(err) || errdefs.IsUnavailable(err))
+}
@@ -0,0 +1,32 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	scalingGroupExisted = "scaling group existed"
+	scalingGroupInvalid = "scaling group invalid"
+)
+
+func NewScalingGroupExistedError() error {
+	return errors.New(scalingGroupExisted)
+}
+
+func IsScalingGroupExistedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == scalingGroupExisted
+}
+
+func NewScalingGroupInvalidError() error {
+	return errors.New(scalingGroupInvalid)
+}
+
+func IsScalingGroupInvalidError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == scalingGroupInvalid
+}
@@ -5,8 +5,19 @@ import (
 )
 
 const (
-	gpuNotEnough  = "gpu not enough"
-	portNotEnough = "port not enough"
+	gpuNotEnough       = "gpu not enough"
+	portNotEnough      = "port not enough"
+	resourceNotEnough  = "cpu or memory not enough"
+	gpuConflict        = "no gpu without a conflicting workload"
+	reservationInvalid = "gpu reservation invalid"
+	gpuCountExceeded   = "gpu count exceeds the gpus on the host"
+	gpuUnhealthy       = "the free gpus are unhealthy"
+	gpuNotFound        = "gpu not found on the host"
+	gpuBusy            = "gpu is held by others"
+	migProfileNotFound = "mig profile not found on the host"
+	portConflict       = "host port conflict"
+
+	gpuConstraintUnsatisfiable = "no enough free gpus satisfy the constraints"
 )
 
 func NewGpuNotEnoughError() error {
@@ -30,3 +41,113 @@ func IsPortNotEnoughError(err error) bool {
 	}
 	return errors.Cause(err).Error() == portNotEnough
 }
+
+func NewResourceNotEnoughError() error {
+	return errors.New(resourceNotEnough)
+}
+
+func IsResourceNotEnoughError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == resourceNotEnough
+}
+
+func NewGpuConflictError() error {
+	return errors.New(gpuConflict)
+}
+
+func IsGpuConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuConflict
+}
+
+func NewReservationInvalidError() error {
+	return errors.New(reservationInvalid)
+}
+
+func IsReservationInvalidError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == reservationInvalid
+}
+
+func NewGpuCountExceededError() error {
+	return errors.New(gpuCountExceeded)
+}
+
+func IsGpuCountExceededError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuCountExceeded
+}
+
+func NewGpuUnhealthyError() error {
+	return errors.New(gpuUnhealthy)
+}
+
+func IsGpuUnhealthyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuUnhealthy
+}
+
+func NewGpuNotFoundError() error {
+	return errors.New(gpuNotFound)
+}
+
+func IsGpuNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuNotFound
+}
+
+func NewGpuBusyError() error {
+	return errors.New(gpuBusy)
+}
+
+func IsGpuBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuBusy
+}
+
+func NewMigProfileNotFoundError() error {
+	return errors.New(migProfileNotFound)
+}
+
+func IsMigProfileNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == migProfileNotFound
+}
+
+func NewPortConflictError() error {
+	return errors.New(portConflict)
+}
+
+func IsPortConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == portConflict
+}
+
+func NewGpuConstraintUnsatisfiableError() error {
+	return errors.New(gpuConstraintUnsatisfiable)
+}
+
+func IsGpuConstraintUnsatisfiableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == gpuConstraintUnsatisfiable
+}
@@ -0,0 +1,18 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const templateParamsMissing = "template params missing"
+
+func NewTemplateParamsMissingError() error {
+	return errors.New(templateParamsMissing)
+}
+
+func IsTemplateParamsMissingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == templateParamsMissing
+}
@@ -0,0 +1,20 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	tokenInvalid = "token invalid"
+)
+
+func NewTokenInvalidError() error {
+	return errors.New(tokenInvalid)
+}
+
+func IsTokenInvalidError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == tokenInvalid
+}
@@ -7,8 +7,35 @@ import (
 const (
 	volumeExisted                    = "volume existed"
 	volumeSizeUsedGreaterThanReduced = "volume The used size is greater than the reduced size"
+	volumeInUse                      = "volume in use"
+	encryptionKeyUnavailable         = "volume encryption key unavailable"
+	volumeOptionsInvalid             = "volume driver options invalid"
+	volumePending                    = "volume pending, the data is being copied to it"
+	volumeDataNotOnHost              = "volume data is not on the host"
 )
 
+func NewVolumeDataNotOnHostError() error {
+	return errors.New(volumeDataNotOnHost)
+}
+
+func IsVolumeDataNotOnHostError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == volumeDataNotOnHost
+}
+
+func NewEncryptionKeyUnavailableError() error {
+	return errors.New(encryptionKeyUnavailable)
+}
+
+func IsEncryptionKeyUnavailableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == encryptionKeyUnavailable
+}
+
 func NewVolumeExistedError() error {
 	return errors.New(volumeExisted)
 }
@@ -30,3 +57,36 @@ func IsVolumeSizeUsedGreaterThanReduced(err error) bool {
 	}
 	return errors.Cause(err).Error() == volumeSizeUsedGreaterThanReduced
 }
+
+func NewVolumeInUseError() error {
+	return errors.New(volumeInUse)
+}
+
+func IsVolumeInUseError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == volumeInUse
+}
+
+func NewVolumeOptionsInvalidError() error {
+	return errors.New(volumeOptionsInvalid)
+}
+
+func IsVolumeOptionsInvalidError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == volumeOptionsInvalid
+}
+
+func NewVolumePendingError() error {
+	return errors.New(volumePending)
+}
+
+func IsVolumePendingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == volumePending
+}
@@ -3,6 +3,9 @@ package utils
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/commander-cli/cmd"
 	"github.com/pkg/errors"
@@ -11,33 +14,92 @@ import (
 )
 
 var (
-	cpRFPOption = "cp -rf -p %s/* %s/"
+	// the contents are copied through "src/." instead of a glob, so the quoted paths are not expanded by the shell
+	// and the hidden files are copied too, the files are cloned by reflink if the filesystem supports it
+	cpRFPOption = "cp -rf -p --reflink=auto %s %s"
 )
 
-func CopyDir(src, dest string) error {
-	command := fmt.Sprintf(cpRFPOption, src, dest)
-	if err := cmd.NewCommand(command).Execute(); err != nil {
+// copySampleInterval is the interval of estimating the progress of cp by the size of the destination
+const copySampleInterval = 5 * time.Second
+
+// copyWithCp means CopyDir shells out to cp instead of the native copy
+var copyWithCp atomic.Bool
+
+// SetCopyWithCp switches CopyDir back to cp, it's kept for one release in case the native copy misbehaves
+func SetCopyWithCp(enabled bool) {
+	copyWithCp.Store(enabled)
+}
+
+// CopyDir copies the contents of src into dest, preserving the mode, owner, modification time,
+// extended attributes and symlinks, it stops when the ctx is done.
+// The files counted by the stats are unknown if it's copied by cp, cp doesn't report which files are cloned.
+func CopyDir(ctx context.Context, src, dest string, progress *CopyProgress) (CopyStats, error) {
+	if copyWithCp.Load() {
+		return CopyStats{}, copyDirWithCp(ctx, src, dest, progress)
+	}
+	return CopyTree(ctx, src, dest, progress)
+}
+
+// copyDirWithCp copies the contents of src into dest with cp, the progress is estimated by the growth of dest
+// while cp is running, the files overwritten in dest are not counted until it completes.
+func copyDirWithCp(ctx context.Context, src, dest string, progress *CopyProgress) error {
+	total := treeSize(src)
+	progress.Start(total)
+	baseline := treeSize(dest)
+
+	command := fmt.Sprintf(cpRFPOption, ShellQuote(src+"/."), ShellQuote(dest+"/"))
+	// the ctx decides when to stop, a large layer may take longer than the default timeout
+	c := cmd.NewCommand(command, cmd.WithoutTimeout)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.ExecuteContext(ctx)
+	}()
+
+	ticker := time.NewTicker(copySampleInterval)
+	defer ticker.Stop()
+	var err error
+wait:
+	for {
+		select {
+		case err = <-done:
+			break wait
+		case <-ticker.C:
+			progress.set(min(max(treeSize(dest)-baseline, 0), total))
+		}
+	}
+	if err != nil {
 		return errors.Wrapf(err, "cmd.Execute failed, command %s, src:%s, dest: %s", command, src, dest)
 	}
+	if c.ExitCode() != 0 {
+		return errors.Errorf("command: %s exit with code %d, output: %s", command, c.ExitCode(), c.Combined())
+	}
+	progress.set(total)
 	return nil
 }
 
+// ShellQuote quotes the argument for the shell that runs the command,
+// the paths may contain spaces or characters like $, ;, * that the shell would interpret.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // CopyOldMergedToNewContainerMerged is used to copy the merged layer from the old container
 // to the new container during patch operations.
-func CopyOldMergedToNewContainerMerged(oldContainer, newContainer string) error {
+func CopyOldMergedToNewContainerMerged(ctx context.Context, oldContainer, newContainer string, progress *CopyProgress) (CopyStats, error) {
 	oldMerged, err := GetContainerMergedLayer(oldContainer)
 	if err != nil {
-		return errors.WithMessage(err, "GetContainerMergedLayer failed")
+		return CopyStats{}, errors.WithMessage(err, "GetContainerMergedLayer failed")
 	}
 	newMerged, err := GetContainerMergedLayer(newContainer)
 	if err != nil {
-		return errors.WithMessage(err, "GetContainerMergedLayer failed")
+		return CopyStats{}, errors.WithMessage(err, "GetContainerMergedLayer failed")
 	}
 
-	if err = CopyDir(oldMerged, newMerged); err != nil {
-		return errors.WithMessage(err, "copyDir failed")
+	stats, err := CopyDir(ctx, oldMerged, newMerged, progress)
+	if err != nil {
+		return stats, errors.WithMessage(err, "copyDir failed")
 	}
-	return nil
+	return stats, nil
 }
 
 func GetContainerMergedLayer(name string) (string, error) {
@@ -49,21 +111,22 @@ func GetContainerMergedLayer(name string) (string, error) {
 }
 
 // CopyOldMountPointToContainerMountPoint is used to copy the volume data from the old container
-// to the new container during patch operations.
-func CopyOldMountPointToContainerMountPoint(oldVolume, newVolume string) error {
+// to the new container during patch operations, a retry resumes from the files already copied.
+func CopyOldMountPointToContainerMountPoint(oldVolume, newVolume string, progress *CopyProgress) (CopyStats, error) {
 	oldMountPoint, err := GetVolumeMountPoint(oldVolume)
 	if err != nil {
-		return errors.WithMessage(err, "GetVolumeMountPoint failed")
+		return CopyStats{}, errors.WithMessage(err, "GetVolumeMountPoint failed")
 	}
 	newMountPoint, err := GetVolumeMountPoint(newVolume)
 	if err != nil {
-		return errors.WithMessage(err, "GetVolumeMountPoint failed")
+		return CopyStats{}, errors.WithMessage(err, "GetVolumeMountPoint failed")
 	}
 
-	if err = CopyDir(oldMountPoint, newMountPoint); err != nil {
-		return errors.WithMessage(err, "copyDir failed")
+	stats, err := CopyDirResumable(oldMountPoint, newMountPoint, progress)
+	if err != nil {
+		return stats, errors.WithMessage(err, "CopyDirResumable failed")
 	}
-	return nil
+	return stats, nil
 }
 
 func GetVolumeMountPoint(name string) (string, error) {
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not found")
+	}
+	tests := []struct {
+		name string
+		arg  string
+	}{
+		{name: "plain", arg: "/var/lib/docker/overlay2/abc/merged"},
+		{name: "spaces", arg: "/data root/docker/overlay2/abc/merged"},
+		{name: "single quote", arg: "/data/it's/merged"},
+		{name: "variable", arg: "/data/$HOME/merged"},
+		{name: "command", arg: "/data/$(id)/`id`/merged"},
+		{name: "separator", arg: "/data/a; rm -rf b/merged"},
+		{name: "glob", arg: "/data/*/merged?"},
+		{name: "empty", arg: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(tt.arg)).Output()
+			if err != nil {
+				t.Fatalf("sh -c printf %s error = %v", ShellQuote(tt.arg), err)
+			}
+			if string(out) != tt.arg {
+				t.Errorf("the shell reads ShellQuote(%q) as %q", tt.arg, out)
+			}
+		})
+	}
+}
+
+func TestCopyDirWithCp(t *testing.T) {
+	if _, err := exec.LookPath("cp"); err != nil {
+		t.Skip("cp is not found")
+	}
+	tests := []struct {
+		name string
+		src  string
+		dest string
+	}{
+		{name: "spaces", src: "data root/merged", dest: "new data root/merged"},
+		{name: "special characters", src: "it's $HOME/merged", dest: "a; b & `c`/merged"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dest := filepath.Join(dir, tt.src), filepath.Join(dir, tt.dest)
+			files := map[string]string{"a.txt": "foo", "sub dir/b c.txt": "bar"}
+			for name, content := range files {
+				path := filepath.Join(src, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			progress := new(CopyProgress)
+			if err := copyDirWithCp(context.Background(), src, dest, progress); err != nil {
+				t.Fatalf("copyDirWithCp(%q, %q) error = %v", src, dest, err)
+			}
+			for name, content := range files {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil || string(got) != content {
+					t.Errorf("copy of %s = %q, %v, want %q", name, got, err, content)
+				}
+			}
+			if copied, total := progress.Bytes(); copied != total {
+				t.Errorf("copyDirWithCp() progress = %d/%d, want all", copied, total)
+			}
+		})
+	}
+}
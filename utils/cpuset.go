@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCpuset parses the cpus in the cpuset format of cgroup, e.g. "0-3,8", and returns them in order without duplicates.
+// The cpus must be less than numCpus, ranges are checked before they are expanded.
+func ParseCpuset(cpuset string, numCpus int) ([]int, error) {
+	seen := make(map[int]struct{})
+	cpus := make([]int, 0)
+	for _, part := range strings.Split(cpuset, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 || start >= numCpus {
+			return nil, errors.Errorf("invalid cpu: %s in cpuset: %s", part, cpuset)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start || end >= numCpus {
+				return nil, errors.Errorf("invalid cpu range: %s in cpuset: %s", part, cpuset)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			if _, ok := seen[cpu]; !ok {
+				seen[cpu] = struct{}{}
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
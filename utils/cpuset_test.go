@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCpuset(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpuset  string
+		numCpus int
+		want    []int
+		wantErr bool
+	}{
+		{name: "single", cpuset: "2", numCpus: 4, want: []int{2}},
+		{name: "range and list", cpuset: "0-2,5", numCpus: 8, want: []int{0, 1, 2, 5}},
+		{name: "duplicates and order", cpuset: "3, 1-3", numCpus: 4, want: []int{1, 2, 3}},
+		{name: "last cpu", cpuset: "3", numCpus: 4, want: []int{3}},
+		{name: "beyond host", cpuset: "4", numCpus: 4, wantErr: true},
+		{name: "range beyond host", cpuset: "0-4", numCpus: 4, wantErr: true},
+		{name: "huge range", cpuset: "0-2147483647", numCpus: 64, wantErr: true},
+		{name: "reversed", cpuset: "3-1", numCpus: 4, wantErr: true},
+		{name: "negative", cpuset: "-1", numCpus: 4, wantErr: true},
+		{name: "empty part", cpuset: "1,", numCpus: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCpuset(tt.cpuset, tt.numCpus)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCpuset(%q) error = %v, wantErr %v", tt.cpuset, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCpuset(%q) = %v, want %v", tt.cpuset, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -21,7 +24,26 @@ func DirSize(path string) (int64, error) {
 	return size, err
 }
 
+var sizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT])(?:I?B|I)?$`)
+
+// NormalizeSize converts a human-readable size, e.g. 10G, 512m, 1Ti or 2.5GiB, into the form of ToBytes, e.g. 10GB,
+// the units are binary, which is the same as the local driver of docker
+func NormalizeSize(origin string) (string, error) {
+	matches := sizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(origin)))
+	if matches == nil {
+		return "", fmt.Errorf("invalid size: %s, it must be a number with the unit K, M, G or T, e.g. 10G", origin)
+	}
+	size := matches[1] + matches[2] + "B"
+	if bytes, err := ToBytes(size); err != nil || bytes <= 0 {
+		return "", fmt.Errorf("invalid size: %s, it must be greater than 0", origin)
+	}
+	return size, nil
+}
+
 func ToBytes(origin string) (int64, error) {
+	if len(origin) <= 2 {
+		return 0, fmt.Errorf("invalid size: %s", origin)
+	}
 	sizeStr := origin[:len(origin)-2]
 	unit := origin[len(origin)-2:]
 
@@ -57,3 +79,28 @@ func IsDir(src string) error {
 	}
 	return nil
 }
+
+// EqualStringMap reports whether two maps contain the same key-value pairs, nil and empty map are equal
+func EqualStringMap(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// StringMapValues returns the values of the map sorted, the empty values are skipped
+func StringMapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		if len(v) != 0 {
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package utils
+
+import (
+	"archive/tar"
+	"io/fs"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mknod recreates the fifo, socket or device of the source at path, the devices require CAP_MKNOD
+func mknod(path string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Errorf("the special file: %s has no stat", path)
+	}
+	if err := unix.Mknod(path, uint32(stat.Mode), int(stat.Rdev)); err != nil {
+		return errors.Wrapf(err, "unix.Mknod failed, path: %s, mode: %s", path, info.Mode())
+	}
+	return nil
+}
+
+// mknodEntry creates the fifo or device of the tar entry at path
+func mknodEntry(path string, hdr *tar.Header) error {
+	mode := uint32(fs.FileMode(hdr.Mode).Perm())
+	switch hdr.Typeflag {
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	}
+	dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	if err := unix.Mknod(path, mode, int(dev)); err != nil {
+		return errors.Wrapf(err, "unix.Mknod failed, path: %s, type: %q", path, hdr.Typeflag)
+	}
+	return nil
+}
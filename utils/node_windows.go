@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"archive/tar"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// mknod fails, the fifos, sockets and devices can't be created on windows
+func mknod(path string, info fs.FileInfo) error {
+	return errors.Errorf("the special file: %s, mode: %s is not supported on windows", path, info.Mode())
+}
+
+// mknodEntry fails, the fifos and devices can't be created on windows
+func mknodEntry(path string, hdr *tar.Header) error {
+	return errors.Errorf("tar entry: %s of type: %q is not supported on windows", path, hdr.Typeflag)
+}
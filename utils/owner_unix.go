@@ -0,0 +1,56 @@
+//go:build !windows
+
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// preserveOwner sets the owner of the source on the copy, the link itself is changed for a symlink
+func preserveOwner(path string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := os.Lchown(path, int(stat.Uid), int(stat.Gid)); err != nil {
+		return errors.Wrapf(err, "os.Lchown failed, path: %s", path)
+	}
+	return nil
+}
+
+// preserveXattrs copies the extended attributes of the source to the copy,
+// they are skipped if either filesystem doesn't support them.
+func preserveXattrs(src, path string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return nil
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		n, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(src, name, value); err != nil {
+			continue
+		}
+		if err = unix.Lsetxattr(path, name, value[:n], 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			return errors.Wrapf(err, "unix.Lsetxattr failed, path: %s, name: %s", path, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package utils
+
+import "io/fs"
+
+// preserveOwner is a no-op, windows has no uid and gid
+func preserveOwner(string, fs.FileInfo) error {
+	return nil
+}
+
+// preserveXattrs is a no-op, the extended attributes are not supported on windows
+func preserveXattrs(string, string) error {
+	return nil
+}
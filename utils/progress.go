@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// CopyProgress counts the bytes of a copy, it's updated by the copy and read by the status queries concurrently.
+// A nil progress is valid and counts nothing.
+type CopyProgress struct {
+	total  atomic.Int64
+	copied atomic.Int64
+}
+
+// Start resets the progress for a new attempt that copies total bytes
+func (p *CopyProgress) Start(total int64) {
+	if p == nil {
+		return
+	}
+	p.total.Store(total)
+	p.copied.Store(0)
+}
+
+func (p *CopyProgress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.copied.Add(n)
+}
+
+func (p *CopyProgress) set(n int64) {
+	if p == nil {
+		return
+	}
+	p.copied.Store(n)
+}
+
+// Bytes returns the bytes copied and the bytes to copy
+func (p *CopyProgress) Bytes() (copied, total int64) {
+	if p == nil {
+		return 0, 0
+	}
+	return p.copied.Load(), p.total.Load()
+}
+
+// progressWriter adds the bytes written to the progress
+type progressWriter struct {
+	progress *CopyProgress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.progress.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// treeSize sums the size of the regular files under the path, the files that can't be read are ignored,
+// because the tree may be changed by the running container while it's walked.
+func treeSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// reflink clones the content of src into dst with FICLONE, the blocks are shared until either is written,
+// it's supported by xfs with reflink=1, btrfs and overlayfs on top of them
+func reflink(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// reflinkUnsupported means the filesystems can't clone, e.g. ext4 or the files are on different filesystems,
+// rather than the clone of the file failed
+func reflinkUnsupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY)
+}
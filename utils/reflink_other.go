@@ -0,0 +1,18 @@
+//go:build !linux
+
+package utils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// reflink is not supported, the files are always copied
+func reflink(*os.File, *os.File) error {
+	return errors.New("reflink is only supported on linux")
+}
+
+func reflinkUnsupported(error) bool {
+	return true
+}
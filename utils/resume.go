@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// CopyManifestName is the sidecar file in the destination that records the files already copied,
+// it's removed when the copy completes.
+const CopyManifestName = ".gpu-docker-api-copy.manifest"
+
+// CopyStats counts the files handled by one attempt of a resumable copy,
+// Cloned is the part of Copied that is cloned copy-on-write by reflink instead of copied
+type CopyStats struct {
+	Copied  int
+	Skipped int
+	Cloned  int
+}
+
+// manifestEntry is a file copied, the size and modification time are the same on the source and the copy,
+// the checksum is computed by the writer while the content is copied, it's empty for a clone
+type manifestEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Sha256  string `json:"sha256,omitempty"`
+}
+
+// CopyDirResumable copies the directory tree from src to dest, preserving the mode, owner and modification time.
+// The files are cloned by reflink if the filesystem supports it, which is near-instant for large files.
+// Every regular file copied is appended to the manifest in dest, so that a retry after a failure skips
+// the files whose source and copy are unchanged since, the copies are not read again to verify them.
+// The fifos, sockets and devices are recreated, the copy fails if they can't be.
+// The skipped files are counted as copied in the progress.
+func CopyDirResumable(src, dest string, progress *CopyProgress) (stats CopyStats, err error) {
+	progress.Start(treeSize(src))
+
+	manifestPath := filepath.Join(dest, CopyManifestName)
+	done, err := loadManifest(manifestPath)
+	if err != nil {
+		return stats, errors.WithMessage(err, "loadManifest failed")
+	}
+
+	manifest, err := os.OpenFile(manifestPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return stats, errors.Wrapf(err, "os.OpenFile failed, path: %s", manifestPath)
+	}
+	defer func() {
+		_ = manifest.Close()
+		if err == nil {
+			err = errors.Wrapf(os.Remove(manifestPath), "os.Remove failed, path: %s", manifestPath)
+		}
+	}()
+	encoder := json.NewEncoder(manifest)
+
+	// the modification time of a directory changes when its entries are created, so set them at last
+	var dirs []string
+	rl := new(reflinker)
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || rel == CopyManifestName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			if err = os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "os.MkdirAll failed, path: %s", target)
+			}
+			if err = preserveAttributes(path, target, info); err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return errors.Wrapf(err, "os.Readlink failed, path: %s", path)
+			}
+			_ = os.Remove(target)
+			if err = os.Symlink(link, target); err != nil {
+				return errors.Wrapf(err, "os.Symlink failed, path: %s", target)
+			}
+			_ = preserveOwner(target, info)
+		case info.Mode().IsRegular():
+			entry, ok := done[rel]
+			if ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() && copyMatches(target, entry) {
+				progress.Add(info.Size())
+				stats.Skipped++
+				return nil
+			}
+			h := sha256.New()
+			cloned, err := copyFile(context.Background(), path, target, info, io.MultiWriter(h, progressWriter{progress}), rl)
+			if err != nil {
+				return err
+			}
+			// the content of a clone is not read, so it has no checksum
+			var sum string
+			if cloned {
+				progress.Add(info.Size())
+				stats.Cloned++
+			} else {
+				sum = hex.EncodeToString(h.Sum(nil))
+			}
+			entry = manifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Sha256: sum}
+			if err = encoder.Encode(entry); err != nil {
+				return errors.Wrapf(err, "write manifest failed, path: %s", manifestPath)
+			}
+			stats.Copied++
+		default:
+			_ = os.RemoveAll(target)
+			if err = mknod(target, info); err != nil {
+				return err
+			}
+			if err = preserveAttributes(path, target, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, errors.Wrapf(err, "filepath.WalkDir failed, src: %s, dest: %s", src, dest)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return stats, errors.Wrapf(err, "os.Lstat failed, path: %s", dirs[i])
+		}
+		target := filepath.Join(dest, dirs[i])
+		if err = os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return stats, errors.Wrapf(err, "os.Chtimes failed, path: %s", target)
+		}
+	}
+	return stats, nil
+}
+
+// loadManifest reads the files recorded by the previous attempts, a partly written last entry is ignored
+func loadManifest(path string) (map[string]manifestEntry, error) {
+	done := make(map[string]manifestEntry)
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return done, nil
+		}
+		return nil, errors.Wrapf(err, "os.Open failed, path: %s", path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			done[entry.Path] = entry
+		}
+	}
+	return done, errors.Wrapf(scanner.Err(), "read manifest failed, path: %s", path)
+}
+
+// copyMatches reports whether the copy is still the one recorded, a copy changed or truncated since
+// has another size or modification time, the modification time of the source is set on the copy
+func copyMatches(path string, entry manifestEntry) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular() && info.Size() == entry.Size && info.ModTime().UnixNano() == entry.ModTime
+}
+
+// reflinker clones the files of a copy copy-on-write if the filesystems support it, the first clone failed
+// for lack of support turns it off for the rest of the copy. A nil reflinker never clones.
+type reflinker struct {
+	disabled bool
+}
+
+// clone reports whether the content of in is cloned into out, out is untouched if it's not
+func (r *reflinker) clone(out, in *os.File) bool {
+	if r == nil || r.disabled {
+		return false
+	}
+	err := reflink(out, in)
+	if err != nil && reflinkUnsupported(err) {
+		r.disabled = true
+	}
+	return err == nil
+}
+
+// copyFile copies the regular file, the content is also written to w, e.g. to compute the checksum,
+// unless it's cloned by the reflinker, which is reported by cloned.
+func copyFile(ctx context.Context, src, dest string, info fs.FileInfo, w io.Writer, rl *reflinker) (cloned bool, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, errors.Wrapf(err, "os.Open failed, path: %s", src)
+	}
+	defer in.Close()
+
+	_ = os.Remove(dest)
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return false, errors.Wrapf(err, "os.OpenFile failed, path: %s", dest)
+	}
+	cloned = rl.clone(out, in)
+	if !cloned {
+		if _, err = io.Copy(io.MultiWriter(out, w), ctxReader{ctx, in}); err != nil {
+			_ = out.Close()
+			return false, errors.Wrapf(err, "io.Copy failed, src: %s, dest: %s", src, dest)
+		}
+	}
+	if err = out.Close(); err != nil {
+		return cloned, errors.Wrapf(err, "close file failed, path: %s", dest)
+	}
+	return cloned, preserveAttributes(src, dest, info)
+}
+
+// preserveAttributes sets the mode, owner, extended attributes and modification time of the source on the copy
+func preserveAttributes(src, path string, info fs.FileInfo) error {
+	if err := preserveOwner(path, info); err != nil {
+		return err
+	}
+	// the extended attributes are set before chmod too, a security.capability is cleared by chown
+	if err := preserveXattrs(src, path); err != nil {
+		return err
+	}
+	// chmod after chown, because chown clears the setuid and setgid bits
+	if err := os.Chmod(path, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return errors.Wrapf(err, "os.Chmod failed, path: %s", path)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		return errors.Wrapf(err, "os.Chtimes failed, path: %s", path)
+	}
+	return nil
+}
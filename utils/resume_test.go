@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCopyDirResumable interrupts the copy at c.txt, whose destination is a directory that can't be replaced,
+// and retries it after the change
+func TestCopyDirResumable(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, src, dest string)
+		wantCopied  int
+		wantSkipped int
+	}{
+		{name: "unchanged", wantCopied: 1, wantSkipped: 2},
+		{
+			name: "source changed",
+			change: func(t *testing.T, src, _ string) {
+				path := filepath.Join(src, "a.txt")
+				if err := os.WriteFile(path, []byte("changed"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCopied:  2,
+			wantSkipped: 1,
+		},
+		{
+			name: "copy truncated",
+			change: func(t *testing.T, _, dest string) {
+				if err := os.Truncate(filepath.Join(dest, "b.txt"), 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCopied:  2,
+			wantSkipped: 1,
+		},
+		{
+			name: "copy removed",
+			change: func(t *testing.T, _, dest string) {
+				if err := os.Remove(filepath.Join(dest, "a.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCopied:  2,
+			wantSkipped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+			files := map[string]string{"a.txt": "foo", "b.txt": "bar", "c.txt": "baz"}
+			if err := os.MkdirAll(src, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range files {
+				if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			blocker := filepath.Join(dest, "c.txt", "blocker")
+			if err := os.MkdirAll(blocker, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := CopyDirResumable(src, dest, new(CopyProgress))
+			if err == nil {
+				t.Fatal("CopyDirResumable() error = nil, want the copy interrupted at c.txt")
+			}
+			if stats.Copied != 2 {
+				t.Fatalf("CopyDirResumable() copied = %d before the interruption, want 2", stats.Copied)
+			}
+			if _, err = os.Stat(filepath.Join(dest, CopyManifestName)); err != nil {
+				t.Fatalf("manifest after the interruption error = %v", err)
+			}
+
+			if err = os.RemoveAll(filepath.Join(dest, "c.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(t, src, dest)
+				content, _ := os.ReadFile(filepath.Join(src, "a.txt"))
+				files["a.txt"] = string(content)
+			}
+			progress := new(CopyProgress)
+			stats, err = CopyDirResumable(src, dest, progress)
+			if err != nil {
+				t.Fatalf("CopyDirResumable() retry error = %v", err)
+			}
+			if stats.Copied != tt.wantCopied || stats.Skipped != tt.wantSkipped {
+				t.Errorf("CopyDirResumable() retry copied = %d, skipped = %d, want %d, %d",
+					stats.Copied, stats.Skipped, tt.wantCopied, tt.wantSkipped)
+			}
+			for name, content := range files {
+				if got, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(got) != content {
+					t.Errorf("copy of %s = %q, %v, want %q", name, got, err, content)
+				}
+			}
+			if _, err = os.Stat(filepath.Join(dest, CopyManifestName)); !os.IsNotExist(err) {
+				t.Errorf("manifest after the retry error = %v, want removed", err)
+			}
+			if copied, total := progress.Bytes(); copied != total {
+				t.Errorf("progress of the retry = %d/%d, want all", copied, total)
+			}
+		})
+	}
+}
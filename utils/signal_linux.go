@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SignalProcess sends the signal to the process through a pidfd, check is called after the pidfd is opened,
+// so the pid checked can't be reused by another process before the signal is sent
+func SignalProcess(pid int, signal syscall.Signal, check func() error) error {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return errors.Wrapf(err, "unix.PidfdOpen failed, pid: %d", pid)
+	}
+	defer unix.Close(fd)
+
+	if err = check(); err != nil {
+		return err
+	}
+	if err = unix.PidfdSendSignal(fd, signal, nil, 0); err != nil {
+		return errors.Wrapf(err, "unix.PidfdSendSignal failed, pid: %d, signal: %d", pid, signal)
+	}
+	return nil
+}
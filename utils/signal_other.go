@@ -0,0 +1,14 @@
+//go:build !linux
+
+package utils
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SignalProcess is not supported, the pid may be reused without a pidfd
+func SignalProcess(int, syscall.Signal, func() error) error {
+	return errors.New("signaling a process is only supported on linux")
+}
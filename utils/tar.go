@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TarTree writes the contents of src to w as a tar archive, the paths are relative to src,
+// the mode, owner, modification time, symlinks, fifos and devices are kept, it fails on a socket. The files are streamed one by one,
+// so the memory used doesn't depend on the size of the tree. It stops between files and chunks when the ctx is done.
+func TarTree(ctx context.Context, src string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return errors.Wrapf(err, "os.Readlink failed, path: %s", path)
+			}
+		case info.Mode()&fs.ModeSocket != 0:
+			// tar has no type of socket
+			return errors.Errorf("socket: %s can't be archived", path)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "tar.FileInfoHeader failed, path: %s", path)
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "tar.WriteHeader failed, path: %s", path)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "os.Open failed, path: %s", path)
+		}
+		defer f.Close()
+		// the file may be truncated by a running container, the header has promised the size
+		if _, err = io.CopyN(tw, ctxReader{ctx, f}, hdr.Size); err != nil {
+			return errors.Wrapf(err, "io.CopyN failed, path: %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "filepath.WalkDir failed, src: %s", src)
+	}
+	return errors.Wrap(tw.Close(), "tar.Close failed")
+}
+
+// UntarTree extracts the tar archive read from r into dest, the entries escaping dest,
+// directly or through a symlink extracted before, are rejected. The owners are kept if it runs as root,
+// the devices are created only with CAP_MKNOD, the extraction fails otherwise.
+func UntarTree(ctx context.Context, r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	// the modification time of a directory changes when its entries are created, and a read-only directory
+	// can't be filled, so they are set at last
+	dirs := make(map[string]*tar.Header)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar.Next failed")
+		}
+
+		target, err := extractPath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(hdr.Mode).Perm()
+		// the archives written by other tools may have no entries of the parents
+		if hdr.Typeflag != tar.TypeDir {
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.Wrapf(err, "os.MkdirAll failed, path: %s", filepath.Dir(target))
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// a symlink in the place of the directory would be followed
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				_ = os.RemoveAll(target)
+			}
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return errors.Wrapf(err, "os.MkdirAll failed, path: %s", target)
+			}
+			dirs[target] = hdr
+		case tar.TypeReg:
+			_ = os.RemoveAll(target)
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return errors.Wrapf(err, "os.OpenFile failed, path: %s", target)
+			}
+			_, err = io.Copy(f, ctxReader{ctx, tr})
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return errors.Wrapf(err, "io.Copy failed, path: %s", target)
+			}
+		case tar.TypeSymlink:
+			_ = os.RemoveAll(target)
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return errors.Wrapf(err, "os.Symlink failed, path: %s", target)
+			}
+		case tar.TypeLink:
+			source, err := extractPath(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			_ = os.RemoveAll(target)
+			if err = os.Link(source, target); err != nil {
+				return errors.Wrapf(err, "os.Link failed, path: %s", target)
+			}
+		case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+			_ = os.RemoveAll(target)
+			if err = mknodEntry(target, hdr); err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("tar entry: %s of type: %q is not supported", hdr.Name, hdr.Typeflag)
+		}
+
+		_ = os.Lchown(target, hdr.Uid, hdr.Gid)
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeSymlink {
+			_ = os.Chmod(target, mode)
+			if err = os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return errors.Wrapf(err, "os.Chtimes failed, path: %s", target)
+			}
+		}
+	}
+
+	for dir, hdr := range dirs {
+		_ = os.Chmod(dir, fs.FileMode(hdr.Mode).Perm())
+		if err := os.Chtimes(dir, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.Wrapf(err, "os.Chtimes failed, path: %s", dir)
+		}
+	}
+	return nil
+}
+
+// extractPath returns the path of the entry under dest, it fails if the entry or any of its parents
+// resolves outside dest, e.g. ../etc/passwd or a file under a symlink to /
+func extractPath(dest, name string) (string, error) {
+	rel := filepath.FromSlash(strings.TrimPrefix(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return "", errors.Errorf("tar entry: %s escapes the destination", name)
+	}
+	target := filepath.Join(dest, rel)
+	for parent := filepath.Dir(target); len(parent) > len(dest); parent = filepath.Dir(parent) {
+		info, err := os.Lstat(parent)
+		if err != nil {
+			// the missing parents are created as directories
+			continue
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", errors.Errorf("tar entry: %s is under the symlink: %s", name, parent)
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// treeChecksums returns the sha256 of the regular files and the targets of the symlinks of the tree by relative path
+func treeChecksums(t *testing.T, root string) map[string]string {
+	t.Helper()
+	sums := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			sums[rel] = "-> " + link
+			return err
+		case d.Type().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			h := sha256.New()
+			if _, err = io.Copy(h, f); err != nil {
+				return err
+			}
+			sums[rel] = hex.EncodeToString(h.Sum(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sums
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		links map[string]string
+	}{
+		{name: "empty"},
+		{name: "files", files: map[string]string{"a.txt": "foo", "b.bin": string(bytes.Repeat([]byte{0, 1, 2}, 100000))}},
+		{name: "nested", files: map[string]string{"a/b/c.txt": "foo", "a/d.txt": "bar", "e/f/g/h.txt": ""}},
+		{name: "spaces", files: map[string]string{"my dir/my file.txt": "foo"}},
+		{name: "symlinks", files: map[string]string{"data/a.txt": "foo"},
+			links: map[string]string{"relative": "data/a.txt", "dangling": "/not/exist"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// the mountpoint of the new volume exists before the import
+			src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+			for _, path := range []string{src, dest} {
+				if err := os.MkdirAll(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range tt.files {
+				path := filepath.Join(src, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, link := range tt.links {
+				if err := os.Symlink(link, filepath.Join(src, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var archive bytes.Buffer
+			if err := TarTree(context.Background(), src, &archive); err != nil {
+				t.Fatalf("TarTree() error = %v", err)
+			}
+			if err := UntarTree(context.Background(), &archive, dest); err != nil {
+				t.Fatalf("UntarTree() error = %v", err)
+			}
+			if got, want := treeChecksums(t, dest), treeChecksums(t, src); !reflect.DeepEqual(got, want) {
+				t.Errorf("checksums after the round trip = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUntarTreeEscape(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		wantErr bool
+	}{
+		{name: "inside", headers: []*tar.Header{{Name: "a/b.txt", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{name: "absolute is relative to dest", headers: []*tar.Header{{Name: "/a.txt", Typeflag: tar.TypeReg, Mode: 0644}}},
+		{name: "parent", headers: []*tar.Header{{Name: "../a.txt", Typeflag: tar.TypeReg, Mode: 0644}}, wantErr: true},
+		{name: "through a symlink", headers: []*tar.Header{
+			{Name: "root", Typeflag: tar.TypeSymlink, Linkname: "/"},
+			{Name: "root/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		}, wantErr: true},
+		{name: "hard link outside", headers: []*tar.Header{{Name: "a", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+			wantErr: true},
+		{name: "unsupported type", headers: []*tar.Header{{Name: "a", Typeflag: 'Z'}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			tw := tar.NewWriter(&archive)
+			for _, hdr := range tt.headers {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			err := UntarTree(context.Background(), &archive, filepath.Join(t.TempDir(), "dest"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UntarTree() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
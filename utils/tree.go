@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// CopyTree copies the contents of src into dest natively, preserving the mode, owner, modification time,
+// extended attributes and symlinks, the existing files in dest are overwritten, or cloned by reflink if supported.
+// It stops between files and between the chunks of a file when the ctx is done.
+// The fifos, sockets and devices are recreated, the copy fails if they can't be, e.g. a device without CAP_MKNOD.
+// The stats count the regular files copied and the part of them cloned, even if the copy failed halfway.
+func CopyTree(ctx context.Context, src, dest string, progress *CopyProgress) (stats CopyStats, err error) {
+	progress.Start(treeSize(src))
+
+	// the modification time of a directory changes when its entries are created, so set them at last
+	var dirs []string
+	rl := new(reflinker)
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			if err = os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "os.MkdirAll failed, path: %s", target)
+			}
+			if err = preserveAttributes(path, target, info); err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return errors.Wrapf(err, "os.Readlink failed, path: %s", path)
+			}
+			_ = os.RemoveAll(target)
+			if err = os.Symlink(link, target); err != nil {
+				return errors.Wrapf(err, "os.Symlink failed, path: %s", target)
+			}
+			_ = preserveOwner(target, info)
+		case info.Mode().IsRegular():
+			cloned, err := copyFile(ctx, path, target, info, progressWriter{progress}, rl)
+			if err != nil {
+				return err
+			}
+			stats.Copied++
+			if cloned {
+				stats.Cloned++
+				progress.Add(info.Size())
+			}
+		default:
+			// the fifos, sockets and devices are recreated, it fails if they can't be
+			_ = os.RemoveAll(target)
+			if err = mknod(target, info); err != nil {
+				return err
+			}
+			if err = preserveAttributes(path, target, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, errors.Wrapf(err, "filepath.WalkDir failed, src: %s, dest: %s", src, dest)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return stats, errors.Wrapf(err, "os.Lstat failed, path: %s", dirs[i])
+		}
+		target := filepath.Join(dest, dirs[i])
+		if err = os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return stats, errors.Wrapf(err, "os.Chtimes failed, path: %s", target)
+		}
+	}
+	return stats, nil
+}
+
+// ctxReader stops reading when the ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// reflinkSupported reports whether the filesystem of dir clones the files by reflink
+func reflinkSupported(t *testing.T, dir string) bool {
+	t.Helper()
+	src := filepath.Join(dir, ".reflink-src")
+	if err := os.WriteFile(src, []byte("reflink"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src)
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, ".reflink-dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	return reflink(out, in) == nil
+}
+
+func TestCopyDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		withCp     bool
+		reflink    bool
+		wantCopied int
+	}{
+		{name: "native", wantCopied: 2},
+		{name: "native cloned by reflink", reflink: true, wantCopied: 2},
+		{name: "cp", withCp: true},
+		{name: "cp cloned by reflink", withCp: true, reflink: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.reflink && !reflinkSupported(t, dir) {
+				t.Skipf("reflink is not supported by the filesystem of %s", dir)
+			}
+			if tt.withCp {
+				if _, err := exec.LookPath("cp"); err != nil {
+					t.Skip("cp is not found")
+				}
+				SetCopyWithCp(true)
+				defer SetCopyWithCp(false)
+			}
+
+			src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest dir")
+			files := map[string]string{"a.bin": "foo", "sub/b.bin": "bar"}
+			for name, content := range files {
+				path := filepath.Join(src, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			progress := new(CopyProgress)
+			stats, err := CopyDir(context.Background(), src, dest, progress)
+			if err != nil {
+				t.Fatalf("CopyDir() error = %v", err)
+			}
+			for name, content := range files {
+				got, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil || string(got) != content {
+					t.Errorf("copy of %s = %q, %v, want %q", name, got, err, content)
+				}
+			}
+			if stats.Copied != tt.wantCopied {
+				t.Errorf("CopyDir() copied = %d, want %d", stats.Copied, tt.wantCopied)
+			}
+			if tt.reflink && !tt.withCp && stats.Cloned != stats.Copied {
+				t.Errorf("CopyDir() cloned = %d, want %d", stats.Cloned, stats.Copied)
+			}
+			if !tt.reflink && !reflinkSupported(t, dir) && stats.Cloned != 0 {
+				t.Errorf("CopyDir() cloned = %d on a filesystem without reflink", stats.Cloned)
+			}
+			if copied, total := progress.Bytes(); copied != total {
+				t.Errorf("CopyDir() progress = %d/%d, want all", copied, total)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+//go:build !windows
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// treeEntry is a file of the tree, a fifo if fifo is set, a symlink if link is set, a directory if the name ends with /
+type treeEntry struct {
+	name    string
+	content string
+	link    string
+	fifo    bool
+	mode    os.FileMode
+}
+
+func makeTree(t *testing.T, root string, entries []treeEntry) {
+	t.Helper()
+	for _, e := range entries {
+		path := filepath.Join(root, e.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			err = os.MkdirAll(path, e.mode)
+		case len(e.link) != 0:
+			err = os.Symlink(e.link, path)
+		case e.fifo:
+			err = unix.Mkfifo(path, uint32(e.mode))
+		default:
+			err = os.WriteFile(path, []byte(e.content), e.mode)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.link) == 0 {
+			if err = os.Chmod(path, e.mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func checkTree(t *testing.T, root string, entries []treeEntry) {
+	t.Helper()
+	for _, e := range entries {
+		path := filepath.Join(root, e.name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("os.Lstat(%s) error = %v", e.name, err)
+			continue
+		}
+		switch {
+		case len(e.link) != 0:
+			if link, err := os.Readlink(path); err != nil || link != e.link {
+				t.Errorf("link of %s = %q, %v, want %q", e.name, link, err, e.link)
+			}
+			continue
+		case e.fifo:
+			if info.Mode()&os.ModeNamedPipe == 0 {
+				t.Errorf("mode of %s = %s, want a fifo", e.name, info.Mode())
+			}
+		case !strings.HasSuffix(e.name, "/"):
+			if got, err := os.ReadFile(path); err != nil || string(got) != e.content {
+				t.Errorf("content of %s = %q, %v, want %q", e.name, got, err, e.content)
+			}
+		}
+		if info.Mode().Perm() != e.mode {
+			t.Errorf("permission of %s = %s, want %s", e.name, info.Mode().Perm(), e.mode)
+		}
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []treeEntry
+	}{
+		{name: "nested dirs", entries: []treeEntry{
+			{name: "a/b/c/d.txt", content: "foo", mode: 0644},
+			{name: "a/b/", mode: 0750},
+		}},
+		{name: "permissions", entries: []treeEntry{
+			{name: "private.key", content: "secret", mode: 0600},
+			{name: "run.sh", content: "#!/bin/sh", mode: 0755},
+			{name: "read-only/", mode: 0555},
+		}},
+		{name: "symlinks", entries: []treeEntry{
+			{name: "data.bin", content: "bar", mode: 0644},
+			{name: "relative", link: "data.bin"},
+			{name: "dangling", link: "/not/exist"},
+			{name: "sub/up", link: "../data.bin"},
+		}},
+		{name: "fifo", entries: []treeEntry{
+			{name: "pipe", fifo: true, mode: 0640},
+			{name: "sub/pipe", fifo: true, mode: 0600},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+			makeTree(t, src, tt.entries)
+			if _, err := CopyTree(context.Background(), src, dest, new(CopyProgress)); err != nil {
+				t.Fatalf("CopyTree() error = %v", err)
+			}
+			checkTree(t, dest, tt.entries)
+		})
+	}
+}
+
+func TestCopyTreeDevice(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the same device as /dev/null
+	if err := unix.Mknod(filepath.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Skipf("unix.Mknod() error = %v, CAP_MKNOD is required", err)
+	}
+	if _, err := CopyTree(context.Background(), src, dest, new(CopyProgress)); err != nil {
+		t.Fatalf("CopyTree() error = %v", err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Lstat(filepath.Join(dest, "null"), &stat); err != nil {
+		t.Fatalf("unix.Lstat() error = %v", err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFCHR || uint64(stat.Rdev) != unix.Mkdev(1, 3) {
+		t.Errorf("copy of the device mode = %o, rdev = %d, want a character device %d", stat.Mode, stat.Rdev, unix.Mkdev(1, 3))
+	}
+}
+
+func TestCopyTreeCanceled(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	makeTree(t, src, []treeEntry{{name: "a.txt", content: "foo", mode: 0644}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := CopyTree(ctx, src, filepath.Join(dir, "dest"), new(CopyProgress)); !errors.Is(err, context.Canceled) {
+		t.Errorf("CopyTree() error = %v, want canceled", err)
+	}
+}
+
+func TestTarSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	makeTree(t, src, []treeEntry{{name: "pipe", fifo: true, mode: 0640}, {name: "a.txt", content: "foo", mode: 0600}})
+	var archive bytes.Buffer
+	if err := TarTree(context.Background(), src, &archive); err != nil {
+		t.Fatalf("TarTree() error = %v", err)
+	}
+	if err := UntarTree(context.Background(), &archive, dest); err != nil {
+		t.Fatalf("UntarTree() error = %v", err)
+	}
+	checkTree(t, dest, []treeEntry{{name: "pipe", fifo: true, mode: 0640}, {name: "a.txt", content: "foo", mode: 0600}})
+
+	// a socket has no tar type, the export fails instead of dropping it
+	l, err := net.Listen("unix", filepath.Join(src, "sock"))
+	if err != nil {
+		t.Skipf("net.Listen() error = %v", err)
+	}
+	defer l.Close()
+	if err = TarTree(context.Background(), src, io.Discard); err == nil {
+		t.Error("TarTree() of a socket error = nil, want an error")
+	}
+}